@@ -3,11 +3,11 @@ package main
 import (
     "flag"
 	"context"
-	"database/sql"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -19,6 +19,14 @@ import (
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/auth-service/internal/biz"
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/auth-service/internal/data"
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/auth-service/internal/server"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/buildinfo"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/database"
+)
+
+// Version and Commit are set at build time with -ldflags "-X main.Version=... -X main.Commit=..."
+var (
+	Version = "dev"
+	Commit  = "unknown"
 )
 
 func main() {
@@ -49,7 +57,11 @@ func main() {
         }
     }
     log.Printf("Using database source: %s", dbSource)
-    db, err := sql.Open("postgres", dbSource)
+	poolConfig := database.DefaultPoolConfig()
+	poolConfig.MaxOpenConns = getEnvInt("DB_MAX_OPEN_CONNS", poolConfig.MaxOpenConns)
+	poolConfig.MaxIdleConns = getEnvInt("DB_MAX_IDLE_CONNS", poolConfig.MaxIdleConns)
+	poolConfig.ConnMaxLifetime = getEnvDuration("DB_CONN_MAX_LIFETIME", poolConfig.ConnMaxLifetime)
+	db, err := database.Open("postgres", dbSource, poolConfig)
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
@@ -59,21 +71,71 @@ func main() {
 	authRepo := data.NewAuthRepo(db)
 
 	// Use case
-    jwtSecret := getEnv("JWT_SECRET", "your-secret-key-change-this-in-production")
-	tokenTTL := 24 * time.Hour
+	jwtConfig := biz.JWTConfig{
+		Secret:   getEnv("JWT_SECRET", "your-secret-key-change-this-in-production"),
+		TokenTTL: getEnvDuration("JWT_TOKEN_TTL", 24*time.Hour),
+		Issuer:   getEnv("JWT_ISSUER", "orbit-auth-service"),
+		Audience: getEnv("JWT_AUDIENCE", "orbit-chat"),
+
+		MQTTTokenTTL: getEnvDuration("MQTT_TOKEN_TTL", 15*time.Minute),
+
+		RefreshTokenTTL: getEnvDuration("REFRESH_TOKEN_TTL", biz.DefaultRefreshTokenTTL),
+		SessionMaxAge:   getEnvDuration("SESSION_MAX_AGE", biz.DefaultSessionMaxAge),
+	}
+	passwordConfig := biz.PasswordConfig{
+		Scheme: biz.PasswordScheme(getEnv("PASSWORD_HASH_SCHEME", string(biz.PasswordSchemeBcrypt))),
+		// 0 uses bcrypt's default cost
+		BcryptCost: getEnvInt("BCRYPT_COST", 0),
+		// 0 uses the Argon2id defaults
+		Argon2: biz.Argon2Params{
+			MemoryKiB:   uint32(getEnvInt("ARGON2_MEMORY_KIB", 0)),
+			Iterations:  uint32(getEnvInt("ARGON2_ITERATIONS", 0)),
+			Parallelism: uint8(getEnvInt("ARGON2_PARALLELISM", 0)),
+		},
+	}
 	keycloakConfig := biz.KeycloakConfig{
         URL:          getEnv("KEYCLOAK_URL", "http://localhost:8080"),
         Realm:        getEnv("KEYCLOAK_REALM", "orbit-chat"),
         ClientID:     getEnv("KEYCLOAK_CLIENT_ID", "orbit-chat-client"),
         ClientSecret: getEnv("KEYCLOAK_CLIENT_SECRET", "your-client-secret"),
+		RoleMapping:  biz.ParseRoleMapping(getEnv("KEYCLOAK_ROLE_MAPPING", "")),
+
+		AccountLinking: biz.AccountLinkingMode(getEnv("KEYCLOAK_ACCOUNT_LINKING", string(biz.AccountLinkingConfirm))),
+	}
+	totpConfig := biz.TOTPConfig{
+		Issuer:        getEnv("TOTP_ISSUER", "Orbit Messenger"),
+		EncryptionKey: getEnv("TOTP_ENCRYPTION_KEY", ""),
 	}
-	authUc, err := biz.NewAuthUsecase(authRepo, jwtSecret, tokenTTL, keycloakConfig)
+	presenceClient := data.NewPresenceClient(getEnv("PRESENCE_SERVICE_URL", "http://localhost:8002"))
+	platformConfig := biz.PlatformConfig{
+		SuperAdminUserIDs: biz.ParseSuperAdmins(getEnv("SUPER_ADMIN_USER_IDS", "")),
+	}
+	authUc, err := biz.NewAuthUsecase(authRepo, presenceClient, jwtConfig, passwordConfig, keycloakConfig, totpConfig, platformConfig)
 	if err != nil {
 		log.Fatal("Failed to create auth usecase:", err)
 	}
 
+	// Reported by GET /info
+	info := buildinfo.New("auth-service", Version, Commit)
+	info.Register("keycloak", func() string {
+		if authUc.OIDCAvailable() {
+			return buildinfo.StatusUp
+		}
+		return buildinfo.StatusUnavailable
+	})
+
 	// HTTP server
-	httpServer := server.NewHTTPServer(authUc)
+	brokerSecret := getEnv("MQTT_ACL_SECRET", "")
+	if brokerSecret == "" {
+		log.Println("MQTT_ACL_SECRET is not set, the MQTT broker auth and ACL endpoints will deny every request")
+	}
+	// Only these proxies' X-Forwarded-For is believed for the session IP
+	trustedProxies := server.ParseTrustedProxies(getEnv("TRUSTED_PROXIES", ""))
+	internalSecret := getEnv("INTERNAL_API_SECRET", "")
+	if internalSecret == "" {
+		log.Println("INTERNAL_API_SECRET is not set, the internal routes will deny every request")
+	}
+	httpServer := server.NewHTTPServer(authUc, info, brokerSecret, internalSecret, trustedProxies)
 
 	// Start server
     listenAddr := ":" + getEnv("PORT", "")
@@ -93,6 +155,18 @@ func main() {
 		}
 	}()
 
+	// Service-to-service routes get their own listener, kept off the public network
+	internalSrv := &http.Server{
+		Addr:    ":" + getEnv("INTERNAL_PORT", "8100"),
+		Handler: httpServer.InternalHandler(),
+	}
+	go func() {
+		log.Printf("Auth service internal routes on port %s", getEnv("INTERNAL_PORT", "8100"))
+		if err := internalSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Failed to start internal server:", err)
+		}
+	}()
+
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -105,6 +179,9 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatal("Server forced to shutdown:", err)
 	}
+	if err := internalSrv.Shutdown(ctx); err != nil {
+		log.Printf("Internal server forced to shutdown: %v", err)
+	}
 
 	log.Println("Server exited")
 }
@@ -115,3 +192,23 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+		log.Printf("Invalid value for %s: %q, using default %d", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+		log.Printf("Invalid value for %s: %q, using default %s", key, value, defaultValue)
+	}
+	return defaultValue
+}
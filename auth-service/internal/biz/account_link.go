@@ -0,0 +1,148 @@
+package biz
+
+import (
+	"github.com/google/uuid"
+
+	"context"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// AccountLinkingMode controls what happens when an OIDC login matches an existing
+// password account by email
+type AccountLinkingMode string
+
+const (
+	// AccountLinkingAuto links immediately when Keycloak reports the email as verified
+	AccountLinkingAuto AccountLinkingMode = "auto"
+	// AccountLinkingConfirm requires the user to prove ownership with their local password
+	AccountLinkingConfirm AccountLinkingMode = "confirm"
+)
+
+// linkAudience is the aud claim of link tokens so they can't be used anywhere else
+const linkAudience = "oidc-link"
+
+var ErrAccountLinkRequired = errors.New("account exists, confirm with local password to link")
+
+// AccountLinkRequiredError is returned by OIDCLogin when a local account with the
+// same email exists and must be confirmed before the Keycloak identity is linked.
+// LinkToken is passed back to LinkOIDCAccount together with the local password.
+type AccountLinkRequiredError struct {
+	LinkToken string
+	ExpiresAt time.Time
+}
+
+func (e *AccountLinkRequiredError) Error() string {
+	return ErrAccountLinkRequired.Error()
+}
+
+func (e *AccountLinkRequiredError) Is(target error) bool {
+	return target == ErrAccountLinkRequired
+}
+
+type LinkOIDCAccountRequest struct {
+	LinkToken string `json:"link_token" validate:"required"`
+	Password  string `json:"password" validate:"required"`
+	// TOTPCode or RecoveryCode is required when the local account has two-factor
+	// authentication, so linking can't be used to get around it
+	TOTPCode     string `json:"totp_code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+type oidcLinkClaims struct {
+	UserID      uuid.UUID `json:"user_id"`
+	KeycloakID  string    `json:"keycloak_id"`
+	Email       string    `json:"email"`
+	DisplayName string    `json:"display_name"`
+	Role        UserRole  `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// linkExistingAccount handles an OIDC login whose email matches a local account
+// that has no Keycloak identity yet
+func (uc *AuthUsecase) linkExistingAccount(ctx context.Context, user *User, keycloakID, email, displayName string, role UserRole, emailVerified bool) error {
+	if user.KeycloakID != "" {
+		// Already bound to a different Keycloak identity
+		return ErrUserExists
+	}
+
+	if uc.keycloakConfig.AccountLinking == AccountLinkingAuto && emailVerified {
+		if err := uc.repo.SetKeycloakID(ctx, user.ID, keycloakID); err != nil {
+			return err
+		}
+		user.KeycloakID = keycloakID
+		return uc.syncOIDCUser(ctx, user, email, displayName, role)
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(10 * time.Minute)
+	claims := oidcLinkClaims{
+		UserID:      user.ID,
+		KeycloakID:  keycloakID,
+		Email:       email,
+		DisplayName: displayName,
+		Role:        role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    uc.jwtIssuer,
+			Audience:  jwt.ClaimStrings{linkAudience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	linkToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(uc.jwtSecret))
+	if err != nil {
+		return err
+	}
+
+	return &AccountLinkRequiredError{LinkToken: linkToken, ExpiresAt: expiresAt}
+}
+
+// LinkOIDCAccount completes a confirmed account link. The caller must know the local
+// account's password, so an attacker controlling a Keycloak account with someone
+// else's email can't take over their account.
+func (uc *AuthUsecase) LinkOIDCAccount(ctx context.Context, req *LinkOIDCAccountRequest, client ClientInfo) (*User, *SessionTokens, error) {
+	claims := &oidcLinkClaims{}
+	_, err := jwt.ParseWithClaims(req.LinkToken, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(uc.jwtSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(linkAudience))
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	user, err := uc.repo.GetUserByID(ctx, claims.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.KeycloakID != "" {
+		return nil, nil, ErrUserExists
+	}
+
+	if err := checkPassword(user.PasswordHash, req.Password); err != nil {
+		return nil, nil, err
+	}
+	if err := uc.checkSecondFactor(ctx, user, req.TOTPCode, req.RecoveryCode); err != nil {
+		return nil, nil, err
+	}
+
+	if err := uc.repo.SetKeycloakID(ctx, user.ID, claims.KeycloakID); err != nil {
+		return nil, nil, err
+	}
+	user.KeycloakID = claims.KeycloakID
+
+	if err := uc.syncOIDCUser(ctx, user, claims.Email, claims.DisplayName, claims.Role); err != nil {
+		return nil, nil, err
+	}
+
+	uc.repo.UpdateLastSeen(ctx, user.ID)
+
+	tokens, err := uc.startSession(ctx, user, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user.PasswordHash = "" // Don't return password hash
+	return user, tokens, nil
+}
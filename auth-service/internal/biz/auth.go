@@ -12,6 +12,8 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/audit"
 )
 
 var (
@@ -19,8 +21,41 @@ var (
 	ErrInvalidPassword = errors.New("invalid password")
 	ErrUserExists      = errors.New("user already exists")
 	ErrInvalidToken    = errors.New("invalid token")
+
+	ErrOrganizationNotFound   = errors.New("organization not found")
+	ErrAmbiguousOrganization  = errors.New("email exists in multiple organizations")
+	ErrIncompleteOIDCUserInfo = errors.New("keycloak user info is missing subject or email")
+	ErrNoOIDCSession          = errors.New("no keycloak session for user")
+
+	ErrInsufficientPermissions = errors.New("insufficient permissions")
+	ErrCannotResetOwnPassword  = errors.New("cannot reset your own password")
+	ErrPasswordTooShort        = errors.New("password must be at least 6 characters")
+	ErrLastAdmin               = errors.New("cannot reset the password of the organization's last admin")
+	// ErrPasswordChangeRequired is returned for a restricted token, which is only
+	// good for changing the password
+	ErrPasswordChangeRequired = errors.New("password change required")
 )
 
+// AmbiguousOrganizationError is returned when a login without an organization
+// matches accounts in more than one organization. It lists the candidates so the
+// client can retry with X-Organization-ID.
+type AmbiguousOrganizationError struct {
+	Candidates []*OrganizationCandidate
+}
+
+type OrganizationCandidate struct {
+	ID   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+}
+
+func (e *AmbiguousOrganizationError) Error() string {
+	return ErrAmbiguousOrganization.Error()
+}
+
+func (e *AmbiguousOrganizationError) Is(target error) bool {
+	return target == ErrAmbiguousOrganization
+}
+
 type UserRole string
 
 const (
@@ -29,7 +64,7 @@ const (
 )
 
 type User struct {
-	ID             int                    `json:"id"`
+	ID             uuid.UUID              `json:"id"`
 	OrganizationID uuid.UUID              `json:"organization_id"`
 	Email          string                 `json:"email"`
 	DisplayName    string                 `json:"display_name"`
@@ -40,6 +75,12 @@ type User struct {
 	LastSeenAt     *time.Time             `json:"last_seen_at,omitempty"`
 	PasswordHash   string                 `json:"-"`
 	KeycloakID     string                 `json:"-"`
+
+	// MustChangePassword is set after an admin reset until the user picks a new password
+	MustChangePassword bool `json:"must_change_password,omitempty"`
+
+	// Status is the presence status, only filled in when presence is requested
+	Status string `json:"status,omitempty"`
 }
 
 type Organization struct {
@@ -52,6 +93,9 @@ type Organization struct {
 type LoginRequest struct {
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required,min=6"`
+	// TOTPCode or RecoveryCode is required for accounts with two-factor authentication
+	TOTPCode     string `json:"totp_code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
 }
 
 type RegisterRequest struct {
@@ -63,25 +107,98 @@ type RegisterRequest struct {
 }
 
 type JWTClaims struct {
-	UserID         int    `json:"user_id"`
-	OrganizationID string `json:"organization_id"`
-	Email          string `json:"email"`
-	Role           string `json:"role"`
-	KeycloakID     string `json:"keycloak_id,omitempty"`
+	UserID         uuid.UUID `json:"user_id"`
+	OrganizationID string    `json:"organization_id"`
+	Email          string    `json:"email"`
+	Role           string    `json:"role"`
+	KeycloakID     string    `json:"keycloak_id,omitempty"`
+	// SessionID ties the token to a session the user can revoke; tokens issued
+	// before sessions were tracked don't have one
+	SessionID string `json:"sid,omitempty"`
+	// Scope restricts what the token is good for; unrestricted tokens have none
+	Scope string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// TokenScopePasswordChange restricts the tokens of a user who must change their
+// password after an admin reset to changing it. Refreshing the session once the
+// password is changed issues an unrestricted token.
+const TokenScopePasswordChange = "password_change"
+
+// MQTTAudience is the aud claim of broker credentials. Tokens with it are only
+// accepted by the MQTT broker, never by the HTTP APIs.
+const MQTTAudience = "mqtt"
+
+// MQTTACL lists the topic filters a client may publish and subscribe to, in the
+// shape broker JWT ACL plugins expect
+type MQTTACL struct {
+	Pub []string `json:"pub"`
+	Sub []string `json:"sub"`
+}
+
+type MQTTClaims struct {
+	UserID         uuid.UUID `json:"user_id"`
+	OrganizationID string    `json:"organization_id"`
+	ACL            MQTTACL   `json:"acl"`
 	jwt.RegisteredClaims
 }
 
+type MQTTCredentials struct {
+	Username  string    `json:"username"`
+	Password  string    `json:"password"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Topics    MQTTACL   `json:"topics"`
+}
+
 type OIDCLoginRequest struct {
 	Code        string `json:"code" validate:"required"`
 	RedirectURI string `json:"redirect_uri" validate:"required"`
 	ClientID    string `json:"client_id" validate:"required"`
 }
 
+// JWTConfig controls how access tokens are signed and which iss/aud they carry
+type JWTConfig struct {
+	Secret   string        `yaml:"secret"`
+	TokenTTL time.Duration `yaml:"token_ttl"`
+	Issuer   string        `yaml:"issuer"`
+	Audience string        `yaml:"audience"`
+
+	// MQTTTokenTTL is how long broker credentials stay valid before they must be refreshed
+	MQTTTokenTTL time.Duration `yaml:"mqtt_token_ttl"`
+
+	// RefreshTokenTTL is how long a session may go unused and still be refreshed, and
+	// SessionMaxAge how long after login it may be refreshed at all. Zero values use
+	// DefaultRefreshTokenTTL and DefaultSessionMaxAge.
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl"`
+	SessionMaxAge   time.Duration `yaml:"session_max_age"`
+}
+
+// PasswordConfig controls how passwords are hashed. Stored hashes of either scheme
+// keep verifying; those made with another scheme or weaker parameters than configured
+// are upgraded on the next successful login.
+type PasswordConfig struct {
+	// Scheme is the algorithm new hashes use, bcrypt unless set to argon2id
+	Scheme PasswordScheme `yaml:"scheme"`
+	// BcryptCost is the cost new bcrypt hashes use. Out of range values fall back to
+	// bcrypt.DefaultCost.
+	BcryptCost int `yaml:"bcrypt_cost"`
+	// Argon2 holds the Argon2id costs; zero fields use DefaultArgon2Params
+	Argon2 Argon2Params `yaml:"argon2"`
+}
+
 type KeycloakConfig struct {
 	URL          string `yaml:"url"`
 	Realm        string `yaml:"realm"`
 	ClientID     string `yaml:"client_id"`
 	ClientSecret string `yaml:"client_secret"`
+
+	// AccountLinking decides how OIDC logins are linked to existing password
+	// accounts with the same email: "auto" or "confirm" (the default)
+	AccountLinking AccountLinkingMode `yaml:"account_linking"`
+
+	// RoleMapping maps Keycloak realm roles, client roles or group paths to
+	// application roles. Users matching none of them are members.
+	RoleMapping map[string]UserRole `yaml:"role_mapping"`
 }
 
 type UpdateUserRequest struct {
@@ -91,31 +208,123 @@ type UpdateUserRequest struct {
 	Profile     *map[string]interface{} `json:"profile,omitempty"`
 }
 
+// UserListFilter narrows and pages an organization's user list
+type UserListFilter struct {
+	// Role only returns users with this role when set
+	Role UserRole
+	// SeenSince only returns users active at or after it
+	SeenSince *time.Time
+	// Status only returns users with this presence status when set. Presence lives in
+	// presence-service, so the repo ignores it and the usecase filters instead.
+	Status string
+	// Limit of 0 returns every matching user
+	Limit  int
+	Offset int
+}
+
+// IsValid reports whether r is a known user role
+func (r UserRole) IsValid() bool {
+	return r == UserRoleAdmin || r == UserRoleMember
+}
+
 type AuthRepo interface {
 	CreateUser(ctx context.Context, user *User) error
 	GetUserByEmail(ctx context.Context, email string, orgID uuid.UUID) (*User, error)
-	GetUserByEmailAnyOrg(ctx context.Context, email string) (*User, error)
-	GetUserByID(ctx context.Context, id int) (*User, error)
+	GetUsersByEmailAnyOrg(ctx context.Context, email string) ([]*User, error)
+	GetUserByID(ctx context.Context, id uuid.UUID) (*User, error)
 	GetUserByKeycloakID(ctx context.Context, keycloakID string) (*User, error)
-	GetOrganizationUsers(ctx context.Context, orgID uuid.UUID) ([]*User, error)
-	UpdateUser(ctx context.Context, userID int, req *UpdateUserRequest) error
-	DeleteUser(ctx context.Context, userID int) error
-	UpdateLastSeen(ctx context.Context, userID int) error
+	// GetOrganizationUsers pages through an organization's users ordered by display name
+	GetOrganizationUsers(ctx context.Context, orgID uuid.UUID, filter UserListFilter) ([]*User, error)
+	CountOrganizationUsers(ctx context.Context, orgID uuid.UUID, filter UserListFilter) (int, error)
+	UpdateUser(ctx context.Context, userID uuid.UUID, req *UpdateUserRequest) error
+	DeleteUser(ctx context.Context, userID uuid.UUID) error
+	UpdateLastSeen(ctx context.Context, userID uuid.UUID) error
+	SetKeycloakID(ctx context.Context, userID uuid.UUID, keycloakID string) error
+	UpdatePasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error
+	SetPassword(ctx context.Context, userID uuid.UUID, passwordHash string, mustChange bool) error
+	RevokeTokens(ctx context.Context, userID uuid.UUID) error
+	// CountActiveAdmins counts the organization's admins without a pending password change
+	CountActiveAdmins(ctx context.Context, orgID uuid.UUID) (int, error)
+	// GetTokensRevokedAt returns when the user's tokens were last revoked, nil if never
+	GetTokensRevokedAt(ctx context.Context, userID uuid.UUID) (*time.Time, error)
+	CreateAuditEvent(ctx context.Context, event *AuditEvent) error
+	UpdateOIDCUser(ctx context.Context, userID uuid.UUID, email, displayName string, role UserRole) error
+	GetUserConversationIDs(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error)
+	GetConversationPeerIDs(ctx context.Context, userID uuid.UUID) ([]string, error)
+	// ConversationAccess and SharesConversation back the broker's topic ACL
+	ConversationAccess(ctx context.Context, conversationID, userID uuid.UUID) (participant, locked bool, err error)
+	SharesConversation(ctx context.Context, userID, peerID uuid.UUID) (bool, error)
+	GetKeycloakRefreshToken(ctx context.Context, userID uuid.UUID) (string, error)
+	// GetTOTP returns nil when the user has no two-factor setup, enabled or pending
+	GetTOTP(ctx context.Context, userID uuid.UUID) (*TOTPState, error)
+	// SetTOTPSecret stores a pending enrollment, replacing any earlier one
+	SetTOTPSecret(ctx context.Context, userID uuid.UUID, encryptedSecret string) error
+	// EnableTOTP activates the pending enrollment and replaces the recovery codes
+	EnableTOTP(ctx context.Context, userID uuid.UUID, recoveryCodeHashes []string) error
+	DisableTOTP(ctx context.Context, userID uuid.UUID) error
+	// RecordTOTPFailure counts a wrong two-factor code and returns how many there
+	// have been in a row; ResetTOTPFailures clears the count and any lock
+	RecordTOTPFailure(ctx context.Context, userID uuid.UUID) (int, error)
+	ResetTOTPFailures(ctx context.Context, userID uuid.UUID) error
+	// LockTOTP refuses two-factor sign-in until the given time
+	LockTOTP(ctx context.Context, userID uuid.UUID, until time.Time) error
+	// ClaimTOTPStep records a time step as used, returning false if it or a later one already was
+	ClaimTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error)
+	// UseRecoveryCode marks an unused recovery code used, returning false if there was none
+	UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error)
+	SetKeycloakRefreshToken(ctx context.Context, userID uuid.UUID, refreshToken string) error
+
+	CreateSession(ctx context.Context, session *Session) error
+	// IsSessionActive reports whether the session exists, hasn't been revoked and was
+	// started at or after createdSince
+	IsSessionActive(ctx context.Context, sessionID uuid.UUID, createdSince time.Time) (bool, error)
+	// TouchSession records the user's session as used now, returning
+	// ErrSessionNotFound if it isn't theirs or was revoked
+	TouchSession(ctx context.Context, sessionID uuid.UUID, userID uuid.UUID) error
+	// RotateRefreshToken replaces the session's refresh token, whose hash is
+	// presentedHash, with nextHash and records the session as used, returning the
+	// session's user. The session must be unrevoked, used at or after usedSince and
+	// started at or after createdSince, or ErrSessionNotFound is returned. Presenting
+	// the refresh token the current one replaced revokes the session and returns
+	// ErrRefreshTokenReused.
+	RotateRefreshToken(ctx context.Context, sessionID uuid.UUID, presentedHash, nextHash string, usedSince, createdSince time.Time) (uuid.UUID, error)
+	// GetActiveSessions returns unrevoked sessions last used at or after usedSince and
+	// started at or after createdSince
+	GetActiveSessions(ctx context.Context, userID uuid.UUID, usedSince, createdSince time.Time) ([]*Session, error)
+	RevokeSession(ctx context.Context, sessionID uuid.UUID, userID uuid.UUID) (bool, error)
+	RevokeOtherSessions(ctx context.Context, userID uuid.UUID, keep uuid.UUID) (int, error)
 
 	CreateOrganization(ctx context.Context, org *Organization) error
 	GetOrganization(ctx context.Context, id uuid.UUID) (*Organization, error)
+	// ListOrganizationSummaries pages through all organizations, oldest first, with
+	// their user counts; GetOrganizationSummary returns ErrOrganizationNotFound
+	ListOrganizationSummaries(ctx context.Context, limit, offset int) ([]*OrganizationSummary, error)
+	GetOrganizationSummary(ctx context.Context, id uuid.UUID) (*OrganizationSummary, error)
+	CountOrganizations(ctx context.Context) (int, error)
 }
 
 type AuthUsecase struct {
-	repo           AuthRepo
-	jwtSecret      string
-	tokenTTL       time.Duration
-	keycloakConfig KeycloakConfig
-	keycloakClient *gocloak.GoCloak
-	oidcProvider   *oidc.Provider
+	repo            AuthRepo
+	jwtSecret       string
+	tokenTTL        time.Duration
+	mqttTokenTTL    time.Duration
+	refreshTokenTTL time.Duration
+	sessionMaxAge   time.Duration
+	jwtIssuer       string
+	jwtAudience     string
+	keycloakConfig  KeycloakConfig
+	keycloakClient  *gocloak.GoCloak
+	oidcProvider    *oidc.Provider
+	presence        PresenceClient
+	passwordScheme  PasswordScheme
+	bcryptCost      int
+	argon2Params    Argon2Params
+	totpIssuer      string
+	totpKey         string
+	superAdmins     map[uuid.UUID]bool
 }
 
-func NewAuthUsecase(repo AuthRepo, jwtSecret string, tokenTTL time.Duration, keycloakConfig KeycloakConfig) (*AuthUsecase, error) {
+func NewAuthUsecase(repo AuthRepo, presence PresenceClient, jwtConfig JWTConfig, passwordConfig PasswordConfig, keycloakConfig KeycloakConfig, totpConfig TOTPConfig, platformConfig PlatformConfig) (*AuthUsecase, error) {
 	keycloakClient := gocloak.NewClient(keycloakConfig.URL)
 
 	// Try to initialize OIDC provider, but don't fail if Keycloak is not available
@@ -127,21 +336,94 @@ func NewAuthUsecase(repo AuthRepo, jwtSecret string, tokenTTL time.Duration, key
 		oidcProvider = nil
 	}
 
+	mqttTokenTTL := jwtConfig.MQTTTokenTTL
+	if mqttTokenTTL <= 0 {
+		mqttTokenTTL = 15 * time.Minute
+	}
+	refreshTokenTTL := jwtConfig.RefreshTokenTTL
+	if refreshTokenTTL <= 0 {
+		refreshTokenTTL = DefaultRefreshTokenTTL
+	}
+	sessionMaxAge := jwtConfig.SessionMaxAge
+	if sessionMaxAge <= 0 {
+		sessionMaxAge = DefaultSessionMaxAge
+	}
+
+	bcryptCost := passwordConfig.BcryptCost
+	if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+		if bcryptCost != 0 {
+			log.Printf("Invalid bcrypt cost %d, using %d", bcryptCost, bcrypt.DefaultCost)
+		}
+		bcryptCost = bcrypt.DefaultCost
+	}
+
+	passwordScheme := passwordConfig.Scheme
+	if passwordScheme != PasswordSchemeArgon2id {
+		if passwordScheme != "" && passwordScheme != PasswordSchemeBcrypt {
+			log.Printf("Unknown password scheme %q, using %s", passwordScheme, PasswordSchemeBcrypt)
+		}
+		passwordScheme = PasswordSchemeBcrypt
+	}
+	argon2Params := passwordConfig.Argon2
+	defaultArgon2 := DefaultArgon2Params()
+	if argon2Params.MemoryKiB == 0 {
+		argon2Params.MemoryKiB = defaultArgon2.MemoryKiB
+	}
+	if argon2Params.Iterations == 0 {
+		argon2Params.Iterations = defaultArgon2.Iterations
+	}
+	if argon2Params.Parallelism == 0 {
+		argon2Params.Parallelism = defaultArgon2.Parallelism
+	}
+
+	totpIssuer := totpConfig.Issuer
+	if totpIssuer == "" {
+		totpIssuer = "Orbit Messenger"
+	}
+	totpKey := totpConfig.EncryptionKey
+	if totpKey == "" {
+		log.Printf("No TOTP encryption key configured, encrypting TOTP secrets with the JWT secret")
+		totpKey = jwtConfig.Secret
+	}
+
+	superAdmins := make(map[uuid.UUID]bool, len(platformConfig.SuperAdminUserIDs))
+	for _, id := range platformConfig.SuperAdminUserIDs {
+		superAdmins[id] = true
+	}
+
 	return &AuthUsecase{
-		repo:           repo,
-		jwtSecret:      jwtSecret,
-		tokenTTL:       tokenTTL,
-		keycloakConfig: keycloakConfig,
-		keycloakClient: keycloakClient,
-		oidcProvider:   oidcProvider,
+		repo:            repo,
+		jwtSecret:       jwtConfig.Secret,
+		tokenTTL:        jwtConfig.TokenTTL,
+		mqttTokenTTL:    mqttTokenTTL,
+		refreshTokenTTL: refreshTokenTTL,
+		sessionMaxAge:   sessionMaxAge,
+		jwtIssuer:       jwtConfig.Issuer,
+		jwtAudience:     jwtConfig.Audience,
+		keycloakConfig:  keycloakConfig,
+		keycloakClient:  keycloakClient,
+		oidcProvider:    oidcProvider,
+		presence:        presence,
+		passwordScheme:  passwordScheme,
+		bcryptCost:      bcryptCost,
+		argon2Params:    argon2Params,
+		totpIssuer:      totpIssuer,
+		totpKey:         totpKey,
+		superAdmins:     superAdmins,
 	}, nil
 }
 
-func (uc *AuthUsecase) Register(ctx context.Context, req *RegisterRequest) (*User, string, error) {
+// OIDCAvailable reports whether the Keycloak OIDC provider initialized at startup.
+// Without it OIDC login is unavailable and only direct auth works.
+func (uc *AuthUsecase) OIDCAvailable() bool {
+	return uc.oidcProvider != nil
+}
+
+func (uc *AuthUsecase) Register(ctx context.Context, req *RegisterRequest, client ClientInfo) (*User, *SessionTokens, error) {
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := uc.hashPassword(req.Password)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 
 	// Create or get organization
@@ -150,7 +432,7 @@ func (uc *AuthUsecase) Register(ctx context.Context, req *RegisterRequest) (*Use
 		orgID = *req.OrganizationID
 		// Verify organization exists
 		if _, err := uc.repo.GetOrganization(ctx, orgID); err != nil {
-			return nil, "", err
+			return nil, nil, err
 		}
 	} else if req.OrganizationName != nil {
 		// Create new organization
@@ -161,11 +443,11 @@ func (uc *AuthUsecase) Register(ctx context.Context, req *RegisterRequest) (*Use
 			CreatedAt: time.Now(),
 		}
 		if err := uc.repo.CreateOrganization(ctx, org); err != nil {
-			return nil, "", err
+			return nil, nil, err
 		}
 		orgID = org.ID
 	} else {
-		return nil, "", errors.New("either organization_id or organization_name is required")
+		return nil, nil, errors.New("either organization_id or organization_name is required")
 	}
 
 	// Create user
@@ -176,74 +458,200 @@ func (uc *AuthUsecase) Register(ctx context.Context, req *RegisterRequest) (*Use
 		Role:           UserRoleMember, // Default role
 		Profile:        make(map[string]interface{}),
 		CreatedAt:      time.Now(),
-		PasswordHash:   string(hashedPassword),
+		PasswordHash:   hashedPassword,
 	}
 
 	if err := uc.repo.CreateUser(ctx, user); err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 
 	// Generate JWT token
-	token, err := uc.generateToken(user)
+	tokens, err := uc.startSession(ctx, user, client)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 
 	user.PasswordHash = "" // Don't return password hash
-	return user, token, nil
+	return user, tokens, nil
 }
 
-func (uc *AuthUsecase) Login(ctx context.Context, req *LoginRequest, orgID uuid.UUID) (*User, string, error) {
+func (uc *AuthUsecase) Login(ctx context.Context, req *LoginRequest, orgID uuid.UUID, client ClientInfo) (*User, *SessionTokens, error) {
 	// Get user by email
 	var user *User
 	var err error
 
 	// If no organization ID provided, find user in any organization
 	if orgID == uuid.Nil {
-		user, err = uc.repo.GetUserByEmailAnyOrg(ctx, req.Email)
+		user, err = uc.findUserInAnyOrg(ctx, req)
+		if err != nil {
+			return nil, nil, err
+		}
 	} else {
 		user, err = uc.repo.GetUserByEmail(ctx, req.Email, orgID)
+		if err != nil {
+			return nil, nil, ErrUserNotFound
+		}
 	}
 
-	if err != nil {
-		return nil, "", ErrUserNotFound
+	// Verify password
+	if err := checkPassword(user.PasswordHash, req.Password); err != nil {
+		return nil, nil, err
 	}
 
-	// Verify password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		return nil, "", ErrInvalidPassword
+	if err := uc.checkSecondFactor(ctx, user, req.TOTPCode, req.RecoveryCode); err != nil {
+		return nil, nil, err
 	}
 
+	uc.upgradePasswordHash(ctx, user, req.Password)
+
 	// Update last seen
 	uc.repo.UpdateLastSeen(ctx, user.ID)
 
 	// Generate JWT token
-	token, err := uc.generateToken(user)
+	tokens, err := uc.startSession(ctx, user, client)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 
 	user.PasswordHash = "" // Don't return password hash
-	return user, token, nil
+	return user, tokens, nil
+}
+
+// upgradePasswordHash rehashes a just-verified password with the configured scheme
+// and costs if the stored hash uses another scheme or is weaker, so hashes keep up
+// with the configuration without forcing resets. It is best effort: a failure leaves
+// the old hash in place and the login proceeds.
+func (uc *AuthUsecase) upgradePasswordHash(ctx context.Context, user *User, password string) {
+	if !uc.needsRehash(user.PasswordHash) {
+		return
+	}
+
+	hashed, err := uc.hashPassword(password)
+	if err != nil {
+		log.Printf("Failed to rehash password for user %s: %v", user.ID, err)
+		return
+	}
+	if err := uc.repo.UpdatePasswordHash(ctx, user.ID, string(hashed)); err != nil {
+		log.Printf("Failed to store rehashed password for user %s: %v", user.ID, err)
+		return
+	}
+	user.PasswordHash = string(hashed)
+}
+
+// findUserInAnyOrg resolves the account for a login without an organization.
+// If the email exists in several organizations it refuses to guess and returns an
+// AmbiguousOrganizationError listing only the organizations the password is valid
+// for, so the response doesn't reveal memberships to someone without credentials.
+func (uc *AuthUsecase) findUserInAnyOrg(ctx context.Context, req *LoginRequest) (*User, error) {
+	users, err := uc.repo.GetUsersByEmailAnyOrg(ctx, req.Email)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, ErrUserNotFound
+	}
+	if len(users) == 1 {
+		return users[0], nil
+	}
+
+	var candidates []*OrganizationCandidate
+	for _, user := range users {
+		if checkPassword(user.PasswordHash, req.Password) != nil {
+			continue
+		}
+		org, err := uc.repo.GetOrganization(ctx, user.OrganizationID)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, &OrganizationCandidate{ID: org.ID, Name: org.Name})
+	}
+
+	if len(candidates) == 0 {
+		return nil, ErrInvalidPassword
+	}
+
+	return nil, &AmbiguousOrganizationError{Candidates: candidates}
 }
 
+// ValidateToken returns the claims of an unrestricted access token. A restricted
+// token fails with ErrPasswordChangeRequired.
 func (uc *AuthUsecase) ValidateToken(ctx context.Context, tokenString string) (*JWTClaims, error) {
+	claims, err := uc.validateToken(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Scope != "" {
+		return nil, ErrPasswordChangeRequired
+	}
+	return claims, nil
+}
+
+// ValidatePasswordChangeToken is ValidateToken for the endpoints a user who must
+// change their password can still use, accepting restricted tokens too
+func (uc *AuthUsecase) ValidatePasswordChangeToken(ctx context.Context, tokenString string) (*JWTClaims, error) {
+	claims, err := uc.validateToken(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Scope != "" && claims.Scope != TokenScopePasswordChange {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func (uc *AuthUsecase) validateToken(ctx context.Context, tokenString string) (*JWTClaims, error) {
+	opts := []jwt.ParserOption{jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()})}
+	if uc.jwtIssuer != "" {
+		opts = append(opts, jwt.WithIssuer(uc.jwtIssuer))
+	}
+	if uc.jwtAudience != "" {
+		opts = append(opts, jwt.WithAudience(uc.jwtAudience))
+	}
+
 	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
 		return []byte(uc.jwtSecret), nil
-	})
+	}, opts...)
 
 	if err != nil {
 		return nil, ErrInvalidToken
 	}
 
 	if claims, ok := token.Claims.(*JWTClaims); ok && token.Valid {
+		// Broker credentials are signed with the same key but must not work as API tokens
+		for _, aud := range claims.Audience {
+			if aud == MQTTAudience {
+				return nil, ErrInvalidToken
+			}
+		}
+
+		// Tokens issued before an admin revoked the user's sessions are dead. iat
+		// only has second precision, so compare at that precision.
+		revokedAt, err := uc.repo.GetTokensRevokedAt(ctx, claims.UserID)
+		if err != nil {
+			return nil, ErrInvalidToken
+		}
+		if revokedAt != nil && (claims.IssuedAt == nil || claims.IssuedAt.Time.Before(revokedAt.Truncate(time.Second))) {
+			return nil, ErrInvalidToken
+		}
+
+		// Tokens of a revoked session are dead too
+		if claims.SessionID != "" {
+			sessionID, err := uuid.Parse(claims.SessionID)
+			if err != nil {
+				return nil, ErrInvalidToken
+			}
+			active, err := uc.repo.IsSessionActive(ctx, sessionID, time.Now().Add(-uc.sessionMaxAge))
+			if err != nil || !active {
+				return nil, ErrInvalidToken
+			}
+		}
 		return claims, nil
 	}
 
 	return nil, ErrInvalidToken
 }
 
-func (uc *AuthUsecase) GetUser(ctx context.Context, userID int) (*User, error) {
+func (uc *AuthUsecase) GetUser(ctx context.Context, userID uuid.UUID) (*User, error) {
 	user, err := uc.repo.GetUserByID(ctx, userID)
 	if err != nil {
 		return nil, err
@@ -253,9 +661,9 @@ func (uc *AuthUsecase) GetUser(ctx context.Context, userID int) (*User, error) {
 }
 
 // OIDCLogin handles Keycloak OIDC authentication
-func (uc *AuthUsecase) OIDCLogin(ctx context.Context, req *OIDCLoginRequest, orgID uuid.UUID) (*User, string, error) {
+func (uc *AuthUsecase) OIDCLogin(ctx context.Context, req *OIDCLoginRequest, orgID uuid.UUID, client ClientInfo) (*User, *SessionTokens, error) {
 	if uc.oidcProvider == nil {
-		return nil, "", errors.New("Keycloak OIDC provider not available")
+		return nil, nil, errors.New("Keycloak OIDC provider not available")
 	}
 
 	// Exchange authorization code for token
@@ -267,66 +675,297 @@ func (uc *AuthUsecase) OIDCLogin(ctx context.Context, req *OIDCLoginRequest, org
 		GrantType:    gocloak.StringP("authorization_code"),
 	})
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 
 	// Get user info from Keycloak
 	userInfo, err := uc.keycloakClient.GetUserInfo(ctx, token.AccessToken, uc.keycloakConfig.Realm)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
+	}
+
+	if userInfo == nil {
+		return nil, nil, ErrIncompleteOIDCUserInfo
+	}
+	subject, email := stringClaim(userInfo.Sub), stringClaim(userInfo.Email)
+	if subject == "" || email == "" {
+		return nil, nil, ErrIncompleteOIDCUserInfo
+	}
+
+	role := mapKeycloakRole(keycloakRoles(token.AccessToken, uc.keycloakConfig.ClientID), uc.keycloakConfig.RoleMapping)
+
+	// New users without a name at the provider are named after their email; existing
+	// users keep the name they have unless the provider supplies one
+	claimedName := oidcClaimedName(userInfo, email)
+	displayName := claimedName
+	if displayName == "" {
+		displayName = emailLocalPart(email)
 	}
 
 	// Check if user exists in our database
-	user, err := uc.repo.GetUserByKeycloakID(ctx, *userInfo.Sub)
+	user, err := uc.repo.GetUserByKeycloakID(ctx, subject)
 	if err != nil {
-		// User doesn't exist, create new user
+		// User doesn't exist, create new user in an existing organization
+		if orgID == uuid.Nil {
+			return nil, nil, ErrOrganizationNotFound
+		}
+		if _, err := uc.repo.GetOrganization(ctx, orgID); err != nil {
+			return nil, nil, err
+		}
+
+		// Link to an existing password account instead of creating a duplicate
+		if existing, err := uc.repo.GetUserByEmail(ctx, email, orgID); err == nil {
+			emailVerified := userInfo.EmailVerified != nil && *userInfo.EmailVerified
+			if err := uc.linkExistingAccount(ctx, existing, subject, email, claimedName, role, emailVerified); err != nil {
+				return nil, nil, err
+			}
+			return uc.completeOIDCLogin(ctx, existing, token.RefreshToken, client)
+		} else if err != ErrUserNotFound {
+			return nil, nil, err
+		}
+
 		user = &User{
 			OrganizationID: orgID,
-			Email:          *userInfo.Email,
-			DisplayName:    *userInfo.Name,
-			Role:           UserRoleMember,
-			KeycloakID:     *userInfo.Sub,
+			Email:          email,
+			DisplayName:    displayName,
+			Role:           role,
+			KeycloakID:     subject,
 			Profile:        make(map[string]interface{}),
 			CreatedAt:      time.Now(),
 		}
 
 		if err := uc.repo.CreateUser(ctx, user); err != nil {
-			return nil, "", err
+			return nil, nil, err
 		}
+	} else if err := uc.syncOIDCUser(ctx, user, email, claimedName, role); err != nil {
+		return nil, nil, err
+	}
+
+	return uc.completeOIDCLogin(ctx, user, token.RefreshToken, client)
+}
+
+func (uc *AuthUsecase) completeOIDCLogin(ctx context.Context, user *User, refreshToken string, client ClientInfo) (*User, *SessionTokens, error) {
+	// Keep the Keycloak refresh token so the SSO session can be refreshed or ended later
+	if err := uc.repo.SetKeycloakRefreshToken(ctx, user.ID, refreshToken); err != nil {
+		return nil, nil, err
 	}
 
 	// Update last seen
 	uc.repo.UpdateLastSeen(ctx, user.ID)
 
 	// Generate JWT token
-	jwtToken, err := uc.generateToken(user)
+	tokens, err := uc.startSession(ctx, user, client)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user.PasswordHash = "" // Don't return password hash
+	return user, tokens, nil
+}
+
+// syncOIDCUser propagates role, email and name changes made in Keycloak since the
+// user's last login. The display name is only overwritten when Keycloak has one.
+func (uc *AuthUsecase) syncOIDCUser(ctx context.Context, user *User, email, displayName string, role UserRole) error {
+	var changed bool
+	if user.Role != role {
+		user.Role = role
+		changed = true
+	}
+	if user.Email != email {
+		user.Email = email
+		changed = true
+	}
+	if displayName != "" && displayName != email && user.DisplayName != displayName {
+		user.DisplayName = displayName
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return uc.repo.UpdateOIDCUser(ctx, user.ID, user.Email, user.DisplayName, user.Role)
+}
+
+// OIDCRefresh refreshes the user's Keycloak session and issues a new access token.
+// It fails if the Keycloak session has ended, so a user signed out in Keycloak
+// can't keep extending their local session. The new token stays in the caller's session.
+func (uc *AuthUsecase) OIDCRefresh(ctx context.Context, userID uuid.UUID, sessionID string) (string, error) {
+	refreshToken, err := uc.repo.GetKeycloakRefreshToken(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if refreshToken == "" {
+		return "", ErrNoOIDCSession
+	}
+
+	token, err := uc.keycloakClient.RefreshToken(ctx, refreshToken,
+		uc.keycloakConfig.ClientID, uc.keycloakConfig.ClientSecret, uc.keycloakConfig.Realm)
+	if err != nil {
+		// The upstream session is gone, forget the stale refresh token
+		if clearErr := uc.repo.SetKeycloakRefreshToken(ctx, userID, ""); clearErr != nil {
+			log.Printf("Failed to clear Keycloak refresh token for user %s: %v", userID, clearErr)
+		}
+		return "", ErrNoOIDCSession
+	}
+
+	if err := uc.repo.SetKeycloakRefreshToken(ctx, userID, token.RefreshToken); err != nil {
+		return "", err
+	}
+
+	if id, err := uuid.Parse(sessionID); err == nil {
+		if err := uc.repo.TouchSession(ctx, id, userID); err != nil {
+			return "", err
+		}
+	}
+
+	user, err := uc.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	return uc.generateToken(user, sessionID)
+}
+
+// OIDCLogout ends the user's Keycloak SSO session through the end-session endpoint
+// so they are signed out of every application sharing it, not just this one
+func (uc *AuthUsecase) OIDCLogout(ctx context.Context, userID uuid.UUID) error {
+	refreshToken, err := uc.repo.GetKeycloakRefreshToken(ctx, userID)
 	if err != nil {
-		return nil, "", err
+		return err
+	}
+	if refreshToken == "" {
+		return ErrNoOIDCSession
 	}
 
-	return user, jwtToken, nil
+	logoutErr := uc.keycloakClient.Logout(ctx, uc.keycloakConfig.ClientID,
+		uc.keycloakConfig.ClientSecret, uc.keycloakConfig.Realm, refreshToken)
+
+	// Drop the stored token even if Keycloak failed, it must not be reused
+	if err := uc.repo.SetKeycloakRefreshToken(ctx, userID, ""); err != nil {
+		return err
+	}
+
+	return logoutErr
 }
 
-// GenerateMQTTCredentials creates credentials for MQTT broker authentication
-func (uc *AuthUsecase) GenerateMQTTCredentials(ctx context.Context, userID int) (string, string, error) {
+// GenerateMQTTCredentials issues short-lived broker credentials. The password is a
+// separate token with aud "mqtt" whose ACL only covers the user's own conversations
+// and notification topics, so the broker never sees the API token. Clients call it
+// again before ExpiresAt to refresh, which also picks up conversations joined since.
+func (uc *AuthUsecase) GenerateMQTTCredentials(ctx context.Context, userID uuid.UUID) (*MQTTCredentials, error) {
 	user, err := uc.repo.GetUserByID(ctx, userID)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+
+	conversationIDs, err := uc.repo.GetUserConversationIDs(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Presence is visible for everyone the user shares a conversation with
+	peerIDs, err := uc.repo.GetConversationPeerIDs(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	acl := MQTTACL{
+		Pub: []string{fmt.Sprintf("presence/%s/#", user.ID)},
+		Sub: []string{
+			fmt.Sprintf("notifications/%s/#", user.ID),
+			fmt.Sprintf("users/%s/notifications", user.ID),
+			fmt.Sprintf("users/%s/attachments", user.ID),
+			// Persistence acks of the user's own messages
+			fmt.Sprintf("users/%s/acks", user.ID),
+			fmt.Sprintf("presence/%s/#", user.ID),
+		},
+	}
+	for _, id := range conversationIDs {
+		// Messages are sent through chat-api, which checks them before publishing; typing
+		// and receipts only on the user's own topics, so they can't be sent for others
+		acl.Pub = append(acl.Pub, fmt.Sprintf("chat/%s/typing/%s", id, user.ID), fmt.Sprintf("chat/%s/receipts/%s", id, user.ID))
+		acl.Sub = append(acl.Sub, fmt.Sprintf("chat/%s/#", id))
+	}
+	for _, id := range peerIDs {
+		acl.Sub = append(acl.Sub, fmt.Sprintf("presence/%s/#", id))
+	}
+
+	username := fmt.Sprintf("user_%s", user.ID)
+	now := time.Now()
+	expiresAt := now.Add(uc.mqttTokenTTL)
+
+	claims := MQTTClaims{
+		UserID:         user.ID,
+		OrganizationID: user.OrganizationID.String(),
+		ACL:            acl,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    uc.jwtIssuer,
+			Subject:   username,
+			Audience:  jwt.ClaimStrings{MQTTAudience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+
+	password, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(uc.jwtSecret))
+	if err != nil {
+		return nil, err
+	}
+
+	return &MQTTCredentials{
+		Username:  username,
+		Password:  password,
+		ExpiresAt: expiresAt,
+		Topics:    acl,
+	}, nil
+}
+
+// VerifyMQTTCredentials checks broker credentials for the broker's authentication
+// plugin and returns the topic ACL embedded in them
+func (uc *AuthUsecase) VerifyMQTTCredentials(ctx context.Context, username, password string) (*MQTTClaims, error) {
+	claims := &MQTTClaims{}
+	_, err := jwt.ParseWithClaims(password, claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(uc.jwtSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(MQTTAudience))
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.Subject != username {
+		return nil, ErrInvalidToken
 	}
 
-	// Generate MQTT username and password
-	mqttUsername := fmt.Sprintf("user_%d", user.ID)
-	mqttPassword, err := uc.generateToken(user)
+	// Like API tokens, credentials issued before the user's tokens were revoked are dead
+	revokedAt, err := uc.repo.GetTokensRevokedAt(ctx, claims.UserID)
 	if err != nil {
-		return "", "", err
+		return nil, ErrInvalidToken
+	}
+	if revokedAt != nil && (claims.IssuedAt == nil || claims.IssuedAt.Time.Before(revokedAt.Truncate(time.Second))) {
+		return nil, ErrInvalidToken
 	}
 
-	return mqttUsername, mqttPassword, nil
+	return claims, nil
 }
 
-// GetOrganizationUsers returns all users in the same organization
-func (uc *AuthUsecase) GetOrganizationUsers(ctx context.Context, orgID uuid.UUID) ([]*User, error) {
-	users, err := uc.repo.GetOrganizationUsers(ctx, orgID)
+// RevokeUserTokens invalidates every access token, session and MQTT credential issued
+// to the user so far
+func (uc *AuthUsecase) RevokeUserTokens(ctx context.Context, userID uuid.UUID) error {
+	if _, err := uc.repo.GetUserByID(ctx, userID); err != nil {
+		return err
+	}
+	return uc.repo.RevokeTokens(ctx, userID)
+}
+
+// GetOrganizationUsers returns the users in the same organization matching filter
+func (uc *AuthUsecase) GetOrganizationUsers(ctx context.Context, orgID uuid.UUID, filter UserListFilter) ([]*User, error) {
+	var users []*User
+	var err error
+	if filter.Status != "" {
+		users, err = uc.organizationUsersWithStatus(ctx, orgID, filter)
+	} else {
+		users, err = uc.repo.GetOrganizationUsers(ctx, orgID, filter)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -339,8 +978,21 @@ func (uc *AuthUsecase) GetOrganizationUsers(ctx context.Context, orgID uuid.UUID
 	return users, nil
 }
 
+// CountOrganizationUsers counts an organization's users matching filter for pagination totals
+func (uc *AuthUsecase) CountOrganizationUsers(ctx context.Context, orgID uuid.UUID, filter UserListFilter) (int, error) {
+	if filter.Status != "" {
+		total := 0
+		err := uc.scanUsersByStatus(ctx, orgID, filter, func(*User) bool {
+			total++
+			return true
+		})
+		return total, err
+	}
+	return uc.repo.CountOrganizationUsers(ctx, orgID, filter)
+}
+
 // UpdateUser updates user information (admin only)
-func (uc *AuthUsecase) UpdateUser(ctx context.Context, requesterID, targetUserID int, req *UpdateUserRequest) error {
+func (uc *AuthUsecase) UpdateUser(ctx context.Context, requesterID, targetUserID uuid.UUID, req *UpdateUserRequest) error {
 	// Get requester to check permissions
 	requester, err := uc.repo.GetUserByID(ctx, requesterID)
 	if err != nil {
@@ -349,7 +1001,7 @@ func (uc *AuthUsecase) UpdateUser(ctx context.Context, requesterID, targetUserID
 
 	// Only admins can update other users, users can update themselves (limited fields)
 	if requesterID != targetUserID && requester.Role != UserRoleAdmin {
-		return errors.New("insufficient permissions")
+		return ErrInsufficientPermissions
 	}
 
 	// If not admin, restrict what can be updated
@@ -363,11 +1015,37 @@ func (uc *AuthUsecase) UpdateUser(ctx context.Context, requesterID, targetUserID
 		return uc.repo.UpdateUser(ctx, targetUserID, restrictedReq)
 	}
 
-	return uc.repo.UpdateUser(ctx, targetUserID, req)
+	before, err := uc.repo.GetUserByID(ctx, targetUserID)
+	if err != nil {
+		return err
+	}
+	// Users in other organizations don't exist as far as the admin is concerned
+	if before.OrganizationID != requester.OrganizationID {
+		return ErrUserNotFound
+	}
+	if err := uc.repo.UpdateUser(ctx, targetUserID, req); err != nil {
+		return err
+	}
+	after, err := uc.repo.GetUserByID(ctx, targetUserID)
+	if err != nil {
+		log.Printf("Failed to read user %s back for the audit log: %v", targetUserID, err)
+		return nil
+	}
+
+	changes := audit.Diff(userAuditSnapshot(before), userAuditSnapshot(after))
+	if len(changes) == 0 {
+		return nil
+	}
+	action := AuditActionUserUpdate
+	if _, ok := changes["role"]; ok {
+		action = AuditActionUserRoleChange
+	}
+	uc.auditUserAction(ctx, requester, action, before, changes)
+	return nil
 }
 
 // DeleteUser deletes a user (admin only)
-func (uc *AuthUsecase) DeleteUser(ctx context.Context, requesterID, targetUserID int) error {
+func (uc *AuthUsecase) DeleteUser(ctx context.Context, requesterID, targetUserID uuid.UUID) error {
 	// Get requester to check permissions
 	requester, err := uc.repo.GetUserByID(ctx, requesterID)
 	if err != nil {
@@ -376,7 +1054,7 @@ func (uc *AuthUsecase) DeleteUser(ctx context.Context, requesterID, targetUserID
 
 	// Only admins can delete users
 	if requester.Role != UserRoleAdmin {
-		return errors.New("insufficient permissions")
+		return ErrInsufficientPermissions
 	}
 
 	// Cannot delete yourself
@@ -384,11 +1062,54 @@ func (uc *AuthUsecase) DeleteUser(ctx context.Context, requesterID, targetUserID
 		return errors.New("cannot delete yourself")
 	}
 
-	return uc.repo.DeleteUser(ctx, targetUserID)
+	target, err := uc.repo.GetUserByID(ctx, targetUserID)
+	if err != nil {
+		return err
+	}
+	// Users in other organizations don't exist as far as the admin is concerned
+	if target.OrganizationID != requester.OrganizationID {
+		return ErrUserNotFound
+	}
+	if err := uc.repo.DeleteUser(ctx, targetUserID); err != nil {
+		return err
+	}
+
+	changes := audit.Diff(userAuditSnapshot(target), nil)
+	uc.auditUserAction(ctx, requester, AuditActionUserDelete, target, changes)
+	return nil
+}
+
+// userAuditSnapshot is the part of a user an admin can change, as recorded in the
+// audit log's before/after diff
+func userAuditSnapshot(user *User) map[string]interface{} {
+	return map[string]interface{}{
+		"email":        user.Email,
+		"display_name": user.DisplayName,
+		"avatar_url":   user.AvatarURL,
+		"role":         user.Role,
+		"profile":      user.Profile,
+	}
+}
+
+// auditUserAction records an admin's change to a user in the target's organization.
+// The change already happened, so a failed audit write is only logged.
+func (uc *AuthUsecase) auditUserAction(ctx context.Context, actor *User, action string, target *User, changes map[string]audit.Change) {
+	event := &AuditEvent{
+		OrganizationID: target.OrganizationID,
+		ActorID:        actor.ID,
+		Action:         action,
+		TargetType:     "user",
+		TargetID:       target.ID.String(),
+		Changes:        changes,
+		CreatedAt:      time.Now(),
+	}
+	if err := uc.repo.CreateAuditEvent(ctx, event); err != nil {
+		log.Printf("Failed to audit %s of user %s by %s: %v", action, target.ID, actor.ID, err)
+	}
 }
 
 // IsAdmin checks if a user is an admin
-func (uc *AuthUsecase) IsAdmin(ctx context.Context, userID int) (bool, error) {
+func (uc *AuthUsecase) IsAdmin(ctx context.Context, userID uuid.UUID) (bool, error) {
 	user, err := uc.repo.GetUserByID(ctx, userID)
 	if err != nil {
 		return false, err
@@ -396,7 +1117,7 @@ func (uc *AuthUsecase) IsAdmin(ctx context.Context, userID int) (bool, error) {
 	return user.Role == UserRoleAdmin, nil
 }
 
-func (uc *AuthUsecase) generateToken(user *User) (string, error) {
+func (uc *AuthUsecase) generateToken(user *User, sessionID string) (string, error) {
 	now := time.Now()
 	claims := JWTClaims{
 		UserID:         user.ID,
@@ -404,13 +1125,21 @@ func (uc *AuthUsecase) generateToken(user *User) (string, error) {
 		Email:          user.Email,
 		Role:           string(user.Role),
 		KeycloakID:     user.KeycloakID,
+		SessionID:      sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    uc.jwtIssuer,
 			ExpiresAt: jwt.NewNumericDate(now.Add(uc.tokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
-			Subject:   fmt.Sprintf("%d", user.ID),
+			Subject:   user.ID.String(),
 		},
 	}
+	if user.MustChangePassword {
+		claims.Scope = TokenScopePasswordChange
+	}
+	if uc.jwtAudience != "" {
+		claims.Audience = jwt.ClaimStrings{uc.jwtAudience}
+	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(uc.jwtSecret))
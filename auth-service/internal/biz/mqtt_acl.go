@@ -0,0 +1,18 @@
+package biz
+
+import (
+	"context"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/mqttacl"
+)
+
+// CheckMQTTTopicAccess decides whether the broker should let a client publish or
+// subscribe to a topic, based on live conversation membership rather than the ACL
+// frozen into the credentials. The rules are shared with chat-api's ACL endpoint.
+func (uc *AuthUsecase) CheckMQTTTopicAccess(ctx context.Context, username, topic string, action mqttacl.Access) (bool, error) {
+	userID, ok := mqttacl.ParseUsername(username)
+	if !ok {
+		return false, nil
+	}
+	return mqttacl.Check(ctx, uc.repo, userID, topic, action)
+}
@@ -0,0 +1,74 @@
+package biz
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// credentialsRepo serves one user and their conversations; methods
+// GenerateMQTTCredentials doesn't use are left to the embedded nil interface
+type credentialsRepo struct {
+	AuthRepo
+	user          *User
+	conversations []uuid.UUID
+	peers         []string
+}
+
+func (r *credentialsRepo) GetUserByID(ctx context.Context, id uuid.UUID) (*User, error) {
+	return r.user, nil
+}
+
+func (r *credentialsRepo) GetUserConversationIDs(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	return r.conversations, nil
+}
+
+func (r *credentialsRepo) GetConversationPeerIDs(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	return r.peers, nil
+}
+
+func TestGenerateMQTTCredentialsTopics(t *testing.T) {
+	user := &User{ID: uuid.New(), OrganizationID: uuid.New()}
+	conversationID := uuid.New()
+	peerID := uuid.New()
+	uc := &AuthUsecase{repo: &credentialsRepo{user: user, conversations: []uuid.UUID{conversationID}, peers: []string{peerID.String()}}, jwtSecret: "secret"}
+
+	creds, err := uc.GenerateMQTTCredentials(context.Background(), user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userTopic := "users/" + user.ID.String()
+	chatTopic := "chat/" + conversationID.String()
+	tests := []struct {
+		name   string
+		topics []string
+		topic  string
+	}{
+		{"own acks", creds.Topics.Sub, userTopic + "/acks"},
+		{"own notifications", creds.Topics.Sub, userTopic + "/notifications"},
+		{"own attachment status", creds.Topics.Sub, userTopic + "/attachments"},
+		{"conversation", creds.Topics.Sub, chatTopic + "/#"},
+		{"peer presence", creds.Topics.Sub, "presence/" + peerID.String() + "/#"},
+		{"own typing", creds.Topics.Pub, chatTopic + "/typing/" + user.ID.String()},
+		{"own receipts", creds.Topics.Pub, chatTopic + "/receipts/" + user.ID.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, topic := range tt.topics {
+				if topic == tt.topic {
+					return
+				}
+			}
+			t.Errorf("%s missing from %v", tt.topic, tt.topics)
+		})
+	}
+
+	// Messages go through chat-api, so a client can't forge their sender or conversation
+	for _, topic := range creds.Topics.Pub {
+		if topic == chatTopic+"/messages" {
+			t.Errorf("client may publish to %s", topic)
+		}
+	}
+}
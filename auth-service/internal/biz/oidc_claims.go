@@ -0,0 +1,41 @@
+package biz
+
+import (
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// stringClaim reads an optional user info claim; providers omit claims they have no
+// value for, so any of them may be nil
+func stringClaim(claim *string) string {
+	if claim == nil {
+		return ""
+	}
+	return strings.TrimSpace(*claim)
+}
+
+// oidcClaimedName is the display name the identity provider has for the user, or ""
+// if it has none. Keycloak often only has an email, in which case preferred_username
+// is usually that email too and isn't worth using.
+func oidcClaimedName(info *gocloak.UserInfo, email string) string {
+	if name := stringClaim(info.Name); name != "" {
+		return name
+	}
+	if name := strings.TrimSpace(stringClaim(info.GivenName) + " " + stringClaim(info.FamilyName)); name != "" {
+		return name
+	}
+	if username := stringClaim(info.PreferredUsername); username != "" && !strings.EqualFold(username, email) {
+		return username
+	}
+	return ""
+}
+
+// emailLocalPart is the part of an email address before the @, used as the display
+// name of users the identity provider has no name for
+func emailLocalPart(email string) string {
+	if at := strings.LastIndex(email, "@"); at > 0 {
+		return email[:at]
+	}
+	return email
+}
@@ -0,0 +1,234 @@
+package biz
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+)
+
+func TestStringClaim(t *testing.T) {
+	tests := []struct {
+		name  string
+		claim *string
+		want  string
+	}{
+		{"omitted", nil, ""},
+		{"empty", gocloak.StringP(""), ""},
+		{"blank", gocloak.StringP("   "), ""},
+		{"padded", gocloak.StringP("  Ada Lovelace "), "Ada Lovelace"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stringClaim(tt.claim); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCClaimedName(t *testing.T) {
+	const email = "ada@example.com"
+
+	tests := []struct {
+		name string
+		info gocloak.UserInfo
+		want string
+	}{
+		{"no claims", gocloak.UserInfo{}, ""},
+		{"name", gocloak.UserInfo{Name: gocloak.StringP("Ada Lovelace"), GivenName: gocloak.StringP("Augusta")}, "Ada Lovelace"},
+		{"blank name falls back to given and family name", gocloak.UserInfo{Name: gocloak.StringP(" "), GivenName: gocloak.StringP("Ada"), FamilyName: gocloak.StringP("Lovelace")}, "Ada Lovelace"},
+		{"given name only", gocloak.UserInfo{GivenName: gocloak.StringP("Ada")}, "Ada"},
+		{"family name only", gocloak.UserInfo{FamilyName: gocloak.StringP("Lovelace")}, "Lovelace"},
+		{"preferred username", gocloak.UserInfo{PreferredUsername: gocloak.StringP("ada")}, "ada"},
+		{"preferred username that is the email", gocloak.UserInfo{PreferredUsername: gocloak.StringP("ADA@example.com")}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := oidcClaimedName(&tt.info, email); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmailLocalPart(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+	}{
+		{"ada@example.com", "ada"},
+		{"first.last+tag@example.com", "first.last+tag"},
+		{`"a@b"@example.com`, `"a@b"`},
+		{"@example.com", "@example.com"},
+		{"ada", "ada"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			if got := emailLocalPart(tt.email); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// oidcRepo has no users yet, so every OIDC login creates one; methods the login
+// doesn't use are left to the embedded nil interface
+type oidcRepo struct {
+	AuthRepo
+	created *User
+}
+
+func (r *oidcRepo) GetUserByKeycloakID(ctx context.Context, keycloakID string) (*User, error) {
+	return nil, ErrUserNotFound
+}
+
+func (r *oidcRepo) GetOrganization(ctx context.Context, id uuid.UUID) (*Organization, error) {
+	return &Organization{ID: id}, nil
+}
+
+func (r *oidcRepo) GetUserByEmail(ctx context.Context, email string, orgID uuid.UUID) (*User, error) {
+	return nil, ErrUserNotFound
+}
+
+func (r *oidcRepo) CreateUser(ctx context.Context, user *User) error {
+	user.ID = uuid.New()
+	r.created = user
+	return nil
+}
+
+func (r *oidcRepo) SetKeycloakRefreshToken(ctx context.Context, userID uuid.UUID, refreshToken string) error {
+	return nil
+}
+
+func (r *oidcRepo) UpdateLastSeen(ctx context.Context, userID uuid.UUID) error {
+	return nil
+}
+
+func (r *oidcRepo) CreateSession(ctx context.Context, session *Session) error {
+	return nil
+}
+
+// fakeKeycloak serves the discovery document, token and userinfo endpoints of a
+// realm, answering userinfo with the given claims
+func fakeKeycloak(t *testing.T, realm string, userInfo map[string]interface{}) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	realmURL := srv.URL + "/realms/" + realm
+	writeJSON := func(w http.ResponseWriter, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}
+
+	mux.HandleFunc("/realms/"+realm+"/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 realmURL,
+			"authorization_endpoint": realmURL + "/protocol/openid-connect/auth",
+			"token_endpoint":         realmURL + "/protocol/openid-connect/token",
+			"userinfo_endpoint":      realmURL + "/protocol/openid-connect/userinfo",
+			"jwks_uri":               realmURL + "/protocol/openid-connect/certs",
+		})
+	})
+	mux.HandleFunc("/realms/"+realm+"/protocol/openid-connect/token", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"access_token": "access", "refresh_token": "refresh", "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/realms/"+realm+"/protocol/openid-connect/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, userInfo)
+	})
+
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOIDCLoginOptionalClaims(t *testing.T) {
+	const realm = "orbit"
+	orgID := uuid.New()
+
+	tests := []struct {
+		name            string
+		userInfo        map[string]interface{}
+		wantErr         error
+		wantDisplayName string
+	}{
+		{
+			name:            "all claims",
+			userInfo:        map[string]interface{}{"sub": "kc-1", "email": "ada@example.com", "name": "Ada Lovelace"},
+			wantDisplayName: "Ada Lovelace",
+		},
+		{
+			name:            "no name claims",
+			userInfo:        map[string]interface{}{"sub": "kc-1", "email": "ada@example.com"},
+			wantDisplayName: "ada",
+		},
+		{
+			name:            "only given name",
+			userInfo:        map[string]interface{}{"sub": "kc-1", "email": "ada@example.com", "given_name": "Ada"},
+			wantDisplayName: "Ada",
+		},
+		{
+			name:     "no email",
+			userInfo: map[string]interface{}{"sub": "kc-1", "name": "Ada Lovelace"},
+			wantErr:  ErrIncompleteOIDCUserInfo,
+		},
+		{
+			name:     "blank email",
+			userInfo: map[string]interface{}{"sub": "kc-1", "email": " "},
+			wantErr:  ErrIncompleteOIDCUserInfo,
+		},
+		{
+			name:     "no subject",
+			userInfo: map[string]interface{}{"email": "ada@example.com", "name": "Ada Lovelace"},
+			wantErr:  ErrIncompleteOIDCUserInfo,
+		},
+		{
+			name:     "no claims at all",
+			userInfo: map[string]interface{}{},
+			wantErr:  ErrIncompleteOIDCUserInfo,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fakeKeycloak(t, realm, tt.userInfo)
+			provider, err := oidc.NewProvider(context.Background(), srv.URL+"/realms/"+realm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo := &oidcRepo{}
+			uc := &AuthUsecase{
+				repo:           repo,
+				jwtSecret:      "secret",
+				tokenTTL:       time.Hour,
+				keycloakConfig: KeycloakConfig{URL: srv.URL, Realm: realm, ClientID: "orbit-messenger"},
+				keycloakClient: gocloak.NewClient(srv.URL),
+				oidcProvider:   provider,
+			}
+
+			user, _, err := uc.OIDCLogin(context.Background(), &OIDCLoginRequest{Code: "code", RedirectURI: "http://localhost/callback"}, orgID, ClientInfo{})
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if repo.created != nil {
+					t.Error("created a user from incomplete claims")
+				}
+				return
+			}
+			if user.DisplayName != tt.wantDisplayName {
+				t.Errorf("got display name %q, want %q", user.DisplayName, tt.wantDisplayName)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// PlatformConfig controls platform administration across organizations
+type PlatformConfig struct {
+	// SuperAdminUserIDs may list and inspect every organization. Nobody can when it
+	// is empty; organization admins never can by virtue of their role.
+	SuperAdminUserIDs []uuid.UUID `yaml:"super_admin_user_ids"`
+}
+
+// ParseSuperAdmins parses a comma-separated list of user IDs, skipping invalid entries
+func ParseSuperAdmins(value string) []uuid.UUID {
+	var ids []uuid.UUID
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, err := uuid.Parse(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid super admin user ID %q", entry)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// OrganizationSummary is an organization as platform administrators see it
+type OrganizationSummary struct {
+	*Organization
+	UserCount  int `json:"user_count"`
+	AdminCount int `json:"admin_count"`
+}
+
+// ListOrganizations returns every organization with its user counts, oldest first.
+// Only super admins may list them.
+func (uc *AuthUsecase) ListOrganizations(ctx context.Context, requesterID uuid.UUID, limit, offset int) ([]*OrganizationSummary, error) {
+	if err := uc.requireSuperAdmin(ctx, requesterID); err != nil {
+		return nil, err
+	}
+	return uc.repo.ListOrganizationSummaries(ctx, limit, offset)
+}
+
+func (uc *AuthUsecase) CountOrganizations(ctx context.Context) (int, error) {
+	return uc.repo.CountOrganizations(ctx)
+}
+
+// GetOrganizationSummary returns any organization with its user counts. Only super
+// admins may inspect organizations this way.
+func (uc *AuthUsecase) GetOrganizationSummary(ctx context.Context, requesterID uuid.UUID, orgID uuid.UUID) (*OrganizationSummary, error) {
+	if err := uc.requireSuperAdmin(ctx, requesterID); err != nil {
+		return nil, err
+	}
+	return uc.repo.GetOrganizationSummary(ctx, orgID)
+}
+
+// requireSuperAdmin checks the requester is on the configured allowlist and still
+// exists, so a token outliving its user doesn't keep cross-tenant access
+func (uc *AuthUsecase) requireSuperAdmin(ctx context.Context, userID uuid.UUID) error {
+	if !uc.superAdmins[userID] {
+		return ErrInsufficientPermissions
+	}
+	if _, err := uc.repo.GetUserByID(ctx, userID); err != nil {
+		if err == ErrUserNotFound {
+			return ErrInsufficientPermissions
+		}
+		return err
+	}
+	return nil
+}
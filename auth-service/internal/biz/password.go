@@ -0,0 +1,140 @@
+package biz
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordScheme is the algorithm new password hashes are made with
+type PasswordScheme string
+
+const (
+	PasswordSchemeBcrypt   PasswordScheme = "bcrypt"
+	PasswordSchemeArgon2id PasswordScheme = "argon2id"
+)
+
+// argon2idPrefix starts Argon2id hashes, which are stored in the PHC string format:
+// $argon2id$v=19$m=<memory KiB>,t=<iterations>,p=<parallelism>$<salt>$<hash>.
+// bcrypt hashes carry their own $2a$/$2b$ prefix, so the two can't be confused.
+const argon2idPrefix = "$argon2id$"
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// Argon2Params are the Argon2id cost parameters
+type Argon2Params struct {
+	MemoryKiB   uint32 `yaml:"memory_kib"`
+	Iterations  uint32 `yaml:"iterations"`
+	Parallelism uint8  `yaml:"parallelism"`
+}
+
+// DefaultArgon2Params returns the Argon2id costs used when nothing is configured
+func DefaultArgon2Params() Argon2Params {
+	return Argon2Params{
+		MemoryKiB:   64 * 1024,
+		Iterations:  3,
+		Parallelism: 2,
+	}
+}
+
+// errMalformedHash means a stored hash couldn't be parsed; it's treated as a wrong password
+var errMalformedHash = errors.New("malformed password hash")
+
+// hashPassword hashes a password with the configured scheme
+func (uc *AuthUsecase) hashPassword(password string) (string, error) {
+	if uc.passwordScheme == PasswordSchemeArgon2id {
+		return hashArgon2id(password, uc.argon2Params)
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), uc.bcryptCost)
+	return string(hashed), err
+}
+
+// checkPassword verifies a password against a stored hash of either scheme. Any
+// mismatch or unreadable hash is reported as ErrInvalidPassword.
+func checkPassword(hash, password string) error {
+	if strings.HasPrefix(hash, argon2idPrefix) {
+		params, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			log.Printf("Unreadable Argon2id password hash: %v", err)
+			return ErrInvalidPassword
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.MemoryKiB, params.Parallelism, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return ErrInvalidPassword
+		}
+		return nil
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// needsRehash reports whether a stored hash was made with another scheme or weaker
+// parameters than the configured ones
+func (uc *AuthUsecase) needsRehash(hash string) bool {
+	if strings.HasPrefix(hash, argon2idPrefix) {
+		if uc.passwordScheme != PasswordSchemeArgon2id {
+			return true
+		}
+		params, _, _, err := parseArgon2id(hash)
+		return err != nil || params.MemoryKiB < uc.argon2Params.MemoryKiB ||
+			params.Iterations < uc.argon2Params.Iterations || params.Parallelism < uc.argon2Params.Parallelism
+	}
+
+	if uc.passwordScheme != PasswordSchemeBcrypt {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost < uc.bcryptCost
+}
+
+func hashArgon2id(password string, params Argon2Params) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.MemoryKiB, params.Parallelism, argon2KeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		params.MemoryKiB, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func parseArgon2id(hash string) (params Argon2Params, salt, key []byte, err error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errMalformedHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.MemoryKiB, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, errMalformedHash
+	}
+	if params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, errMalformedHash
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, errMalformedHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, errMalformedHash
+	}
+	return params, salt, key, nil
+}
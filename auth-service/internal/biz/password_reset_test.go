@@ -0,0 +1,126 @@
+package biz
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// resetRepo keeps an organization's users in memory; methods the reset and token
+// checks don't use are left to the embedded nil interface
+type resetRepo struct {
+	AuthRepo
+	users map[uuid.UUID]*User
+}
+
+func (r *resetRepo) GetUserByID(ctx context.Context, id uuid.UUID) (*User, error) {
+	user, ok := r.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (r *resetRepo) CountActiveAdmins(ctx context.Context, orgID uuid.UUID) (int, error) {
+	count := 0
+	for _, user := range r.users {
+		if user.OrganizationID == orgID && user.Role == UserRoleAdmin && !user.MustChangePassword {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *resetRepo) SetPassword(ctx context.Context, userID uuid.UUID, passwordHash string, mustChange bool) error {
+	r.users[userID].PasswordHash = passwordHash
+	r.users[userID].MustChangePassword = mustChange
+	return nil
+}
+
+func (r *resetRepo) CreateAuditEvent(ctx context.Context, event *AuditEvent) error {
+	return nil
+}
+
+func (r *resetRepo) GetTokensRevokedAt(ctx context.Context, userID uuid.UUID) (*time.Time, error) {
+	return nil, nil
+}
+
+func TestResetPasswordLastAdmin(t *testing.T) {
+	orgID := uuid.New()
+	requesterID, targetID := uuid.New(), uuid.New()
+
+	tests := []struct {
+		name      string
+		target    *User
+		requester *User
+		wantErr   error
+	}{
+		{
+			name:      "member",
+			requester: &User{Role: UserRoleAdmin},
+			target:    &User{Role: UserRoleMember},
+		},
+		{
+			name:      "another admin remains",
+			requester: &User{Role: UserRoleAdmin},
+			target:    &User{Role: UserRoleAdmin},
+		},
+		{
+			name:      "only admin left who can act",
+			requester: &User{Role: UserRoleAdmin, MustChangePassword: true},
+			target:    &User{Role: UserRoleAdmin},
+			wantErr:   ErrLastAdmin,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.requester.ID, tt.requester.OrganizationID = requesterID, orgID
+			tt.target.ID, tt.target.OrganizationID = targetID, orgID
+			repo := &resetRepo{users: map[uuid.UUID]*User{requesterID: tt.requester, targetID: tt.target}}
+			uc := &AuthUsecase{repo: repo, bcryptCost: bcrypt.MinCost}
+
+			_, err := uc.ResetPassword(context.Background(), requesterID, targetID, &ResetPasswordRequest{})
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if want := tt.wantErr == nil; repo.users[targetID].MustChangePassword != want {
+				t.Errorf("target must change password = %v, want %v", repo.users[targetID].MustChangePassword, want)
+			}
+		})
+	}
+}
+
+func TestRestrictedToken(t *testing.T) {
+	tests := []struct {
+		name               string
+		mustChangePassword bool
+		wantAPIErr         error
+		wantChangeErr      error
+	}{
+		{"unrestricted token", false, nil, nil},
+		{"restricted token only changes the password", true, ErrPasswordChangeRequired, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &User{ID: uuid.New(), OrganizationID: uuid.New(), Role: UserRoleMember, MustChangePassword: tt.mustChangePassword}
+			uc := &AuthUsecase{repo: &resetRepo{}, jwtSecret: "secret", tokenTTL: time.Hour}
+
+			token, err := uc.generateToken(user, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := uc.ValidateToken(context.Background(), token); err != tt.wantAPIErr {
+				t.Errorf("ValidateToken error %v, want %v", err, tt.wantAPIErr)
+			}
+			if _, err := uc.ValidatePasswordChangeToken(context.Background(), token); err != tt.wantChangeErr {
+				t.Errorf("ValidatePasswordChangeToken error %v, want %v", err, tt.wantChangeErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package biz
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PresenceUnknown is reported for users whose presence couldn't be looked up
+const PresenceUnknown = "unknown"
+
+// ErrPresenceUnavailable means users can't be filtered by presence because
+// presence-service couldn't be reached
+var ErrPresenceUnavailable = errors.New("presence service unavailable")
+
+// presenceFilterBatch is how many users are looked up in presence-service at a time
+// while filtering by status
+const presenceFilterBatch = 200
+
+// IsValidPresenceStatus reports whether users can be filtered by status
+func IsValidPresenceStatus(status string) bool {
+	switch status {
+	case "online", "away", "dnd", "offline":
+		return true
+	}
+	return false
+}
+
+// presenceLookupTimeout keeps a slow presence service from holding up user listings
+const presenceLookupTimeout = 2 * time.Second
+
+// PresenceClient looks up current presence statuses in presence-service
+type PresenceClient interface {
+	GetPresence(ctx context.Context, userIDs []string) (map[string]string, error)
+}
+
+// AttachPresence fills in each user's presence status. Presence is best effort: if
+// presence-service is slow or down the users are marked unknown instead of failing.
+func (uc *AuthUsecase) AttachPresence(ctx context.Context, users []*User) {
+	if len(users) == 0 {
+		return
+	}
+
+	ids := make([]string, len(users))
+	for i, user := range users {
+		ids[i] = user.ID.String()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, presenceLookupTimeout)
+	defer cancel()
+
+	statuses, err := uc.presence.GetPresence(ctx, ids)
+	if err != nil {
+		log.Printf("Presence lookup failed, returning users without presence: %v", err)
+	}
+	for i, user := range users {
+		status, ok := statuses[ids[i]]
+		if !ok || status == "" {
+			status = PresenceUnknown
+		}
+		user.Status = status
+	}
+}
+
+// organizationUsersWithStatus returns the page of filter's users whose presence is
+// filter.Status, in the usual name order
+func (uc *AuthUsecase) organizationUsersWithStatus(ctx context.Context, orgID uuid.UUID, filter UserListFilter) ([]*User, error) {
+	var users []*User
+	skip := filter.Offset
+	err := uc.scanUsersByStatus(ctx, orgID, filter, func(user *User) bool {
+		if skip > 0 {
+			skip--
+			return true
+		}
+		users = append(users, user)
+		return filter.Limit == 0 || len(users) < filter.Limit
+	})
+	return users, err
+}
+
+// scanUsersByStatus walks the organization's users matching filter's other criteria in
+// name order, a batch at a time, and calls visit with each one whose presence is
+// filter.Status until visit returns false. Presence is fetched for every user
+// scanned, so unlike the other filters this one costs more the larger the organization.
+func (uc *AuthUsecase) scanUsersByStatus(ctx context.Context, orgID uuid.UUID, filter UserListFilter, visit func(*User) bool) error {
+	batchFilter := filter
+	batchFilter.Limit = presenceFilterBatch
+	batchFilter.Offset = 0
+
+	for {
+		batch, err := uc.repo.GetOrganizationUsers(ctx, orgID, batchFilter)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]string, len(batch))
+		for i, user := range batch {
+			ids[i] = user.ID.String()
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, presenceLookupTimeout)
+		statuses, err := uc.presence.GetPresence(lookupCtx, ids)
+		cancel()
+		if err != nil {
+			log.Printf("Presence lookup failed while filtering users by status: %v", err)
+			return ErrPresenceUnavailable
+		}
+
+		for i, user := range batch {
+			if statuses[ids[i]] != filter.Status {
+				continue
+			}
+			user.Status = filter.Status
+			if !visit(user) {
+				return nil
+			}
+		}
+
+		if len(batch) < presenceFilterBatch {
+			return nil
+		}
+		batchFilter.Offset += presenceFilterBatch
+	}
+}
@@ -0,0 +1,96 @@
+package biz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// listRepo pages through an organization's users, already in name order
+type listRepo struct {
+	AuthRepo
+	users []*User
+}
+
+func (r *listRepo) GetOrganizationUsers(ctx context.Context, orgID uuid.UUID, filter UserListFilter) ([]*User, error) {
+	if filter.Offset >= len(r.users) {
+		return nil, nil
+	}
+	users := r.users[filter.Offset:]
+	if filter.Limit > 0 && len(users) > filter.Limit {
+		users = users[:filter.Limit]
+	}
+	return users, nil
+}
+
+// fixedPresence reports the statuses it was given, or err
+type fixedPresence struct {
+	statuses map[string]string
+	err      error
+}
+
+func (p *fixedPresence) GetPresence(ctx context.Context, userIDs []string) (map[string]string, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.statuses, nil
+}
+
+func TestOrganizationUsersByStatus(t *testing.T) {
+	// More users than fit in one presence batch; every third one is online
+	var users []*User
+	statuses := make(map[string]string)
+	var online []uuid.UUID
+	for i := 0; i < presenceFilterBatch+50; i++ {
+		user := &User{ID: uuid.New(), DisplayName: fmt.Sprintf("user %03d", i)}
+		users = append(users, user)
+		statuses[user.ID.String()] = "offline"
+		if i%3 == 0 {
+			statuses[user.ID.String()] = "online"
+			online = append(online, user.ID)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		filter      UserListFilter
+		presenceErr error
+		want        []uuid.UUID
+		wantErr     error
+	}{
+		{"first page", UserListFilter{Status: "online", Limit: 5}, nil, online[:5], nil},
+		{"page spanning batches", UserListFilter{Status: "online", Limit: 10, Offset: 60}, nil, online[60:70], nil},
+		{"everything", UserListFilter{Status: "online"}, nil, online, nil},
+		{"past the end", UserListFilter{Status: "online", Limit: 10, Offset: len(online)}, nil, nil, nil},
+		{"presence unavailable", UserListFilter{Status: "online", Limit: 5}, errors.New("connection refused"), nil, ErrPresenceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uc := &AuthUsecase{repo: &listRepo{users: users}, presence: &fixedPresence{statuses: statuses, err: tt.presenceErr}}
+
+			got, err := uc.GetOrganizationUsers(context.Background(), uuid.New(), tt.filter)
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d users, want %d", len(got), len(tt.want))
+			}
+			for i, user := range got {
+				if user.ID != tt.want[i] || user.Status != "online" {
+					t.Errorf("user %d is %s (%s), want %s", i, user.ID, user.Status, tt.want[i])
+				}
+			}
+
+			if tt.wantErr == nil {
+				total, err := uc.CountOrganizationUsers(context.Background(), uuid.New(), tt.filter)
+				if err != nil || total != len(online) {
+					t.Errorf("got total %d (%v), want %d", total, err, len(online))
+				}
+			}
+		})
+	}
+}
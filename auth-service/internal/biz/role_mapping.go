@@ -0,0 +1,77 @@
+package biz
+
+import (
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ParseRoleMapping parses a mapping of Keycloak roles or groups to application roles
+// in the form "keycloak-role:admin,/group-path:member". Entries with an unknown
+// application role are ignored.
+func ParseRoleMapping(value string) map[string]UserRole {
+	mapping := make(map[string]UserRole)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		idx := strings.LastIndex(entry, ":")
+		if idx <= 0 {
+			continue
+		}
+
+		role := UserRole(strings.TrimSpace(entry[idx+1:]))
+		if role != UserRoleAdmin && role != UserRoleMember {
+			continue
+		}
+		mapping[strings.TrimSpace(entry[:idx])] = role
+	}
+	return mapping
+}
+
+// keycloakRoles extracts realm roles, roles of the configured client and group
+// paths from a Keycloak access token. The token comes straight from Keycloak's
+// token endpoint over the back channel, so its signature isn't re-verified here.
+func keycloakRoles(accessToken, clientID string) []string {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(accessToken, claims); err != nil {
+		return nil
+	}
+
+	var roles []string
+	if realmAccess, ok := claims["realm_access"].(map[string]interface{}); ok {
+		roles = append(roles, stringSlice(realmAccess["roles"])...)
+	}
+	if resourceAccess, ok := claims["resource_access"].(map[string]interface{}); ok {
+		if client, ok := resourceAccess[clientID].(map[string]interface{}); ok {
+			roles = append(roles, stringSlice(client["roles"])...)
+		}
+	}
+	roles = append(roles, stringSlice(claims["groups"])...)
+
+	return roles
+}
+
+// mapKeycloakRole returns the most privileged application role any of the given
+// Keycloak roles map to, defaulting to member when nothing matches
+func mapKeycloakRole(roles []string, mapping map[string]UserRole) UserRole {
+	for _, r := range roles {
+		if mapping[r] == UserRoleAdmin {
+			return UserRoleAdmin
+		}
+	}
+	return UserRoleMember
+}
+
+func stringSlice(value interface{}) []string {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var result []string
+	for _, item := range items {
+		if str, ok := item.(string); ok {
+			result = append(result, str)
+		}
+	}
+	return result
+}
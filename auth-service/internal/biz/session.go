@@ -0,0 +1,189 @@
+package biz
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrRefreshTokenReused means a refresh token was presented after it had already
+	// been exchanged, so it may have been stolen; the session is revoked
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// Session limits used when JWTConfig leaves them unset
+const (
+	DefaultRefreshTokenTTL = 14 * 24 * time.Hour
+	DefaultSessionMaxAge   = 30 * 24 * time.Hour
+)
+
+// SessionTokens are handed out when a session starts or is refreshed. The access
+// token authenticates API calls until it expires; the refresh token gets the next
+// pair from /auth/refresh and is replaced every time it is used.
+type SessionTokens struct {
+	AccessToken  string
+	RefreshToken string
+}
+
+// ClientInfo describes the device a session was started from
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+// Session is one login of a user. Each access token carries its session's ID, so
+// revoking the session invalidates every token issued for it.
+type Session struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"-"`
+	UserAgent  string     `json:"user_agent,omitempty"`
+	IP         string     `json:"ip,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"-"`
+	// RefreshTokenHash is the SHA-256 of the session's current refresh token
+	RefreshTokenHash string `json:"-"`
+	// Current marks the session the listing was requested from
+	Current bool `json:"current"`
+}
+
+// maxUserAgentLength keeps a hostile client from storing an arbitrarily long header
+const maxUserAgentLength = 512
+
+// startSession records a new session for the user and issues its first tokens
+func (uc *AuthUsecase) startSession(ctx context.Context, user *User, client ClientInfo) (*SessionTokens, error) {
+	userAgent := client.UserAgent
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	sessionID := uuid.New()
+	refreshToken, err := newRefreshToken(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:               sessionID,
+		UserID:           user.ID,
+		UserAgent:        userAgent,
+		IP:               client.IP,
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		RefreshTokenHash: hashRefreshToken(refreshToken),
+	}
+	if err := uc.repo.CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := uc.generateToken(user, session.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	return &SessionTokens{AccessToken: accessToken, RefreshToken: refreshToken}, nil
+}
+
+// RefreshSession exchanges a refresh token for a new access token and refresh token.
+// It fails with ErrSessionNotFound once the session is revoked, has gone unused for
+// longer than the refresh token TTL or is older than the session's maximum age, so
+// a session can't be extended forever. An already exchanged refresh token ends the
+// session and fails with ErrRefreshTokenReused.
+func (uc *AuthUsecase) RefreshSession(ctx context.Context, refreshToken string) (*SessionTokens, error) {
+	idPart, _, ok := strings.Cut(refreshToken, ".")
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	sessionID, err := uuid.Parse(idPart)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+
+	next, err := newRefreshToken(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	userID, err := uc.repo.RotateRefreshToken(ctx, sessionID, hashRefreshToken(refreshToken), hashRefreshToken(next),
+		now.Add(-uc.refreshTokenTTL), now.Add(-uc.sessionMaxAge))
+	if err == ErrRefreshTokenReused {
+		log.Printf("Refresh token of session %s was reused, session revoked", sessionID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := uc.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := uc.generateToken(user, sessionID.String())
+	if err != nil {
+		return nil, err
+	}
+	return &SessionTokens{AccessToken: accessToken, RefreshToken: next}, nil
+}
+
+// newRefreshToken returns a random refresh token for the session. The session ID
+// prefix lets RefreshSession find the session without a lookup by token.
+func newRefreshToken(sessionID uuid.UUID) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return sessionID.String() + "." + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// hashRefreshToken is what is stored of a refresh token, so a database leak doesn't
+// hand out working sessions
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ListSessions returns the user's sessions that are neither revoked nor expired,
+// most recently used first. currentSessionID, if it is one of them, is marked current.
+func (uc *AuthUsecase) ListSessions(ctx context.Context, userID uuid.UUID, currentSessionID string) ([]*Session, error) {
+	now := time.Now()
+	sessions, err := uc.repo.GetActiveSessions(ctx, userID, now.Add(-uc.refreshTokenTTL), now.Add(-uc.sessionMaxAge))
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		session.Current = session.ID.String() == currentSessionID
+	}
+	return sessions, nil
+}
+
+// RevokeSession ends one of the user's own sessions
+func (uc *AuthUsecase) RevokeSession(ctx context.Context, userID uuid.UUID, sessionID uuid.UUID) error {
+	revoked, err := uc.repo.RevokeSession(ctx, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeOtherSessions ends all of the user's sessions except the current one and
+// returns how many were ended
+func (uc *AuthUsecase) RevokeOtherSessions(ctx context.Context, userID uuid.UUID, currentSessionID string) (int, error) {
+	current, err := uuid.Parse(currentSessionID)
+	if err != nil {
+		// A token without a session can't be kept apart from the others
+		return 0, ErrSessionNotFound
+	}
+	return uc.repo.RevokeOtherSessions(ctx, userID, current)
+}
@@ -0,0 +1,362 @@
+package biz
+
+import (
+	"github.com/google/uuid"
+
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTOTPRequired       = errors.New("two-factor code required")
+	ErrInvalidTOTPCode    = errors.New("invalid two-factor code")
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotEnrolled    = errors.New("two-factor authentication has not been enrolled")
+	ErrTOTPNotEnabled     = errors.New("two-factor authentication is not enabled")
+	// ErrTOTPLocked means too many wrong two-factor codes were tried in a row and
+	// sign-in is refused for a while
+	ErrTOTPLocked = errors.New("too many failed two-factor attempts")
+)
+
+// TOTP parameters, the ones authenticator apps assume when the otpauth URL leaves
+// them out: HMAC-SHA1, 6 digits, 30 second steps
+const (
+	totpDigits     = 6
+	totpPeriod     = 30
+	totpSecretSize = 20
+	// totpSkew accepts codes from one step either side of now to allow for clock drift
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+
+	// After totpMaxFailures wrong codes in a row sign-in is locked for totpLockout.
+	// Each further wrong code doubles the lock, up to totpMaxLockout, so the code
+	// space can't be guessed through.
+	totpMaxFailures = 5
+	totpLockout     = time.Minute
+	totpMaxLockout  = time.Hour
+)
+
+// TOTPConfig controls two-factor authentication
+type TOTPConfig struct {
+	// Issuer is the account label authenticator apps show
+	Issuer string `yaml:"issuer"`
+	// EncryptionKey encrypts TOTP secrets at rest. The JWT secret is used when unset.
+	EncryptionKey string `yaml:"encryption_key"`
+}
+
+// TOTPState is a user's two-factor setup. Secret is encrypted; EnabledAt is nil
+// while an enrollment waits to be verified.
+type TOTPState struct {
+	Secret    string
+	EnabledAt *time.Time
+	// LockedUntil is set while sign-in is locked after too many wrong codes
+	LockedUntil *time.Time
+}
+
+type TOTPEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURL string `json:"otpauth_url"`
+}
+
+type VerifyTOTPRequest struct {
+	Code string `json:"code"`
+}
+
+type VerifyTOTPResponse struct {
+	// RecoveryCodes each work once in place of a code and are only returned here
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type DisableTOTPRequest struct {
+	Password string `json:"password"`
+}
+
+// EnrollTOTP starts two-factor enrollment with a fresh secret. It only takes effect
+// once a code from it is verified; enrolling again before then replaces the secret.
+func (uc *AuthUsecase) EnrollTOTP(ctx context.Context, userID uuid.UUID) (*TOTPEnrollment, error) {
+	user, err := uc.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	state, err := uc.repo.GetTOTP(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if state != nil && state.EnabledAt != nil {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	raw := make([]byte, totpSecretSize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+
+	encrypted, err := uc.encryptTOTPSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+	if err := uc.repo.SetTOTPSecret(ctx, userID, encrypted); err != nil {
+		return nil, err
+	}
+
+	label := url.PathEscape(uc.totpIssuer + ":" + user.Email)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", uc.totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	return &TOTPEnrollment{
+		Secret:     secret,
+		OTPAuthURL: "otpauth://totp/" + label + "?" + query.Encode(),
+	}, nil
+}
+
+// VerifyTOTP activates a pending enrollment once the user proves their authenticator
+// has the secret, and returns a new set of recovery codes
+func (uc *AuthUsecase) VerifyTOTP(ctx context.Context, userID uuid.UUID, req *VerifyTOTPRequest) (*VerifyTOTPResponse, error) {
+	state, err := uc.repo.GetTOTP(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if state.EnabledAt != nil {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+
+	if err := uc.checkTOTPCode(ctx, userID, state, req.Code); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = generateRecoveryCode(); err != nil {
+			return nil, err
+		}
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	if err := uc.repo.EnableTOTP(ctx, userID, hashes); err != nil {
+		return nil, err
+	}
+	return &VerifyTOTPResponse{RecoveryCodes: codes}, nil
+}
+
+// DisableTOTP turns two-factor authentication off after checking the user's password
+func (uc *AuthUsecase) DisableTOTP(ctx context.Context, userID uuid.UUID, req *DisableTOTPRequest) error {
+	user, err := uc.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := checkPassword(user.PasswordHash, req.Password); err != nil {
+		return err
+	}
+
+	state, err := uc.repo.GetTOTP(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return ErrTOTPNotEnabled
+	}
+	return uc.repo.DisableTOTP(ctx, userID)
+}
+
+// checkSecondFactor is called once a user's password has been verified. Users with
+// two-factor authentication enabled must also give a current code or an unused
+// recovery code.
+func (uc *AuthUsecase) checkSecondFactor(ctx context.Context, user *User, code, recoveryCode string) error {
+	state, err := uc.repo.GetTOTP(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if state == nil || state.EnabledAt == nil {
+		return nil
+	}
+	if state.LockedUntil != nil && time.Now().Before(*state.LockedUntil) {
+		return ErrTOTPLocked
+	}
+
+	if recoveryCode = strings.TrimSpace(recoveryCode); recoveryCode != "" {
+		used, err := uc.repo.UseRecoveryCode(ctx, user.ID, hashRecoveryCode(recoveryCode))
+		if err != nil {
+			return err
+		}
+		if !used {
+			return uc.recordTOTPFailure(ctx, user.ID)
+		}
+		log.Printf("User %s signed in with a recovery code", user.ID)
+		return uc.repo.ResetTOTPFailures(ctx, user.ID)
+	}
+
+	if strings.TrimSpace(code) == "" {
+		return ErrTOTPRequired
+	}
+	if err := uc.checkTOTPCode(ctx, user.ID, state, code); err != nil {
+		if err == ErrInvalidTOTPCode {
+			return uc.recordTOTPFailure(ctx, user.ID)
+		}
+		return err
+	}
+	return uc.repo.ResetTOTPFailures(ctx, user.ID)
+}
+
+// recordTOTPFailure counts a wrong code or recovery code and locks sign-in once
+// there have been too many in a row. It returns the error to report for the attempt.
+func (uc *AuthUsecase) recordTOTPFailure(ctx context.Context, userID uuid.UUID) error {
+	failures, err := uc.repo.RecordTOTPFailure(ctx, userID)
+	if err != nil {
+		return err
+	}
+	lockout := totpLockoutFor(failures)
+	if lockout == 0 {
+		return ErrInvalidTOTPCode
+	}
+
+	log.Printf("Locking two-factor sign-in of user %s for %s after %d failed attempts", userID, lockout, failures)
+	if err := uc.repo.LockTOTP(ctx, userID, time.Now().Add(lockout)); err != nil {
+		return err
+	}
+	return ErrTOTPLocked
+}
+
+// totpLockoutFor returns how long sign-in is locked after the given number of wrong
+// codes in a row, zero while it isn't
+func totpLockoutFor(failures int) time.Duration {
+	if failures < totpMaxFailures {
+		return 0
+	}
+	lockout := totpLockout
+	for i := totpMaxFailures; i < failures && lockout < totpMaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > totpMaxLockout {
+		lockout = totpMaxLockout
+	}
+	return lockout
+}
+
+// checkTOTPCode validates a code against the user's secret. Each time step can only
+// be used once, so a code seen by someone else can't be replayed.
+func (uc *AuthUsecase) checkTOTPCode(ctx context.Context, userID uuid.UUID, state *TOTPState, code string) error {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return ErrInvalidTOTPCode
+	}
+
+	secret, err := uc.decryptTOTPSecret(state.Secret)
+	if err != nil {
+		return err
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return err
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if !hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			continue
+		}
+		claimed, err := uc.repo.ClaimTOTPStep(ctx, userID, step)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return ErrInvalidTOTPCode
+		}
+		return nil
+	}
+	return ErrInvalidTOTPCode
+}
+
+// totpCode computes the RFC 6238 code for a time step
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// generateRecoveryCode returns a code like "3f9a1-c07be"
+func generateRecoveryCode() (string, error) {
+	raw := make([]byte, 5)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(raw)
+	return code[:5] + "-" + code[5:], nil
+}
+
+// hashRecoveryCode hashes a recovery code for storage. The codes are random enough
+// that a fast hash is sufficient.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+func (uc *AuthUsecase) totpCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(uc.totpKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptTOTPSecret seals a secret with AES-GCM, storing the nonce in front of it
+func (uc *AuthUsecase) encryptTOTPSecret(secret string) (string, error) {
+	aead, err := uc.totpCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func (uc *AuthUsecase) decryptTOTPSecret(encrypted string) (string, error) {
+	aead, err := uc.totpCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed TOTP secret")
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting TOTP secret: %w", err)
+	}
+	return string(secret), nil
+}
@@ -0,0 +1,159 @@
+package biz
+
+import (
+	"context"
+	"encoding/base32"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// totpRepo keeps one user's two-factor state in memory; methods checkSecondFactor
+// doesn't use are left to the embedded nil interface
+type totpRepo struct {
+	AuthRepo
+	state    *TOTPState
+	failures int
+	lastStep int64
+}
+
+func (r *totpRepo) GetTOTP(ctx context.Context, userID uuid.UUID) (*TOTPState, error) {
+	state := *r.state
+	return &state, nil
+}
+
+func (r *totpRepo) ClaimTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	if step <= r.lastStep {
+		return false, nil
+	}
+	r.lastStep = step
+	return true, nil
+}
+
+func (r *totpRepo) UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error) {
+	return false, nil
+}
+
+func (r *totpRepo) RecordTOTPFailure(ctx context.Context, userID uuid.UUID) (int, error) {
+	r.failures++
+	return r.failures, nil
+}
+
+func (r *totpRepo) ResetTOTPFailures(ctx context.Context, userID uuid.UUID) error {
+	r.failures = 0
+	r.state.LockedUntil = nil
+	return nil
+}
+
+func (r *totpRepo) LockTOTP(ctx context.Context, userID uuid.UUID, until time.Time) error {
+	r.state.LockedUntil = &until
+	return nil
+}
+
+func TestCheckSecondFactorLockout(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)
+	validCode := func() string { return totpCode(key, time.Now().Unix()/totpPeriod) }
+
+	type attempt struct {
+		code     string
+		recovery string
+		want     error
+	}
+	wrong := attempt{code: "000000", want: ErrInvalidTOTPCode}
+
+	tests := []struct {
+		name     string
+		attempts []attempt
+		// validLast replaces the last attempt's code with one that is currently valid
+		validLast    bool
+		wantFailures int
+		wantLocked   bool
+	}{
+		{
+			name:         "wrong codes below the limit",
+			attempts:     []attempt{wrong, wrong, wrong, wrong},
+			wantFailures: 4,
+		},
+		{
+			name:         "limit reached locks sign-in",
+			attempts:     []attempt{wrong, wrong, wrong, wrong, {code: "000000", want: ErrTOTPLocked}},
+			wantFailures: 5,
+			wantLocked:   true,
+		},
+		{
+			name:         "locked sign-in refuses even a valid code",
+			attempts:     []attempt{wrong, wrong, wrong, wrong, {code: "000000", want: ErrTOTPLocked}, {want: ErrTOTPLocked}},
+			validLast:    true,
+			wantFailures: 5,
+			wantLocked:   true,
+		},
+		{
+			name:         "wrong recovery codes count too",
+			attempts:     []attempt{wrong, wrong, wrong, wrong, {recovery: "abcd-efgh", want: ErrTOTPLocked}},
+			wantFailures: 5,
+			wantLocked:   true,
+		},
+		{
+			name:      "valid code clears the count",
+			attempts:  []attempt{wrong, wrong, {want: nil}},
+			validLast: true,
+		},
+		{
+			name:     "missing code isn't a failure",
+			attempts: []attempt{{want: ErrTOTPRequired}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uc := &AuthUsecase{totpKey: "test-key"}
+			encrypted, err := uc.encryptTOTPSecret(secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			enabledAt := time.Now()
+			repo := &totpRepo{state: &TOTPState{Secret: encrypted, EnabledAt: &enabledAt}}
+			uc.repo = repo
+			user := &User{ID: uuid.New()}
+
+			for i, a := range tt.attempts {
+				code := a.code
+				if tt.validLast && i == len(tt.attempts)-1 {
+					code = validCode()
+				}
+				if err := uc.checkSecondFactor(context.Background(), user, code, a.recovery); err != a.want {
+					t.Fatalf("attempt %d: got %v, want %v", i, err, a.want)
+				}
+			}
+
+			if repo.failures != tt.wantFailures {
+				t.Errorf("got %d failures, want %d", repo.failures, tt.wantFailures)
+			}
+			if locked := repo.state.LockedUntil != nil; locked != tt.wantLocked {
+				t.Errorf("got locked %v, want %v", locked, tt.wantLocked)
+			}
+		})
+	}
+}
+
+func TestTOTPLockoutFor(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{totpMaxFailures - 1, 0},
+		{totpMaxFailures, totpLockout},
+		{totpMaxFailures + 1, 2 * totpLockout},
+		{totpMaxFailures + 3, 8 * totpLockout},
+		{totpMaxFailures + 20, totpMaxLockout},
+	}
+
+	for _, tt := range tests {
+		if got := totpLockoutFor(tt.failures); got != tt.want {
+			t.Errorf("totpLockoutFor(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
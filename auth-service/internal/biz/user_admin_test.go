@@ -0,0 +1,84 @@
+package biz
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// adminRepo records the user updates, deletions and audit events an admin causes
+type adminRepo struct {
+	resetRepo
+	updated []uuid.UUID
+	deleted []uuid.UUID
+	events  []*AuditEvent
+}
+
+func (r *adminRepo) UpdateUser(ctx context.Context, id uuid.UUID, req *UpdateUserRequest) error {
+	r.updated = append(r.updated, id)
+	if req.DisplayName != nil {
+		r.users[id].DisplayName = *req.DisplayName
+	}
+	return nil
+}
+
+func (r *adminRepo) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	r.deleted = append(r.deleted, id)
+	return nil
+}
+
+func (r *adminRepo) CreateAuditEvent(ctx context.Context, event *AuditEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func TestAdminUserChangesStayInOrganization(t *testing.T) {
+	orgID := uuid.New()
+	admin := &User{ID: uuid.New(), OrganizationID: orgID, Role: UserRoleAdmin}
+
+	tests := []struct {
+		name    string
+		target  *User
+		wantErr error
+	}{
+		{"user in the admin's organization", &User{ID: uuid.New(), OrganizationID: orgID, Role: UserRoleMember}, nil},
+		{"user in another organization", &User{ID: uuid.New(), OrganizationID: uuid.New(), Role: UserRoleMember}, ErrUserNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newRepo := func() *adminRepo {
+				target := *tt.target
+				return &adminRepo{resetRepo: resetRepo{users: map[uuid.UUID]*User{admin.ID: admin, target.ID: &target}}}
+			}
+			name := "Renamed"
+			update := func(uc *AuthUsecase) error {
+				return uc.UpdateUser(context.Background(), admin.ID, tt.target.ID, &UpdateUserRequest{DisplayName: &name})
+			}
+			remove := func(uc *AuthUsecase) error {
+				return uc.DeleteUser(context.Background(), admin.ID, tt.target.ID)
+			}
+
+			for action, do := range map[string]func(*AuthUsecase) error{"update": update, "delete": remove} {
+				repo := newRepo()
+				err := do(&AuthUsecase{repo: repo})
+				if err != tt.wantErr {
+					t.Fatalf("%s: got error %v, want %v", action, err, tt.wantErr)
+				}
+				if tt.wantErr != nil {
+					if len(repo.updated) != 0 || len(repo.deleted) != 0 {
+						t.Errorf("%s changed a user in another organization", action)
+					}
+					continue
+				}
+				if len(repo.events) != 1 {
+					t.Fatalf("%s: got %d audit events, want 1", action, len(repo.events))
+				}
+				if event := repo.events[0]; event.OrganizationID != tt.target.OrganizationID || event.TargetID != tt.target.ID.String() {
+					t.Errorf("%s audited under organization %s for %s, want the target's", action, event.OrganizationID, event.TargetID)
+				}
+			}
+		})
+	}
+}
@@ -4,15 +4,16 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/lib/pq"
 	_ "github.com/lib/pq"
 
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/auth-service/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/audit"
 )
 
 type authRepo struct {
@@ -53,12 +54,12 @@ func (r *authRepo) GetUserByEmail(ctx context.Context, email string, orgID uuid.
 	var profileJSON []byte
 
 	query := `
-		SELECT id, organization_id, email, display_name, avatar_url, role, profile, created_at, last_seen_at, password_hash, keycloak_id
+		SELECT id, organization_id, email, display_name, avatar_url, role, profile, created_at, last_seen_at, password_hash, keycloak_id, must_change_password
 		FROM users WHERE email = $1 AND organization_id = $2`
 
 	err := r.db.QueryRowContext(ctx, query, email, orgID).Scan(
 		&user.ID, &user.OrganizationID, &user.Email, &user.DisplayName,
-		&user.AvatarURL, &user.Role, &profileJSON, &user.CreatedAt, &user.LastSeenAt, &user.PasswordHash, &user.KeycloakID)
+		&user.AvatarURL, &user.Role, &profileJSON, &user.CreatedAt, &user.LastSeenAt, &user.PasswordHash, &user.KeycloakID, &user.MustChangePassword)
 
 	if err == sql.ErrNoRows {
 		return nil, biz.ErrUserNotFound
@@ -71,40 +72,48 @@ func (r *authRepo) GetUserByEmail(ctx context.Context, email string, orgID uuid.
 	return user, nil
 }
 
-func (r *authRepo) GetUserByEmailAnyOrg(ctx context.Context, email string) (*biz.User, error) {
-	user := &biz.User{}
-	var profileJSON []byte
-
+func (r *authRepo) GetUsersByEmailAnyOrg(ctx context.Context, email string) ([]*biz.User, error) {
 	query := `
-		SELECT id, organization_id, email, display_name, avatar_url, role, profile, created_at, last_seen_at, password_hash, keycloak_id
-		FROM users WHERE email = $1 ORDER BY created_at DESC LIMIT 1`
-
-	err := r.db.QueryRowContext(ctx, query, email).Scan(
-		&user.ID, &user.OrganizationID, &user.Email, &user.DisplayName,
-		&user.AvatarURL, &user.Role, &profileJSON, &user.CreatedAt, &user.LastSeenAt, &user.PasswordHash, &user.KeycloakID)
+		SELECT id, organization_id, email, display_name, avatar_url, role, profile, created_at, last_seen_at, password_hash, keycloak_id, must_change_password
+		FROM users WHERE email = $1 ORDER BY created_at DESC`
 
-	if err == sql.ErrNoRows {
-		return nil, biz.ErrUserNotFound
-	}
+	rows, err := r.db.QueryContext(ctx, query, email)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	json.Unmarshal(profileJSON, &user.Profile)
-	return user, nil
+	var users []*biz.User
+	for rows.Next() {
+		user := &biz.User{}
+		var profileJSON []byte
+
+		err := rows.Scan(
+			&user.ID, &user.OrganizationID, &user.Email, &user.DisplayName,
+			&user.AvatarURL, &user.Role, &profileJSON, &user.CreatedAt, &user.LastSeenAt,
+			&user.PasswordHash, &user.KeycloakID, &user.MustChangePassword)
+		if err != nil {
+			return nil, err
+		}
+
+		json.Unmarshal(profileJSON, &user.Profile)
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
 }
 
-func (r *authRepo) GetUserByID(ctx context.Context, id int) (*biz.User, error) {
+func (r *authRepo) GetUserByID(ctx context.Context, id uuid.UUID) (*biz.User, error) {
 	user := &biz.User{}
 	var profileJSON []byte
 
 	query := `
-		SELECT id, organization_id, email, display_name, avatar_url, role, profile, created_at, last_seen_at, password_hash, keycloak_id
+		SELECT id, organization_id, email, display_name, avatar_url, role, profile, created_at, last_seen_at, password_hash, keycloak_id, must_change_password
 		FROM users WHERE id = $1`
 
 	err := r.db.QueryRowContext(ctx, query, id).Scan(
 		&user.ID, &user.OrganizationID, &user.Email, &user.DisplayName,
-		&user.AvatarURL, &user.Role, &profileJSON, &user.CreatedAt, &user.LastSeenAt, &user.PasswordHash, &user.KeycloakID)
+		&user.AvatarURL, &user.Role, &profileJSON, &user.CreatedAt, &user.LastSeenAt, &user.PasswordHash, &user.KeycloakID, &user.MustChangePassword)
 
 	if err == sql.ErrNoRows {
 		return nil, biz.ErrUserNotFound
@@ -122,12 +131,12 @@ func (r *authRepo) GetUserByKeycloakID(ctx context.Context, keycloakID string) (
 	var profileJSON []byte
 
 	query := `
-		SELECT id, organization_id, email, display_name, avatar_url, role, profile, created_at, last_seen_at, password_hash, keycloak_id
+		SELECT id, organization_id, email, display_name, avatar_url, role, profile, created_at, last_seen_at, password_hash, keycloak_id, must_change_password
 		FROM users WHERE keycloak_id = $1`
 
 	err := r.db.QueryRowContext(ctx, query, keycloakID).Scan(
 		&user.ID, &user.OrganizationID, &user.Email, &user.DisplayName,
-		&user.AvatarURL, &user.Role, &profileJSON, &user.CreatedAt, &user.LastSeenAt, &user.PasswordHash, &user.KeycloakID)
+		&user.AvatarURL, &user.Role, &profileJSON, &user.CreatedAt, &user.LastSeenAt, &user.PasswordHash, &user.KeycloakID, &user.MustChangePassword)
 
 	if err == sql.ErrNoRows {
 		return nil, biz.ErrUserNotFound
@@ -140,12 +149,412 @@ func (r *authRepo) GetUserByKeycloakID(ctx context.Context, keycloakID string) (
 	return user, nil
 }
 
-func (r *authRepo) UpdateLastSeen(ctx context.Context, userID int) error {
+func (r *authRepo) UpdateLastSeen(ctx context.Context, userID uuid.UUID) error {
 	query := `UPDATE users SET last_seen_at = NOW() WHERE id = $1`
 	_, err := r.db.ExecContext(ctx, query, userID)
 	return err
 }
 
+func (r *authRepo) SetKeycloakID(ctx context.Context, userID uuid.UUID, keycloakID string) error {
+	query := `UPDATE users SET keycloak_id = $2 WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, userID, keycloakID)
+	return err
+}
+
+func (r *authRepo) UpdatePasswordHash(ctx context.Context, userID uuid.UUID, passwordHash string) error {
+	query := `UPDATE users SET password_hash = $2 WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, userID, passwordHash)
+	return err
+}
+
+func (r *authRepo) SetPassword(ctx context.Context, userID uuid.UUID, passwordHash string, mustChange bool) error {
+	query := `UPDATE users SET password_hash = $2, must_change_password = $3 WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, userID, passwordHash, mustChange)
+	return err
+}
+
+func (r *authRepo) CountActiveAdmins(ctx context.Context, orgID uuid.UUID) (int, error) {
+	query := `SELECT COUNT(*) FROM users WHERE organization_id = $1 AND role = 'admin' AND NOT must_change_password`
+	var count int
+	err := r.db.QueryRowContext(ctx, query, orgID).Scan(&count)
+	return count, err
+}
+
+// RevokeTokens invalidates the user's access tokens issued before now, ends their
+// sessions and forgets their Keycloak refresh token
+func (r *authRepo) RevokeTokens(ctx context.Context, userID uuid.UUID) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE users SET tokens_revoked_at = now(), keycloak_refresh_token = NULL WHERE id = $1`
+	if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+		return err
+	}
+	query = `UPDATE auth_sessions SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL`
+	if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *authRepo) GetTokensRevokedAt(ctx context.Context, userID uuid.UUID) (*time.Time, error) {
+	var revokedAt *time.Time
+	query := `SELECT tokens_revoked_at FROM users WHERE id = $1`
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, biz.ErrUserNotFound
+	}
+	return revokedAt, err
+}
+
+func (r *authRepo) CreateAuditEvent(ctx context.Context, event *biz.AuditEvent) error {
+	return audit.Record(ctx, r.db, &audit.Entry{
+		OrganizationID: event.OrganizationID,
+		ActorID:        &event.ActorID,
+		Action:         event.Action,
+		TargetType:     event.TargetType,
+		TargetID:       event.TargetID,
+		Details:        event.Details,
+		Changes:        event.Changes,
+		CreatedAt:      event.CreatedAt,
+	})
+}
+
+// UpdateOIDCUser overwrites the fields that are owned by Keycloak
+func (r *authRepo) UpdateOIDCUser(ctx context.Context, userID uuid.UUID, email, displayName string, role biz.UserRole) error {
+	query := `UPDATE users SET email = $2, display_name = $3, role = $4 WHERE id = $1`
+
+	_, err := r.db.ExecContext(ctx, query, userID, email, displayName, role)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return biz.ErrUserExists
+	}
+	return err
+}
+
+func (r *authRepo) GetUserConversationIDs(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	query := `SELECT conversation_id FROM conversation_participants WHERE user_id = $1`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// ConversationAccess reports whether the user participates in the conversation and
+// whether it is locked for them; only its admins may post while it is locked
+func (r *authRepo) ConversationAccess(ctx context.Context, conversationID, userID uuid.UUID) (bool, bool, error) {
+	var locked bool
+	query := `
+		SELECT c.locked AND cp.role <> 'admin'
+		FROM conversation_participants cp
+		INNER JOIN conversations c ON c.id = cp.conversation_id
+		WHERE cp.conversation_id = $1 AND cp.user_id = $2`
+	err := r.db.QueryRowContext(ctx, query, conversationID, userID).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, locked, nil
+}
+
+func (r *authRepo) SharesConversation(ctx context.Context, userID, peerID uuid.UUID) (bool, error) {
+	var shared bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM conversation_participants own
+			INNER JOIN conversation_participants peer ON peer.conversation_id = own.conversation_id
+			WHERE own.user_id = $1 AND peer.user_id = $2
+		)`
+	err := r.db.QueryRowContext(ctx, query, userID, peerID).Scan(&shared)
+	return shared, err
+}
+
+// GetConversationPeerIDs returns everyone who shares at least one conversation with the user
+func (r *authRepo) GetConversationPeerIDs(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	query := `
+		SELECT DISTINCT peer.user_id
+		FROM conversation_participants own
+		INNER JOIN conversation_participants peer ON peer.conversation_id = own.conversation_id
+		WHERE own.user_id = $1 AND peer.user_id <> own.user_id`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func (r *authRepo) GetKeycloakRefreshToken(ctx context.Context, userID uuid.UUID) (string, error) {
+	var refreshToken sql.NullString
+	query := `SELECT keycloak_refresh_token FROM users WHERE id = $1`
+
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&refreshToken)
+	if err == sql.ErrNoRows {
+		return "", biz.ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return refreshToken.String, nil
+}
+
+func (r *authRepo) SetKeycloakRefreshToken(ctx context.Context, userID uuid.UUID, refreshToken string) error {
+	query := `UPDATE users SET keycloak_refresh_token = NULLIF($2, '') WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, userID, refreshToken)
+	return err
+}
+
+func (r *authRepo) GetTOTP(ctx context.Context, userID uuid.UUID) (*biz.TOTPState, error) {
+	var secret sql.NullString
+	state := &biz.TOTPState{}
+	query := `SELECT totp_secret, totp_enabled_at, totp_locked_until FROM users WHERE id = $1`
+
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&secret, &state.EnabledAt, &state.LockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, biz.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !secret.Valid {
+		return nil, nil
+	}
+
+	state.Secret = secret.String
+	return state, nil
+}
+
+func (r *authRepo) RecordTOTPFailure(ctx context.Context, userID uuid.UUID) (int, error) {
+	var failures int
+	query := `UPDATE users SET totp_failed_attempts = totp_failed_attempts + 1 WHERE id = $1 RETURNING totp_failed_attempts`
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&failures)
+	if err == sql.ErrNoRows {
+		return 0, biz.ErrUserNotFound
+	}
+	return failures, err
+}
+
+func (r *authRepo) ResetTOTPFailures(ctx context.Context, userID uuid.UUID) error {
+	query := `
+		UPDATE users SET totp_failed_attempts = 0, totp_locked_until = NULL
+		WHERE id = $1 AND (totp_failed_attempts <> 0 OR totp_locked_until IS NOT NULL)`
+	_, err := r.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+func (r *authRepo) LockTOTP(ctx context.Context, userID uuid.UUID, until time.Time) error {
+	_, err := r.db.ExecContext(ctx, `UPDATE users SET totp_locked_until = $2 WHERE id = $1`, userID, until)
+	return err
+}
+
+func (r *authRepo) SetTOTPSecret(ctx context.Context, userID uuid.UUID, encryptedSecret string) error {
+	query := `UPDATE users SET totp_secret = $2, totp_enabled_at = NULL, totp_last_step = NULL WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, userID, encryptedSecret)
+	return err
+}
+
+func (r *authRepo) EnableTOTP(ctx context.Context, userID uuid.UUID, recoveryCodeHashes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET totp_enabled_at = now() WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO totp_recovery_codes (user_id, code_hash)
+		SELECT $1, unnest($2::text[])`, userID, pq.Array(recoveryCodeHashes)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *authRepo) DisableTOTP(ctx context.Context, userID uuid.UUID) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL WHERE id = $1`
+	if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *authRepo) ClaimTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	query := `
+		UPDATE users SET totp_last_step = $2
+		WHERE id = $1 AND (totp_last_step IS NULL OR totp_last_step < $2)`
+
+	result, err := r.db.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (r *authRepo) UseRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error) {
+	query := `
+		UPDATE totp_recovery_codes SET used_at = now()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+
+	result, err := r.db.ExecContext(ctx, query, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (r *authRepo) CreateSession(ctx context.Context, session *biz.Session) error {
+	query := `
+		INSERT INTO auth_sessions (id, user_id, user_agent, ip, created_at, last_used_at, refresh_token_hash)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7)`
+
+	_, err := r.db.ExecContext(ctx, query,
+		session.ID, session.UserID, session.UserAgent, session.IP, session.CreatedAt, session.LastUsedAt, session.RefreshTokenHash)
+	return err
+}
+
+func (r *authRepo) IsSessionActive(ctx context.Context, sessionID uuid.UUID, createdSince time.Time) (bool, error) {
+	var active bool
+	query := `SELECT EXISTS (SELECT 1 FROM auth_sessions WHERE id = $1 AND revoked_at IS NULL AND created_at >= $2)`
+	err := r.db.QueryRowContext(ctx, query, sessionID, createdSince).Scan(&active)
+	return active, err
+}
+
+func (r *authRepo) TouchSession(ctx context.Context, sessionID uuid.UUID, userID uuid.UUID) error {
+	query := `UPDATE auth_sessions SET last_used_at = now() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`
+	result, err := r.db.ExecContext(ctx, query, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return biz.ErrSessionNotFound
+	}
+	return nil
+}
+
+func (r *authRepo) RotateRefreshToken(ctx context.Context, sessionID uuid.UUID, presentedHash, nextHash string, usedSince, createdSince time.Time) (uuid.UUID, error) {
+	// Matching on the presented hash makes concurrent refreshes with one token race
+	// for a single rotation; the loser sees a replaced token
+	rotate := `
+		UPDATE auth_sessions
+		SET previous_refresh_token_hash = refresh_token_hash, refresh_token_hash = $3, last_used_at = now()
+		WHERE id = $1 AND refresh_token_hash = $2 AND revoked_at IS NULL
+		  AND last_used_at >= $4 AND created_at >= $5
+		RETURNING user_id`
+
+	var userID uuid.UUID
+	err := r.db.QueryRowContext(ctx, rotate, sessionID, presentedHash, nextHash, usedSince, createdSince).Scan(&userID)
+	if err == nil {
+		return userID, nil
+	}
+	if err != sql.ErrNoRows {
+		return uuid.Nil, err
+	}
+
+	revoke := `
+		UPDATE auth_sessions SET revoked_at = now()
+		WHERE id = $1 AND previous_refresh_token_hash = $2 AND revoked_at IS NULL`
+	result, err := r.db.ExecContext(ctx, revoke, sessionID, presentedHash)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		return uuid.Nil, biz.ErrRefreshTokenReused
+	}
+	return uuid.Nil, biz.ErrSessionNotFound
+}
+
+func (r *authRepo) GetActiveSessions(ctx context.Context, userID uuid.UUID, usedSince, createdSince time.Time) ([]*biz.Session, error) {
+	query := `
+		SELECT id, user_id, COALESCE(user_agent, ''), COALESCE(ip, ''), created_at, last_used_at
+		FROM auth_sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND last_used_at >= $2 AND created_at >= $3
+		ORDER BY last_used_at DESC`
+
+	rows, err := r.db.QueryContext(ctx, query, userID, usedSince, createdSince)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*biz.Session{}
+	for rows.Next() {
+		session := &biz.Session{}
+		if err := rows.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastUsedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (r *authRepo) RevokeSession(ctx context.Context, sessionID uuid.UUID, userID uuid.UUID) (bool, error) {
+	query := `UPDATE auth_sessions SET revoked_at = now() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`
+	result, err := r.db.ExecContext(ctx, query, sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (r *authRepo) RevokeOtherSessions(ctx context.Context, userID uuid.UUID, keep uuid.UUID) (int, error) {
+	query := `UPDATE auth_sessions SET revoked_at = now() WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL`
+	result, err := r.db.ExecContext(ctx, query, userID, keep)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
 func (r *authRepo) CreateOrganization(ctx context.Context, org *biz.Organization) error {
 	settingsJSON, _ := json.Marshal(org.Settings)
 
@@ -167,7 +576,7 @@ func (r *authRepo) GetOrganization(ctx context.Context, id uuid.UUID) (*biz.Orga
 		&org.ID, &org.Name, &settingsJSON, &org.CreatedAt)
 
 	if err == sql.ErrNoRows {
-		return nil, errors.New("organization not found")
+		return nil, biz.ErrOrganizationNotFound
 	}
 	if err != nil {
 		return nil, err
@@ -177,14 +586,92 @@ func (r *authRepo) GetOrganization(ctx context.Context, id uuid.UUID) (*biz.Orga
 	return org, nil
 }
 
-func (r *authRepo) GetOrganizationUsers(ctx context.Context, orgID uuid.UUID) ([]*biz.User, error) {
-	query := `
-		SELECT id, organization_id, email, display_name, avatar_url, role, profile, created_at, last_seen_at, password_hash, keycloak_id
+const organizationSummaryQuery = `
+	SELECT o.id, o.name, o.settings, o.created_at,
+	       COUNT(u.id), COUNT(u.id) FILTER (WHERE u.role = 'admin')
+	FROM organizations o
+	LEFT JOIN users u ON u.organization_id = o.id`
+
+func (r *authRepo) ListOrganizationSummaries(ctx context.Context, limit, offset int) ([]*biz.OrganizationSummary, error) {
+	query := organizationSummaryQuery + `
+		GROUP BY o.id
+		ORDER BY o.created_at, o.id
+		LIMIT NULLIF($1, 0) OFFSET $2`
+
+	rows, err := r.db.QueryContext(ctx, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []*biz.OrganizationSummary{}
+	for rows.Next() {
+		summary, err := scanOrganizationSummary(rows)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+func (r *authRepo) GetOrganizationSummary(ctx context.Context, id uuid.UUID) (*biz.OrganizationSummary, error) {
+	query := organizationSummaryQuery + `
+		WHERE o.id = $1
+		GROUP BY o.id`
+
+	summary, err := scanOrganizationSummary(r.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return nil, biz.ErrOrganizationNotFound
+	}
+	return summary, err
+}
+
+func scanOrganizationSummary(row interface{ Scan(...interface{}) error }) (*biz.OrganizationSummary, error) {
+	summary := &biz.OrganizationSummary{Organization: &biz.Organization{}}
+	var settingsJSON []byte
+	err := row.Scan(&summary.ID, &summary.Name, &settingsJSON, &summary.CreatedAt, &summary.UserCount, &summary.AdminCount)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(settingsJSON, &summary.Settings)
+	return summary, nil
+}
+
+func (r *authRepo) CountOrganizations(ctx context.Context) (int, error) {
+	var count int
+	err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM organizations`).Scan(&count)
+	return count, err
+}
+
+// organizationUsersWhere builds the WHERE clause shared by the org user list and its count
+func organizationUsersWhere(orgID uuid.UUID, filter biz.UserListFilter) (string, []interface{}) {
+	where := "organization_id = $1"
+	args := []interface{}{orgID}
+	if filter.Role != "" {
+		args = append(args, filter.Role)
+		where += fmt.Sprintf(" AND role = $%d", len(args))
+	}
+	if filter.SeenSince != nil {
+		args = append(args, *filter.SeenSince)
+		where += fmt.Sprintf(" AND last_seen_at >= $%d", len(args))
+	}
+	return where, args
+}
+
+func (r *authRepo) GetOrganizationUsers(ctx context.Context, orgID uuid.UUID, filter biz.UserListFilter) ([]*biz.User, error) {
+	where, args := organizationUsersWhere(orgID, filter)
+	query := fmt.Sprintf(`
+		SELECT id, organization_id, email, display_name, avatar_url, role, profile, created_at, last_seen_at, password_hash, keycloak_id, must_change_password
 		FROM users 
-		WHERE organization_id = $1 
-		ORDER BY display_name ASC`
+		WHERE %s 
+		ORDER BY display_name ASC, id ASC`, where)
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit, filter.Offset)
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
 
-	rows, err := r.db.QueryContext(ctx, query, orgID)
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -198,7 +685,7 @@ func (r *authRepo) GetOrganizationUsers(ctx context.Context, orgID uuid.UUID) ([
 		err := rows.Scan(
 			&user.ID, &user.OrganizationID, &user.Email, &user.DisplayName,
 			&user.AvatarURL, &user.Role, &profileJSON, &user.CreatedAt, &user.LastSeenAt,
-			&user.PasswordHash, &user.KeycloakID)
+			&user.PasswordHash, &user.KeycloakID, &user.MustChangePassword)
 		if err != nil {
 			return nil, err
 		}
@@ -210,8 +697,16 @@ func (r *authRepo) GetOrganizationUsers(ctx context.Context, orgID uuid.UUID) ([
 	return users, nil
 }
 
+func (r *authRepo) CountOrganizationUsers(ctx context.Context, orgID uuid.UUID, filter biz.UserListFilter) (int, error) {
+	where, args := organizationUsersWhere(orgID, filter)
+
+	var count int
+	err := r.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE `+where, args...).Scan(&count)
+	return count, err
+}
+
 // UpdateUser updates user information
-func (r *authRepo) UpdateUser(ctx context.Context, userID int, req *biz.UpdateUserRequest) error {
+func (r *authRepo) UpdateUser(ctx context.Context, userID uuid.UUID, req *biz.UpdateUserRequest) error {
 	setParts := []string{}
 	args := []interface{}{}
 	argIndex := 1
@@ -254,7 +749,7 @@ func (r *authRepo) UpdateUser(ctx context.Context, userID int, req *biz.UpdateUs
 }
 
 // DeleteUser soft deletes a user (or hard delete if preferred)
-func (r *authRepo) DeleteUser(ctx context.Context, userID int) error {
+func (r *authRepo) DeleteUser(ctx context.Context, userID uuid.UUID) error {
 	// Hard delete - remove user completely
 	query := `DELETE FROM users WHERE id = $1`
 	_, err := r.db.ExecContext(ctx, query, userID)
@@ -0,0 +1,74 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/auth-service/internal/biz"
+)
+
+type presenceClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewPresenceClient creates a client for the presence-service HTTP API
+func NewPresenceClient(baseURL string) biz.PresenceClient {
+	return &presenceClient{
+		baseURL:    baseURL,
+		httpClient: &http.Client{Timeout: 3 * time.Second},
+	}
+}
+
+func (c *presenceClient) GetPresence(ctx context.Context, userIDs []string) (map[string]string, error) {
+	statuses := make(map[string]string, len(userIDs))
+
+	// The bulk endpoint accepts at most 100 users per call
+	const batchSize = 100
+	for start := 0; start < len(userIDs); start += batchSize {
+		end := start + batchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		body, err := json.Marshal(map[string]interface{}{"user_ids": userIDs[start:end]})
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v1/presence/bulk", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var result map[string]struct {
+			Status string `json:"status"`
+		}
+		err = func() error {
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("presence service returned status %d", resp.StatusCode)
+			}
+			return json.NewDecoder(resp.Body).Decode(&result)
+		}()
+		if err != nil {
+			return nil, err
+		}
+
+		for id, presence := range result {
+			statuses[id] = presence.Status
+		}
+	}
+
+	return statuses, nil
+}
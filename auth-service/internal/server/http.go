@@ -2,28 +2,52 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/auth-service/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/buildinfo"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/mqttacl"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/pagination"
 )
 
 type HTTPServer struct {
 	authUc *biz.AuthUsecase
+	info   *buildinfo.Info
 	router *mux.Router
+	// brokerSecret must be sent by the MQTT broker in X-Broker-Secret; the broker
+	// endpoints deny every request while it is empty
+	brokerSecret string
+	// trustedProxies are the addresses whose X-Forwarded-For is believed
+	trustedProxies []*net.IPNet
+	// internalRouter serves the service-to-service routes, which require
+	// internalSecret in X-Internal-Secret and deny everything while it is empty
+	internalRouter *mux.Router
+	internalSecret string
 }
 
-func NewHTTPServer(authUc *biz.AuthUsecase) *HTTPServer {
+func NewHTTPServer(authUc *biz.AuthUsecase, info *buildinfo.Info, brokerSecret, internalSecret string, trustedProxies []*net.IPNet) *HTTPServer {
 	s := &HTTPServer{
-		authUc: authUc,
-		router: mux.NewRouter(),
+		authUc:         authUc,
+		info:           info,
+		router:         mux.NewRouter(),
+		brokerSecret:   brokerSecret,
+		trustedProxies: trustedProxies,
+		internalRouter: mux.NewRouter(),
+		internalSecret: internalSecret,
 	}
 	s.setupRoutes()
+	s.setupInternalRoutes()
 	return s
 }
 
@@ -33,21 +57,87 @@ func (s *HTTPServer) setupRoutes() {
 	api.HandleFunc("/auth/register", s.handleRegister).Methods("POST")
 	api.HandleFunc("/auth/login", s.handleLogin).Methods("POST")
 	api.HandleFunc("/auth/oidc/login", s.handleOIDCLogin).Methods("POST")
+	api.HandleFunc("/auth/oidc/link", s.handleOIDCLink).Methods("POST")
+	api.HandleFunc("/auth/oidc/refresh", s.authMiddleware(s.handleOIDCRefresh)).Methods("POST")
+	api.HandleFunc("/auth/oidc/logout", s.authMiddleware(s.handleOIDCLogout)).Methods("POST")
 	api.HandleFunc("/auth/validate", s.handleValidateToken).Methods("POST")
-	api.HandleFunc("/auth/me", s.authMiddleware(s.handleGetMe)).Methods("GET")
+	api.HandleFunc("/auth/refresh", s.handleRefreshSession).Methods("POST")
+	api.HandleFunc("/auth/me", s.passwordChangeMiddleware(s.handleGetMe)).Methods("GET")
 	api.HandleFunc("/auth/mqtt-credentials", s.authMiddleware(s.handleMQTTCredentials)).Methods("GET")
+	api.HandleFunc("/auth/mqtt-credentials/refresh", s.authMiddleware(s.handleMQTTCredentials)).Methods("POST")
+
+	// MQTT broker auth plugin endpoints
+	api.HandleFunc("/mqtt/auth", s.brokerMiddleware(s.handleMQTTAuth)).Methods("POST")
+	api.HandleFunc("/mqtt/acl", s.brokerMiddleware(s.handleMQTTACL)).Methods("POST")
+	// Deprecated: the broker auth endpoint's old path, kept until brokers are moved to /mqtt/auth
+	api.HandleFunc("/auth/mqtt/verify", s.brokerMiddleware(s.deprecated("/api/v1/mqtt/auth", s.handleMQTTAuth))).Methods("POST")
 
 	// User management endpoints
 	api.HandleFunc("/auth/users", s.authMiddleware(s.handleGetOrganizationUsers)).Methods("GET")
 	api.HandleFunc("/auth/users/{id}", s.authMiddleware(s.handleGetUser)).Methods("GET")
 	api.HandleFunc("/auth/users/{id}", s.authMiddleware(s.handleUpdateUser)).Methods("PUT")
 	api.HandleFunc("/auth/users/{id}", s.authMiddleware(s.handleDeleteUser)).Methods("DELETE")
+	api.HandleFunc("/auth/users/{id}/reset-password", s.authMiddleware(s.handleResetPassword)).Methods("POST")
+	api.HandleFunc("/auth/me/password", s.passwordChangeMiddleware(s.handleChangePassword)).Methods("PUT")
+
+	// Platform administration across organizations (super admins only)
+	api.HandleFunc("/auth/organizations", s.authMiddleware(s.handleListOrganizations)).Methods("GET")
+	api.HandleFunc("/auth/organizations/{id}", s.authMiddleware(s.handleGetOrganization)).Methods("GET")
+
+	// Sessions
+	api.HandleFunc("/auth/sessions", s.authMiddleware(s.handleListSessions)).Methods("GET")
+	api.HandleFunc("/auth/sessions", s.authMiddleware(s.handleRevokeOtherSessions)).Methods("DELETE")
+	api.HandleFunc("/auth/sessions/{id}", s.authMiddleware(s.handleRevokeSession)).Methods("DELETE")
+
+	// Two-factor authentication
+	api.HandleFunc("/auth/2fa/enroll", s.authMiddleware(s.handleEnrollTOTP)).Methods("POST")
+	api.HandleFunc("/auth/2fa/verify", s.authMiddleware(s.handleVerifyTOTP)).Methods("POST")
+	api.HandleFunc("/auth/2fa", s.authMiddleware(s.handleDisableTOTP)).Methods("DELETE")
 
 	// Health check
 	s.router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	}).Methods("GET")
+
+	// Build and dependency status
+	s.router.HandleFunc("/info", s.info.Handler).Methods("GET")
+}
+
+// setupInternalRoutes registers the service-to-service routes, which are only served
+// on the internal listener and still require the internal secret
+func (s *HTTPServer) setupInternalRoutes() {
+	internal := s.internalRouter.PathPrefix("/api/v1/internal").Subrouter()
+
+	// Used by presence-service's force-offline
+	internal.HandleFunc("/users/{id}/revoke-tokens", s.internalMiddleware(s.handleRevokeUserTokens)).Methods("POST")
+}
+
+// InternalHandler serves the service-to-service routes. It must only be exposed on a
+// listener other services can reach and clients can't.
+func (s *HTTPServer) InternalHandler() http.Handler {
+	return s.internalRouter
+}
+
+// handleRevokeUserTokens kills every API token, session and MQTT credential the user
+// holds, so a client kicked off the broker can't sign back in with them
+func (s *HTTPServer) handleRevokeUserTokens(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	if err := s.authUc.RevokeUserTokens(r.Context(), userID); err != nil {
+		if err == biz.ErrUserNotFound {
+			s.writeError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -55,6 +145,7 @@ func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-User-ID, X-Organization-ID")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
@@ -71,7 +162,7 @@ func (s *HTTPServer) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, token, err := s.authUc.Register(r.Context(), &req)
+	user, tokens, err := s.authUc.Register(r.Context(), &req, s.clientInfo(r))
 	if err != nil {
 		if err == biz.ErrUserExists {
 			s.writeError(w, http.StatusConflict, "User already exists")
@@ -82,8 +173,9 @@ func (s *HTTPServer) handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := map[string]interface{}{
-		"user":  user,
-		"token": token,
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
 	}
 	s.writeJSON(w, http.StatusCreated, response)
 }
@@ -111,19 +203,43 @@ func (s *HTTPServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	user, token, err := s.authUc.Login(r.Context(), &req, orgID)
+	user, tokens, err := s.authUc.Login(r.Context(), &req, orgID, s.clientInfo(r))
 	if err != nil {
+		var ambiguous *biz.AmbiguousOrganizationError
+		if errors.As(err, &ambiguous) {
+			s.writeJSON(w, http.StatusConflict, map[string]interface{}{
+				"error":         "Account exists in multiple organizations, resend with X-Organization-ID",
+				"organizations": ambiguous.Candidates,
+			})
+			return
+		}
 		if err == biz.ErrUserNotFound || err == biz.ErrInvalidPassword {
 			s.writeError(w, http.StatusUnauthorized, "Invalid credentials")
 			return
 		}
+		if err == biz.ErrTOTPRequired {
+			s.writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"error":        "Two-factor code required, resend with totp_code or recovery_code",
+				"2fa_required": true,
+			})
+			return
+		}
+		if err == biz.ErrInvalidTOTPCode {
+			s.writeError(w, http.StatusUnauthorized, "Invalid two-factor code")
+			return
+		}
+		if err == biz.ErrTOTPLocked {
+			s.writeError(w, http.StatusTooManyRequests, "Too many failed two-factor attempts, try again later")
+			return
+		}
 		s.writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	response := map[string]interface{}{
-		"user":  user,
-		"token": token,
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
 	}
 	s.writeJSON(w, http.StatusOK, response)
 }
@@ -182,50 +298,362 @@ func (s *HTTPServer) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, token, err := s.authUc.OIDCLogin(r.Context(), &req, orgID)
+	user, tokens, err := s.authUc.OIDCLogin(r.Context(), &req, orgID, s.clientInfo(r))
 	if err != nil {
-		s.writeError(w, http.StatusUnauthorized, "OIDC authentication failed")
+		var linkRequired *biz.AccountLinkRequiredError
+		if errors.As(err, &linkRequired) {
+			s.writeJSON(w, http.StatusConflict, map[string]interface{}{
+				"error":      "An account with this email already exists, confirm with its password to link",
+				"link_token": linkRequired.LinkToken,
+				"expires_at": linkRequired.ExpiresAt,
+			})
+			return
+		}
+		switch err {
+		case biz.ErrOrganizationNotFound:
+			s.writeError(w, http.StatusNotFound, "Organization not found")
+		case biz.ErrIncompleteOIDCUserInfo:
+			s.writeError(w, http.StatusUnauthorized, "Identity provider did not return a subject and email")
+		case biz.ErrUserExists:
+			s.writeError(w, http.StatusConflict, "Email from identity provider is already used by another account")
+		default:
+			s.writeError(w, http.StatusUnauthorized, "OIDC authentication failed")
+		}
 		return
 	}
 
 	response := map[string]interface{}{
-		"user":  user,
-		"token": token,
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
 	}
 	s.writeJSON(w, http.StatusOK, response)
 }
 
+func (s *HTTPServer) handleOIDCLink(w http.ResponseWriter, r *http.Request) {
+	var req biz.LinkOIDCAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	user, tokens, err := s.authUc.LinkOIDCAccount(r.Context(), &req, s.clientInfo(r))
+	if err != nil {
+		switch err {
+		case biz.ErrInvalidToken:
+			s.writeError(w, http.StatusUnauthorized, "Invalid or expired link token")
+		case biz.ErrInvalidPassword:
+			s.writeError(w, http.StatusUnauthorized, "Invalid credentials")
+		case biz.ErrTOTPRequired:
+			s.writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"error":        "Two-factor code required, resend with totp_code or recovery_code",
+				"2fa_required": true,
+			})
+		case biz.ErrInvalidTOTPCode:
+			s.writeError(w, http.StatusUnauthorized, "Invalid two-factor code")
+		case biz.ErrTOTPLocked:
+			s.writeError(w, http.StatusTooManyRequests, "Too many failed two-factor attempts, try again later")
+		case biz.ErrUserExists:
+			s.writeError(w, http.StatusConflict, "Account is already linked to another identity")
+		default:
+			s.writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	response := map[string]interface{}{
+		"user":          user,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+	}
+	s.writeJSON(w, http.StatusOK, response)
+}
+
+func (s *HTTPServer) handleOIDCRefresh(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*biz.JWTClaims)
+
+	token, err := s.authUc.OIDCRefresh(r.Context(), claims.UserID, claims.SessionID)
+	if err != nil {
+		if err == biz.ErrNoOIDCSession || err == biz.ErrSessionNotFound {
+			s.writeError(w, http.StatusUnauthorized, "Keycloak session has ended, please log in again")
+			return
+		}
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+func (s *HTTPServer) handleOIDCLogout(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*biz.JWTClaims)
+
+	if err := s.authUc.OIDCLogout(r.Context(), claims.UserID); err != nil {
+		if err == biz.ErrNoOIDCSession {
+			s.writeError(w, http.StatusNotFound, "No Keycloak session to log out of")
+			return
+		}
+		s.writeError(w, http.StatusBadGateway, "Failed to end Keycloak session")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"message": "Logged out"})
+}
+
 func (s *HTTPServer) handleMQTTCredentials(w http.ResponseWriter, r *http.Request) {
 	claims := r.Context().Value("claims").(*biz.JWTClaims)
 	userID := claims.UserID
 
-	username, password, err := s.authUc.GenerateMQTTCredentials(r.Context(), userID)
+	credentials, err := s.authUc.GenerateMQTTCredentials(r.Context(), userID)
 	if err != nil {
 		s.writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	response := map[string]interface{}{
-		"username": username,
-		"password": password,
+	s.writeJSON(w, http.StatusOK, credentials)
+}
+
+// handleMQTTAuth is called by the broker's authentication plugin when a client
+// connects. It always answers 200 with {"result": "allow"|"deny"} and, on allow,
+// the client's topic ACL.
+func (s *HTTPServer) handleMQTTAuth(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
 	}
-	s.writeJSON(w, http.StatusOK, response)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	claims, err := s.authUc.VerifyMQTTCredentials(r.Context(), req.Username, req.Password)
+	if err != nil {
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"result": "deny"})
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"result":       "allow",
+		"is_superuser": false,
+		"acl":          claims.ACL,
+		"expire_at":    claims.ExpiresAt.Unix(),
+	})
+}
+
+// handleMQTTACL is called by the broker's authorization plugin for each publish or
+// subscribe and answers {"result": "allow"|"deny"}
+func (s *HTTPServer) handleMQTTACL(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string         `json:"username"`
+		Topic    string         `json:"topic"`
+		Action   mqttacl.Access `json:"action"`
+		// Access is the name chat-api's ACL endpoint uses for action
+		Access mqttacl.Access `json:"access"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if req.Action == "" {
+		req.Action = req.Access
+	}
+
+	allowed, err := s.authUc.CheckMQTTTopicAccess(r.Context(), req.Username, req.Topic, req.Action)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "Failed to check topic access")
+		return
+	}
+
+	result := "deny"
+	if allowed {
+		result = "allow"
+	}
+	s.writeJSON(w, http.StatusOK, map[string]string{"result": result})
 }
 
 func (s *HTTPServer) handleGetOrganizationUsers(w http.ResponseWriter, r *http.Request) {
 	claims := r.Context().Value("claims").(*biz.JWTClaims)
 	orgID, _ := uuid.Parse(claims.OrganizationID)
 
-	users, err := s.authUc.GetOrganizationUsers(r.Context(), orgID)
+	params, err := pagination.Parse(r, 50, 200)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid cursor")
+		return
+	}
+	// Legacy bare-array clients without a limit get the whole organization, as they always have
+	if pagination.Bare(r) && r.URL.Query().Get("limit") == "" {
+		params.Limit = 0
+	}
+
+	var filter biz.UserListFilter
+	if role := biz.UserRole(r.URL.Query().Get("role")); role != "" {
+		if !role.IsValid() {
+			s.writeError(w, http.StatusBadRequest, "role must be 'admin' or 'member'")
+			return
+		}
+		filter.Role = role
+	}
+	// seen_within filters on last activity, e.g. ?seen_within=15m for recently active users
+	if seenWithin := r.URL.Query().Get("seen_within"); seenWithin != "" {
+		d, err := time.ParseDuration(seenWithin)
+		if err != nil || d <= 0 {
+			s.writeError(w, http.StatusBadRequest, "seen_within must be a positive duration such as 15m")
+			return
+		}
+		since := time.Now().Add(-d)
+		filter.SeenSince = &since
+	}
+
+	// status filters on presence, e.g. ?status=online
+	if status := r.URL.Query().Get("status"); status != "" {
+		if !biz.IsValidPresenceStatus(status) {
+			s.writeError(w, http.StatusBadRequest, "status must be 'online', 'away', 'dnd' or 'offline'")
+			return
+		}
+		filter.Status = status
+	}
+
+	countFilter := filter
+	filter.Limit = params.Fetch()
+	filter.Offset = params.Offset
+
+	users, err := s.authUc.GetOrganizationUsers(r.Context(), orgID, filter)
+	if err == biz.ErrPresenceUnavailable {
+		s.writeError(w, http.StatusServiceUnavailable, "Presence service unavailable")
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	page := pagination.New(users, params)
+	for _, include := range strings.Split(r.URL.Query().Get("include"), ",") {
+		if strings.TrimSpace(include) == "presence" {
+			// Only the users on this page are looked up
+			s.authUc.AttachPresence(r.Context(), page.Data.([]*biz.User))
+		}
+	}
+	if params.IncludeTotal {
+		total, err := s.authUc.CountOrganizationUsers(r.Context(), orgID, countFilter)
+		if err == biz.ErrPresenceUnavailable {
+			s.writeError(w, http.StatusServiceUnavailable, "Presence service unavailable")
+			return
+		}
+		if err != nil {
+			s.writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		page.SetTotal(total)
+		// Also sent as a header so bare-array clients can paginate
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	}
+
+	s.writeJSON(w, http.StatusOK, page.Body(r))
+}
+
+// handleListOrganizations lists every organization with its user counts (super admins only)
+func (s *HTTPServer) handleListOrganizations(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*biz.JWTClaims)
+
+	params, err := pagination.Parse(r, 50, 200)
 	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid cursor")
+		return
+	}
+
+	orgs, err := s.authUc.ListOrganizations(r.Context(), claims.UserID, params.Fetch(), params.Offset)
+	if err != nil {
+		if err == biz.ErrInsufficientPermissions {
+			s.writeError(w, http.StatusForbidden, "Insufficient permissions")
+			return
+		}
 		s.writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, users)
+	page := pagination.New(orgs, params)
+	if params.IncludeTotal {
+		total, err := s.authUc.CountOrganizations(r.Context())
+		if err != nil {
+			s.writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		page.SetTotal(total)
+	}
+
+	s.writeJSON(w, http.StatusOK, page.Body(r))
+}
+
+// handleGetOrganization returns any organization with its user counts (super admins only)
+func (s *HTTPServer) handleGetOrganization(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*biz.JWTClaims)
+
+	orgID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid organization ID")
+		return
+	}
+
+	org, err := s.authUc.GetOrganizationSummary(r.Context(), claims.UserID, orgID)
+	if err != nil {
+		switch err {
+		case biz.ErrInsufficientPermissions:
+			s.writeError(w, http.StatusForbidden, "Insufficient permissions")
+		case biz.ErrOrganizationNotFound:
+			s.writeError(w, http.StatusNotFound, "Organization not found")
+		default:
+			s.writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, org)
+}
+
+// brokerMiddleware only lets through requests from the MQTT broker, which sends the
+// shared secret in X-Broker-Secret. Without a configured secret nothing gets through.
+func (s *HTTPServer) brokerMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.brokerSecret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Broker-Secret")), []byte(s.brokerSecret)) != 1 {
+			s.writeError(w, http.StatusUnauthorized, "Invalid broker secret")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// internalMiddleware guards service-to-service routes with the shared internal secret
+func (s *HTTPServer) internalMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.internalSecret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Internal-Secret")), []byte(s.internalSecret)) != 1 {
+			s.writeError(w, http.StatusUnauthorized, "Invalid internal secret")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// deprecated marks responses of a route that has been replaced by successor
+func (s *HTTPServer) deprecated(successor string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+		next(w, r)
+	}
 }
 
 func (s *HTTPServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return s.authenticate(s.authUc.ValidateToken, next)
+}
+
+// passwordChangeMiddleware is authMiddleware for the endpoints a user who must
+// change their password can still use with their restricted token
+func (s *HTTPServer) passwordChangeMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return s.authenticate(s.authUc.ValidatePasswordChangeToken, next)
+}
+
+func (s *HTTPServer) authenticate(validate func(ctx context.Context, token string) (*biz.JWTClaims, error), next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -239,7 +667,11 @@ func (s *HTTPServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		claims, err := s.authUc.ValidateToken(r.Context(), tokenString)
+		claims, err := validate(r.Context(), tokenString)
+		if err == biz.ErrPasswordChangeRequired {
+			s.writeError(w, http.StatusForbidden, "Password change required")
+			return
+		}
 		if err != nil {
 			s.writeError(w, http.StatusUnauthorized, "Invalid token")
 			return
@@ -250,6 +682,314 @@ func (s *HTTPServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// handleResetPassword sets a temporary password for a user (admin only)
+func (s *HTTPServer) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*biz.JWTClaims)
+	requesterID := claims.UserID
+
+	vars := mux.Vars(r)
+	targetUserID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var req biz.ResetPasswordRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+	}
+
+	resp, err := s.authUc.ResetPassword(r.Context(), requesterID, targetUserID, &req)
+	if err != nil {
+		switch err {
+		case biz.ErrInsufficientPermissions:
+			s.writeError(w, http.StatusForbidden, "Insufficient permissions")
+		case biz.ErrCannotResetOwnPassword:
+			s.writeError(w, http.StatusBadRequest, "Cannot reset your own password")
+		case biz.ErrLastAdmin:
+			s.writeError(w, http.StatusConflict, err.Error())
+		case biz.ErrPasswordTooShort:
+			s.writeError(w, http.StatusBadRequest, err.Error())
+		case biz.ErrUserNotFound:
+			s.writeError(w, http.StatusNotFound, "User not found")
+		default:
+			s.writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	// The generated password is only ever shown in this response
+	w.Header().Set("Cache-Control", "no-store")
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+// handleChangePassword changes the caller's own password
+func (s *HTTPServer) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*biz.JWTClaims)
+
+	var req biz.ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if err := s.authUc.ChangePassword(r.Context(), claims.UserID, &req); err != nil {
+		switch err {
+		case biz.ErrInvalidPassword:
+			s.writeError(w, http.StatusUnauthorized, "Current password is incorrect")
+		case biz.ErrPasswordTooShort:
+			s.writeError(w, http.StatusBadRequest, err.Error())
+		default:
+			s.writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"message": "Password changed successfully"})
+}
+
+// handleRefreshSession exchanges a refresh token for a new access token and refresh
+// token. The refresh token is the credential, so no access token is needed.
+func (s *HTTPServer) handleRefreshSession(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if req.RefreshToken == "" {
+		s.writeError(w, http.StatusBadRequest, "refresh_token is required")
+		return
+	}
+
+	tokens, err := s.authUc.RefreshSession(r.Context(), req.RefreshToken)
+	if err != nil {
+		if err == biz.ErrSessionNotFound || err == biz.ErrRefreshTokenReused {
+			s.writeError(w, http.StatusUnauthorized, "Session has ended, please log in again")
+			return
+		}
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	s.writeJSON(w, http.StatusOK, map[string]string{"token": tokens.AccessToken, "refresh_token": tokens.RefreshToken})
+}
+
+// handleListSessions lists the caller's active sessions
+func (s *HTTPServer) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*biz.JWTClaims)
+
+	// Legacy clients don't page, so a cursor they send is ignored rather than rejected
+	bare := pagination.Bare(r)
+	params, err := pagination.Parse(r, 50, 200)
+	if err != nil && !bare {
+		s.writeError(w, http.StatusBadRequest, "Invalid cursor")
+		return
+	}
+
+	sessions, err := s.authUc.ListSessions(r.Context(), claims.UserID, claims.SessionID)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Sessions used to come wrapped in {"sessions": [...]}; legacy clients still get that
+	if bare {
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": sessions})
+		return
+	}
+
+	page := pagination.New(pagination.Slice(sessions, params), params)
+	if params.IncludeTotal {
+		page.SetTotal(len(sessions))
+	}
+	s.writeJSON(w, http.StatusOK, page.Body(r))
+}
+
+// handleRevokeSession ends one of the caller's sessions, which may be the current one
+func (s *HTTPServer) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*biz.JWTClaims)
+
+	sessionID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid session ID")
+		return
+	}
+
+	if err := s.authUc.RevokeSession(r.Context(), claims.UserID, sessionID); err != nil {
+		if err == biz.ErrSessionNotFound {
+			s.writeError(w, http.StatusNotFound, "Session not found")
+			return
+		}
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"message": "Session revoked"})
+}
+
+// handleRevokeOtherSessions ends every session of the caller but the current one
+func (s *HTTPServer) handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*biz.JWTClaims)
+
+	revoked, err := s.authUc.RevokeOtherSessions(r.Context(), claims.UserID, claims.SessionID)
+	if err != nil {
+		if err == biz.ErrSessionNotFound {
+			s.writeError(w, http.StatusBadRequest, "Log in again to manage sessions from this token")
+			return
+		}
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]int{"revoked": revoked})
+}
+
+// clientInfo describes the device a request came from. X-Forwarded-For is only
+// believed when the request comes from a trusted proxy, and then only as far back as
+// the chain of trusted proxies goes: the client is the last address before it.
+func (s *HTTPServer) clientInfo(r *http.Request) biz.ClientInfo {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	if s.trustedProxy(ip) {
+		forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(forwarded[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !s.trustedProxy(hop) {
+				break
+			}
+		}
+	}
+	return biz.ClientInfo{UserAgent: r.UserAgent(), IP: ip}
+}
+
+func (s *HTTPServer) trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range s.trustedProxies {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTrustedProxies parses a comma-separated list of proxy addresses and CIDR
+// ranges, skipping invalid entries
+func ParseTrustedProxies(value string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 8 * len(ip.To4())
+				if bits == 0 {
+					bits = 128
+				}
+				entry += "/" + strconv.Itoa(bits)
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid trusted proxy %q", entry)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// handleEnrollTOTP starts two-factor enrollment for the caller
+func (s *HTTPServer) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*biz.JWTClaims)
+
+	enrollment, err := s.authUc.EnrollTOTP(r.Context(), claims.UserID)
+	if err != nil {
+		if err == biz.ErrTOTPAlreadyEnabled {
+			s.writeError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+			return
+		}
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// The secret is only ever shown in this response
+	w.Header().Set("Cache-Control", "no-store")
+	s.writeJSON(w, http.StatusOK, enrollment)
+}
+
+// handleVerifyTOTP activates two-factor authentication with a code from the enrolled secret
+func (s *HTTPServer) handleVerifyTOTP(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*biz.JWTClaims)
+
+	var req biz.VerifyTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	resp, err := s.authUc.VerifyTOTP(r.Context(), claims.UserID, &req)
+	if err != nil {
+		switch err {
+		case biz.ErrTOTPNotEnrolled:
+			s.writeError(w, http.StatusBadRequest, "Enroll in two-factor authentication first")
+		case biz.ErrTOTPAlreadyEnabled:
+			s.writeError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		case biz.ErrInvalidTOTPCode:
+			s.writeError(w, http.StatusBadRequest, "Invalid two-factor code")
+		default:
+			s.writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	// Recovery codes are only ever shown in this response
+	w.Header().Set("Cache-Control", "no-store")
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+// handleDisableTOTP turns two-factor authentication off after confirming the password
+func (s *HTTPServer) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*biz.JWTClaims)
+
+	var req biz.DisableTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if err := s.authUc.DisableTOTP(r.Context(), claims.UserID, &req); err != nil {
+		switch err {
+		case biz.ErrInvalidPassword:
+			s.writeError(w, http.StatusUnauthorized, "Password is incorrect")
+		case biz.ErrTOTPNotEnabled:
+			s.writeError(w, http.StatusNotFound, "Two-factor authentication is not enabled")
+		default:
+			s.writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"message": "Two-factor authentication disabled"})
+}
+
 func (s *HTTPServer) writeJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -268,7 +1008,7 @@ func (s *HTTPServer) handleGetUser(w http.ResponseWriter, r *http.Request) {
 	requesterID := claims.UserID
 
 	vars := mux.Vars(r)
-	userID, err := strconv.Atoi(vars["id"])
+	userID, err := uuid.Parse(vars["id"])
 	if err != nil {
 		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
 		return
@@ -301,7 +1041,7 @@ func (s *HTTPServer) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 	requesterID := claims.UserID
 
 	vars := mux.Vars(r)
-	targetUserID, err := strconv.Atoi(vars["id"])
+	targetUserID, err := uuid.Parse(vars["id"])
 	if err != nil {
 		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
 		return
@@ -318,6 +1058,10 @@ func (s *HTTPServer) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
 			s.writeError(w, http.StatusForbidden, "Insufficient permissions")
 			return
 		}
+		if err == biz.ErrUserNotFound {
+			s.writeError(w, http.StatusNotFound, "User not found")
+			return
+		}
 		s.writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -338,7 +1082,7 @@ func (s *HTTPServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
 	requesterID := claims.UserID
 
 	vars := mux.Vars(r)
-	targetUserID, err := strconv.Atoi(vars["id"])
+	targetUserID, err := uuid.Parse(vars["id"])
 	if err != nil {
 		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
 		return
@@ -349,6 +1093,10 @@ func (s *HTTPServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
 			s.writeError(w, http.StatusForbidden, "Insufficient permissions")
 			return
 		}
+		if err == biz.ErrUserNotFound {
+			s.writeError(w, http.StatusNotFound, "User not found")
+			return
+		}
 		if err.Error() == "cannot delete yourself" {
 			s.writeError(w, http.StatusBadRequest, "Cannot delete yourself")
 			return
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientInfo(t *testing.T) {
+	s := &HTTPServer{trustedProxies: ParseTrustedProxies("10.0.0.0/8, 192.168.1.1, not-a-proxy")}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted sender's header is ignored", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.1.2.3:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"single trusted address", "192.168.1.1:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entries before the client are skipped", "10.1.2.3:5000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.1.2.3:5000", []string{"198.51.100.1, 10.9.9.9"}, "198.51.100.1"},
+		{"repeated headers", "10.1.2.3:5000", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"garbage stops the walk", "10.1.2.3:5000", []string{"198.51.100.1, garbage"}, "10.1.2.3"},
+		{"only trusted hops", "10.1.2.3:5000", []string{"10.4.4.4"}, "10.4.4.4"},
+		{"trusted proxy without the header", "10.1.2.3:5000", nil, "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/auth/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := s.clientInfo(r).IP; got != tt.want {
+				t.Errorf("clientInfo IP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package biz
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/mqttacl"
+)
+
+// CheckTopicAccess decides whether a user may publish or subscribe to an MQTT topic.
+// It backs the broker's authorization plugin with the rules in mqttacl.Check, the
+// same ones auth-service's ACL endpoint applies.
+func (uc *ChatUsecase) CheckTopicAccess(ctx context.Context, userID uuid.UUID, topic string, access mqttacl.Access) (bool, error) {
+	return mqttacl.Check(ctx, topicConversations{uc}, userID, topic, access)
+}
+
+// topicConversations answers the topic rules' membership questions from chat-api's repository
+type topicConversations struct {
+	uc *ChatUsecase
+}
+
+func (c topicConversations) ConversationAccess(ctx context.Context, conversationID, userID uuid.UUID) (bool, bool, error) {
+	participant, err := c.uc.repo.GetParticipant(ctx, conversationID, userID)
+	if err != nil || participant == nil {
+		return false, false, err
+	}
+	conversation, err := c.uc.repo.GetConversation(ctx, conversationID)
+	if err != nil {
+		return false, false, err
+	}
+	return true, conversation.LockedFor(participant), nil
+}
+
+func (c topicConversations) SharesConversation(ctx context.Context, userID, peerID uuid.UUID) (bool, error) {
+	return c.uc.repo.SharesConversation(ctx, userID, peerID)
+}
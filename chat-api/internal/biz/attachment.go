@@ -0,0 +1,121 @@
+package biz
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MetaKeyAttachments lists the IDs of the media-service attachments a message carries
+const MetaKeyAttachments = "attachments"
+
+// AttachmentStatusReady is media-service's status for an attachment that uploaded and passed its scan
+const AttachmentStatusReady = "ready"
+
+// AttachmentStatusScanning is media-service's status while the antivirus scan runs
+const AttachmentStatusScanning = "scanning"
+
+// attachmentScanPollInterval is how often held messages recheck their attachments
+const attachmentScanPollInterval = 500 * time.Millisecond
+
+// AttachmentChecker looks up attachments in media-service
+type AttachmentChecker interface {
+	// GetAttachmentStatuses returns the status of each attachment the sender may put on a
+	// new message. Attachments that don't exist, belong to someone else or are already
+	// on a message are left out.
+	GetAttachmentStatuses(ctx context.Context, orgID, senderID uuid.UUID, attachmentIDs []uuid.UUID) (map[uuid.UUID]string, error)
+}
+
+// AttachmentsNotReadyError rejects a message referencing attachments that haven't
+// finished uploading and scanning, or that the sender can't use
+type AttachmentsNotReadyError struct {
+	AttachmentIDs []uuid.UUID
+}
+
+func (e *AttachmentsNotReadyError) Error() string {
+	return fmt.Sprintf("%d attachment(s) not ready", len(e.AttachmentIDs))
+}
+
+// checkAttachments makes sure every attachment listed in the message meta is ready, so
+// recipients never get a link to media that is missing or unscanned. With
+// AttachmentScanHold set, attachments still being scanned are waited on for that long.
+func (uc *ChatUsecase) checkAttachments(ctx context.Context, conversation *Conversation, senderID uuid.UUID, meta map[string]interface{}) error {
+	raw, ok := meta[MetaKeyAttachments]
+	if !ok {
+		return nil
+	}
+
+	attachmentIDs, err := parseAttachmentIDs(raw)
+	if err != nil {
+		return err
+	}
+	if len(attachmentIDs) == 0 || uc.attachments == nil {
+		return nil
+	}
+
+	deadline := time.Now().Add(uc.config.AttachmentScanHold)
+	for {
+		statuses, err := uc.attachments.GetAttachmentStatuses(ctx, conversation.OrganizationID, senderID, attachmentIDs)
+		if err != nil {
+			return err
+		}
+
+		var notReady []uuid.UUID
+		scanning := false
+		for _, id := range attachmentIDs {
+			status := statuses[id]
+			if status == AttachmentStatusReady {
+				continue
+			}
+			notReady = append(notReady, id)
+			if status == AttachmentStatusScanning {
+				scanning = true
+			}
+		}
+		if len(notReady) == 0 {
+			return nil
+		}
+
+		// Only scans finish on their own; anything else is for the client to fix
+		if !scanning || !time.Now().Before(deadline) {
+			return &AttachmentsNotReadyError{AttachmentIDs: notReady}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(attachmentScanPollInterval):
+		}
+	}
+}
+
+// parseAttachmentIDs reads the attachment list from message meta, which must be an
+// array of attachment IDs. Repeated IDs are dropped.
+func parseAttachmentIDs(raw interface{}) ([]uuid.UUID, error) {
+	invalid := &ValidationError{Fields: map[string]string{"meta.attachments": "must be a list of attachment IDs"}}
+
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, invalid
+	}
+
+	seen := make(map[uuid.UUID]bool, len(items))
+	ids := make([]uuid.UUID, 0, len(items))
+	for _, item := range items {
+		str, ok := item.(string)
+		if !ok {
+			return nil, invalid
+		}
+		id, err := uuid.Parse(str)
+		if err != nil {
+			return nil, invalid
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,69 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/audit"
+)
+
+// Audit actions for admin changes to conversations
+const (
+	AuditActionConversationUpdate = "conversation.update"
+	AuditActionParticipantRemove  = "conversation.participant.remove"
+	AuditActionParticipantRole    = "conversation.participant.role_change"
+	AuditActionReportResolve      = "moderation.report.resolve"
+)
+
+// ListAuditLog returns the organization's audit log, newest first, for compliance
+// review. Only admins of the organization can read it.
+func (uc *ChatUsecase) ListAuditLog(ctx context.Context, adminID, orgID uuid.UUID, filter audit.Filter) ([]*audit.Entry, error) {
+	if err := uc.requireOrgAdminOf(ctx, adminID, orgID); err != nil {
+		return nil, err
+	}
+	if filter.Since != nil && filter.Until != nil && !filter.Since.Before(*filter.Until) {
+		return nil, &ValidationError{Fields: map[string]string{"until": "must be after since"}}
+	}
+	return uc.repo.ListAuditEvents(ctx, orgID, filter)
+}
+
+func (uc *ChatUsecase) CountAuditLog(ctx context.Context, orgID uuid.UUID, filter audit.Filter) (int, error) {
+	return uc.repo.CountAuditEvents(ctx, orgID, filter)
+}
+
+// conversationAuditSnapshot is the part of a conversation UpdateConversation can
+// change, as recorded in the audit log's before/after diff
+func conversationAuditSnapshot(conversation *Conversation) map[string]interface{} {
+	var retentionDays interface{}
+	if conversation.RetentionDays != nil {
+		retentionDays = *conversation.RetentionDays
+	}
+	return map[string]interface{}{
+		"title":             conversation.Title,
+		"post_policy":       conversation.PostPolicy,
+		"retention_days":    retentionDays,
+		"slow_mode_seconds": conversation.SlowModeSeconds,
+		"locked":            conversation.Locked,
+	}
+}
+
+// auditConversationAction records an admin action on a conversation. The action
+// already happened, so a failed audit write is only logged.
+func (uc *ChatUsecase) auditConversationAction(ctx context.Context, conversation *Conversation, actorID uuid.UUID, action string, details map[string]interface{}, changes map[string]audit.Change) {
+	event := &AuditEvent{
+		OrganizationID: conversation.OrganizationID,
+		UserID:         actorID,
+		Action:         action,
+		TargetType:     "conversation",
+		TargetID:       conversation.ID.String(),
+		Details:        details,
+		Changes:        changes,
+		CreatedAt:      time.Now(),
+	}
+	if err := uc.repo.CreateAuditEvent(ctx, event); err != nil {
+		log.Printf("Failed to audit %s of conversation %s by %s: %v", action, conversation.ID, actorID, err)
+	}
+}
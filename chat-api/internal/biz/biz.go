@@ -13,6 +13,28 @@ var (
 	ErrInvalidRequest          = errors.New("invalid request")
 	ErrInvalidDMParticipants   = errors.New("DM conversations must have exactly 2 participants")
 	ErrMessageNotFound         = errors.New("message not found")
+	ErrPostingRestricted       = errors.New("only admins can post in this conversation")
+	ErrConversationLocked      = errors.New("conversation is locked")
+	ErrDeviceNotFound          = errors.New("device not found")
+	ErrInvalidPushToken        = errors.New("push token is no longer valid")
+	ErrPinLimitReached         = errors.New("pinned conversation limit reached")
+	ErrUserNotFound            = errors.New("user not found")
+	ErrReportNotFound          = errors.New("report not found")
+	ErrGroupFull                = errors.New("group is full")
+	ErrConversationLimitReached = errors.New("conversation creation limit reached")
+	ErrCrossOrgParticipant      = errors.New("participant does not belong to the conversation's organization")
+	ErrKeysNotFound             = errors.New("user has not published encryption keys")
+	ErrNotEncrypted             = errors.New("conversation is not end-to-end encrypted")
+	ErrIdempotencyKeyReused     = errors.New("idempotency key was already used for a different message")
+	ErrIdempotencyKeyInUse      = errors.New("a request with this idempotency key is in progress")
+	ErrSearchUnavailable        = errors.New("search is not available")
+	ErrLinkPreviewsDisabled     = errors.New("link previews are disabled")
+	ErrInvalidPreviewURL        = errors.New("only absolute http and https URLs can be previewed")
+	// ErrPreviewUnavailable covers pages that can't be fetched, aren't HTML, have no
+	// preview metadata, or live at addresses the server won't connect to
+	ErrPreviewUnavailable = errors.New("no preview available for this URL")
+	// ErrMessagingUnavailable is deliberately vague so a blocked user can't tell they were blocked
+	ErrMessagingUnavailable = errors.New("unable to message this user")
 )
 
 // ProviderSet is biz providers.
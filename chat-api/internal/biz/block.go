@@ -0,0 +1,70 @@
+package biz
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserBlock records that BlockerID has blocked BlockedID within an organization
+type UserBlock struct {
+	OrganizationID uuid.UUID `json:"organization_id"`
+	BlockerID      uuid.UUID `json:"blocker_id"`
+	BlockedID      uuid.UUID `json:"blocked_id"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// BlockUser blocks another user of the same organization. Blocking twice is a no-op.
+func (uc *ChatUsecase) BlockUser(ctx context.Context, blockerID, orgID, blockedID uuid.UUID) error {
+	if blockerID == blockedID {
+		return ErrInvalidRequest
+	}
+
+	orgs, err := uc.repo.GetUserOrganizations(ctx, []uuid.UUID{blockedID})
+	if err != nil {
+		return err
+	}
+	if blockedOrg, ok := orgs[blockedID]; !ok || blockedOrg != orgID {
+		return ErrUserNotFound
+	}
+
+	return uc.repo.CreateBlock(ctx, &UserBlock{
+		OrganizationID: orgID,
+		BlockerID:      blockerID,
+		BlockedID:      blockedID,
+		CreatedAt:      time.Now(),
+	})
+}
+
+// UnblockUser removes a block; unblocking someone who isn't blocked is a no-op
+func (uc *ChatUsecase) UnblockUser(ctx context.Context, blockerID, orgID, blockedID uuid.UUID) error {
+	return uc.repo.DeleteBlock(ctx, orgID, blockerID, blockedID)
+}
+
+// GetBlockedUsers lists the users the caller has blocked
+func (uc *ChatUsecase) GetBlockedUsers(ctx context.Context, blockerID, orgID uuid.UUID) ([]*UserBlock, error) {
+	return uc.repo.GetBlocks(ctx, orgID, blockerID)
+}
+
+// isDMBlocked reports whether the conversation is a DM whose two members have a
+// block between them in either direction
+func (uc *ChatUsecase) isDMBlocked(ctx context.Context, conversation *Conversation, userID uuid.UUID) (bool, error) {
+	if conversation.Type != ConversationTypeDM {
+		return false, nil
+	}
+
+	participants, err := uc.repo.GetConversationParticipants(ctx, conversation.ID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range participants {
+		if p.UserID == userID {
+			continue
+		}
+		return uc.repo.IsBlockedBetween(ctx, conversation.OrganizationID, userID, p.UserID)
+	}
+
+	return false, nil
+}
@@ -2,9 +2,13 @@ package biz
 
 import (
 	"context"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/audit"
 )
 
 type ConversationType string
@@ -21,6 +25,30 @@ const (
 	ParticipantRoleMember ParticipantRole = "member"
 )
 
+type DeliveryStatus string
+
+const (
+	DeliveryStatusSent      DeliveryStatus = "sent"
+	DeliveryStatusDelivered DeliveryStatus = "delivered"
+	DeliveryStatusRead      DeliveryStatus = "read"
+)
+
+// ReadPolicy decides when a message counts as read for its sender
+type ReadPolicy string
+
+const (
+	ReadPolicyAll ReadPolicy = "all" // every recipient has read it
+	ReadPolicyAny ReadPolicy = "any" // at least one recipient has read it
+)
+
+// PostPolicy controls who may send messages in a conversation
+type PostPolicy string
+
+const (
+	PostPolicyEveryone   PostPolicy = "everyone"
+	PostPolicyAdminsOnly PostPolicy = "admins_only" // broadcast/announcement conversations
+)
+
 type Conversation struct {
 	ID             uuid.UUID        `json:"id"`
 	OrganizationID uuid.UUID        `json:"organization_id"`
@@ -28,7 +56,30 @@ type Conversation struct {
 	Title          string           `json:"title,omitempty"`
 	CreatedBy      uuid.UUID        `json:"created_by"`
 	IsEncrypted    bool             `json:"is_encrypted"`
+	PostPolicy     PostPolicy       `json:"post_policy"`
 	CreatedAt      time.Time        `json:"created_at"`
+	// UpdatedAt is the last activity: a new message or a change to the conversation's settings
+	UpdatedAt time.Time `json:"updated_at"`
+	// LastMessageAt is maintained by message-service when messages are persisted
+	LastMessageAt *time.Time `json:"last_message_at,omitempty"`
+	// RetentionDays overrides the organization's retention for this conversation
+	RetentionDays *int `json:"retention_days,omitempty"`
+	// Retention is the policy in effect, unset if messages are kept forever
+	Retention *RetentionPolicy `json:"retention,omitempty"`
+	// SlowModeSeconds is the minimum gap an admin set between each member's messages; 0 is off
+	SlowModeSeconds int `json:"slow_mode_seconds,omitempty"`
+	// Locked freezes the conversation: only its admins can post or type, history stays readable
+	Locked bool `json:"locked"`
+
+	// PinnedAt is private to the requesting user and only set in their conversation list
+	PinnedAt *time.Time `json:"pinned_at,omitempty"`
+
+	// DisplayTitle and OtherParticipant are only set in the requesting user's conversation
+	// list. DisplayTitle is what to show for the conversation: the other participant's
+	// name for a DM, and the title, or failing that a list of members, for a group.
+	DisplayTitle string `json:"display_title,omitempty"`
+	// OtherParticipant is who a DM is with
+	OtherParticipant *ParticipantSnapshot `json:"other_participant,omitempty"`
 }
 
 type Participant struct {
@@ -38,10 +89,25 @@ type Participant struct {
 	Role           ParticipantRole `json:"role"`
 	JoinedAt       time.Time       `json:"joined_at"`
 	LastReadAt     *time.Time      `json:"last_read_at,omitempty"`
+	MutedUntil     *time.Time      `json:"muted_until,omitempty"`
+	PinnedAt       *time.Time      `json:"-"`
 	DisplayName    string          `json:"display_name,omitempty"`
 	Email          string          `json:"email,omitempty"`
+	CanPost        bool            `json:"can_post"`
+	// Status is the presence status, only filled in when presence is requested
+	Status string `json:"status,omitempty"`
 }
 
+// ParticipantListFilter pages a conversation's participant list
+type ParticipantListFilter struct {
+	// Limit of 0 returns every participant
+	Limit  int
+	Offset int
+}
+
+// Message is a chat message. Seq is its position in the conversation, assigned by
+// message-service when it persists the message, so a message that was just sent has
+// none yet; lists are ordered by it rather than by SentAt.
 type Message struct {
 	ID             uuid.UUID              `json:"id"`
 	ConversationID uuid.UUID              `json:"conversation_id"`
@@ -50,10 +116,33 @@ type Message struct {
 	Content        string                 `json:"content"`
 	Meta           map[string]interface{} `json:"meta,omitempty"`
 	DedupeKey      string                 `json:"dedupe_key,omitempty"`
+	ParentID       *uuid.UUID             `json:"parent_id,omitempty"`
+	Seq            int64                  `json:"seq,omitempty"`
 	SentAt         time.Time              `json:"sent_at"`
 	EditedAt       *time.Time             `json:"edited_at,omitempty"`
+	PinnedAt       *time.Time             `json:"pinned_at,omitempty"`
 	Deleted        bool                   `json:"deleted"`
 	IsRead         bool                   `json:"is_read"`
+	DeliveryStatus DeliveryStatus         `json:"delivery_status,omitempty"`
+	Receipts       []*MessageReceipt      `json:"receipts,omitempty"`
+
+	// ParentDeleted is set when listing replies whose parent has been deleted
+	ParentDeleted bool `json:"-"`
+
+	// Read state from participants' last_read_at, used to derive IsRead
+	ReadByAll bool `json:"-"`
+	ReadByAny bool `json:"-"`
+
+	// Receipt aggregates used to derive DeliveryStatus, never serialized
+	RecipientCount int `json:"-"`
+	DeliveredCount int `json:"-"`
+	ReadCount      int `json:"-"`
+}
+
+type MessageReceipt struct {
+	UserID uuid.UUID `json:"user_id"`
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
 }
 
 type CreateConversationRequest struct {
@@ -61,6 +150,7 @@ type CreateConversationRequest struct {
 	Title          string           `json:"title,omitempty"`
 	ParticipantIDs []uuid.UUID      `json:"participant_ids" validate:"required"`
 	IsEncrypted    bool             `json:"is_encrypted"`
+	PostPolicy     PostPolicy       `json:"post_policy,omitempty"`
 }
 
 type SendMessageRequest struct {
@@ -69,66 +159,359 @@ type SendMessageRequest struct {
 	Content        string                 `json:"content" validate:"required"`
 	Meta           map[string]interface{} `json:"meta,omitempty"`
 	DedupeKey      string                 `json:"dedupe_key,omitempty"`
+	// ParentID makes the message a reply; the parent is quoted in meta.reply_to
+	ParentID *uuid.UUID `json:"parent_id,omitempty"`
+	// IdempotencyKey comes from the Idempotency-Key header and becomes the dedupe key
+	IdempotencyKey string `json:"-"`
 }
 
 type UpdateConversationRequest struct {
-	Title *string `json:"title,omitempty"`
+	Title      *string     `json:"title,omitempty"`
+	PostPolicy *PostPolicy `json:"post_policy,omitempty"`
+	// IsEncrypted is fixed at creation; it is only accepted if it matches the current value
+	IsEncrypted *bool `json:"is_encrypted,omitempty"`
+	// RetentionDays overrides the organization's retention; 0 goes back to inheriting it
+	RetentionDays *int `json:"retention_days,omitempty"`
+	// SlowModeSeconds limits how often each member may post; 0 turns slow mode off
+	SlowModeSeconds *int `json:"slow_mode_seconds,omitempty"`
+	// Locked freezes the conversation. Organization admins may change it without
+	// being conversation admins.
+	Locked *bool `json:"locked,omitempty"`
 }
 
+// onlyLocks reports whether the request changes nothing but the lock
+func (r *UpdateConversationRequest) onlyLocks() bool {
+	return r.Locked != nil && r.Title == nil && r.PostPolicy == nil && r.IsEncrypted == nil &&
+		r.RetentionDays == nil && r.SlowModeSeconds == nil
+}
+
+// AddParticipantRequest adds either a single user (UserID) or many at once (UserIDs)
 type AddParticipantRequest struct {
-	UserID uuid.UUID       `json:"user_id" validate:"required"`
-	Role   ParticipantRole `json:"role,omitempty"`
+	UserID  uuid.UUID       `json:"user_id,omitempty"`
+	UserIDs []uuid.UUID     `json:"user_ids,omitempty"`
+	Role    ParticipantRole `json:"role,omitempty"`
+}
+
+type ParticipantAddStatus string
+
+const (
+	ParticipantAddStatusAdded         ParticipantAddStatus = "added"
+	ParticipantAddStatusAlreadyMember ParticipantAddStatus = "already_member"
+	ParticipantAddStatusNotFound      ParticipantAddStatus = "not_found"
+	ParticipantAddStatusWrongOrg      ParticipantAddStatus = "wrong_org"
+)
+
+// ParticipantAddResult is the outcome of adding one user in a bulk add
+type ParticipantAddResult struct {
+	UserID uuid.UUID            `json:"user_id"`
+	Status ParticipantAddStatus `json:"status"`
+}
+
+// ConversationListFilter narrows and pages the caller's conversation list
+type ConversationListFilter struct {
+	// UpdatedSince only returns conversations updated or joined after it
+	UpdatedSince *time.Time
+	// Limit of 0 returns every conversation
+	Limit  int
+	Offset int
+}
+
+type MuteConversationRequest struct {
+	// Until is when the mute expires; nil mutes indefinitely
+	Until *time.Time `json:"until,omitempty"`
 }
 
 type ChatRepo interface {
 	// Conversations
-	CreateConversation(ctx context.Context, conversation *Conversation) error
+	// CreateConversation fails with ErrConversationLimitReached if the creator has
+	// already created maxCreated conversations in the organization; 0 doesn't limit.
+	// The count and insert are serialised per creator so concurrent creates can't
+	// both slip under the limit.
+	CreateConversation(ctx context.Context, conversation *Conversation, maxCreated int) error
 	GetConversation(ctx context.Context, id uuid.UUID) (*Conversation, error)
-	GetUserConversations(ctx context.Context, userID uuid.UUID) ([]*Conversation, error)
+	GetUserConversations(ctx context.Context, userID uuid.UUID, filter ConversationListFilter) ([]*Conversation, error)
+	CountUserConversations(ctx context.Context, userID uuid.UUID, filter ConversationListFilter) (int, error)
+	// SearchUserConversations matches query as a substring, case-insensitively
+	SearchUserConversations(ctx context.Context, userID uuid.UUID, query string, limit, offset int) ([]*ConversationSearchResult, error)
+	GetConversationSummaries(ctx context.Context, userID uuid.UUID, countSystemMessages bool) ([]*ConversationSummary, error)
+	// GetParticipantSnapshots returns up to limit participants other than excludeUserID per conversation
+	GetParticipantSnapshots(ctx context.Context, conversationIDs []uuid.UUID, excludeUserID uuid.UUID, limit int) (map[uuid.UUID][]*ParticipantSnapshot, error)
 	UpdateConversation(ctx context.Context, conversation *Conversation) error
 	DeleteConversation(ctx context.Context, id uuid.UUID) error
 
 	// Participants
 	AddParticipant(ctx context.Context, participant *Participant) error
+	AddParticipants(ctx context.Context, participants []*Participant) ([]uuid.UUID, error)
 	RemoveParticipant(ctx context.Context, conversationID, userID uuid.UUID) error
 	GetConversationParticipants(ctx context.Context, conversationID uuid.UUID) ([]*Participant, error)
+	CountParticipants(ctx context.Context, conversationID uuid.UUID) (int, error)
+	// ListParticipants pages through participants, admins first, then by display name
+	ListParticipants(ctx context.Context, conversationID uuid.UUID, filter ParticipantListFilter) ([]*Participant, error)
 	GetParticipant(ctx context.Context, conversationID, userID uuid.UUID) (*Participant, error)
+	// SharesConversation reports whether two users participate in a common conversation
+	SharesConversation(ctx context.Context, userID, peerID uuid.UUID) (bool, error)
 	UpdateParticipantRole(ctx context.Context, conversationID, userID uuid.UUID, role ParticipantRole) error
-	UpdateLastReadAt(ctx context.Context, conversationID, userID uuid.UUID) error
+	// MarkConversationRead moves the user's last_read_at to readAt and creates read
+	// receipts for up to limit of the newest messages from others it newly covers,
+	// returning those message IDs
+	MarkConversationRead(ctx context.Context, conversationID, userID uuid.UUID, readAt time.Time, limit int) ([]uuid.UUID, error)
+	SetMutedUntil(ctx context.Context, conversationID, userID uuid.UUID, mutedUntil *time.Time) error
+	SetPinnedAt(ctx context.Context, conversationID, userID uuid.UUID, pinnedAt *time.Time) error
+	CountPinnedConversations(ctx context.Context, userID uuid.UUID) (int, error)
+
+	// Organizations
+	GetOrganizationSettings(ctx context.Context, orgID uuid.UUID) (map[string]interface{}, error)
+	// UpdateOrganizationSetting sets one settings key, removing it when value is nil
+	UpdateOrganizationSetting(ctx context.Context, orgID uuid.UUID, key string, value interface{}) error
+
+	// Users
+	GetUserOrganizations(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]uuid.UUID, error)
+	GetUserRole(ctx context.Context, userID uuid.UUID) (string, error)
+	FlagUser(ctx context.Context, userID uuid.UUID) error
+	GetUserSnapshot(ctx context.Context, userID uuid.UUID) (*ParticipantSnapshot, error)
+	ListUsersForIndex(ctx context.Context, afterID uuid.UUID, limit int) ([]*UserDocument, error)
+
+	// Moderation
+	CreateMessageReport(ctx context.Context, report *MessageReport) (*MessageReport, error)
+	GetMessageReport(ctx context.Context, id uuid.UUID) (*MessageReport, error)
+	GetMessageReports(ctx context.Context, orgID uuid.UUID, status ReportStatus) ([]*MessageReport, error)
+	ResolveMessageReports(ctx context.Context, messageID uuid.UUID, action ReportAction, resolvedBy uuid.UUID, resolvedAt time.Time) error
+
+	// Admin
+	ListOrganizationConversations(ctx context.Context, orgID uuid.UUID, filter AdminConversationFilter) ([]*AdminConversation, error)
+	CountOrganizationConversations(ctx context.Context, orgID uuid.UUID, filter AdminConversationFilter) (int, error)
+	CreateAuditEvent(ctx context.Context, event *AuditEvent) error
+	ListAuditEvents(ctx context.Context, orgID uuid.UUID, filter audit.Filter) ([]*audit.Entry, error)
+	CountAuditEvents(ctx context.Context, orgID uuid.UUID, filter audit.Filter) (int, error)
+
+	// Blocks
+	CreateBlock(ctx context.Context, block *UserBlock) error
+	DeleteBlock(ctx context.Context, orgID, blockerID, blockedID uuid.UUID) error
+	GetBlocks(ctx context.Context, orgID, blockerID uuid.UUID) ([]*UserBlock, error)
+	IsBlockedBetween(ctx context.Context, orgID, userA, userB uuid.UUID) (bool, error)
+
+	// Notifications
+	GetNotificationPreferences(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]*NotificationPreferences, error)
+	UpsertNotificationPreferences(ctx context.Context, pref *NotificationPreferences) error
+
+	// Device push tokens
+	UpsertDeviceToken(ctx context.Context, device *DeviceToken) error
+	DeleteUserDeviceToken(ctx context.Context, userID uuid.UUID, token string) error
+	// InvalidateDeviceToken soft-deletes a token the push provider rejected
+	InvalidateDeviceToken(ctx context.Context, token string) error
+	// GetDeviceTokens excludes invalidated tokens
+	GetDeviceTokens(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID][]*DeviceToken, error)
 
 	// Messages
-	GetConversationMessages(ctx context.Context, conversationID uuid.UUID, limit, offset int) ([]*Message, error)
+	// GetConversationMessages only returns messages if the conversation belongs to orgID.
+	// Messages come newest first, or, when afterSeq is set, oldest first from just after it.
+	// With hideBlockedBy set, messages from users they have blocked are left out.
+	GetConversationMessages(ctx context.Context, orgID, conversationID uuid.UUID, afterSeq *int64, hideBlockedBy *uuid.UUID, limit, offset int) ([]*Message, error)
+	GetMessageWithContext(ctx context.Context, orgID, conversationID, messageID uuid.UUID, before, after int) ([]*Message, error)
+	GetMessageAttachments(ctx context.Context, messageID uuid.UUID) ([]*MessageAttachment, error)
+	// CountConversationMessages counts what GetConversationMessages would list unpaged
+	CountConversationMessages(ctx context.Context, orgID, conversationID uuid.UUID, afterSeq *int64, hideBlockedBy *uuid.UUID) (int, error)
+	// FindMessageAt returns the oldest visible message sent at or after at, nil if there is none
+	FindMessageAt(ctx context.Context, orgID, conversationID uuid.UUID, at time.Time) (*MessagePosition, error)
+	// GetMessagePosition returns ErrMessageNotFound if the message isn't in the conversation
+	GetMessagePosition(ctx context.Context, orgID, conversationID, messageID uuid.UUID) (*MessagePosition, error)
 	GetMessage(ctx context.Context, messageID uuid.UUID) (*Message, error)
+	// SetMessagePinnedAt returns ErrMessageNotFound if the message isn't a visible
+	// message of the conversation
+	SetMessagePinnedAt(ctx context.Context, conversationID, messageID uuid.UUID, pinnedAt *time.Time) error
+	DeleteMessage(ctx context.Context, messageID uuid.UUID) error
+	GetMessageReceipts(ctx context.Context, messageIDs []uuid.UUID) (map[uuid.UUID][]*MessageReceipt, error)
+	// PurgeExpiredMessages deletes up to limit messages past their retention and reports
+	// the counts per organization
+	PurgeExpiredMessages(ctx context.Context, limit int, exemptPinned bool) ([]*RetentionPurge, error)
+
+	// Idempotency keys
+	// ClaimIdempotencyKey stores the record unless its key is already held by a record
+	// created after expiredBefore, in which case that record is returned instead
+	ClaimIdempotencyKey(ctx context.Context, record *IdempotencyRecord, expiredBefore time.Time) (*IdempotencyRecord, error)
+	ReleaseIdempotencyKey(ctx context.Context, conversationID uuid.UUID, key string) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int, error)
+
+	// Encryption keys
+	UpsertUserKeys(ctx context.Context, keys *UserKeys, oneTimePreKeys []PreKey) error
+	ClaimKeyBundle(ctx context.Context, userID uuid.UUID) (*KeyBundle, error)
+	// GetConversationKeys lists the keys of the conversation's current participants
+	GetConversationKeys(ctx context.Context, conversationID uuid.UUID) (*ConversationKeySet, error)
+	// GetEncryptedConversationIDs lists the encrypted conversations the user takes part in
+	GetEncryptedConversationIDs(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error)
+
+	// Mentions
+	GetUserMentions(ctx context.Context, userID uuid.UUID, unreadOnly bool, limit, offset int) ([]*Mention, error)
+	CountUserMentions(ctx context.Context, userID uuid.UUID, unreadOnly bool) (int, error)
+
+	// Outbox
+	EnqueueOutboxEvent(ctx context.Context, event *OutboxEvent) error
+	ProcessOutboxBatch(ctx context.Context, limit int, handle func(ctx context.Context, event *OutboxEvent)) (int, error)
+	CountOutboxEvents(ctx context.Context) (pending, dead int, err error)
+	DeleteSentOutboxEvents(ctx context.Context, before time.Time) error
 }
 
 type MQTTPublisher interface {
 	PublishMessage(ctx context.Context, conversationID uuid.UUID, message *Message) error
 	PublishTypingIndicator(ctx context.Context, conversationID, userID uuid.UUID, isTyping bool) error
+	PublishParticipantsAdded(ctx context.Context, conversationID, addedBy uuid.UUID, userIDs []uuid.UUID) error
+	PublishKeyRotation(ctx context.Context, conversationID uuid.UUID, reason KeyRotationReason, userIDs []uuid.UUID) error
+	PublishReadReceipts(ctx context.Context, conversationID, userID uuid.UUID, messageIDs []uuid.UUID, readAt time.Time) error
+	PublishConversationUpdated(ctx context.Context, conversation *Conversation, updatedBy uuid.UUID) error
+	// Publish sends an already encoded payload, used to replay outbox events
+	Publish(ctx context.Context, topic string, qos byte, payload []byte) error
+	// Close disconnects from the broker once publishes in flight have completed
+	Close()
+}
+
+// MaxPinnedConversations caps how many conversations a user can pin
+const MaxPinnedConversations = 10
+
+// ChatConfig holds tunable chat behaviour
+type ChatConfig struct {
+	ReadPolicy ReadPolicy
+	// AllowMemberTypingInBroadcast lets non-admins send typing indicators in admins-only conversations
+	AllowMemberTypingInBroadcast bool
+	// MaxGroupParticipants caps group size including the creator; 0 means unlimited.
+	// Organizations can override it.
+	MaxGroupParticipants int
+	// MaxConversationsPerUser caps how many conversations, DMs included, a user can
+	// create; 0 means unlimited. Organizations can override it.
+	MaxConversationsPerUser int
+	// AllowedContentTypes is the message content type allowlist, DefaultContentTypes if empty
+	AllowedContentTypes []string
+	// MaxContentLength caps message content in bytes unless the organization overrides it
+	MaxContentLength int
+	// MaxMetaBytes caps the JSON-encoded size of message meta
+	MaxMetaBytes int
+	// SystemMessagesCountUnread includes system messages in unread badges
+	SystemMessagesCountUnread bool
+	// AttachmentScanHold is how long a send waits for attachments still being scanned
+	// before rejecting the message; 0 rejects it straight away
+	AttachmentScanHold time.Duration
 }
 
 type ChatUsecase struct {
 	repo      ChatRepo
 	publisher MQTTPublisher
+	notifier  *NotificationDispatcher
+	presence  PresenceChecker
+	search    *SearchIndexer
+	flood     *FloodController
+	// attachments checks referenced attachments are ready; nil skips the check
+	attachments AttachmentChecker
+	// previews unfurls links in messages; nil disables link previews
+	previews *LinkPreviewer
+	config   ChatConfig
 }
 
-func NewChatUsecase(repo ChatRepo, publisher MQTTPublisher) *ChatUsecase {
+// NewChatUsecase wires the chat use cases. search may be nil when no search cluster is configured,
+// flood may be nil to disable flood control, attachments may be nil to skip attachment checks,
+// and previews may be nil to disable link previews.
+func NewChatUsecase(repo ChatRepo, publisher MQTTPublisher, notifier *NotificationDispatcher, presence PresenceChecker, search *SearchIndexer, flood *FloodController, attachments AttachmentChecker, previews *LinkPreviewer, config ChatConfig) *ChatUsecase {
+	if config.ReadPolicy != ReadPolicyAny {
+		config.ReadPolicy = ReadPolicyAll
+	}
 	return &ChatUsecase{
-		repo:      repo,
-		publisher: publisher,
+		repo:        repo,
+		publisher:   publisher,
+		notifier:    notifier,
+		presence:    presence,
+		search:      search,
+		flood:       flood,
+		attachments: attachments,
+		previews:    previews,
+		config:      config,
+	}
+}
+
+// presenceLookupTimeout keeps a slow presence service from holding up listings
+const presenceLookupTimeout = 2 * time.Second
+
+// recordActivity reports the user as active to the presence service in the background.
+// Presence is best effort, so a slow or unavailable presence service never fails the request.
+func (uc *ChatUsecase) recordActivity(userID uuid.UUID) {
+	if uc.presence == nil {
+		return
 	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		if err := uc.presence.RecordActivity(ctx, userID); err != nil {
+			log.Printf("Failed to record activity for %s: %v", userID, err)
+		}
+	}()
 }
 
 func (uc *ChatUsecase) CreateConversation(ctx context.Context, req *CreateConversationRequest, creatorID uuid.UUID, orgID uuid.UUID) (*Conversation, error) {
-	// Validate participants
-	if len(req.ParticipantIDs) == 0 {
-		return nil, ErrInvalidRequest
+	// Deduplicate participants, the creator is always added separately
+	seen := map[uuid.UUID]bool{creatorID: true}
+	var participantIDs []uuid.UUID
+	for _, id := range req.ParticipantIDs {
+		if id == uuid.Nil {
+			return nil, &ValidationError{Fields: map[string]string{"participant_ids": "contains an empty user ID"}}
+		}
+		if !seen[id] {
+			seen[id] = true
+			participantIDs = append(participantIDs, id)
+		}
+	}
+
+	// Validate participants after deduplication so a request listing only the
+	// creator, possibly several times, can't produce a one-person conversation
+	if len(participantIDs) == 0 {
+		msg := "must include at least one user other than the creator"
+		if req.Type == ConversationTypeDM {
+			msg = "a direct message needs a participant other than the creator"
+		}
+		return nil, &ValidationError{Fields: map[string]string{"participant_ids": msg}}
 	}
 
 	// For DM conversations, ensure only 2 participants
-	if req.Type == ConversationTypeDM && len(req.ParticipantIDs) != 1 {
+	if req.Type == ConversationTypeDM && len(participantIDs) != 1 {
 		return nil, ErrInvalidDMParticipants
 	}
 
+	postPolicy := req.PostPolicy
+	if postPolicy == "" {
+		postPolicy = PostPolicyEveryone
+	}
+	if !postPolicy.IsValid() || (req.Type == ConversationTypeDM && postPolicy != PostPolicyEveryone) {
+		return nil, ErrInvalidRequest
+	}
+
+	if req.Type == ConversationTypeGroup {
+		maxParticipants, err := uc.maxGroupParticipants(ctx, orgID)
+		if err != nil {
+			return nil, err
+		}
+		if maxParticipants > 0 && len(participantIDs)+1 > maxParticipants {
+			return nil, ErrGroupFull
+		}
+	}
+
+	// DMs count too, or opening DMs with everyone would be an unlimited way around it
+	maxCreated, err := uc.maxConversationsPerUser(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The creator is checked too, the org ID comes from a header and can't be trusted on its own
+	if err := uc.verifySameOrganization(ctx, orgID, append([]uuid.UUID{creatorID}, participantIDs...)); err != nil {
+		return nil, err
+	}
+
+	if req.Type == ConversationTypeDM {
+		blocked, err := uc.repo.IsBlockedBetween(ctx, orgID, creatorID, participantIDs[0])
+		if err != nil {
+			return nil, err
+		}
+		if blocked {
+			return nil, ErrMessagingUnavailable
+		}
+	}
+
 	// Create conversation
 	conversation := &Conversation{
 		ID:             uuid.New(),
@@ -137,10 +520,12 @@ func (uc *ChatUsecase) CreateConversation(ctx context.Context, req *CreateConver
 		Title:          req.Title,
 		CreatedBy:      creatorID,
 		IsEncrypted:    req.IsEncrypted,
+		PostPolicy:     postPolicy,
 		CreatedAt:      time.Now(),
 	}
+	conversation.UpdatedAt = conversation.CreatedAt
 
-	if err := uc.repo.CreateConversation(ctx, conversation); err != nil {
+	if err := uc.repo.CreateConversation(ctx, conversation, maxCreated); err != nil {
 		return nil, err
 	}
 
@@ -158,11 +543,7 @@ func (uc *ChatUsecase) CreateConversation(ctx context.Context, req *CreateConver
 	}
 
 	// Add other participants
-	for _, participantID := range req.ParticipantIDs {
-		if participantID == creatorID {
-			continue // Skip creator, already added
-		}
-
+	for _, participantID := range participantIDs {
 		participant := &Participant{
 			ID:             uuid.New(),
 			ConversationID: conversation.ID,
@@ -176,11 +557,75 @@ func (uc *ChatUsecase) CreateConversation(ctx context.Context, req *CreateConver
 		}
 	}
 
+	uc.postSystemMessage(ctx, conversation.ID, creatorID, SystemEventConversationCreated, map[string]interface{}{
+		MetaKeyTargetIDs: userIDStrings(participantIDs),
+	})
+	uc.reindexConversation(conversation.ID)
+
 	return conversation, nil
 }
 
-func (uc *ChatUsecase) GetUserConversations(ctx context.Context, userID uuid.UUID) ([]*Conversation, error) {
-	return uc.repo.GetUserConversations(ctx, userID)
+// GetUserConversations lists the user's conversations, most recently active first
+func (uc *ChatUsecase) GetUserConversations(ctx context.Context, userID uuid.UUID, filter ConversationListFilter) ([]*Conversation, error) {
+	conversations, err := uc.repo.GetUserConversations(ctx, userID, filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := uc.applyRetention(ctx, conversations...); err != nil {
+		return nil, err
+	}
+	if err := uc.resolveDisplayTitles(ctx, userID, conversations); err != nil {
+		return nil, err
+	}
+	return conversations, nil
+}
+
+// untitledGroupTitleMembers is how many members an untitled group's display title lists
+const untitledGroupTitleMembers = 3
+
+// resolveDisplayTitles fills in who each DM is with and names untitled groups after
+// their members, with one query for the whole list
+func (uc *ChatUsecase) resolveDisplayTitles(ctx context.Context, userID uuid.UUID, conversations []*Conversation) error {
+	var unresolved []uuid.UUID
+	for _, conversation := range conversations {
+		conversation.DisplayTitle = conversation.Title
+		if conversation.Type == ConversationTypeDM || conversation.Title == "" {
+			unresolved = append(unresolved, conversation.ID)
+		}
+	}
+	if len(unresolved) == 0 {
+		return nil
+	}
+
+	snapshots, err := uc.repo.GetParticipantSnapshots(ctx, unresolved, userID, untitledGroupTitleMembers)
+	if err != nil {
+		return err
+	}
+
+	for _, conversation := range conversations {
+		others := snapshots[conversation.ID]
+		if len(others) == 0 {
+			continue
+		}
+		if conversation.Type == ConversationTypeDM {
+			conversation.OtherParticipant = others[0]
+			conversation.DisplayTitle = others[0].DisplayName
+			continue
+		}
+		if conversation.Title == "" {
+			names := make([]string, len(others))
+			for i, other := range others {
+				names[i] = other.DisplayName
+			}
+			conversation.DisplayTitle = strings.Join(names, ", ")
+		}
+	}
+	return nil
+}
+
+// CountUserConversations counts the conversations GetUserConversations would return without paging
+func (uc *ChatUsecase) CountUserConversations(ctx context.Context, userID uuid.UUID, filter ConversationListFilter) (int, error) {
+	return uc.repo.CountUserConversations(ctx, userID, filter)
 }
 
 func (uc *ChatUsecase) GetConversation(ctx context.Context, conversationID, userID uuid.UUID) (*Conversation, error) {
@@ -193,21 +638,54 @@ func (uc *ChatUsecase) GetConversation(ctx context.Context, conversationID, user
 		return nil, ErrNotParticipant
 	}
 
-	return uc.repo.GetConversation(ctx, conversationID)
+	conversation, err := uc.repo.GetConversation(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if err := uc.applyRetention(ctx, conversation); err != nil {
+		return nil, err
+	}
+	return conversation, nil
 }
 
-func (uc *ChatUsecase) SendMessage(ctx context.Context, req *SendMessageRequest, senderID uuid.UUID) (*Message, error) {
-	// Check if user is participant
-	participant, err := uc.repo.GetParticipant(ctx, req.ConversationID, senderID)
+// SendMessage validates and publishes a message. When the request carries an
+// idempotency key that was already used, the original message is returned with
+// replayed set and nothing is published again.
+func (uc *ChatUsecase) SendMessage(ctx context.Context, req *SendMessageRequest, senderID uuid.UUID) (message *Message, replayed bool, err error) {
+	// Deleting a conversation takes its participants with it, so look it up first to
+	// report it as gone rather than as a conversation the sender isn't in
+	conversation, err := uc.repo.GetConversation(ctx, req.ConversationID)
 	if err != nil {
-		return nil, ErrNotParticipant
+		return nil, false, err
 	}
-	if participant == nil {
-		return nil, ErrNotParticipant
+	participant, err := uc.currentParticipant(ctx, req.ConversationID, senderID)
+	if err != nil {
+		return nil, false, err
+	}
+	if conversation.LockedFor(participant) {
+		return nil, false, ErrConversationLocked
+	}
+	if !conversation.CanPost(participant) {
+		return nil, false, ErrPostingRestricted
+	}
+
+	blocked, err := uc.isDMBlocked(ctx, conversation, senderID)
+	if err != nil {
+		return nil, false, err
+	}
+	if blocked {
+		return nil, false, ErrMessagingUnavailable
+	}
+
+	if err := validateIdempotencyKey(req); err != nil {
+		return nil, false, err
+	}
+	if err := uc.validateMessage(ctx, conversation, req); err != nil {
+		return nil, false, err
 	}
 
 	// Create message
-	message := &Message{
+	message = &Message{
 		ID:             uuid.New(),
 		ConversationID: req.ConversationID,
 		SenderID:       senderID,
@@ -215,29 +693,262 @@ func (uc *ChatUsecase) SendMessage(ctx context.Context, req *SendMessageRequest,
 		Content:        req.Content,
 		Meta:           req.Meta,
 		DedupeKey:      req.DedupeKey,
+		ParentID:       req.ParentID,
 		SentAt:         time.Now(),
 		Deleted:        false,
 	}
 
-	// Publish to MQTT for real-time delivery
+	// The quote snapshot is server-owned; clients can't supply their own
+	if message.Meta != nil {
+		delete(message.Meta, MetaKeyReplyTo)
+	}
+	if req.ParentID != nil {
+		snapshot, err := uc.buildReplySnapshot(ctx, req.ConversationID, *req.ParentID)
+		if err != nil {
+			return nil, false, err
+		}
+		if message.Meta == nil {
+			message.Meta = make(map[string]interface{})
+		}
+		message.Meta[MetaKeyReplyTo] = snapshot
+	}
+
+	// Resolve @mentions server-side so clients can't mention non-participants.
+	// Encrypted content is opaque to the server, so it is never scanned.
+	var mentioned []uuid.UUID
+	if message.Meta != nil {
+		delete(message.Meta, MetaKeyMentions)
+	}
+	if !conversation.IsEncrypted && strings.Contains(message.Content, "@") {
+		participants, err := uc.repo.GetConversationParticipants(ctx, req.ConversationID)
+		if err != nil {
+			return nil, false, err
+		}
+
+		mentioned = resolveMentions(message.Content, participants, senderID)
+		if len(mentioned) > 0 {
+			if message.Meta == nil {
+				message.Meta = make(map[string]interface{})
+			}
+			mentionIDs := make([]string, len(mentioned))
+			for i, id := range mentioned {
+				mentionIDs[i] = id.String()
+			}
+			message.Meta[MetaKeyMentions] = mentionIDs
+		}
+	}
+
+	// Unfurled before the idempotency claim stores the message, so replays carry the previews too
+	uc.attachPreviews(ctx, conversation, message)
+
+	if req.IdempotencyKey != "" {
+		original, err := uc.claimIdempotencyKey(ctx, req, message)
+		if err != nil {
+			return nil, false, err
+		}
+		if original != nil {
+			return original, true, nil
+		}
+	}
+
+	// Checked after the idempotency claim so a retried send that already went
+	// through is replayed instead of counted as a duplicate or rejected for
+	// attachments it has since claimed
+	if err := uc.checkAttachments(ctx, conversation, senderID, message.Meta); err != nil {
+		uc.releaseIdempotencyKey(ctx, req)
+		return nil, false, err
+	}
+	if err := uc.checkFlood(ctx, conversation, participant, message); err != nil {
+		uc.releaseIdempotencyKey(ctx, req)
+		return nil, false, err
+	}
+
+	// Unfurling links can take a while; a sender removed in the meantime must not
+	// get the message through
+	if _, err := uc.currentParticipant(ctx, req.ConversationID, senderID); err != nil {
+		uc.releaseIdempotencyKey(ctx, req)
+		return nil, false, err
+	}
+
+	// Publish to MQTT for real-time delivery; with the outbox publisher this only
+	// stores the event and the dispatcher delivers it
 	if err := uc.publisher.PublishMessage(ctx, req.ConversationID, message); err != nil {
+		uc.releaseIdempotencyKey(ctx, req)
+		return nil, false, err
+	}
+
+	// Mentioned users and the replied-to author are notified on their personal topics
+	// by message-service, once it has stored the message
+
+	// Push notifications for offline recipients are dispatched in the background
+	if uc.notifier != nil {
+		uc.notifier.Enqueue(message)
+	}
+
+	uc.recordActivity(senderID)
+
+	return message, false, nil
+}
+
+// currentParticipant returns the user's participant row in the conversation, or
+// ErrNotParticipant if they were never in it or have since left or been removed
+func (uc *ChatUsecase) currentParticipant(ctx context.Context, conversationID, userID uuid.UUID) (*Participant, error) {
+	participant, err := uc.repo.GetParticipant(ctx, conversationID, userID)
+	if err != nil {
 		return nil, err
 	}
+	if participant == nil {
+		return nil, ErrNotParticipant
+	}
+	return participant, nil
+}
+
+// CheckParticipant returns ErrNotParticipant unless the user is currently in the
+// conversation, for services that show conversation data to its members
+func (uc *ChatUsecase) CheckParticipant(ctx context.Context, conversationID, userID uuid.UUID) error {
+	_, err := uc.currentParticipant(ctx, conversationID, userID)
+	return err
+}
 
-	return message, nil
+// MessageListOptions tweaks what GetConversationMessages returns
+type MessageListOptions struct {
+	// IncludeReceipts attaches per-recipient receipts to the caller's own messages
+	IncludeReceipts bool
+	// HideBlocked drops messages sent by users the caller has blocked
+	HideBlocked bool
+	// ReadPolicy decides whether is_read means read by all other participants or
+	// by at least one; empty uses the configured policy
+	ReadPolicy ReadPolicy
+	// AfterSeq only returns messages with a higher seq, oldest first, so a client
+	// catching up after a reconnect can page forward without gaps
+	AfterSeq *int64
 }
 
-func (uc *ChatUsecase) GetConversationMessages(ctx context.Context, conversationID, userID uuid.UUID, limit, offset int) ([]*Message, error) {
+// hideBlockedBy returns the user whose blocks filter the list, nil if none do
+func (opts MessageListOptions) hideBlockedBy(userID uuid.UUID) *uuid.UUID {
+	if !opts.HideBlocked {
+		return nil
+	}
+	return &userID
+}
+
+// checkHistoryAccess verifies the conversation belongs to orgID and userID takes part in it
+func (uc *ChatUsecase) checkHistoryAccess(ctx context.Context, conversationID, userID, orgID uuid.UUID) error {
+	// Membership alone isn't trusted across tenants; a conversation outside the
+	// caller's organization doesn't exist as far as they're concerned
+	conversation, err := uc.repo.GetConversation(ctx, conversationID)
+	if err != nil {
+		return err
+	}
+	if conversation.OrganizationID != orgID {
+		return ErrConversationNotFound
+	}
+
 	// Check if user is participant
 	participant, err := uc.repo.GetParticipant(ctx, conversationID, userID)
 	if err != nil {
-		return nil, ErrNotParticipant
+		return ErrNotParticipant
 	}
 	if participant == nil {
-		return nil, ErrNotParticipant
+		return ErrNotParticipant
 	}
+	return nil
+}
 
-	return uc.repo.GetConversationMessages(ctx, conversationID, limit, offset)
+// CountConversationMessages counts the messages GetConversationMessages lists with
+// the same options, for pagination totals
+func (uc *ChatUsecase) CountConversationMessages(ctx context.Context, conversationID, userID, orgID uuid.UUID, opts MessageListOptions) (int, error) {
+	if err := uc.checkHistoryAccess(ctx, conversationID, userID, orgID); err != nil {
+		return 0, err
+	}
+	return uc.repo.CountConversationMessages(ctx, orgID, conversationID, opts.AfterSeq, opts.hideBlockedBy(userID))
+}
+
+func (uc *ChatUsecase) GetConversationMessages(ctx context.Context, conversationID, userID, orgID uuid.UUID, limit, offset int, opts MessageListOptions) ([]*Message, error) {
+	if err := uc.checkHistoryAccess(ctx, conversationID, userID, orgID); err != nil {
+		return nil, err
+	}
+
+	// Blocked senders are filtered by the query, so pages stay full and totals agree
+	messages, err := uc.repo.GetConversationMessages(ctx, orgID, conversationID, opts.AfterSeq, opts.hideBlockedBy(userID), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	// Opening a conversation counts as activity
+	uc.recordActivity(userID)
+
+	return uc.decorateMessages(ctx, conversationID, userID, messages, opts)
+}
+
+// decorateMessages derives the caller's view of listed messages: read state under the
+// requested policy, redacted reply quotes and delivery state
+func (uc *ChatUsecase) decorateMessages(ctx context.Context, conversationID, userID uuid.UUID, messages []*Message, opts MessageListOptions) ([]*Message, error) {
+	readPolicy := opts.ReadPolicy
+	if readPolicy == "" {
+		readPolicy = uc.config.ReadPolicy
+	}
+	for _, message := range messages {
+		redactDeletedParent(message)
+		if readPolicy == ReadPolicyAny {
+			message.IsRead = message.ReadByAny
+		} else {
+			message.IsRead = message.ReadByAll
+		}
+	}
+
+	// Delivery status is only visible to the sender; other participants
+	// shouldn't learn who has read what
+	var ownMessageIDs []uuid.UUID
+	for _, message := range messages {
+		if message.SenderID != userID {
+			continue
+		}
+		message.DeliveryStatus = uc.deliveryStatus(message)
+		ownMessageIDs = append(ownMessageIDs, message.ID)
+	}
+
+	if opts.IncludeReceipts && len(ownMessageIDs) > 0 {
+		receipts, err := uc.repo.GetMessageReceipts(ctx, ownMessageIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			if message.SenderID == userID {
+				message.Receipts = receipts[message.ID]
+			}
+		}
+	}
+
+	return messages, nil
+}
+
+// IsValid reports whether p is a known post policy
+func (p PostPolicy) IsValid() bool {
+	return p == PostPolicyEveryone || p == PostPolicyAdminsOnly
+}
+
+// CanPost reports whether the participant may send messages in the conversation
+func (c *Conversation) CanPost(participant *Participant) bool {
+	return c.PostPolicy != PostPolicyAdminsOnly || participant.Role == ParticipantRoleAdmin
+}
+
+// LockedFor reports whether the lock keeps the participant from posting or typing
+func (c *Conversation) LockedFor(participant *Participant) bool {
+	return c.Locked && participant.Role != ParticipantRoleAdmin
+}
+
+// deliveryStatus derives the sent/delivered/read tick state from receipt aggregates
+func (uc *ChatUsecase) deliveryStatus(message *Message) DeliveryStatus {
+	if message.ReadCount > 0 {
+		if uc.config.ReadPolicy == ReadPolicyAny || message.ReadCount >= message.RecipientCount {
+			return DeliveryStatusRead
+		}
+	}
+	if message.DeliveredCount > 0 {
+		return DeliveryStatusDelivered
+	}
+	return DeliveryStatusSent
 }
 
 func (uc *ChatUsecase) AddParticipant(ctx context.Context, conversationID, requesterID uuid.UUID, req *AddParticipantRequest) error {
@@ -249,21 +960,219 @@ func (uc *ChatUsecase) AddParticipant(ctx context.Context, conversationID, reque
 	if requesterParticipant == nil || requesterParticipant.Role != ParticipantRoleAdmin {
 		return ErrInsufficientPermissions
 	}
+	if req.UserID == uuid.Nil {
+		return ErrInvalidRequest
+	}
+	role, err := newParticipantRole(req.Role)
+	if err != nil {
+		return err
+	}
+
+	conversation, err := uc.repo.GetConversation(ctx, conversationID)
+	if err != nil {
+		return err
+	}
+	if conversation.Type == ConversationTypeDM {
+		return ErrInvalidDMParticipants
+	}
+
+	existing, err := uc.repo.GetParticipant(ctx, conversationID, req.UserID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return nil
+	}
+
+	if err := uc.verifySameOrganization(ctx, conversation.OrganizationID, []uuid.UUID{req.UserID}); err != nil {
+		return err
+	}
+	if err := uc.checkGroupCapacity(ctx, conversation, 1); err != nil {
+		return err
+	}
 
 	// Add participant
 	participant := &Participant{
 		ID:             uuid.New(),
 		ConversationID: conversationID,
 		UserID:         req.UserID,
-		Role:           req.Role,
+		Role:           role,
 		JoinedAt:       time.Now(),
 	}
 
-	if participant.Role == "" {
-		participant.Role = ParticipantRoleMember
+	if err := uc.repo.AddParticipant(ctx, participant); err != nil {
+		return err
 	}
 
-	return uc.repo.AddParticipant(ctx, participant)
+	uc.postSystemMessage(ctx, conversationID, requesterID, SystemEventParticipantsAdded, map[string]interface{}{
+		MetaKeyTargetIDs: userIDStrings([]uuid.UUID{req.UserID}),
+		MetaKeyRole:      participant.Role,
+	})
+	uc.requestKeyRotation(ctx, conversation, KeyRotationParticipantsAdded, []uuid.UUID{req.UserID})
+	uc.reindexConversation(conversationID)
+	return nil
+}
+
+// newParticipantRole is the role a user is added with, member unless the request
+// asks for admin
+func newParticipantRole(role ParticipantRole) (ParticipantRole, error) {
+	switch role {
+	case "":
+		return ParticipantRoleMember, nil
+	case ParticipantRoleAdmin, ParticipantRoleMember:
+		return role, nil
+	}
+	return "", &ValidationError{Fields: map[string]string{"role": "must be admin or member"}}
+}
+
+// AddParticipants adds many users to a conversation in one write and reports what
+// happened to each of them. Users that don't exist or belong to another organization
+// are skipped rather than failing the whole request.
+func (uc *ChatUsecase) AddParticipants(ctx context.Context, conversationID, requesterID uuid.UUID, req *AddParticipantRequest) ([]*ParticipantAddResult, error) {
+	// Check if requester is admin
+	requesterParticipant, err := uc.repo.GetParticipant(ctx, conversationID, requesterID)
+	if err != nil {
+		return nil, ErrNotParticipant
+	}
+	if requesterParticipant == nil || requesterParticipant.Role != ParticipantRoleAdmin {
+		return nil, ErrInsufficientPermissions
+	}
+
+	conversation, err := uc.repo.GetConversation(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if conversation.Type == ConversationTypeDM {
+		return nil, ErrInvalidDMParticipants
+	}
+
+	role, err := newParticipantRole(req.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop duplicates while keeping the order the client sent
+	seen := make(map[uuid.UUID]bool)
+	var userIDs []uuid.UUID
+	for _, id := range req.UserIDs {
+		if id == uuid.Nil || seen[id] {
+			continue
+		}
+		seen[id] = true
+		userIDs = append(userIDs, id)
+	}
+	if len(userIDs) == 0 {
+		return nil, ErrInvalidRequest
+	}
+
+	orgs, err := uc.repo.GetUserOrganizations(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*ParticipantAddResult, len(userIDs))
+	var candidates []*Participant
+	now := time.Now()
+	for i, id := range userIDs {
+		results[i] = &ParticipantAddResult{UserID: id}
+
+		orgID, ok := orgs[id]
+		switch {
+		case !ok:
+			results[i].Status = ParticipantAddStatusNotFound
+		case orgID != conversation.OrganizationID:
+			results[i].Status = ParticipantAddStatusWrongOrg
+		default:
+			candidates = append(candidates, &Participant{
+				ID:             uuid.New(),
+				ConversationID: conversationID,
+				UserID:         id,
+				Role:           role,
+				JoinedAt:       now,
+			})
+		}
+	}
+
+	if len(candidates) == 0 {
+		return results, nil
+	}
+
+	// Existing members among the candidates are counted too, so this errs on the strict side
+	if err := uc.checkGroupCapacity(ctx, conversation, len(candidates)); err != nil {
+		return nil, err
+	}
+
+	added, err := uc.repo.AddParticipants(ctx, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	addedSet := make(map[uuid.UUID]bool, len(added))
+	for _, id := range added {
+		addedSet[id] = true
+	}
+	for _, result := range results {
+		if result.Status != "" {
+			continue
+		}
+		if addedSet[result.UserID] {
+			result.Status = ParticipantAddStatusAdded
+		} else {
+			result.Status = ParticipantAddStatusAlreadyMember
+		}
+	}
+
+	if len(added) > 0 {
+		if err := uc.publisher.PublishParticipantsAdded(ctx, conversationID, requesterID, added); err != nil {
+			log.Printf("Failed to publish participants-added event for conversation %s: %v", conversationID, err)
+		}
+		uc.postSystemMessage(ctx, conversationID, requesterID, SystemEventParticipantsAdded, map[string]interface{}{
+			MetaKeyTargetIDs: userIDStrings(added),
+			MetaKeyRole:      role,
+		})
+		uc.requestKeyRotation(ctx, conversation, KeyRotationParticipantsAdded, added)
+		uc.reindexConversation(conversationID)
+	}
+
+	return results, nil
+}
+
+// verifySameOrganization rejects users that don't exist or belong to another organization
+func (uc *ChatUsecase) verifySameOrganization(ctx context.Context, orgID uuid.UUID, userIDs []uuid.UUID) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	orgs, err := uc.repo.GetUserOrganizations(ctx, userIDs)
+	if err != nil {
+		return err
+	}
+	for _, id := range userIDs {
+		if userOrg, ok := orgs[id]; !ok || userOrg != orgID {
+			return ErrCrossOrgParticipant
+		}
+	}
+	return nil
+}
+
+// checkGroupCapacity rejects adding more members than the organization's group size allows
+func (uc *ChatUsecase) checkGroupCapacity(ctx context.Context, conversation *Conversation, adding int) error {
+	if conversation.Type != ConversationTypeGroup {
+		return nil
+	}
+	maxParticipants, err := uc.maxGroupParticipants(ctx, conversation.OrganizationID)
+	if err != nil || maxParticipants <= 0 {
+		return err
+	}
+
+	count, err := uc.repo.CountParticipants(ctx, conversation.ID)
+	if err != nil {
+		return err
+	}
+	if count+adding > maxParticipants {
+		return ErrGroupFull
+	}
+	return nil
 }
 
 func (uc *ChatUsecase) RemoveParticipant(ctx context.Context, conversationID, requesterID, targetUserID uuid.UUID) error {
@@ -280,35 +1189,195 @@ func (uc *ChatUsecase) RemoveParticipant(ctx context.Context, conversationID, re
 		return ErrInsufficientPermissions
 	}
 
-	return uc.repo.RemoveParticipant(ctx, conversationID, targetUserID)
+	if err := uc.repo.RemoveParticipant(ctx, conversationID, targetUserID); err != nil {
+		return err
+	}
+
+	conversation, err := uc.repo.GetConversation(ctx, conversationID)
+	if err == nil {
+		uc.requestKeyRotation(ctx, conversation, KeyRotationParticipantRemoved, []uuid.UUID{targetUserID})
+	}
+	uc.reindexConversation(conversationID)
+	if requesterID == targetUserID {
+		uc.postSystemMessage(ctx, conversationID, requesterID, SystemEventParticipantLeft, nil)
+	} else {
+		uc.postSystemMessage(ctx, conversationID, requesterID, SystemEventParticipantRemoved, map[string]interface{}{
+			MetaKeyTargetIDs: userIDStrings([]uuid.UUID{targetUserID}),
+		})
+		if conversation != nil {
+			uc.auditConversationAction(ctx, conversation, requesterID, AuditActionParticipantRemove,
+				map[string]interface{}{"user_id": targetUserID}, nil)
+		}
+	}
+	return nil
 }
 
-func (uc *ChatUsecase) UpdateConversation(ctx context.Context, conversationID, requesterID uuid.UUID, req *UpdateConversationRequest) (*Conversation, error) {
-	// Check if requester is admin
+// UpdateParticipantRole promotes or demotes a member of a group. Only admins may
+// change roles.
+func (uc *ChatUsecase) UpdateParticipantRole(ctx context.Context, conversationID, requesterID, targetUserID uuid.UUID, role ParticipantRole) error {
 	requesterParticipant, err := uc.repo.GetParticipant(ctx, conversationID, requesterID)
 	if err != nil {
-		return nil, ErrNotParticipant
+		return ErrNotParticipant
 	}
 	if requesterParticipant == nil || requesterParticipant.Role != ParticipantRoleAdmin {
-		return nil, ErrInsufficientPermissions
+		return ErrInsufficientPermissions
+	}
+	if role != ParticipantRoleAdmin && role != ParticipantRoleMember {
+		return &ValidationError{Fields: map[string]string{"role": "must be admin or member"}}
 	}
 
+	conversation, err := uc.repo.GetConversation(ctx, conversationID)
+	if err != nil {
+		return err
+	}
+	if conversation.Type == ConversationTypeDM {
+		return ErrInvalidDMParticipants
+	}
+
+	target, err := uc.repo.GetParticipant(ctx, conversationID, targetUserID)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return ErrNotParticipant
+	}
+	if target.Role == role {
+		return nil
+	}
+
+	if err := uc.repo.UpdateParticipantRole(ctx, conversationID, targetUserID, role); err != nil {
+		return err
+	}
+
+	uc.postSystemMessage(ctx, conversationID, requesterID, SystemEventRoleChanged, map[string]interface{}{
+		MetaKeyTargetIDs: userIDStrings([]uuid.UUID{targetUserID}),
+		MetaKeyOldValue:  target.Role,
+		MetaKeyNewValue:  role,
+	})
+	uc.auditConversationAction(ctx, conversation, requesterID, AuditActionParticipantRole,
+		map[string]interface{}{"user_id": targetUserID},
+		map[string]audit.Change{"role": {Before: target.Role, After: role}})
+	return nil
+}
+
+func (uc *ChatUsecase) UpdateConversation(ctx context.Context, conversationID, requesterID uuid.UUID, req *UpdateConversationRequest) (*Conversation, error) {
 	conversation, err := uc.repo.GetConversation(ctx, conversationID)
 	if err != nil {
 		return nil, err
 	}
 
+	// Conversation admins can change everything; organization admins handling an
+	// incident can only lock or unlock
+	requesterParticipant, err := uc.repo.GetParticipant(ctx, conversationID, requesterID)
+	if err != nil {
+		return nil, ErrNotParticipant
+	}
+	if requesterParticipant == nil || requesterParticipant.Role != ParticipantRoleAdmin {
+		if !req.onlyLocks() {
+			return nil, ErrInsufficientPermissions
+		}
+		if err := uc.requireOrgAdminOf(ctx, requesterID, conversation.OrganizationID); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.IsEncrypted != nil && *req.IsEncrypted != conversation.IsEncrypted {
+		return nil, &ValidationError{Fields: map[string]string{"is_encrypted": "cannot be changed after creation"}}
+	}
+
+	oldTitle, oldPostPolicy, oldRetention := conversation.Title, conversation.PostPolicy, conversation.RetentionDays
+	oldSlowMode, oldLocked := conversation.SlowModeSeconds, conversation.Locked
+	before := conversationAuditSnapshot(conversation)
+
 	if req.Title != nil {
 		conversation.Title = *req.Title
 	}
 
+	if req.PostPolicy != nil {
+		if !req.PostPolicy.IsValid() || (conversation.Type == ConversationTypeDM && *req.PostPolicy != PostPolicyEveryone) {
+			return nil, ErrInvalidRequest
+		}
+		conversation.PostPolicy = *req.PostPolicy
+	}
+
+	if req.RetentionDays != nil {
+		switch days := *req.RetentionDays; {
+		case days == 0:
+			conversation.RetentionDays = nil
+		case days < 0 || days > MaxRetentionDays:
+			return nil, &ValidationError{Fields: map[string]string{"retention_days": "must be between 1 and 36500, or 0 to inherit the organization's"}}
+		default:
+			conversation.RetentionDays = &days
+		}
+	}
+
+	if req.SlowModeSeconds != nil {
+		if *req.SlowModeSeconds < 0 || *req.SlowModeSeconds > MaxSlowModeSeconds {
+			return nil, &ValidationError{Fields: map[string]string{"slow_mode_seconds": "must be between 0 and 3600"}}
+		}
+		conversation.SlowModeSeconds = *req.SlowModeSeconds
+	}
+
+	if req.Locked != nil {
+		conversation.Locked = *req.Locked
+	}
+
+	conversation.UpdatedAt = time.Now()
 	if err := uc.repo.UpdateConversation(ctx, conversation); err != nil {
 		return nil, err
 	}
 
+	if conversation.Title != oldTitle {
+		uc.reindexConversation(conversationID)
+		uc.postSystemMessage(ctx, conversationID, requesterID, SystemEventTitleChanged, map[string]interface{}{
+			MetaKeyOldValue: oldTitle,
+			MetaKeyNewValue: conversation.Title,
+		})
+	}
+	if conversation.PostPolicy != oldPostPolicy {
+		uc.postSystemMessage(ctx, conversationID, requesterID, SystemEventPostPolicyChanged, map[string]interface{}{
+			MetaKeyOldValue: oldPostPolicy,
+			MetaKeyNewValue: conversation.PostPolicy,
+		})
+	}
+	if !equalIntPtr(conversation.RetentionDays, oldRetention) {
+		uc.postSystemMessage(ctx, conversationID, requesterID, SystemEventRetentionChanged, map[string]interface{}{
+			MetaKeyOldValue: oldRetention,
+			MetaKeyNewValue: conversation.RetentionDays,
+		})
+	}
+	if conversation.SlowModeSeconds != oldSlowMode {
+		uc.postSystemMessage(ctx, conversationID, requesterID, SystemEventSlowModeChanged, map[string]interface{}{
+			MetaKeyOldValue: oldSlowMode,
+			MetaKeyNewValue: conversation.SlowModeSeconds,
+		})
+	}
+	if conversation.Locked != oldLocked {
+		event := SystemEventConversationUnlocked
+		if conversation.Locked {
+			event = SystemEventConversationLocked
+		}
+		uc.postSystemMessage(ctx, conversationID, requesterID, event, nil)
+	}
+	if changes := audit.Diff(before, conversationAuditSnapshot(conversation)); len(changes) > 0 {
+		uc.auditConversationAction(ctx, conversation, requesterID, AuditActionConversationUpdate, nil, changes)
+	}
+
+	if err := uc.applyRetention(ctx, conversation); err != nil {
+		return nil, err
+	}
+
+	// Lets clients apply settings such as the lock without refetching the conversation
+	if err := uc.publisher.PublishConversationUpdated(ctx, conversation, requesterID); err != nil {
+		log.Printf("Failed to publish update of conversation %s: %v", conversationID, err)
+	}
 	return conversation, nil
 }
 
+// maxReadReceiptsPerMark bounds the read receipts a single MarkAsRead creates, so
+// catching up on a long backlog only writes receipts for the newest messages
+const maxReadReceiptsPerMark = 500
+
 func (uc *ChatUsecase) MarkAsRead(ctx context.Context, conversationID, userID uuid.UUID) error {
 	// Check if user is participant
 	participant, err := uc.repo.GetParticipant(ctx, conversationID, userID)
@@ -319,7 +1388,22 @@ func (uc *ChatUsecase) MarkAsRead(ctx context.Context, conversationID, userID uu
 		return ErrNotParticipant
 	}
 
-	return uc.repo.UpdateLastReadAt(ctx, conversationID, userID)
+	readAt := time.Now()
+	messageIDs, err := uc.repo.MarkConversationRead(ctx, conversationID, userID, readAt, maxReadReceiptsPerMark)
+	if err != nil {
+		return err
+	}
+
+	// Let senders' clients update "seen by"; last_read_at is already saved, so a failed
+	// publish is only logged
+	if len(messageIDs) > 0 {
+		if err := uc.publisher.PublishReadReceipts(ctx, conversationID, userID, messageIDs, readAt); err != nil {
+			log.Printf("Failed to publish read receipts for conversation %s: %v", conversationID, err)
+		}
+	}
+
+	uc.recordActivity(userID)
+	return nil
 }
 
 func (uc *ChatUsecase) SendTypingIndicator(ctx context.Context, conversationID, userID uuid.UUID, isTyping bool) error {
@@ -332,10 +1416,32 @@ func (uc *ChatUsecase) SendTypingIndicator(ctx context.Context, conversationID,
 		return ErrNotParticipant
 	}
 
+	conversation, err := uc.repo.GetConversation(ctx, conversationID)
+	if err != nil {
+		return err
+	}
+	if conversation.LockedFor(participant) {
+		return ErrConversationLocked
+	}
+	if !uc.config.AllowMemberTypingInBroadcast && !conversation.CanPost(participant) {
+		return ErrPostingRestricted
+	}
+
+	// Typing in a blocked DM is silently dropped so neither side learns about the block
+	blocked, err := uc.isDMBlocked(ctx, conversation, userID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return nil
+	}
+
 	return uc.publisher.PublishTypingIndicator(ctx, conversationID, userID, isTyping)
 }
 
-func (uc *ChatUsecase) GetConversationParticipants(ctx context.Context, conversationID, userID uuid.UUID) ([]*Participant, error) {
+// GetConversationParticipants pages through the participants of a conversation the
+// caller takes part in, admins first and then by display name
+func (uc *ChatUsecase) GetConversationParticipants(ctx context.Context, conversationID, userID uuid.UUID, filter ParticipantListFilter) ([]*Participant, error) {
 	// Check if user is participant
 	participant, err := uc.repo.GetParticipant(ctx, conversationID, userID)
 	if err != nil {
@@ -345,5 +1451,145 @@ func (uc *ChatUsecase) GetConversationParticipants(ctx context.Context, conversa
 		return nil, ErrNotParticipant
 	}
 
-	return uc.repo.GetConversationParticipants(ctx, conversationID)
+	conversation, err := uc.repo.GetConversation(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	participants, err := uc.repo.ListParticipants(ctx, conversationID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lets clients hide the composer for members of broadcast conversations
+	for _, p := range participants {
+		p.CanPost = conversation.CanPost(p)
+	}
+
+	return participants, nil
+}
+
+// CountConversationParticipants counts the participants GetConversationParticipants
+// pages through. The caller's membership has already been checked by the listing.
+func (uc *ChatUsecase) CountConversationParticipants(ctx context.Context, conversationID uuid.UUID) (int, error) {
+	return uc.repo.CountParticipants(ctx, conversationID)
+}
+
+// PresenceUnknown is the status given to participants whose presence couldn't be looked up
+const PresenceUnknown = "unknown"
+
+// AttachParticipantPresence fills in each participant's presence status with a single
+// bulk lookup. Presence is best effort: if presence-service is slow or down the
+// participants are returned with status "unknown" instead of failing the listing.
+func (uc *ChatUsecase) AttachParticipantPresence(ctx context.Context, participants []*Participant) {
+	if len(participants) == 0 {
+		return
+	}
+	if uc.presence == nil {
+		setPresenceUnknown(participants)
+		return
+	}
+
+	userIDs := make([]uuid.UUID, len(participants))
+	for i, p := range participants {
+		userIDs[i] = p.UserID
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, presenceLookupTimeout)
+	defer cancel()
+
+	statuses, err := uc.presence.GetPresence(ctx, userIDs)
+	if err != nil {
+		log.Printf("Presence lookup failed, returning participants with unknown presence: %v", err)
+		setPresenceUnknown(participants)
+		return
+	}
+	for _, p := range participants {
+		p.Status = statuses[p.UserID]
+		if p.Status == "" {
+			p.Status = PresenceUnknown
+		}
+	}
+}
+
+func setPresenceUnknown(participants []*Participant) {
+	for _, p := range participants {
+		p.Status = PresenceUnknown
+	}
+}
+
+// MuteConversation silences push notifications for the caller in a conversation.
+// Mentions still notify while muted.
+func (uc *ChatUsecase) MuteConversation(ctx context.Context, conversationID, userID uuid.UUID, req *MuteConversationRequest) error {
+	participant, err := uc.repo.GetParticipant(ctx, conversationID, userID)
+	if err != nil {
+		return ErrNotParticipant
+	}
+	if participant == nil {
+		return ErrNotParticipant
+	}
+
+	mutedUntil := req.Until
+	if mutedUntil == nil {
+		// Postgres' 'infinity' doesn't map to time.Time, so use a far future date
+		forever := time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+		mutedUntil = &forever
+	} else if !mutedUntil.After(time.Now()) {
+		return ErrInvalidRequest
+	}
+
+	return uc.repo.SetMutedUntil(ctx, conversationID, userID, mutedUntil)
+}
+
+// UnmuteConversation re-enables push notifications for the caller in a conversation
+func (uc *ChatUsecase) UnmuteConversation(ctx context.Context, conversationID, userID uuid.UUID) error {
+	participant, err := uc.repo.GetParticipant(ctx, conversationID, userID)
+	if err != nil {
+		return ErrNotParticipant
+	}
+	if participant == nil {
+		return ErrNotParticipant
+	}
+
+	return uc.repo.SetMutedUntil(ctx, conversationID, userID, nil)
+}
+
+// PinConversation pins a conversation to the top of the caller's conversation list
+func (uc *ChatUsecase) PinConversation(ctx context.Context, conversationID, userID uuid.UUID) error {
+	participant, err := uc.repo.GetParticipant(ctx, conversationID, userID)
+	if err != nil {
+		return ErrNotParticipant
+	}
+	if participant == nil {
+		return ErrNotParticipant
+	}
+
+	// Pinning again is a no-op so clients can retry safely
+	if participant.PinnedAt != nil {
+		return nil
+	}
+
+	pinned, err := uc.repo.CountPinnedConversations(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if pinned >= MaxPinnedConversations {
+		return ErrPinLimitReached
+	}
+
+	now := time.Now()
+	return uc.repo.SetPinnedAt(ctx, conversationID, userID, &now)
+}
+
+// UnpinConversation removes a conversation from the caller's pinned list
+func (uc *ChatUsecase) UnpinConversation(ctx context.Context, conversationID, userID uuid.UUID) error {
+	participant, err := uc.repo.GetParticipant(ctx, conversationID, userID)
+	if err != nil {
+		return ErrNotParticipant
+	}
+	if participant == nil {
+		return ErrNotParticipant
+	}
+
+	return uc.repo.SetPinnedAt(ctx, conversationID, userID, nil)
 }
@@ -0,0 +1,60 @@
+package biz
+
+import (
+	"context"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// MaxConversationSearchLength caps the conversation search query
+const MaxConversationSearchLength = 100
+
+// ConversationMatch says why a conversation turned up in a search
+type ConversationMatch string
+
+const (
+	ConversationMatchTitle       ConversationMatch = "title"
+	ConversationMatchParticipant ConversationMatch = "participant"
+)
+
+// ConversationSearchResult is one of the user's conversations matching a search.
+// Title matches rank first; for participant matches, MatchedParticipant is the
+// first other participant whose name or email matched.
+type ConversationSearchResult struct {
+	*Conversation
+	MatchedOn          ConversationMatch   `json:"matched_on"`
+	MatchedParticipant *MatchedParticipant `json:"matched_participant,omitempty"`
+}
+
+type MatchedParticipant struct {
+	UserID      uuid.UUID `json:"user_id"`
+	DisplayName string    `json:"display_name"`
+}
+
+// SearchUserConversations finds the user's own conversations whose title, or one of
+// whose other participants' display name or email, contains the query
+func (uc *ChatUsecase) SearchUserConversations(ctx context.Context, userID uuid.UUID, query string, limit, offset int) ([]*ConversationSearchResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, &ValidationError{Fields: map[string]string{"q": "is required"}}
+	}
+	if utf8.RuneCountInString(query) > MaxConversationSearchLength {
+		return nil, &ValidationError{Fields: map[string]string{"q": "is too long"}}
+	}
+
+	results, err := uc.repo.SearchUserConversations(ctx, userID, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	conversations := make([]*Conversation, len(results))
+	for i, result := range results {
+		conversations[i] = result.Conversation
+	}
+	if err := uc.applyRetention(ctx, conversations...); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,77 @@
+package biz
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type DevicePlatform string
+
+const (
+	DevicePlatformIOS     DevicePlatform = "ios"
+	DevicePlatformAndroid DevicePlatform = "android"
+	DevicePlatformWeb     DevicePlatform = "web"
+)
+
+// DeviceToken is a push token registered by one of a user's devices
+type DeviceToken struct {
+	ID         uuid.UUID      `json:"id"`
+	UserID     uuid.UUID      `json:"user_id"`
+	Token      string         `json:"token"`
+	Platform   DevicePlatform `json:"platform"`
+	AppVersion string         `json:"app_version,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+type RegisterDeviceRequest struct {
+	Token      string         `json:"token" validate:"required"`
+	Platform   DevicePlatform `json:"platform" validate:"required"`
+	AppVersion string         `json:"app_version"`
+}
+
+// RegisterDevice stores a push token for the user. Re-registering an existing
+// token (e.g. after a refresh or a different user signing in on the device)
+// updates the existing row instead of creating a duplicate, and revives a token
+// that was previously pruned as invalid.
+func (uc *ChatUsecase) RegisterDevice(ctx context.Context, userID uuid.UUID, req *RegisterDeviceRequest) (*DeviceToken, error) {
+	token := strings.TrimSpace(req.Token)
+	if token == "" {
+		return nil, ErrInvalidRequest
+	}
+
+	switch req.Platform {
+	case DevicePlatformIOS, DevicePlatformAndroid, DevicePlatformWeb:
+	default:
+		return nil, ErrInvalidRequest
+	}
+
+	device := &DeviceToken{
+		ID:         uuid.New(),
+		UserID:     userID,
+		Token:      token,
+		Platform:   req.Platform,
+		AppVersion: strings.TrimSpace(req.AppVersion),
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+
+	if err := uc.repo.UpsertDeviceToken(ctx, device); err != nil {
+		return nil, err
+	}
+
+	return device, nil
+}
+
+// UnregisterDeviceToken removes one of the user's push tokens by its value, for
+// clients that only keep the token they registered
+func (uc *ChatUsecase) UnregisterDeviceToken(ctx context.Context, userID uuid.UUID, token string) error {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return ErrInvalidRequest
+	}
+	return uc.repo.DeleteUserDeviceToken(ctx, userID, token)
+}
@@ -0,0 +1,243 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ConversationDocument is the searchable copy of a conversation's metadata
+type ConversationDocument struct {
+	ID               uuid.UUID        `json:"id"`
+	OrganizationID   uuid.UUID        `json:"organization_id"`
+	Type             ConversationType `json:"type"`
+	Title            string           `json:"title"`
+	ParticipantIDs   []string         `json:"participant_ids"`
+	ParticipantNames []string         `json:"participant_names"`
+	UpdatedAt        time.Time        `json:"updated_at"`
+}
+
+// UserDocument is the searchable copy of a user's profile
+type UserDocument struct {
+	ID             uuid.UUID `json:"id"`
+	OrganizationID uuid.UUID `json:"organization_id"`
+	DisplayName    string    `json:"display_name"`
+	Email          string    `json:"email"`
+}
+
+type DiscoverConversation struct {
+	ID               uuid.UUID        `json:"id"`
+	Type             ConversationType `json:"type"`
+	Title            string           `json:"title,omitempty"`
+	ParticipantNames []string         `json:"participant_names"`
+	Score            float64          `json:"score"`
+}
+
+type DiscoverUser struct {
+	ID          uuid.UUID `json:"id"`
+	DisplayName string    `json:"display_name"`
+	Email       string    `json:"email"`
+	Score       float64   `json:"score"`
+}
+
+// DiscoverResult holds matches ordered by relevance, best first
+type DiscoverResult struct {
+	Conversations []*DiscoverConversation `json:"conversations"`
+	Users         []*DiscoverUser         `json:"users"`
+}
+
+// SearchIndex is a full-text index of conversations and users (OpenSearch).
+// Search only returns users in orgID and conversations userID takes part in.
+type SearchIndex interface {
+	EnsureIndices(ctx context.Context) error
+	IndexConversation(ctx context.Context, doc *ConversationDocument) error
+	DeleteConversation(ctx context.Context, id uuid.UUID) error
+	IndexUsers(ctx context.Context, docs []*UserDocument) error
+	Search(ctx context.Context, orgID, userID uuid.UUID, query string, limit int) (*DiscoverResult, error)
+}
+
+type SearchIndexRepo interface {
+	GetConversation(ctx context.Context, id uuid.UUID) (*Conversation, error)
+	GetConversationParticipants(ctx context.Context, conversationID uuid.UUID) ([]*Participant, error)
+	ListUsersForIndex(ctx context.Context, afterID uuid.UUID, limit int) ([]*UserDocument, error)
+}
+
+// SearchIndexer keeps the search index in sync with Postgres. Changed conversations
+// are queued and re-read from the database before indexing, so the index always
+// converges on the current state no matter what order changes arrive in. Users are
+// owned by auth-service, so they are re-synced in full on an interval instead.
+type SearchIndexer struct {
+	index            SearchIndex
+	repo             SearchIndexRepo
+	queue            chan uuid.UUID
+	userSyncInterval time.Duration
+	stop             chan struct{}
+	wg               sync.WaitGroup
+	// mu guards stopped, so Enqueue never sends on the queue once Stop has closed it
+	mu      sync.RWMutex
+	stopped bool
+}
+
+func NewSearchIndexer(index SearchIndex, repo SearchIndexRepo, queueSize int, userSyncInterval time.Duration) *SearchIndexer {
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+	if userSyncInterval <= 0 {
+		userSyncInterval = 10 * time.Minute
+	}
+	return &SearchIndexer{
+		index:            index,
+		repo:             repo,
+		queue:            make(chan uuid.UUID, queueSize),
+		userSyncInterval: userSyncInterval,
+		stop:             make(chan struct{}),
+	}
+}
+
+// Start creates the indices if needed and runs the sync workers until Stop is called
+func (ix *SearchIndexer) Start() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := ix.index.EnsureIndices(ctx); err != nil {
+		log.Printf("Failed to create search indices: %v", err)
+	}
+	cancel()
+
+	ix.wg.Add(2)
+	go func() {
+		defer ix.wg.Done()
+		for conversationID := range ix.queue {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := ix.syncConversation(ctx, conversationID); err != nil {
+				log.Printf("Error indexing conversation %s: %v", conversationID, err)
+			}
+			cancel()
+		}
+	}()
+	go func() {
+		defer ix.wg.Done()
+		ix.syncUsers()
+		ticker := time.NewTicker(ix.userSyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ix.syncUsers()
+			case <-ix.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop drains queued conversations and waits for the workers to finish
+func (ix *SearchIndexer) Stop() {
+	ix.mu.Lock()
+	if ix.stopped {
+		ix.mu.Unlock()
+		return
+	}
+	ix.stopped = true
+	close(ix.stop)
+	close(ix.queue)
+	ix.mu.Unlock()
+
+	ix.wg.Wait()
+}
+
+// Enqueue schedules a conversation to be re-indexed. If the queue is full the
+// update is dropped; the next change to the conversation will fix it up. Updates
+// arriving after Stop, from requests still finishing during shutdown, are dropped too.
+func (ix *SearchIndexer) Enqueue(conversationID uuid.UUID) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if ix.stopped {
+		log.Printf("Search indexer stopped, dropping update for conversation %s", conversationID)
+		return
+	}
+
+	select {
+	case ix.queue <- conversationID:
+	default:
+		log.Printf("Search index queue full, dropping update for conversation %s", conversationID)
+	}
+}
+
+func (ix *SearchIndexer) syncConversation(ctx context.Context, conversationID uuid.UUID) error {
+	conversation, err := ix.repo.GetConversation(ctx, conversationID)
+	if err == ErrConversationNotFound {
+		return ix.index.DeleteConversation(ctx, conversationID)
+	}
+	if err != nil {
+		return err
+	}
+
+	participants, err := ix.repo.GetConversationParticipants(ctx, conversationID)
+	if err != nil {
+		return err
+	}
+
+	doc := &ConversationDocument{
+		ID:               conversation.ID,
+		OrganizationID:   conversation.OrganizationID,
+		Type:             conversation.Type,
+		Title:            conversation.Title,
+		ParticipantIDs:   make([]string, 0, len(participants)),
+		ParticipantNames: make([]string, 0, len(participants)),
+		UpdatedAt:        conversation.UpdatedAt,
+	}
+	for _, p := range participants {
+		doc.ParticipantIDs = append(doc.ParticipantIDs, p.UserID.String())
+		if p.DisplayName != "" {
+			doc.ParticipantNames = append(doc.ParticipantNames, p.DisplayName)
+		}
+	}
+
+	return ix.index.IndexConversation(ctx, doc)
+}
+
+func (ix *SearchIndexer) syncUsers() {
+	const batchSize = 500
+	afterID := uuid.Nil
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		users, err := ix.repo.ListUsersForIndex(ctx, afterID, batchSize)
+		if err == nil && len(users) > 0 {
+			err = ix.index.IndexUsers(ctx, users)
+		}
+		cancel()
+		if err != nil {
+			log.Printf("Error syncing users to search index: %v", err)
+			return
+		}
+		if len(users) < batchSize {
+			return
+		}
+		afterID = users[len(users)-1].ID
+	}
+}
+
+// reindexConversation queues a conversation for the search index if search is enabled
+func (uc *ChatUsecase) reindexConversation(conversationID uuid.UUID) {
+	if uc.search != nil {
+		uc.search.Enqueue(conversationID)
+	}
+}
+
+// Discover searches conversation titles, participant names and users of the caller's
+// organization. Conversations are limited to ones the caller takes part in.
+func (uc *ChatUsecase) Discover(ctx context.Context, userID, orgID uuid.UUID, query string, limit int) (*DiscoverResult, error) {
+	if uc.search == nil {
+		return nil, ErrSearchUnavailable
+	}
+
+	query = strings.TrimSpace(query)
+	if len([]rune(query)) < 2 {
+		return nil, &ValidationError{Fields: map[string]string{"q": "must be at least 2 characters"}}
+	}
+
+	return uc.search.index.Search(ctx, orgID, userID, query, limit)
+}
@@ -0,0 +1,151 @@
+package biz
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxSlowModeSeconds caps the slow mode interval admins can set on a conversation
+const MaxSlowModeSeconds = 3600
+
+// FloodReason says which conversation-level protection rejected a message
+type FloodReason string
+
+const (
+	FloodReasonDuplicate FloodReason = "duplicate"
+	FloodReasonSlowMode  FloodReason = "slow_mode"
+)
+
+// FloodError rejects a message that would flood a conversation. The client may try
+// again after RetryAfter.
+type FloodError struct {
+	Reason     FloodReason
+	RetryAfter time.Duration
+}
+
+func (e *FloodError) Error() string {
+	return fmt.Sprintf("message rejected by flood control (%s), retry after %s", e.Reason, e.RetryAfter)
+}
+
+// FloodConfig tunes conversation-level flood control
+type FloodConfig struct {
+	// DuplicateLimit is how many times the same user may send identical content to a
+	// conversation within DuplicateWindow
+	DuplicateLimit  int
+	DuplicateWindow time.Duration
+	// ConversationRateLimit is the messages per second a conversation can take before
+	// it is put in slow mode for AutoSlowModeDuration, with AutoSlowModeInterval
+	// between each user's messages
+	ConversationRateLimit int
+	AutoSlowModeInterval  time.Duration
+	AutoSlowModeDuration  time.Duration
+}
+
+// DefaultFloodConfig returns the flood control settings used when nothing is configured
+func DefaultFloodConfig() FloodConfig {
+	return FloodConfig{
+		DuplicateLimit:        3,
+		DuplicateWindow:       30 * time.Second,
+		ConversationRateLimit: 20,
+		AutoSlowModeInterval:  5 * time.Second,
+		AutoSlowModeDuration:  2 * time.Minute,
+	}
+}
+
+// FloodGuard keeps flood control state somewhere shared by all chat-api replicas
+type FloodGuard interface {
+	// CountDuplicate records content sent by the user and returns how many times it
+	// was sent within window, and how long until that count expires
+	CountDuplicate(ctx context.Context, conversationID, userID uuid.UUID, contentHash string, window time.Duration) (int, time.Duration, error)
+	// CountConversationMessage records a message and returns how many the
+	// conversation has taken in the current second
+	CountConversationMessage(ctx context.Context, conversationID uuid.UUID) (int, error)
+	// StartSlowMode puts the conversation in slow mode for duration
+	StartSlowMode(ctx context.Context, conversationID uuid.UUID, interval, duration time.Duration) error
+	// GetSlowMode returns the automatic slow mode interval in effect, 0 if none
+	GetSlowMode(ctx context.Context, conversationID uuid.UUID) (time.Duration, error)
+	// ClaimSlowModeTurn lets the user post if their last message was at least interval
+	// ago and starts their next interval; otherwise it returns how long they must wait
+	ClaimSlowModeTurn(ctx context.Context, conversationID, userID uuid.UUID, interval time.Duration) (time.Duration, error)
+}
+
+// FloodController applies the flood config using a FloodGuard
+type FloodController struct {
+	guard  FloodGuard
+	config FloodConfig
+}
+
+func NewFloodController(guard FloodGuard, config FloodConfig) *FloodController {
+	defaults := DefaultFloodConfig()
+	if config.DuplicateWindow <= 0 {
+		config.DuplicateWindow = defaults.DuplicateWindow
+	}
+	if config.AutoSlowModeInterval <= 0 {
+		config.AutoSlowModeInterval = defaults.AutoSlowModeInterval
+	}
+	if config.AutoSlowModeDuration <= 0 {
+		config.AutoSlowModeDuration = defaults.AutoSlowModeDuration
+	}
+	return &FloodController{guard: guard, config: config}
+}
+
+// checkFlood rejects repeated identical content and enforces slow mode, whether set by
+// an admin or started automatically when the conversation exceeds its rate. Admins
+// are exempt from slow mode. Flood control fails open: if its state store is down,
+// messages go through.
+func (uc *ChatUsecase) checkFlood(ctx context.Context, conversation *Conversation, participant *Participant, message *Message) error {
+	if uc.flood == nil {
+		return nil
+	}
+	guard, config := uc.flood.guard, uc.flood.config
+
+	if config.DuplicateLimit > 0 {
+		sum := sha256.Sum256([]byte(message.ContentType + "\x00" + message.Content))
+		count, ttl, err := guard.CountDuplicate(ctx, conversation.ID, message.SenderID, hex.EncodeToString(sum[:]), config.DuplicateWindow)
+		if err != nil {
+			log.Printf("Flood control unavailable, skipping duplicate check: %v", err)
+		} else if count > config.DuplicateLimit {
+			return &FloodError{Reason: FloodReasonDuplicate, RetryAfter: ttl}
+		}
+	}
+
+	if participant.Role != ParticipantRoleAdmin {
+		interval := time.Duration(conversation.SlowModeSeconds) * time.Second
+		if auto, err := guard.GetSlowMode(ctx, conversation.ID); err != nil {
+			log.Printf("Flood control unavailable, skipping slow mode: %v", err)
+		} else if auto > interval {
+			interval = auto
+		}
+
+		if interval > 0 {
+			wait, err := guard.ClaimSlowModeTurn(ctx, conversation.ID, message.SenderID, interval)
+			if err != nil {
+				log.Printf("Flood control unavailable, skipping slow mode: %v", err)
+			} else if wait > 0 {
+				return &FloodError{Reason: FloodReasonSlowMode, RetryAfter: wait}
+			}
+		}
+	}
+
+	if config.ConversationRateLimit > 0 {
+		count, err := guard.CountConversationMessage(ctx, conversation.ID)
+		if err != nil {
+			log.Printf("Flood control unavailable, skipping rate check: %v", err)
+		} else if count == config.ConversationRateLimit+1 {
+			// Only the message that crosses the limit starts slow mode; this one still goes through
+			if err := guard.StartSlowMode(ctx, conversation.ID, config.AutoSlowModeInterval, config.AutoSlowModeDuration); err != nil {
+				log.Printf("Failed to start slow mode for conversation %s: %v", conversation.ID, err)
+			} else {
+				log.Printf("Conversation %s exceeded %d messages/s, slow mode on for %s", conversation.ID, config.ConversationRateLimit, config.AutoSlowModeDuration)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdempotencyKeyTTL is how long an Idempotency-Key is remembered, well past any
+// realistic client retry window
+const IdempotencyKeyTTL = 24 * time.Hour
+
+// DefaultIdempotencyPurgeInterval is how often expired idempotency keys are deleted
+// when nothing is configured
+const DefaultIdempotencyPurgeInterval = time.Hour
+
+// maxIdempotencyKeyLength bounds the header; clients typically send a UUID
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyRecord remembers the message an Idempotency-Key produced so a retried
+// send gets the same message back instead of a new one
+type IdempotencyRecord struct {
+	ConversationID uuid.UUID
+	Key            string
+	SenderID       uuid.UUID
+	Message        *Message
+	CreatedAt      time.Time
+}
+
+// claimIdempotencyKey records the message under the request's key. If the key was
+// already used by an equivalent send the original message is returned instead, and
+// the caller should answer with it rather than publishing again.
+func (uc *ChatUsecase) claimIdempotencyKey(ctx context.Context, req *SendMessageRequest, message *Message) (*Message, error) {
+	record := &IdempotencyRecord{
+		ConversationID: req.ConversationID,
+		Key:            req.IdempotencyKey,
+		SenderID:       message.SenderID,
+		Message:        message,
+		CreatedAt:      message.SentAt,
+	}
+
+	existing, err := uc.repo.ClaimIdempotencyKey(ctx, record, time.Now().Add(-IdempotencyKeyTTL))
+	if err != nil || existing == nil {
+		return nil, err
+	}
+
+	// A key reused for a different message is a client bug, not a retry
+	original := existing.Message
+	if existing.SenderID != message.SenderID || original.ContentType != req.ContentType || original.Content != req.Content {
+		return nil, ErrIdempotencyKeyReused
+	}
+	return original, nil
+}
+
+// releaseIdempotencyKey forgets the request's key after a send failed, so the
+// client's retry goes through rather than replaying a message that was never sent
+func (uc *ChatUsecase) releaseIdempotencyKey(ctx context.Context, req *SendMessageRequest) {
+	if req.IdempotencyKey == "" {
+		return
+	}
+	if err := uc.repo.ReleaseIdempotencyKey(ctx, req.ConversationID, req.IdempotencyKey); err != nil {
+		log.Printf("Failed to release idempotency key for conversation %s: %v", req.ConversationID, err)
+	}
+}
+
+// validateIdempotencyKey checks the header and makes it the message's dedupe key, so
+// the unique constraint on persisted messages backs it up
+func validateIdempotencyKey(req *SendMessageRequest) error {
+	req.IdempotencyKey = strings.TrimSpace(req.IdempotencyKey)
+	if req.IdempotencyKey == "" {
+		return nil
+	}
+
+	fields := make(map[string]string)
+	if len(req.IdempotencyKey) > maxIdempotencyKeyLength {
+		fields["Idempotency-Key"] = "must be at most 255 characters"
+	}
+	if req.DedupeKey != "" && req.DedupeKey != req.IdempotencyKey {
+		fields["dedupe_key"] = "must match the Idempotency-Key header when both are sent"
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+
+	req.DedupeKey = req.IdempotencyKey
+	return nil
+}
+
+// IdempotencyKeyPurger deletes idempotency keys past IdempotencyKeyTTL. It runs on its
+// own schedule so the table stays bounded whether or not retention purges are enabled.
+type IdempotencyKeyPurger struct {
+	repo     ChatRepo
+	interval time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewIdempotencyKeyPurger(repo ChatRepo, interval time.Duration) *IdempotencyKeyPurger {
+	if interval <= 0 {
+		interval = DefaultIdempotencyPurgeInterval
+	}
+	return &IdempotencyKeyPurger{
+		repo:     repo,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start deletes expired keys every interval until Stop is called
+func (p *IdempotencyKeyPurger) Start() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.purge()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for the purge in flight to finish
+func (p *IdempotencyKeyPurger) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+func (p *IdempotencyKeyPurger) purge() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	deleted, err := p.repo.DeleteExpiredIdempotencyKeys(ctx, time.Now().Add(-IdempotencyKeyTTL))
+	if err != nil {
+		log.Printf("Error deleting expired idempotency keys: %v", err)
+		return
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d expired idempotency keys", deleted)
+	}
+}
@@ -0,0 +1,178 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxOneTimePreKeysPerUpload caps how many one-time prekeys a single PUT /keys may carry
+const MaxOneTimePreKeysPerUpload = 100
+
+// maxPublicKeyLength bounds encoded key material; real keys are well under this
+const maxPublicKeyLength = 1024
+
+// PreKey is a public prekey identified by a client-chosen key ID
+type PreKey struct {
+	KeyID     int    `json:"key_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// SignedPreKey is a medium-term prekey signed with the user's identity key
+type SignedPreKey struct {
+	PreKey
+	Signature string `json:"signature"`
+}
+
+// PublishKeysRequest registers or rotates a user's public keys. The server only ever
+// sees public material; private keys never leave the client.
+type PublishKeysRequest struct {
+	IdentityKey    string        `json:"identity_key"`
+	SignedPreKey   *SignedPreKey `json:"signed_prekey"`
+	OneTimePreKeys []PreKey      `json:"one_time_prekeys,omitempty"`
+}
+
+// UserKeys are the long-lived keys stored for a user
+type UserKeys struct {
+	UserID       uuid.UUID    `json:"user_id"`
+	IdentityKey  string       `json:"identity_key"`
+	SignedPreKey SignedPreKey `json:"signed_prekey"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+}
+
+// KeyBundle is what another user fetches to start an encrypted session. Each fetch
+// hands out (and removes) at most one one-time prekey.
+type KeyBundle struct {
+	UserKeys
+	OneTimePreKey *PreKey `json:"one_time_prekey,omitempty"`
+}
+
+// PublishKeys stores the caller's identity key and signed prekey and appends any
+// one-time prekeys. Changing the identity key discards prekeys signed by the old one.
+func (uc *ChatUsecase) PublishKeys(ctx context.Context, userID uuid.UUID, req *PublishKeysRequest) error {
+	fields := make(map[string]string)
+
+	if !validPublicKey(req.IdentityKey) {
+		fields["identity_key"] = "is required"
+	}
+	if req.SignedPreKey == nil || !validPublicKey(req.SignedPreKey.PublicKey) || strings.TrimSpace(req.SignedPreKey.Signature) == "" {
+		fields["signed_prekey"] = "public_key and signature are required"
+	}
+	if len(req.OneTimePreKeys) > MaxOneTimePreKeysPerUpload {
+		fields["one_time_prekeys"] = "too many prekeys in one upload"
+	}
+	for _, preKey := range req.OneTimePreKeys {
+		if !validPublicKey(preKey.PublicKey) {
+			fields["one_time_prekeys"] = "every prekey needs a public_key"
+			break
+		}
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+
+	keys := &UserKeys{
+		UserID:       userID,
+		IdentityKey:  req.IdentityKey,
+		SignedPreKey: *req.SignedPreKey,
+		UpdatedAt:    time.Now(),
+	}
+
+	if err := uc.repo.UpsertUserKeys(ctx, keys, req.OneTimePreKeys); err != nil {
+		return err
+	}
+
+	// Participants of the user's encrypted conversations must stop wrapping to the old keys
+	conversationIDs, err := uc.repo.GetEncryptedConversationIDs(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to list encrypted conversations of %s for key rotation: %v", userID, err)
+		return nil
+	}
+	for _, conversationID := range conversationIDs {
+		if err := uc.publisher.PublishKeyRotation(ctx, conversationID, KeyRotationKeyPublished, []uuid.UUID{userID}); err != nil {
+			log.Printf("Failed to publish key rotation for conversation %s: %v", conversationID, err)
+		}
+	}
+	return nil
+}
+
+// GetKeyBundle returns another user's key bundle. Users can only fetch keys of
+// people in their own organization.
+func (uc *ChatUsecase) GetKeyBundle(ctx context.Context, orgID, targetUserID uuid.UUID) (*KeyBundle, error) {
+	orgs, err := uc.repo.GetUserOrganizations(ctx, []uuid.UUID{targetUserID})
+	if err != nil {
+		return nil, err
+	}
+	if userOrg, ok := orgs[targetUserID]; !ok || userOrg != orgID {
+		return nil, ErrUserNotFound
+	}
+
+	return uc.repo.ClaimKeyBundle(ctx, targetUserID)
+}
+
+// ConversationKeySet holds the published keys of a conversation's current
+// participants, without one-time prekeys: senders wrap message keys to each
+// participant's signed prekey. Missing lists the participants that haven't published
+// keys yet and so can't be encrypted to.
+type ConversationKeySet struct {
+	Keys    []*UserKeys `json:"keys"`
+	Missing []uuid.UUID `json:"missing"`
+}
+
+// KeyRotationReason says why participants of an encrypted conversation should rotate
+type KeyRotationReason string
+
+const (
+	KeyRotationParticipantsAdded  KeyRotationReason = "participants-added"
+	KeyRotationParticipantRemoved KeyRotationReason = "participant-removed"
+	KeyRotationKeyPublished       KeyRotationReason = "key-published"
+)
+
+// GetConversationKeys returns the key bundles of everyone currently in an encrypted
+// conversation
+func (uc *ChatUsecase) GetConversationKeys(ctx context.Context, conversationID, userID uuid.UUID) (*ConversationKeySet, error) {
+	if _, err := uc.getEncryptedConversation(ctx, conversationID, userID); err != nil {
+		return nil, err
+	}
+
+	return uc.repo.GetConversationKeys(ctx, conversationID)
+}
+
+func (uc *ChatUsecase) getEncryptedConversation(ctx context.Context, conversationID, userID uuid.UUID) (*Conversation, error) {
+	participant, err := uc.repo.GetParticipant(ctx, conversationID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if participant == nil {
+		return nil, ErrNotParticipant
+	}
+
+	conversation, err := uc.repo.GetConversation(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !conversation.IsEncrypted {
+		return nil, ErrNotEncrypted
+	}
+	return conversation, nil
+}
+
+// requestKeyRotation tells the participants of an encrypted conversation that its
+// membership or keys changed, so clients refetch keys and rotate their sender keys.
+// Failures are logged; clients also refetch keys when they reconnect.
+func (uc *ChatUsecase) requestKeyRotation(ctx context.Context, conversation *Conversation, reason KeyRotationReason, userIDs []uuid.UUID) {
+	if !conversation.IsEncrypted {
+		return
+	}
+	if err := uc.publisher.PublishKeyRotation(ctx, conversation.ID, reason, userIDs); err != nil {
+		log.Printf("Failed to publish key rotation for conversation %s: %v", conversation.ID, err)
+	}
+}
+
+func validPublicKey(key string) bool {
+	key = strings.TrimSpace(key)
+	return key != "" && len(key) <= maxPublicKeyLength
+}
@@ -0,0 +1,151 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/audit"
+)
+
+// Organization settings overriding the configured group limits. 0 lifts a limit.
+const (
+	OrgSettingMaxGroupParticipants    = "max_group_participants"
+	OrgSettingMaxConversationsPerUser = "max_conversations_per_user"
+
+	// maxOrganizationLimit bounds what an organization can set either limit to
+	maxOrganizationLimit = 100000
+)
+
+const AuditActionLimitsUpdate = "limits.update"
+
+// OrganizationLimits are an organization's overrides of the group limits; nil uses the
+// server's configured default
+type OrganizationLimits struct {
+	// MaxGroupParticipants caps group size including the creator
+	MaxGroupParticipants *int `json:"max_group_participants"`
+	// MaxConversationsPerUser caps how many conversations each user can create
+	MaxConversationsPerUser *int `json:"max_conversations_per_user"`
+}
+
+// GetOrganizationLimits returns the organization's overrides of the group limits to
+// its admins
+func (uc *ChatUsecase) GetOrganizationLimits(ctx context.Context, adminID, orgID uuid.UUID) (*OrganizationLimits, error) {
+	if err := uc.requireOrgAdminOf(ctx, adminID, orgID); err != nil {
+		return nil, err
+	}
+	return uc.organizationLimits(ctx, orgID)
+}
+
+func (uc *ChatUsecase) organizationLimits(ctx context.Context, orgID uuid.UUID) (*OrganizationLimits, error) {
+	settings, err := uc.repo.GetOrganizationSettings(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	return &OrganizationLimits{
+		MaxGroupParticipants:    settingInt(settings, OrgSettingMaxGroupParticipants),
+		MaxConversationsPerUser: settingInt(settings, OrgSettingMaxConversationsPerUser),
+	}, nil
+}
+
+// SetOrganizationLimits replaces the organization's overrides of the group limits.
+// Only admins of the organization may change them, and the change is audited.
+func (uc *ChatUsecase) SetOrganizationLimits(ctx context.Context, adminID, orgID uuid.UUID, req *OrganizationLimits) (*OrganizationLimits, error) {
+	if err := uc.requireOrgAdminOf(ctx, adminID, orgID); err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string)
+	for key, value := range map[string]*int{
+		OrgSettingMaxGroupParticipants:    req.MaxGroupParticipants,
+		OrgSettingMaxConversationsPerUser: req.MaxConversationsPerUser,
+	} {
+		if value != nil && (*value < 0 || *value > maxOrganizationLimit) {
+			fields[key] = "must be between 0 and 100000, or null"
+		}
+	}
+	if req.MaxGroupParticipants != nil && *req.MaxGroupParticipants == 1 {
+		fields[OrgSettingMaxGroupParticipants] = "must leave room for someone besides the creator"
+	}
+	if len(fields) > 0 {
+		return nil, &ValidationError{Fields: fields}
+	}
+
+	before, err := uc.organizationLimits(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := uc.repo.UpdateOrganizationSetting(ctx, orgID, OrgSettingMaxGroupParticipants, intOrNil(req.MaxGroupParticipants)); err != nil {
+		return nil, err
+	}
+	if err := uc.repo.UpdateOrganizationSetting(ctx, orgID, OrgSettingMaxConversationsPerUser, intOrNil(req.MaxConversationsPerUser)); err != nil {
+		return nil, err
+	}
+
+	event := &AuditEvent{
+		OrganizationID: orgID,
+		UserID:         adminID,
+		Action:         AuditActionLimitsUpdate,
+		TargetType:     "organization",
+		TargetID:       orgID.String(),
+		Changes:        audit.Diff(before.snapshot(), req.snapshot()),
+		CreatedAt:      time.Now(),
+	}
+	if err := uc.repo.CreateAuditEvent(ctx, event); err != nil {
+		log.Printf("Failed to audit limits change for organization %s: %v", orgID, err)
+	}
+
+	return req, nil
+}
+
+func (l *OrganizationLimits) snapshot() map[string]interface{} {
+	return map[string]interface{}{
+		OrgSettingMaxGroupParticipants:    intOrNil(l.MaxGroupParticipants),
+		OrgSettingMaxConversationsPerUser: intOrNil(l.MaxConversationsPerUser),
+	}
+}
+
+// maxGroupParticipants returns the organization's group size limit, or the configured
+// default if it has no override; 0 means unlimited
+func (uc *ChatUsecase) maxGroupParticipants(ctx context.Context, orgID uuid.UUID) (int, error) {
+	return uc.organizationLimit(ctx, orgID, OrgSettingMaxGroupParticipants, uc.config.MaxGroupParticipants)
+}
+
+// maxConversationsPerUser returns how many conversations each user of the organization
+// may create, or the configured default if it has no override; 0 means unlimited.
+// The repo enforces it when the conversation is created.
+func (uc *ChatUsecase) maxConversationsPerUser(ctx context.Context, orgID uuid.UUID) (int, error) {
+	return uc.organizationLimit(ctx, orgID, OrgSettingMaxConversationsPerUser, uc.config.MaxConversationsPerUser)
+}
+
+func (uc *ChatUsecase) organizationLimit(ctx context.Context, orgID uuid.UUID, key string, fallback int) (int, error) {
+	settings, err := uc.repo.GetOrganizationSettings(ctx, orgID)
+	if err != nil {
+		return 0, err
+	}
+	if limit := settingInt(settings, key); limit != nil {
+		return *limit, nil
+	}
+	return fallback, nil
+}
+
+// settingInt reads a whole-number organization setting, nil if it isn't set
+func settingInt(settings map[string]interface{}, key string) *int {
+	// JSON numbers decode as float64
+	value, ok := settings[key].(float64)
+	if !ok || value < 0 {
+		return nil
+	}
+	limit := int(value)
+	return &limit
+}
+
+func intOrNil(value *int) interface{} {
+	if value == nil {
+		return nil
+	}
+	return *value
+}
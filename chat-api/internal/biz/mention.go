@@ -0,0 +1,101 @@
+package biz
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// MetaKeyMentions is the message meta key holding the resolved mention user IDs
+const MetaKeyMentions = "mentions"
+
+// resolveMentions finds @displayname, @userid and @{userid} references in content and returns the
+// IDs of the participants they refer to. Tokens that don't match a participant are ignored,
+// so the result only ever contains actual members of the conversation.
+func resolveMentions(content string, participants []*Participant, senderID uuid.UUID) []uuid.UUID {
+	if !strings.Contains(content, "@") {
+		return nil
+	}
+
+	lowered := strings.ToLower(content)
+	seen := make(map[uuid.UUID]bool)
+	var mentioned []uuid.UUID
+
+	for _, p := range participants {
+		if p.UserID == senderID || seen[p.UserID] {
+			continue
+		}
+
+		id := strings.ToLower(p.UserID.String())
+		if containsMention(lowered, id) || strings.Contains(lowered, "@{"+id+"}") ||
+			(p.DisplayName != "" && containsMention(lowered, strings.ToLower(p.DisplayName))) {
+			seen[p.UserID] = true
+			mentioned = append(mentioned, p.UserID)
+		}
+	}
+
+	return mentioned
+}
+
+// containsMention reports whether "@"+name occurs in content as a whole token
+func containsMention(content, name string) bool {
+	needle := "@" + name
+	for start := 0; ; {
+		idx := strings.Index(content[start:], needle)
+		if idx < 0 {
+			return false
+		}
+		idx += start
+		end := idx + len(needle)
+
+		prev, _ := utf8.DecodeLastRuneInString(content[:idx])
+		next, _ := utf8.DecodeRuneInString(content[end:])
+		before := idx == 0 || !isMentionRune(prev)
+		after := end == len(content) || !isMentionRune(next)
+		if before && after {
+			return true
+		}
+		start = idx + 1
+	}
+}
+
+func isMentionRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// Mention is a message the user was mentioned in, as listed in their mentions feed
+type Mention struct {
+	MessageID         uuid.UUID `json:"message_id"`
+	ConversationID    uuid.UUID `json:"conversation_id"`
+	ConversationTitle string    `json:"conversation_title,omitempty"`
+	SenderID          uuid.UUID `json:"sender_id"`
+	SenderName        string    `json:"sender_name,omitempty"`
+	ContentType       string    `json:"content_type"`
+	Preview           string    `json:"preview"`
+	SentAt            time.Time `json:"sent_at"`
+	IsRead            bool      `json:"is_read"`
+}
+
+// GetMentions returns the messages the user was mentioned in across all of their
+// conversations, newest first. A mention counts as read once the user has read the
+// conversation past it.
+func (uc *ChatUsecase) GetMentions(ctx context.Context, userID uuid.UUID, unreadOnly bool, limit, offset int) ([]*Mention, error) {
+	mentions, err := uc.repo.GetUserMentions(ctx, userID, unreadOnly, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mention := range mentions {
+		mention.Preview = MessagePreview(mention.ContentType, mention.Preview)
+	}
+	return mentions, nil
+}
+
+// CountMentions counts the mentions GetMentions would return without paging
+func (uc *ChatUsecase) CountMentions(ctx context.Context, userID uuid.UUID, unreadOnly bool) (int, error) {
+	return uc.repo.CountUserMentions(ctx, userID, unreadOnly)
+}
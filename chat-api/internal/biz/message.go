@@ -0,0 +1,191 @@
+package biz
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxMessageContext caps how many messages either side of a message can be requested
+const MaxMessageContext = 50
+
+// MessageAttachment is a file attached to a message, as tracked by media-service
+type MessageAttachment struct {
+	ID       uuid.UUID `json:"id"`
+	FileName string    `json:"file_name"`
+	MimeType string    `json:"mime_type"`
+	Size     int64     `json:"size"`
+	Status   string    `json:"status"`
+}
+
+// ReceiptSummary counts how many recipients have the message, only shown to its sender
+type ReceiptSummary struct {
+	Recipients int `json:"recipients"`
+	Delivered  int `json:"delivered"`
+	Read       int `json:"read"`
+}
+
+// MessageDetail is a single message with everything needed to render it on its own
+type MessageDetail struct {
+	*Message
+	Sender         *ParticipantSnapshot `json:"sender,omitempty"`
+	Attachments    []*MessageAttachment `json:"attachments"`
+	ReceiptSummary *ReceiptSummary      `json:"receipt_summary,omitempty"`
+}
+
+// MessageContext is a message and its neighbours for jump-to-message. Before and
+// After are newest first, like the message list.
+type MessageContext struct {
+	Message *MessageDetail `json:"message"`
+	Before  []*Message     `json:"before"`
+	After   []*Message     `json:"after"`
+}
+
+// GetMessage returns one message of a conversation the caller takes part in, with up
+// to contextSize visible messages on either side. A deleted message comes back as a
+// tombstone, without its content, so clients can render "message deleted".
+func (uc *ChatUsecase) GetMessage(ctx context.Context, conversationID, messageID, userID, orgID uuid.UUID, contextSize int) (*MessageContext, error) {
+	if err := uc.checkHistoryAccess(ctx, conversationID, userID, orgID); err != nil {
+		return nil, err
+	}
+
+	messages, err := uc.repo.GetMessageWithContext(ctx, orgID, conversationID, messageID, contextSize, contextSize)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err = uc.decorateMessages(ctx, conversationID, userID, messages, MessageListOptions{IncludeReceipts: true})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &MessageContext{Before: []*Message{}, After: []*Message{}}
+	for _, message := range messages {
+		switch {
+		case message.ID == messageID:
+			result.Message = &MessageDetail{Message: message, Attachments: []*MessageAttachment{}}
+		case result.Message == nil:
+			result.After = append(result.After, message)
+		default:
+			result.Before = append(result.Before, message)
+		}
+	}
+	if result.Message == nil {
+		return nil, ErrMessageNotFound
+	}
+
+	detail := result.Message
+	if detail.Deleted {
+		tombstone(detail.Message)
+		return result, nil
+	}
+
+	// The sender may have been removed since; the message still renders without them
+	sender, err := uc.repo.GetUserSnapshot(ctx, detail.SenderID)
+	if err != nil && err != ErrUserNotFound {
+		return nil, err
+	}
+	detail.Sender = sender
+
+	attachments, err := uc.repo.GetMessageAttachments(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if attachments != nil {
+		detail.Attachments = attachments
+	}
+
+	if detail.SenderID == userID {
+		detail.ReceiptSummary = &ReceiptSummary{
+			Recipients: detail.RecipientCount,
+			Delivered:  detail.DeliveredCount,
+			Read:       detail.ReadCount,
+		}
+	}
+
+	return result, nil
+}
+
+// tombstone strips everything but the identity of a deleted message
+func tombstone(message *Message) {
+	message.Content = ""
+	message.Meta = nil
+	message.ParentID = nil
+	message.EditedAt = nil
+	message.IsRead = false
+	message.DeliveryStatus = ""
+	message.Receipts = nil
+}
+
+// PinMessage pins a message of the conversation. Pinned messages are kept past the
+// retention window unless RETENTION_EXEMPT_PINNED is off, so only conversation
+// admins may pin. Pinning again keeps the original time.
+func (uc *ChatUsecase) PinMessage(ctx context.Context, conversationID, messageID, userID, orgID uuid.UUID) error {
+	now := time.Now()
+	return uc.setMessagePinnedAt(ctx, conversationID, messageID, userID, orgID, &now)
+}
+
+// UnpinMessage unpins a message, leaving it to the retention window again
+func (uc *ChatUsecase) UnpinMessage(ctx context.Context, conversationID, messageID, userID, orgID uuid.UUID) error {
+	return uc.setMessagePinnedAt(ctx, conversationID, messageID, userID, orgID, nil)
+}
+
+func (uc *ChatUsecase) setMessagePinnedAt(ctx context.Context, conversationID, messageID, userID, orgID uuid.UUID, pinnedAt *time.Time) error {
+	if err := uc.checkHistoryAccess(ctx, conversationID, userID, orgID); err != nil {
+		return err
+	}
+	participant, err := uc.currentParticipant(ctx, conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if participant.Role != ParticipantRoleAdmin {
+		return ErrInsufficientPermissions
+	}
+	return uc.repo.SetMessagePinnedAt(ctx, conversationID, messageID, pinnedAt)
+}
+
+// MessagePosition is where a message sits in the newest-first message list
+type MessagePosition struct {
+	MessageID uuid.UUID `json:"message_id"`
+	// Newer counts the visible messages newer than this one, which is its offset in the list
+	Newer int `json:"newer_count"`
+}
+
+// GetMessageAt finds the oldest visible message sent at or after the given time, for
+// jumping to a date. A time before the conversation began lands on its first message;
+// a time after its last message finds nothing and returns nil without an error.
+func (uc *ChatUsecase) GetMessageAt(ctx context.Context, conversationID, userID, orgID uuid.UUID, at time.Time) (*Message, *MessagePosition, error) {
+	if err := uc.checkHistoryAccess(ctx, conversationID, userID, orgID); err != nil {
+		return nil, nil, err
+	}
+
+	position, err := uc.repo.FindMessageAt(ctx, orgID, conversationID, at)
+	if err != nil || position == nil {
+		return nil, nil, err
+	}
+
+	messages, err := uc.repo.GetMessageWithContext(ctx, orgID, conversationID, position.MessageID, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	messages, err = uc.decorateMessages(ctx, conversationID, userID, messages, MessageListOptions{})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(messages) == 0 {
+		// Deleted between the two queries
+		return nil, nil, nil
+	}
+
+	return messages[0], position, nil
+}
+
+// GetMessagePosition reports how many visible messages are newer than the given one,
+// so clients can work out which page it is on
+func (uc *ChatUsecase) GetMessagePosition(ctx context.Context, conversationID, messageID, userID, orgID uuid.UUID) (*MessagePosition, error) {
+	if err := uc.checkHistoryAccess(ctx, conversationID, userID, orgID); err != nil {
+		return nil, err
+	}
+	return uc.repo.GetMessagePosition(ctx, orgID, conversationID, messageID)
+}
@@ -0,0 +1,221 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OrgRoleAdmin is the organization-wide admin role stored on the user
+const OrgRoleAdmin = "admin"
+
+type ReportReason string
+
+const (
+	ReportReasonSpam          ReportReason = "spam"
+	ReportReasonHarassment    ReportReason = "harassment"
+	ReportReasonInappropriate ReportReason = "inappropriate"
+	ReportReasonOther         ReportReason = "other"
+)
+
+type ReportStatus string
+
+const (
+	ReportStatusOpen     ReportStatus = "open"
+	ReportStatusResolved ReportStatus = "resolved"
+)
+
+type ReportAction string
+
+const (
+	ReportActionDismiss       ReportAction = "dismiss"
+	ReportActionDeleteMessage ReportAction = "delete_message"
+	ReportActionFlagUser      ReportAction = "flag_user"
+)
+
+// MessageReport is a user's report of a message. The content is snapshotted when the
+// report is filed so later edits or deletes don't hide the evidence from moderators.
+type MessageReport struct {
+	ID                uuid.UUID        `json:"id"`
+	OrganizationID    uuid.UUID        `json:"organization_id"`
+	MessageID         uuid.UUID        `json:"message_id"`
+	ConversationID    uuid.UUID        `json:"conversation_id"`
+	ConversationType  ConversationType `json:"conversation_type,omitempty"`
+	ConversationTitle string           `json:"conversation_title,omitempty"`
+	ReporterID        uuid.UUID        `json:"reporter_id"`
+	SenderID          uuid.UUID        `json:"sender_id"`
+	Reason            ReportReason     `json:"reason"`
+	Note              string           `json:"note,omitempty"`
+	ContentType       string           `json:"content_type"`
+	ContentSnapshot   string           `json:"content_snapshot"`
+	Status            ReportStatus     `json:"status"`
+	Action            ReportAction     `json:"action,omitempty"`
+	ResolvedBy        *uuid.UUID       `json:"resolved_by,omitempty"`
+	ResolvedAt        *time.Time       `json:"resolved_at,omitempty"`
+	CreatedAt         time.Time        `json:"created_at"`
+}
+
+type ReportMessageRequest struct {
+	Reason ReportReason `json:"reason" validate:"required"`
+	Note   string       `json:"note,omitempty"`
+}
+
+type ResolveReportRequest struct {
+	Action ReportAction `json:"action" validate:"required"`
+}
+
+// ReportMessage files a report against a message in a conversation the caller belongs to.
+// Reporting the same message twice returns the existing report.
+func (uc *ChatUsecase) ReportMessage(ctx context.Context, conversationID, messageID, reporterID uuid.UUID, req *ReportMessageRequest) (*MessageReport, error) {
+	switch req.Reason {
+	case ReportReasonSpam, ReportReasonHarassment, ReportReasonInappropriate, ReportReasonOther:
+	default:
+		return nil, ErrInvalidRequest
+	}
+
+	participant, err := uc.repo.GetParticipant(ctx, conversationID, reporterID)
+	if err != nil {
+		return nil, ErrNotParticipant
+	}
+	if participant == nil {
+		return nil, ErrNotParticipant
+	}
+
+	message, err := uc.repo.GetMessage(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message.ConversationID != conversationID || message.Deleted {
+		return nil, ErrMessageNotFound
+	}
+
+	conversation, err := uc.repo.GetConversation(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MessageReport{
+		ID:              uuid.New(),
+		OrganizationID:  conversation.OrganizationID,
+		MessageID:       message.ID,
+		ConversationID:  conversationID,
+		ReporterID:      reporterID,
+		SenderID:        message.SenderID,
+		Reason:          req.Reason,
+		Note:            req.Note,
+		ContentType:     message.ContentType,
+		ContentSnapshot: message.Content,
+		Status:          ReportStatusOpen,
+		CreatedAt:       time.Now(),
+	}
+
+	return uc.repo.CreateMessageReport(ctx, report)
+}
+
+// GetModerationReports lists the organization's reports for org admins. Admins see
+// reported content even for conversations they are not part of.
+func (uc *ChatUsecase) GetModerationReports(ctx context.Context, adminID, orgID uuid.UUID, status ReportStatus) ([]*MessageReport, error) {
+	if err := uc.requireOrgAdmin(ctx, adminID); err != nil {
+		return nil, err
+	}
+
+	if status == "" {
+		status = ReportStatusOpen
+	}
+	if status != ReportStatusOpen && status != ReportStatusResolved {
+		return nil, ErrInvalidRequest
+	}
+
+	return uc.repo.GetMessageReports(ctx, orgID, status)
+}
+
+// ResolveReport closes a report, optionally deleting the message or flagging its sender.
+// Resolving a report also resolves every other open report on the same message.
+func (uc *ChatUsecase) ResolveReport(ctx context.Context, adminID, orgID, reportID uuid.UUID, req *ResolveReportRequest) (*MessageReport, error) {
+	if err := uc.requireOrgAdmin(ctx, adminID); err != nil {
+		return nil, err
+	}
+
+	report, err := uc.repo.GetMessageReport(ctx, reportID)
+	if err != nil {
+		return nil, err
+	}
+	if report.OrganizationID != orgID {
+		return nil, ErrReportNotFound
+	}
+	if report.Status == ReportStatusResolved {
+		return report, nil
+	}
+
+	switch req.Action {
+	case ReportActionDismiss:
+	case ReportActionDeleteMessage:
+		if err := uc.repo.DeleteMessage(ctx, report.MessageID); err != nil {
+			return nil, err
+		}
+	case ReportActionFlagUser:
+		if err := uc.repo.FlagUser(ctx, report.SenderID); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrInvalidRequest
+	}
+
+	now := time.Now()
+	if err := uc.repo.ResolveMessageReports(ctx, report.MessageID, req.Action, adminID, now); err != nil {
+		return nil, err
+	}
+
+	report.Status = ReportStatusResolved
+	report.Action = req.Action
+	report.ResolvedBy = &adminID
+	report.ResolvedAt = &now
+
+	event := &AuditEvent{
+		OrganizationID: orgID,
+		UserID:         adminID,
+		Action:         AuditActionReportResolve,
+		TargetType:     "report",
+		TargetID:       reportID.String(),
+		Details: map[string]interface{}{
+			"action":          req.Action,
+			"conversation_id": report.ConversationID,
+			"message_id":      report.MessageID,
+			"sender_id":       report.SenderID,
+		},
+		CreatedAt: now,
+	}
+	if err := uc.repo.CreateAuditEvent(ctx, event); err != nil {
+		log.Printf("Failed to audit resolution of report %s by %s: %v", reportID, adminID, err)
+	}
+	return report, nil
+}
+
+// requireOrgAdmin checks the user's organization-wide role, not a conversation role
+func (uc *ChatUsecase) requireOrgAdmin(ctx context.Context, userID uuid.UUID) error {
+	role, err := uc.repo.GetUserRole(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if role != OrgRoleAdmin {
+		return ErrInsufficientPermissions
+	}
+	return nil
+}
+
+// requireOrgAdminOf checks the user is an admin of the given organization
+func (uc *ChatUsecase) requireOrgAdminOf(ctx context.Context, userID, orgID uuid.UUID) error {
+	if err := uc.requireOrgAdmin(ctx, userID); err != nil {
+		return err
+	}
+	orgs, err := uc.repo.GetUserOrganizations(ctx, []uuid.UUID{userID})
+	if err != nil {
+		return err
+	}
+	if orgs[userID] != orgID {
+		return ErrInsufficientPermissions
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package biz
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type PushNotification struct {
+	RecipientID    uuid.UUID `json:"recipient_id"`
+	ConversationID uuid.UUID `json:"conversation_id"`
+	MessageID      uuid.UUID `json:"message_id"`
+	SenderID       uuid.UUID `json:"sender_id"`
+	SenderName     string    `json:"sender_name,omitempty"`
+	Preview        string    `json:"preview"`
+	IsMention      bool      `json:"is_mention"`
+}
+
+// NotificationLevel is which messages push a notification by default. Per-conversation
+// mutes still apply on top of it.
+type NotificationLevel string
+
+const (
+	NotificationLevelAll      NotificationLevel = "all"
+	NotificationLevelMentions NotificationLevel = "mentions"
+	NotificationLevelNone     NotificationLevel = "none"
+)
+
+// NotificationPreferences are a user's delivery preferences for push notifications.
+// Quiet hours are "HH:MM" in the user's timezone and may wrap past midnight.
+type NotificationPreferences struct {
+	UserID          uuid.UUID         `json:"user_id"`
+	DefaultLevel    NotificationLevel `json:"default_level"`
+	QuietHoursStart string            `json:"quiet_hours_start,omitempty"`
+	QuietHoursEnd   string            `json:"quiet_hours_end,omitempty"`
+	Timezone        string            `json:"timezone,omitempty"`
+}
+
+type UpdateNotificationPreferencesRequest struct {
+	DefaultLevel    NotificationLevel `json:"default_level"`
+	QuietHoursStart string            `json:"quiet_hours_start"`
+	QuietHoursEnd   string            `json:"quiet_hours_end"`
+	Timezone        string            `json:"timezone"`
+}
+
+// allowsPush reports whether the preferences let a message through right now.
+// Mentions get through the "mentions" level but not quiet hours.
+func (p *NotificationPreferences) allowsPush(isMention bool, now time.Time) bool {
+	if p == nil {
+		return true
+	}
+	switch p.DefaultLevel {
+	case NotificationLevelNone:
+		return false
+	case NotificationLevelMentions:
+		if !isMention {
+			return false
+		}
+	}
+	return !inQuietHours(p, now)
+}
+
+// PushProvider delivers a push notification to a device (FCM, APNs, ...).
+// Send returns ErrInvalidPushToken when the provider rejects the token as
+// expired or unregistered so the dispatcher can prune it.
+type PushProvider interface {
+	Send(ctx context.Context, device *DeviceToken, notification *PushNotification) error
+}
+
+// PresenceChecker looks up the current presence status of users and reports chat
+// activity back to the presence service
+type PresenceChecker interface {
+	GetPresence(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]string, error)
+	RecordActivity(ctx context.Context, userID uuid.UUID) error
+}
+
+type NotificationRepo interface {
+	GetConversationParticipants(ctx context.Context, conversationID uuid.UUID) ([]*Participant, error)
+	GetNotificationPreferences(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]*NotificationPreferences, error)
+	GetDeviceTokens(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID][]*DeviceToken, error)
+	InvalidateDeviceToken(ctx context.Context, token string) error
+}
+
+// NotificationDispatcher fans out push notifications for new messages to
+// recipients who are offline or away. Messages are queued and processed in the
+// background so sending a message never waits on presence or push providers.
+type NotificationDispatcher struct {
+	repo     NotificationRepo
+	presence PresenceChecker
+	push     PushProvider
+	queue    chan *Message
+	wg       sync.WaitGroup
+}
+
+func NewNotificationDispatcher(repo NotificationRepo, presence PresenceChecker, push PushProvider, queueSize int) *NotificationDispatcher {
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+	return &NotificationDispatcher{
+		repo:     repo,
+		presence: presence,
+		push:     push,
+		queue:    make(chan *Message, queueSize),
+	}
+}
+
+// Start runs the dispatch worker until Stop is called
+func (d *NotificationDispatcher) Start() {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for message := range d.queue {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := d.dispatch(ctx, message); err != nil {
+				log.Printf("Error dispatching notifications for message %s: %v", message.ID, err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// Stop drains the queue and waits for the worker to finish
+func (d *NotificationDispatcher) Stop() {
+	close(d.queue)
+	d.wg.Wait()
+}
+
+// Enqueue schedules notifications for a newly sent message. If the queue is
+// full the message is dropped rather than blocking the sender.
+func (d *NotificationDispatcher) Enqueue(message *Message) {
+	select {
+	case d.queue <- message:
+	default:
+		log.Printf("Notification queue full, dropping notifications for message %s", message.ID)
+	}
+}
+
+func (d *NotificationDispatcher) dispatch(ctx context.Context, message *Message) error {
+	participants, err := d.repo.GetConversationParticipants(ctx, message.ConversationID)
+	if err != nil {
+		return err
+	}
+
+	mentioned := mentionedUserIDs(message)
+	now := time.Now()
+
+	var senderName string
+	var candidates []*Participant
+	for _, p := range participants {
+		if p.UserID == message.SenderID {
+			senderName = p.DisplayName
+			continue
+		}
+		// Mentions still notify in muted conversations
+		if p.MutedUntil != nil && p.MutedUntil.After(now) && !mentioned[p.UserID] {
+			continue
+		}
+		candidates = append(candidates, p)
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	userIDs := make([]uuid.UUID, len(candidates))
+	for i, p := range candidates {
+		userIDs[i] = p.UserID
+	}
+
+	// If presence is unavailable treat everyone as offline; a duplicate push is
+	// better than a missed one
+	statuses, err := d.presence.GetPresence(ctx, userIDs)
+	if err != nil {
+		log.Printf("Failed to fetch presence, notifying all recipients: %v", err)
+		statuses = map[uuid.UUID]string{}
+	}
+
+	prefs, err := d.repo.GetNotificationPreferences(ctx, userIDs)
+	if err != nil {
+		return err
+	}
+
+	devices, err := d.repo.GetDeviceTokens(ctx, userIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range candidates {
+		status := statuses[p.UserID]
+		if status != "" && status != "offline" && status != "away" {
+			continue
+		}
+		if !prefs[p.UserID].allowsPush(mentioned[p.UserID], now) {
+			continue
+		}
+		if len(devices[p.UserID]) == 0 {
+			continue
+		}
+
+		notification := &PushNotification{
+			RecipientID:    p.UserID,
+			ConversationID: message.ConversationID,
+			MessageID:      message.ID,
+			SenderID:       message.SenderID,
+			SenderName:     senderName,
+			Preview:        MessagePreview(message.ContentType, message.Content),
+			IsMention:      mentioned[p.UserID],
+		}
+		for _, device := range devices[p.UserID] {
+			err := d.push.Send(ctx, device, notification)
+			if errors.Is(err, ErrInvalidPushToken) {
+				if err := d.repo.InvalidateDeviceToken(ctx, device.Token); err != nil {
+					log.Printf("Failed to prune invalid push token %s: %v", device.ID, err)
+				}
+			} else if err != nil {
+				log.Printf("Failed to send push notification to %s: %v", p.UserID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// mentionedUserIDs returns the set of users resolved into the message's mention meta
+func mentionedUserIDs(message *Message) map[uuid.UUID]bool {
+	mentioned := make(map[uuid.UUID]bool)
+	if message.Meta == nil {
+		return mentioned
+	}
+
+	switch ids := message.Meta[MetaKeyMentions].(type) {
+	case []string:
+		for _, id := range ids {
+			if parsed, err := uuid.Parse(id); err == nil {
+				mentioned[parsed] = true
+			}
+		}
+	case []interface{}:
+		for _, id := range ids {
+			if str, ok := id.(string); ok {
+				if parsed, err := uuid.Parse(str); err == nil {
+					mentioned[parsed] = true
+				}
+			}
+		}
+	}
+
+	return mentioned
+}
+
+// GetNotificationPreferences returns the user's preferences, or the defaults if they
+// never saved any
+func (uc *ChatUsecase) GetNotificationPreferences(ctx context.Context, userID uuid.UUID) (*NotificationPreferences, error) {
+	prefs, err := uc.repo.GetNotificationPreferences(ctx, []uuid.UUID{userID})
+	if err != nil {
+		return nil, err
+	}
+	if pref := prefs[userID]; pref != nil {
+		return pref, nil
+	}
+	return &NotificationPreferences{UserID: userID, DefaultLevel: NotificationLevelAll}, nil
+}
+
+// UpdateNotificationPreferences replaces the user's preferences. Quiet hours are
+// cleared by sending both bounds empty.
+func (uc *ChatUsecase) UpdateNotificationPreferences(ctx context.Context, userID uuid.UUID, req *UpdateNotificationPreferencesRequest) (*NotificationPreferences, error) {
+	pref := &NotificationPreferences{
+		UserID:          userID,
+		DefaultLevel:    req.DefaultLevel,
+		QuietHoursStart: strings.TrimSpace(req.QuietHoursStart),
+		QuietHoursEnd:   strings.TrimSpace(req.QuietHoursEnd),
+		Timezone:        strings.TrimSpace(req.Timezone),
+	}
+	if pref.DefaultLevel == "" {
+		pref.DefaultLevel = NotificationLevelAll
+	}
+
+	fields := make(map[string]string)
+	switch pref.DefaultLevel {
+	case NotificationLevelAll, NotificationLevelMentions, NotificationLevelNone:
+	default:
+		fields["default_level"] = "must be all, mentions or none"
+	}
+	if (pref.QuietHoursStart == "") != (pref.QuietHoursEnd == "") {
+		fields["quiet_hours"] = "start and end must be set together"
+	}
+	if pref.QuietHoursStart != "" {
+		if _, err := time.Parse("15:04", pref.QuietHoursStart); err != nil {
+			fields["quiet_hours_start"] = "must be HH:MM"
+		}
+	}
+	if pref.QuietHoursEnd != "" {
+		if _, err := time.Parse("15:04", pref.QuietHoursEnd); err != nil {
+			fields["quiet_hours_end"] = "must be HH:MM"
+		}
+	}
+	if pref.Timezone != "" {
+		if _, err := time.LoadLocation(pref.Timezone); err != nil {
+			fields["timezone"] = "must be an IANA time zone"
+		}
+	}
+	if len(fields) > 0 {
+		return nil, &ValidationError{Fields: fields}
+	}
+
+	if err := uc.repo.UpsertNotificationPreferences(ctx, pref); err != nil {
+		return nil, err
+	}
+
+	return pref, nil
+}
+
+// GetPushTargets returns the user's active device tokens, or none if their
+// preferences would suppress a push right now. It backs the internal endpoint the
+// message fan-out worker calls per recipient.
+func (uc *ChatUsecase) GetPushTargets(ctx context.Context, userID uuid.UUID, isMention bool) ([]*DeviceToken, error) {
+	prefs, err := uc.repo.GetNotificationPreferences(ctx, []uuid.UUID{userID})
+	if err != nil {
+		return nil, err
+	}
+	if !prefs[userID].allowsPush(isMention, time.Now()) {
+		return []*DeviceToken{}, nil
+	}
+
+	devices, err := uc.repo.GetDeviceTokens(ctx, []uuid.UUID{userID})
+	if err != nil {
+		return nil, err
+	}
+	if devices[userID] == nil {
+		return []*DeviceToken{}, nil
+	}
+
+	return devices[userID], nil
+}
+
+// inQuietHours reports whether now falls inside the user's quiet hours window
+func inQuietHours(pref *NotificationPreferences, now time.Time) bool {
+	if pref.QuietHoursStart == "" || pref.QuietHoursEnd == "" {
+		return false
+	}
+
+	loc := time.UTC
+	if pref.Timezone != "" {
+		if l, err := time.LoadLocation(pref.Timezone); err == nil {
+			loc = l
+		}
+	}
+
+	start, err := time.Parse("15:04", pref.QuietHoursStart)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse("15:04", pref.QuietHoursEnd)
+	if err != nil {
+		return false
+	}
+
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := end.Hour()*60 + end.Minute()
+
+	if startMinute <= endMinute {
+		return minute >= startMinute && minute < endMinute
+	}
+	// Window wraps past midnight, e.g. 22:00-07:00
+	return minute >= startMinute || minute < endMinute
+}
+
+// MessagePreview truncates message content for notification payloads. Encrypted
+// content is replaced with a placeholder rather than leaking ciphertext.
+func MessagePreview(contentType, content string) string {
+	if isEncryptedContentType(contentType) {
+		return "Encrypted message"
+	}
+
+	const maxPreview = 100
+	runes := []rune(content)
+	if len(runes) <= maxPreview {
+		return content
+	}
+	return string(runes[:maxPreview]) + "…"
+}
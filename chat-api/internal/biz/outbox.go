@@ -0,0 +1,253 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type OutboxStatus string
+
+const (
+	OutboxStatusPending OutboxStatus = "pending"
+	OutboxStatusSent    OutboxStatus = "sent"
+	// OutboxStatusDead events ran out of attempts; they no longer block their ordering key
+	OutboxStatusDead OutboxStatus = "dead"
+)
+
+// OutboxEvent is an MQTT publish that has been stored durably and is waiting to be sent.
+// Events sharing an OrderingKey (the conversation ID) are published strictly in order.
+type OutboxEvent struct {
+	ID            int64
+	Topic         string
+	QoS           byte
+	Payload       []byte
+	OrderingKey   string
+	Status        OutboxStatus
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+}
+
+type OutboxRepo interface {
+	EnqueueOutboxEvent(ctx context.Context, event *OutboxEvent) error
+	// ProcessOutboxBatch locks up to limit due events, each the oldest pending event
+	// of its ordering key, calls handle for each and stores the status, attempts,
+	// next attempt and error handle leaves on the event. It returns how many were handled.
+	ProcessOutboxBatch(ctx context.Context, limit int, handle func(ctx context.Context, event *OutboxEvent)) (int, error)
+	CountOutboxEvents(ctx context.Context) (pending, dead int, err error)
+	DeleteSentOutboxEvents(ctx context.Context, before time.Time) error
+}
+
+// OutboxConfig tunes the outbox dispatcher
+type OutboxConfig struct {
+	PollInterval   time.Duration
+	BatchSize      int
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// SentRetention is how long sent events are kept before being deleted
+	SentRetention time.Duration
+	// DrainTimeout bounds the final flush of due events when the dispatcher stops
+	DrainTimeout time.Duration
+}
+
+// DefaultOutboxConfig returns the dispatcher settings used when nothing is configured
+func DefaultOutboxConfig() OutboxConfig {
+	return OutboxConfig{
+		PollInterval:   500 * time.Millisecond,
+		BatchSize:      100,
+		MaxAttempts:    10,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Minute,
+		SentRetention:  24 * time.Hour,
+		DrainTimeout:   5 * time.Second,
+	}
+}
+
+// OutboxStats is the dispatcher's view of the outbox for metrics
+type OutboxStats struct {
+	Backlog         int    `json:"backlog"`
+	Dead            int    `json:"dead"`
+	Published       uint64 `json:"published_total"`
+	PublishFailures uint64 `json:"publish_failures_total"`
+}
+
+// OutboxDispatcher publishes stored outbox events to MQTT in the background, retrying
+// failed publishes with exponential backoff. Rows are claimed with SKIP LOCKED so any
+// number of chat-api instances can run a dispatcher against the same table.
+type OutboxDispatcher struct {
+	repo      OutboxRepo
+	publisher MQTTPublisher
+	config    OutboxConfig
+	stop      chan struct{}
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+
+	published uint64
+	failures  uint64
+}
+
+func NewOutboxDispatcher(repo OutboxRepo, publisher MQTTPublisher, config OutboxConfig) *OutboxDispatcher {
+	defaults := DefaultOutboxConfig()
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaults.PollInterval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaults.BatchSize
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaults.MaxAttempts
+	}
+	if config.SentRetention <= 0 {
+		config.SentRetention = defaults.SentRetention
+	}
+	if config.DrainTimeout <= 0 {
+		config.DrainTimeout = defaults.DrainTimeout
+	}
+	return &OutboxDispatcher{
+		repo:      repo,
+		publisher: publisher,
+		config:    config,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start runs the dispatch loop until Stop is called
+func (d *OutboxDispatcher) Start() {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+
+		ticker := time.NewTicker(d.config.PollInterval)
+		defer ticker.Stop()
+		lastCleanup := time.Now()
+
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				d.drain()
+				if time.Since(lastCleanup) > time.Hour {
+					d.cleanup()
+					lastCleanup = time.Now()
+				}
+			}
+		}
+	}()
+}
+
+// Stop waits for the batch in flight to finish, then publishes what is already due for
+// up to DrainTimeout. Anything left, including events waiting out a backoff, stays in
+// the outbox for the next instance. Calling Stop again does nothing.
+func (d *OutboxDispatcher) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+		d.wg.Wait()
+		d.flush()
+	})
+}
+
+// Stats reports the current backlog along with publish counters since startup
+func (d *OutboxDispatcher) Stats(ctx context.Context) (*OutboxStats, error) {
+	pending, dead, err := d.repo.CountOutboxEvents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxStats{
+		Backlog:         pending,
+		Dead:            dead,
+		Published:       atomic.LoadUint64(&d.published),
+		PublishFailures: atomic.LoadUint64(&d.failures),
+	}, nil
+}
+
+// drain keeps processing batches while they come back full
+func (d *OutboxDispatcher) drain() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		processed, err := d.repo.ProcessOutboxBatch(ctx, d.config.BatchSize, d.publish)
+		cancel()
+		if err != nil {
+			log.Printf("Error processing outbox batch: %v", err)
+			return
+		}
+		if processed < d.config.BatchSize {
+			return
+		}
+
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+	}
+}
+
+// flush drains due events until none are left or DrainTimeout passes. Failed publishes
+// are backed off as usual, so they aren't retried within the flush.
+func (d *OutboxDispatcher) flush() {
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.DrainTimeout)
+	defer cancel()
+
+	for ctx.Err() == nil {
+		processed, err := d.repo.ProcessOutboxBatch(ctx, d.config.BatchSize, d.publish)
+		if err != nil {
+			log.Printf("Error flushing outbox: %v", err)
+			return
+		}
+		if processed < d.config.BatchSize {
+			return
+		}
+	}
+}
+
+func (d *OutboxDispatcher) publish(ctx context.Context, event *OutboxEvent) {
+	err := d.publisher.Publish(ctx, event.Topic, event.QoS, event.Payload)
+	if err == nil {
+		atomic.AddUint64(&d.published, 1)
+		event.Status = OutboxStatusSent
+		event.LastError = ""
+		return
+	}
+
+	atomic.AddUint64(&d.failures, 1)
+	event.Attempts++
+	event.LastError = err.Error()
+	if event.Attempts >= d.config.MaxAttempts {
+		log.Printf("Giving up on outbox event %d to %s after %d attempts: %v", event.ID, event.Topic, event.Attempts, err)
+		event.Status = OutboxStatusDead
+		return
+	}
+	event.NextAttemptAt = time.Now().Add(d.backoff(event.Attempts))
+}
+
+// backoff doubles the delay with every attempt, capped at MaxBackoff, with jitter so
+// instances retrying the same broker outage don't stampede it together
+func (d *OutboxDispatcher) backoff(attempt int) time.Duration {
+	delay := d.config.InitialBackoff
+	if delay <= 0 {
+		return 0
+	}
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if d.config.MaxBackoff > 0 && delay >= d.config.MaxBackoff {
+			delay = d.config.MaxBackoff
+			break
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (d *OutboxDispatcher) cleanup() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := d.repo.DeleteSentOutboxEvents(ctx, time.Now().Add(-d.config.SentRetention)); err != nil {
+		log.Printf("Error cleaning up sent outbox events: %v", err)
+	}
+}
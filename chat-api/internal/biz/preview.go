@@ -0,0 +1,225 @@
+package biz
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetaKeyPreviews holds the link previews the server attached to a message
+const MetaKeyPreviews = "previews"
+
+// LinkPreview is the Open Graph / Twitter card summary of a linked page
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// PreviewFetcher fetches and parses a page for its preview metadata. It must refuse
+// anything but public http(s) addresses, and returns ErrPreviewUnavailable when the
+// page can't be fetched or has nothing worth showing.
+type PreviewFetcher interface {
+	FetchPreview(ctx context.Context, rawURL string) (*LinkPreview, error)
+}
+
+// LinkPreviewConfig tunes link unfurling
+type LinkPreviewConfig struct {
+	// MaxPerMessage caps how many links in one message are unfurled
+	MaxPerMessage int
+	// Timeout bounds how long a send waits for previews; links that don't make it
+	// are sent without one
+	Timeout time.Duration
+	// CacheTTL is how long a preview is reused, FailureTTL how long a failed URL is
+	// left alone before it is fetched again
+	CacheTTL   time.Duration
+	FailureTTL time.Duration
+	// CacheSize caps how many URLs are cached
+	CacheSize int
+}
+
+// DefaultLinkPreviewConfig returns the unfurl settings used when nothing is configured
+func DefaultLinkPreviewConfig() LinkPreviewConfig {
+	return LinkPreviewConfig{
+		MaxPerMessage: 3,
+		Timeout:       2 * time.Second,
+		CacheTTL:      time.Hour,
+		FailureTTL:    5 * time.Minute,
+		CacheSize:     1000,
+	}
+}
+
+type previewCacheEntry struct {
+	preview   *LinkPreview
+	expiresAt time.Time
+}
+
+// LinkPreviewer unfurls links through a PreviewFetcher, caching the results
+type LinkPreviewer struct {
+	fetcher PreviewFetcher
+	config  LinkPreviewConfig
+
+	mu    sync.Mutex
+	cache map[string]*previewCacheEntry
+}
+
+func NewLinkPreviewer(fetcher PreviewFetcher, config LinkPreviewConfig) *LinkPreviewer {
+	return &LinkPreviewer{
+		fetcher: fetcher,
+		config:  config,
+		cache:   make(map[string]*previewCacheEntry),
+	}
+}
+
+// Preview returns the preview for a URL, from the cache when possible. Failures are
+// cached too, so a dead link posted repeatedly isn't fetched every time.
+func (p *LinkPreviewer) Preview(ctx context.Context, rawURL string) (*LinkPreview, error) {
+	normalized, err := normalizePreviewURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	entry, ok := p.cache[normalized]
+	p.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		if entry.preview == nil {
+			return nil, ErrPreviewUnavailable
+		}
+		return entry.preview, nil
+	}
+
+	preview, err := p.fetcher.FetchPreview(ctx, normalized)
+	if err != nil && err != ErrPreviewUnavailable {
+		// Timeouts and the like aren't the page's fault, so they aren't cached
+		return nil, err
+	}
+
+	ttl := p.config.CacheTTL
+	if preview == nil {
+		ttl = p.config.FailureTTL
+	}
+	p.store(normalized, &previewCacheEntry{preview: preview, expiresAt: time.Now().Add(ttl)})
+
+	if preview == nil {
+		return nil, ErrPreviewUnavailable
+	}
+	return preview, nil
+}
+
+// store caches an entry, making room by dropping expired entries and then, if the
+// cache is still full, arbitrary ones
+func (p *LinkPreviewer) store(key string, entry *previewCacheEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.cache) >= p.config.CacheSize {
+		now := time.Now()
+		for k, e := range p.cache {
+			if now.After(e.expiresAt) {
+				delete(p.cache, k)
+			}
+		}
+		for k := range p.cache {
+			if len(p.cache) < p.config.CacheSize {
+				break
+			}
+			delete(p.cache, k)
+		}
+	}
+	p.cache[key] = entry
+}
+
+// normalizePreviewURL accepts absolute http(s) URLs only and drops the fragment, which
+// never changes the page that's served
+func normalizePreviewURL(rawURL string) (string, error) {
+	parsed, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return "", ErrInvalidPreviewURL
+	}
+	parsed.Fragment = ""
+	return parsed.String(), nil
+}
+
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// extractLinks finds up to max distinct http(s) links in message content. Punctuation
+// that usually ends a sentence rather than a URL is trimmed off.
+func extractLinks(content string, max int) []string {
+	var links []string
+	seen := make(map[string]bool)
+	for _, match := range linkPattern.FindAllString(content, -1) {
+		link := strings.TrimRight(match, ".,;:!?)]}")
+		if seen[link] {
+			continue
+		}
+		seen[link] = true
+		links = append(links, link)
+		if len(links) == max {
+			break
+		}
+	}
+	return links
+}
+
+// attachPreviews unfurls the links in a message and stores the results in its meta.
+// Previews are server-owned, so anything the client put there is dropped. Encrypted
+// content is opaque to the server and never unfurled. Unfurling is best effort: links
+// that fail or don't finish within the configured timeout just go without a preview.
+func (uc *ChatUsecase) attachPreviews(ctx context.Context, conversation *Conversation, message *Message) {
+	if message.Meta != nil {
+		delete(message.Meta, MetaKeyPreviews)
+	}
+	if uc.previews == nil || conversation.IsEncrypted {
+		return
+	}
+
+	links := extractLinks(message.Content, uc.previews.config.MaxPerMessage)
+	if len(links) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, uc.previews.config.Timeout)
+	defer cancel()
+
+	results := make([]*LinkPreview, len(links))
+	var wg sync.WaitGroup
+	for i, link := range links {
+		wg.Add(1)
+		go func(i int, link string) {
+			defer wg.Done()
+			if preview, err := uc.previews.Preview(ctx, link); err == nil {
+				results[i] = preview
+			}
+		}(i, link)
+	}
+	wg.Wait()
+
+	var previews []*LinkPreview
+	for _, preview := range results {
+		if preview != nil {
+			previews = append(previews, preview)
+		}
+	}
+	if len(previews) == 0 {
+		return
+	}
+
+	if message.Meta == nil {
+		message.Meta = make(map[string]interface{})
+	}
+	message.Meta[MetaKeyPreviews] = previews
+}
+
+// UnfurlURL returns the preview for a single URL on demand
+func (uc *ChatUsecase) UnfurlURL(ctx context.Context, rawURL string) (*LinkPreview, error) {
+	if uc.previews == nil {
+		return nil, ErrLinkPreviewsDisabled
+	}
+	return uc.previews.Preview(ctx, rawURL)
+}
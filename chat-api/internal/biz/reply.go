@@ -0,0 +1,69 @@
+package biz
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MetaKeyReplyTo is the message meta key holding the quoted parent snapshot
+const MetaKeyReplyTo = "reply_to"
+
+// ReplySnapshot is a point-in-time copy of the parent message taken when the reply is
+// sent, so clients can render the quote without fetching the parent. Later edits to
+// the parent are not reflected; EditedAt tells clients the snapshot may be stale.
+type ReplySnapshot struct {
+	MessageID   uuid.UUID  `json:"message_id"`
+	SenderID    uuid.UUID  `json:"sender_id"`
+	ContentType string     `json:"content_type"`
+	Preview     string     `json:"preview"`
+	SentAt      time.Time  `json:"sent_at"`
+	EditedAt    *time.Time `json:"edited_at,omitempty"`
+	Deleted     bool       `json:"deleted,omitempty"`
+}
+
+// buildReplySnapshot loads the parent message and snapshots it for the reply's meta.
+// The parent must be a live message in the same conversation.
+func (uc *ChatUsecase) buildReplySnapshot(ctx context.Context, conversationID, parentID uuid.UUID) (*ReplySnapshot, error) {
+	parent, err := uc.repo.GetMessage(ctx, parentID)
+	if err == ErrMessageNotFound || (err == nil && parent.ConversationID != conversationID) {
+		return nil, &ValidationError{Fields: map[string]string{"parent_id": "message not found in this conversation"}}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if parent.Deleted {
+		return nil, &ValidationError{Fields: map[string]string{"parent_id": "cannot reply to a deleted message"}}
+	}
+
+	return &ReplySnapshot{
+		MessageID:   parent.ID,
+		SenderID:    parent.SenderID,
+		ContentType: parent.ContentType,
+		Preview:     MessagePreview(parent.ContentType, parent.Content),
+		SentAt:      parent.SentAt,
+		EditedAt:    parent.EditedAt,
+	}, nil
+}
+
+// redactDeletedParent strips the quoted content from a reply whose parent has since
+// been deleted, leaving only a marker so clients can show "message deleted"
+func redactDeletedParent(message *Message) {
+	if message.Meta == nil {
+		return
+	}
+	if _, ok := message.Meta[MetaKeyReplyTo]; !ok {
+		return
+	}
+	// A parent that was removed outright leaves parent_id unset
+	if !message.ParentDeleted && message.ParentID != nil {
+		return
+	}
+
+	redacted := map[string]interface{}{"deleted": true}
+	if message.ParentID != nil {
+		redacted["message_id"] = message.ParentID.String()
+	}
+	message.Meta[MetaKeyReplyTo] = redacted
+}
@@ -0,0 +1,308 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OrgSettingRetentionDays is the organization's default message retention in days
+const OrgSettingRetentionDays = "retention_days"
+
+// MaxRetentionDays bounds retention settings to something a purge can act on
+const MaxRetentionDays = 36500
+
+const (
+	AuditActionRetentionPurge  = "retention.purge"
+	AuditActionRetentionUpdate = "retention.update"
+)
+
+// RetentionSource says where the retention in effect for a conversation comes from
+type RetentionSource string
+
+const (
+	RetentionSourceConversation RetentionSource = "conversation"
+	RetentionSourceOrganization RetentionSource = "organization"
+)
+
+// RetentionPolicy is the retention in effect: messages older than Days are purged
+type RetentionPolicy struct {
+	Days   int             `json:"days"`
+	Source RetentionSource `json:"source"`
+}
+
+// OrganizationRetention is the organization-wide default. Nil days keeps messages forever.
+type OrganizationRetention struct {
+	RetentionDays *int `json:"retention_days"`
+}
+
+// RetentionPurge counts what one purge batch deleted in an organization
+type RetentionPurge struct {
+	OrganizationID uuid.UUID
+	Messages       int
+	Receipts       int
+	Attachments    int
+}
+
+// RetentionConfig tunes the retention purger
+type RetentionConfig struct {
+	Interval  time.Duration
+	BatchSize int
+	// ExemptPinned keeps pinned messages regardless of age
+	ExemptPinned bool
+}
+
+// DefaultRetentionConfig returns the purger settings used when nothing is configured
+func DefaultRetentionConfig() RetentionConfig {
+	return RetentionConfig{
+		Interval:     time.Hour,
+		BatchSize:    500,
+		ExemptPinned: true,
+	}
+}
+
+// RetentionStats counts purged rows since startup for metrics
+type RetentionStats struct {
+	Runs        uint64 `json:"runs_total"`
+	Failures    uint64 `json:"failures_total"`
+	Messages    uint64 `json:"messages_total"`
+	Receipts    uint64 `json:"receipts_total"`
+	Attachments uint64 `json:"attachments_total"`
+}
+
+// RetentionPurger hard-deletes messages older than their conversation's retention, in
+// batches claimed with SKIP LOCKED so several chat-api instances can run it. Receipts
+// go with their messages; attachments are detached and marked expired so media-service
+// removes the stored objects. Every run writes an audit record per organization with
+// what it deleted.
+type RetentionPurger struct {
+	repo   ChatRepo
+	config RetentionConfig
+	stop   chan struct{}
+	wg     sync.WaitGroup
+
+	runs        uint64
+	failures    uint64
+	messages    uint64
+	receipts    uint64
+	attachments uint64
+}
+
+func NewRetentionPurger(repo ChatRepo, config RetentionConfig) *RetentionPurger {
+	defaults := DefaultRetentionConfig()
+	if config.Interval <= 0 {
+		config.Interval = defaults.Interval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaults.BatchSize
+	}
+	return &RetentionPurger{
+		repo:   repo,
+		config: config,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start runs a purge every interval until Stop is called
+func (p *RetentionPurger) Start() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := time.NewTicker(p.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.purge()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for the batch in flight to finish
+func (p *RetentionPurger) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+// Stats reports purge counters since startup
+func (p *RetentionPurger) Stats() *RetentionStats {
+	return &RetentionStats{
+		Runs:        atomic.LoadUint64(&p.runs),
+		Failures:    atomic.LoadUint64(&p.failures),
+		Messages:    atomic.LoadUint64(&p.messages),
+		Receipts:    atomic.LoadUint64(&p.receipts),
+		Attachments: atomic.LoadUint64(&p.attachments),
+	}
+}
+
+// purge deletes batches until nothing is left to purge, then audits the totals
+func (p *RetentionPurger) purge() {
+	atomic.AddUint64(&p.runs, 1)
+
+	totals := make(map[uuid.UUID]*RetentionPurge)
+	defer p.audit(totals)
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		purged, err := p.repo.PurgeExpiredMessages(ctx, p.config.BatchSize, p.config.ExemptPinned)
+		cancel()
+		if err != nil {
+			atomic.AddUint64(&p.failures, 1)
+			log.Printf("Error purging expired messages: %v", err)
+			return
+		}
+
+		deleted := 0
+		for _, batch := range purged {
+			total, ok := totals[batch.OrganizationID]
+			if !ok {
+				total = &RetentionPurge{OrganizationID: batch.OrganizationID}
+				totals[batch.OrganizationID] = total
+			}
+			total.Messages += batch.Messages
+			total.Receipts += batch.Receipts
+			total.Attachments += batch.Attachments
+			deleted += batch.Messages
+
+			atomic.AddUint64(&p.messages, uint64(batch.Messages))
+			atomic.AddUint64(&p.receipts, uint64(batch.Receipts))
+			atomic.AddUint64(&p.attachments, uint64(batch.Attachments))
+		}
+		if deleted < p.config.BatchSize {
+			return
+		}
+
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+	}
+}
+
+func (p *RetentionPurger) audit(totals map[uuid.UUID]*RetentionPurge) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for orgID, total := range totals {
+		log.Printf("Retention purge for organization %s: %d messages, %d receipts, %d attachments",
+			orgID, total.Messages, total.Receipts, total.Attachments)
+
+		event := &AuditEvent{
+			OrganizationID: orgID,
+			Action:         AuditActionRetentionPurge,
+			TargetType:     "organization",
+			TargetID:       orgID.String(),
+			Details: map[string]interface{}{
+				"messages":    total.Messages,
+				"receipts":    total.Receipts,
+				"attachments": total.Attachments,
+			},
+			CreatedAt: time.Now(),
+		}
+		if err := p.repo.CreateAuditEvent(ctx, event); err != nil {
+			log.Printf("Failed to audit retention purge for organization %s: %v", orgID, err)
+		}
+	}
+}
+
+// GetOrganizationRetention returns the organization's default retention. Like
+// changing it, reading it is for org admins only.
+func (uc *ChatUsecase) GetOrganizationRetention(ctx context.Context, adminID, orgID uuid.UUID) (*OrganizationRetention, error) {
+	if err := uc.requireOrgAdmin(ctx, adminID); err != nil {
+		return nil, err
+	}
+	days, err := uc.organizationRetentionDays(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	return &OrganizationRetention{RetentionDays: days}, nil
+}
+
+// SetOrganizationRetention changes the organization's default retention. Only org admins
+// may change it, and the change is audited.
+func (uc *ChatUsecase) SetOrganizationRetention(ctx context.Context, adminID, orgID uuid.UUID, req *OrganizationRetention) (*OrganizationRetention, error) {
+	if err := uc.requireOrgAdmin(ctx, adminID); err != nil {
+		return nil, err
+	}
+	if req.RetentionDays != nil && (*req.RetentionDays < 1 || *req.RetentionDays > MaxRetentionDays) {
+		return nil, &ValidationError{Fields: map[string]string{"retention_days": "must be between 1 and 36500, or null"}}
+	}
+
+	var value interface{}
+	if req.RetentionDays != nil {
+		value = *req.RetentionDays
+	}
+	if err := uc.repo.UpdateOrganizationSetting(ctx, orgID, OrgSettingRetentionDays, value); err != nil {
+		return nil, err
+	}
+
+	event := &AuditEvent{
+		OrganizationID: orgID,
+		UserID:         adminID,
+		Action:         AuditActionRetentionUpdate,
+		TargetType:     "organization",
+		TargetID:       orgID.String(),
+		Details:        map[string]interface{}{OrgSettingRetentionDays: value},
+		CreatedAt:      time.Now(),
+	}
+	if err := uc.repo.CreateAuditEvent(ctx, event); err != nil {
+		log.Printf("Failed to audit retention change for organization %s: %v", orgID, err)
+	}
+
+	return &OrganizationRetention{RetentionDays: req.RetentionDays}, nil
+}
+
+// applyRetention fills in the retention policy in effect for each conversation
+func (uc *ChatUsecase) applyRetention(ctx context.Context, conversations ...*Conversation) error {
+	orgDays := make(map[uuid.UUID]*int)
+	for _, conversation := range conversations {
+		if conversation.RetentionDays != nil {
+			conversation.Retention = &RetentionPolicy{Days: *conversation.RetentionDays, Source: RetentionSourceConversation}
+			continue
+		}
+
+		days, ok := orgDays[conversation.OrganizationID]
+		if !ok {
+			var err error
+			days, err = uc.organizationRetentionDays(ctx, conversation.OrganizationID)
+			if err != nil {
+				return err
+			}
+			orgDays[conversation.OrganizationID] = days
+		}
+		if days != nil {
+			conversation.Retention = &RetentionPolicy{Days: *days, Source: RetentionSourceOrganization}
+		}
+	}
+	return nil
+}
+
+func (uc *ChatUsecase) organizationRetentionDays(ctx context.Context, orgID uuid.UUID) (*int, error) {
+	settings, err := uc.repo.GetOrganizationSettings(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON numbers decode as float64
+	if days, ok := settings[OrgSettingRetentionDays].(float64); ok && days >= 1 {
+		value := int(days)
+		return &value, nil
+	}
+	return nil, nil
+}
+
+func equalIntPtr(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,83 @@
+package biz
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LastMessagePreview is the latest message of a conversation, trimmed for list views
+type LastMessagePreview struct {
+	ID          uuid.UUID `json:"id"`
+	SenderID    uuid.UUID `json:"sender_id"`
+	ContentType string    `json:"content_type"`
+	Preview     string    `json:"preview"`
+	SentAt      time.Time `json:"sent_at"`
+	// Receipt counts, excluding the sender
+	DeliveredCount int `json:"delivered_count"`
+	ReadCount      int `json:"read_count"`
+}
+
+// ParticipantSnapshot is just enough of a participant to render an avatar stack
+type ParticipantSnapshot struct {
+	UserID      uuid.UUID `json:"user_id"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+}
+
+// ConversationSummary is the per-conversation badge state for the caller
+type ConversationSummary struct {
+	ConversationID uuid.UUID           `json:"conversation_id"`
+	Type           ConversationType    `json:"type"`
+	Title          string              `json:"title,omitempty"`
+	UnreadCount    int                 `json:"unread_count"`
+	UnreadMention  bool                `json:"unread_mention"`
+	Muted          bool                `json:"muted"`
+	MutedUntil     *time.Time          `json:"muted_until,omitempty"`
+	PinnedAt       *time.Time          `json:"pinned_at,omitempty"`
+	LastMessage    *LastMessagePreview `json:"last_message,omitempty"`
+	// ParticipantCount includes the caller; Participants is the first few others
+	ParticipantCount int                    `json:"participant_count"`
+	Participants     []*ParticipantSnapshot `json:"participants"`
+}
+
+// GetConversationSummaries returns unread counts, unread mentions, mute state, the
+// last message with its receipt counts and up to participantLimit other participants
+// of every conversation the user is in, so clients can render the chat list on launch
+// without a request per conversation. It runs two queries however many conversations
+// the user has.
+func (uc *ChatUsecase) GetConversationSummaries(ctx context.Context, userID uuid.UUID, participantLimit int) ([]*ConversationSummary, error) {
+	summaries, err := uc.repo.GetConversationSummaries(ctx, userID, uc.config.SystemMessagesCountUnread)
+	if err != nil {
+		return nil, err
+	}
+
+	if participantLimit > 0 && len(summaries) > 0 {
+		conversationIDs := make([]uuid.UUID, len(summaries))
+		for i, summary := range summaries {
+			conversationIDs[i] = summary.ConversationID
+		}
+
+		snapshots, err := uc.repo.GetParticipantSnapshots(ctx, conversationIDs, userID, participantLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, summary := range summaries {
+			summary.Participants = snapshots[summary.ConversationID]
+		}
+	}
+
+	now := time.Now()
+	for _, summary := range summaries {
+		if summary.Participants == nil {
+			summary.Participants = []*ParticipantSnapshot{}
+		}
+		summary.Muted = summary.MutedUntil != nil && summary.MutedUntil.After(now)
+		if summary.LastMessage != nil {
+			summary.LastMessage.Preview = MessagePreview(summary.LastMessage.ContentType, summary.LastMessage.Preview)
+		}
+	}
+
+	return summaries, nil
+}
@@ -0,0 +1,94 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SystemEvent identifies what a system message records
+type SystemEvent string
+
+const (
+	SystemEventConversationCreated  SystemEvent = "conversation_created"
+	SystemEventParticipantsAdded    SystemEvent = "participants_added"
+	SystemEventParticipantRemoved   SystemEvent = "participant_removed"
+	SystemEventParticipantLeft      SystemEvent = "participant_left"
+	SystemEventRoleChanged          SystemEvent = "role_changed"
+	SystemEventTitleChanged         SystemEvent = "title_changed"
+	SystemEventPostPolicyChanged    SystemEvent = "post_policy_changed"
+	SystemEventRetentionChanged     SystemEvent = "retention_changed"
+	SystemEventSlowModeChanged      SystemEvent = "slow_mode_changed"
+	SystemEventConversationLocked   SystemEvent = "conversation_locked"
+	SystemEventConversationUnlocked SystemEvent = "conversation_unlocked"
+)
+
+// Meta keys of a system message. Clients render the text from these, e.g. resolving
+// actor_id and target_ids to names for "Alice added Bob".
+const (
+	MetaKeySystemEvent = "event"
+	MetaKeyActorID     = "actor_id"
+	MetaKeyTargetIDs   = "target_ids"
+	MetaKeyRole        = "role"
+	MetaKeyOldValue    = "old_value"
+	MetaKeyNewValue    = "new_value"
+)
+
+// systemMessageText is the fallback content for clients that don't understand an event
+var systemMessageText = map[SystemEvent]string{
+	SystemEventConversationCreated:  "Conversation created",
+	SystemEventParticipantsAdded:    "Participants added",
+	SystemEventParticipantRemoved:   "Participant removed",
+	SystemEventParticipantLeft:      "Participant left",
+	SystemEventRoleChanged:          "Participant role changed",
+	SystemEventTitleChanged:         "Title changed",
+	SystemEventPostPolicyChanged:    "Posting permissions changed",
+	SystemEventRetentionChanged:     "Message retention changed",
+	SystemEventSlowModeChanged:      "Slow mode changed",
+	SystemEventConversationLocked:   "Conversation locked",
+	SystemEventConversationUnlocked: "Conversation unlocked",
+}
+
+// IsSystemMessage reports whether the message was generated by the server
+func (m *Message) IsSystemMessage() bool {
+	return m.ContentType == ContentTypeSystem
+}
+
+// postSystemMessage records a membership or settings change in the conversation
+// history. It goes through the same publish path as user messages so it is persisted
+// by message-service and delivered live. The change itself has already happened, so
+// failures are only logged.
+func (uc *ChatUsecase) postSystemMessage(ctx context.Context, conversationID, actorID uuid.UUID, event SystemEvent, details map[string]interface{}) {
+	meta := map[string]interface{}{
+		MetaKeySystemEvent: event,
+		MetaKeyActorID:     actorID.String(),
+	}
+	for key, value := range details {
+		meta[key] = value
+	}
+
+	message := &Message{
+		ID:             uuid.New(),
+		ConversationID: conversationID,
+		SenderID:       actorID,
+		ContentType:    ContentTypeSystem,
+		Content:        systemMessageText[event],
+		Meta:           meta,
+		SentAt:         time.Now(),
+	}
+
+	if err := uc.publisher.PublishMessage(ctx, conversationID, message); err != nil {
+		log.Printf("Failed to publish %s system message for conversation %s: %v", event, conversationID, err)
+	}
+}
+
+// userIDStrings formats user IDs for system message meta
+func userIDStrings(userIDs []uuid.UUID) []string {
+	ids := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = id.String()
+	}
+	return ids
+}
@@ -0,0 +1,98 @@
+package biz
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TypingEvent is a typing indicator enriched with the typist's display name, as
+// message-service republishes it on chat/{id}/typing/enriched
+type TypingEvent struct {
+	ConversationID uuid.UUID `json:"conversation_id"`
+	UserID         uuid.UUID `json:"user_id"`
+	DisplayName    string    `json:"display_name"`
+	IsTyping       bool      `json:"is_typing"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// TypingSource delivers every enriched typing event published on the broker
+type TypingSource interface {
+	SubscribeTyping(handle func(event *TypingEvent)) error
+	Close()
+}
+
+// typingSubscriberBuffer is how many events a slow stream can fall behind before
+// further events are dropped for it. Typing is ephemeral, so dropping is harmless.
+const typingSubscriberBuffer = 16
+
+type typingSubscriber struct {
+	userID uuid.UUID
+	events chan *TypingEvent
+}
+
+// TypingRelay fans typing events out to clients streaming them over HTTP. Unlike a
+// raw MQTT subscription it never hands a user their own events, so clients don't see
+// their typing echoed back. Raw MQTT subscribers still receive every event, their own
+// included, and have to filter on user_id themselves.
+type TypingRelay struct {
+	source TypingSource
+
+	mu          sync.Mutex
+	subscribers map[uuid.UUID]map[*typingSubscriber]struct{}
+}
+
+func NewTypingRelay(source TypingSource) *TypingRelay {
+	return &TypingRelay{
+		source:      source,
+		subscribers: make(map[uuid.UUID]map[*typingSubscriber]struct{}),
+	}
+}
+
+// Start subscribes to the source. Events arriving before then are not relayed.
+func (r *TypingRelay) Start() error {
+	return r.source.SubscribeTyping(r.dispatch)
+}
+
+// Stop unsubscribes from the source
+func (r *TypingRelay) Stop() {
+	r.source.Close()
+}
+
+// Subscribe streams a conversation's typing events to userID, leaving out the ones
+// userID sent. The returned function must be called to unsubscribe.
+func (r *TypingRelay) Subscribe(conversationID, userID uuid.UUID) (<-chan *TypingEvent, func()) {
+	sub := &typingSubscriber{userID: userID, events: make(chan *TypingEvent, typingSubscriberBuffer)}
+
+	r.mu.Lock()
+	if r.subscribers[conversationID] == nil {
+		r.subscribers[conversationID] = make(map[*typingSubscriber]struct{})
+	}
+	r.subscribers[conversationID][sub] = struct{}{}
+	r.mu.Unlock()
+
+	return sub.events, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.subscribers[conversationID], sub)
+		if len(r.subscribers[conversationID]) == 0 {
+			delete(r.subscribers, conversationID)
+		}
+	}
+}
+
+func (r *TypingRelay) dispatch(event *TypingEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for sub := range r.subscribers[event.ConversationID] {
+		if sub.userID == event.UserID {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package biz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	ContentTypeText     = "text"
+	ContentTypeMarkdown = "markdown"
+	ContentTypeSystem   = "system"
+	ContentTypeImageRef = "image-ref"
+	ContentTypeFileRef  = "file-ref"
+	ContentTypeLocation = "location"
+
+	// ContentTypeEncrypted is client-side encrypted ciphertext. ContentTypeSenderKey
+	// distributes a sender key to the other participants. Both are only accepted in
+	// encrypted conversations, and the server never inspects or previews them.
+	ContentTypeEncrypted = "encrypted"
+	ContentTypeSenderKey = "sender-key"
+
+	// OrgSettingMaxMessageLength overrides MaxContentLength for an organization
+	OrgSettingMaxMessageLength = "max_message_length"
+)
+
+// DefaultContentTypes is the content type allowlist used when none is configured
+var DefaultContentTypes = []string{ContentTypeText, ContentTypeMarkdown, ContentTypeImageRef, ContentTypeFileRef, ContentTypeLocation}
+
+// Meta keys of a location message
+const (
+	MetaKeyLatitude  = "lat"
+	MetaKeyLongitude = "lng"
+	MetaKeyLabel     = "label"
+
+	maxLocationLabelLength = 200
+)
+
+// ValidationError reports which request fields failed validation and why
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, 0, len(e.Fields))
+	for field, msg := range e.Fields {
+		parts = append(parts, field+": "+msg)
+	}
+	return "validation failed: " + strings.Join(parts, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidRequest
+}
+
+// validateMessage checks content type, length and meta size, and strips control
+// characters from the content in place
+func (uc *ChatUsecase) validateMessage(ctx context.Context, conversation *Conversation, req *SendMessageRequest) error {
+	fields := make(map[string]string)
+
+	if conversation.IsEncrypted {
+		// Ciphertext can't be sanitized or checked for emptiness, only for size
+		if !isEncryptedContentType(req.ContentType) {
+			fields["content_type"] = fmt.Sprintf("must be %s or %s in encrypted conversations", ContentTypeEncrypted, ContentTypeSenderKey)
+		}
+		if req.Content == "" {
+			fields["content"] = "must not be empty"
+		}
+	} else {
+		if isEncryptedContentType(req.ContentType) {
+			fields["content_type"] = "is only allowed in encrypted conversations"
+		} else if req.ContentType == ContentTypeSystem {
+			fields["content_type"] = "system messages are generated by the server"
+		} else if !uc.isAllowedContentType(req.ContentType) {
+			fields["content_type"] = fmt.Sprintf("must be one of %s", strings.Join(uc.allowedContentTypes(), ", "))
+		}
+
+		req.Content = stripControlCharacters(req.Content)
+		if (req.ContentType == ContentTypeText || req.ContentType == ContentTypeMarkdown) && strings.TrimSpace(req.Content) == "" {
+			fields["content"] = "must not be empty"
+		}
+
+		if req.ContentType == ContentTypeLocation {
+			validateLocation(req, fields)
+		}
+	}
+
+	maxLength, err := uc.maxContentLength(ctx, conversation)
+	if err != nil {
+		return err
+	}
+	if maxLength > 0 && len(req.Content) > maxLength {
+		fields["content"] = fmt.Sprintf("must be at most %d bytes", maxLength)
+	}
+
+	if uc.config.MaxMetaBytes > 0 && len(req.Meta) > 0 {
+		metaJSON, err := json.Marshal(req.Meta)
+		if err != nil {
+			fields["meta"] = "must be valid JSON"
+		} else if len(metaJSON) > uc.config.MaxMetaBytes {
+			fields["meta"] = fmt.Sprintf("must be at most %d bytes when encoded", uc.config.MaxMetaBytes)
+		}
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+func (uc *ChatUsecase) allowedContentTypes() []string {
+	if len(uc.config.AllowedContentTypes) > 0 {
+		return uc.config.AllowedContentTypes
+	}
+	return DefaultContentTypes
+}
+
+func (uc *ChatUsecase) isAllowedContentType(contentType string) bool {
+	for _, allowed := range uc.allowedContentTypes() {
+		if contentType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// validateLocation checks the coordinates and label of a location message. Content is
+// optional for locations; when empty it falls back to the label or the coordinates so
+// previews and notifications have something to show.
+func validateLocation(req *SendMessageRequest, fields map[string]string) {
+	lat, latOK := req.Meta[MetaKeyLatitude].(float64)
+	lng, lngOK := req.Meta[MetaKeyLongitude].(float64)
+
+	if !latOK || math.IsNaN(lat) || lat < -90 || lat > 90 {
+		fields["meta.lat"] = "must be a number between -90 and 90"
+	}
+	if !lngOK || math.IsNaN(lng) || lng < -180 || lng > 180 {
+		fields["meta.lng"] = "must be a number between -180 and 180"
+	}
+
+	label := ""
+	if raw, ok := req.Meta[MetaKeyLabel]; ok && raw != nil {
+		str, ok := raw.(string)
+		if !ok {
+			fields["meta.label"] = "must be a string"
+		} else if label = strings.TrimSpace(stripControlCharacters(str)); utf8.RuneCountInString(label) > maxLocationLabelLength {
+			fields["meta.label"] = fmt.Sprintf("must be at most %d characters", maxLocationLabelLength)
+		} else {
+			req.Meta[MetaKeyLabel] = label
+		}
+	}
+
+	if strings.TrimSpace(req.Content) == "" && latOK && lngOK {
+		if label != "" {
+			req.Content = label
+		} else {
+			req.Content = fmt.Sprintf("%.6f, %.6f", lat, lng)
+		}
+	}
+}
+
+func isEncryptedContentType(contentType string) bool {
+	return contentType == ContentTypeEncrypted || contentType == ContentTypeSenderKey
+}
+
+// maxContentLength returns the organization's override if it has one, else the configured default
+func (uc *ChatUsecase) maxContentLength(ctx context.Context, conversation *Conversation) (int, error) {
+	settings, err := uc.repo.GetOrganizationSettings(ctx, conversation.OrganizationID)
+	if err != nil {
+		return 0, err
+	}
+
+	// JSON numbers decode as float64
+	if override, ok := settings[OrgSettingMaxMessageLength].(float64); ok && override > 0 {
+		return int(override), nil
+	}
+	return uc.config.MaxContentLength, nil
+}
+
+// stripControlCharacters removes control characters other than newlines and tabs
+func stripControlCharacters(content string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, content)
+}
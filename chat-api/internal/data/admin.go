@@ -0,0 +1,119 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/audit"
+)
+
+// organizationConversationConditions builds the WHERE clause shared by the admin
+// conversation listing and its count
+func organizationConversationConditions(orgID uuid.UUID, filter biz.AdminConversationFilter) ([]string, []interface{}) {
+	conditions := []string{"c.organization_id = $1"}
+	args := []interface{}{orgID}
+
+	if filter.Type != "" {
+		args = append(args, filter.Type)
+		conditions = append(conditions, fmt.Sprintf("c.type = $%d", len(args)))
+	}
+	if filter.CreatedAfter != nil {
+		args = append(args, *filter.CreatedAfter)
+		conditions = append(conditions, fmt.Sprintf("c.created_at > $%d", len(args)))
+	}
+	if filter.Query != "" {
+		args = append(args, "%"+filter.Query+"%")
+		conditions = append(conditions, fmt.Sprintf("c.title ILIKE $%d", len(args)))
+	}
+	return conditions, args
+}
+
+func (r *chatRepo) ListOrganizationConversations(ctx context.Context, orgID uuid.UUID, filter biz.AdminConversationFilter) ([]*biz.AdminConversation, error) {
+	conditions, args := organizationConversationConditions(orgID, filter)
+
+	args = append(args, filter.Limit, filter.Offset)
+	query := fmt.Sprintf(`
+		SELECT c.id, c.organization_id, c.type, COALESCE(c.title, ''), c.created_by, c.is_encrypted, c.post_policy, c.created_at,
+		       COALESCE(u.display_name, ''),
+		       (SELECT COUNT(*) FROM conversation_participants cp WHERE cp.conversation_id = c.id),
+		       stats.message_count, stats.last_message_at
+		FROM conversations c
+		LEFT JOIN users u ON u.id = c.created_by
+		LEFT JOIN LATERAL (
+			SELECT COUNT(*) AS message_count, MAX(m.sent_at) AS last_message_at
+			FROM messages m
+			WHERE m.conversation_id = c.id AND m.deleted = false
+		) stats ON true
+		WHERE %s
+		ORDER BY COALESCE(stats.last_message_at, c.created_at) DESC
+		LIMIT $%d OFFSET $%d`,
+		strings.Join(conditions, " AND "), len(args)-1, len(args))
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversations []*biz.AdminConversation
+	for rows.Next() {
+		conversation := &biz.AdminConversation{}
+		err := rows.Scan(
+			&conversation.ID, &conversation.OrganizationID, &conversation.Type, &conversation.Title,
+			&conversation.CreatedBy, &conversation.IsEncrypted, &conversation.PostPolicy, &conversation.CreatedAt,
+			&conversation.CreatorName, &conversation.ParticipantCount,
+			&conversation.MessageCount, &conversation.LastActivityAt)
+		if err != nil {
+			return nil, err
+		}
+
+		// Conversations without messages were last active when they were created
+		if conversation.LastActivityAt == nil {
+			createdAt := conversation.CreatedAt
+			conversation.LastActivityAt = &createdAt
+		}
+		conversations = append(conversations, conversation)
+	}
+
+	return conversations, rows.Err()
+}
+
+func (r *chatRepo) CountOrganizationConversations(ctx context.Context, orgID uuid.UUID, filter biz.AdminConversationFilter) (int, error) {
+	conditions, args := organizationConversationConditions(orgID, filter)
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM conversations c WHERE %s`, strings.Join(conditions, " AND "))
+
+	var count int
+	err := r.db.QueryRowContext(ctx, query, args...).Scan(&count)
+	return count, err
+}
+
+func (r *chatRepo) CreateAuditEvent(ctx context.Context, event *biz.AuditEvent) error {
+	// System actions such as retention purges have no acting user
+	var actorID *uuid.UUID
+	if event.UserID != uuid.Nil {
+		actorID = &event.UserID
+	}
+
+	return audit.Record(ctx, r.db, &audit.Entry{
+		OrganizationID: event.OrganizationID,
+		ActorID:        actorID,
+		Action:         event.Action,
+		TargetType:     event.TargetType,
+		TargetID:       event.TargetID,
+		Details:        event.Details,
+		Changes:        event.Changes,
+		CreatedAt:      event.CreatedAt,
+	})
+}
+
+func (r *chatRepo) ListAuditEvents(ctx context.Context, orgID uuid.UUID, filter audit.Filter) ([]*audit.Entry, error) {
+	return audit.List(ctx, r.db, orgID, filter)
+}
+
+func (r *chatRepo) CountAuditEvents(ctx context.Context, orgID uuid.UUID, filter audit.Filter) (int, error) {
+	return audit.Count(ctx, r.db, orgID, filter)
+}
@@ -4,43 +4,74 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/retry"
 )
 
 type chatRepo struct {
-	db *sql.DB
+	db    *sql.DB
+	retry retry.Config
 }
 
-func NewChatRepo(db *sql.DB) biz.ChatRepo {
-	return &chatRepo{db: db}
+func NewChatRepo(db *sql.DB, retryConfig retry.Config) biz.ChatRepo {
+	return &chatRepo{db: db, retry: retryConfig}
 }
 
-func (r *chatRepo) CreateConversation(ctx context.Context, conversation *biz.Conversation) error {
+func (r *chatRepo) CreateConversation(ctx context.Context, conversation *biz.Conversation, maxCreated int) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if maxCreated > 0 {
+		// Held until commit, so a concurrent create by the same user counts this one
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('conversations_created_by:' || $1::text))`, conversation.CreatedBy); err != nil {
+			return err
+		}
+		var count int
+		query := `SELECT COUNT(*) FROM conversations WHERE organization_id = $1 AND created_by = $2`
+		if err := tx.QueryRowContext(ctx, query, conversation.OrganizationID, conversation.CreatedBy).Scan(&count); err != nil {
+			return err
+		}
+		if count >= maxCreated {
+			return biz.ErrConversationLimitReached
+		}
+	}
+
 	query := `
-		INSERT INTO conversations (id, organization_id, type, title, created_by, is_encrypted, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+		INSERT INTO conversations (id, organization_id, type, title, created_by, is_encrypted, post_policy, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)`
 
-	_, err := r.db.ExecContext(ctx, query,
+	_, err = tx.ExecContext(ctx, query,
 		conversation.ID, conversation.OrganizationID, conversation.Type, conversation.Title,
-		conversation.CreatedBy, conversation.IsEncrypted, conversation.CreatedAt)
+		conversation.CreatedBy, conversation.IsEncrypted, conversation.PostPolicy, conversation.CreatedAt)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return tx.Commit()
 }
 
 func (r *chatRepo) GetConversation(ctx context.Context, id uuid.UUID) (*biz.Conversation, error) {
 	conversation := &biz.Conversation{}
 
 	query := `
-		SELECT id, organization_id, type, title, created_by, is_encrypted, created_at
+		SELECT id, organization_id, type, title, created_by, is_encrypted, post_policy, created_at,
+		       updated_at, last_message_at, retention_days, slow_mode_seconds, locked
 		FROM conversations WHERE id = $1`
 
 	err := r.db.QueryRowContext(ctx, query, id).Scan(
 		&conversation.ID, &conversation.OrganizationID, &conversation.Type, &conversation.Title,
-		&conversation.CreatedBy, &conversation.IsEncrypted, &conversation.CreatedAt)
+		&conversation.CreatedBy, &conversation.IsEncrypted, &conversation.PostPolicy, &conversation.CreatedAt,
+		&conversation.UpdatedAt, &conversation.LastMessageAt, &conversation.RetentionDays, &conversation.SlowModeSeconds, &conversation.Locked)
 
 	if err == sql.ErrNoRows {
 		return nil, biz.ErrConversationNotFound
@@ -52,15 +83,37 @@ func (r *chatRepo) GetConversation(ctx context.Context, id uuid.UUID) (*biz.Conv
 	return conversation, nil
 }
 
-func (r *chatRepo) GetUserConversations(ctx context.Context, userID uuid.UUID) ([]*biz.Conversation, error) {
-	query := `
-		SELECT c.id, c.organization_id, c.type, c.title, c.created_by, c.is_encrypted, c.created_at
+// userConversationsWhere builds the shared filter of the conversation list and its count
+func userConversationsWhere(userID uuid.UUID, filter biz.ConversationListFilter) (string, []interface{}) {
+	args := []interface{}{userID}
+	where := "cp.user_id = $1"
+	if filter.UpdatedSince != nil {
+		// Joining counts as a change so delta syncs pick up newly added conversations
+		args = append(args, *filter.UpdatedSince)
+		where += " AND (c.updated_at > $2 OR cp.joined_at > $2)"
+	}
+	return where, args
+}
+
+func (r *chatRepo) GetUserConversations(ctx context.Context, userID uuid.UUID, filter biz.ConversationListFilter) ([]*biz.Conversation, error) {
+	where, args := userConversationsWhere(userID, filter)
+
+	page := ""
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit, filter.Offset)
+		page = fmt.Sprintf("LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT c.id, c.organization_id, c.type, COALESCE(c.title, ''), c.created_by, c.is_encrypted, c.post_policy, c.created_at,
+		       c.updated_at, c.last_message_at, c.retention_days, c.slow_mode_seconds, c.locked, cp.pinned_at
 		FROM conversations c
 		INNER JOIN conversation_participants cp ON c.id = cp.conversation_id
-		WHERE cp.user_id = $1
-		ORDER BY c.created_at DESC`
+		WHERE %s
+		ORDER BY cp.pinned_at DESC NULLS LAST, c.updated_at DESC, c.id
+		%s`, where, page)
 
-	rows, err := r.db.QueryContext(ctx, query, userID)
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -71,7 +124,8 @@ func (r *chatRepo) GetUserConversations(ctx context.Context, userID uuid.UUID) (
 		conversation := &biz.Conversation{}
 		err := rows.Scan(
 			&conversation.ID, &conversation.OrganizationID, &conversation.Type, &conversation.Title,
-			&conversation.CreatedBy, &conversation.IsEncrypted, &conversation.CreatedAt)
+			&conversation.CreatedBy, &conversation.IsEncrypted, &conversation.PostPolicy, &conversation.CreatedAt,
+			&conversation.UpdatedAt, &conversation.LastMessageAt, &conversation.RetentionDays, &conversation.SlowModeSeconds, &conversation.Locked, &conversation.PinnedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -81,13 +135,202 @@ func (r *chatRepo) GetUserConversations(ctx context.Context, userID uuid.UUID) (
 	return conversations, nil
 }
 
+func (r *chatRepo) CountUserConversations(ctx context.Context, userID uuid.UUID, filter biz.ConversationListFilter) (int, error) {
+	where, args := userConversationsWhere(userID, filter)
+	query := fmt.Sprintf(`
+		SELECT COUNT(*)
+		FROM conversations c
+		INNER JOIN conversation_participants cp ON c.id = cp.conversation_id
+		WHERE %s`, where)
+
+	var count int
+	err := r.db.QueryRowContext(ctx, query, args...).Scan(&count)
+	return count, err
+}
+
+// likeEscaper escapes LIKE wildcards so user input is matched literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchUserConversations ranks title matches first, then the most recently active.
+// Only the user's own conversations are searched, and they never match on themselves.
+func (r *chatRepo) SearchUserConversations(ctx context.Context, userID uuid.UUID, query string, limit, offset int) ([]*biz.ConversationSearchResult, error) {
+	sqlQuery := `
+		SELECT c.id, c.organization_id, c.type, COALESCE(c.title, ''), c.created_by, c.is_encrypted, c.post_policy, c.created_at,
+		       c.updated_at, c.last_message_at, c.retention_days, c.slow_mode_seconds, c.locked, cp.pinned_at,
+		       COALESCE(c.title, '') ILIKE $2 AS title_match, pm.user_id, pm.display_name
+		FROM conversations c
+		INNER JOIN conversation_participants cp ON cp.conversation_id = c.id AND cp.user_id = $1
+		LEFT JOIN LATERAL (
+			SELECT u.id AS user_id, u.display_name
+			FROM conversation_participants op
+			INNER JOIN users u ON u.id = op.user_id
+			WHERE op.conversation_id = c.id AND op.user_id <> $1
+			  AND (u.display_name ILIKE $2 OR u.email ILIKE $2)
+			ORDER BY u.display_name, u.id
+			LIMIT 1
+		) pm ON true
+		WHERE COALESCE(c.title, '') ILIKE $2 OR pm.user_id IS NOT NULL
+		ORDER BY title_match DESC, c.updated_at DESC, c.id
+		LIMIT $3 OFFSET $4`
+
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+	rows, err := r.db.QueryContext(ctx, sqlQuery, userID, pattern, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*biz.ConversationSearchResult
+	for rows.Next() {
+		conversation := &biz.Conversation{}
+		var titleMatch bool
+		var matchedUserID *uuid.UUID
+		var matchedName sql.NullString
+		err := rows.Scan(
+			&conversation.ID, &conversation.OrganizationID, &conversation.Type, &conversation.Title,
+			&conversation.CreatedBy, &conversation.IsEncrypted, &conversation.PostPolicy, &conversation.CreatedAt,
+			&conversation.UpdatedAt, &conversation.LastMessageAt, &conversation.RetentionDays, &conversation.SlowModeSeconds, &conversation.Locked, &conversation.PinnedAt,
+			&titleMatch, &matchedUserID, &matchedName)
+		if err != nil {
+			return nil, err
+		}
+
+		result := &biz.ConversationSearchResult{Conversation: conversation, MatchedOn: biz.ConversationMatchParticipant}
+		if titleMatch {
+			result.MatchedOn = biz.ConversationMatchTitle
+		} else if matchedUserID != nil {
+			result.MatchedParticipant = &biz.MatchedParticipant{UserID: *matchedUserID, DisplayName: matchedName.String}
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// GetConversationSummaries computes unread state, the last message and its receipt
+// counts for all of the user's conversations in a single query
+func (r *chatRepo) GetConversationSummaries(ctx context.Context, userID uuid.UUID, countSystemMessages bool) ([]*biz.ConversationSummary, error) {
+	query := `
+		SELECT c.id, c.type, COALESCE(c.title, ''), cp.muted_until, cp.pinned_at,
+		       unread.unread_count, unread.mentioned,
+		       last.id, last.sender_id, last.content_type, last.content, last.sent_at,
+		       COALESCE(last.delivered_count, 0), COALESCE(last.read_count, 0),
+		       (SELECT COUNT(*) FROM conversation_participants pc WHERE pc.conversation_id = c.id)
+		FROM conversation_participants cp
+		INNER JOIN conversations c ON c.id = cp.conversation_id
+		LEFT JOIN LATERAL (
+			SELECT COUNT(*) AS unread_count,
+			       COALESCE(BOOL_OR(EXISTS (
+			           SELECT 1 FROM message_mentions mm WHERE mm.message_id = m.id AND mm.user_id = cp.user_id
+			       )), false) AS mentioned
+			FROM messages m
+			WHERE m.conversation_id = c.id AND m.deleted = false AND m.sender_id <> cp.user_id
+			  AND (cp.last_read_at IS NULL OR m.sent_at > cp.last_read_at)
+			  AND ($2 OR m.content_type <> 'system')
+		) unread ON true
+		LEFT JOIN LATERAL (
+			SELECT m.id, m.sender_id, m.content_type, m.content, m.sent_at,
+			       (SELECT COUNT(*) FROM message_receipts mr
+			        WHERE mr.message_id = m.id AND mr.status = 'delivered' AND mr.user_id <> m.sender_id) AS delivered_count,
+			       (SELECT COUNT(*) FROM message_receipts mr
+			        WHERE mr.message_id = m.id AND mr.status = 'read' AND mr.user_id <> m.sender_id) AS read_count
+			FROM messages m
+			WHERE m.conversation_id = c.id AND m.deleted = false
+			ORDER BY m.seq DESC
+			LIMIT 1
+		) last ON true
+		WHERE cp.user_id = $1
+		ORDER BY cp.pinned_at DESC NULLS LAST, c.updated_at DESC, c.id`
+
+	rows, err := r.db.QueryContext(ctx, query, userID, countSystemMessages)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []*biz.ConversationSummary
+	for rows.Next() {
+		summary := &biz.ConversationSummary{}
+		var lastID, lastSenderID, lastContentType, lastContent sql.NullString
+		var lastSentAt sql.NullTime
+		var deliveredCount, readCount int
+
+		err := rows.Scan(
+			&summary.ConversationID, &summary.Type, &summary.Title, &summary.MutedUntil, &summary.PinnedAt,
+			&summary.UnreadCount, &summary.UnreadMention,
+			&lastID, &lastSenderID, &lastContentType, &lastContent, &lastSentAt,
+			&deliveredCount, &readCount, &summary.ParticipantCount)
+		if err != nil {
+			return nil, err
+		}
+
+		if lastID.Valid {
+			summary.LastMessage = &biz.LastMessagePreview{
+				ID:          uuid.MustParse(lastID.String),
+				SenderID:    uuid.MustParse(lastSenderID.String),
+				ContentType: lastContentType.String,
+				Preview:     lastContent.String,
+				SentAt:      lastSentAt.Time,
+
+				DeliveredCount: deliveredCount,
+				ReadCount:      readCount,
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, rows.Err()
+}
+
+// GetParticipantSnapshots loads the avatar stacks of many conversations at once,
+// earliest joiners first
+func (r *chatRepo) GetParticipantSnapshots(ctx context.Context, conversationIDs []uuid.UUID, excludeUserID uuid.UUID, limit int) (map[uuid.UUID][]*biz.ParticipantSnapshot, error) {
+	query := `
+		SELECT conversation_id, user_id, display_name, avatar_url
+		FROM (
+			SELECT cp.conversation_id, u.id AS user_id, u.display_name, COALESCE(u.avatar_url, '') AS avatar_url,
+			       ROW_NUMBER() OVER (PARTITION BY cp.conversation_id ORDER BY cp.joined_at, cp.user_id) AS rn
+			FROM conversation_participants cp
+			INNER JOIN users u ON u.id = cp.user_id
+			WHERE cp.conversation_id = ANY($1) AND cp.user_id <> $2
+		) ranked
+		WHERE rn <= $3
+		ORDER BY conversation_id, rn`
+
+	ids := make([]string, len(conversationIDs))
+	for i, id := range conversationIDs {
+		ids[i] = id.String()
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(ids), excludeUserID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := make(map[uuid.UUID][]*biz.ParticipantSnapshot)
+	for rows.Next() {
+		var conversationID uuid.UUID
+		snapshot := &biz.ParticipantSnapshot{}
+		if err := rows.Scan(&conversationID, &snapshot.UserID, &snapshot.DisplayName, &snapshot.AvatarURL); err != nil {
+			return nil, err
+		}
+		snapshots[conversationID] = append(snapshots[conversationID], snapshot)
+	}
+
+	return snapshots, rows.Err()
+}
+
 func (r *chatRepo) UpdateConversation(ctx context.Context, conversation *biz.Conversation) error {
 	query := `
 		UPDATE conversations 
-		SET title = $2, is_encrypted = $3
+		SET title = $2, post_policy = $3, updated_at = $4, retention_days = $5,
+		    slow_mode_seconds = $6, locked = $7
 		WHERE id = $1`
 
-	_, err := r.db.ExecContext(ctx, query, conversation.ID, conversation.Title, conversation.IsEncrypted)
+	// is_encrypted is deliberately not updatable
+	_, err := r.db.ExecContext(ctx, query, conversation.ID, conversation.Title, conversation.PostPolicy, conversation.UpdatedAt,
+		conversation.RetentionDays, conversation.SlowModeSeconds, conversation.Locked)
 	return err
 }
 
@@ -103,10 +346,51 @@ func (r *chatRepo) AddParticipant(ctx context.Context, participant *biz.Particip
 		VALUES ($1, $2, $3, $4, $5)
 		ON CONFLICT (conversation_id, user_id) DO NOTHING`
 
-	_, err := r.db.ExecContext(ctx, query,
-		participant.ID, participant.ConversationID, participant.UserID, participant.Role, participant.JoinedAt)
+	return retry.Do(ctx, r.retry, func(ctx context.Context) error {
+		_, err := r.db.ExecContext(ctx, query,
+			participant.ID, participant.ConversationID, participant.UserID, participant.Role, participant.JoinedAt)
+		return err
+	})
+}
 
-	return err
+// AddParticipants inserts all participants in a single statement and returns the IDs
+// of the users that were actually added; existing members are left untouched
+func (r *chatRepo) AddParticipants(ctx context.Context, participants []*biz.Participant) ([]uuid.UUID, error) {
+	values := make([]string, len(participants))
+	args := make([]interface{}, 0, len(participants)*5)
+	for i, p := range participants {
+		n := i * 5
+		values[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5)
+		args = append(args, p.ID, p.ConversationID, p.UserID, p.Role, p.JoinedAt)
+	}
+
+	query := `
+		INSERT INTO conversation_participants (id, conversation_id, user_id, role, joined_at)
+		VALUES ` + strings.Join(values, ", ") + `
+		ON CONFLICT (conversation_id, user_id) DO NOTHING
+		RETURNING user_id`
+
+	var added []uuid.UUID
+	err := retry.Do(ctx, r.retry, func(ctx context.Context) error {
+		added = added[:0]
+
+		rows, err := r.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var userID uuid.UUID
+			if err := rows.Scan(&userID); err != nil {
+				return err
+			}
+			added = append(added, userID)
+		}
+		return rows.Err()
+	})
+
+	return added, err
 }
 
 func (r *chatRepo) RemoveParticipant(ctx context.Context, conversationID, userID uuid.UUID) error {
@@ -115,9 +399,48 @@ func (r *chatRepo) RemoveParticipant(ctx context.Context, conversationID, userID
 	return err
 }
 
+func (r *chatRepo) CountParticipants(ctx context.Context, conversationID uuid.UUID) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM conversation_participants WHERE conversation_id = $1`
+	err := r.db.QueryRowContext(ctx, query, conversationID).Scan(&count)
+	return count, err
+}
+
+func (r *chatRepo) ListParticipants(ctx context.Context, conversationID uuid.UUID, filter biz.ParticipantListFilter) ([]*biz.Participant, error) {
+	query := `
+		SELECT cp.id, cp.conversation_id, cp.user_id, cp.role, cp.joined_at, cp.last_read_at, cp.muted_until,
+		       u.display_name, u.email
+		FROM conversation_participants cp
+		INNER JOIN users u ON cp.user_id = u.id
+		WHERE cp.conversation_id = $1
+		ORDER BY cp.role = 'admin' DESC, lower(u.display_name), cp.user_id
+		LIMIT NULLIF($2, 0) OFFSET $3`
+
+	rows, err := r.db.QueryContext(ctx, query, conversationID, filter.Limit, filter.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var participants []*biz.Participant
+	for rows.Next() {
+		participant := &biz.Participant{}
+		err := rows.Scan(
+			&participant.ID, &participant.ConversationID, &participant.UserID,
+			&participant.Role, &participant.JoinedAt, &participant.LastReadAt, &participant.MutedUntil,
+			&participant.DisplayName, &participant.Email)
+		if err != nil {
+			return nil, err
+		}
+		participants = append(participants, participant)
+	}
+
+	return participants, rows.Err()
+}
+
 func (r *chatRepo) GetConversationParticipants(ctx context.Context, conversationID uuid.UUID) ([]*biz.Participant, error) {
 	query := `
-		SELECT cp.id, cp.conversation_id, cp.user_id, cp.role, cp.joined_at, cp.last_read_at,
+		SELECT cp.id, cp.conversation_id, cp.user_id, cp.role, cp.joined_at, cp.last_read_at, cp.muted_until,
 		       u.display_name, u.email
 		FROM conversation_participants cp
 		INNER JOIN users u ON cp.user_id = u.id
@@ -135,7 +458,7 @@ func (r *chatRepo) GetConversationParticipants(ctx context.Context, conversation
 		participant := &biz.Participant{}
 		err := rows.Scan(
 			&participant.ID, &participant.ConversationID, &participant.UserID,
-			&participant.Role, &participant.JoinedAt, &participant.LastReadAt,
+			&participant.Role, &participant.JoinedAt, &participant.LastReadAt, &participant.MutedUntil,
 			&participant.DisplayName, &participant.Email)
 		if err != nil {
 			return nil, err
@@ -150,13 +473,14 @@ func (r *chatRepo) GetParticipant(ctx context.Context, conversationID, userID uu
 	participant := &biz.Participant{}
 
 	query := `
-		SELECT id, conversation_id, user_id, role, joined_at, last_read_at
+		SELECT id, conversation_id, user_id, role, joined_at, last_read_at, muted_until, pinned_at
 		FROM conversation_participants 
 		WHERE conversation_id = $1 AND user_id = $2`
 
 	err := r.db.QueryRowContext(ctx, query, conversationID, userID).Scan(
 		&participant.ID, &participant.ConversationID, &participant.UserID,
-		&participant.Role, &participant.JoinedAt, &participant.LastReadAt)
+		&participant.Role, &participant.JoinedAt, &participant.LastReadAt, &participant.MutedUntil,
+		&participant.PinnedAt)
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -168,42 +492,209 @@ func (r *chatRepo) GetParticipant(ctx context.Context, conversationID, userID uu
 	return participant, nil
 }
 
+func (r *chatRepo) SharesConversation(ctx context.Context, userID, peerID uuid.UUID) (bool, error) {
+	var shared bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM conversation_participants own
+			INNER JOIN conversation_participants peer ON peer.conversation_id = own.conversation_id
+			WHERE own.user_id = $1 AND peer.user_id = $2
+		)`
+	err := r.db.QueryRowContext(ctx, query, userID, peerID).Scan(&shared)
+	return shared, err
+}
+
 func (r *chatRepo) UpdateParticipantRole(ctx context.Context, conversationID, userID uuid.UUID, role biz.ParticipantRole) error {
 	query := `UPDATE conversation_participants SET role = $3 WHERE conversation_id = $1 AND user_id = $2`
 	_, err := r.db.ExecContext(ctx, query, conversationID, userID, role)
 	return err
 }
 
-func (r *chatRepo) UpdateLastReadAt(ctx context.Context, conversationID, userID uuid.UUID) error {
-	query := `UPDATE conversation_participants SET last_read_at = NOW() WHERE conversation_id = $1 AND user_id = $2`
-	_, err := r.db.ExecContext(ctx, query, conversationID, userID)
+// MarkConversationRead does the update and the receipt inserts in one statement, so
+// the window between the old and new last_read_at is read under the row lock and
+// concurrent marks can't both claim the same messages
+func (r *chatRepo) MarkConversationRead(ctx context.Context, conversationID, userID uuid.UUID, readAt time.Time, limit int) ([]uuid.UUID, error) {
+	query := `
+		WITH prev AS (
+		    SELECT last_read_at FROM conversation_participants
+		    WHERE conversation_id = $1 AND user_id = $2
+		    FOR UPDATE
+		), marked AS (
+		    UPDATE conversation_participants SET last_read_at = $3
+		    WHERE conversation_id = $1 AND user_id = $2
+		      AND (last_read_at IS NULL OR last_read_at < $3)
+		), covered AS (
+		    SELECT m.id FROM messages m, prev
+		    WHERE m.conversation_id = $1 AND m.sender_id <> $2 AND NOT m.deleted
+		      AND m.sent_at <= $3
+		      AND (prev.last_read_at IS NULL OR m.sent_at > prev.last_read_at)
+		    ORDER BY m.sent_at DESC
+		    LIMIT $4
+		)
+		INSERT INTO message_receipts (message_id, user_id, status, at)
+		SELECT id, $2, 'read', $3 FROM covered
+		ON CONFLICT (message_id, user_id, status) DO NOTHING
+		RETURNING message_id`
+
+	var messageIDs []uuid.UUID
+	err := retry.Do(ctx, r.retry, func(ctx context.Context) error {
+		messageIDs = nil
+		rows, err := r.db.QueryContext(ctx, query, conversationID, userID, readAt, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id uuid.UUID
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			messageIDs = append(messageIDs, id)
+		}
+		return rows.Err()
+	})
+	return messageIDs, err
+}
+
+func (r *chatRepo) SetMutedUntil(ctx context.Context, conversationID, userID uuid.UUID, mutedUntil *time.Time) error {
+	query := `UPDATE conversation_participants SET muted_until = $3 WHERE conversation_id = $1 AND user_id = $2`
+	_, err := r.db.ExecContext(ctx, query, conversationID, userID, mutedUntil)
 	return err
 }
 
-func (r *chatRepo) GetConversationMessages(ctx context.Context, conversationID uuid.UUID, limit, offset int) ([]*biz.Message, error) {
-	query := `
-		SELECT m.id, m.conversation_id, m.sender_id, m.content_type, m.content, m.meta, m.dedupe_key, 
-		       m.sent_at, m.edited_at, m.deleted,
-		       CASE 
-		           WHEN EXISTS (
-		               SELECT 1 FROM conversation_participants cp 
-		               WHERE cp.conversation_id = m.conversation_id 
-		               AND cp.user_id != m.sender_id 
-		               AND cp.last_read_at >= m.sent_at
-		           ) THEN true 
-		           ELSE false 
-		       END as is_read
-		FROM messages m
-		WHERE m.conversation_id = $1 AND m.deleted = false
-		ORDER BY m.sent_at DESC
-		LIMIT $2 OFFSET $3`
+func (r *chatRepo) SetPinnedAt(ctx context.Context, conversationID, userID uuid.UUID, pinnedAt *time.Time) error {
+	query := `UPDATE conversation_participants SET pinned_at = $3 WHERE conversation_id = $1 AND user_id = $2`
+	_, err := r.db.ExecContext(ctx, query, conversationID, userID, pinnedAt)
+	return err
+}
+
+func (r *chatRepo) CountPinnedConversations(ctx context.Context, userID uuid.UUID) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM conversation_participants WHERE user_id = $1 AND pinned_at IS NOT NULL`
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
 
-	rows, err := r.db.QueryContext(ctx, query, conversationID, limit, offset)
+// messageListQuery completes a query whose leading CTEs (given by with) define page,
+// the messages to return with $1 bound to their conversation. The conversation's
+// participants are read once and joined to every message on the page, so read state
+// for both policies and the recipient count come out of a single aggregate instead of
+// correlated subqueries per row. Receipt counts are aggregated the same way to avoid
+// N+1 lookups; a read receipt implies delivery, so delivered counts distinct
+// recipients with any receipt. Messages are listed in seq order, newest first unless
+// ascending.
+func messageListQuery(with string, ascending bool) string {
+	order := "DESC"
+	if ascending {
+		order = "ASC"
+	}
+	return with + `, participants AS (
+		    SELECT cp.user_id, cp.last_read_at
+		    FROM conversation_participants cp
+		    WHERE cp.conversation_id = $1
+		), reads AS (
+		    SELECT p.id,
+		           COUNT(cp.user_id) as recipient_count,
+		           COALESCE(bool_and(COALESCE(cp.last_read_at >= p.sent_at, false)), false) as read_by_all,
+		           COALESCE(bool_or(cp.last_read_at >= p.sent_at), false) as read_by_any
+		    FROM page p
+		    LEFT JOIN participants cp ON cp.user_id != p.sender_id
+		    GROUP BY p.id
+		), receipts AS (
+		    SELECT mr.message_id,
+		           COUNT(DISTINCT mr.user_id) as delivered_count,
+		           COUNT(DISTINCT mr.user_id) FILTER (WHERE mr.status = 'read') as read_count
+		    FROM message_receipts mr
+		    JOIN page p ON p.id = mr.message_id AND mr.user_id != p.sender_id
+		    GROUP BY mr.message_id
+		)
+		SELECT p.id, p.conversation_id, p.sender_id, p.content_type, p.content, p.meta, p.dedupe_key,
+		       p.parent_id, p.seq, p.sent_at, p.edited_at, p.pinned_at, p.deleted, COALESCE(parent.deleted, false),
+		       rd.read_by_all, rd.read_by_any, rd.recipient_count,
+		       COALESCE(rc.delivered_count, 0), COALESCE(rc.read_count, 0)
+		FROM page p
+		JOIN reads rd ON rd.id = p.id
+		LEFT JOIN receipts rc ON rc.message_id = p.id
+		LEFT JOIN messages parent ON parent.id = p.parent_id
+		ORDER BY p.seq ` + order
+}
+
+func (r *chatRepo) GetConversationMessages(ctx context.Context, orgID, conversationID uuid.UUID, afterSeq *int64, hideBlockedBy *uuid.UUID, limit, offset int) ([]*biz.Message, error) {
+	// Without afterSeq, $5 is NULL and every message qualifies; likewise $6 without hideBlockedBy
+	order := "DESC"
+	if afterSeq != nil {
+		order = "ASC"
+	}
+	query := messageListQuery(`
+		WITH page AS (
+		    SELECT m.id, m.conversation_id, m.sender_id, m.content_type, m.content, m.meta,
+		           m.dedupe_key, m.parent_id, m.seq, m.sent_at, m.edited_at, m.pinned_at, m.deleted
+		    FROM messages m
+		    INNER JOIN conversations c ON c.id = m.conversation_id AND c.organization_id = $4
+		    WHERE m.conversation_id = $1 AND m.deleted = false AND ($5::bigint IS NULL OR m.seq > $5)
+		      AND `+notBlockedCondition("$4", "$6")+`
+		    ORDER BY m.seq `+order+`
+		    LIMIT $2 OFFSET $3
+		)`, afterSeq != nil)
+
+	rows, err := r.db.QueryContext(ctx, query, conversationID, limit, offset, orgID, afterSeq, hideBlockedBy)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	return scanMessageList(rows)
+}
+
+// notBlockedCondition filters out messages m whose sender the user in blockerParam
+// has blocked within the organization in orgParam. A NULL blocker keeps every message.
+func notBlockedCondition(orgParam, blockerParam string) string {
+	return `(` + blockerParam + `::uuid IS NULL OR NOT EXISTS (
+		    SELECT 1 FROM blocked_users b
+		    WHERE b.organization_id = ` + orgParam + ` AND b.blocker_id = ` + blockerParam + ` AND b.blocked_id = m.sender_id))`
+}
+
+// GetMessageWithContext returns the message, deleted or not, along with up to before
+// older and after newer visible messages, newest first
+func (r *chatRepo) GetMessageWithContext(ctx context.Context, orgID, conversationID, messageID uuid.UUID, before, after int) ([]*biz.Message, error) {
+	query := messageListQuery(`
+		WITH target AS (
+		    SELECT m.id, m.seq
+		    FROM messages m
+		    INNER JOIN conversations c ON c.id = m.conversation_id AND c.organization_id = $5
+		    WHERE m.id = $2 AND m.conversation_id = $1
+		), page AS (
+		    (SELECT m.id, m.conversation_id, m.sender_id, m.content_type, m.content, m.meta,
+		            m.dedupe_key, m.parent_id, m.seq, m.sent_at, m.edited_at, m.pinned_at, m.deleted
+		     FROM messages m
+		     INNER JOIN target t ON t.id = m.id)
+		    UNION ALL
+		    (SELECT m.id, m.conversation_id, m.sender_id, m.content_type, m.content, m.meta,
+		            m.dedupe_key, m.parent_id, m.seq, m.sent_at, m.edited_at, m.pinned_at, m.deleted
+		     FROM messages m, target t
+		     WHERE m.conversation_id = $1 AND m.deleted = false AND m.seq < t.seq
+		     ORDER BY m.seq DESC
+		     LIMIT $3)
+		    UNION ALL
+		    (SELECT m.id, m.conversation_id, m.sender_id, m.content_type, m.content, m.meta,
+		            m.dedupe_key, m.parent_id, m.seq, m.sent_at, m.edited_at, m.pinned_at, m.deleted
+		     FROM messages m, target t
+		     WHERE m.conversation_id = $1 AND m.deleted = false AND m.seq > t.seq
+		     ORDER BY m.seq ASC
+		     LIMIT $4)
+		)`, false)
+
+	rows, err := r.db.QueryContext(ctx, query, conversationID, messageID, before, after, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMessageList(rows)
+}
+
+func scanMessageList(rows *sql.Rows) ([]*biz.Message, error) {
 	var messages []*biz.Message
 	for rows.Next() {
 		message := &biz.Message{}
@@ -211,7 +702,9 @@ func (r *chatRepo) GetConversationMessages(ctx context.Context, conversationID u
 
 		err := rows.Scan(
 			&message.ID, &message.ConversationID, &message.SenderID, &message.ContentType,
-			&message.Content, &metaJSON, &message.DedupeKey, &message.SentAt, &message.EditedAt, &message.Deleted, &message.IsRead)
+			&message.Content, &metaJSON, &message.DedupeKey, &message.ParentID, &message.Seq, &message.SentAt, &message.EditedAt,
+			&message.PinnedAt, &message.Deleted, &message.ParentDeleted, &message.ReadByAll, &message.ReadByAny,
+			&message.RecipientCount, &message.DeliveredCount, &message.ReadCount)
 		if err != nil {
 			return nil, err
 		}
@@ -222,7 +715,94 @@ func (r *chatRepo) GetConversationMessages(ctx context.Context, conversationID u
 		messages = append(messages, message)
 	}
 
-	return messages, nil
+	return messages, rows.Err()
+}
+
+func (r *chatRepo) CountConversationMessages(ctx context.Context, orgID, conversationID uuid.UUID, afterSeq *int64, hideBlockedBy *uuid.UUID) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM messages m
+		INNER JOIN conversations c ON c.id = m.conversation_id AND c.organization_id = $2
+		WHERE m.conversation_id = $1 AND m.deleted = false AND ($3::bigint IS NULL OR m.seq > $3)
+		  AND ` + notBlockedCondition("$2", "$4")
+
+	var count int
+	err := r.db.QueryRowContext(ctx, query, conversationID, orgID, afterSeq, hideBlockedBy).Scan(&count)
+	return count, err
+}
+
+// FindMessageAt walks msg_conv_time_idx forward from at to the first visible message,
+// then counts the newer ones along the same index
+func (r *chatRepo) FindMessageAt(ctx context.Context, orgID, conversationID uuid.UUID, at time.Time) (*biz.MessagePosition, error) {
+	query := `
+		WITH target AS (
+		    SELECT m.id, m.seq
+		    FROM messages m
+		    INNER JOIN conversations c ON c.id = m.conversation_id AND c.organization_id = $3
+		    WHERE m.conversation_id = $1 AND m.deleted = false AND m.sent_at >= $2
+		    ORDER BY m.sent_at ASC, m.seq ASC
+		    LIMIT 1
+		)
+		SELECT t.id,
+		       (SELECT COUNT(*) FROM messages m
+		        WHERE m.conversation_id = $1 AND m.deleted = false AND m.seq > t.seq)
+		FROM target t`
+
+	position := &biz.MessagePosition{}
+	err := r.db.QueryRowContext(ctx, query, conversationID, at, orgID).Scan(&position.MessageID, &position.Newer)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return position, nil
+}
+
+func (r *chatRepo) GetMessagePosition(ctx context.Context, orgID, conversationID, messageID uuid.UUID) (*biz.MessagePosition, error) {
+	query := `
+		WITH target AS (
+		    SELECT m.id, m.seq
+		    FROM messages m
+		    INNER JOIN conversations c ON c.id = m.conversation_id AND c.organization_id = $3
+		    WHERE m.id = $2 AND m.conversation_id = $1
+		)
+		SELECT t.id,
+		       (SELECT COUNT(*) FROM messages m
+		        WHERE m.conversation_id = $1 AND m.deleted = false AND m.seq > t.seq)
+		FROM target t`
+
+	position := &biz.MessagePosition{}
+	err := r.db.QueryRowContext(ctx, query, conversationID, messageID, orgID).Scan(&position.MessageID, &position.Newer)
+	if err == sql.ErrNoRows {
+		return nil, biz.ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return position, nil
+}
+
+// SetMessagePinnedAt pins the message at pinnedAt, keeping the original time if it is
+// already pinned, or unpins it when pinnedAt is nil
+func (r *chatRepo) SetMessagePinnedAt(ctx context.Context, conversationID, messageID uuid.UUID, pinnedAt *time.Time) error {
+	query := `
+		UPDATE messages
+		SET pinned_at = CASE WHEN $3::timestamptz IS NULL THEN NULL ELSE COALESCE(pinned_at, $3) END
+		WHERE id = $1 AND conversation_id = $2 AND deleted = false`
+
+	result, err := r.db.ExecContext(ctx, query, messageID, conversationID, pinnedAt)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return biz.ErrMessageNotFound
+	}
+	return nil
 }
 
 func (r *chatRepo) GetMessage(ctx context.Context, messageID uuid.UUID) (*biz.Message, error) {
@@ -230,12 +810,12 @@ func (r *chatRepo) GetMessage(ctx context.Context, messageID uuid.UUID) (*biz.Me
 	var metaJSON []byte
 
 	query := `
-		SELECT id, conversation_id, sender_id, content_type, content, meta, dedupe_key, sent_at, edited_at, deleted
+		SELECT id, conversation_id, sender_id, content_type, content, meta, dedupe_key, parent_id, seq, sent_at, edited_at, deleted
 		FROM messages WHERE id = $1`
 
 	err := r.db.QueryRowContext(ctx, query, messageID).Scan(
 		&message.ID, &message.ConversationID, &message.SenderID, &message.ContentType,
-		&message.Content, &metaJSON, &message.DedupeKey, &message.SentAt, &message.EditedAt, &message.Deleted)
+		&message.Content, &metaJSON, &message.DedupeKey, &message.ParentID, &message.Seq, &message.SentAt, &message.EditedAt, &message.Deleted)
 
 	if err == sql.ErrNoRows {
 		return nil, biz.ErrMessageNotFound
@@ -250,3 +830,344 @@ func (r *chatRepo) GetMessage(ctx context.Context, messageID uuid.UUID) (*biz.Me
 
 	return message, nil
 }
+
+// GetMessageAttachments lists the files attached to a message, which media-service owns
+func (r *chatRepo) GetMessageAttachments(ctx context.Context, messageID uuid.UUID) ([]*biz.MessageAttachment, error) {
+	query := `
+		SELECT id, file_name, mime_type, size, status
+		FROM attachments
+		WHERE message_id = $1
+		ORDER BY created_at ASC`
+
+	rows, err := r.db.QueryContext(ctx, query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []*biz.MessageAttachment
+	for rows.Next() {
+		attachment := &biz.MessageAttachment{}
+		if err := rows.Scan(&attachment.ID, &attachment.FileName, &attachment.MimeType, &attachment.Size, &attachment.Status); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, rows.Err()
+}
+
+func (r *chatRepo) GetUserSnapshot(ctx context.Context, userID uuid.UUID) (*biz.ParticipantSnapshot, error) {
+	snapshot := &biz.ParticipantSnapshot{}
+	query := `SELECT id, display_name, COALESCE(avatar_url, '') FROM users WHERE id = $1`
+
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&snapshot.UserID, &snapshot.DisplayName, &snapshot.AvatarURL)
+	if err == sql.ErrNoRows {
+		return nil, biz.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// DeleteMessage soft-deletes a message so it drops out of conversation history
+func (r *chatRepo) DeleteMessage(ctx context.Context, messageID uuid.UUID) error {
+	query := `UPDATE messages SET deleted = true WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, messageID)
+	return err
+}
+
+func (r *chatRepo) GetMessageReceipts(ctx context.Context, messageIDs []uuid.UUID) (map[uuid.UUID][]*biz.MessageReceipt, error) {
+	query := `
+		SELECT message_id, user_id, status, at
+		FROM message_receipts
+		WHERE message_id = ANY($1)
+		ORDER BY at ASC`
+
+	ids := make([]string, len(messageIDs))
+	for i, id := range messageIDs {
+		ids[i] = id.String()
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	receipts := make(map[uuid.UUID][]*biz.MessageReceipt)
+	for rows.Next() {
+		var messageID uuid.UUID
+		receipt := &biz.MessageReceipt{}
+		if err := rows.Scan(&messageID, &receipt.UserID, &receipt.Status, &receipt.At); err != nil {
+			return nil, err
+		}
+		receipts[messageID] = append(receipts[messageID], receipt)
+	}
+
+	return receipts, rows.Err()
+}
+
+func (r *chatRepo) GetUserOrganizations(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]uuid.UUID, error) {
+	query := `SELECT id, organization_id FROM users WHERE id = ANY($1)`
+
+	ids := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = id.String()
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := make(map[uuid.UUID]uuid.UUID)
+	for rows.Next() {
+		var userID, orgID uuid.UUID
+		if err := rows.Scan(&userID, &orgID); err != nil {
+			return nil, err
+		}
+		orgs[userID] = orgID
+	}
+
+	return orgs, rows.Err()
+}
+
+func (r *chatRepo) GetOrganizationSettings(ctx context.Context, orgID uuid.UUID) (map[string]interface{}, error) {
+	var settingsJSON []byte
+	query := `SELECT settings FROM organizations WHERE id = $1`
+
+	err := r.db.QueryRowContext(ctx, query, orgID).Scan(&settingsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]interface{})
+	if len(settingsJSON) > 0 {
+		if err := json.Unmarshal(settingsJSON, &settings); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+func (r *chatRepo) UpdateOrganizationSetting(ctx context.Context, orgID uuid.UUID, key string, value interface{}) error {
+	if value == nil {
+		query := `UPDATE organizations SET settings = COALESCE(settings, '{}'::jsonb) - $2 WHERE id = $1`
+		_, err := r.db.ExecContext(ctx, query, orgID, key)
+		return err
+	}
+
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE organizations SET settings = jsonb_set(COALESCE(settings, '{}'::jsonb), ARRAY[$2::text], $3::jsonb) WHERE id = $1`
+	_, err = r.db.ExecContext(ctx, query, orgID, key, valueJSON)
+	return err
+}
+
+func (r *chatRepo) GetUserRole(ctx context.Context, userID uuid.UUID) (string, error) {
+	var role string
+	query := `SELECT role FROM users WHERE id = $1`
+
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", biz.ErrUserNotFound
+	}
+	return role, err
+}
+
+func (r *chatRepo) FlagUser(ctx context.Context, userID uuid.UUID) error {
+	query := `UPDATE users SET flagged_at = COALESCE(flagged_at, NOW()) WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, query, userID)
+	return err
+}
+
+func (r *chatRepo) CreateBlock(ctx context.Context, block *biz.UserBlock) error {
+	query := `
+		INSERT INTO blocked_users (organization_id, blocker_id, blocked_id, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (blocker_id, blocked_id) DO NOTHING`
+
+	_, err := r.db.ExecContext(ctx, query, block.OrganizationID, block.BlockerID, block.BlockedID, block.CreatedAt)
+	return err
+}
+
+func (r *chatRepo) DeleteBlock(ctx context.Context, orgID, blockerID, blockedID uuid.UUID) error {
+	query := `DELETE FROM blocked_users WHERE organization_id = $1 AND blocker_id = $2 AND blocked_id = $3`
+	_, err := r.db.ExecContext(ctx, query, orgID, blockerID, blockedID)
+	return err
+}
+
+func (r *chatRepo) GetBlocks(ctx context.Context, orgID, blockerID uuid.UUID) ([]*biz.UserBlock, error) {
+	query := `
+		SELECT organization_id, blocker_id, blocked_id, created_at
+		FROM blocked_users
+		WHERE organization_id = $1 AND blocker_id = $2
+		ORDER BY created_at DESC`
+
+	rows, err := r.db.QueryContext(ctx, query, orgID, blockerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocks []*biz.UserBlock
+	for rows.Next() {
+		block := &biz.UserBlock{}
+		if err := rows.Scan(&block.OrganizationID, &block.BlockerID, &block.BlockedID, &block.CreatedAt); err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, rows.Err()
+}
+
+func (r *chatRepo) IsBlockedBetween(ctx context.Context, orgID, userA, userB uuid.UUID) (bool, error) {
+	var blocked bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM blocked_users
+			WHERE organization_id = $1
+			  AND ((blocker_id = $2 AND blocked_id = $3) OR (blocker_id = $3 AND blocked_id = $2))
+		)`
+
+	err := r.db.QueryRowContext(ctx, query, orgID, userA, userB).Scan(&blocked)
+	return blocked, err
+}
+
+func (r *chatRepo) GetNotificationPreferences(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]*biz.NotificationPreferences, error) {
+	query := `
+		SELECT user_id, default_level, COALESCE(to_char(quiet_hours_start, 'HH24:MI'), ''),
+		       COALESCE(to_char(quiet_hours_end, 'HH24:MI'), ''), COALESCE(timezone, '')
+		FROM notification_preferences
+		WHERE user_id = ANY($1)`
+
+	ids := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = id.String()
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefs := make(map[uuid.UUID]*biz.NotificationPreferences)
+	for rows.Next() {
+		pref := &biz.NotificationPreferences{}
+		if err := rows.Scan(&pref.UserID, &pref.DefaultLevel, &pref.QuietHoursStart, &pref.QuietHoursEnd, &pref.Timezone); err != nil {
+			return nil, err
+		}
+		prefs[pref.UserID] = pref
+	}
+
+	return prefs, rows.Err()
+}
+
+func (r *chatRepo) UpsertNotificationPreferences(ctx context.Context, pref *biz.NotificationPreferences) error {
+	query := `
+		INSERT INTO notification_preferences (user_id, default_level, quiet_hours_start, quiet_hours_end, timezone, updated_at)
+		VALUES ($1, $2, NULLIF($3, '')::time, NULLIF($4, '')::time, NULLIF($5, ''), now())
+		ON CONFLICT (user_id) DO UPDATE SET
+			default_level = EXCLUDED.default_level,
+			quiet_hours_start = EXCLUDED.quiet_hours_start,
+			quiet_hours_end = EXCLUDED.quiet_hours_end,
+			timezone = EXCLUDED.timezone,
+			updated_at = EXCLUDED.updated_at`
+
+	_, err := r.db.ExecContext(ctx, query,
+		pref.UserID, pref.DefaultLevel, pref.QuietHoursStart, pref.QuietHoursEnd, pref.Timezone,
+	)
+	return err
+}
+
+func (r *chatRepo) UpsertDeviceToken(ctx context.Context, device *biz.DeviceToken) error {
+	// A token belongs to one device, so re-registration moves it to the current user
+	// and revives it if it had been invalidated
+	query := `
+		INSERT INTO device_tokens (id, user_id, token, platform, app_version, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)
+		ON CONFLICT (token) DO UPDATE SET user_id = $2, platform = $4, app_version = NULLIF($5, ''), updated_at = $7, deleted_at = NULL
+		RETURNING id, created_at`
+
+	return r.db.QueryRowContext(ctx, query,
+		device.ID, device.UserID, device.Token, device.Platform, device.AppVersion, device.CreatedAt, device.UpdatedAt,
+	).Scan(&device.ID, &device.CreatedAt)
+}
+
+func (r *chatRepo) DeleteDeviceToken(ctx context.Context, id, userID uuid.UUID) error {
+	query := `DELETE FROM device_tokens WHERE id = $1 AND user_id = $2`
+	result, err := r.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return biz.ErrDeviceNotFound
+	}
+
+	return nil
+}
+
+func (r *chatRepo) DeleteUserDeviceToken(ctx context.Context, userID uuid.UUID, token string) error {
+	query := `DELETE FROM device_tokens WHERE token = $1 AND user_id = $2`
+	result, err := r.db.ExecContext(ctx, query, token, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return biz.ErrDeviceNotFound
+	}
+
+	return nil
+}
+
+func (r *chatRepo) InvalidateDeviceToken(ctx context.Context, token string) error {
+	query := `UPDATE device_tokens SET deleted_at = now() WHERE token = $1 AND deleted_at IS NULL`
+	_, err := r.db.ExecContext(ctx, query, token)
+	return err
+}
+
+func (r *chatRepo) GetDeviceTokens(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID][]*biz.DeviceToken, error) {
+	query := `
+		SELECT id, user_id, token, platform, COALESCE(app_version, ''), created_at, updated_at
+		FROM device_tokens
+		WHERE user_id = ANY($1) AND deleted_at IS NULL`
+
+	ids := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = id.String()
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make(map[uuid.UUID][]*biz.DeviceToken)
+	for rows.Next() {
+		device := &biz.DeviceToken{}
+		if err := rows.Scan(&device.ID, &device.UserID, &device.Token, &device.Platform, &device.AppVersion, &device.CreatedAt, &device.UpdatedAt); err != nil {
+			return nil, err
+		}
+		devices[device.UserID] = append(devices[device.UserID], device)
+	}
+
+	return devices, rows.Err()
+}
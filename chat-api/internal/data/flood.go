@@ -0,0 +1,117 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+type floodGuard struct {
+	redis *redis.Client
+}
+
+// NewFloodGuard keeps flood control counters in Redis so every chat-api replica
+// sees the same state
+func NewFloodGuard(redis *redis.Client) biz.FloodGuard {
+	return &floodGuard{redis: redis}
+}
+
+const (
+	floodDuplicatePrefix = "flood:dup:"
+	floodRatePrefix      = "flood:rate:"
+	floodSlowModePrefix  = "flood:slow:"
+	floodTurnPrefix      = "flood:turn:"
+)
+
+func (g *floodGuard) CountDuplicate(ctx context.Context, conversationID, userID uuid.UUID, contentHash string, window time.Duration) (int, time.Duration, error) {
+	key := fmt.Sprintf("%s%s:%s:%s", floodDuplicatePrefix, conversationID, userID, contentHash)
+
+	count, err := g.redis.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The window starts at the first copy; later copies don't extend it
+	if count == 1 {
+		if err := g.redis.PExpire(ctx, key, window).Err(); err != nil {
+			return 0, 0, err
+		}
+		return 1, window, nil
+	}
+
+	ttl, err := g.redis.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	// A previous expiry was lost; restart the window rather than keep the key forever
+	if ttl < 0 {
+		if err := g.redis.PExpire(ctx, key, window).Err(); err != nil {
+			return 0, 0, err
+		}
+		ttl = window
+	}
+
+	return int(count), ttl, nil
+}
+
+func (g *floodGuard) CountConversationMessage(ctx context.Context, conversationID uuid.UUID) (int, error) {
+	key := fmt.Sprintf("%s%s:%d", floodRatePrefix, conversationID, time.Now().Unix())
+
+	pipe := g.redis.TxPipeline()
+	count := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, 2*time.Second)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+
+	return int(count.Val()), nil
+}
+
+func (g *floodGuard) StartSlowMode(ctx context.Context, conversationID uuid.UUID, interval, duration time.Duration) error {
+	key := floodSlowModePrefix + conversationID.String()
+	return g.redis.Set(ctx, key, interval.Milliseconds(), duration).Err()
+}
+
+func (g *floodGuard) GetSlowMode(ctx context.Context, conversationID uuid.UUID) (time.Duration, error) {
+	value, err := g.redis.Get(ctx, floodSlowModePrefix+conversationID.String()).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func (g *floodGuard) ClaimSlowModeTurn(ctx context.Context, conversationID, userID uuid.UUID, interval time.Duration) (time.Duration, error) {
+	key := fmt.Sprintf("%s%s:%s", floodTurnPrefix, conversationID, userID)
+
+	claimed, err := g.redis.SetNX(ctx, key, 1, interval).Result()
+	if err != nil {
+		return 0, err
+	}
+	if claimed {
+		return 0, nil
+	}
+
+	wait, err := g.redis.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// The turn expired between the two calls
+	if wait <= 0 {
+		return time.Millisecond, nil
+	}
+	return wait, nil
+}
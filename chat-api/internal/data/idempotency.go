@@ -0,0 +1,72 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+// ClaimIdempotencyKey inserts the record, taking over a key whose previous record has
+// expired. When a live record holds the key it is returned and nothing is written.
+func (r *chatRepo) ClaimIdempotencyKey(ctx context.Context, record *biz.IdempotencyRecord, expiredBefore time.Time) (*biz.IdempotencyRecord, error) {
+	messageJSON, err := json.Marshal(record.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO idempotency_keys (conversation_id, idempotency_key, sender_id, message_id, message, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (conversation_id, idempotency_key) DO UPDATE
+		SET sender_id = $3, message_id = $4, message = $5, created_at = $6
+		WHERE idempotency_keys.created_at < $7`
+
+	result, err := r.db.ExecContext(ctx, query,
+		record.ConversationID, record.Key, record.SenderID, record.Message.ID, messageJSON, record.CreatedAt, expiredBefore)
+	if err != nil {
+		return nil, err
+	}
+	if claimed, err := result.RowsAffected(); err != nil || claimed > 0 {
+		return nil, err
+	}
+
+	existing := &biz.IdempotencyRecord{ConversationID: record.ConversationID, Key: record.Key}
+	err = r.db.QueryRowContext(ctx, `
+		SELECT sender_id, message, created_at
+		FROM idempotency_keys
+		WHERE conversation_id = $1 AND idempotency_key = $2`,
+		record.ConversationID, record.Key).Scan(&existing.SenderID, &messageJSON, &existing.CreatedAt)
+	if err == sql.ErrNoRows {
+		// Released by a concurrent send whose publish failed; a retry will claim it
+		return nil, biz.ErrIdempotencyKeyInUse
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	existing.Message = &biz.Message{}
+	if err := json.Unmarshal(messageJSON, existing.Message); err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+func (r *chatRepo) ReleaseIdempotencyKey(ctx context.Context, conversationID uuid.UUID, key string) error {
+	query := `DELETE FROM idempotency_keys WHERE conversation_id = $1 AND idempotency_key = $2`
+	_, err := r.db.ExecContext(ctx, query, conversationID, key)
+	return err
+}
+
+func (r *chatRepo) DeleteExpiredIdempotencyKeys(ctx context.Context, before time.Time) (int, error) {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
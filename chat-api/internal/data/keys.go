@@ -0,0 +1,166 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+// UpsertUserKeys replaces the user's identity and signed prekey and adds new one-time
+// prekeys in one transaction. Prekeys belonging to a previous identity key are dropped.
+func (r *chatRepo) UpsertUserKeys(ctx context.Context, keys *biz.UserKeys, oneTimePreKeys []biz.PreKey) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previousIdentity sql.NullString
+	err = tx.QueryRowContext(ctx, `SELECT identity_key FROM user_keys WHERE user_id = $1 FOR UPDATE`, keys.UserID).
+		Scan(&previousIdentity)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if previousIdentity.Valid && previousIdentity.String != keys.IdentityKey {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM user_prekeys WHERE user_id = $1`, keys.UserID); err != nil {
+			return err
+		}
+	}
+
+	query := `
+		INSERT INTO user_keys (user_id, identity_key, signed_prekey_id, signed_prekey, signed_prekey_signature, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id) DO UPDATE
+		SET identity_key = $2, signed_prekey_id = $3, signed_prekey = $4, signed_prekey_signature = $5, updated_at = $6`
+
+	_, err = tx.ExecContext(ctx, query,
+		keys.UserID, keys.IdentityKey, keys.SignedPreKey.KeyID, keys.SignedPreKey.PublicKey,
+		keys.SignedPreKey.Signature, keys.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	for _, preKey := range oneTimePreKeys {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO user_prekeys (user_id, key_id, public_key)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, key_id) DO NOTHING`,
+			keys.UserID, preKey.KeyID, preKey.PublicKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ClaimKeyBundle returns the user's keys and removes one one-time prekey, if any are
+// left, so no two sessions are started with the same prekey
+func (r *chatRepo) ClaimKeyBundle(ctx context.Context, userID uuid.UUID) (*biz.KeyBundle, error) {
+	bundle := &biz.KeyBundle{}
+
+	query := `
+		SELECT user_id, identity_key, signed_prekey_id, signed_prekey, signed_prekey_signature, updated_at
+		FROM user_keys WHERE user_id = $1`
+
+	err := r.db.QueryRowContext(ctx, query, userID).Scan(
+		&bundle.UserID, &bundle.IdentityKey, &bundle.SignedPreKey.KeyID, &bundle.SignedPreKey.PublicKey,
+		&bundle.SignedPreKey.Signature, &bundle.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, biz.ErrKeysNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claimQuery := `
+		DELETE FROM user_prekeys
+		WHERE id = (
+			SELECT id FROM user_prekeys WHERE user_id = $1
+			ORDER BY key_id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING key_id, public_key`
+
+	preKey := &biz.PreKey{}
+	err = r.db.QueryRowContext(ctx, claimQuery, userID).Scan(&preKey.KeyID, &preKey.PublicKey)
+	if err == nil {
+		bundle.OneTimePreKey = preKey
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+// GetConversationKeys lists every current participant with the keys they have
+// published, or as missing if they haven't
+func (r *chatRepo) GetConversationKeys(ctx context.Context, conversationID uuid.UUID) (*biz.ConversationKeySet, error) {
+	query := `
+		SELECT cp.user_id, k.identity_key, k.signed_prekey_id, k.signed_prekey, k.signed_prekey_signature, k.updated_at
+		FROM conversation_participants cp
+		LEFT JOIN user_keys k ON k.user_id = cp.user_id
+		WHERE cp.conversation_id = $1
+		ORDER BY cp.joined_at, cp.user_id`
+
+	rows, err := r.db.QueryContext(ctx, query, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	set := &biz.ConversationKeySet{Keys: []*biz.UserKeys{}, Missing: []uuid.UUID{}}
+	for rows.Next() {
+		var (
+			userID      uuid.UUID
+			identityKey sql.NullString
+			preKeyID    sql.NullInt64
+			preKey      sql.NullString
+			signature   sql.NullString
+			updatedAt   sql.NullTime
+		)
+		if err := rows.Scan(&userID, &identityKey, &preKeyID, &preKey, &signature, &updatedAt); err != nil {
+			return nil, err
+		}
+		if !identityKey.Valid {
+			set.Missing = append(set.Missing, userID)
+			continue
+		}
+		keys := &biz.UserKeys{UserID: userID, IdentityKey: identityKey.String, UpdatedAt: updatedAt.Time}
+		keys.SignedPreKey.KeyID = int(preKeyID.Int64)
+		keys.SignedPreKey.PublicKey = preKey.String
+		keys.SignedPreKey.Signature = signature.String
+		set.Keys = append(set.Keys, keys)
+	}
+
+	return set, rows.Err()
+}
+
+func (r *chatRepo) GetEncryptedConversationIDs(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, error) {
+	query := `
+		SELECT c.id
+		FROM conversations c
+		INNER JOIN conversation_participants cp ON cp.conversation_id = c.id
+		WHERE cp.user_id = $1 AND c.is_encrypted = true`
+
+	rows, err := r.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
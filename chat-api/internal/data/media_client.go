@@ -0,0 +1,65 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+type mediaClient struct {
+	baseURL        string
+	internalSecret string
+	httpClient     *http.Client
+}
+
+// NewMediaClient creates a client for media-service's internal HTTP API
+func NewMediaClient(baseURL, internalSecret string) biz.AttachmentChecker {
+	return &mediaClient{
+		baseURL:        baseURL,
+		internalSecret: internalSecret,
+		httpClient:     &http.Client{Timeout: 3 * time.Second},
+	}
+}
+
+func (c *mediaClient) GetAttachmentStatuses(ctx context.Context, orgID, senderID uuid.UUID, attachmentIDs []uuid.UUID) (map[uuid.UUID]string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"organization_id": orgID,
+		"sender_id":       senderID,
+		"attachment_ids":  attachmentIDs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/internal/attachments/status", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Internal-Secret", c.internalSecret)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("media service returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Statuses map[uuid.UUID]string `json:"statuses"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Statuses, nil
+}
@@ -0,0 +1,63 @@
+package data
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+// GetUserMentions lists mentions of the user in conversations they are still part of.
+// Read state comes from the participant's last_read_at rather than a per-mention flag.
+func (r *chatRepo) GetUserMentions(ctx context.Context, userID uuid.UUID, unreadOnly bool, limit, offset int) ([]*biz.Mention, error) {
+	query := `
+		SELECT m.id, m.conversation_id, COALESCE(c.title, ''), m.sender_id, COALESCE(u.display_name, ''),
+		       m.content_type, m.content, m.sent_at,
+		       (cp.last_read_at IS NOT NULL AND cp.last_read_at >= m.sent_at) AS is_read
+		FROM message_mentions mm
+		INNER JOIN messages m ON m.id = mm.message_id
+		INNER JOIN conversations c ON c.id = mm.conversation_id
+		INNER JOIN conversation_participants cp ON cp.conversation_id = mm.conversation_id AND cp.user_id = mm.user_id
+		LEFT JOIN users u ON u.id = m.sender_id
+		WHERE mm.user_id = $1 AND m.deleted = false
+		  AND (NOT $2 OR cp.last_read_at IS NULL OR cp.last_read_at < m.sent_at)
+		ORDER BY mm.created_at DESC
+		LIMIT $3 OFFSET $4`
+
+	rows, err := r.db.QueryContext(ctx, query, userID, unreadOnly, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mentions []*biz.Mention
+	for rows.Next() {
+		mention := &biz.Mention{}
+		err := rows.Scan(
+			&mention.MessageID, &mention.ConversationID, &mention.ConversationTitle,
+			&mention.SenderID, &mention.SenderName, &mention.ContentType, &mention.Preview,
+			&mention.SentAt, &mention.IsRead)
+		if err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+
+	return mentions, rows.Err()
+}
+
+// CountUserMentions counts the mentions GetUserMentions would list without paging
+func (r *chatRepo) CountUserMentions(ctx context.Context, userID uuid.UUID, unreadOnly bool) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM message_mentions mm
+		INNER JOIN messages m ON m.id = mm.message_id
+		INNER JOIN conversation_participants cp ON cp.conversation_id = mm.conversation_id AND cp.user_id = mm.user_id
+		WHERE mm.user_id = $1 AND m.deleted = false
+		  AND (NOT $2 OR cp.last_read_at IS NULL OR cp.last_read_at < m.sent_at)`
+
+	var count int
+	err := r.db.QueryRowContext(ctx, query, userID, unreadOnly).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,104 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+const messageReportColumns = `
+	mr.id, mr.organization_id, mr.message_id, mr.conversation_id, c.type, COALESCE(c.title, ''),
+	mr.reporter_id, mr.sender_id, mr.reason, COALESCE(mr.note, ''), mr.content_type, mr.content_snapshot,
+	mr.status, COALESCE(mr.action, ''), mr.resolved_by, mr.resolved_at, mr.created_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMessageReport(row rowScanner) (*biz.MessageReport, error) {
+	report := &biz.MessageReport{}
+	err := row.Scan(
+		&report.ID, &report.OrganizationID, &report.MessageID, &report.ConversationID,
+		&report.ConversationType, &report.ConversationTitle,
+		&report.ReporterID, &report.SenderID, &report.Reason, &report.Note,
+		&report.ContentType, &report.ContentSnapshot,
+		&report.Status, &report.Action, &report.ResolvedBy, &report.ResolvedAt, &report.CreatedAt)
+	return report, err
+}
+
+// CreateMessageReport stores a report, or returns the reporter's existing report on the message
+func (r *chatRepo) CreateMessageReport(ctx context.Context, report *biz.MessageReport) (*biz.MessageReport, error) {
+	query := `
+		INSERT INTO message_reports (id, organization_id, message_id, conversation_id, reporter_id, sender_id,
+		                             reason, note, content_type, content_snapshot, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, $10, $11, $12)
+		ON CONFLICT (message_id, reporter_id) DO NOTHING`
+
+	_, err := r.db.ExecContext(ctx, query,
+		report.ID, report.OrganizationID, report.MessageID, report.ConversationID, report.ReporterID, report.SenderID,
+		report.Reason, report.Note, report.ContentType, report.ContentSnapshot, report.Status, report.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	row := r.db.QueryRowContext(ctx, `
+		SELECT `+messageReportColumns+`
+		FROM message_reports mr
+		INNER JOIN conversations c ON c.id = mr.conversation_id
+		WHERE mr.message_id = $1 AND mr.reporter_id = $2`, report.MessageID, report.ReporterID)
+	return scanMessageReport(row)
+}
+
+func (r *chatRepo) GetMessageReport(ctx context.Context, id uuid.UUID) (*biz.MessageReport, error) {
+	row := r.db.QueryRowContext(ctx, `
+		SELECT `+messageReportColumns+`
+		FROM message_reports mr
+		INNER JOIN conversations c ON c.id = mr.conversation_id
+		WHERE mr.id = $1`, id)
+
+	report, err := scanMessageReport(row)
+	if err == sql.ErrNoRows {
+		return nil, biz.ErrReportNotFound
+	}
+	return report, err
+}
+
+func (r *chatRepo) GetMessageReports(ctx context.Context, orgID uuid.UUID, status biz.ReportStatus) ([]*biz.MessageReport, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+messageReportColumns+`
+		FROM message_reports mr
+		INNER JOIN conversations c ON c.id = mr.conversation_id
+		WHERE mr.organization_id = $1 AND mr.status = $2
+		ORDER BY mr.created_at ASC`, orgID, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []*biz.MessageReport
+	for rows.Next() {
+		report, err := scanMessageReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, rows.Err()
+}
+
+// ResolveMessageReports closes every open report on the message with the same action
+func (r *chatRepo) ResolveMessageReports(ctx context.Context, messageID uuid.UUID, action biz.ReportAction, resolvedBy uuid.UUID, resolvedAt time.Time) error {
+	query := `
+		UPDATE message_reports
+		SET status = $2, action = $3, resolved_by = $4, resolved_at = $5
+		WHERE message_id = $1 AND status = $6`
+
+	_, err := r.db.ExecContext(ctx, query,
+		messageID, biz.ReportStatusResolved, action, resolvedBy, resolvedAt, biz.ReportStatusOpen)
+	return err
+}
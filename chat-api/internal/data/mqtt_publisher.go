@@ -42,20 +42,15 @@ func NewMQTTPublisher(config MQTTConfig) (biz.MQTTPublisher, error) {
 }
 
 func (p *mqttPublisher) PublishMessage(ctx context.Context, conversationID uuid.UUID, message *biz.Message) error {
-	topic := fmt.Sprintf("chat/%s/messages", conversationID.String())
-	
-	payload, err := json.Marshal(message)
+	event, err := messageEvent(conversationID, message)
 	if err != nil {
 		return err
 	}
-
-	token := p.client.Publish(topic, 1, false, payload)
-	token.Wait()
-	return token.Error()
+	return p.Publish(ctx, event.Topic, event.QoS, event.Payload)
 }
 
 func (p *mqttPublisher) PublishTypingIndicator(ctx context.Context, conversationID, userID uuid.UUID, isTyping bool) error {
-	topic := fmt.Sprintf("chat/%s/typing", conversationID.String())
+	topic := fmt.Sprintf("chat/%s/typing/%s", conversationID.String(), userID.String())
 	
 	indicator := map[string]interface{}{
 		"user_id":   userID.String(),
@@ -68,7 +63,167 @@ func (p *mqttPublisher) PublishTypingIndicator(ctx context.Context, conversation
 		return err
 	}
 
-	token := p.client.Publish(topic, 0, false, payload)
+	return p.Publish(ctx, topic, 0, payload)
+}
+
+// PublishParticipantsAdded announces a batch of new members as a single event
+func (p *mqttPublisher) PublishParticipantsAdded(ctx context.Context, conversationID, addedBy uuid.UUID, userIDs []uuid.UUID) error {
+	event, err := participantsAddedEvent(conversationID, addedBy, userIDs)
+	if err != nil {
+		return err
+	}
+	return p.Publish(ctx, event.Topic, event.QoS, event.Payload)
+}
+
+// PublishConversationUpdated announces changed conversation settings
+func (p *mqttPublisher) PublishConversationUpdated(ctx context.Context, conversation *biz.Conversation, updatedBy uuid.UUID) error {
+	event, err := conversationUpdatedEvent(conversation, updatedBy)
+	if err != nil {
+		return err
+	}
+	return p.Publish(ctx, event.Topic, event.QoS, event.Payload)
+}
+
+// PublishKeyRotation asks participants of an encrypted conversation to refetch keys
+func (p *mqttPublisher) PublishKeyRotation(ctx context.Context, conversationID uuid.UUID, reason biz.KeyRotationReason, userIDs []uuid.UUID) error {
+	event, err := keyRotationEvent(conversationID, reason, userIDs)
+	if err != nil {
+		return err
+	}
+	return p.Publish(ctx, event.Topic, event.QoS, event.Payload)
+}
+
+// PublishReadReceipts tells the conversation which messages a participant just read
+func (p *mqttPublisher) PublishReadReceipts(ctx context.Context, conversationID, userID uuid.UUID, messageIDs []uuid.UUID, readAt time.Time) error {
+	event, err := readReceiptsEvent(conversationID, userID, messageIDs, readAt)
+	if err != nil {
+		return err
+	}
+	return p.Publish(ctx, event.Topic, event.QoS, event.Payload)
+}
+
+func (p *mqttPublisher) Publish(ctx context.Context, topic string, qos byte, payload []byte) error {
+	token := p.client.Publish(topic, qos, false, payload)
 	token.Wait()
 	return token.Error()
 }
+
+// Close gives outstanding publishes up to a second to be acknowledged
+func (p *mqttPublisher) Close() {
+	p.client.Disconnect(1000)
+}
+
+// The event builders below are shared by the direct publisher and the outbox, so a
+// message looks the same on the wire whichever path it took. Events are ordered per
+// conversation.
+
+func messageEvent(conversationID uuid.UUID, message *biz.Message) (*biz.OutboxEvent, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	// System messages have a topic of their own that only the services can publish to,
+	// so message-service can tell them apart from clients posting content_type system
+	topic := fmt.Sprintf("chat/%s/messages", conversationID.String())
+	if message.IsSystemMessage() {
+		topic = fmt.Sprintf("chat/%s/system", conversationID.String())
+	}
+
+	return &biz.OutboxEvent{
+		Topic:       topic,
+		QoS:         1,
+		Payload:     payload,
+		OrderingKey: conversationID.String(),
+	}, nil
+}
+
+func participantsAddedEvent(conversationID, addedBy uuid.UUID, userIDs []uuid.UUID) (*biz.OutboxEvent, error) {
+	event := map[string]interface{}{
+		"type":            "participants-added",
+		"conversation_id": conversationID.String(),
+		"added_by":        addedBy.String(),
+		"user_ids":        userIDs,
+		"timestamp":       time.Now(),
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return &biz.OutboxEvent{
+		Topic:       fmt.Sprintf("chat/%s/participants", conversationID.String()),
+		QoS:         1,
+		Payload:     payload,
+		OrderingKey: conversationID.String(),
+	}, nil
+}
+
+func conversationUpdatedEvent(conversation *biz.Conversation, updatedBy uuid.UUID) (*biz.OutboxEvent, error) {
+	event := map[string]interface{}{
+		"type":            "conversation-updated",
+		"conversation_id": conversation.ID.String(),
+		"updated_by":      updatedBy.String(),
+		"conversation":    conversation,
+		"timestamp":       time.Now(),
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return &biz.OutboxEvent{
+		Topic:       fmt.Sprintf("chat/%s/updated", conversation.ID.String()),
+		QoS:         1,
+		Payload:     payload,
+		OrderingKey: conversation.ID.String(),
+	}, nil
+}
+
+func keyRotationEvent(conversationID uuid.UUID, reason biz.KeyRotationReason, userIDs []uuid.UUID) (*biz.OutboxEvent, error) {
+	event := map[string]interface{}{
+		"type":            "key-rotation",
+		"conversation_id": conversationID.String(),
+		"reason":          reason,
+		"user_ids":        userIDs,
+		"timestamp":       time.Now(),
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return &biz.OutboxEvent{
+		Topic:       fmt.Sprintf("chat/%s/keys", conversationID.String()),
+		QoS:         1,
+		Payload:     payload,
+		OrderingKey: conversationID.String(),
+	}, nil
+}
+
+// readReceiptsEvent shares chat/{id}/receipts with message-service's per-message
+// receipt events, whose type is "delivered" or "read", so it has a type of its own
+func readReceiptsEvent(conversationID, userID uuid.UUID, messageIDs []uuid.UUID, readAt time.Time) (*biz.OutboxEvent, error) {
+	event := map[string]interface{}{
+		"type":            "conversation-read",
+		"conversation_id": conversationID.String(),
+		"user_id":         userID.String(),
+		"message_ids":     messageIDs,
+		"read_at":         readAt,
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return &biz.OutboxEvent{
+		Topic:       fmt.Sprintf("chat/%s/receipts", conversationID.String()),
+		QoS:         1,
+		Payload:     payload,
+		OrderingKey: conversationID.String(),
+	}, nil
+}
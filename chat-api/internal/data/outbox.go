@@ -0,0 +1,165 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+func (r *chatRepo) EnqueueOutboxEvent(ctx context.Context, event *biz.OutboxEvent) error {
+	query := `
+		INSERT INTO mqtt_outbox (topic, qos, payload, ordering_key, status, next_attempt_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)
+		RETURNING id`
+
+	return r.db.QueryRowContext(ctx, query,
+		event.Topic, int(event.QoS), event.Payload, event.OrderingKey, biz.OutboxStatusPending, time.Now(),
+	).Scan(&event.ID)
+}
+
+// ProcessOutboxBatch only claims the head of each ordering key, so while an event is
+// locked by one instance or waiting on a retry nothing after it in the same
+// conversation can be published ahead of it
+func (r *chatRepo) ProcessOutboxBatch(ctx context.Context, limit int, handle func(ctx context.Context, event *biz.OutboxEvent)) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT o.id, o.topic, o.qos, o.payload, o.ordering_key, o.status, o.attempts, o.next_attempt_at,
+		       COALESCE(o.last_error, ''), o.created_at
+		FROM mqtt_outbox o
+		WHERE o.status = 'pending' AND o.next_attempt_at <= NOW()
+		  AND NOT EXISTS (
+		      SELECT 1 FROM mqtt_outbox p
+		      WHERE p.ordering_key = o.ordering_key AND p.status = 'pending' AND p.id < o.id
+		  )
+		ORDER BY o.id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`
+
+	rows, err := tx.QueryContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	var events []*biz.OutboxEvent
+	for rows.Next() {
+		event := &biz.OutboxEvent{}
+		var qos int
+		err := rows.Scan(&event.ID, &event.Topic, &qos, &event.Payload, &event.OrderingKey, &event.Status,
+			&event.Attempts, &event.NextAttemptAt, &event.LastError, &event.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		event.QoS = byte(qos)
+		events = append(events, event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, event := range events {
+		handle(ctx, event)
+
+		_, err := tx.ExecContext(ctx, `
+			UPDATE mqtt_outbox
+			SET status = $2, attempts = $3, next_attempt_at = $4, last_error = NULLIF($5, ''),
+			    sent_at = CASE WHEN $2 = 'sent' THEN NOW() ELSE NULL END
+			WHERE id = $1`,
+			event.ID, event.Status, event.Attempts, event.NextAttemptAt, event.LastError)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(events), tx.Commit()
+}
+
+func (r *chatRepo) CountOutboxEvents(ctx context.Context) (int, int, error) {
+	var pending, dead int
+	query := `
+		SELECT COUNT(*) FILTER (WHERE status = 'pending'), COUNT(*) FILTER (WHERE status = 'dead')
+		FROM mqtt_outbox
+		WHERE status <> 'sent'`
+
+	err := r.db.QueryRowContext(ctx, query).Scan(&pending, &dead)
+	return pending, dead, err
+}
+
+func (r *chatRepo) DeleteSentOutboxEvents(ctx context.Context, before time.Time) error {
+	query := `DELETE FROM mqtt_outbox WHERE status = 'sent' AND sent_at < $1`
+	_, err := r.db.ExecContext(ctx, query, before)
+	return err
+}
+
+type outboxPublisher struct {
+	repo   biz.OutboxRepo
+	direct biz.MQTTPublisher
+}
+
+// NewOutboxPublisher returns a publisher that stores durable events (messages, membership
+// changes) in the outbox for the dispatcher to send.
+// Typing indicators are ephemeral and still go straight to the broker.
+func NewOutboxPublisher(repo biz.OutboxRepo, direct biz.MQTTPublisher) biz.MQTTPublisher {
+	return &outboxPublisher{repo: repo, direct: direct}
+}
+
+func (p *outboxPublisher) PublishMessage(ctx context.Context, conversationID uuid.UUID, message *biz.Message) error {
+	event, err := messageEvent(conversationID, message)
+	if err != nil {
+		return err
+	}
+	return p.repo.EnqueueOutboxEvent(ctx, event)
+}
+
+func (p *outboxPublisher) PublishTypingIndicator(ctx context.Context, conversationID, userID uuid.UUID, isTyping bool) error {
+	return p.direct.PublishTypingIndicator(ctx, conversationID, userID, isTyping)
+}
+
+func (p *outboxPublisher) PublishParticipantsAdded(ctx context.Context, conversationID, addedBy uuid.UUID, userIDs []uuid.UUID) error {
+	event, err := participantsAddedEvent(conversationID, addedBy, userIDs)
+	if err != nil {
+		return err
+	}
+	return p.repo.EnqueueOutboxEvent(ctx, event)
+}
+
+func (p *outboxPublisher) PublishConversationUpdated(ctx context.Context, conversation *biz.Conversation, updatedBy uuid.UUID) error {
+	event, err := conversationUpdatedEvent(conversation, updatedBy)
+	if err != nil {
+		return err
+	}
+	return p.repo.EnqueueOutboxEvent(ctx, event)
+}
+
+func (p *outboxPublisher) PublishReadReceipts(ctx context.Context, conversationID, userID uuid.UUID, messageIDs []uuid.UUID, readAt time.Time) error {
+	event, err := readReceiptsEvent(conversationID, userID, messageIDs, readAt)
+	if err != nil {
+		return err
+	}
+	return p.repo.EnqueueOutboxEvent(ctx, event)
+}
+
+func (p *outboxPublisher) PublishKeyRotation(ctx context.Context, conversationID uuid.UUID, reason biz.KeyRotationReason, userIDs []uuid.UUID) error {
+	event, err := keyRotationEvent(conversationID, reason, userIDs)
+	if err != nil {
+		return err
+	}
+	return p.repo.EnqueueOutboxEvent(ctx, event)
+}
+
+func (p *outboxPublisher) Publish(ctx context.Context, topic string, qos byte, payload []byte) error {
+	return p.direct.Publish(ctx, topic, qos, payload)
+}
+
+// Close does nothing: the direct publisher is shared with the outbox dispatcher, so
+// it is closed by its owner once the dispatcher has stopped
+func (p *outboxPublisher) Close() {}
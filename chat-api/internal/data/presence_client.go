@@ -0,0 +1,103 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+type presenceClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewPresenceClient creates a client for the presence-service HTTP API
+func NewPresenceClient(baseURL string) biz.PresenceChecker {
+	return &presenceClient{
+		baseURL:    baseURL,
+		httpClient: &http.Client{Timeout: 3 * time.Second},
+	}
+}
+
+func (c *presenceClient) GetPresence(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]string, error) {
+	statuses := make(map[uuid.UUID]string, len(userIDs))
+
+	// The bulk endpoint accepts at most 100 users per call
+	const batchSize = 100
+	for start := 0; start < len(userIDs); start += batchSize {
+		end := start + batchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+
+		ids := make([]string, 0, end-start)
+		for _, id := range userIDs[start:end] {
+			ids = append(ids, id.String())
+		}
+
+		body, err := json.Marshal(map[string]interface{}{"user_ids": ids})
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/api/v1/presence/bulk", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var result map[string]struct {
+			Status string `json:"status"`
+		}
+		err = func() error {
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("presence service returned status %d", resp.StatusCode)
+			}
+			return json.NewDecoder(resp.Body).Decode(&result)
+		}()
+		if err != nil {
+			return nil, err
+		}
+
+		for idStr, presence := range result {
+			if id, err := uuid.Parse(idStr); err == nil {
+				statuses[id] = presence.Status
+			}
+		}
+	}
+
+	return statuses, nil
+}
+
+// RecordActivity tells the presence service the user is active; it debounces on its side
+func (c *presenceClient) RecordActivity(ctx context.Context, userID uuid.UUID) error {
+	url := fmt.Sprintf("%s/api/v1/presence/%s/activity", c.baseURL, userID.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("presence service returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+const (
+	maxPreviewRedirects   = 3
+	maxPreviewTitle       = 300
+	maxPreviewDescription = 500
+)
+
+// errBlockedAddress is returned by the dialer for addresses previews may not reach
+var errBlockedAddress = errors.New("address is not publicly routable")
+
+// blockedNetworks are ranges that aren't covered by net.IP's own classification
+// but must not be reachable from unfurling either
+var blockedNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // "this" network
+		"100.64.0.0/10", // carrier-grade NAT
+		"192.0.0.0/24",  // IETF protocol assignments
+		"198.18.0.0/15", // benchmarking
+		"64:ff9b::/96",  // NAT64, which can map onto private IPv4 addresses
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+type previewFetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+// NewPreviewFetcher creates a fetcher for link previews. It only connects to public
+// addresses: the check runs on the resolved IP at dial time, so hostnames that resolve
+// to internal addresses and redirects to them are refused too. At most maxBytes of
+// each page are read.
+func NewPreviewFetcher(timeout time.Duration, maxBytes int64) biz.PreviewFetcher {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errBlockedAddress
+			}
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		// Never go through an environment proxy, which would do its own resolving
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          20,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &previewFetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxPreviewRedirects {
+					return biz.ErrPreviewUnavailable
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return biz.ErrPreviewUnavailable
+				}
+				return nil
+			},
+		},
+		maxBytes: maxBytes,
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *previewFetcher) FetchPreview(ctx context.Context, rawURL string) (*biz.LinkPreview, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, biz.ErrPreviewUnavailable
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "OrbitMessengerBot/1.0 (link preview)")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// Blocked addresses, refused redirects, DNS failures and the like
+		return nil, biz.ErrPreviewUnavailable
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, biz.ErrPreviewUnavailable
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, biz.ErrPreviewUnavailable
+	}
+
+	preview, err := parsePreview(io.LimitReader(resp.Body, f.maxBytes), resp.Request.URL)
+	if err != nil {
+		return nil, err
+	}
+	// Previews point at the requested URL, not wherever it redirected to
+	preview.URL = rawURL
+	return preview, nil
+}
+
+// parsePreview reads Open Graph and Twitter card tags from the document head, falling
+// back to <title> and the description meta tag
+func parsePreview(body io.Reader, pageURL *url.URL) (*biz.LinkPreview, error) {
+	tags := make(map[string]string)
+	var title string
+	inTitle := false
+
+	tokenizer := html.NewTokenizer(body)
+parse:
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			// EOF, the size limit, or markup too broken to continue with
+			break parse
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch string(name) {
+			case "body":
+				break parse
+			case "title":
+				inTitle = true
+			case "meta":
+				if !hasAttr {
+					continue
+				}
+				var key, content string
+				for {
+					attr, value, more := tokenizer.TagAttr()
+					switch strings.ToLower(string(attr)) {
+					case "property", "name":
+						key = strings.ToLower(string(value))
+					case "content":
+						content = string(value)
+					}
+					if !more {
+						break
+					}
+				}
+				if key != "" && content != "" {
+					if _, seen := tags[key]; !seen {
+						tags[key] = content
+					}
+				}
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "head":
+				break parse
+			case "title":
+				inTitle = false
+			}
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = string(tokenizer.Text())
+			}
+		}
+	}
+
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if value := strings.TrimSpace(tags[key]); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	preview := &biz.LinkPreview{
+		Title:       truncateRunes(first("og:title", "twitter:title"), maxPreviewTitle),
+		Description: truncateRunes(first("og:description", "twitter:description", "description"), maxPreviewDescription),
+		SiteName:    truncateRunes(first("og:site_name"), maxPreviewTitle),
+	}
+	if preview.Title == "" {
+		preview.Title = truncateRunes(strings.TrimSpace(title), maxPreviewTitle)
+	}
+	if image := first("og:image", "og:image:url", "twitter:image", "twitter:image:src"); image != "" {
+		if resolved, err := pageURL.Parse(image); err == nil && (resolved.Scheme == "http" || resolved.Scheme == "https") {
+			preview.Image = resolved.String()
+		}
+	}
+
+	if preview.Title == "" && preview.Description == "" && preview.Image == "" {
+		return nil, biz.ErrPreviewUnavailable
+	}
+	return preview, nil
+}
+
+func truncateRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:max-1]) + "…"
+}
@@ -0,0 +1,91 @@
+package data
+
+import (
+	"context"
+	"log"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+type PushConfig struct {
+	Provider     string `yaml:"provider"` // fcm, apns, all or none
+	FCMServerKey string `yaml:"fcm_server_key"`
+	APNsKeyID    string `yaml:"apns_key_id"`
+	APNsTeamID   string `yaml:"apns_team_id"`
+	APNsBundleID string `yaml:"apns_bundle_id"`
+}
+
+// pushRouter sends each notification through the provider for the device's platform
+type pushRouter struct {
+	fcm  biz.PushProvider
+	apns biz.PushProvider
+}
+
+// NewPushProvider returns a provider that routes Android and web devices to FCM
+// and iOS devices to APNs. Provider selects which of them are enabled; "none" or an
+// unknown value disables push, and providers without credentials stay disabled.
+func NewPushProvider(config PushConfig) biz.PushProvider {
+	router := &pushRouter{
+		fcm:  &noopPushProvider{},
+		apns: &noopPushProvider{},
+	}
+	var useFCM, useAPNs bool
+	switch config.Provider {
+	case "fcm":
+		useFCM = true
+	case "apns":
+		useAPNs = true
+	case "all":
+		useFCM, useAPNs = true, true
+	case "none", "":
+	default:
+		log.Printf("Unknown push provider %q, push notifications are disabled", config.Provider)
+	}
+	if useFCM && config.FCMServerKey != "" {
+		router.fcm = &fcmPushProvider{serverKey: config.FCMServerKey}
+	}
+	if useAPNs && config.APNsKeyID != "" {
+		router.apns = &apnsPushProvider{keyID: config.APNsKeyID, teamID: config.APNsTeamID, bundleID: config.APNsBundleID}
+	}
+	return router
+}
+
+func (r *pushRouter) Send(ctx context.Context, device *biz.DeviceToken, notification *biz.PushNotification) error {
+	if device.Platform == biz.DevicePlatformIOS {
+		return r.apns.Send(ctx, device, notification)
+	}
+	return r.fcm.Send(ctx, device, notification)
+}
+
+// fcmPushProvider is a stub for Firebase Cloud Messaging
+type fcmPushProvider struct {
+	serverKey string
+}
+
+func (p *fcmPushProvider) Send(ctx context.Context, device *biz.DeviceToken, notification *biz.PushNotification) error {
+	// TODO: Call the FCM HTTP v1 API and map UNREGISTERED/INVALID_ARGUMENT to biz.ErrInvalidPushToken
+	log.Printf("[fcm] push to device %s of %s for message %s in conversation %s",
+		device.ID, notification.RecipientID, notification.MessageID, notification.ConversationID)
+	return nil
+}
+
+// apnsPushProvider is a stub for Apple Push Notification service
+type apnsPushProvider struct {
+	keyID    string
+	teamID   string
+	bundleID string
+}
+
+func (p *apnsPushProvider) Send(ctx context.Context, device *biz.DeviceToken, notification *biz.PushNotification) error {
+	// TODO: Call APNs over HTTP/2 and map BadDeviceToken/Unregistered to biz.ErrInvalidPushToken
+	log.Printf("[apns] push to device %s of %s for message %s in conversation %s",
+		device.ID, notification.RecipientID, notification.MessageID, notification.ConversationID)
+	return nil
+}
+
+// noopPushProvider drops notifications when a provider isn't configured
+type noopPushProvider struct{}
+
+func (p *noopPushProvider) Send(ctx context.Context, device *biz.DeviceToken, notification *biz.PushNotification) error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package data
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+// PurgeExpiredMessages deletes one batch of messages older than their conversation's
+// retention, falling back to the organization's settings->retention_days. Rows are
+// claimed with SKIP LOCKED so concurrent purgers split the work. Attachments are
+// detached and marked expired rather than deleted, leaving media-service to remove
+// the stored objects.
+func (r *chatRepo) PurgeExpiredMessages(ctx context.Context, limit int, exemptPinned bool) ([]*biz.RetentionPurge, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT m.id, c.organization_id
+		FROM messages m
+		JOIN conversations c ON c.id = m.conversation_id
+		JOIN organizations o ON o.id = c.organization_id
+		CROSS JOIN LATERAL (
+			SELECT COALESCE(c.retention_days,
+				CASE WHEN jsonb_typeof(o.settings->'retention_days') = 'number'
+				     THEN (o.settings->>'retention_days')::numeric::int END) AS days
+		) retention
+		WHERE retention.days > 0
+		  AND m.sent_at < now() - make_interval(days => retention.days)
+		  AND (NOT $2 OR m.pinned_at IS NULL)
+		ORDER BY m.sent_at
+		LIMIT $1
+		FOR UPDATE OF m SKIP LOCKED`
+
+	rows, err := tx.QueryContext(ctx, query, limit, exemptPinned)
+	if err != nil {
+		return nil, err
+	}
+
+	var messageIDs []string
+	orgOf := make(map[uuid.UUID]uuid.UUID)
+	for rows.Next() {
+		var messageID, orgID uuid.UUID
+		if err := rows.Scan(&messageID, &orgID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messageIDs = append(messageIDs, messageID.String())
+		orgOf[messageID] = orgID
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+
+	purges := make(map[uuid.UUID]*biz.RetentionPurge)
+	purgeFor := func(messageID uuid.UUID) *biz.RetentionPurge {
+		orgID := orgOf[messageID]
+		purge, ok := purges[orgID]
+		if !ok {
+			purge = &biz.RetentionPurge{OrganizationID: orgID}
+			purges[orgID] = purge
+		}
+		return purge
+	}
+
+	// Receipts and attachments would go with the messages anyway, but deleting them
+	// explicitly gives the counts for the audit record
+	countByMessage := func(query string, count func(*biz.RetentionPurge)) error {
+		rows, err := tx.QueryContext(ctx, query, pq.Array(messageIDs))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var messageID uuid.UUID
+			if err := rows.Scan(&messageID); err != nil {
+				return err
+			}
+			count(purgeFor(messageID))
+		}
+		return rows.Err()
+	}
+
+	err = countByMessage(`DELETE FROM message_receipts WHERE message_id = ANY($1) RETURNING message_id`,
+		func(p *biz.RetentionPurge) { p.Receipts++ })
+	if err != nil {
+		return nil, err
+	}
+
+	err = countByMessage(`
+		UPDATE attachments a
+		SET message_id = NULL, status = 'expired', updated_at = now()
+		FROM unnest($1::uuid[]) AS expired(id)
+		WHERE a.message_id = expired.id
+		RETURNING expired.id`,
+		func(p *biz.RetentionPurge) { p.Attachments++ })
+	if err != nil {
+		return nil, err
+	}
+
+	err = countByMessage(`DELETE FROM messages WHERE id = ANY($1) RETURNING id`,
+		func(p *biz.RetentionPurge) { p.Messages++ })
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	result := make([]*biz.RetentionPurge, 0, len(purges))
+	for _, purge := range purges {
+		result = append(result, purge)
+	}
+	return result, nil
+}
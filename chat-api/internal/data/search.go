@@ -0,0 +1,295 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/config"
+)
+
+// searchIndex talks to OpenSearch over its REST API
+type searchIndex struct {
+	endpoint           string
+	username           string
+	password           string
+	conversationsIndex string
+	usersIndex         string
+	httpClient         *http.Client
+}
+
+// NewSearchIndex creates an OpenSearch-backed index. Index names are prefixed so
+// several environments can share a cluster.
+func NewSearchIndex(cfg config.OpenSearch, prefix string) biz.SearchIndex {
+	return &searchIndex{
+		endpoint:           strings.TrimRight(cfg.Endpoints[0], "/"),
+		username:           cfg.Username,
+		password:           cfg.Password,
+		conversationsIndex: prefix + "-conversations",
+		usersIndex:         prefix + "-users",
+		httpClient:         &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (s *searchIndex) EnsureIndices(ctx context.Context) error {
+	mappings := map[string]map[string]interface{}{
+		s.conversationsIndex: {
+			"properties": map[string]interface{}{
+				"organization_id":   map[string]string{"type": "keyword"},
+				"type":              map[string]string{"type": "keyword"},
+				"title":             map[string]string{"type": "text"},
+				"participant_ids":   map[string]string{"type": "keyword"},
+				"participant_names": map[string]string{"type": "text"},
+				"updated_at":        map[string]string{"type": "date"},
+			},
+		},
+		s.usersIndex: {
+			"properties": map[string]interface{}{
+				"organization_id": map[string]string{"type": "keyword"},
+				"display_name":    map[string]string{"type": "text"},
+				"email":           map[string]string{"type": "text", "analyzer": "simple"},
+			},
+		},
+	}
+
+	for index, mapping := range mappings {
+		resp, err := s.do(ctx, http.MethodHead, "/"+index, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			continue
+		}
+
+		if err := s.send(ctx, http.MethodPut, "/"+index, map[string]interface{}{"mappings": mapping}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *searchIndex) IndexConversation(ctx context.Context, doc *biz.ConversationDocument) error {
+	return s.send(ctx, http.MethodPut, fmt.Sprintf("/%s/_doc/%s", s.conversationsIndex, doc.ID), doc)
+}
+
+func (s *searchIndex) DeleteConversation(ctx context.Context, id uuid.UUID) error {
+	resp, err := s.do(ctx, http.MethodDelete, fmt.Sprintf("/%s/_doc/%s", s.conversationsIndex, id), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Deleting a document that was never indexed is fine
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("opensearch returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *searchIndex) IndexUsers(ctx context.Context, docs []*biz.UserDocument) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, doc := range docs {
+		action := map[string]interface{}{"index": map[string]string{"_index": s.usersIndex, "_id": doc.ID.String()}}
+		if err := encoder.Encode(action); err != nil {
+			return err
+		}
+		if err := encoder.Encode(doc); err != nil {
+			return err
+		}
+	}
+
+	resp, err := s.doRaw(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Errors bool `json:"errors"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("opensearch returned status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if result.Errors {
+		return fmt.Errorf("opensearch rejected some user documents")
+	}
+	return nil
+}
+
+func (s *searchIndex) Search(ctx context.Context, orgID, userID uuid.UUID, query string, limit int) (*biz.DiscoverResult, error) {
+	result := &biz.DiscoverResult{
+		Conversations: []*biz.DiscoverConversation{},
+		Users:         []*biz.DiscoverUser{},
+	}
+
+	conversationQuery := map[string]interface{}{
+		"size": limit,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": map[string]interface{}{
+					"multi_match": map[string]interface{}{
+						"query":     query,
+						"fields":    []string{"title^3", "participant_names"},
+						"fuzziness": "AUTO",
+					},
+				},
+				"filter": []interface{}{
+					map[string]interface{}{"term": map[string]string{"organization_id": orgID.String()}},
+					map[string]interface{}{"term": map[string]string{"participant_ids": userID.String()}},
+				},
+			},
+		},
+	}
+
+	var conversationHits searchResponse[biz.ConversationDocument]
+	if err := s.search(ctx, s.conversationsIndex, conversationQuery, &conversationHits); err != nil {
+		return nil, err
+	}
+	for _, hit := range conversationHits.Hits.Hits {
+		result.Conversations = append(result.Conversations, &biz.DiscoverConversation{
+			ID:               hit.Source.ID,
+			Type:             hit.Source.Type,
+			Title:            hit.Source.Title,
+			ParticipantNames: hit.Source.ParticipantNames,
+			Score:            hit.Score,
+		})
+	}
+
+	userQuery := map[string]interface{}{
+		"size": limit,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": map[string]interface{}{
+					"multi_match": map[string]interface{}{
+						"query":     query,
+						"fields":    []string{"display_name^2", "email"},
+						"fuzziness": "AUTO",
+					},
+				},
+				"filter": map[string]interface{}{
+					"term": map[string]string{"organization_id": orgID.String()},
+				},
+			},
+		},
+	}
+
+	var userHits searchResponse[biz.UserDocument]
+	if err := s.search(ctx, s.usersIndex, userQuery, &userHits); err != nil {
+		return nil, err
+	}
+	for _, hit := range userHits.Hits.Hits {
+		result.Users = append(result.Users, &biz.DiscoverUser{
+			ID:          hit.Source.ID,
+			DisplayName: hit.Source.DisplayName,
+			Email:       hit.Source.Email,
+			Score:       hit.Score,
+		})
+	}
+
+	return result, nil
+}
+
+type searchResponse[T any] struct {
+	Hits struct {
+		Hits []struct {
+			Score  float64 `json:"_score"`
+			Source T       `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+func (s *searchIndex) search(ctx context.Context, index string, query interface{}, out interface{}) error {
+	body, err := json.Marshal(query)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.doRaw(ctx, http.MethodPost, "/"+index+"/_search", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("opensearch returned status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send issues a request with a JSON body and only checks the status
+func (s *searchIndex) send(ctx context.Context, method, path string, payload interface{}) error {
+	resp, err := s.do(ctx, method, path, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("opensearch returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *searchIndex) do(ctx context.Context, method, path string, payload interface{}) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	return s.doRaw(ctx, method, path, "application/json", body)
+}
+
+func (s *searchIndex) doRaw(ctx context.Context, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	return s.httpClient.Do(req)
+}
+
+func (r *chatRepo) ListUsersForIndex(ctx context.Context, afterID uuid.UUID, limit int) ([]*biz.UserDocument, error) {
+	query := `
+		SELECT id, organization_id, display_name, email
+		FROM users
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2`
+
+	rows, err := r.db.QueryContext(ctx, query, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*biz.UserDocument
+	for rows.Next() {
+		user := &biz.UserDocument{}
+		if err := rows.Scan(&user.ID, &user.OrganizationID, &user.DisplayName, &user.Email); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
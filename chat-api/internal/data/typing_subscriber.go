@@ -0,0 +1,69 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+// enrichedTypingTopic matches the typing events message-service republishes with
+// display names
+const enrichedTypingTopic = "chat/+/typing/enriched"
+
+type typingSubscriber struct {
+	config MQTTConfig
+	client mqtt.Client
+}
+
+// NewTypingSubscriber creates the broker subscription behind the typing relay. Every
+// replica needs all events, so each connects with its own client ID rather than
+// sharing a subscription.
+func NewTypingSubscriber(config MQTTConfig) biz.TypingSource {
+	return &typingSubscriber{config: config}
+}
+
+func (s *typingSubscriber) SubscribeTyping(handle func(event *biz.TypingEvent)) error {
+	onMessage := func(client mqtt.Client, msg mqtt.Message) {
+		var event biz.TypingEvent
+		if err := json.Unmarshal(msg.Payload(), &event); err != nil || event.ConversationID == uuid.Nil {
+			log.Printf("Ignoring malformed typing event on %s", msg.Topic())
+			return
+		}
+		handle(&event)
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(s.config.BrokerURL)
+	opts.SetClientID("chat-api-typing-" + uuid.NewString()[:8])
+	opts.SetUsername(s.config.Username)
+	opts.SetPassword(s.config.Password)
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	// A clean session forgets subscriptions, so subscribe again on every (re)connect
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		if token := client.Subscribe(enrichedTypingTopic, 0, onMessage); token.Wait() && token.Error() != nil {
+			log.Printf("Failed to subscribe to %s: %v", enrichedTypingTopic, token.Error())
+		}
+	})
+
+	s.client = mqtt.NewClient(opts)
+	if token := s.client.Connect(); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("failed to connect to MQTT broker: %v", token.Error())
+	}
+	return nil
+}
+
+// Close disconnects from the broker
+func (s *typingSubscriber) Close() {
+	if s.client != nil {
+		s.client.Disconnect(250)
+	}
+}
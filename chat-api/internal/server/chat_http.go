@@ -2,26 +2,54 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/audit"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/buildinfo"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/mqttacl"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/pagination"
 )
 
 type ChatHTTPServer struct {
-	chatUc *biz.ChatUsecase
-	router *mux.Router
+	chatUc         *biz.ChatUsecase
+	outbox         *biz.OutboxDispatcher
+	retention      *biz.RetentionPurger
+	typing         *biz.TypingRelay
+	info           *buildinfo.Info
+	router         *mux.Router
+	internalRouter *mux.Router
+	brokerSecret   string
+	internalSecret string
 }
 
-func NewChatHTTPServer(chatUc *biz.ChatUsecase) *ChatHTTPServer {
+// NewChatHTTPServer creates the HTTP server. brokerSecret must be sent by the MQTT
+// broker in X-Broker-Secret when calling the ACL endpoint, and internalSecret by other
+// services in X-Internal-Secret on the internal routes; while either is empty, its
+// routes deny every request.
+// retention may be nil when purging is disabled, typing when the typing stream is.
+func NewChatHTTPServer(chatUc *biz.ChatUsecase, outbox *biz.OutboxDispatcher, retention *biz.RetentionPurger, typing *biz.TypingRelay, info *buildinfo.Info, brokerSecret, internalSecret string) *ChatHTTPServer {
 	s := &ChatHTTPServer{
-		chatUc: chatUc,
-		router: mux.NewRouter(),
+		chatUc:         chatUc,
+		outbox:         outbox,
+		retention:      retention,
+		typing:         typing,
+		info:           info,
+		router:         mux.NewRouter(),
+		internalRouter: mux.NewRouter(),
+		brokerSecret:   brokerSecret,
+		internalSecret: internalSecret,
 	}
 	s.setupRoutes()
 	return s
@@ -29,237 +57,1355 @@ func NewChatHTTPServer(chatUc *biz.ChatUsecase) *ChatHTTPServer {
 
 func (s *ChatHTTPServer) setupRoutes() {
 	api := s.router.PathPrefix("/api/v1").Subrouter()
+	api.Use(s.validatePathIDs)
 
 	// Conversations
 	api.HandleFunc("/conversations", s.authMiddleware(s.handleCreateConversation)).Methods("POST")
 	api.HandleFunc("/conversations", s.authMiddleware(s.handleGetUserConversations)).Methods("GET")
+	api.HandleFunc("/conversations/summary", s.authMiddleware(s.handleGetConversationSummaries)).Methods("GET")
+	api.HandleFunc("/conversations/search", s.authMiddleware(s.handleSearchConversations)).Methods("GET")
 	api.HandleFunc("/conversations/{conversationID}", s.authMiddleware(s.handleGetConversation)).Methods("GET")
 	api.HandleFunc("/conversations/{conversationID}", s.authMiddleware(s.handleUpdateConversation)).Methods("PUT")
+	api.HandleFunc("/conversations/{conversationID}/pin", s.authMiddleware(s.handlePinConversation)).Methods("POST")
+	api.HandleFunc("/conversations/{conversationID}/pin", s.authMiddleware(s.handleUnpinConversation)).Methods("DELETE")
 
 	// Participants
 	api.HandleFunc("/conversations/{conversationID}/participants", s.authMiddleware(s.handleGetParticipants)).Methods("GET")
 	api.HandleFunc("/conversations/{conversationID}/participants", s.authMiddleware(s.handleAddParticipant)).Methods("POST")
 	api.HandleFunc("/conversations/{conversationID}/participants/{userID}", s.authMiddleware(s.handleRemoveParticipant)).Methods("DELETE")
+	api.HandleFunc("/conversations/{conversationID}/participants/{userID}/role", s.authMiddleware(s.handleUpdateParticipantRole)).Methods("PUT")
 
 	// Messages
 	api.HandleFunc("/conversations/{conversationID}/messages", s.authMiddleware(s.handleGetMessages)).Methods("GET")
 	api.HandleFunc("/conversations/{conversationID}/messages", s.authMiddleware(s.handleSendMessage)).Methods("POST")
+	api.HandleFunc("/conversations/{conversationID}/messages/at", s.authMiddleware(s.handleGetMessageAt)).Methods("GET")
+	api.HandleFunc("/conversations/{conversationID}/messages/{messageID}", s.authMiddleware(s.handleGetMessage)).Methods("GET")
+	api.HandleFunc("/conversations/{conversationID}/messages/{messageID}/position", s.authMiddleware(s.handleGetMessagePosition)).Methods("GET")
 	api.HandleFunc("/conversations/{conversationID}/read", s.authMiddleware(s.handleMarkAsRead)).Methods("POST")
+	api.HandleFunc("/conversations/{conversationID}/messages/{messageID}/report", s.authMiddleware(s.handleReportMessage)).Methods("POST")
+	api.HandleFunc("/conversations/{conversationID}/messages/{messageID}/pin", s.authMiddleware(s.handlePinMessage)).Methods("POST")
+	api.HandleFunc("/conversations/{conversationID}/messages/{messageID}/pin", s.authMiddleware(s.handleUnpinMessage)).Methods("DELETE")
 	api.HandleFunc("/conversations/{conversationID}/typing", s.authMiddleware(s.handleTypingIndicator)).Methods("POST")
+	api.HandleFunc("/conversations/{conversationID}/typing/stream", s.authMiddleware(s.handleTypingStream)).Methods("GET")
+
+	// Link previews
+	api.HandleFunc("/unfurl", s.authMiddleware(s.handleUnfurl)).Methods("GET")
+
+	// Search across conversations, users and messages
+	api.HandleFunc("/discover", s.authMiddleware(s.handleDiscover)).Methods("GET")
+
+	// Mentions
+	api.HandleFunc("/mentions", s.authMiddleware(s.handleGetMentions)).Methods("GET")
+
+	// Notifications
+	api.HandleFunc("/conversations/{conversationID}/mute", s.authMiddleware(s.handleMuteConversation)).Methods("POST")
+	api.HandleFunc("/conversations/{conversationID}/mute", s.authMiddleware(s.handleUnmuteConversation)).Methods("DELETE")
+
+	// Push devices
+	api.HandleFunc("/devices", s.authMiddleware(s.handleRegisterDevice)).Methods("POST")
+	api.HandleFunc("/devices/{token}", s.authMiddleware(s.handleUnregisterDeviceToken)).Methods("DELETE")
+	api.HandleFunc("/notification-preferences", s.authMiddleware(s.handleGetNotificationPreferences)).Methods("GET")
+	api.HandleFunc("/notification-preferences", s.authMiddleware(s.handleUpdateNotificationPreferences)).Methods("PUT")
+
+	// End-to-end encryption keys
+	api.HandleFunc("/keys", s.authMiddleware(s.handlePublishKeys)).Methods("PUT")
+	api.HandleFunc("/users/{userID}/keys", s.authMiddleware(s.handleGetKeyBundle)).Methods("GET")
+	api.HandleFunc("/conversations/{conversationID}/keys", s.authMiddleware(s.handleGetConversationKeys)).Methods("GET")
+
+	// Blocks
+	api.HandleFunc("/blocks", s.authMiddleware(s.handleGetBlocks)).Methods("GET")
+	api.HandleFunc("/blocks/{userID}", s.authMiddleware(s.handleBlockUser)).Methods("POST")
+	api.HandleFunc("/blocks/{userID}", s.authMiddleware(s.handleUnblockUser)).Methods("DELETE")
+
+	// Org admin, bypasses membership checks and is audited
+	api.HandleFunc("/admin/conversations", s.authMiddleware(s.handleAdminListConversations)).Methods("GET")
+	api.HandleFunc("/admin/retention", s.authMiddleware(s.handleGetOrganizationRetention)).Methods("GET")
+	api.HandleFunc("/admin/retention", s.authMiddleware(s.handleSetOrganizationRetention)).Methods("PUT")
+	api.HandleFunc("/admin/limits", s.authMiddleware(s.handleGetOrganizationLimits)).Methods("GET")
+	api.HandleFunc("/admin/limits", s.authMiddleware(s.handleSetOrganizationLimits)).Methods("PUT")
+	api.HandleFunc("/admin/audit", s.authMiddleware(s.handleListAuditLog)).Methods("GET")
+
+	// Moderation (org admins)
+	api.HandleFunc("/moderation/reports", s.authMiddleware(s.handleGetModerationReports)).Methods("GET")
+	api.HandleFunc("/moderation/reports/{reportID}/resolve", s.authMiddleware(s.handleResolveReport)).Methods("POST")
+
+	// MQTT broker authorization plugin
+	api.HandleFunc("/mqtt/acl", s.handleMQTTACL).Methods("POST")
+
+	// Prometheus scrape endpoint
+	s.router.HandleFunc("/metrics", s.handleMetrics).Methods("GET")
+
+	// Build and dependency status
+	s.router.HandleFunc("/info", s.info.Handler).Methods("GET")
+
+	s.setupInternalRoutes()
+}
+
+// setupInternalRoutes registers the service-to-service routes, which are only served
+// on the internal listener and still require the internal secret
+func (s *ChatHTTPServer) setupInternalRoutes() {
+	internal := s.internalRouter.PathPrefix("/api/v1/internal").Subrouter()
+	internal.Use(s.validatePathIDs)
+
+	// Used by the message fan-out worker
+	internal.HandleFunc("/users/{userID}/push-targets", s.internalMiddleware(s.handleGetPushTargets)).Methods("GET")
+
+	// Used by presence-service to show a conversation's viewers only to its members
+	internal.HandleFunc("/conversations/{conversationID}/participants/{userID}", s.internalMiddleware(s.handleCheckParticipant)).Methods("GET")
+}
+
+// InternalHandler serves the service-to-service routes. It must only be exposed on a
+// listener other services can reach and clients can't.
+func (s *ChatHTTPServer) InternalHandler() http.Handler {
+	return s.internalRouter
+}
+
+func (s *ChatHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-User-ID, X-Organization-ID, Idempotency-Key")
+	w.Header().Set("Access-Control-Expose-Headers", "Idempotent-Replayed")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	s.router.ServeHTTP(w, r)
+}
+
+func (s *ChatHTTPServer) handleCreateConversation(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	orgID := s.getOrgIDFromContext(r.Context())
+
+	var req biz.CreateConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	conversation, err := s.chatUc.CreateConversation(r.Context(), &req, userID, orgID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusCreated, conversation)
+}
+
+func (s *ChatHTTPServer) handleGetUserConversations(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+
+	var filter biz.ConversationListFilter
+	if since := r.URL.Query().Get("updated_since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "updated_since must be an RFC 3339 timestamp")
+			return
+		}
+		filter.UpdatedSince = &t
+	}
+
+	params, ok := s.parsePagination(w, r, 50, 100)
+	if !ok {
+		return
+	}
+	// Legacy bare-array clients without a limit get the whole list, as they always have
+	if pagination.Bare(r) && r.URL.Query().Get("limit") == "" {
+		params.Limit = 0
+	}
+
+	filter.Limit = params.Fetch()
+	filter.Offset = params.Offset
+	conversations, err := s.chatUc.GetUserConversations(r.Context(), userID, filter)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	page := pagination.New(conversations, params)
+	if params.IncludeTotal {
+		total, err := s.chatUc.CountUserConversations(r.Context(), userID, filter)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		page.SetTotal(total)
+	}
+
+	s.writeJSON(w, http.StatusOK, page.Body(r))
+}
+
+// handleSearchConversations finds the caller's conversations by title or participant
+func (s *ChatHTTPServer) handleSearchConversations(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+
+	params, ok := s.parsePagination(w, r, 20, 50)
+	if !ok {
+		return
+	}
+
+	results, err := s.chatUc.SearchUserConversations(r.Context(), userID, r.URL.Query().Get("q"), params.Fetch(), params.Offset)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, pagination.New(results, params).Body(r))
+}
+
+func (s *ChatHTTPServer) handleGetConversation(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	conversation, err := s.chatUc.GetConversation(r.Context(), conversationID, userID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, conversation)
+}
+
+func (s *ChatHTTPServer) handleUpdateConversation(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req biz.UpdateConversationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	conversation, err := s.chatUc.UpdateConversation(r.Context(), conversationID, userID, &req)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, conversation)
+}
+
+func (s *ChatHTTPServer) handleGetConversationSummaries(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+
+	// How many other participants to include per conversation, 0 to skip them
+	participantLimit := 4
+	if limitStr := r.URL.Query().Get("participants"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l >= 0 && l <= 20 {
+			participantLimit = l
+		}
+	}
+
+	summaries, err := s.chatUc.GetConversationSummaries(r.Context(), userID, participantLimit)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, summaries)
+}
+
+func (s *ChatHTTPServer) handlePinConversation(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.chatUc.PinConversation(r.Context(), conversationID, userID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "pinned"})
+}
+
+func (s *ChatHTTPServer) handleUnpinConversation(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.chatUc.UnpinConversation(r.Context(), conversationID, userID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "unpinned"})
+}
+
+func (s *ChatHTTPServer) handleGetParticipants(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	params, ok := s.parsePagination(w, r, 100, 500)
+	if !ok {
+		return
+	}
+
+	participants, err := s.chatUc.GetConversationParticipants(r.Context(), conversationID, userID, biz.ParticipantListFilter{
+		Limit:  params.Fetch(),
+		Offset: params.Offset,
+	})
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	page := pagination.New(participants, params)
+	includePresence := r.URL.Query().Get("include_presence") == "true"
+	for _, include := range strings.Split(r.URL.Query().Get("include"), ",") {
+		if strings.TrimSpace(include) == "presence" {
+			includePresence = true
+		}
+	}
+	if includePresence {
+		// Only the participants on this page are looked up
+		s.chatUc.AttachParticipantPresence(r.Context(), page.Data.([]*biz.Participant))
+	}
+	if params.IncludeTotal {
+		total, err := s.chatUc.CountConversationParticipants(r.Context(), conversationID)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		page.SetTotal(total)
+	}
+
+	s.writeJSON(w, http.StatusOK, page.Body(r))
+}
+
+func (s *ChatHTTPServer) handleAddParticipant(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req biz.AddParticipantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if len(req.UserIDs) > 0 {
+		results, err := s.chatUc.AddParticipants(r.Context(), conversationID, userID, &req)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+		return
+	}
+
+	if err := s.chatUc.AddParticipant(r.Context(), conversationID, userID, &req); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "added"})
+}
+
+func (s *ChatHTTPServer) handleRemoveParticipant(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	targetUserIDStr := vars["userID"]
+	targetUserID, err := uuid.Parse(targetUserIDStr)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	if err := s.chatUc.RemoveParticipant(r.Context(), conversationID, userID, targetUserID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+}
+
+func (s *ChatHTTPServer) handleUpdateParticipantRole(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	targetUserID, err := uuid.Parse(mux.Vars(r)["userID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var req struct {
+		Role biz.ParticipantRole `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if err := s.chatUc.UpdateParticipantRole(r.Context(), conversationID, userID, targetUserID, req.Role); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "updated"})
+}
+
+func (s *ChatHTTPServer) handleGetMessages(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	params, ok := s.parsePagination(w, r, 50, 100)
+	if !ok {
+		return
+	}
+
+	var opts biz.MessageListOptions
+	opts.HideBlocked = r.URL.Query().Get("hide_blocked") == "true"
+	switch policy := biz.ReadPolicy(r.URL.Query().Get("read_policy")); policy {
+	case "":
+	case biz.ReadPolicyAll, biz.ReadPolicyAny:
+		opts.ReadPolicy = policy
+	default:
+		s.writeError(w, http.StatusBadRequest, "read_policy must be 'all' or 'any'")
+		return
+	}
+	for _, include := range strings.Split(r.URL.Query().Get("include"), ",") {
+		if strings.TrimSpace(include) == "receipts" {
+			opts.IncludeReceipts = true
+		}
+	}
+	// after_seq syncs forward from the last message a client holds, oldest first
+	if raw := r.URL.Query().Get("after_seq"); raw != "" {
+		afterSeq, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || afterSeq < 0 {
+			s.writeError(w, http.StatusBadRequest, "after_seq must be a non-negative integer")
+			return
+		}
+		opts.AfterSeq = &afterSeq
+	}
+
+	orgID := s.getOrgIDFromContext(r.Context())
+	messages, err := s.chatUc.GetConversationMessages(r.Context(), conversationID, userID, orgID, params.Fetch(), params.Offset, opts)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	// hide_blocked is applied before paging, so pages are full and the total
+	// counts only the messages that are listed
+	page := pagination.New(messages, params)
+	if params.IncludeTotal {
+		total, err := s.chatUc.CountConversationMessages(r.Context(), conversationID, userID, orgID, opts)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		page.SetTotal(total)
+	}
+
+	s.writeJSON(w, http.StatusOK, page.Body(r))
+}
+
+// handleGetMessageAt jumps to a date: it returns the first message at or after
+// ?timestamp= (RFC 3339) and a cursor for the message list page starting there
+func (s *ChatHTTPServer) handleGetMessageAt(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	orgID := s.getOrgIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("timestamp"))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "timestamp must be an RFC 3339 time")
+		return
+	}
+
+	message, position, err := s.chatUc.GetMessageAt(r.Context(), conversationID, userID, orgID, at)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	// Past the last message there's nothing to jump to; the newest page is the closest
+	response := map[string]interface{}{
+		"message":     message,
+		"newer_count": 0,
+		"cursor":      pagination.CursorAt(0),
+	}
+	if position != nil {
+		response["newer_count"] = position.Newer
+		response["cursor"] = pagination.CursorAt(position.Newer)
+	}
+	s.writeJSON(w, http.StatusOK, response)
+}
+
+func (s *ChatHTTPServer) handleGetMessagePosition(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	orgID := s.getOrgIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	messageID, err := uuid.Parse(mux.Vars(r)["messageID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	position, err := s.chatUc.GetMessagePosition(r.Context(), conversationID, messageID, userID, orgID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message_id":  position.MessageID,
+		"newer_count": position.Newer,
+		"cursor":      pagination.CursorAt(position.Newer),
+	})
+}
+
+func (s *ChatHTTPServer) handlePinMessage(w http.ResponseWriter, r *http.Request) {
+	s.setMessagePinned(w, r, true)
+}
+
+func (s *ChatHTTPServer) handleUnpinMessage(w http.ResponseWriter, r *http.Request) {
+	s.setMessagePinned(w, r, false)
+}
+
+func (s *ChatHTTPServer) setMessagePinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	userID := s.getUserIDFromContext(r.Context())
+	orgID := s.getOrgIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	messageID, err := uuid.Parse(mux.Vars(r)["messageID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	status := "pinned"
+	if pinned {
+		err = s.chatUc.PinMessage(r.Context(), conversationID, messageID, userID, orgID)
+	} else {
+		status = "unpinned"
+		err = s.chatUc.UnpinMessage(r.Context(), conversationID, messageID, userID, orgID)
+	}
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": status})
+}
+
+func (s *ChatHTTPServer) handleGetMessage(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	orgID := s.getOrgIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	messageID, err := uuid.Parse(mux.Vars(r)["messageID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	contextSize := 0
+	if contextStr := r.URL.Query().Get("context"); contextStr != "" {
+		contextSize, err = strconv.Atoi(contextStr)
+		if err != nil || contextSize < 0 || contextSize > biz.MaxMessageContext {
+			s.writeError(w, http.StatusBadRequest, fmt.Sprintf("context must be between 0 and %d", biz.MaxMessageContext))
+			return
+		}
+	}
+
+	result, err := s.chatUc.GetMessage(r.Context(), conversationID, messageID, userID, orgID, contextSize)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, result)
+}
+
+func (s *ChatHTTPServer) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req biz.SendMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	req.ConversationID = conversationID
+	req.IdempotencyKey = r.Header.Get("Idempotency-Key")
+
+	message, replayed, err := s.chatUc.SendMessage(r.Context(), &req, userID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	// A retried request gets the original message back
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+		s.writeJSON(w, http.StatusOK, message)
+		return
+	}
+	s.writeJSON(w, http.StatusCreated, message)
+}
+
+func (s *ChatHTTPServer) handleMarkAsRead(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.chatUc.MarkAsRead(r.Context(), conversationID, userID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "marked_as_read"})
+}
+
+func (s *ChatHTTPServer) handleTypingIndicator(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		IsTyping bool `json:"is_typing"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	if err := s.chatUc.SendTypingIndicator(r.Context(), conversationID, userID, req.IsTyping); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "sent"})
+}
+
+// typingKeepAlive is how often an idle typing stream sends a comment, so proxies
+// don't close it
+const typingKeepAlive = 15 * time.Second
+
+// handleTypingStream relays a conversation's typing events as server-sent events.
+// The caller's own typing is filtered out, unlike on the raw MQTT topics.
+func (s *ChatHTTPServer) handleTypingStream(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if s.typing == nil {
+		s.writeError(w, http.StatusServiceUnavailable, "Typing stream is not enabled")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.writeError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	if _, err := s.chatUc.GetConversation(r.Context(), conversationID, userID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	events, unsubscribe := s.typing.Subscribe(conversationID, userID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(typingKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-events:
+			payload, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: typing\ndata: %s\n\n", payload)
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *ChatHTTPServer) handleGetMentions(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+
+	params, ok := s.parsePagination(w, r, 50, 100)
+	if !ok {
+		return
+	}
+
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+
+	mentions, err := s.chatUc.GetMentions(r.Context(), userID, unreadOnly, params.Fetch(), params.Offset)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	page := pagination.New(mentions, params)
+	if params.IncludeTotal {
+		total, err := s.chatUc.CountMentions(r.Context(), userID, unreadOnly)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		page.SetTotal(total)
+	}
+
+	s.writeJSON(w, http.StatusOK, page.Body(r))
+}
+
+func (s *ChatHTTPServer) handleMuteConversation(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req biz.MuteConversationRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+			return
+		}
+	}
+
+	if err := s.chatUc.MuteConversation(r.Context(), conversationID, userID, &req); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "muted"})
+}
+
+func (s *ChatHTTPServer) handleUnmuteConversation(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.chatUc.UnmuteConversation(r.Context(), conversationID, userID); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "unmuted"})
+}
+
+func (s *ChatHTTPServer) handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+
+	var req biz.RegisterDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	device, err := s.chatUc.RegisterDevice(r.Context(), userID, &req)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusCreated, device)
+}
+
+func (s *ChatHTTPServer) handleUnregisterDeviceToken(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+
+	if err := s.chatUc.UnregisterDeviceToken(r.Context(), userID, mux.Vars(r)["token"]); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+}
+
+func (s *ChatHTTPServer) handleGetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+
+	prefs, err := s.chatUc.GetNotificationPreferences(r.Context(), userID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, prefs)
+}
+
+func (s *ChatHTTPServer) handleUpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+
+	var req biz.UpdateNotificationPreferencesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	prefs, err := s.chatUc.UpdateNotificationPreferences(r.Context(), userID, &req)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, prefs)
+}
+
+// handleGetPushTargets returns the user's active device tokens after applying their
+// notification preferences. Pass mention=true when the message mentions the user.
+func (s *ChatHTTPServer) handleGetPushTargets(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(mux.Vars(r)["userID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	isMention := r.URL.Query().Get("mention") == "true"
+
+	devices, err := s.chatUc.GetPushTargets(r.Context(), userID, isMention)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{"devices": devices})
 }
 
-func (s *ChatHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// CORS headers
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-User-ID, X-Organization-ID")
+// handleCheckParticipant answers 204 if the user is currently in the conversation and
+// 403 if not
+func (s *ChatHTTPServer) handleCheckParticipant(w http.ResponseWriter, r *http.Request) {
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+	userID, err := uuid.Parse(mux.Vars(r)["userID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
+	if err := s.chatUc.CheckParticipant(r.Context(), conversationID, userID); err != nil {
+		s.handleError(w, err)
 		return
 	}
 
-	s.router.ServeHTTP(w, r)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *ChatHTTPServer) handleCreateConversation(w http.ResponseWriter, r *http.Request) {
+func (s *ChatHTTPServer) handlePublishKeys(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromContext(r.Context())
-	orgID := s.getOrgIDFromContext(r.Context())
 
-	var req biz.CreateConversationRequest
+	var req biz.PublishKeysRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
 		return
 	}
 
-	conversation, err := s.chatUc.CreateConversation(r.Context(), &req, userID, orgID)
+	if err := s.chatUc.PublishKeys(r.Context(), userID, &req); err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "updated"})
+}
+
+func (s *ChatHTTPServer) handleGetKeyBundle(w http.ResponseWriter, r *http.Request) {
+	orgID := s.getOrgIDFromContext(r.Context())
+
+	targetUserID, err := uuid.Parse(mux.Vars(r)["userID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	bundle, err := s.chatUc.GetKeyBundle(r.Context(), orgID, targetUserID)
 	if err != nil {
 		s.handleError(w, err)
 		return
 	}
 
-	s.writeJSON(w, http.StatusCreated, conversation)
+	s.writeJSON(w, http.StatusOK, bundle)
 }
 
-func (s *ChatHTTPServer) handleGetUserConversations(w http.ResponseWriter, r *http.Request) {
+func (s *ChatHTTPServer) handleGetConversationKeys(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
 
-	conversations, err := s.chatUc.GetUserConversations(r.Context(), userID)
+	keys, err := s.chatUc.GetConversationKeys(r.Context(), conversationID, userID)
 	if err != nil {
 		s.handleError(w, err)
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, conversations)
+	s.writeJSON(w, http.StatusOK, keys)
 }
 
-func (s *ChatHTTPServer) handleGetConversation(w http.ResponseWriter, r *http.Request) {
+func (s *ChatHTTPServer) handleGetBlocks(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromContext(r.Context())
-	conversationID := s.getConversationIDFromPath(r)
+	orgID := s.getOrgIDFromContext(r.Context())
 
-	conversation, err := s.chatUc.GetConversation(r.Context(), conversationID, userID)
+	blocks, err := s.chatUc.GetBlockedUsers(r.Context(), userID, orgID)
 	if err != nil {
 		s.handleError(w, err)
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, conversation)
+	s.writeJSON(w, http.StatusOK, blocks)
 }
 
-func (s *ChatHTTPServer) handleUpdateConversation(w http.ResponseWriter, r *http.Request) {
+func (s *ChatHTTPServer) handleBlockUser(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromContext(r.Context())
-	conversationID := s.getConversationIDFromPath(r)
+	orgID := s.getOrgIDFromContext(r.Context())
 
-	var req biz.UpdateConversationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+	blockedID, err := uuid.Parse(mux.Vars(r)["userID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
 		return
 	}
 
-	conversation, err := s.chatUc.UpdateConversation(r.Context(), conversationID, userID, &req)
-	if err != nil {
+	if err := s.chatUc.BlockUser(r.Context(), userID, orgID, blockedID); err != nil {
 		s.handleError(w, err)
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, conversation)
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "blocked"})
 }
 
-func (s *ChatHTTPServer) handleGetParticipants(w http.ResponseWriter, r *http.Request) {
+func (s *ChatHTTPServer) handleUnblockUser(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromContext(r.Context())
-	conversationID := s.getConversationIDFromPath(r)
+	orgID := s.getOrgIDFromContext(r.Context())
 
-	participants, err := s.chatUc.GetConversationParticipants(r.Context(), conversationID, userID)
+	blockedID, err := uuid.Parse(mux.Vars(r)["userID"])
 	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	if err := s.chatUc.UnblockUser(r.Context(), userID, orgID, blockedID); err != nil {
 		s.handleError(w, err)
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, participants)
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "unblocked"})
 }
 
-func (s *ChatHTTPServer) handleAddParticipant(w http.ResponseWriter, r *http.Request) {
+func (s *ChatHTTPServer) handleAdminListConversations(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromContext(r.Context())
-	conversationID := s.getConversationIDFromPath(r)
+	orgID := s.getOrgIDFromContext(r.Context())
+	query := r.URL.Query()
 
-	var req biz.AddParticipantRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+	params, ok := s.parsePagination(w, r, 50, 100)
+	if !ok {
 		return
 	}
 
-	if err := s.chatUc.AddParticipant(r.Context(), conversationID, userID, &req); err != nil {
+	filter := biz.AdminConversationFilter{
+		Type:   biz.ConversationType(query.Get("type")),
+		Query:  strings.TrimSpace(query.Get("q")),
+		Limit:  params.Fetch(),
+		Offset: params.Offset,
+	}
+
+	if createdAfter := query.Get("created_after"); createdAfter != "" {
+		t, err := time.Parse(time.RFC3339, createdAfter)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "created_after must be an RFC 3339 timestamp")
+			return
+		}
+		filter.CreatedAfter = &t
+	}
+
+	conversations, err := s.chatUc.ListOrganizationConversations(r.Context(), userID, orgID, filter)
+	if err != nil {
 		s.handleError(w, err)
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, map[string]string{"status": "added"})
+	page := pagination.New(conversations, params)
+	if params.IncludeTotal {
+		total, err := s.chatUc.CountOrganizationConversations(r.Context(), orgID, filter)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		page.SetTotal(total)
+	}
+
+	s.writeJSON(w, http.StatusOK, page.Body(r))
 }
 
-func (s *ChatHTTPServer) handleRemoveParticipant(w http.ResponseWriter, r *http.Request) {
+// handleListAuditLog lists the organization's audit log for compliance review,
+// filtered by actor_id, action (a trailing * matches a prefix) and since/until
+func (s *ChatHTTPServer) handleListAuditLog(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromContext(r.Context())
-	conversationID := s.getConversationIDFromPath(r)
+	orgID := s.getOrgIDFromContext(r.Context())
+	query := r.URL.Query()
 
-	vars := mux.Vars(r)
-	targetUserIDStr := vars["userID"]
-	targetUserID, err := uuid.Parse(targetUserIDStr)
-	if err != nil {
-		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
+	params, ok := s.parsePagination(w, r, 50, 200)
+	if !ok {
 		return
 	}
 
-	if err := s.chatUc.RemoveParticipant(r.Context(), conversationID, userID, targetUserID); err != nil {
+	filter := audit.Filter{
+		Action: strings.TrimSpace(query.Get("action")),
+	}
+	if actor := strings.TrimSpace(query.Get("actor_id")); actor != "" {
+		actorID, err := uuid.Parse(actor)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "actor_id must be a user ID")
+			return
+		}
+		filter.ActorID = &actorID
+	}
+	for name, bound := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, name+" must be an RFC 3339 timestamp")
+			return
+		}
+		*bound = &t
+	}
+
+	filter.Limit = params.Fetch()
+	filter.Offset = params.Offset
+	entries, err := s.chatUc.ListAuditLog(r.Context(), userID, orgID, filter)
+	if err != nil {
 		s.handleError(w, err)
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+	page := pagination.New(entries, params)
+	if params.IncludeTotal {
+		total, err := s.chatUc.CountAuditLog(r.Context(), orgID, filter)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		page.SetTotal(total)
+	}
+
+	s.writeJSON(w, http.StatusOK, page.Body(r))
 }
 
-func (s *ChatHTTPServer) handleGetMessages(w http.ResponseWriter, r *http.Request) {
+func (s *ChatHTTPServer) handleGetOrganizationRetention(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromContext(r.Context())
-	conversationID := s.getConversationIDFromPath(r)
+	orgID := s.getOrgIDFromContext(r.Context())
+
+	retention, err := s.chatUc.GetOrganizationRetention(r.Context(), userID, orgID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
 
-	// Parse pagination parameters
-	limit := 50
-	offset := 0
+	s.writeJSON(w, http.StatusOK, retention)
+}
 
-	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
-			limit = l
-		}
+func (s *ChatHTTPServer) handleSetOrganizationRetention(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	orgID := s.getOrgIDFromContext(r.Context())
+
+	var req biz.OrganizationRetention
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
 	}
 
-	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
-		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
-			offset = o
-		}
+	retention, err := s.chatUc.SetOrganizationRetention(r.Context(), userID, orgID, &req)
+	if err != nil {
+		s.handleError(w, err)
+		return
 	}
 
-	messages, err := s.chatUc.GetConversationMessages(r.Context(), conversationID, userID, limit, offset)
+	s.writeJSON(w, http.StatusOK, retention)
+}
+
+func (s *ChatHTTPServer) handleGetOrganizationLimits(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	orgID := s.getOrgIDFromContext(r.Context())
+
+	limits, err := s.chatUc.GetOrganizationLimits(r.Context(), userID, orgID)
 	if err != nil {
 		s.handleError(w, err)
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, messages)
+	s.writeJSON(w, http.StatusOK, limits)
 }
 
-func (s *ChatHTTPServer) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+func (s *ChatHTTPServer) handleSetOrganizationLimits(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromContext(r.Context())
-	conversationID := s.getConversationIDFromPath(r)
+	orgID := s.getOrgIDFromContext(r.Context())
 
-	var req biz.SendMessageRequest
+	var req biz.OrganizationLimits
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
 		return
 	}
 
-	req.ConversationID = conversationID
+	limits, err := s.chatUc.SetOrganizationLimits(r.Context(), userID, orgID, &req)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, limits)
+}
 
-	message, err := s.chatUc.SendMessage(r.Context(), &req, userID)
+func (s *ChatHTTPServer) handleReportMessage(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	conversationID, ok := s.getConversationIDFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	messageID, err := uuid.Parse(mux.Vars(r)["messageID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	var req biz.ReportMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	report, err := s.chatUc.ReportMessage(r.Context(), conversationID, messageID, userID, &req)
 	if err != nil {
 		s.handleError(w, err)
 		return
 	}
 
-	s.writeJSON(w, http.StatusCreated, message)
+	s.writeJSON(w, http.StatusCreated, report)
 }
 
-func (s *ChatHTTPServer) handleMarkAsRead(w http.ResponseWriter, r *http.Request) {
+func (s *ChatHTTPServer) handleGetModerationReports(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromContext(r.Context())
-	conversationID := s.getConversationIDFromPath(r)
+	orgID := s.getOrgIDFromContext(r.Context())
+	status := biz.ReportStatus(r.URL.Query().Get("status"))
 
-	if err := s.chatUc.MarkAsRead(r.Context(), conversationID, userID); err != nil {
+	reports, err := s.chatUc.GetModerationReports(r.Context(), userID, orgID, status)
+	if err != nil {
 		s.handleError(w, err)
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, map[string]string{"status": "marked_as_read"})
+	s.writeJSON(w, http.StatusOK, reports)
 }
 
-func (s *ChatHTTPServer) handleTypingIndicator(w http.ResponseWriter, r *http.Request) {
+func (s *ChatHTTPServer) handleResolveReport(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromContext(r.Context())
-	conversationID := s.getConversationIDFromPath(r)
+	orgID := s.getOrgIDFromContext(r.Context())
 
-	var req struct {
-		IsTyping bool `json:"is_typing"`
+	reportID, err := uuid.Parse(mux.Vars(r)["reportID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid report ID")
+		return
 	}
 
+	var req biz.ResolveReportRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
 		return
 	}
 
-	if err := s.chatUc.SendTypingIndicator(r.Context(), conversationID, userID, req.IsTyping); err != nil {
+	report, err := s.chatUc.ResolveReport(r.Context(), userID, orgID, reportID, &req)
+	if err != nil {
 		s.handleError(w, err)
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, map[string]string{"status": "sent"})
+	s.writeJSON(w, http.StatusOK, report)
+}
+
+// handleMQTTACL answers the broker's per-topic authorization check with
+// {"result": "allow"} or {"result": "deny"}
+func (s *ChatHTTPServer) handleMQTTACL(w http.ResponseWriter, r *http.Request) {
+	if s.brokerSecret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Broker-Secret")), []byte(s.brokerSecret)) != 1 {
+		s.writeError(w, http.StatusUnauthorized, "Invalid broker secret")
+		return
+	}
+
+	var req struct {
+		Username string         `json:"username"`
+		Topic    string         `json:"topic"`
+		Access   mqttacl.Access `json:"access"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+
+	result := "deny"
+	if userID, ok := mqttacl.ParseUsername(req.Username); ok {
+		allowed, err := s.chatUc.CheckTopicAccess(r.Context(), userID, req.Topic, req.Access)
+		if err != nil {
+			s.writeError(w, http.StatusInternalServerError, "Failed to check topic access")
+			return
+		}
+		if allowed {
+			result = "allow"
+		}
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"result": result})
+}
+
+func (s *ChatHTTPServer) handleDiscover(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	orgID := s.getOrgIDFromContext(r.Context())
+
+	limit := 10
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 50 {
+			limit = l
+		}
+	}
+
+	result, err := s.chatUc.Discover(r.Context(), userID, orgID, r.URL.Query().Get("q"), limit)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, result)
+}
+
+// handleUnfurl returns the link preview for ?url= on demand, e.g. while composing
+func (s *ChatHTTPServer) handleUnfurl(w http.ResponseWriter, r *http.Request) {
+	preview, err := s.chatUc.UnfurlURL(r.Context(), r.URL.Query().Get("url"))
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, preview)
+}
+
+// handleMetrics exposes outbox health and retention purge counters in the Prometheus text format
+func (s *ChatHTTPServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.outbox == nil && s.retention == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if s.retention != nil {
+		s.writeRetentionMetrics(w)
+	}
+	if s.outbox == nil {
+		return
+	}
+
+	stats, err := s.outbox.Stats(r.Context())
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, "Failed to read outbox stats")
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP chat_outbox_backlog MQTT events waiting to be published.\n")
+	fmt.Fprintf(w, "# TYPE chat_outbox_backlog gauge\nchat_outbox_backlog %d\n", stats.Backlog)
+	fmt.Fprintf(w, "# HELP chat_outbox_dead MQTT events that ran out of publish attempts.\n")
+	fmt.Fprintf(w, "# TYPE chat_outbox_dead gauge\nchat_outbox_dead %d\n", stats.Dead)
+	fmt.Fprintf(w, "# HELP chat_outbox_published_total MQTT events published by this instance.\n")
+	fmt.Fprintf(w, "# TYPE chat_outbox_published_total counter\nchat_outbox_published_total %d\n", stats.Published)
+	fmt.Fprintf(w, "# HELP chat_outbox_publish_failures_total Failed MQTT publish attempts by this instance.\n")
+	fmt.Fprintf(w, "# TYPE chat_outbox_publish_failures_total counter\nchat_outbox_publish_failures_total %d\n", stats.PublishFailures)
+}
+
+func (s *ChatHTTPServer) writeRetentionMetrics(w http.ResponseWriter) {
+	stats := s.retention.Stats()
+	fmt.Fprintf(w, "# HELP chat_retention_runs_total Retention purge runs by this instance.\n")
+	fmt.Fprintf(w, "# TYPE chat_retention_runs_total counter\nchat_retention_runs_total %d\n", stats.Runs)
+	fmt.Fprintf(w, "# HELP chat_retention_failures_total Retention purge runs that failed.\n")
+	fmt.Fprintf(w, "# TYPE chat_retention_failures_total counter\nchat_retention_failures_total %d\n", stats.Failures)
+	fmt.Fprintf(w, "# HELP chat_retention_purged_total Rows deleted by retention purges, by kind.\n")
+	fmt.Fprintf(w, "# TYPE chat_retention_purged_total counter\n")
+	fmt.Fprintf(w, "chat_retention_purged_total{kind=\"message\"} %d\n", stats.Messages)
+	fmt.Fprintf(w, "chat_retention_purged_total{kind=\"receipt\"} %d\n", stats.Receipts)
+	fmt.Fprintf(w, "chat_retention_purged_total{kind=\"attachment\"} %d\n", stats.Attachments)
 }
 
 // Helper methods
+
+// parsePagination reads the paging query parameters, answering 400 for a bad cursor
+func (s *ChatHTTPServer) parsePagination(w http.ResponseWriter, r *http.Request, defaultLimit, maxLimit int) (pagination.Params, bool) {
+	params, err := pagination.Parse(r, defaultLimit, maxLimit)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid cursor")
+		return params, false
+	}
+	return params, true
+}
+
 func (s *ChatHTTPServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// This is a simplified auth middleware
@@ -307,6 +1453,51 @@ func (s *ChatHTTPServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc
 	}
 }
 
+// internalMiddleware guards service-to-service routes with the shared internal secret
+func (s *ChatHTTPServer) internalMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.internalSecret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Internal-Secret")), []byte(s.internalSecret)) != 1 {
+			s.writeError(w, http.StatusUnauthorized, "Invalid internal secret")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// pathIDParams are the route variables that must be UUIDs, with the name used in errors
+var pathIDParams = []struct {
+	name  string
+	label string
+}{
+	{"conversationID", "conversation ID"},
+	{"userID", "user ID"},
+	{"messageID", "message ID"},
+	{"deviceID", "device ID"},
+	{"reportID", "report ID"},
+}
+
+// validatePathIDs rejects requests whose UUID path parameters don't parse, so handlers
+// never see a zero ID for a malformed path and turn it into a misleading 403 or 404.
+func (s *ChatHTTPServer) validatePathIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		for _, param := range pathIDParams {
+			value, ok := vars[param.name]
+			if !ok {
+				continue
+			}
+			if _, err := uuid.Parse(value); err != nil {
+				s.writeJSON(w, http.StatusBadRequest, map[string]string{
+					"error":     "Invalid " + param.label,
+					"parameter": param.name,
+				})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *ChatHTTPServer) getUserIDFromContext(ctx context.Context) uuid.UUID {
 	return ctx.Value("userID").(uuid.UUID)
 }
@@ -315,14 +1506,55 @@ func (s *ChatHTTPServer) getOrgIDFromContext(ctx context.Context) uuid.UUID {
 	return ctx.Value("orgID").(uuid.UUID)
 }
 
-func (s *ChatHTTPServer) getConversationIDFromPath(r *http.Request) uuid.UUID {
-	vars := mux.Vars(r)
-	conversationIDStr := vars["conversationID"]
-	conversationID, _ := uuid.Parse(conversationIDStr)
-	return conversationID
+// getConversationIDFromPath returns the conversation ID route variable. validatePathIDs
+// normally rejects malformed IDs first; if one gets through anyway it is answered with
+// 400 here and ok is false.
+func (s *ChatHTTPServer) getConversationIDFromPath(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	conversationID, err := uuid.Parse(mux.Vars(r)["conversationID"])
+	if err != nil {
+		s.writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error":     "Invalid conversation ID",
+			"parameter": "conversationID",
+		})
+		return uuid.Nil, false
+	}
+	return conversationID, true
 }
 
 func (s *ChatHTTPServer) handleError(w http.ResponseWriter, err error) {
+	var validationErr *biz.ValidationError
+	if errors.As(err, &validationErr) {
+		s.writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"error":  "Validation failed",
+			"fields": validationErr.Fields,
+		})
+		return
+	}
+
+	var notReady *biz.AttachmentsNotReadyError
+	if errors.As(err, &notReady) {
+		s.writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"error":          "Attachments are not ready; wait for them to finish uploading and scanning",
+			"attachment_ids": notReady.AttachmentIDs,
+		})
+		return
+	}
+
+	var floodErr *biz.FloodError
+	if errors.As(err, &floodErr) {
+		retryAfter := int(math.Ceil(floodErr.RetryAfter.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		s.writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"error":       "Too many messages, slow down",
+			"reason":      floodErr.Reason,
+			"retry_after": retryAfter,
+		})
+		return
+	}
+
 	switch err {
 	case biz.ErrConversationNotFound:
 		s.writeError(w, http.StatusNotFound, "Conversation not found")
@@ -336,6 +1568,42 @@ func (s *ChatHTTPServer) handleError(w http.ResponseWriter, err error) {
 		s.writeError(w, http.StatusBadRequest, "DM conversations must have exactly 2 participants")
 	case biz.ErrMessageNotFound:
 		s.writeError(w, http.StatusNotFound, "Message not found")
+	case biz.ErrGroupFull:
+		s.writeError(w, http.StatusConflict, "Group is full")
+	case biz.ErrConversationLimitReached:
+		s.writeError(w, http.StatusConflict, "Conversation creation limit reached")
+	case biz.ErrCrossOrgParticipant:
+		s.writeError(w, http.StatusBadRequest, "Participant does not belong to this organization")
+	case biz.ErrReportNotFound:
+		s.writeError(w, http.StatusNotFound, "Report not found")
+	case biz.ErrUserNotFound:
+		s.writeError(w, http.StatusNotFound, "User not found")
+	case biz.ErrKeysNotFound:
+		s.writeError(w, http.StatusNotFound, "User has not published encryption keys")
+	case biz.ErrIdempotencyKeyReused:
+		s.writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different message")
+	case biz.ErrIdempotencyKeyInUse:
+		s.writeError(w, http.StatusConflict, "A request with this Idempotency-Key is in progress")
+	case biz.ErrNotEncrypted:
+		s.writeError(w, http.StatusConflict, "Conversation is not end-to-end encrypted")
+	case biz.ErrSearchUnavailable:
+		s.writeError(w, http.StatusServiceUnavailable, "Search is not available")
+	case biz.ErrLinkPreviewsDisabled:
+		s.writeError(w, http.StatusServiceUnavailable, "Link previews are disabled")
+	case biz.ErrInvalidPreviewURL:
+		s.writeError(w, http.StatusBadRequest, "Only absolute http and https URLs can be previewed")
+	case biz.ErrPreviewUnavailable:
+		s.writeError(w, http.StatusNotFound, "No preview available for this URL")
+	case biz.ErrMessagingUnavailable:
+		s.writeError(w, http.StatusConflict, "Unable to message this user")
+	case biz.ErrPinLimitReached:
+		s.writeError(w, http.StatusConflict, "Pinned conversation limit reached")
+	case biz.ErrDeviceNotFound:
+		s.writeError(w, http.StatusNotFound, "Device not found")
+	case biz.ErrConversationLocked:
+		s.writeError(w, http.StatusLocked, "Conversation is locked")
+	case biz.ErrPostingRestricted:
+		s.writeError(w, http.StatusForbidden, "Only admins can post in this conversation")
 	default:
 		s.writeError(w, http.StatusInternalServerError, err.Error())
 	}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/chat-api/internal/biz"
+)
+
+// historyRepo serves one conversation's messages newest first, filtering blocked
+// senders the way the query does; methods the history handlers don't use are left
+// to the embedded nil interface
+type historyRepo struct {
+	biz.ChatRepo
+	conversation *biz.Conversation
+	participants map[uuid.UUID]bool
+	messages     []*biz.Message
+	// blocked maps a blocker to the senders they have blocked
+	blocked map[uuid.UUID]map[uuid.UUID]bool
+}
+
+func (r *historyRepo) GetConversation(ctx context.Context, id uuid.UUID) (*biz.Conversation, error) {
+	if id != r.conversation.ID {
+		return nil, biz.ErrConversationNotFound
+	}
+	return r.conversation, nil
+}
+
+func (r *historyRepo) GetParticipant(ctx context.Context, conversationID, userID uuid.UUID) (*biz.Participant, error) {
+	if !r.participants[userID] {
+		return nil, nil
+	}
+	return &biz.Participant{ConversationID: conversationID, UserID: userID}, nil
+}
+
+func (r *historyRepo) visible(hideBlockedBy *uuid.UUID) []*biz.Message {
+	var messages []*biz.Message
+	for _, message := range r.messages {
+		if hideBlockedBy != nil && r.blocked[*hideBlockedBy][message.SenderID] {
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func (r *historyRepo) GetConversationMessages(ctx context.Context, orgID, conversationID uuid.UUID, afterSeq *int64, hideBlockedBy *uuid.UUID, limit, offset int) ([]*biz.Message, error) {
+	messages := r.visible(hideBlockedBy)
+	if offset >= len(messages) {
+		return nil, nil
+	}
+	messages = messages[offset:]
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (r *historyRepo) CountConversationMessages(ctx context.Context, orgID, conversationID uuid.UUID, afterSeq *int64, hideBlockedBy *uuid.UUID) (int, error) {
+	return len(r.visible(hideBlockedBy)), nil
+}
+
+func TestHandleGetMessagesHideBlocked(t *testing.T) {
+	orgID := uuid.New()
+	readerID, friendID, blockedID := uuid.New(), uuid.New(), uuid.New()
+	conversation := &biz.Conversation{ID: uuid.New(), OrganizationID: orgID}
+
+	// Newest first: the newest three are from the blocked user
+	senders := []uuid.UUID{blockedID, blockedID, blockedID, friendID, friendID, friendID}
+	var messages []*biz.Message
+	for i, sender := range senders {
+		messages = append(messages, &biz.Message{ID: uuid.New(), ConversationID: conversation.ID, SenderID: sender, Seq: int64(len(senders) - i)})
+	}
+
+	repo := &historyRepo{
+		conversation: conversation,
+		participants: map[uuid.UUID]bool{readerID: true, friendID: true, blockedID: true},
+		messages:     messages,
+		blocked:      map[uuid.UUID]map[uuid.UUID]bool{readerID: {blockedID: true}},
+	}
+	s := &ChatHTTPServer{chatUc: biz.NewChatUsecase(repo, nil, nil, nil, nil, nil, nil, nil, biz.ChatConfig{})}
+
+	tests := []struct {
+		name        string
+		query       string
+		wantSenders []uuid.UUID
+		wantHasMore bool
+		wantTotal   int
+	}{
+		{"blocked senders shown by default", "limit=2&include_total=true", []uuid.UUID{blockedID, blockedID}, true, 6},
+		{"page is filled past blocked senders", "hide_blocked=true&limit=2&include_total=true", []uuid.UUID{friendID, friendID}, true, 3},
+		{"last filtered page", "hide_blocked=true&limit=3&include_total=true", []uuid.UUID{friendID, friendID, friendID}, false, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/conversations/"+conversation.ID.String()+"/messages?"+tt.query, nil)
+			r = mux.SetURLVars(r, map[string]string{"conversationID": conversation.ID.String()})
+			ctx := context.WithValue(r.Context(), "userID", readerID)
+			ctx = context.WithValue(ctx, "orgID", orgID)
+			w := httptest.NewRecorder()
+
+			s.handleGetMessages(w, r.WithContext(ctx))
+
+			if w.Code != 200 {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+			var body struct {
+				Data       []*biz.Message `json:"data"`
+				Pagination struct {
+					HasMore bool `json:"has_more"`
+					Total   *int `json:"total"`
+				} `json:"pagination"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(body.Data) != len(tt.wantSenders) {
+				t.Fatalf("got %d messages, want %d", len(body.Data), len(tt.wantSenders))
+			}
+			for i, message := range body.Data {
+				if message.SenderID != tt.wantSenders[i] {
+					t.Errorf("message %d sent by %s, want %s", i, message.SenderID, tt.wantSenders[i])
+				}
+			}
+			if body.Pagination.HasMore != tt.wantHasMore {
+				t.Errorf("got has_more %v, want %v", body.Pagination.HasMore, tt.wantHasMore)
+			}
+			if body.Pagination.Total == nil || *body.Pagination.Total != tt.wantTotal {
+				t.Errorf("got total %v, want %d", body.Pagination.Total, tt.wantTotal)
+			}
+		})
+	}
+}
+
+// mentionRepo lists a fixed set of mentions, unread first
+type mentionRepo struct {
+	biz.ChatRepo
+	mentions []*biz.Mention
+}
+
+func (r *mentionRepo) matching(unreadOnly bool) []*biz.Mention {
+	var mentions []*biz.Mention
+	for _, mention := range r.mentions {
+		if !unreadOnly || !mention.IsRead {
+			mentions = append(mentions, mention)
+		}
+	}
+	return mentions
+}
+
+func (r *mentionRepo) GetUserMentions(ctx context.Context, userID uuid.UUID, unreadOnly bool, limit, offset int) ([]*biz.Mention, error) {
+	mentions := r.matching(unreadOnly)
+	if offset >= len(mentions) {
+		return nil, nil
+	}
+	mentions = mentions[offset:]
+	if len(mentions) > limit {
+		mentions = mentions[:limit]
+	}
+	return mentions, nil
+}
+
+func (r *mentionRepo) CountUserMentions(ctx context.Context, userID uuid.UUID, unreadOnly bool) (int, error) {
+	return len(r.matching(unreadOnly)), nil
+}
+
+func TestHandleGetMentionsTotal(t *testing.T) {
+	repo := &mentionRepo{}
+	for i := 0; i < 5; i++ {
+		repo.mentions = append(repo.mentions, &biz.Mention{MessageID: uuid.New(), ContentType: "text", IsRead: i >= 2})
+	}
+	s := &ChatHTTPServer{chatUc: biz.NewChatUsecase(repo, nil, nil, nil, nil, nil, nil, nil, biz.ChatConfig{})}
+
+	tests := []struct {
+		name      string
+		query     string
+		wantCount int
+		wantTotal *int
+	}{
+		{"total of all mentions", "limit=2&include_total=true", 2, intPtr(5)},
+		{"total of unread mentions", "unread=true&limit=1&include_total=true", 1, intPtr(2)},
+		{"no total unless asked", "limit=2", 2, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/mentions?"+tt.query, nil)
+			r = r.WithContext(context.WithValue(r.Context(), "userID", uuid.New()))
+			w := httptest.NewRecorder()
+
+			s.handleGetMentions(w, r)
+
+			if w.Code != 200 {
+				t.Fatalf("got status %d: %s", w.Code, w.Body)
+			}
+			var body struct {
+				Data       []*biz.Mention `json:"data"`
+				Pagination struct {
+					Total *int `json:"total"`
+				} `json:"pagination"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(body.Data) != tt.wantCount {
+				t.Errorf("got %d mentions, want %d", len(body.Data), tt.wantCount)
+			}
+			switch {
+			case tt.wantTotal == nil && body.Pagination.Total != nil:
+				t.Errorf("got total %d, want none", *body.Pagination.Total)
+			case tt.wantTotal != nil && (body.Pagination.Total == nil || *body.Pagination.Total != *tt.wantTotal):
+				t.Errorf("got total %v, want %d", body.Pagination.Total, *tt.wantTotal)
+			}
+		})
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestValidatePathIDs(t *testing.T) {
+	s := &ChatHTTPServer{}
+	router := mux.NewRouter()
+	router.Use(s.validatePathIDs)
+	reached := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	router.HandleFunc("/conversations/{conversationID}", reached)
+	router.HandleFunc("/conversations/{conversationID}/messages/{messageID}", reached)
+
+	id := uuid.New().String()
+	tests := []struct {
+		name          string
+		path          string
+		wantStatus    int
+		wantParameter string
+	}{
+		{"valid conversation", "/conversations/" + id, http.StatusNoContent, ""},
+		{"valid conversation and message", "/conversations/" + id + "/messages/" + id, http.StatusNoContent, ""},
+		{"malformed conversation", "/conversations/not-a-uuid", http.StatusBadRequest, "conversationID"},
+		{"truncated conversation", "/conversations/" + id[:35], http.StatusBadRequest, "conversationID"},
+		{"malformed message", "/conversations/" + id + "/messages/42", http.StatusBadRequest, "messageID"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantParameter == "" {
+				return
+			}
+			var body map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body["parameter"] != tt.wantParameter {
+				t.Errorf("got parameter %q, want %q", body["parameter"], tt.wantParameter)
+			}
+		})
+	}
+}
+
+func TestGetConversationIDFromPath(t *testing.T) {
+	s := &ChatHTTPServer{}
+	id := uuid.New()
+
+	tests := []struct {
+		name   string
+		vars   map[string]string
+		wantOK bool
+	}{
+		{"valid", map[string]string{"conversationID": id.String()}, true},
+		{"malformed", map[string]string{"conversationID": "not-a-uuid"}, false},
+		{"empty", map[string]string{"conversationID": ""}, false},
+		{"missing", map[string]string{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Called directly, without validatePathIDs in front of it
+			r := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), tt.vars)
+			w := httptest.NewRecorder()
+
+			got, ok := s.getConversationIDFromPath(w, r)
+			if ok != tt.wantOK {
+				t.Fatalf("got ok %v, want %v", ok, tt.wantOK)
+			}
+			if ok && got != id {
+				t.Errorf("got %s, want %s", got, id)
+			}
+			if !ok && w.Code != http.StatusBadRequest {
+				t.Errorf("got status %d, want 400", w.Code)
+			}
+		})
+	}
+}
+
+func TestHandleCheckParticipant(t *testing.T) {
+	memberID, outsiderID := uuid.New(), uuid.New()
+	conversation := &biz.Conversation{ID: uuid.New()}
+	repo := &historyRepo{conversation: conversation, participants: map[uuid.UUID]bool{memberID: true}}
+	s := &ChatHTTPServer{chatUc: biz.NewChatUsecase(repo, nil, nil, nil, nil, nil, nil, nil, biz.ChatConfig{})}
+
+	tests := []struct {
+		name       string
+		userID     string
+		wantStatus int
+	}{
+		{"participant", memberID.String(), http.StatusNoContent},
+		{"not a participant", outsiderID.String(), http.StatusForbidden},
+		{"malformed user", "not-a-uuid", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mux.SetURLVars(httptest.NewRequest("GET", "/", nil),
+				map[string]string{"conversationID": conversation.ID.String(), "userID": tt.userID})
+			w := httptest.NewRecorder()
+
+			s.handleCheckParticipant(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// adminRepo makes adminID an admin of its one conversation; methods the rejected
+// additions don't reach are left to the embedded nil interface
+type adminRepo struct {
+	biz.ChatRepo
+	conversation *biz.Conversation
+	adminID      uuid.UUID
+}
+
+func (r *adminRepo) GetConversation(ctx context.Context, id uuid.UUID) (*biz.Conversation, error) {
+	return r.conversation, nil
+}
+
+func (r *adminRepo) GetParticipant(ctx context.Context, conversationID, userID uuid.UUID) (*biz.Participant, error) {
+	if userID != r.adminID {
+		return nil, nil
+	}
+	return &biz.Participant{ConversationID: conversationID, UserID: userID, Role: biz.ParticipantRoleAdmin}, nil
+}
+
+func TestHandleAddParticipantRejected(t *testing.T) {
+	adminID, userID := uuid.New(), uuid.New()
+
+	tests := []struct {
+		name       string
+		kind       biz.ConversationType
+		body       string
+		wantStatus int
+	}{
+		{"user added to a DM", biz.ConversationTypeDM, `{"user_id":"` + userID.String() + `"}`, http.StatusBadRequest},
+		{"users added to a DM", biz.ConversationTypeDM, `{"user_ids":["` + userID.String() + `"]}`, http.StatusBadRequest},
+		{"user added with an unknown role", biz.ConversationTypeGroup, `{"user_id":"` + userID.String() + `","role":"owner"}`, http.StatusUnprocessableEntity},
+		{"users added with an unknown role", biz.ConversationTypeGroup, `{"user_ids":["` + userID.String() + `"],"role":"owner"}`, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conversation := &biz.Conversation{ID: uuid.New(), Type: tt.kind}
+			repo := &adminRepo{conversation: conversation, adminID: adminID}
+			s := &ChatHTTPServer{chatUc: biz.NewChatUsecase(repo, nil, nil, nil, nil, nil, nil, nil, biz.ChatConfig{})}
+
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, map[string]string{"conversationID": conversation.ID.String()})
+			w := httptest.NewRecorder()
+
+			s.handleAddParticipant(w, r.WithContext(context.WithValue(r.Context(), "userID", adminID)))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
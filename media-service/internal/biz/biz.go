@@ -8,23 +8,38 @@ import (
 
 var (
 	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrMessageNotFound    = errors.New("message not found")
 	ErrFileTooLarge       = errors.New("file too large")
 	ErrInvalidFileType    = errors.New("invalid file type")
 	ErrInvalidFileStatus  = errors.New("invalid file status")
 	ErrFileNotReady       = errors.New("file not ready")
 	ErrUnauthorized       = errors.New("unauthorized")
+	ErrObjectNotFound     = errors.New("object not found in storage")
+	ErrScannerUnavailable = errors.New("antivirus scanner unavailable")
+	// ErrPosterUnavailable means the video frame extraction tool couldn't be run
+	ErrPosterUnavailable = errors.New("poster frame extraction unavailable")
+	// ErrUploadRateLimited means the user started too many uploads in a short time
+	ErrUploadRateLimited = errors.New("upload rate limit exceeded")
+	// ErrTooManyUploadsInFlight means the user has too many uploads started but not completed
+	ErrTooManyUploadsInFlight = errors.New("too many uploads in progress")
+	ErrInvalidVisibility      = errors.New("invalid visibility")
+	ErrInvalidPurpose         = errors.New("invalid upload purpose")
+	// ErrPublicNotAllowed means an attachment can't be public, e.g. because it belongs to a message
+	ErrPublicNotAllowed = errors.New("attachment can't be public")
 )
 
 // ProviderSet is biz providers.
 var ProviderSet = wire.NewSet(NewMediaUsecaseFromConfig)
 
 // NewMediaUsecaseFromConfig creates media usecase with default config
-func NewMediaUsecaseFromConfig(repo MediaRepo, storage StorageProvider, antivirus AntivirusScanner) *MediaUsecase {
+func NewMediaUsecaseFromConfig(repo MediaRepo, storage StorageProvider, antivirus AntivirusScanner, sizeLimits map[FileCategory]int64, scanRetry ScanRetryConfig, statusPublisher StatusPublisher, posters PosterExtractor, uploadLimits UploadLimitConfig) *MediaUsecase {
 	allowedTypes := []string{
 		"image/jpeg", "image/png", "image/gif", "image/webp",
+		"video/mp4", "video/quicktime", "video/webm",
+		"audio/mpeg", "audio/mp4", "audio/ogg",
 		"application/pdf", "application/msword",
 		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
 		"text/plain", "application/zip", "application/x-rar-compressed",
 	}
-	return NewMediaUsecase(repo, storage, antivirus, 100*1024*1024, allowedTypes, false) // 100MB max
+	return NewMediaUsecase(repo, storage, antivirus, 100*1024*1024, sizeLimits, allowedTypes, false, scanRetry, statusPublisher, posters, uploadLimits) // 100MB max
 }
@@ -0,0 +1,96 @@
+package biz
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FileCategory groups content types for size limits and usage reporting
+type FileCategory string
+
+const (
+	FileCategoryImage    FileCategory = "image"
+	FileCategoryVideo    FileCategory = "video"
+	FileCategoryAudio    FileCategory = "audio"
+	FileCategoryDocument FileCategory = "document"
+	FileCategoryArchive  FileCategory = "archive"
+	FileCategoryOther    FileCategory = "other"
+)
+
+const megabyte = 1024 * 1024
+
+// DefaultSizeLimits returns the per-category upload limits used when nothing is configured
+func DefaultSizeLimits() map[FileCategory]int64 {
+	return map[FileCategory]int64{
+		FileCategoryImage:    10 * megabyte,
+		FileCategoryVideo:    200 * megabyte,
+		FileCategoryAudio:    50 * megabyte,
+		FileCategoryDocument: 50 * megabyte,
+		FileCategoryArchive:  100 * megabyte,
+	}
+}
+
+// CategoryOf classifies a content type. It matches the buckets of the storage usage
+// report, so keep the two in step.
+func CategoryOf(contentType string) FileCategory {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return FileCategoryImage
+	case strings.HasPrefix(contentType, "video/"):
+		return FileCategoryVideo
+	case strings.HasPrefix(contentType, "audio/"):
+		return FileCategoryAudio
+	case contentType == "application/zip" || contentType == "application/x-rar-compressed":
+		return FileCategoryArchive
+	case strings.HasPrefix(contentType, "text/") || contentType == "application/pdf" ||
+		strings.HasPrefix(contentType, "application/msword") ||
+		strings.HasPrefix(contentType, "application/vnd.openxmlformats-officedocument."):
+		return FileCategoryDocument
+	}
+	return FileCategoryOther
+}
+
+// FileTooLargeError rejects an upload over the limit for its category. It matches
+// ErrFileTooLarge with errors.Is.
+type FileTooLargeError struct {
+	Category FileCategory
+	Limit    int64
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("%s files are limited to %s", e.Category, formatSize(e.Limit))
+}
+
+func (e *FileTooLargeError) Unwrap() error {
+	return ErrFileTooLarge
+}
+
+// sizeLimit is the largest upload allowed for the content type. Categories without
+// their own limit fall back to maxFileSize.
+func (uc *MediaUsecase) sizeLimit(contentType string) int64 {
+	if limit, ok := uc.sizeLimits[CategoryOf(contentType)]; ok && limit > 0 {
+		return limit
+	}
+	return uc.maxFileSize
+}
+
+// checkFileSize rejects a file larger than its category allows
+func (uc *MediaUsecase) checkFileSize(contentType string, size int64) error {
+	if limit := uc.sizeLimit(contentType); size > limit {
+		return &FileTooLargeError{Category: CategoryOf(contentType), Limit: limit}
+	}
+	return nil
+}
+
+// formatSize renders a byte count in the largest whole unit, e.g. "200 MB"
+func formatSize(bytes int64) string {
+	switch {
+	case bytes >= 1024*megabyte && bytes%(1024*megabyte) == 0:
+		return fmt.Sprintf("%d GB", bytes/(1024*megabyte))
+	case bytes >= megabyte && bytes%megabyte == 0:
+		return fmt.Sprintf("%d MB", bytes/megabyte)
+	case bytes >= 1024 && bytes%1024 == 0:
+		return fmt.Sprintf("%d KB", bytes/1024)
+	}
+	return fmt.Sprintf("%d bytes", bytes)
+}
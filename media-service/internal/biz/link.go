@@ -0,0 +1,128 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LinkResult sorts the attachments a message referenced by what became of them
+type LinkResult struct {
+	// Linked attachments are ready and now belong to the message
+	Linked []uuid.UUID `json:"linked"`
+	// Pending attachments belong to the message but are still uploading or scanning
+	Pending []uuid.UUID `json:"pending"`
+	// Missing attachments don't exist (yet); the caller may retry them later
+	Missing []uuid.UUID `json:"missing"`
+	// Rejected attachments belong to someone else, another message, are public, or were blocked
+	Rejected []uuid.UUID `json:"rejected"`
+}
+
+// LinkMessageAttachments associates the attachments a message references with it. It
+// is called by message-service when it stores a message whose meta lists attachments.
+// Only attachments uploaded by the sender in the message's organization are linked;
+// anything else is rejected rather than failing the whole batch. The sender and
+// organization must be those of the stored message, or ErrUnauthorized is returned.
+func (uc *MediaUsecase) LinkMessageAttachments(ctx context.Context, messageID, orgID, senderID uuid.UUID, attachmentIDs []uuid.UUID) (*LinkResult, error) {
+	storedSender, storedOrg, err := uc.repo.GetMessageSender(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if storedSender != senderID || storedOrg != orgID {
+		log.Printf("Refusing to link attachments to message %s for a sender or organization it doesn't have", messageID)
+		return nil, ErrUnauthorized
+	}
+
+	result := &LinkResult{
+		Linked:   []uuid.UUID{},
+		Pending:  []uuid.UUID{},
+		Missing:  []uuid.UUID{},
+		Rejected: []uuid.UUID{},
+	}
+
+	for _, attachmentID := range attachmentIDs {
+		attachment, err := uc.repo.GetAttachment(ctx, attachmentID)
+		if err == ErrAttachmentNotFound {
+			result.Missing = append(result.Missing, attachmentID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !canLink(attachment, messageID, orgID, senderID) {
+			log.Printf("Refusing to link attachment %s to message %s", attachmentID, messageID)
+			result.Rejected = append(result.Rejected, attachmentID)
+			continue
+		}
+
+		if attachment.MessageID == nil {
+			attachment.MessageID = &messageID
+			attachment.UpdatedAt = time.Now()
+			if err := uc.repo.UpdateAttachment(ctx, attachment); err != nil {
+				return nil, err
+			}
+		}
+
+		if attachment.Status == FileStatusReady {
+			result.Linked = append(result.Linked, attachmentID)
+		} else {
+			result.Pending = append(result.Pending, attachmentID)
+		}
+	}
+
+	return result, nil
+}
+
+// AttachmentStatuses returns the status of each attachment the sender could attach to
+// a new message: their own uploads in the organization that no message has claimed
+// yet. Attachments they can't use are left out, just like ones that don't exist.
+func (uc *MediaUsecase) AttachmentStatuses(ctx context.Context, orgID, senderID uuid.UUID, attachmentIDs []uuid.UUID) (map[uuid.UUID]FileStatus, error) {
+	statuses := make(map[uuid.UUID]FileStatus, len(attachmentIDs))
+	for _, attachmentID := range attachmentIDs {
+		attachment, err := uc.repo.GetAttachment(ctx, attachmentID)
+		if err == ErrAttachmentNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attachment.MessageID != nil || attachment.Visibility == VisibilityPublic {
+			continue
+		}
+		if attachment.OrganizationID != nil && *attachment.OrganizationID != orgID {
+			continue
+		}
+		if attachment.UploadedBy != nil && *attachment.UploadedBy != senderID {
+			continue
+		}
+		statuses[attachmentID] = attachment.Status
+	}
+	return statuses, nil
+}
+
+// canLink reports whether the attachment may be linked to the message. Attachments
+// from before organizations and uploaders were recorded are only checked for status.
+func canLink(attachment *Attachment, messageID, orgID, senderID uuid.UUID) bool {
+	switch attachment.Status {
+	case FileStatusUploading, FileStatusScanning, FileStatusReady:
+	default:
+		return false
+	}
+	if attachment.MessageID != nil && *attachment.MessageID != messageID {
+		return false
+	}
+	// Message attachments must stay private
+	if attachment.Visibility == VisibilityPublic {
+		return false
+	}
+	if attachment.OrganizationID != nil && *attachment.OrganizationID != orgID {
+		return false
+	}
+	if attachment.UploadedBy != nil && *attachment.UploadedBy != senderID {
+		return false
+	}
+	return true
+}
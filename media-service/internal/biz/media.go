@@ -2,14 +2,19 @@ package biz
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"mime"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/inflight"
 )
 
 type FileStatus string
@@ -20,8 +25,14 @@ const (
 	FileStatusReady     FileStatus = "ready"
 	FileStatusQuarantine FileStatus = "quarantine"
 	FileStatusError     FileStatus = "error"
+	// FileStatusExpired attachments lost their message to a retention purge in chat-api
+	// and are waiting for the sweeper to remove the stored object
+	FileStatusExpired FileStatus = "expired"
 )
 
+// UploadURLTTL is how long a presigned upload URL stays valid
+const UploadURLTTL = time.Hour
+
 type Attachment struct {
 	ID        uuid.UUID              `json:"id"`
 	MessageID *uuid.UUID             `json:"message_id,omitempty"`
@@ -33,6 +44,14 @@ type Attachment struct {
 	Meta      map[string]interface{} `json:"meta,omitempty"`
 	CreatedAt time.Time              `json:"created_at"`
 	UpdatedAt time.Time              `json:"updated_at"`
+
+	// OrganizationID and UploadedBy are unset on attachments from before they were recorded
+	OrganizationID *uuid.UUID `json:"organization_id,omitempty"`
+	UploadedBy     *uuid.UUID `json:"uploaded_by,omitempty"`
+
+	Visibility Visibility `json:"visibility"`
+	// PublicURL is the stable URL of a public attachment, set once it's ready
+	PublicURL string `json:"public_url,omitempty"`
 }
 
 type UploadRequest struct {
@@ -40,6 +59,9 @@ type UploadRequest struct {
 	ContentType string `json:"content_type" validate:"required"`
 	Size        int64  `json:"size" validate:"required"`
 	MessageID   *uuid.UUID `json:"message_id,omitempty"`
+	// Visibility defaults to private; only avatars and organization logos may be public
+	Visibility Visibility    `json:"visibility,omitempty"`
+	Purpose    UploadPurpose `json:"purpose,omitempty"`
 }
 
 type UploadResponse struct {
@@ -49,8 +71,9 @@ type UploadResponse struct {
 }
 
 type DownloadResponse struct {
-	DownloadURL string    `json:"download_url"`
-	ExpiresAt   time.Time `json:"expires_at"`
+	DownloadURL string `json:"download_url"`
+	// ExpiresAt is unset for public attachments, whose URL doesn't expire
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 type MediaRepo interface {
@@ -59,6 +82,21 @@ type MediaRepo interface {
 	UpdateAttachment(ctx context.Context, attachment *Attachment) error
 	DeleteAttachment(ctx context.Context, id uuid.UUID) error
 	GetAttachmentsByMessage(ctx context.Context, messageID uuid.UUID) ([]*Attachment, error)
+	GetStorageUsage(ctx context.Context, orgID uuid.UUID) ([]*CategoryUsage, error)
+	// GetUserRole returns the user's role in the organization, or ErrUnauthorized
+	// if they aren't a member of it
+	GetUserRole(ctx context.Context, userID, orgID uuid.UUID) (string, error)
+	// GetMessageSender returns who sent a stored message and the organization of its
+	// conversation, or ErrMessageNotFound
+	GetMessageSender(ctx context.Context, messageID uuid.UUID) (senderID, orgID uuid.UUID, err error)
+	// ListStaleUploads returns up to limit attachments still uploading that were created before the cutoff
+	ListStaleUploads(ctx context.Context, before time.Time, limit int) ([]*Attachment, error)
+	// ListExpiredAttachments returns up to limit attachments expired by message retention
+	ListExpiredAttachments(ctx context.Context, limit int) ([]*Attachment, error)
+	// ListScanningAttachments returns up to limit attachments left scanning that were created before the cutoff
+	ListScanningAttachments(ctx context.Context, before time.Time, limit int) ([]*Attachment, error)
+	// CountUploadsInFlight counts the user's attachments still uploading that were created after the cutoff
+	CountUploadsInFlight(ctx context.Context, userID uuid.UUID, since time.Time) (int, error)
 }
 
 type StorageProvider interface {
@@ -66,11 +104,19 @@ type StorageProvider interface {
 	GenerateDownloadURL(ctx context.Context, objectKey string, expiresIn time.Duration) (string, error)
 	UploadFile(ctx context.Context, objectKey string, reader io.Reader, contentType string) error
 	DeleteFile(ctx context.Context, objectKey string) error
+	// CopyFile copies the object at srcKey to dstKey within the bucket
+	CopyFile(ctx context.Context, srcKey, dstKey string) error
+	// GetFileInfo returns ErrObjectNotFound if nothing was uploaded to objectKey
 	GetFileInfo(ctx context.Context, objectKey string) (size int64, err error)
+	// PublicURL returns the unsigned URL of an object under PublicObjectPrefix; ok is
+	// false if the storage isn't set up to serve public objects
+	PublicURL(objectKey string) (url string, ok bool)
 }
 
 type AntivirusScanner interface {
-	ScanFile(ctx context.Context, objectKey string) (bool, error) // returns true if clean
+	// ScanFile returns true if the file is clean. Errors that may go away on retry,
+	// such as the scanner being unreachable, wrap ErrScannerUnavailable.
+	ScanFile(ctx context.Context, objectKey string) (bool, error)
 }
 
 type MediaUsecase struct {
@@ -78,39 +124,91 @@ type MediaUsecase struct {
 	storage         StorageProvider
 	antivirus       AntivirusScanner
 	maxFileSize     int64
+	sizeLimits      map[FileCategory]int64
 	allowedTypes    []string
 	antivirusEnabled bool
+
+	usageMu    sync.Mutex
+	usageCache map[uuid.UUID]*StorageUsage
+
+	// Background antivirus scans run under scanCtx and are tracked by scans so
+	// Shutdown can wait for them
+	scanCtx    context.Context
+	scanCancel context.CancelFunc
+	scans      inflight.Tracker
+	scanRetry  ScanRetryConfig
+
+	// statusPublisher tells uploaders when their attachment is ready or blocked; nil disables it
+	statusPublisher StatusPublisher
+	// posters extracts video poster frames; nil disables them
+	posters PosterExtractor
+
+	uploadLimits  UploadLimitConfig
+	uploadLimiter *uploadLimiter
 }
 
-func NewMediaUsecase(repo MediaRepo, storage StorageProvider, antivirus AntivirusScanner, maxFileSize int64, allowedTypes []string, antivirusEnabled bool) *MediaUsecase {
+// NewMediaUsecase wires the media use cases. sizeLimits caps uploads per category;
+// categories missing from it are capped at maxFileSize.
+func NewMediaUsecase(repo MediaRepo, storage StorageProvider, antivirus AntivirusScanner, maxFileSize int64, sizeLimits map[FileCategory]int64, allowedTypes []string, antivirusEnabled bool, scanRetry ScanRetryConfig, statusPublisher StatusPublisher, posters PosterExtractor, uploadLimits UploadLimitConfig) *MediaUsecase {
+	defaults := DefaultScanRetryConfig()
+	if scanRetry.MaxAttempts <= 0 {
+		scanRetry.MaxAttempts = defaults.MaxAttempts
+	}
+	if scanRetry.InitialBackoff <= 0 {
+		scanRetry.InitialBackoff = defaults.InitialBackoff
+	}
+	if scanRetry.MaxBackoff < scanRetry.InitialBackoff {
+		scanRetry.MaxBackoff = scanRetry.InitialBackoff
+	}
+
+	scanCtx, scanCancel := context.WithCancel(context.Background())
 	return &MediaUsecase{
 		repo:            repo,
 		storage:         storage,
 		antivirus:       antivirus,
 		maxFileSize:     maxFileSize,
+		sizeLimits:      sizeLimits,
 		allowedTypes:    allowedTypes,
 		antivirusEnabled: antivirusEnabled,
+		usageCache:      make(map[uuid.UUID]*StorageUsage),
+		scanCtx:         scanCtx,
+		scanCancel:      scanCancel,
+		scanRetry:       scanRetry,
+		statusPublisher: statusPublisher,
+		posters:         posters,
+		uploadLimits:    uploadLimits,
+		uploadLimiter:   newUploadLimiter(uploadLimits),
 	}
 }
 
-func (uc *MediaUsecase) InitiateUpload(ctx context.Context, req *UploadRequest, userID uuid.UUID) (*UploadResponse, error) {
-	// Validate file size
-	if req.Size > uc.maxFileSize {
-		return nil, ErrFileTooLarge
-	}
-
+func (uc *MediaUsecase) InitiateUpload(ctx context.Context, req *UploadRequest, userID, orgID uuid.UUID) (*UploadResponse, error) {
 	// Validate content type
 	if !uc.isAllowedContentType(req.ContentType) {
 		return nil, ErrInvalidFileType
 	}
 
+	// Validate file size against the limit for its category
+	if err := uc.checkFileSize(req.ContentType, req.Size); err != nil {
+		return nil, err
+	}
+
 	// Validate file extension matches content type
 	if !uc.validateFileExtension(req.FileName, req.ContentType) {
 		return nil, ErrInvalidFileType
 	}
 
-	// Generate unique object key
-	objectKey := uc.generateObjectKey(userID, req.FileName)
+	visibility, err := uc.resolveVisibility(ctx, req, userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := uc.checkUploadLimits(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	// Generate unique object key. Public uploads are staged under a private key too
+	// and only copied under PublicObjectPrefix once they have passed their checks.
+	objectKey := uc.generateObjectKey(orgID, userID, req.FileName)
 
 	// Create attachment record
 	attachment := &Attachment{
@@ -124,6 +222,10 @@ func (uc *MediaUsecase) InitiateUpload(ctx context.Context, req *UploadRequest,
 		Meta:      make(map[string]interface{}),
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
+
+		OrganizationID: &orgID,
+		UploadedBy:     &userID,
+		Visibility:     visibility,
 	}
 
 	if req.MessageID != nil {
@@ -134,8 +236,7 @@ func (uc *MediaUsecase) InitiateUpload(ctx context.Context, req *UploadRequest,
 		return nil, err
 	}
 
-	// Generate upload URL (valid for 1 hour)
-	uploadURL, err := uc.storage.GenerateUploadURL(ctx, objectKey, req.ContentType, time.Hour)
+	uploadURL, err := uc.storage.GenerateUploadURL(ctx, objectKey, req.ContentType, UploadURLTTL)
 	if err != nil {
 		return nil, err
 	}
@@ -143,7 +244,7 @@ func (uc *MediaUsecase) InitiateUpload(ctx context.Context, req *UploadRequest,
 	return &UploadResponse{
 		AttachmentID: attachment.ID,
 		UploadURL:    uploadURL,
-		ExpiresAt:    time.Now().Add(time.Hour),
+		ExpiresAt:    time.Now().Add(UploadURLTTL),
 	}, nil
 }
 
@@ -162,7 +263,9 @@ func (uc *MediaUsecase) CompleteUpload(ctx context.Context, attachmentID uuid.UU
 	if err != nil {
 		attachment.Status = FileStatusError
 		attachment.UpdatedAt = time.Now()
-		uc.repo.UpdateAttachment(ctx, attachment)
+		if uc.repo.UpdateAttachment(ctx, attachment) == nil {
+			uc.publishStatus(ctx, attachment, StatusReasonUploadFailed)
+		}
 		return err
 	}
 
@@ -171,6 +274,19 @@ func (uc *MediaUsecase) CompleteUpload(ctx context.Context, attachmentID uuid.UU
 		attachment.Size = actualSize
 	}
 
+	// The declared size was checked at initiation; the uploaded file may be bigger
+	if err := uc.checkFileSize(attachment.MimeType, actualSize); err != nil {
+		if deleteErr := uc.storage.DeleteFile(ctx, attachment.ObjectKey); deleteErr != nil {
+			log.Printf("Failed to delete oversized upload %s: %v", attachment.ID, deleteErr)
+		}
+		attachment.Status = FileStatusError
+		attachment.UpdatedAt = time.Now()
+		if uc.repo.UpdateAttachment(ctx, attachment) == nil {
+			uc.publishStatus(ctx, attachment, err.Error())
+		}
+		return err
+	}
+
 	// Start antivirus scan if enabled
 	if uc.antivirusEnabled && uc.antivirus != nil {
 		attachment.Status = FileStatusScanning
@@ -180,38 +296,34 @@ func (uc *MediaUsecase) CompleteUpload(ctx context.Context, attachmentID uuid.UU
 		}
 
 		// Perform scan asynchronously
-		go uc.performAntivirusScan(context.Background(), attachmentID)
+		uc.startAntivirusScan(attachmentID)
 	} else {
+		stagingKey, err := uc.publishPublicObject(ctx, attachment)
+		if err != nil {
+			log.Printf("Failed to publish attachment %s: %v", attachment.ID, err)
+			attachment.Status = FileStatusError
+			attachment.UpdatedAt = time.Now()
+			if uc.repo.UpdateAttachment(ctx, attachment) == nil {
+				uc.publishStatus(ctx, attachment, StatusReasonPublishFailed)
+			}
+			return err
+		}
+
 		// Mark as ready
 		attachment.Status = FileStatusReady
 		attachment.UpdatedAt = time.Now()
 		if err := uc.repo.UpdateAttachment(ctx, attachment); err != nil {
+			uc.unpublishPublicObject(ctx, attachment, stagingKey)
 			return err
 		}
+		uc.removeStagedObject(ctx, attachment, stagingKey)
+		uc.publishStatus(ctx, attachment, "")
+		uc.startVideoPoster(attachment)
 	}
 
 	return nil
 }
 
-func (uc *MediaUsecase) performAntivirusScan(ctx context.Context, attachmentID uuid.UUID) {
-	attachment, err := uc.repo.GetAttachment(ctx, attachmentID)
-	if err != nil {
-		return
-	}
-
-	isClean, err := uc.antivirus.ScanFile(ctx, attachment.ObjectKey)
-	if err != nil {
-		attachment.Status = FileStatusError
-	} else if isClean {
-		attachment.Status = FileStatusReady
-	} else {
-		attachment.Status = FileStatusQuarantine
-	}
-
-	attachment.UpdatedAt = time.Now()
-	uc.repo.UpdateAttachment(ctx, attachment)
-}
-
 func (uc *MediaUsecase) GetDownloadURL(ctx context.Context, attachmentID uuid.UUID, userID uuid.UUID) (*DownloadResponse, error) {
 	attachment, err := uc.repo.GetAttachment(ctx, attachmentID)
 	if err != nil {
@@ -224,20 +336,29 @@ func (uc *MediaUsecase) GetDownloadURL(ctx context.Context, attachmentID uuid.UU
 
 	// TODO: Add permission check - verify user has access to this attachment
 
+	if publicURL := uc.publicURL(attachment); publicURL != "" {
+		return &DownloadResponse{DownloadURL: publicURL}, nil
+	}
+
 	// Generate download URL (valid for 1 hour)
 	downloadURL, err := uc.storage.GenerateDownloadURL(ctx, attachment.ObjectKey, time.Hour)
 	if err != nil {
 		return nil, err
 	}
 
+	expiresAt := time.Now().Add(time.Hour)
 	return &DownloadResponse{
 		DownloadURL: downloadURL,
-		ExpiresAt:   time.Now().Add(time.Hour),
+		ExpiresAt:   &expiresAt,
 	}, nil
 }
 
 func (uc *MediaUsecase) GetAttachment(ctx context.Context, attachmentID uuid.UUID) (*Attachment, error) {
-	return uc.repo.GetAttachment(ctx, attachmentID)
+	attachment, err := uc.repo.GetAttachment(ctx, attachmentID)
+	if err != nil {
+		return nil, err
+	}
+	return uc.withPublicURL(attachment), nil
 }
 
 func (uc *MediaUsecase) GetMessageAttachments(ctx context.Context, messageID uuid.UUID) ([]*Attachment, error) {
@@ -253,6 +374,7 @@ func (uc *MediaUsecase) DeleteAttachment(ctx context.Context, attachmentID uuid.
 	// TODO: Add permission check - verify user owns this attachment or has admin rights
 
 	// Delete from storage
+	uc.deleteThumbnail(ctx, attachment)
 	if err := uc.storage.DeleteFile(ctx, attachment.ObjectKey); err != nil {
 		// Log error but continue with database deletion
 	}
@@ -267,6 +389,14 @@ func (uc *MediaUsecase) AssociateWithMessage(ctx context.Context, attachmentID,
 		return err
 	}
 
+	// Messages may only point at media that finished uploading and passed its scan
+	if attachment.Status != FileStatusReady {
+		return ErrFileNotReady
+	}
+	if attachment.Visibility == VisibilityPublic {
+		return ErrPublicNotAllowed
+	}
+
 	attachment.MessageID = &messageID
 	attachment.UpdatedAt = time.Now()
 
@@ -283,22 +413,43 @@ func (uc *MediaUsecase) isAllowedContentType(contentType string) bool {
 	return false
 }
 
+// mediaExtensionTypes covers audio and video extensions Go doesn't know without a system MIME table
+var mediaExtensionTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".ogg":  "audio/ogg",
+}
+
 func (uc *MediaUsecase) validateFileExtension(fileName, contentType string) bool {
 	ext := strings.ToLower(filepath.Ext(fileName))
 	expectedType := mime.TypeByExtension(ext)
+	if expectedType == "" {
+		// Slim images often ship without a system MIME table
+		expectedType = mediaExtensionTypes[ext]
+	}
 	
 	// Basic validation - in production you might want more sophisticated checks
 	return expectedType == contentType || 
 		   (strings.HasPrefix(contentType, "image/") && strings.HasPrefix(expectedType, "image/")) ||
+		   (strings.HasPrefix(contentType, "video/") && strings.HasPrefix(expectedType, "video/")) ||
+		   (strings.HasPrefix(contentType, "audio/") && strings.HasPrefix(expectedType, "audio/")) ||
 		   (strings.HasPrefix(contentType, "application/") && strings.HasPrefix(expectedType, "application/"))
 }
 
-func (uc *MediaUsecase) generateObjectKey(userID uuid.UUID, fileName string) string {
-	timestamp := time.Now().Unix()
+// generateObjectKey lays objects out as attachments/{org}/{user}/{yyyy}/{mm}/{uuid}{ext} so
+// bucket lifecycle rules and usage accounting can work per organization and month.
+// Older attachments keep their attachments/{user}/{ts}_{uuid}{ext} keys; reads always
+// go through the stored object_key so both layouts stay readable.
+func (uc *MediaUsecase) generateObjectKey(orgID, userID uuid.UUID, fileName string) string {
+	now := time.Now().UTC()
 	fileID := uuid.New().String()
 	ext := filepath.Ext(fileName)
-	
-	return fmt.Sprintf("attachments/%s/%d_%s%s", userID.String(), timestamp, fileID, ext)
+
+	return fmt.Sprintf("attachments/%s/%s/%04d/%02d/%s%s", orgID, userID, now.Year(), int(now.Month()), fileID, ext)
 }
 
 // GenerateThumbnail generates a thumbnail for image files
@@ -308,6 +459,17 @@ func (uc *MediaUsecase) GenerateThumbnail(ctx context.Context, attachmentID uuid
 		return err
 	}
 
+	// Videos get a poster frame when ffmpeg is available
+	if CategoryOf(attachment.MimeType) == FileCategoryVideo {
+		if uc.posters == nil {
+			return nil
+		}
+		if err := uc.generateVideoPoster(ctx, attachmentID); err != nil && !errors.Is(err, ErrPosterUnavailable) {
+			return err
+		}
+		return nil
+	}
+
 	// Only generate thumbnails for images
 	if !strings.HasPrefix(attachment.MimeType, "image/") {
 		return nil
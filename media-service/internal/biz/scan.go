@@ -0,0 +1,192 @@
+package biz
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ScanRetryConfig bounds retries of antivirus scans that fail because the scanner is
+// unavailable. Backoff doubles after each attempt up to MaxBackoff.
+type ScanRetryConfig struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultScanRetryConfig returns the retry settings used when nothing is configured
+func DefaultScanRetryConfig() ScanRetryConfig {
+	return ScanRetryConfig{
+		MaxAttempts:    5,
+		InitialBackoff: 2 * time.Second,
+		MaxBackoff:     time.Minute,
+	}
+}
+
+// Attachment meta keys recording how the last scan went
+const (
+	MetaKeyScanAttempts = "scan_attempts"
+	MetaKeyScanError    = "scan_error"
+)
+
+// scanRecoveryBatchSize is how many interrupted scans are fetched at a time on startup
+const scanRecoveryBatchSize = 100
+
+// startAntivirusScan scans the attachment in the background. Once shutdown has begun
+// the scan isn't started and the attachment stays scanning until the next startup
+// recovers it.
+func (uc *MediaUsecase) startAntivirusScan(attachmentID uuid.UUID) {
+	if !uc.scans.Enter() {
+		log.Printf("Shutting down, deferring antivirus scan of attachment %s", attachmentID)
+		return
+	}
+	go func() {
+		defer uc.scans.Exit()
+		uc.performAntivirusScan(uc.scanCtx, attachmentID)
+	}()
+}
+
+// RecoverScans re-scans attachments left scanning by a previous process that
+// stopped mid-scan. It works through them one at a time in the background so a
+// large backlog doesn't flood the scanner, and stops at Shutdown.
+func (uc *MediaUsecase) RecoverScans() {
+	if !uc.antivirusEnabled || uc.antivirus == nil {
+		return
+	}
+	if !uc.scans.Enter() {
+		return
+	}
+
+	// Scans started after this point belong to this process
+	cutoff := time.Now()
+	go func() {
+		defer uc.scans.Exit()
+
+		// A scan whose result couldn't be saved stays scanning; attempted stops the
+		// loop from fetching it forever
+		attempted := make(map[uuid.UUID]bool)
+		for uc.scanCtx.Err() == nil {
+			attachments, err := uc.repo.ListScanningAttachments(uc.scanCtx, cutoff, scanRecoveryBatchSize+len(attempted))
+			if err != nil {
+				if uc.scanCtx.Err() == nil {
+					log.Printf("Failed to list interrupted antivirus scans: %v", err)
+				}
+				return
+			}
+
+			progressed := false
+			for _, attachment := range attachments {
+				if attempted[attachment.ID] {
+					continue
+				}
+				attempted[attachment.ID] = true
+				progressed = true
+
+				uc.performAntivirusScan(uc.scanCtx, attachment.ID)
+				if uc.scanCtx.Err() != nil {
+					return
+				}
+			}
+			if !progressed {
+				break
+			}
+		}
+
+		if len(attempted) > 0 {
+			log.Printf("Recovered %d interrupted antivirus scans", len(attempted))
+		}
+	}()
+}
+
+// performAntivirusScan scans the attachment and records the verdict. A scanner that
+// is unavailable is retried with backoff; only when the attempts run out does the
+// attachment move to error. Any other scan error is final.
+func (uc *MediaUsecase) performAntivirusScan(ctx context.Context, attachmentID uuid.UUID) {
+	attachment, err := uc.repo.GetAttachment(ctx, attachmentID)
+	if err != nil {
+		return
+	}
+
+	var isClean bool
+	attempts := 0
+	backoff := uc.scanRetry.InitialBackoff
+	for {
+		attempts++
+		isClean, err = uc.antivirus.ScanFile(ctx, attachment.ObjectKey)
+		if ctx.Err() != nil {
+			// Interrupted by shutdown; leave it scanning so it is recovered on startup
+			return
+		}
+		if err == nil || !errors.Is(err, ErrScannerUnavailable) || attempts >= uc.scanRetry.MaxAttempts {
+			break
+		}
+
+		log.Printf("Antivirus scan of attachment %s failed (attempt %d/%d), retrying in %s: %v",
+			attachmentID, attempts, uc.scanRetry.MaxAttempts, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > uc.scanRetry.MaxBackoff {
+			backoff = uc.scanRetry.MaxBackoff
+		}
+	}
+
+	if attachment.Meta == nil {
+		attachment.Meta = make(map[string]interface{})
+	}
+	attachment.Meta[MetaKeyScanAttempts] = attempts
+	delete(attachment.Meta, MetaKeyScanError)
+
+	// The scanner's own error stays in meta for operators; the uploader only gets a safe reason
+	var reason string
+	if err != nil {
+		log.Printf("Antivirus scan of attachment %s failed after %d attempts: %v", attachmentID, attempts, err)
+		attachment.Status = FileStatusError
+		attachment.Meta[MetaKeyScanError] = err.Error()
+		reason = StatusReasonScanFailed
+	} else if isClean {
+		attachment.Status = FileStatusReady
+	} else {
+		attachment.Status = FileStatusQuarantine
+		reason = StatusReasonQuarantined
+	}
+
+	var stagingKey string
+	if attachment.Status == FileStatusReady {
+		if stagingKey, err = uc.publishPublicObject(ctx, attachment); err != nil {
+			log.Printf("Failed to publish attachment %s: %v", attachmentID, err)
+			attachment.Status = FileStatusError
+			reason = StatusReasonPublishFailed
+		}
+	}
+
+	attachment.UpdatedAt = time.Now()
+	if err := uc.repo.UpdateAttachment(ctx, attachment); err != nil {
+		log.Printf("Failed to record antivirus verdict for attachment %s: %v", attachmentID, err)
+		uc.unpublishPublicObject(ctx, attachment, stagingKey)
+		return
+	}
+	uc.removeStagedObject(ctx, attachment, stagingKey)
+	if attachment.Status == FileStatusQuarantine {
+		uc.withdrawPublicObject(ctx, attachment)
+	}
+	uc.publishStatus(ctx, attachment, reason)
+	if attachment.Status == FileStatusReady {
+		uc.startVideoPoster(attachment)
+	}
+}
+
+// Shutdown stops starting antivirus scans and waits for those in progress until ctx
+// is done, then cancels any still running. Cancelled scans stay scanning and are
+// picked up by RecoverScans on the next startup.
+func (uc *MediaUsecase) Shutdown(ctx context.Context) error {
+	err := uc.scans.Close(ctx)
+	uc.scanCancel()
+	return err
+}
@@ -0,0 +1,54 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reasons given to the uploader when an attachment doesn't become ready. They are
+// deliberately generic: scanner output such as signature names is never passed on.
+const (
+	StatusReasonQuarantined  = "File was blocked by the antivirus scan"
+	StatusReasonScanFailed   = "File could not be scanned"
+	StatusReasonUploadFailed = "Uploaded file could not be found"
+	// StatusReasonPublishFailed means a clean public upload couldn't be made public
+	StatusReasonPublishFailed = "File could not be published"
+)
+
+// AttachmentStatusEvent tells the uploader an attachment reached a final status
+type AttachmentStatusEvent struct {
+	AttachmentID uuid.UUID  `json:"attachment_id"`
+	MessageID    *uuid.UUID `json:"message_id,omitempty"`
+	Status       FileStatus `json:"status"`
+	// Reason is a safe, user-facing explanation for quarantine and error
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// StatusPublisher delivers attachment status events to the uploader's clients
+type StatusPublisher interface {
+	PublishAttachmentStatus(ctx context.Context, userID uuid.UUID, event *AttachmentStatusEvent) error
+}
+
+// publishStatus notifies the uploader that the attachment is now ready, quarantined
+// or failed. Attachments from before uploaders were recorded have nobody to tell.
+// Publishing is best effort; clients can always poll the attachment.
+func (uc *MediaUsecase) publishStatus(ctx context.Context, attachment *Attachment, reason string) {
+	if uc.statusPublisher == nil || attachment.UploadedBy == nil {
+		return
+	}
+
+	event := &AttachmentStatusEvent{
+		AttachmentID: attachment.ID,
+		MessageID:    attachment.MessageID,
+		Status:       attachment.Status,
+		Reason:       reason,
+		Timestamp:    attachment.UpdatedAt,
+	}
+	if err := uc.statusPublisher.PublishAttachmentStatus(ctx, *attachment.UploadedBy, event); err != nil {
+		log.Printf("Failed to publish status of attachment %s: %v", attachment.ID, err)
+	}
+}
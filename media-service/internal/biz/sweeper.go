@@ -0,0 +1,188 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// SweeperConfig tunes the orphaned upload sweeper
+type SweeperConfig struct {
+	Interval time.Duration
+	// Threshold is how old an upload must be before it's swept. It is never less than
+	// UploadURLTTL, since the client may still be using its upload URL until then.
+	Threshold time.Duration
+	BatchSize int
+}
+
+// DefaultSweeperConfig returns the sweeper settings used when nothing is configured
+func DefaultSweeperConfig() SweeperConfig {
+	return SweeperConfig{
+		Interval:  10 * time.Minute,
+		Threshold: UploadURLTTL + 15*time.Minute,
+		BatchSize: 100,
+	}
+}
+
+// UploadSweeper reclaims attachments whose upload was started but never completed.
+// If the object made it to storage the upload is completed on the client's behalf;
+// otherwise the attachment row is removed. It also deletes attachments expired by
+// chat-api's message retention, object and row.
+type UploadSweeper struct {
+	uc     *MediaUsecase
+	config SweeperConfig
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewUploadSweeper(uc *MediaUsecase, config SweeperConfig) *UploadSweeper {
+	defaults := DefaultSweeperConfig()
+	if config.Interval <= 0 {
+		config.Interval = defaults.Interval
+	}
+	if config.Threshold < UploadURLTTL {
+		log.Printf("Upload sweep threshold %s is shorter than the upload URL TTL, using %s", config.Threshold, UploadURLTTL)
+		config.Threshold = UploadURLTTL
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaults.BatchSize
+	}
+	return &UploadSweeper{
+		uc:     uc,
+		config: config,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start runs a sweep every interval until Stop is called
+func (s *UploadSweeper) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sweep()
+				s.sweepExpired()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop waits for a running sweep to finish
+func (s *UploadSweeper) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+func (s *UploadSweeper) sweep() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Interval)
+	defer cancel()
+
+	var completed, removed int
+	var reclaimed int64
+	defer func() {
+		if completed > 0 || removed > 0 {
+			log.Printf("Upload sweep: completed %d, removed %d, reclaimed %d bytes", completed, removed, reclaimed)
+		}
+	}()
+
+	cutoff := time.Now().Add(-s.config.Threshold)
+	for {
+		attachments, err := s.uc.repo.ListStaleUploads(ctx, cutoff, s.config.BatchSize)
+		if err != nil {
+			log.Printf("Error listing stale uploads: %v", err)
+			return
+		}
+
+		progress := false
+		for _, attachment := range attachments {
+			size, err := s.uc.storage.GetFileInfo(ctx, attachment.ObjectKey)
+			switch {
+			case err == ErrObjectNotFound:
+				// The upload never happened, so there's nothing in storage to reclaim
+				if err := s.uc.repo.DeleteAttachment(ctx, attachment.ID); err != nil {
+					log.Printf("Error removing stale upload %s: %v", attachment.ID, err)
+					continue
+				}
+				removed++
+			case err != nil:
+				log.Printf("Error checking stale upload %s: %v", attachment.ID, err)
+				continue
+			case size > s.uc.sizeLimit(attachment.MimeType):
+				// The client uploaded more than it declared and more than we allow
+				if err := s.uc.storage.DeleteFile(ctx, attachment.ObjectKey); err != nil {
+					log.Printf("Error deleting oversized upload %s: %v", attachment.ID, err)
+					continue
+				}
+				if err := s.uc.repo.DeleteAttachment(ctx, attachment.ID); err != nil {
+					log.Printf("Error removing stale upload %s: %v", attachment.ID, err)
+					continue
+				}
+				removed++
+				reclaimed += size
+			default:
+				if err := s.uc.CompleteUpload(ctx, attachment.ID); err != nil {
+					log.Printf("Error completing stale upload %s: %v", attachment.ID, err)
+					continue
+				}
+				completed++
+			}
+			progress = true
+		}
+
+		// Stop when the backlog is drained, or if nothing in the batch could be handled
+		// so the same rows aren't retried in a tight loop
+		if len(attachments) < s.config.BatchSize || !progress {
+			return
+		}
+	}
+}
+
+// sweepExpired removes attachments whose message was purged by retention
+func (s *UploadSweeper) sweepExpired() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Interval)
+	defer cancel()
+
+	var removed int
+	var reclaimed int64
+	defer func() {
+		if removed > 0 {
+			log.Printf("Expired attachment sweep: removed %d, reclaimed %d bytes", removed, reclaimed)
+		}
+	}()
+
+	for {
+		attachments, err := s.uc.repo.ListExpiredAttachments(ctx, s.config.BatchSize)
+		if err != nil {
+			log.Printf("Error listing expired attachments: %v", err)
+			return
+		}
+
+		progress := false
+		for _, attachment := range attachments {
+			s.uc.deleteThumbnail(ctx, attachment)
+			if err := s.uc.storage.DeleteFile(ctx, attachment.ObjectKey); err != nil {
+				log.Printf("Error deleting expired attachment %s: %v", attachment.ID, err)
+				continue
+			}
+			if err := s.uc.repo.DeleteAttachment(ctx, attachment.ID); err != nil {
+				log.Printf("Error removing expired attachment %s: %v", attachment.ID, err)
+				continue
+			}
+			removed++
+			reclaimed += attachment.Size
+			progress = true
+		}
+
+		if len(attachments) < s.config.BatchSize || !progress {
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package biz
+
+import (
+	"bytes"
+	"context"
+	"image"
+	_ "image/jpeg"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Attachment meta keys describing a generated thumbnail or video poster frame
+const (
+	MetaKeyThumbnailKey    = "thumbnail_key"
+	MetaKeyThumbnailWidth  = "thumbnail_width"
+	MetaKeyThumbnailHeight = "thumbnail_height"
+)
+
+// posterSourceURLTTL only needs to outlive reading the start of the video
+const posterSourceURLTTL = 10 * time.Minute
+
+// PosterExtractor pulls a still frame out of a video for previews
+type PosterExtractor interface {
+	// ExtractPoster reads the video at sourceURL and returns a JPEG frame near its
+	// start. It returns ErrPosterUnavailable if the tool can't be run.
+	ExtractPoster(ctx context.Context, sourceURL string) ([]byte, error)
+}
+
+// startVideoPoster generates the poster frame of a ready video in the background.
+// It shares the scan tracker so Shutdown waits for it too.
+func (uc *MediaUsecase) startVideoPoster(attachment *Attachment) {
+	if uc.posters == nil || CategoryOf(attachment.MimeType) != FileCategoryVideo {
+		return
+	}
+	if !uc.scans.Enter() {
+		return
+	}
+	go func() {
+		defer uc.scans.Exit()
+		if err := uc.generateVideoPoster(uc.scanCtx, attachment.ID); err != nil && uc.scanCtx.Err() == nil {
+			log.Printf("Failed to generate poster frame for attachment %s: %v", attachment.ID, err)
+		}
+	}()
+}
+
+// generateVideoPoster stores a still frame of the video next to it and records it in
+// the attachment's meta the way image thumbnails are. Without a poster the
+// attachment is still ready; clients show a generic video placeholder.
+func (uc *MediaUsecase) generateVideoPoster(ctx context.Context, attachmentID uuid.UUID) error {
+	attachment, err := uc.repo.GetAttachment(ctx, attachmentID)
+	if err != nil {
+		return err
+	}
+	if attachment.Status != FileStatusReady {
+		return ErrFileNotReady
+	}
+
+	sourceURL, err := uc.storage.GenerateDownloadURL(ctx, attachment.ObjectKey, posterSourceURLTTL)
+	if err != nil {
+		return err
+	}
+	poster, err := uc.posters.ExtractPoster(ctx, sourceURL)
+	if err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(poster))
+	if err != nil {
+		return err
+	}
+
+	posterKey := attachment.ObjectKey + ".poster.jpg"
+	if err := uc.storage.UploadFile(ctx, posterKey, bytes.NewReader(poster), "image/jpeg"); err != nil {
+		return err
+	}
+
+	if attachment.Meta == nil {
+		attachment.Meta = make(map[string]interface{})
+	}
+	attachment.Meta[MetaKeyThumbnailKey] = posterKey
+	attachment.Meta[MetaKeyThumbnailWidth] = config.Width
+	attachment.Meta[MetaKeyThumbnailHeight] = config.Height
+	attachment.UpdatedAt = time.Now()
+	return uc.repo.UpdateAttachment(ctx, attachment)
+}
+
+// deleteThumbnail removes the attachment's thumbnail or poster frame, if it has one,
+// along with the attachment's own object
+func (uc *MediaUsecase) deleteThumbnail(ctx context.Context, attachment *Attachment) {
+	key, ok := attachment.Meta[MetaKeyThumbnailKey].(string)
+	if !ok || key == "" {
+		return
+	}
+	if err := uc.storage.DeleteFile(ctx, key); err != nil {
+		log.Printf("Failed to delete thumbnail of attachment %s: %v", attachment.ID, err)
+	}
+}
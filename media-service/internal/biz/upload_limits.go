@@ -0,0 +1,138 @@
+package biz
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UploadLimitConfig throttles how many uploads each user can start
+type UploadLimitConfig struct {
+	// RatePerMinute is how fast a user's allowance refills; 0 disables the rate limit
+	RatePerMinute float64
+	// Burst is how many uploads a user can start back to back
+	Burst int
+	// MaxInFlight caps a user's uploads started but not yet completed; 0 disables it
+	MaxInFlight int
+}
+
+// DefaultUploadLimitConfig returns the upload limits used when nothing is configured
+func DefaultUploadLimitConfig() UploadLimitConfig {
+	return UploadLimitConfig{
+		RatePerMinute: 30,
+		Burst:         20,
+		MaxInFlight:   20,
+	}
+}
+
+// UploadRateLimitedError rejects an upload started too soon after the user spent their
+// allowance. It matches ErrUploadRateLimited with errors.Is.
+type UploadRateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *UploadRateLimitedError) Error() string {
+	return fmt.Sprintf("too many uploads started, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+func (e *UploadRateLimitedError) Unwrap() error {
+	return ErrUploadRateLimited
+}
+
+// checkUploadLimits rejects an upload the user isn't allowed to start yet. The rate
+// limit is checked first so a user hammering the endpoint costs no database queries.
+func (uc *MediaUsecase) checkUploadLimits(ctx context.Context, userID uuid.UUID) error {
+	if wait := uc.uploadLimiter.take(userID, time.Now()); wait > 0 {
+		return &UploadRateLimitedError{RetryAfter: wait}
+	}
+
+	if uc.uploadLimits.MaxInFlight <= 0 {
+		return nil
+	}
+	// Uploads whose URL has expired can no longer be finished and are left for the
+	// sweeper, so they don't hold up new ones
+	count, err := uc.repo.CountUploadsInFlight(ctx, userID, time.Now().Add(-UploadURLTTL))
+	if err != nil {
+		return err
+	}
+	if count >= uc.uploadLimits.MaxInFlight {
+		return ErrTooManyUploadsInFlight
+	}
+	return nil
+}
+
+// uploadLimiter is a token bucket per user, kept in memory so each instance limits
+// on its own
+type uploadLimiter struct {
+	// rate is tokens per second; 0 disables the limiter
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[uuid.UUID]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newUploadLimiter(config UploadLimitConfig) *uploadLimiter {
+	burst := float64(config.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &uploadLimiter{
+		rate:    config.RatePerMinute / 60,
+		burst:   burst,
+		buckets: make(map[uuid.UUID]*tokenBucket),
+	}
+}
+
+// take spends one of the user's tokens, returning how long until one is available if
+// they have none left
+func (l *uploadLimiter) take(userID uuid.UUID, now time.Time) time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+
+	bucket, ok := l.buckets[userID]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[userID] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return 0
+}
+
+// prune drops buckets that have refilled, which are no different from a new one. It
+// runs at most once a minute.
+func (l *uploadLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for userID, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= refill {
+			delete(l.buckets, userID)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package biz
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// usageCacheTTL is how long a computed usage report is served before it's recomputed
+const usageCacheTTL = time.Minute
+
+// CategoryUsage is the storage used by one kind of file: image, video, audio,
+// document, archive or other
+type CategoryUsage struct {
+	Category string `json:"category"`
+	Count    int64  `json:"count"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// StorageUsage is how much an organization stores in attachments
+type StorageUsage struct {
+	OrganizationID uuid.UUID        `json:"organization_id"`
+	TotalBytes     int64            `json:"total_bytes"`
+	Count          int64            `json:"count"`
+	Categories     []*CategoryUsage `json:"categories"`
+	ComputedAt     time.Time        `json:"computed_at"`
+}
+
+// GetStorageUsage reports an organization's attachment storage to its admins. The
+// aggregate is cached briefly since admins tend to reload it and it scans every
+// attachment of the organization.
+func (uc *MediaUsecase) GetStorageUsage(ctx context.Context, requesterID, orgID uuid.UUID) (*StorageUsage, error) {
+	role, err := uc.repo.GetUserRole(ctx, requesterID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	if role != "admin" {
+		return nil, ErrUnauthorized
+	}
+
+	uc.usageMu.Lock()
+	cached, ok := uc.usageCache[orgID]
+	uc.usageMu.Unlock()
+	if ok && time.Since(cached.ComputedAt) < usageCacheTTL {
+		return cached, nil
+	}
+
+	categories, err := uc.repo.GetStorageUsage(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &StorageUsage{
+		OrganizationID: orgID,
+		Categories:     categories,
+		ComputedAt:     time.Now(),
+	}
+	if usage.Categories == nil {
+		usage.Categories = []*CategoryUsage{}
+	}
+	for _, category := range categories {
+		usage.TotalBytes += category.Bytes
+		usage.Count += category.Count
+	}
+
+	uc.usageMu.Lock()
+	uc.usageCache[orgID] = usage
+	uc.usageMu.Unlock()
+
+	return usage, nil
+}
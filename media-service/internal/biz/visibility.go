@@ -0,0 +1,148 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Visibility decides how an attachment's object is reached: private objects only
+// through short-lived presigned URLs, public ones through a stable URL anyone can
+// fetch and cache
+type Visibility string
+
+const (
+	VisibilityPrivate Visibility = "private"
+	VisibilityPublic  Visibility = "public"
+)
+
+// UploadPurpose says what an upload is for. Only some purposes may be public.
+type UploadPurpose string
+
+const (
+	// PurposeMessage uploads are attached to messages and are always private
+	PurposeMessage UploadPurpose = "message"
+	PurposeAvatar  UploadPurpose = "avatar"
+	// PurposeOrgLogo uploads can only be made by organization admins
+	PurposeOrgLogo UploadPurpose = "org_logo"
+)
+
+// PublicObjectPrefix is where public objects are stored. The storage provider makes
+// everything under it readable without a signature, so nothing private or unscanned
+// may live there: public uploads are staged under a private key and copied here by
+// publishPublicObject once they are ready.
+const PublicObjectPrefix = "public/"
+
+// publicPurposes are the uploads that may be public; they must be images
+var publicPurposes = map[UploadPurpose]bool{
+	PurposeAvatar:  true,
+	PurposeOrgLogo: true,
+}
+
+// resolveVisibility validates the visibility and purpose requested for an upload and
+// returns the visibility to store it with. Uploads are private unless asked otherwise.
+// Only admins of the organization the upload belongs to may upload its logo.
+func (uc *MediaUsecase) resolveVisibility(ctx context.Context, req *UploadRequest, userID, orgID uuid.UUID) (Visibility, error) {
+	purpose := req.Purpose
+	if purpose == "" {
+		purpose = PurposeMessage
+	}
+	if purpose != PurposeMessage && !publicPurposes[purpose] {
+		return "", ErrInvalidPurpose
+	}
+
+	if purpose == PurposeOrgLogo {
+		role, err := uc.repo.GetUserRole(ctx, userID, orgID)
+		if err != nil {
+			return "", err
+		}
+		if role != "admin" {
+			return "", ErrUnauthorized
+		}
+	}
+
+	switch req.Visibility {
+	case "", VisibilityPrivate:
+		return VisibilityPrivate, nil
+	case VisibilityPublic:
+	default:
+		return "", ErrInvalidVisibility
+	}
+
+	// Message attachments are only ever reachable by the conversation's participants
+	if !publicPurposes[purpose] || req.MessageID != nil || CategoryOf(req.ContentType) != FileCategoryImage {
+		return "", ErrPublicNotAllowed
+	}
+	if _, ok := uc.storage.PublicURL(PublicObjectPrefix); !ok {
+		return "", ErrPublicNotAllowed
+	}
+	return VisibilityPublic, nil
+}
+
+// publicURL is the stable URL of a public attachment once it's ready. Public objects
+// are never advertised before they pass their antivirus scan.
+func (uc *MediaUsecase) publicURL(attachment *Attachment) string {
+	if attachment.Visibility != VisibilityPublic || attachment.Status != FileStatusReady {
+		return ""
+	}
+	url, _ := uc.storage.PublicURL(attachment.ObjectKey)
+	return url
+}
+
+// withPublicURL fills in the attachment's public URL for clients
+func (uc *MediaUsecase) withPublicURL(attachment *Attachment) *Attachment {
+	attachment.PublicURL = uc.publicURL(attachment)
+	return attachment
+}
+
+// publishPublicObject copies a public attachment that has passed its checks from its
+// private staging key to PublicObjectPrefix and points the attachment at the copy. It
+// returns the staging key for the caller to remove with removeStagedObject once the
+// attachment is saved, or "" if there was nothing to publish.
+func (uc *MediaUsecase) publishPublicObject(ctx context.Context, attachment *Attachment) (string, error) {
+	if attachment.Visibility != VisibilityPublic || strings.HasPrefix(attachment.ObjectKey, PublicObjectPrefix) {
+		return "", nil
+	}
+	stagingKey := attachment.ObjectKey
+	publicKey := PublicObjectPrefix + stagingKey
+	if err := uc.storage.CopyFile(ctx, stagingKey, publicKey); err != nil {
+		return "", err
+	}
+	attachment.ObjectKey = publicKey
+	return stagingKey, nil
+}
+
+// removeStagedObject deletes the staging copy of a published attachment
+func (uc *MediaUsecase) removeStagedObject(ctx context.Context, attachment *Attachment, stagingKey string) {
+	if stagingKey == "" {
+		return
+	}
+	if err := uc.storage.DeleteFile(ctx, stagingKey); err != nil {
+		log.Printf("Failed to delete staged object of attachment %s: %v", attachment.ID, err)
+	}
+}
+
+// unpublishPublicObject undoes publishPublicObject when the attachment couldn't be
+// saved, so no public copy outlives the attachment that would advertise it
+func (uc *MediaUsecase) unpublishPublicObject(ctx context.Context, attachment *Attachment, stagingKey string) {
+	if stagingKey == "" {
+		return
+	}
+	if err := uc.storage.DeleteFile(ctx, attachment.ObjectKey); err != nil {
+		log.Printf("Failed to delete unsaved public object of attachment %s: %v", attachment.ID, err)
+	}
+	attachment.ObjectKey = stagingKey
+}
+
+// withdrawPublicObject deletes the stored object of a public attachment that was
+// blocked, since anyone who learned its key could otherwise still fetch it
+func (uc *MediaUsecase) withdrawPublicObject(ctx context.Context, attachment *Attachment) {
+	if attachment.Visibility != VisibilityPublic || !strings.HasPrefix(attachment.ObjectKey, PublicObjectPrefix) {
+		return
+	}
+	if err := uc.storage.DeleteFile(ctx, attachment.ObjectKey); err != nil {
+		log.Printf("Failed to withdraw public object of attachment %s: %v", attachment.ID, err)
+	}
+}
@@ -39,11 +39,11 @@ func (s *clamAVScanner) ScanFile(ctx context.Context, objectKey string) (bool, e
 	// 3. Parse the response
 	
 	// For now, we'll just check if ClamAV is reachable
-	conn, err := net.DialTimeout("tcp", s.host, 5*time.Second)
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", s.host)
 	if err != nil {
-		// If ClamAV is not reachable, log error and assume clean
-		// In production, you might want to fail safe or retry
-		return true, fmt.Errorf("clamav not reachable: %v", err)
+		// Refused connections and timeouts are transient; the caller retries them
+		return false, fmt.Errorf("%w: clamav not reachable: %v", biz.ErrScannerUnavailable, err)
 	}
 	defer conn.Close()
 
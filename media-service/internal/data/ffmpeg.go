@@ -0,0 +1,90 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/media-service/internal/biz"
+)
+
+// posterTimeout bounds a single ffmpeg run; it only decodes the first second or so
+const posterTimeout = 30 * time.Second
+
+// posterMaxWidth keeps poster frames preview-sized; narrower videos aren't upscaled
+const posterMaxWidth = 640
+
+// posterProtocols and posterFormats limit what ffmpeg will open for an upload. The
+// source is a presigned storage URL, but format autodetection would otherwise let an
+// uploaded HLS playlist or concat script make ffmpeg fetch any URL or local file.
+const (
+	posterProtocols = "http,https,tcp,tls"
+	posterFormats   = "mov,mp4,matroska,webm"
+)
+
+type ffmpegPosterExtractor struct {
+	path string
+}
+
+// NewFFmpegPosterExtractor extracts poster frames with the ffmpeg binary at path,
+// which may be a bare name looked up in PATH. It fails if ffmpeg can't be found.
+func NewFFmpegPosterExtractor(path string) (biz.PosterExtractor, error) {
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", biz.ErrPosterUnavailable, err)
+	}
+	return &ffmpegPosterExtractor{path: resolved}, nil
+}
+
+func (e *ffmpegPosterExtractor) ExtractPoster(ctx context.Context, sourceURL string) ([]byte, error) {
+	// A frame one second in skips the black frame many videos open with; clips
+	// shorter than that fall back to the first frame
+	poster, err := e.extractAt(ctx, sourceURL, "1")
+	if err == nil && len(poster) == 0 {
+		poster, err = e.extractAt(ctx, sourceURL, "0")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(poster) == 0 {
+		return nil, errors.New("ffmpeg produced no frame")
+	}
+	return poster, nil
+}
+
+func (e *ffmpegPosterExtractor) extractAt(ctx context.Context, sourceURL, offset string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, posterTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, e.path, posterArgs(sourceURL, offset)...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		var execErr *exec.Error
+		if errors.As(err, &execErr) {
+			return nil, fmt.Errorf("%w: %v", biz.ErrPosterUnavailable, err)
+		}
+		return nil, fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// posterArgs are the ffmpeg arguments to grab one frame at offset seconds. The
+// whitelists are input options, so they come before -i.
+func posterArgs(sourceURL, offset string) []string {
+	return []string{
+		"-hide_banner", "-loglevel", "error",
+		"-protocol_whitelist", posterProtocols,
+		"-format_whitelist", posterFormats,
+		"-ss", offset, "-i", sourceURL,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", posterMaxWidth),
+		"-f", "image2pipe", "-vcodec", "mjpeg", "pipe:1",
+	}
+}
@@ -0,0 +1,90 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPosterArgs(t *testing.T) {
+	args := posterArgs("https://storage.example/video.mp4?sig=1", "1")
+
+	index := func(arg string) int {
+		for i, a := range args {
+			if a == arg {
+				return i
+			}
+		}
+		return -1
+	}
+	input := index("-i")
+	if input < 0 || args[input+1] != "https://storage.example/video.mp4?sig=1" {
+		t.Fatalf("source URL isn't the input: %v", args)
+	}
+
+	tests := []struct {
+		option string
+		want   string
+	}{
+		{"-protocol_whitelist", posterProtocols},
+		{"-format_whitelist", posterFormats},
+		{"-ss", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.option, func(t *testing.T) {
+			i := index(tt.option)
+			if i < 0 {
+				t.Fatalf("%s missing: %v", tt.option, args)
+			}
+			if i > input {
+				t.Errorf("%s comes after -i, so it doesn't apply to the input", tt.option)
+			}
+			if args[i+1] != tt.want {
+				t.Errorf("%s = %q, want %q", tt.option, args[i+1], tt.want)
+			}
+		})
+	}
+}
+
+// TestExtractPosterRefusesPlaylists uploads playlists and scripts that reference
+// another server and checks ffmpeg never contacts it. It needs ffmpeg in PATH.
+func TestExtractPosterRefusesPlaylists(t *testing.T) {
+	extractor, err := NewFFmpegPosterExtractor("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg not available")
+	}
+
+	var fetched atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+	}))
+	defer target.Close()
+
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"hls playlist", fmt.Sprintf("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\n%s/segment.ts\n#EXT-X-ENDLIST\n", target.URL)},
+		{"concat script", fmt.Sprintf("ffconcat version 1.0\nfile '%s/segment.mp4'\n", target.URL)},
+		{"local file in playlist", "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:1,\nfile:///etc/passwd\n#EXT-X-ENDLIST\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upload := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.payload))
+			}))
+			defer upload.Close()
+
+			if _, err := extractor.ExtractPoster(context.Background(), upload.URL+"/video.mp4"); err == nil {
+				t.Error("extracted a poster from a playlist")
+			}
+			if n := fetched.Load(); n != 0 {
+				t.Errorf("ffmpeg made %d requests to a URL the upload referenced", n)
+			}
+		})
+	}
+}
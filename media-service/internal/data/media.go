@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"time"
 
 	"github.com/google/uuid"
 	_ "github.com/lib/pq"
@@ -23,13 +24,14 @@ func (r *mediaRepo) CreateAttachment(ctx context.Context, attachment *biz.Attach
 	metaJSON, _ := json.Marshal(attachment.Meta)
 
 	query := `
-		INSERT INTO attachments (id, message_id, object_key, file_name, mime_type, size, status, meta, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+		INSERT INTO attachments (id, message_id, object_key, file_name, mime_type, size, status, meta,
+		                         organization_id, uploaded_by, visibility, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
 
 	_, err := r.db.ExecContext(ctx, query,
 		attachment.ID, attachment.MessageID, attachment.ObjectKey, attachment.FileName,
 		attachment.MimeType, attachment.Size, attachment.Status, metaJSON,
-		attachment.CreatedAt, attachment.UpdatedAt)
+		attachment.OrganizationID, attachment.UploadedBy, attachment.Visibility, attachment.CreatedAt, attachment.UpdatedAt)
 
 	return err
 }
@@ -39,13 +41,13 @@ func (r *mediaRepo) GetAttachment(ctx context.Context, id uuid.UUID) (*biz.Attac
 	var metaJSON []byte
 
 	query := `
-		SELECT id, message_id, object_key, file_name, mime_type, size, status, meta, created_at, updated_at
+		SELECT id, message_id, object_key, file_name, mime_type, size, status, meta, organization_id, uploaded_by, visibility, created_at, updated_at
 		FROM attachments WHERE id = $1`
 
 	err := r.db.QueryRowContext(ctx, query, id).Scan(
 		&attachment.ID, &attachment.MessageID, &attachment.ObjectKey, &attachment.FileName,
 		&attachment.MimeType, &attachment.Size, &attachment.Status, &metaJSON,
-		&attachment.CreatedAt, &attachment.UpdatedAt)
+		&attachment.OrganizationID, &attachment.UploadedBy, &attachment.Visibility, &attachment.CreatedAt, &attachment.UpdatedAt)
 
 	if err == sql.ErrNoRows {
 		return nil, biz.ErrAttachmentNotFound
@@ -84,7 +86,7 @@ func (r *mediaRepo) DeleteAttachment(ctx context.Context, id uuid.UUID) error {
 
 func (r *mediaRepo) GetAttachmentsByMessage(ctx context.Context, messageID uuid.UUID) ([]*biz.Attachment, error) {
 	query := `
-		SELECT id, message_id, object_key, file_name, mime_type, size, status, meta, created_at, updated_at
+		SELECT id, message_id, object_key, file_name, mime_type, size, status, meta, organization_id, uploaded_by, visibility, created_at, updated_at
 		FROM attachments 
 		WHERE message_id = $1
 		ORDER BY created_at ASC`
@@ -103,7 +105,7 @@ func (r *mediaRepo) GetAttachmentsByMessage(ctx context.Context, messageID uuid.
 		err := rows.Scan(
 			&attachment.ID, &attachment.MessageID, &attachment.ObjectKey, &attachment.FileName,
 			&attachment.MimeType, &attachment.Size, &attachment.Status, &metaJSON,
-			&attachment.CreatedAt, &attachment.UpdatedAt)
+			&attachment.OrganizationID, &attachment.UploadedBy, &attachment.Visibility, &attachment.CreatedAt, &attachment.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -116,3 +118,125 @@ func (r *mediaRepo) GetAttachmentsByMessage(ctx context.Context, messageID uuid.
 
 	return attachments, nil
 }
+
+func (r *mediaRepo) ListStaleUploads(ctx context.Context, before time.Time, limit int) ([]*biz.Attachment, error) {
+	return r.listByStatus(ctx, biz.FileStatusUploading, before, limit)
+}
+
+func (r *mediaRepo) ListExpiredAttachments(ctx context.Context, limit int) ([]*biz.Attachment, error) {
+	return r.listByStatus(ctx, biz.FileStatusExpired, time.Now(), limit)
+}
+
+func (r *mediaRepo) ListScanningAttachments(ctx context.Context, before time.Time, limit int) ([]*biz.Attachment, error) {
+	return r.listByStatus(ctx, biz.FileStatusScanning, before, limit)
+}
+
+// listByStatus returns the oldest attachments in a status created before the cutoff
+func (r *mediaRepo) listByStatus(ctx context.Context, status biz.FileStatus, before time.Time, limit int) ([]*biz.Attachment, error) {
+	query := `
+		SELECT id, message_id, object_key, file_name, mime_type, size, status, meta, organization_id, uploaded_by, visibility, created_at, updated_at
+		FROM attachments
+		WHERE status = $1 AND created_at < $2
+		ORDER BY created_at ASC
+		LIMIT $3`
+
+	rows, err := r.db.QueryContext(ctx, query, status, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []*biz.Attachment
+	for rows.Next() {
+		attachment := &biz.Attachment{}
+		var metaJSON []byte
+
+		err := rows.Scan(
+			&attachment.ID, &attachment.MessageID, &attachment.ObjectKey, &attachment.FileName,
+			&attachment.MimeType, &attachment.Size, &attachment.Status, &metaJSON,
+			&attachment.OrganizationID, &attachment.UploadedBy, &attachment.Visibility, &attachment.CreatedAt, &attachment.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(metaJSON) > 0 {
+			json.Unmarshal(metaJSON, &attachment.Meta)
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, rows.Err()
+}
+
+func (r *mediaRepo) CountUploadsInFlight(ctx context.Context, userID uuid.UUID, since time.Time) (int, error) {
+	var count int
+	err := r.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM attachments
+		WHERE uploaded_by = $1 AND status = $2 AND created_at > $3`,
+		userID, biz.FileStatusUploading, since).Scan(&count)
+	return count, err
+}
+
+// GetStorageUsage sums what an organization stores. Attachments from before uploads
+// recorded their organization are attributed through their message's conversation.
+func (r *mediaRepo) GetStorageUsage(ctx context.Context, orgID uuid.UUID) ([]*biz.CategoryUsage, error) {
+	query := `
+		SELECT CASE
+		           WHEN a.mime_type LIKE 'image/%' THEN 'image'
+		           WHEN a.mime_type LIKE 'video/%' THEN 'video'
+		           WHEN a.mime_type LIKE 'audio/%' THEN 'audio'
+		           WHEN a.mime_type IN ('application/zip', 'application/x-rar-compressed') THEN 'archive'
+		           WHEN a.mime_type LIKE 'text/%' OR a.mime_type = 'application/pdf'
+		                OR a.mime_type LIKE 'application/msword%'
+		                OR a.mime_type LIKE 'application/vnd.openxmlformats-officedocument.%' THEN 'document'
+		           ELSE 'other'
+		       END AS category,
+		       COUNT(*), COALESCE(SUM(a.size), 0)
+		FROM attachments a
+		LEFT JOIN messages m ON a.organization_id IS NULL AND m.id = a.message_id
+		LEFT JOIN conversations c ON c.id = m.conversation_id
+		WHERE COALESCE(a.organization_id, c.organization_id) = $1 AND a.status <> $2
+		GROUP BY category
+		ORDER BY category`
+
+	rows, err := r.db.QueryContext(ctx, query, orgID, biz.FileStatusUploading)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []*biz.CategoryUsage
+	for rows.Next() {
+		category := &biz.CategoryUsage{}
+		if err := rows.Scan(&category.Category, &category.Count, &category.Bytes); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+
+	return categories, rows.Err()
+}
+
+func (r *mediaRepo) GetMessageSender(ctx context.Context, messageID uuid.UUID) (uuid.UUID, uuid.UUID, error) {
+	query := `
+		SELECT m.sender_id, c.organization_id
+		FROM messages m
+		INNER JOIN conversations c ON c.id = m.conversation_id
+		WHERE m.id = $1`
+
+	var senderID, orgID uuid.UUID
+	err := r.db.QueryRowContext(ctx, query, messageID).Scan(&senderID, &orgID)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, uuid.Nil, biz.ErrMessageNotFound
+	}
+	return senderID, orgID, err
+}
+
+func (r *mediaRepo) GetUserRole(ctx context.Context, userID, orgID uuid.UUID) (string, error) {
+	var role string
+	err := r.db.QueryRowContext(ctx, `SELECT role FROM users WHERE id = $1 AND organization_id = $2`, userID, orgID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", biz.ErrUnauthorized
+	}
+	return role, err
+}
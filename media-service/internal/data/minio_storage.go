@@ -2,8 +2,11 @@ package data
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
@@ -15,6 +18,8 @@ import (
 type minioStorage struct {
 	client *minio.Client
 	bucket string
+	// publicBaseURL is where public objects are served from; empty disables them
+	publicBaseURL string
 }
 
 type MinIOConfig struct {
@@ -23,6 +28,9 @@ type MinIOConfig struct {
 	SecretKey string `yaml:"secret_key"`
 	Bucket    string `yaml:"bucket"`
 	UseSSL    bool   `yaml:"use_ssl"`
+	// PublicURL is the externally reachable MinIO address public objects are linked
+	// through, e.g. https://media.example.com. Leaving it empty keeps every object private.
+	PublicURL string `yaml:"public_url"`
 }
 
 func NewMinIOStorage(config MinIOConfig) (biz.StorageProvider, error) {
@@ -36,8 +44,9 @@ func NewMinIOStorage(config MinIOConfig) (biz.StorageProvider, error) {
 	}
 
 	storage := &minioStorage{
-		client: client,
-		bucket: config.Bucket,
+		client:        client,
+		bucket:        config.Bucket,
+		publicBaseURL: strings.TrimRight(config.PublicURL, "/"),
 	}
 
 	// Ensure bucket exists
@@ -54,9 +63,88 @@ func NewMinIOStorage(config MinIOConfig) (biz.StorageProvider, error) {
 		}
 	}
 
+	if storage.publicBaseURL != "" {
+		if err := allowPublicReads(ctx, client, config.Bucket); err != nil {
+			return nil, fmt.Errorf("allow public reads under %s: %w", biz.PublicObjectPrefix, err)
+		}
+	}
+
 	return storage, nil
 }
 
+// publicReadStatementID names the statement media-service adds to the bucket policy,
+// so it can be replaced on restart without touching statements added by anyone else
+const publicReadStatementID = "OrbitMediaPublicRead"
+
+// allowPublicReads adds publicReadStatement to the bucket's policy, keeping every
+// other statement already in it
+func allowPublicReads(ctx context.Context, client *minio.Client, bucket string) error {
+	current, err := client.GetBucketPolicy(ctx, bucket)
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchBucketPolicy" {
+		return err
+	}
+	policy, err := mergePublicReadPolicy(current, bucket)
+	if err != nil {
+		return err
+	}
+	return client.SetBucketPolicy(ctx, bucket, policy)
+}
+
+// mergePublicReadPolicy returns the policy document current with any earlier copy of
+// publicReadStatement replaced by the one for bucket
+func mergePublicReadPolicy(current, bucket string) (string, error) {
+	policy := map[string]interface{}{}
+	if strings.TrimSpace(current) != "" {
+		if err := json.Unmarshal([]byte(current), &policy); err != nil {
+			return "", fmt.Errorf("parse bucket policy: %w", err)
+		}
+	}
+	if _, ok := policy["Version"]; !ok {
+		policy["Version"] = "2012-10-17"
+	}
+
+	var statements []interface{}
+	switch existing := policy["Statement"].(type) {
+	case []interface{}:
+		statements = existing
+	case map[string]interface{}:
+		statements = []interface{}{existing}
+	}
+	merged := make([]interface{}, 0, len(statements)+1)
+	for _, statement := range statements {
+		if fields, ok := statement.(map[string]interface{}); ok && fields["Sid"] == publicReadStatementID {
+			continue
+		}
+		merged = append(merged, statement)
+	}
+	policy["Statement"] = append(merged, publicReadStatement(bucket))
+
+	encoded, err := json.Marshal(policy)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// publicReadStatement lets anyone download objects under the public prefix. Everything
+// else in the bucket stays reachable only through presigned URLs.
+func publicReadStatement(bucket string) map[string]interface{} {
+	return map[string]interface{}{
+		"Sid":       publicReadStatementID,
+		"Effect":    "Allow",
+		"Principal": map[string]interface{}{"AWS": []string{"*"}},
+		"Action":    []string{"s3:GetObject"},
+		"Resource":  []string{fmt.Sprintf("arn:aws:s3:::%s/%s*", bucket, biz.PublicObjectPrefix)},
+	}
+}
+
+func (s *minioStorage) PublicURL(objectKey string) (string, bool) {
+	if s.publicBaseURL == "" || !strings.HasPrefix(objectKey, biz.PublicObjectPrefix) {
+		return "", false
+	}
+	return s.publicBaseURL + "/" + s.bucket + "/" + objectKey, true
+}
+
 func (s *minioStorage) GenerateUploadURL(ctx context.Context, objectKey string, contentType string, expiresIn time.Duration) (string, error) {
 	// Set request parameters for content-type
 	reqParams := make(url.Values)
@@ -92,6 +180,13 @@ func (s *minioStorage) UploadFile(ctx context.Context, objectKey string, reader
 	return err
 }
 
+func (s *minioStorage) CopyFile(ctx context.Context, srcKey, dstKey string) error {
+	_, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: dstKey},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: srcKey})
+	return err
+}
+
 func (s *minioStorage) DeleteFile(ctx context.Context, objectKey string) error {
 	return s.client.RemoveObject(ctx, s.bucket, objectKey, minio.RemoveObjectOptions{})
 }
@@ -99,6 +194,9 @@ func (s *minioStorage) DeleteFile(ctx context.Context, objectKey string) error {
 func (s *minioStorage) GetFileInfo(ctx context.Context, objectKey string) (int64, error) {
 	objInfo, err := s.client.StatObject(ctx, s.bucket, objectKey, minio.StatObjectOptions{})
 	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return 0, biz.ErrObjectNotFound
+		}
 		return 0, err
 	}
 	return objInfo.Size, nil
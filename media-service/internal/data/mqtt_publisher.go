@@ -0,0 +1,70 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/media-service/internal/biz"
+)
+
+// MQTTPublisher publishes attachment events for clients to the broker
+type MQTTPublisher struct {
+	client mqtt.Client
+}
+
+type MQTTConfig struct {
+	BrokerURL string `yaml:"broker_url"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+}
+
+func NewMQTTPublisher(config MQTTConfig) (*MQTTPublisher, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(config.BrokerURL)
+	opts.SetClientID("media-service-publisher")
+	opts.SetUsername(config.Username)
+	opts.SetPassword(config.Password)
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker: %v", token.Error())
+	}
+
+	return &MQTTPublisher{client: client}, nil
+}
+
+// PublishAttachmentStatus sends the event to the uploader's users/{userID}/attachments topic
+func (p *MQTTPublisher) PublishAttachmentStatus(ctx context.Context, userID uuid.UUID, event *biz.AttachmentStatusEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	topic := fmt.Sprintf("users/%s/attachments", userID.String())
+	token := p.client.Publish(topic, 1, false, payload)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Connected reports whether the broker connection is currently up
+func (p *MQTTPublisher) Connected() bool {
+	return p.client.IsConnectionOpen()
+}
+
+// Close gives outstanding publishes up to a second to be acknowledged
+func (p *MQTTPublisher) Close() {
+	p.client.Disconnect(1000)
+}
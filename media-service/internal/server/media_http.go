@@ -2,25 +2,38 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/media-service/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/buildinfo"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/pagination"
 )
 
 type MediaHTTPServer struct {
-	mediaUc *biz.MediaUsecase
-	router  *mux.Router
+	mediaUc        *biz.MediaUsecase
+	info           *buildinfo.Info
+	router         *mux.Router
+	internalSecret string
 }
 
-func NewMediaHTTPServer(mediaUc *biz.MediaUsecase) *MediaHTTPServer {
+// NewMediaHTTPServer creates the media HTTP API. Other services must present
+// internalSecret in X-Internal-Secret to call the /internal routes; with an empty
+// secret those routes deny every request.
+func NewMediaHTTPServer(mediaUc *biz.MediaUsecase, info *buildinfo.Info, internalSecret string) *MediaHTTPServer {
 	s := &MediaHTTPServer{
-		mediaUc: mediaUc,
-		router:  mux.NewRouter(),
+		mediaUc:        mediaUc,
+		info:           info,
+		router:         mux.NewRouter(),
+		internalSecret: internalSecret,
 	}
 	s.setupRoutes()
 	return s
@@ -28,6 +41,7 @@ func NewMediaHTTPServer(mediaUc *biz.MediaUsecase) *MediaHTTPServer {
 
 func (s *MediaHTTPServer) setupRoutes() {
 	api := s.router.PathPrefix("/api/v1").Subrouter()
+	api.Use(s.validatePathIDs)
 
 	// Upload endpoints
 	api.HandleFunc("/upload/initiate", s.authMiddleware(s.handleInitiateUpload)).Methods("POST")
@@ -42,8 +56,20 @@ func (s *MediaHTTPServer) setupRoutes() {
 	// Message attachments
 	api.HandleFunc("/messages/{messageID}/attachments", s.authMiddleware(s.handleGetMessageAttachments)).Methods("GET")
 
+	// Storage usage (org admins)
+	api.HandleFunc("/media/usage", s.authMiddleware(s.handleGetStorageUsage)).Methods("GET")
+
 	// Thumbnail generation
 	api.HandleFunc("/attachments/{attachmentID}/thumbnail", s.authMiddleware(s.handleGenerateThumbnail)).Methods("POST")
+
+	// Service-to-service: message-service links the attachments a message references
+	internal := s.router.PathPrefix("/internal").Subrouter()
+	internal.Use(s.validatePathIDs)
+	internal.HandleFunc("/messages/{messageID}/attachments", s.internalMiddleware(s.handleLinkMessageAttachments)).Methods("POST")
+	internal.HandleFunc("/attachments/status", s.internalMiddleware(s.handleAttachmentStatuses)).Methods("POST")
+
+	// Build and dependency status
+	s.router.HandleFunc("/info", s.info.Handler).Methods("GET")
 }
 
 func (s *MediaHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -62,6 +88,7 @@ func (s *MediaHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (s *MediaHTTPServer) handleInitiateUpload(w http.ResponseWriter, r *http.Request) {
 	userID := s.getUserIDFromContext(r.Context())
+	orgID := s.getOrgIDFromContext(r.Context())
 
 	var req biz.UploadRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -69,7 +96,7 @@ func (s *MediaHTTPServer) handleInitiateUpload(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	response, err := s.mediaUc.InitiateUpload(r.Context(), &req, userID)
+	response, err := s.mediaUc.InitiateUpload(r.Context(), &req, userID, orgID)
 	if err != nil {
 		s.handleError(w, err)
 		return
@@ -174,6 +201,10 @@ func (s *MediaHTTPServer) handleAssociateWithMessage(w http.ResponseWriter, r *h
 	}
 
 	if err := s.mediaUc.AssociateWithMessage(r.Context(), attachmentID, req.MessageID); err != nil {
+		if err == biz.ErrFileNotReady {
+			s.writeError(w, http.StatusConflict, "Attachment is not ready")
+			return
+		}
 		s.handleError(w, err)
 		return
 	}
@@ -181,6 +212,62 @@ func (s *MediaHTTPServer) handleAssociateWithMessage(w http.ResponseWriter, r *h
 	s.writeJSON(w, http.StatusOK, map[string]string{"status": "associated"})
 }
 
+func (s *MediaHTTPServer) handleLinkMessageAttachments(w http.ResponseWriter, r *http.Request) {
+	messageID, err := uuid.Parse(mux.Vars(r)["messageID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	var req struct {
+		OrganizationID uuid.UUID   `json:"organization_id"`
+		SenderID       uuid.UUID   `json:"sender_id"`
+		AttachmentIDs  []uuid.UUID `json:"attachment_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if req.OrganizationID == uuid.Nil || req.SenderID == uuid.Nil {
+		s.writeError(w, http.StatusBadRequest, "organization_id and sender_id are required")
+		return
+	}
+
+	result, err := s.mediaUc.LinkMessageAttachments(r.Context(), messageID, req.OrganizationID, req.SenderID, req.AttachmentIDs)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, result)
+}
+
+// handleAttachmentStatuses lets chat-api check that the attachments a message is about
+// to reference are ready. Attachments the sender can't use are omitted.
+func (s *MediaHTTPServer) handleAttachmentStatuses(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		OrganizationID uuid.UUID   `json:"organization_id"`
+		SenderID       uuid.UUID   `json:"sender_id"`
+		AttachmentIDs  []uuid.UUID `json:"attachment_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if req.OrganizationID == uuid.Nil || req.SenderID == uuid.Nil {
+		s.writeError(w, http.StatusBadRequest, "organization_id and sender_id are required")
+		return
+	}
+
+	statuses, err := s.mediaUc.AttachmentStatuses(r.Context(), req.OrganizationID, req.SenderID, req.AttachmentIDs)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{"statuses": statuses})
+}
+
 func (s *MediaHTTPServer) handleGetMessageAttachments(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	messageIDStr := vars["messageID"]
@@ -191,13 +278,25 @@ func (s *MediaHTTPServer) handleGetMessageAttachments(w http.ResponseWriter, r *
 		return
 	}
 
+	params, err := pagination.Parse(r, 50, 100)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid cursor")
+		return
+	}
+
+	// A message only carries a handful of attachments, so they're paged in memory
 	attachments, err := s.mediaUc.GetMessageAttachments(r.Context(), messageID)
 	if err != nil {
 		s.handleError(w, err)
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, attachments)
+	page := pagination.New(pagination.Slice(attachments, params), params)
+	if params.IncludeTotal {
+		page.SetTotal(len(attachments))
+	}
+
+	s.writeJSON(w, http.StatusOK, page.Body(r))
 }
 
 func (s *MediaHTTPServer) handleGenerateThumbnail(w http.ResponseWriter, r *http.Request) {
@@ -218,6 +317,19 @@ func (s *MediaHTTPServer) handleGenerateThumbnail(w http.ResponseWriter, r *http
 	s.writeJSON(w, http.StatusOK, map[string]string{"status": "thumbnail_generated"})
 }
 
+func (s *MediaHTTPServer) handleGetStorageUsage(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserIDFromContext(r.Context())
+	orgID := s.getOrgIDFromContext(r.Context())
+
+	usage, err := s.mediaUc.GetStorageUsage(r.Context(), userID, orgID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, usage)
+}
+
 // Helper methods
 func (s *MediaHTTPServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -239,9 +351,10 @@ func (s *MediaHTTPServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc
 		// TODO: Validate token with auth service
 		// For now, we'll extract user info from headers (for testing)
 		userIDStr := r.Header.Get("X-User-ID")
+		orgIDStr := r.Header.Get("X-Organization-ID")
 
-		if userIDStr == "" {
-			s.writeError(w, http.StatusUnauthorized, "Missing user ID")
+		if userIDStr == "" || orgIDStr == "" {
+			s.writeError(w, http.StatusUnauthorized, "Missing user or organization ID")
 			return
 		}
 
@@ -251,25 +364,106 @@ func (s *MediaHTTPServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc
 			return
 		}
 
+		orgID, err := uuid.Parse(orgIDStr)
+		if err != nil {
+			s.writeError(w, http.StatusUnauthorized, "Invalid organization ID")
+			return
+		}
+
 		// Add to context
 		ctx := context.WithValue(r.Context(), "userID", userID)
+		ctx = context.WithValue(ctx, "orgID", orgID)
 
 		next(w, r.WithContext(ctx))
 	}
 }
 
+// internalMiddleware guards service-to-service routes with the shared internal secret.
+// Without a configured secret the routes are refused, never left open.
+func (s *MediaHTTPServer) internalMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.internalSecret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Internal-Secret")), []byte(s.internalSecret)) != 1 {
+			s.writeError(w, http.StatusUnauthorized, "Invalid internal secret")
+			return
+		}
+		next(w, r)
+	}
+}
+
 func (s *MediaHTTPServer) getUserIDFromContext(ctx context.Context) uuid.UUID {
 	return ctx.Value("userID").(uuid.UUID)
 }
 
+func (s *MediaHTTPServer) getOrgIDFromContext(ctx context.Context) uuid.UUID {
+	return ctx.Value("orgID").(uuid.UUID)
+}
+
+// pathIDParams are the route variables that must be UUIDs, with the name used in errors
+var pathIDParams = []struct {
+	name  string
+	label string
+}{
+	{"attachmentID", "attachment ID"},
+	{"messageID", "message ID"},
+}
+
+// validatePathIDs rejects requests whose UUID path parameters don't parse, naming the
+// offending parameter in the response.
+func (s *MediaHTTPServer) validatePathIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		for _, param := range pathIDParams {
+			value, ok := vars[param.name]
+			if !ok {
+				continue
+			}
+			if _, err := uuid.Parse(value); err != nil {
+				s.writeJSON(w, http.StatusBadRequest, map[string]string{
+					"error":     "Invalid " + param.label,
+					"parameter": param.name,
+				})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *MediaHTTPServer) handleError(w http.ResponseWriter, err error) {
+	var tooLarge *biz.FileTooLargeError
+	if errors.As(err, &tooLarge) {
+		s.writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error":       "File too large: " + tooLarge.Error(),
+			"category":    tooLarge.Category,
+			"limit_bytes": tooLarge.Limit,
+		})
+		return
+	}
+
+	var rateLimited *biz.UploadRateLimitedError
+	if errors.As(err, &rateLimited) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateLimited.RetryAfter.Seconds()))))
+		s.writeError(w, http.StatusTooManyRequests, "Too many uploads started, try again later")
+		return
+	}
+
 	switch err {
+	case biz.ErrTooManyUploadsInFlight:
+		s.writeError(w, http.StatusTooManyRequests, "Too many uploads in progress, finish or cancel some first")
 	case biz.ErrAttachmentNotFound:
 		s.writeError(w, http.StatusNotFound, "Attachment not found")
+	case biz.ErrMessageNotFound:
+		s.writeError(w, http.StatusNotFound, "Message not found")
 	case biz.ErrFileTooLarge:
 		s.writeError(w, http.StatusBadRequest, "File too large")
 	case biz.ErrInvalidFileType:
 		s.writeError(w, http.StatusBadRequest, "Invalid file type")
+	case biz.ErrInvalidVisibility:
+		s.writeError(w, http.StatusBadRequest, "Visibility must be private or public")
+	case biz.ErrInvalidPurpose:
+		s.writeError(w, http.StatusBadRequest, "Purpose must be message, avatar or org_logo")
+	case biz.ErrPublicNotAllowed:
+		s.writeError(w, http.StatusBadRequest, "Only avatar and organization logo images can be public")
 	case biz.ErrInvalidFileStatus:
 		s.writeError(w, http.StatusBadRequest, "Invalid file status")
 	case biz.ErrFileNotReady:
@@ -0,0 +1,91 @@
+package biz
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AckStatus says whether a message published on chat/{id}/messages was stored
+type AckStatus string
+
+const (
+	AckStatusPersisted AckStatus = "persisted"
+	AckStatusFailed    AckStatus = "failed"
+	// AckStatusQueued messages arrived while the database was unavailable; they are
+	// stored once it recovers and a persisted ack follows
+	AckStatusQueued AckStatus = "queued"
+)
+
+// Error codes carried by failed acks
+const (
+	AckErrorInvalidPayload = "invalid_payload"
+	AckErrorStorageFailed  = "storage_failed"
+	// AckErrorIDConflict means the message ID or dedupe_key belongs to someone else's
+	// message; the sender should resend under a new ID
+	AckErrorIDConflict = "id_conflict"
+	// AckErrorSystemMessage means a client published content_type system, which only
+	// the server may post
+	AckErrorSystemMessage = "system_message"
+	// AckErrorWrongConversation means the payload's conversation_id isn't the
+	// conversation of the topic it was published on
+	AckErrorWrongConversation = "wrong_conversation"
+	// AckErrorNotParticipant means the sender isn't a participant of the conversation
+	AckErrorNotParticipant = "not_participant"
+)
+
+// MessageAck tells the sender and chat-api whether a message was persisted. Acks
+// are published on chat/{conversationID}/acks and, if enabled, users/{senderID}/acks.
+type MessageAck struct {
+	Status         AckStatus `json:"status"`
+	MessageID      uuid.UUID `json:"message_id"`
+	ConversationID uuid.UUID `json:"conversation_id"`
+	SenderID       uuid.UUID `json:"sender_id"`
+	DedupeKey      string    `json:"dedupe_key,omitempty"`
+	// SentAt and Seq are the stored timestamp and position, only set once the message is persisted
+	SentAt *time.Time `json:"sent_at,omitempty"`
+	Seq    int64      `json:"seq,omitempty"`
+	// Duplicate marks a message that was already stored; MessageID, SentAt and Seq
+	// are then the stored original's
+	Duplicate bool `json:"duplicate,omitempty"`
+	// Error is one of the AckError codes for failed acks
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func persistedAck(message *Message) *MessageAck {
+	sentAt := message.SentAt
+	return &MessageAck{
+		Status:         AckStatusPersisted,
+		MessageID:      message.ID,
+		ConversationID: message.ConversationID,
+		SenderID:       message.SenderID,
+		DedupeKey:      message.DedupeKey,
+		SentAt:         &sentAt,
+		Seq:            message.Seq,
+		Timestamp:      time.Now(),
+	}
+}
+
+func queuedAck(incoming *IncomingMessage) *MessageAck {
+	return &MessageAck{
+		Status:         AckStatusQueued,
+		MessageID:      incoming.ID,
+		ConversationID: incoming.ConversationID,
+		SenderID:       incoming.SenderID,
+		DedupeKey:      incoming.DedupeKey,
+		Timestamp:      time.Now(),
+	}
+}
+
+func failedAck(incoming *IncomingMessage, code string) *MessageAck {
+	return &MessageAck{
+		Status:         AckStatusFailed,
+		MessageID:      incoming.ID,
+		ConversationID: incoming.ConversationID,
+		SenderID:       incoming.SenderID,
+		DedupeKey:      incoming.DedupeKey,
+		Error:          code,
+		Timestamp:      time.Now(),
+	}
+}
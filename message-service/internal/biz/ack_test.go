@@ -0,0 +1,182 @@
+package biz
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// failingRepo fails every message write with err, or stores it when err is nil
+type failingRepo struct {
+	MessageRepo
+	err error
+}
+
+func (r *failingRepo) CreateMessage(ctx context.Context, message *Message) (bool, error) {
+	if r.err != nil {
+		return false, r.err
+	}
+	message.Seq = 1
+	return true, nil
+}
+
+func (r *failingRepo) GetParticipantDisplayName(ctx context.Context, conversationID, userID uuid.UUID) (string, error) {
+	return "Participant", nil
+}
+
+func TestProcessIncomingMessageAck(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         uuid.UUID
+		repoErr    error
+		wantStatus AckStatus
+		wantError  string
+		wantErr    error
+	}{
+		{"stored", uuid.New(), nil, AckStatusPersisted, "", nil},
+		{"database rejects the message", uuid.New(), errors.New("check constraint violated"), AckStatusFailed, AckErrorStorageFailed, nil},
+		{"ID belongs to another message", uuid.New(), ErrMessageIDConflict, AckStatusFailed, AckErrorIDConflict, ErrMessageIDConflict},
+		{"database unavailable", uuid.New(), driver.ErrBadConn, AckStatusQueued, "", nil},
+		{"missing message ID", uuid.Nil, nil, AckStatusFailed, AckErrorInvalidPayload, ErrInvalidPayload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uc := NewMessageUsecase(&failingRepo{err: tt.repoErr}, nil, nil, &memoryQueue{})
+			incoming := IncomingMessage{ID: tt.id, ConversationID: uuid.New(), SenderID: uuid.New(),
+				ContentType: "text", Content: "hello", DedupeKey: "key-1", SentAt: time.Now()}
+			payload, err := json.Marshal(incoming)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ack, err := uc.ProcessIncomingMessage(context.Background(), incoming.ConversationID, payload)
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if ack == nil {
+				t.Fatalf("no ack published (error %v)", err)
+			}
+			if ack.Status != tt.wantStatus || ack.Error != tt.wantError {
+				t.Errorf("got ack %s/%q, want %s/%q", ack.Status, ack.Error, tt.wantStatus, tt.wantError)
+			}
+			if ack.MessageID != incoming.ID || ack.SenderID != incoming.SenderID || ack.DedupeKey != incoming.DedupeKey {
+				t.Errorf("ack doesn't identify the message: %+v", ack)
+			}
+		})
+	}
+}
+
+func TestSystemMessageIngest(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		system      bool
+		wantStatus  AckStatus
+		wantError   string
+		wantErr     error
+	}{
+		{"user message", "text", false, AckStatusPersisted, "", nil},
+		{"client posing as the server", ContentTypeSystem, false, AckStatusFailed, AckErrorSystemMessage, ErrSystemMessage},
+		{"system message from chat-api", ContentTypeSystem, true, AckStatusPersisted, "", nil},
+		{"user message on the system topic", "text", true, AckStatusFailed, AckErrorInvalidPayload, ErrInvalidPayload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uc := NewMessageUsecase(&failingRepo{}, nil, nil, nil)
+			conversationID := uuid.New()
+			payload, err := json.Marshal(IncomingMessage{ID: uuid.New(), ConversationID: conversationID, SenderID: uuid.New(),
+				ContentType: tt.contentType, Content: "hello", SentAt: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			process := uc.ProcessIncomingMessage
+			if tt.system {
+				process = uc.ProcessSystemMessage
+			}
+			ack, err := process(context.Background(), conversationID, payload)
+			if err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if ack == nil {
+				t.Fatal("no ack published")
+			}
+			if ack.Status != tt.wantStatus || ack.Error != tt.wantError {
+				t.Errorf("got ack %s/%q, want %s/%q", ack.Status, ack.Error, tt.wantStatus, tt.wantError)
+			}
+		})
+	}
+}
+
+// participantRepo stores messages from the conversation's participants only
+type participantRepo struct {
+	MessageRepo
+	participants map[uuid.UUID]bool
+	stored       int
+}
+
+func (r *participantRepo) CreateMessage(ctx context.Context, message *Message) (bool, error) {
+	r.stored++
+	message.Seq = int64(r.stored)
+	return true, nil
+}
+
+func (r *participantRepo) GetParticipantDisplayName(ctx context.Context, conversationID, userID uuid.UUID) (string, error) {
+	if !r.participants[userID] {
+		return "", ErrNotParticipant
+	}
+	return "Participant", nil
+}
+
+func TestForgedMessagesRejected(t *testing.T) {
+	conversationID, senderID := uuid.New(), uuid.New()
+
+	tests := []struct {
+		name           string
+		conversationID uuid.UUID
+		senderID       uuid.UUID
+		wantStatus     AckStatus
+		wantError      string
+		wantErr        error
+	}{
+		{"participant's message", conversationID, senderID, AckStatusPersisted, "", nil},
+		{"message for another conversation", uuid.New(), senderID, AckStatusFailed, AckErrorWrongConversation, ErrWrongConversation},
+		{"forged sender", conversationID, uuid.New(), AckStatusFailed, AckErrorNotParticipant, ErrNotParticipant},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &participantRepo{participants: map[uuid.UUID]bool{senderID: true}}
+			uc := NewMessageUsecase(repo, nil, nil, &memoryQueue{})
+			payload, err := json.Marshal(IncomingMessage{ID: uuid.New(), ConversationID: tt.conversationID, SenderID: tt.senderID,
+				ContentType: "text", Content: "hello", SentAt: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ack, err := uc.ProcessIncomingMessage(context.Background(), conversationID, payload)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if ack == nil {
+				t.Fatal("no ack published")
+			}
+			if ack.Status != tt.wantStatus || ack.Error != tt.wantError {
+				t.Errorf("got ack %s/%q, want %s/%q", ack.Status, ack.Error, tt.wantStatus, tt.wantError)
+			}
+			if ack.ConversationID != conversationID {
+				t.Errorf("ack went to conversation %s, want the topic's %s", ack.ConversationID, conversationID)
+			}
+			if tt.wantErr != nil && repo.stored != 0 {
+				t.Error("stored a forged message")
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package biz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MetaKeyAttachments is the meta key listing the IDs of the media-service attachments
+// a message carries, e.g. {"attachments": ["<attachment id>", ...]}
+const MetaKeyAttachments = "attachments"
+
+// PendingAttachmentLinkTTL is how long a link to an attachment media-service doesn't
+// know about is kept waiting for that attachment to turn up
+const PendingAttachmentLinkTTL = 24 * time.Hour
+
+// ErrAttachmentsUnavailable means media-service couldn't be asked to link attachments
+// right now, e.g. it answered with a server error; the link is worth retrying
+var ErrAttachmentsUnavailable = errors.New("attachment service unavailable")
+
+// AttachmentLinkResult is media-service's answer to a link request
+type AttachmentLinkResult struct {
+	Linked   []uuid.UUID `json:"linked"`
+	Pending  []uuid.UUID `json:"pending"`
+	Missing  []uuid.UUID `json:"missing"`
+	Rejected []uuid.UUID `json:"rejected"`
+}
+
+// AttachmentLinker associates attachments with the message that references them
+type AttachmentLinker interface {
+	LinkMessageAttachments(ctx context.Context, messageID, orgID, senderID uuid.UUID, attachmentIDs []uuid.UUID) (*AttachmentLinkResult, error)
+}
+
+// PendingAttachmentLink is a message waiting for an attachment to exist before it
+// can be linked
+type PendingAttachmentLink struct {
+	MessageID      uuid.UUID
+	SenderID       uuid.UUID
+	OrganizationID uuid.UUID
+}
+
+// AttachmentStatusEvent is what media-service publishes on users/{userID}/attachments
+// when an attachment finishes uploading and scanning
+type AttachmentStatusEvent struct {
+	AttachmentID uuid.UUID `json:"attachment_id"`
+	Status       string    `json:"status"`
+}
+
+// linkAttachments hands the attachments a message lists in its meta to media-service.
+// Attachments media-service hasn't seen yet are remembered and retried when their
+// status event arrives on the attachments topic.
+func (uc *MessageUsecase) linkAttachments(ctx context.Context, message *Message) error {
+	if uc.attachments == nil {
+		return nil
+	}
+	attachmentIDs := metaIDs(message.Meta, MetaKeyAttachments)
+	if len(attachmentIDs) == 0 {
+		return nil
+	}
+
+	orgID, err := uc.repo.GetConversationOrganization(ctx, message.ConversationID)
+	if err != nil {
+		return err
+	}
+
+	result, err := uc.attachments.LinkMessageAttachments(ctx, message.ID, orgID, message.SenderID, attachmentIDs)
+	if err != nil {
+		return err
+	}
+	if len(result.Rejected) > 0 {
+		log.Printf("Message %s references attachments that can't be linked: %v", message.ID, result.Rejected)
+	}
+	if len(result.Missing) > 0 {
+		return uc.repo.CreatePendingAttachmentLinks(ctx, message.ID, result.Missing, time.Now().Add(-PendingAttachmentLinkTTL))
+	}
+	return nil
+}
+
+// ProcessAttachmentStatus links an attachment that has just turned up to any
+// messages that referenced it before media-service knew about it
+func (uc *MessageUsecase) ProcessAttachmentStatus(ctx context.Context, payload []byte) error {
+	if uc.attachments == nil {
+		return nil
+	}
+
+	var event AttachmentStatusEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return err
+	}
+	if event.AttachmentID == uuid.Nil {
+		return ErrInvalidPayload
+	}
+
+	links, err := uc.repo.TakePendingAttachmentLinks(ctx, event.AttachmentID, time.Now().Add(-PendingAttachmentLinkTTL))
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		result, err := uc.attachments.LinkMessageAttachments(ctx, link.MessageID, link.OrganizationID, link.SenderID, []uuid.UUID{event.AttachmentID})
+		if err != nil {
+			log.Printf("Failed to link attachment %s to message %s: %v", event.AttachmentID, link.MessageID, err)
+			continue
+		}
+		if len(result.Rejected) > 0 {
+			log.Printf("Attachment %s can't be linked to message %s", event.AttachmentID, link.MessageID)
+		}
+	}
+	return nil
+}
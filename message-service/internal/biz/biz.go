@@ -7,9 +7,24 @@ import (
 )
 
 var (
-	ErrMessageNotFound = errors.New("message not found")
-	ErrUnauthorized    = errors.New("unauthorized")
-	ErrInvalidPayload  = errors.New("invalid payload")
+	ErrMessageNotFound      = errors.New("message not found")
+	ErrConversationNotFound = errors.New("conversation not found")
+	ErrUnauthorized         = errors.New("unauthorized")
+	ErrInvalidPayload       = errors.New("invalid payload")
+	ErrImmutableMessage     = errors.New("message cannot be modified")
+	ErrNotParticipant       = errors.New("user is not a participant")
+	// ErrSystemMessage means a client published a system message; only chat-api
+	// generates them, on chat/{id}/system
+	ErrSystemMessage = errors.New("system messages are generated by the server")
+	// ErrMessageIDConflict means an incoming message's ID or dedupe_key is already
+	// taken by a message that isn't a copy of it, from another sender or conversation
+	ErrMessageIDConflict = errors.New("message ID already used by another message")
+	// ErrWrongConversation means a message names a conversation other than the one
+	// whose topic it was published on
+	ErrWrongConversation = errors.New("message published on another conversation's topic")
+	// ErrWrongTypist means a typing indicator names someone other than the user whose
+	// typing topic it was published on
+	ErrWrongTypist = errors.New("typing indicator published on another user's topic")
 )
 
 // ProviderSet is biz providers.
@@ -0,0 +1,171 @@
+package biz
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/retry"
+)
+
+// BreakerConfig tunes the circuit breaker in front of message storage
+type BreakerConfig struct {
+	// FailureThreshold is how many transient storage failures in a row open the breaker
+	FailureThreshold int
+	// OpenDuration is how long the breaker stays open before letting a write through
+	// to probe whether the database is back
+	OpenDuration time.Duration
+}
+
+// DefaultBreakerConfig returns the breaker settings used when nothing is configured
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureThreshold: 5,
+		OpenDuration:     30 * time.Second,
+	}
+}
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// StorageBreaker stops message writes while the database keeps failing, so incoming
+// messages go to the dead letter queue instead of each waiting out its retries. Only
+// transient failures, the ones worth retrying, count against the database. It also
+// counts the retries of database writes, for metrics.
+type StorageBreaker struct {
+	config BreakerConfig
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// probing is set while the one write allowed through a half-open breaker is running
+	probing bool
+
+	trips   uint64
+	retries uint64
+}
+
+func NewStorageBreaker(config BreakerConfig) *StorageBreaker {
+	defaults := DefaultBreakerConfig()
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = defaults.FailureThreshold
+	}
+	if config.OpenDuration <= 0 {
+		config.OpenDuration = defaults.OpenDuration
+	}
+	return &StorageBreaker{config: config, state: BreakerClosed}
+}
+
+// Allow reports whether a write may go to the database. Once the breaker has been
+// open for OpenDuration a single write is let through; its outcome decides whether
+// the breaker closes or opens again.
+func (b *StorageBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.config.OpenDuration {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Success records a write that reached the database
+func (b *StorageBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != BreakerClosed {
+		log.Println("Message storage recovered, closing circuit breaker")
+	}
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a failed write. Errors that aren't transient, such as constraint
+// violations, say nothing about the database's health and only end a probe.
+func (b *StorageBreaker) Failure(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !retry.IsRetriable(err) {
+		if b.state == BreakerHalfOpen {
+			b.state = BreakerClosed
+			b.failures = 0
+		}
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.config.FailureThreshold {
+		if b.state != BreakerOpen {
+			log.Printf("Opening message storage circuit breaker for %s after %d failures: %v", b.config.OpenDuration, b.failures, err)
+			atomic.AddUint64(&b.trips, 1)
+		}
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
+
+func (b *StorageBreaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Trips returns how many times the breaker has opened since startup
+func (b *StorageBreaker) Trips() uint64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&b.trips)
+}
+
+// RecordRetry counts a retried database write; it is meant for retry.Config.OnRetry
+func (b *StorageBreaker) RecordRetry(err error) {
+	if b == nil {
+		return
+	}
+	atomic.AddUint64(&b.retries, 1)
+}
+
+// Retries returns how many database writes have been retried since startup
+func (b *StorageBreaker) Retries() uint64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&b.retries)
+}
@@ -0,0 +1,182 @@
+package biz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/retry"
+)
+
+// DeadLetterQueue holds incoming messages that couldn't be stored because the
+// database was unavailable, until they can be replayed. It must not depend on the
+// database itself.
+type DeadLetterQueue interface {
+	Push(payload []byte) error
+	// Drain calls handle with queued payloads, oldest first, removing each one handle
+	// returns nil for. It stops at the first error, leaving that payload queued.
+	Drain(handle func(payload []byte) error) error
+	Len() int
+}
+
+// errStorageUnavailable means a message wasn't stored because the database couldn't
+// take writes, either failing transiently or behind an open breaker
+var errStorageUnavailable = errors.New("message storage unavailable")
+
+// errConversationHeld means a message was queued without trying the database because
+// earlier messages of its conversation are still waiting in the dead letter queue
+var errConversationHeld = errors.New("earlier messages of the conversation are queued")
+
+// errFollowUpFailed means a message was stored but recording its mentions or linking
+// its attachments failed in a way that may go away on retry
+var errFollowUpFailed = errors.New("message stored without its mentions or attachments")
+
+// ShouldRedeliver reports whether a message that failed with err may be handled if
+// the broker delivers it again: the database couldn't take it and it wasn't
+// dead-lettered either. Invalid messages and ones that were queued fail the same way
+// every time, or don't need another try.
+func ShouldRedeliver(err error) bool {
+	return errors.Is(err, errStorageUnavailable) || errors.Is(err, errConversationHeld) || retry.IsRetriable(err)
+}
+
+// retryFollowUp queues a stored message whose mentions or attachment links failed, so
+// ReplayDeadLetters stores it again: that finds the stored copy and completes them.
+// Without a queue they are left incomplete.
+func (uc *MessageUsecase) retryFollowUp(incoming *IncomingMessage, payload []byte) {
+	if uc.deadLetters == nil {
+		log.Printf("Message %s was stored without its mentions or attachments and can't be retried", incoming.ID)
+		return
+	}
+	if err := uc.deadLetters.Push(payload); err != nil {
+		log.Printf("Failed to queue message %s to retry its mentions and attachments: %v", incoming.ID, err)
+		return
+	}
+	log.Printf("Queued message %s in conversation %s to retry its mentions and attachments", incoming.ID, incoming.ConversationID)
+}
+
+// deadLetter queues a message the database couldn't take and acks it as queued, holding
+// back later messages of its conversation until it is replayed. If it can't even be
+// queued the sender is told it failed, so they can resend.
+func (uc *MessageUsecase) deadLetter(incoming *IncomingMessage, payload []byte, cause error) (*MessageAck, error) {
+	if uc.deadLetters == nil {
+		return failedAck(incoming, AckErrorStorageFailed), cause
+	}
+	// Held before the push, so a replay running meanwhile can't release it first
+	uc.hold(incoming)
+	if err := uc.deadLetters.Push(payload); err != nil {
+		uc.release(incoming)
+		log.Printf("Failed to dead-letter message %s: %v", incoming.ID, err)
+		return failedAck(incoming, AckErrorStorageFailed), cause
+	}
+	log.Printf("Queued message %s in conversation %s for replay: %v", incoming.ID, incoming.ConversationID, cause)
+	return queuedAck(incoming), nil
+}
+
+// isHeld reports whether new messages of conversationID must be queued behind ones
+// already in the dead letter queue
+func (uc *MessageUsecase) isHeld(conversationID uuid.UUID) bool {
+	uc.heldMu.Lock()
+	defer uc.heldMu.Unlock()
+	return uc.heldAll || len(uc.held[conversationID]) > 0
+}
+
+func (uc *MessageUsecase) hold(incoming *IncomingMessage) {
+	uc.heldMu.Lock()
+	defer uc.heldMu.Unlock()
+	if uc.held[incoming.ConversationID] == nil {
+		uc.held[incoming.ConversationID] = map[uuid.UUID]struct{}{}
+	}
+	uc.held[incoming.ConversationID][incoming.ID] = struct{}{}
+}
+
+// release stops a message from holding back its conversation. Messages queued only to
+// retry their mentions or attachments were never held, so releasing them does nothing.
+func (uc *MessageUsecase) release(incoming *IncomingMessage) {
+	uc.heldMu.Lock()
+	defer uc.heldMu.Unlock()
+	delete(uc.held[incoming.ConversationID], incoming.ID)
+	if len(uc.held[incoming.ConversationID]) == 0 {
+		delete(uc.held, incoming.ConversationID)
+	}
+}
+
+// StorageBreaker returns the breaker guarding message writes, for metrics
+func (uc *MessageUsecase) StorageBreaker() *StorageBreaker {
+	return uc.breaker
+}
+
+// DeadLetterCount returns how many messages are waiting to be replayed, for metrics
+func (uc *MessageUsecase) DeadLetterCount() int {
+	if uc.deadLetters == nil {
+		return 0
+	}
+	return uc.deadLetters.Len()
+}
+
+// ReplayDeadLetters stores queued messages once the storage breaker lets writes
+// through again, handing each resulting ack to publish. With the breaker open it does
+// nothing, or sends the first message as the breaker's probe once it may. Messages are stored with their
+// original IDs, so replaying one that did make it to the database is harmless. It
+// stops as soon as the database fails again and returns how many were replayed. Each
+// replayed message stops holding back its conversation; once the queue has been
+// drained through, messages left by an earlier run stop holding back all of them.
+func (uc *MessageUsecase) ReplayDeadLetters(ctx context.Context, publish func(*MessageAck)) (int, error) {
+	if uc.deadLetters == nil || uc.deadLetters.Len() == 0 {
+		return 0, nil
+	}
+
+	replayed := 0
+	err := uc.deadLetters.Drain(func(payload []byte) error {
+		var incoming IncomingMessage
+		if err := json.Unmarshal(payload, &incoming); err != nil {
+			log.Printf("Dropping unreadable dead-lettered message: %v", err)
+			return nil
+		}
+
+		if err := uc.checkSender(ctx, &incoming); err != nil {
+			if errors.Is(err, errStorageUnavailable) {
+				return err
+			}
+			uc.release(&incoming)
+			log.Printf("Dropping dead-lettered message %s: %v", incoming.ID, err)
+			code := AckErrorStorageFailed
+			if errors.Is(err, ErrNotParticipant) {
+				code = AckErrorNotParticipant
+			}
+			publish(failedAck(&incoming, code))
+			replayed++
+			return nil
+		}
+
+		ack, err := uc.storeIncoming(ctx, &incoming)
+		if errors.Is(err, errStorageUnavailable) {
+			return err
+		}
+		uc.release(&incoming)
+		if err != nil {
+			log.Printf("Error replaying message %s: %v", incoming.ID, err)
+		}
+		if errors.Is(err, errFollowUpFailed) {
+			// The message is stored, so it goes to the back of the queue rather than
+			// holding up messages that aren't
+			uc.retryFollowUp(&incoming, payload)
+		}
+		if ack != nil {
+			publish(ack)
+		}
+		replayed++
+		return nil
+	})
+	if err == nil {
+		uc.heldMu.Lock()
+		uc.heldAll = false
+		uc.heldMu.Unlock()
+	}
+	if errors.Is(err, errStorageUnavailable) {
+		err = nil
+	}
+	return replayed, err
+}
@@ -0,0 +1,208 @@
+package biz
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memoryQueue is a DeadLetterQueue kept in memory
+type memoryQueue struct {
+	payloads [][]byte
+}
+
+func (q *memoryQueue) Push(payload []byte) error {
+	q.payloads = append(q.payloads, payload)
+	return nil
+}
+
+func (q *memoryQueue) Drain(handle func(payload []byte) error) error {
+	pending := len(q.payloads)
+	for i := 0; i < pending; i++ {
+		if err := handle(q.payloads[0]); err != nil {
+			return err
+		}
+		q.payloads = q.payloads[1:]
+	}
+	return nil
+}
+
+func (q *memoryQueue) Len() int {
+	return len(q.payloads)
+}
+
+// orderRepo records the order messages are stored in, failing every write while down
+type orderRepo struct {
+	MessageRepo
+	down   bool
+	stored []uuid.UUID
+}
+
+func (r *orderRepo) CreateMessage(ctx context.Context, message *Message) (bool, error) {
+	if r.down {
+		return false, driver.ErrBadConn
+	}
+	r.stored = append(r.stored, message.ID)
+	message.Seq = int64(len(r.stored))
+	return true, nil
+}
+
+func (r *orderRepo) GetParticipantDisplayName(ctx context.Context, conversationID, userID uuid.UUID) (string, error) {
+	if r.down {
+		return "", driver.ErrBadConn
+	}
+	return "Participant", nil
+}
+
+func TestDeadLetterOrdering(t *testing.T) {
+	affected, other := uuid.New(), uuid.New()
+
+	type step struct {
+		conversationID uuid.UUID
+		// down makes the database fail while this message is processed
+		down       bool
+		wantStatus AckStatus
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+		// wantStored lists the steps in the order their messages should end up stored
+		wantStored []int
+		// queuedBefore is how many messages an earlier run left in the queue, stored
+		// ahead of the steps
+		queuedBefore int
+	}{
+		{
+			name: "later message of a queued conversation waits its turn",
+			steps: []step{
+				{affected, true, AckStatusQueued},
+				{affected, false, AckStatusQueued},
+			},
+			wantStored: []int{0, 1},
+		},
+		{
+			name: "other conversations aren't held back",
+			steps: []step{
+				{affected, true, AckStatusQueued},
+				{other, false, AckStatusPersisted},
+				{affected, false, AckStatusQueued},
+			},
+			wantStored: []int{1, 0, 2},
+		},
+		{
+			name: "queue left by an earlier run holds back every conversation",
+			steps: []step{
+				{other, false, AckStatusQueued},
+			},
+			queuedBefore: 1,
+			wantStored:   []int{0},
+		},
+		{
+			name: "nothing queued",
+			steps: []step{
+				{affected, false, AckStatusPersisted},
+				{affected, false, AckStatusPersisted},
+			},
+			wantStored: []int{0, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := &memoryQueue{}
+			var want []uuid.UUID
+			for i := 0; i < tt.queuedBefore; i++ {
+				earlier := IncomingMessage{ID: uuid.New(), ConversationID: uuid.New(), SenderID: uuid.New(), SentAt: time.Now()}
+				payload, _ := json.Marshal(earlier)
+				queue.Push(payload)
+				want = append(want, earlier.ID)
+			}
+			repo := &orderRepo{}
+			uc := NewMessageUsecase(repo, nil, nil, queue)
+
+			ids := make([]uuid.UUID, len(tt.steps))
+			for i, s := range tt.steps {
+				ids[i] = uuid.New()
+				payload, err := json.Marshal(IncomingMessage{ID: ids[i], ConversationID: s.conversationID, SenderID: uuid.New(),
+					ContentType: "text", Content: "hello", SentAt: time.Now()})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				repo.down = s.down
+				ack, err := uc.ProcessIncomingMessage(context.Background(), s.conversationID, payload)
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if ack.Status != s.wantStatus {
+					t.Fatalf("step %d: got ack %s, want %s", i, ack.Status, s.wantStatus)
+				}
+			}
+
+			repo.down = false
+			if _, err := uc.ReplayDeadLetters(context.Background(), func(*MessageAck) {}); err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range tt.wantStored {
+				want = append(want, ids[step])
+			}
+			if len(repo.stored) != len(want) {
+				t.Fatalf("stored %d messages, want %d", len(repo.stored), len(want))
+			}
+			for i := range want {
+				if repo.stored[i] != want[i] {
+					t.Errorf("message %d stored was %s, want %s", i, repo.stored[i], want[i])
+				}
+			}
+			if uc.isHeld(affected) || uc.isHeld(other) {
+				t.Error("conversations still held after the queue was replayed")
+			}
+		})
+	}
+}
+
+func TestRecordRetryNilBreaker(t *testing.T) {
+	var b *StorageBreaker
+	b.RecordRetry(driver.ErrBadConn)
+	if got := b.Retries(); got != 0 {
+		t.Errorf("Retries() = %d, want 0", got)
+	}
+}
+
+func TestShouldRedeliver(t *testing.T) {
+	conversationID := uuid.New()
+	valid := func() []byte {
+		payload, _ := json.Marshal(IncomingMessage{ID: uuid.New(), ConversationID: conversationID, SenderID: uuid.New(),
+			ContentType: "text", Content: "hello", SentAt: time.Now()})
+		return payload
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		down    bool
+		queue   DeadLetterQueue
+		want    bool
+	}{
+		{"database down without a dead letter queue", valid(), true, nil, true},
+		{"database down, dead-lettered", valid(), true, &memoryQueue{}, false},
+		{"stored", valid(), false, nil, false},
+		{"malformed payload", []byte("{"), false, nil, false},
+		{"missing message ID", []byte(`{"conversation_id":"` + conversationID.String() + `","sender_id":"` + uuid.NewString() + `"}`), false, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uc := NewMessageUsecase(&orderRepo{down: tt.down}, nil, nil, tt.queue)
+			_, err := uc.ProcessIncomingMessage(context.Background(), conversationID, tt.payload)
+			if got := err != nil && ShouldRedeliver(err); got != tt.want {
+				t.Errorf("redeliver after %v = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package biz
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/jwtauth"
+)
+
+// Caller is who is reading persisted messages over HTTP. Users only see
+// conversations they take part in; internal callers, authenticated with the shared
+// service secret, can inspect any conversation.
+type Caller struct {
+	UserID         uuid.UUID
+	OrganizationID uuid.UUID
+	Internal       bool
+}
+
+// AuthenticateUser turns the claims of a verified access token into a caller, unless
+// the token has been revoked since it was issued
+func (uc *MessageUsecase) AuthenticateUser(ctx context.Context, claims *jwtauth.Claims) (Caller, error) {
+	var sessionID *uuid.UUID
+	if claims.SessionID != "" {
+		id, err := uuid.Parse(claims.SessionID)
+		if err != nil {
+			return Caller{}, jwtauth.ErrInvalidToken
+		}
+		sessionID = &id
+	}
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+
+	revoked, err := uc.repo.TokenRevoked(ctx, claims.UserID, sessionID, issuedAt)
+	if err != nil {
+		return Caller{}, err
+	}
+	if revoked {
+		return Caller{}, jwtauth.ErrInvalidToken
+	}
+	return Caller{UserID: claims.UserID, OrganizationID: claims.OrganizationID}, nil
+}
+
+// MessageDetail is a message as stored, with its receipts and attachments
+type MessageDetail struct {
+	*Message
+	Receipts    []*Receipt    `json:"receipts"`
+	Attachments []*Attachment `json:"attachments"`
+}
+
+// ListMessages returns a conversation's stored messages, newest first. Users don't see
+// messages past the conversation's retention that are still waiting to be purged.
+func (uc *MessageUsecase) ListMessages(ctx context.Context, caller Caller, conversationID uuid.UUID, limit, offset int) ([]*Message, error) {
+	orgID, err := uc.authorizeConversation(ctx, caller, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	visibleSince, err := uc.visibleSince(ctx, caller, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	return uc.repo.GetMessagesByConversation(ctx, orgID, conversationID, visibleSince, limit, offset)
+}
+
+// CountMessages counts the messages ListMessages would page through
+func (uc *MessageUsecase) CountMessages(ctx context.Context, caller Caller, conversationID uuid.UUID) (int, error) {
+	visibleSince, err := uc.visibleSince(ctx, caller, conversationID)
+	if err != nil {
+		return 0, err
+	}
+	return uc.repo.CountMessagesByConversation(ctx, conversationID, visibleSince)
+}
+
+// GetMessageDetail returns a message with its receipts and attachments
+func (uc *MessageUsecase) GetMessageDetail(ctx context.Context, caller Caller, messageID uuid.UUID) (*MessageDetail, error) {
+	message, err := uc.getAuthorizedMessage(ctx, caller, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	receipts, err := uc.repo.GetReceiptsByMessage(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := uc.repo.GetAttachmentsByMessage(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if receipts == nil {
+		receipts = []*Receipt{}
+	}
+	if attachments == nil {
+		attachments = []*Attachment{}
+	}
+	return &MessageDetail{Message: message, Receipts: receipts, Attachments: attachments}, nil
+}
+
+// GetMessageReceipts returns a message's receipts, most recent first
+func (uc *MessageUsecase) GetMessageReceipts(ctx context.Context, caller Caller, messageID uuid.UUID) ([]*Receipt, error) {
+	if _, err := uc.getAuthorizedMessage(ctx, caller, messageID); err != nil {
+		return nil, err
+	}
+	return uc.repo.GetReceiptsByMessage(ctx, messageID)
+}
+
+func (uc *MessageUsecase) getAuthorizedMessage(ctx context.Context, caller Caller, messageID uuid.UUID) (*Message, error) {
+	message, err := uc.repo.GetMessage(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := uc.authorizeConversation(ctx, caller, message.ConversationID); err != nil {
+		// A message in a conversation the caller can't see doesn't exist for them
+		if err == ErrConversationNotFound {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	visibleSince, err := uc.visibleSince(ctx, caller, message.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	if visibleSince != nil && message.SentAt.Before(*visibleSince) && message.PinnedAt == nil {
+		return nil, ErrMessageNotFound
+	}
+	return message, nil
+}
+
+// visibleSince is when the oldest message a caller may see was sent, applying the
+// conversation's retention as chat-api does; pinned messages are exempt. Internal
+// callers inspect what is actually stored, so for them and for conversations
+// without retention it is nil.
+func (uc *MessageUsecase) visibleSince(ctx context.Context, caller Caller, conversationID uuid.UUID) (*time.Time, error) {
+	if caller.Internal {
+		return nil, nil
+	}
+	days, err := uc.repo.GetRetentionDays(ctx, conversationID)
+	if err != nil || days == nil {
+		return nil, err
+	}
+	since := time.Now().AddDate(0, 0, -*days)
+	return &since, nil
+}
+
+// authorizeConversation checks the caller may read the conversation and returns its
+// organization. Conversations in other organizations are reported as not found.
+func (uc *MessageUsecase) authorizeConversation(ctx context.Context, caller Caller, conversationID uuid.UUID) (uuid.UUID, error) {
+	orgID, err := uc.repo.GetConversationOrganization(ctx, conversationID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if caller.Internal {
+		return orgID, nil
+	}
+	if orgID != caller.OrganizationID {
+		return uuid.Nil, ErrConversationNotFound
+	}
+	if _, err := uc.repo.GetParticipantDisplayName(ctx, conversationID, caller.UserID); err != nil {
+		return uuid.Nil, err
+	}
+	return orgID, nil
+}
@@ -3,11 +3,20 @@ package biz
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/retry"
 )
 
+// Message is a stored message. Seq is its position in the conversation, assigned when
+// it is stored; messages are ordered by it rather than by SentAt.
 type Message struct {
 	ID             uuid.UUID              `json:"id"`
 	ConversationID uuid.UUID              `json:"conversation_id"`
@@ -16,8 +25,11 @@ type Message struct {
 	Content        string                 `json:"content"`
 	Meta           map[string]interface{} `json:"meta,omitempty"`
 	DedupeKey      string                 `json:"dedupe_key,omitempty"`
+	ParentID       *uuid.UUID             `json:"parent_id,omitempty"`
+	Seq            int64                  `json:"seq"`
 	SentAt         time.Time              `json:"sent_at"`
 	EditedAt       *time.Time             `json:"edited_at,omitempty"`
+	PinnedAt       *time.Time             `json:"pinned_at,omitempty"`
 	Deleted        bool                   `json:"deleted"`
 }
 
@@ -29,6 +41,7 @@ type IncomingMessage struct {
 	Content        string                 `json:"content"`
 	Meta           map[string]interface{} `json:"meta,omitempty"`
 	DedupeKey      string                 `json:"dedupe_key,omitempty"`
+	ParentID       *uuid.UUID             `json:"parent_id,omitempty"`
 	SentAt         time.Time              `json:"sent_at"`
 	Deleted        bool                   `json:"deleted"`
 }
@@ -64,35 +77,199 @@ type TypingIndicator struct {
 	Timestamp      time.Time `json:"timestamp"`
 }
 
+// TypingEvent is a typing indicator enriched with the typist's display name, so
+// clients don't have to resolve it themselves
+type TypingEvent struct {
+	ConversationID uuid.UUID `json:"conversation_id"`
+	UserID         uuid.UUID `json:"user_id"`
+	DisplayName    string    `json:"display_name"`
+	IsTyping       bool      `json:"is_typing"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
 type MessageRepo interface {
-	CreateMessage(ctx context.Context, message *Message) error
+	// CreateMessage stores the message and reports whether it was new. If a message
+	// with the same ID or dedupe_key is already stored in the conversation by the same
+	// sender, message is replaced by it; if the ID or dedupe_key is taken by any other
+	// message, ErrMessageIDConflict is returned.
+	CreateMessage(ctx context.Context, message *Message) (bool, error)
 	GetMessage(ctx context.Context, id uuid.UUID) (*Message, error)
-	GetMessagesByConversation(ctx context.Context, conversationID uuid.UUID, limit int, offset int) ([]*Message, error)
+	// GetMessagesByConversation and CountMessagesByConversation leave out messages sent
+	// before visibleSince, unless they are pinned; nil includes every message
+	GetMessagesByConversation(ctx context.Context, orgID, conversationID uuid.UUID, visibleSince *time.Time, limit int, offset int) ([]*Message, error)
+	CountMessagesByConversation(ctx context.Context, conversationID uuid.UUID, visibleSince *time.Time) (int, error)
+	// GetRetentionDays returns the conversation's retention in days, falling back to its
+	// organization's default; nil means messages are kept forever
+	GetRetentionDays(ctx context.Context, conversationID uuid.UUID) (*int, error)
+	// TokenRevoked reports whether an access token issued at issuedAt has been revoked,
+	// either with its session or by revoking all of the user's tokens
+	TokenRevoked(ctx context.Context, userID uuid.UUID, sessionID *uuid.UUID, issuedAt time.Time) (bool, error)
+	// GetParticipantDisplayName returns ErrNotParticipant if the user isn't in the conversation
+	GetParticipantDisplayName(ctx context.Context, conversationID, userID uuid.UUID) (string, error)
 	UpdateMessage(ctx context.Context, message *Message) error
 	DeleteMessage(ctx context.Context, id uuid.UUID) error
 
+	// GetNotifiableParticipants returns those of userIDs who are participants of the
+	// conversation and haven't muted it as of now
+	GetNotifiableParticipants(ctx context.Context, conversationID uuid.UUID, userIDs []uuid.UUID, now time.Time) ([]uuid.UUID, error)
+
+	// CreateMentions records which users a message mentions; users that aren't
+	// participants of the message's conversation are skipped
+	CreateMentions(ctx context.Context, messageID uuid.UUID, userIDs []uuid.UUID) error
+
 	CreateReceipt(ctx context.Context, receipt *Receipt) error
 	GetReceiptsByMessage(ctx context.Context, messageID uuid.UUID) ([]*Receipt, error)
+	// RecordReceipts stores the user's receipts for a message with the given statuses,
+	// keeping existing ones untouched. It reports whether statuses[0] was new.
+	RecordReceipts(ctx context.Context, messageID, userID uuid.UUID, statuses []ReceiptStatus, at time.Time) (bool, error)
+	// CountReceipts returns how many users the message was delivered to and read by
+	CountReceipts(ctx context.Context, messageID uuid.UUID) (delivered, read int, err error)
 
 	CreateAttachment(ctx context.Context, attachment *Attachment) error
 	GetAttachmentsByMessage(ctx context.Context, messageID uuid.UUID) ([]*Attachment, error)
+
+	// GetConversationOrganization returns ErrConversationNotFound if the conversation doesn't exist
+	GetConversationOrganization(ctx context.Context, conversationID uuid.UUID) (uuid.UUID, error)
+	// CreatePendingAttachmentLinks remembers attachments a message is waiting on, and
+	// drops any pending links created before staleBefore
+	CreatePendingAttachmentLinks(ctx context.Context, messageID uuid.UUID, attachmentIDs []uuid.UUID, staleBefore time.Time) error
+	// TakePendingAttachmentLinks removes and returns the messages waiting on an attachment,
+	// leaving out links created before staleBefore
+	TakePendingAttachmentLinks(ctx context.Context, attachmentID uuid.UUID, staleBefore time.Time) ([]*PendingAttachmentLink, error)
 }
 
 type MessageUsecase struct {
-	repo MessageRepo
+	repo  MessageRepo
+	names *displayNameCache
+	// attachments links message attachments in media-service; nil disables linking
+	attachments AttachmentLinker
+	// notifier sends mention and reply notifications; nil disables them
+	notifier UserNotifier
+	// duplicates counts incoming messages that were already stored
+	duplicates uint64
+	// breaker stops writes while the database is failing; deadLetters holds the
+	// messages that arrive meanwhile. A nil deadLetters fails them instead.
+	breaker     *StorageBreaker
+	deadLetters DeadLetterQueue
+	// held maps each conversation to its dead-lettered messages that haven't been
+	// replayed yet. New messages for those conversations are queued behind them, so
+	// replaying doesn't store them out of order. heldAll holds back every conversation
+	// while messages queued by an earlier run, whose conversations aren't known, wait.
+	heldMu  sync.Mutex
+	held    map[uuid.UUID]map[uuid.UUID]struct{}
+	heldAll bool
+}
+
+// DuplicateMessages returns how many incoming messages turned out to be already
+// stored since startup, for metrics
+func (uc *MessageUsecase) DuplicateMessages() uint64 {
+	return atomic.LoadUint64(&uc.duplicates)
 }
 
-func NewMessageUsecase(repo MessageRepo) *MessageUsecase {
+func NewMessageUsecase(repo MessageRepo, attachments AttachmentLinker, breaker *StorageBreaker, deadLetters DeadLetterQueue) *MessageUsecase {
 	return &MessageUsecase{
-		repo: repo,
+		repo:        repo,
+		names:       newDisplayNameCache(displayNameCacheTTL),
+		attachments: attachments,
+		breaker:     breaker,
+		deadLetters: deadLetters,
+		held:        map[uuid.UUID]map[uuid.UUID]struct{}{},
+		heldAll:     deadLetters != nil && deadLetters.Len() > 0,
 	}
 }
 
-func (uc *MessageUsecase) ProcessIncomingMessage(ctx context.Context, payload []byte) error {
+// ProcessIncomingMessage stores a message published on chat/{conversationID}/messages.
+// The returned ack, for the caller to publish, reports whether the message was
+// persisted; it is nil only when the payload is too broken to say who sent what.
+// Messages naming another conversation, or whose sender isn't a participant, are
+// rejected. Messages the database can't take right now are dead-lettered for
+// ReplayDeadLetters and acked as queued, and so are later messages of the same
+// conversation until those are replayed.
+func (uc *MessageUsecase) ProcessIncomingMessage(ctx context.Context, conversationID uuid.UUID, payload []byte) (*MessageAck, error) {
+	return uc.processIncoming(ctx, conversationID, payload, false)
+}
+
+// ProcessSystemMessage stores a system message chat-api published on
+// chat/{conversationID}/system the way ProcessIncomingMessage stores user messages
+func (uc *MessageUsecase) ProcessSystemMessage(ctx context.Context, conversationID uuid.UUID, payload []byte) (*MessageAck, error) {
+	return uc.processIncoming(ctx, conversationID, payload, true)
+}
+
+// processIncoming only accepts content_type system from the system topic, which
+// clients can't publish to, and nothing else there
+func (uc *MessageUsecase) processIncoming(ctx context.Context, conversationID uuid.UUID, payload []byte, system bool) (*MessageAck, error) {
 	var incoming IncomingMessage
 	if err := json.Unmarshal(payload, &incoming); err != nil {
+		return nil, err
+	}
+	if incoming.ConversationID == uuid.Nil || incoming.SenderID == uuid.Nil {
+		return nil, ErrInvalidPayload
+	}
+	if incoming.ID == uuid.Nil {
+		return failedAck(&incoming, AckErrorInvalidPayload), ErrInvalidPayload
+	}
+	if isSystem := incoming.ContentType == ContentTypeSystem; isSystem != system {
+		if isSystem {
+			return failedAck(&incoming, AckErrorSystemMessage), ErrSystemMessage
+		}
+		return failedAck(&incoming, AckErrorInvalidPayload), ErrInvalidPayload
+	}
+	if incoming.ConversationID != conversationID {
+		// Acked on the topic's conversation, not the one the payload claims
+		ack := failedAck(&incoming, AckErrorWrongConversation)
+		ack.ConversationID = conversationID
+		return ack, ErrWrongConversation
+	}
+
+	// Queued messages have their sender checked when they are replayed
+	if uc.isHeld(incoming.ConversationID) {
+		return uc.deadLetter(&incoming, payload, errConversationHeld)
+	}
+
+	if err := uc.checkSender(ctx, &incoming); err != nil {
+		if errors.Is(err, errStorageUnavailable) {
+			return uc.deadLetter(&incoming, payload, err)
+		}
+		if errors.Is(err, ErrNotParticipant) {
+			return failedAck(&incoming, AckErrorNotParticipant), err
+		}
+		return failedAck(&incoming, AckErrorStorageFailed), err
+	}
+
+	ack, err := uc.storeIncoming(ctx, &incoming)
+	if errors.Is(err, errStorageUnavailable) {
+		return uc.deadLetter(&incoming, payload, err)
+	}
+	if errors.Is(err, errFollowUpFailed) {
+		uc.retryFollowUp(&incoming, payload)
+	}
+	return ack, err
+}
+
+// checkSender makes sure the sender of a user message is a participant of its
+// conversation. System messages are exempt: they may record a user leaving. It fails
+// with errStorageUnavailable when the database can't answer right now.
+func (uc *MessageUsecase) checkSender(ctx context.Context, incoming *IncomingMessage) error {
+	if incoming.ContentType == ContentTypeSystem {
+		return nil
+	}
+	if _, err := uc.repo.GetParticipantDisplayName(ctx, incoming.ConversationID, incoming.SenderID); err != nil {
+		if retry.IsRetriable(err) {
+			return fmt.Errorf("%w: %w", errStorageUnavailable, err)
+		}
 		return err
 	}
+	return nil
+}
+
+// storeIncoming persists a validated incoming message along with its mentions and
+// attachment links. It fails with errStorageUnavailable, storing nothing, when the
+// database can't take the message right now, and with errFollowUpFailed when the
+// message was stored but its mentions or attachment links hit a transient failure.
+func (uc *MessageUsecase) storeIncoming(ctx context.Context, incoming *IncomingMessage) (*MessageAck, error) {
+	if !uc.breaker.Allow() {
+		return nil, errStorageUnavailable
+	}
 
 	// Create message with original ID to maintain consistency
 	message := &Message{
@@ -103,27 +280,122 @@ func (uc *MessageUsecase) ProcessIncomingMessage(ctx context.Context, payload []
 		Content:        incoming.Content,
 		Meta:           incoming.Meta,
 		DedupeKey:      incoming.DedupeKey,
+		ParentID:       incoming.ParentID,
 		SentAt:         incoming.SentAt,
 		Deleted:        incoming.Deleted,
 	}
 
-	return uc.repo.CreateMessage(ctx, message)
+	created, err := uc.repo.CreateMessage(ctx, message)
+	if err != nil {
+		uc.breaker.Failure(err)
+		if retry.IsRetriable(err) {
+			return nil, fmt.Errorf("%w: %w", errStorageUnavailable, err)
+		}
+		if errors.Is(err, ErrMessageIDConflict) {
+			return failedAck(incoming, AckErrorIDConflict), err
+		}
+		return failedAck(incoming, AckErrorStorageFailed), err
+	}
+	uc.breaker.Success()
+
+	// The message itself is stored at this point, so later failures don't change the ack
+	ack := persistedAck(message)
+	if !created {
+		// A redelivery or a second publish of the same dedupe_key. message now holds
+		// the stored original, whose mentions and attachments are completed below in
+		// case an earlier attempt failed after storing it.
+		atomic.AddUint64(&uc.duplicates, 1)
+		log.Printf("Message %s in conversation %s is a duplicate of stored message %s", incoming.ID, incoming.ConversationID, message.ID)
+		ack.Duplicate = true
+	} else {
+		// Only the first store notifies, so redeliveries don't notify twice
+		uc.notifyUsers(ctx, message)
+	}
+
+	if err := uc.completeIncoming(ctx, message); err != nil {
+		if retry.IsRetriable(err) || errors.Is(err, ErrAttachmentsUnavailable) {
+			return ack, fmt.Errorf("%w: %w", errFollowUpFailed, err)
+		}
+		return ack, err
+	}
+	return ack, nil
 }
 
-func (uc *MessageUsecase) ProcessTypingIndicator(ctx context.Context, payload []byte) error {
+// completeIncoming records a stored message's mentions and links its attachments.
+// Both are idempotent, so it is safe to run again for a message that already had them.
+func (uc *MessageUsecase) completeIncoming(ctx context.Context, message *Message) error {
+	if mentioned := metaIDs(message.Meta, MetaKeyMentions); len(mentioned) > 0 {
+		if err := uc.repo.CreateMentions(ctx, message.ID, mentioned); err != nil {
+			return err
+		}
+	}
+	return uc.linkAttachments(ctx, message)
+}
+
+// ContentTypeSystem marks server-generated membership and settings messages
+const ContentTypeSystem = "system"
+
+// MetaKeyMentions is the meta key chat-api stores resolved mention user IDs under
+const MetaKeyMentions = "mentions"
+
+// metaIDs reads a list of IDs, such as mentions or attachments, out of message meta,
+// skipping anything that isn't a valid ID
+func metaIDs(meta map[string]interface{}, key string) []uuid.UUID {
+	raw, ok := meta[key].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var ids []uuid.UUID
+	for _, item := range raw {
+		str, ok := item.(string)
+		if !ok {
+			continue
+		}
+		if id, err := uuid.Parse(str); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// ProcessTypingIndicator turns a raw typing indicator userID published on
+// chat/{id}/typing/{userID} into an event carrying the typist's display name, for the
+// caller to fan out. The broker only lets users publish on their own typing topic, so
+// indicators naming anyone else, or from users who aren't participants of the
+// conversation, are rejected.
+func (uc *MessageUsecase) ProcessTypingIndicator(ctx context.Context, conversationID, userID uuid.UUID, payload []byte) (*TypingEvent, error) {
 	var typing TypingIndicator
 	if err := json.Unmarshal(payload, &typing); err != nil {
-		return err
+		return nil, err
 	}
+	if typing.UserID != uuid.Nil && typing.UserID != userID {
+		return nil, ErrWrongTypist
+	}
+	typing.UserID = userID
 
-	// For typing indicators, we typically just broadcast them
-	// without persisting to database
-	// This would be handled by the MQTT publisher
-	return nil
-}
+	displayName, ok := uc.names.get(conversationID, typing.UserID)
+	if !ok {
+		name, err := uc.repo.GetParticipantDisplayName(ctx, conversationID, typing.UserID)
+		if err != nil {
+			return nil, err
+		}
+		uc.names.set(conversationID, typing.UserID, name)
+		displayName = name
+	}
 
-func (uc *MessageUsecase) GetConversationMessages(ctx context.Context, conversationID uuid.UUID, limit int, offset int) ([]*Message, error) {
-	return uc.repo.GetMessagesByConversation(ctx, conversationID, limit, offset)
+	timestamp := typing.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	return &TypingEvent{
+		ConversationID: conversationID,
+		UserID:         typing.UserID,
+		DisplayName:    displayName,
+		IsTyping:       typing.IsTyping,
+		Timestamp:      timestamp,
+	}, nil
 }
 
 func (uc *MessageUsecase) CreateReceipt(ctx context.Context, messageID, userID uuid.UUID, status ReceiptStatus) error {
@@ -148,6 +420,10 @@ func (uc *MessageUsecase) EditMessage(ctx context.Context, messageID uuid.UUID,
 	if message.SenderID != senderID {
 		return ErrUnauthorized
 	}
+	// System messages are a record of what happened and can't be rewritten
+	if message.ContentType == ContentTypeSystem {
+		return ErrImmutableMessage
+	}
 
 	now := time.Now()
 	message.Content = newContent
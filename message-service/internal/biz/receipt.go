@@ -0,0 +1,105 @@
+package biz
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IncomingReceipt is a delivery or read receipt a client publishes on its own
+// chat/{conversationID}/receipts/{userID} topic
+type IncomingReceipt struct {
+	MessageID uuid.UUID `json:"message_id"`
+	// UserID is optional; the reader is the user in the topic, which the broker only
+	// lets that user publish to
+	UserID uuid.UUID     `json:"user_id"`
+	Status ReceiptStatus `json:"status"`
+	At     time.Time     `json:"at"`
+}
+
+// ReceiptEvent announces a new receipt on chat/{conversationID}/receipts together
+// with the message's receipt totals, so every client can update its ticks. Only the
+// services may publish on that topic.
+type ReceiptEvent struct {
+	Type           ReceiptStatus `json:"type"`
+	ConversationID uuid.UUID     `json:"conversation_id"`
+	MessageID      uuid.UUID     `json:"message_id"`
+	UserID         uuid.UUID     `json:"user_id"`
+	At             time.Time     `json:"at"`
+	DeliveredCount int           `json:"delivered_count"`
+	ReadCount      int           `json:"read_count"`
+}
+
+// IsValid reports whether s is a known receipt status
+func (s ReceiptStatus) IsValid() bool {
+	return s == ReceiptStatusDelivered || s == ReceiptStatusRead
+}
+
+// ProcessIncomingReceipt records a receipt userID published on
+// chat/{conversationID}/receipts/{userID} and returns the event to announce for it.
+// A read receipt also records the message as delivered. It returns a nil event, and
+// no error, for anything that needs no announcement: receipts for the reader's own
+// message and duplicates of receipts already recorded.
+func (uc *MessageUsecase) ProcessIncomingReceipt(ctx context.Context, conversationID, userID uuid.UUID, payload []byte) (*ReceiptEvent, error) {
+	var incoming IncomingReceipt
+	if err := json.Unmarshal(payload, &incoming); err != nil {
+		return nil, ErrInvalidPayload
+	}
+	if incoming.UserID == uuid.Nil {
+		incoming.UserID = userID
+	}
+	// A receipt naming someone else is forged, whatever topic it came in on
+	if userID == uuid.Nil || incoming.UserID != userID || incoming.MessageID == uuid.Nil || !incoming.Status.IsValid() {
+		return nil, ErrInvalidPayload
+	}
+
+	message, err := uc.repo.GetMessage(ctx, incoming.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	if message.ConversationID != conversationID {
+		return nil, ErrMessageNotFound
+	}
+	if message.SenderID == incoming.UserID {
+		return nil, nil
+	}
+	if _, err := uc.repo.GetParticipantDisplayName(ctx, conversationID, incoming.UserID); err != nil {
+		return nil, err
+	}
+
+	// Client clocks can't be trusted to be sane, only to be roughly right
+	now := time.Now()
+	at := incoming.At
+	if at.IsZero() || at.After(now) || at.Before(message.SentAt) {
+		at = now
+	}
+
+	statuses := []ReceiptStatus{incoming.Status}
+	if incoming.Status == ReceiptStatusRead {
+		statuses = append(statuses, ReceiptStatusDelivered)
+	}
+	created, err := uc.repo.RecordReceipts(ctx, message.ID, incoming.UserID, statuses, at)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, nil
+	}
+
+	delivered, read, err := uc.repo.CountReceipts(ctx, message.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReceiptEvent{
+		Type:           incoming.Status,
+		ConversationID: conversationID,
+		MessageID:      message.ID,
+		UserID:         incoming.UserID,
+		At:             at,
+		DeliveredCount: delivered,
+		ReadCount:      read,
+	}, nil
+}
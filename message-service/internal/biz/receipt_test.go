@@ -0,0 +1,205 @@
+package biz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// receiptRepo keeps receipts in memory; methods ProcessIncomingReceipt doesn't use
+// are left to the embedded nil interface
+type receiptRepo struct {
+	MessageRepo
+	messages     map[uuid.UUID]*Message
+	participants map[uuid.UUID]bool
+	receipts     map[uuid.UUID]map[uuid.UUID]map[ReceiptStatus]bool
+}
+
+func newReceiptRepo(message *Message, participants ...uuid.UUID) *receiptRepo {
+	r := &receiptRepo{
+		messages:     map[uuid.UUID]*Message{message.ID: message},
+		participants: map[uuid.UUID]bool{},
+		receipts:     map[uuid.UUID]map[uuid.UUID]map[ReceiptStatus]bool{},
+	}
+	for _, id := range participants {
+		r.participants[id] = true
+	}
+	return r
+}
+
+func (r *receiptRepo) GetMessage(ctx context.Context, id uuid.UUID) (*Message, error) {
+	message, ok := r.messages[id]
+	if !ok {
+		return nil, ErrMessageNotFound
+	}
+	return message, nil
+}
+
+func (r *receiptRepo) GetParticipantDisplayName(ctx context.Context, conversationID, userID uuid.UUID) (string, error) {
+	if !r.participants[userID] {
+		return "", ErrNotParticipant
+	}
+	return "someone", nil
+}
+
+func (r *receiptRepo) RecordReceipts(ctx context.Context, messageID, userID uuid.UUID, statuses []ReceiptStatus, at time.Time) (bool, error) {
+	if r.receipts[messageID] == nil {
+		r.receipts[messageID] = map[uuid.UUID]map[ReceiptStatus]bool{}
+	}
+	if r.receipts[messageID][userID] == nil {
+		r.receipts[messageID][userID] = map[ReceiptStatus]bool{}
+	}
+	held := r.receipts[messageID][userID]
+	created := !held[statuses[0]]
+	for _, status := range statuses {
+		held[status] = true
+	}
+	return created, nil
+}
+
+func (r *receiptRepo) CountReceipts(ctx context.Context, messageID uuid.UUID) (int, int, error) {
+	delivered, read := 0, 0
+	for _, held := range r.receipts[messageID] {
+		if held[ReceiptStatusDelivered] {
+			delivered++
+		}
+		if held[ReceiptStatusRead] {
+			read++
+		}
+	}
+	return delivered, read, nil
+}
+
+type receiptStep struct {
+	userID  uuid.UUID
+	payload map[string]interface{}
+	// wantEvent is the status of the announced event, "" for none
+	wantEvent     ReceiptStatus
+	wantErr       error
+	wantDelivered int
+	wantRead      int
+}
+
+func TestProcessIncomingReceipt(t *testing.T) {
+	conversationID := uuid.New()
+	senderID, readerID, otherID := uuid.New(), uuid.New(), uuid.New()
+	message := &Message{ID: uuid.New(), ConversationID: conversationID, SenderID: senderID, SentAt: time.Now().Add(-time.Minute)}
+
+	receipt := func(status ReceiptStatus) map[string]interface{} {
+		return map[string]interface{}{"message_id": message.ID, "status": status}
+	}
+
+	tests := []struct {
+		name  string
+		steps []receiptStep
+	}{
+		{
+			name: "redelivered receipt is recorded once",
+			steps: []receiptStep{
+				{userID: readerID, payload: receipt(ReceiptStatusDelivered), wantEvent: ReceiptStatusDelivered, wantDelivered: 1},
+				{userID: readerID, payload: receipt(ReceiptStatusDelivered)},
+			},
+		},
+		{
+			name: "read counts as delivered once",
+			steps: []receiptStep{
+				{userID: readerID, payload: receipt(ReceiptStatusRead), wantEvent: ReceiptStatusRead, wantDelivered: 1, wantRead: 1},
+				{userID: readerID, payload: receipt(ReceiptStatusDelivered)},
+				{userID: readerID, payload: receipt(ReceiptStatusRead)},
+			},
+		},
+		{
+			name: "delivered then read announces both",
+			steps: []receiptStep{
+				{userID: readerID, payload: receipt(ReceiptStatusDelivered), wantEvent: ReceiptStatusDelivered, wantDelivered: 1},
+				{userID: readerID, payload: receipt(ReceiptStatusRead), wantEvent: ReceiptStatusRead, wantDelivered: 1, wantRead: 1},
+			},
+		},
+		{
+			name: "receipts of different readers are counted separately",
+			steps: []receiptStep{
+				{userID: readerID, payload: receipt(ReceiptStatusRead), wantEvent: ReceiptStatusRead, wantDelivered: 1, wantRead: 1},
+				{userID: otherID, payload: receipt(ReceiptStatusDelivered), wantEvent: ReceiptStatusDelivered, wantDelivered: 2, wantRead: 1},
+			},
+		},
+		{
+			name: "payload naming another user is rejected",
+			steps: []receiptStep{
+				{userID: readerID, payload: map[string]interface{}{"message_id": message.ID, "user_id": otherID, "status": ReceiptStatusRead}, wantErr: ErrInvalidPayload},
+			},
+		},
+		{
+			name: "payload naming the topic's user is accepted",
+			steps: []receiptStep{
+				{userID: readerID, payload: map[string]interface{}{"message_id": message.ID, "user_id": readerID, "status": ReceiptStatusRead}, wantEvent: ReceiptStatusRead, wantDelivered: 1, wantRead: 1},
+			},
+		},
+		{
+			name: "sender's own receipt is ignored",
+			steps: []receiptStep{
+				{userID: senderID, payload: receipt(ReceiptStatusRead)},
+			},
+		},
+		{
+			name: "unknown status is rejected",
+			steps: []receiptStep{
+				{userID: readerID, payload: receipt("seen"), wantErr: ErrInvalidPayload},
+			},
+		},
+		{
+			name: "non-participant is rejected",
+			steps: []receiptStep{
+				{userID: uuid.New(), payload: receipt(ReceiptStatusRead), wantErr: ErrNotParticipant},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newReceiptRepo(message, senderID, readerID, otherID)
+			uc := NewMessageUsecase(repo, nil, nil, nil)
+
+			for i, step := range tt.steps {
+				payload, err := json.Marshal(step.payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				event, err := uc.ProcessIncomingReceipt(context.Background(), conversationID, step.userID, payload)
+				if !errors.Is(err, step.wantErr) {
+					t.Fatalf("step %d: got error %v, want %v", i, err, step.wantErr)
+				}
+				if step.wantEvent == "" {
+					if event != nil {
+						t.Fatalf("step %d: got event %+v, want none", i, event)
+					}
+					continue
+				}
+				if event == nil {
+					t.Fatalf("step %d: got no event, want %s", i, step.wantEvent)
+				}
+				if event.Type != step.wantEvent || event.UserID != step.userID || event.MessageID != message.ID {
+					t.Errorf("step %d: got event %+v", i, event)
+				}
+				if event.DeliveredCount != step.wantDelivered || event.ReadCount != step.wantRead {
+					t.Errorf("step %d: got delivered %d, read %d, want %d, %d", i, event.DeliveredCount, event.ReadCount, step.wantDelivered, step.wantRead)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessIncomingReceiptWrongConversation(t *testing.T) {
+	readerID := uuid.New()
+	message := &Message{ID: uuid.New(), ConversationID: uuid.New(), SenderID: uuid.New(), SentAt: time.Now()}
+	uc := NewMessageUsecase(newReceiptRepo(message, readerID), nil, nil, nil)
+
+	payload, _ := json.Marshal(map[string]interface{}{"message_id": message.ID, "status": ReceiptStatusRead})
+	if _, err := uc.ProcessIncomingReceipt(context.Background(), uuid.New(), readerID, payload); err != ErrMessageNotFound {
+		t.Fatalf("got error %v, want %v", err, ErrMessageNotFound)
+	}
+}
@@ -0,0 +1,68 @@
+package biz
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// displayNameCacheTTL bounds how stale a renamed user's name can be in typing events
+const displayNameCacheTTL = 5 * time.Minute
+
+type displayNameKey struct {
+	conversationID uuid.UUID
+	userID         uuid.UUID
+}
+
+type cachedDisplayName struct {
+	name      string
+	expiresAt time.Time
+}
+
+// displayNameCache remembers participants' display names per conversation. Typing
+// indicators arrive every few seconds while someone types, so without it every one
+// would cost a database lookup. Caching per conversation also caches membership, so
+// a removed participant's indicators are forwarded for at most the TTL.
+type displayNameCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[displayNameKey]cachedDisplayName
+}
+
+func newDisplayNameCache(ttl time.Duration) *displayNameCache {
+	return &displayNameCache{
+		ttl:     ttl,
+		entries: make(map[displayNameKey]cachedDisplayName),
+	}
+}
+
+func (c *displayNameCache) get(conversationID, userID uuid.UUID) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := displayNameKey{conversationID, userID}
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.name, true
+}
+
+func (c *displayNameCache) set(conversationID, userID uuid.UUID, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	// Sweep expired entries as we go so the map doesn't grow without bound
+	for key, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[displayNameKey{conversationID, userID}] = cachedDisplayName{name: name, expiresAt: now.Add(c.ttl)}
+}
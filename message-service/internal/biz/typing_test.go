@@ -0,0 +1,49 @@
+package biz
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestProcessTypingIndicator(t *testing.T) {
+	conversationID := uuid.New()
+	typistID, otherID, strangerID := uuid.New(), uuid.New(), uuid.New()
+
+	tests := []struct {
+		name      string
+		publisher uuid.UUID
+		userID    uuid.UUID
+		wantErr   error
+	}{
+		{"own typing", typistID, typistID, nil},
+		{"user ID left out", typistID, uuid.Nil, nil},
+		{"typing as another participant", typistID, otherID, ErrWrongTypist},
+		{"stranger's typing", strangerID, strangerID, ErrNotParticipant},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &participantRepo{participants: map[uuid.UUID]bool{typistID: true, otherID: true}}
+			uc := NewMessageUsecase(repo, nil, nil, nil)
+			payload, err := json.Marshal(TypingIndicator{ConversationID: conversationID, UserID: tt.userID, IsTyping: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			event, err := uc.ProcessTypingIndicator(context.Background(), conversationID, tt.publisher, payload)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if event.UserID != tt.publisher {
+				t.Errorf("event names %s, want the publisher %s", event.UserID, tt.publisher)
+			}
+		})
+	}
+}
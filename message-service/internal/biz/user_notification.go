@@ -0,0 +1,134 @@
+package biz
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserNotificationType is why a message was sent to a user's personal notification topic
+type UserNotificationType string
+
+const (
+	UserNotificationMention UserNotificationType = "mention"
+	UserNotificationReply   UserNotificationType = "reply"
+)
+
+// metaKeyReplyTo is the meta key chat-api stores the quoted parent snapshot under
+const metaKeyReplyTo = "reply_to"
+
+// UserNotification tells a user about a message addressed to them, on
+// users/{userID}/notifications
+type UserNotification struct {
+	UserID         uuid.UUID            `json:"-"`
+	Type           UserNotificationType `json:"type"`
+	ConversationID uuid.UUID            `json:"conversation_id"`
+	MessageID      uuid.UUID            `json:"message_id"`
+	SenderID       uuid.UUID            `json:"sender_id"`
+	Preview        string               `json:"preview"`
+	Timestamp      time.Time            `json:"timestamp"`
+}
+
+// UserNotifier delivers user notifications, implemented by the MQTT server
+type UserNotifier interface {
+	NotifyUser(notification *UserNotification)
+}
+
+// SetUserNotifier enables mention and reply notifications for newly stored messages
+func (uc *MessageUsecase) SetUserNotifier(notifier UserNotifier) {
+	uc.notifier = notifier
+}
+
+// notifyUsers tells everyone a just-stored message mentions, and the author of the
+// message it replies to, about it. It runs only once the message is committed, so a
+// notification never points at a message that isn't there. The sender, users who
+// left the conversation and those who muted it are skipped; a user who is both
+// mentioned and replied to gets one mention. Failures are only logged since the
+// message itself is stored.
+func (uc *MessageUsecase) notifyUsers(ctx context.Context, message *Message) {
+	if uc.notifier == nil {
+		return
+	}
+
+	targets := make(map[uuid.UUID]UserNotificationType)
+	var order []uuid.UUID
+	for _, userID := range metaIDs(message.Meta, MetaKeyMentions) {
+		if _, ok := targets[userID]; !ok {
+			targets[userID] = UserNotificationMention
+			order = append(order, userID)
+		}
+	}
+	if repliedTo, ok := replyAuthor(message.Meta); ok {
+		if _, ok := targets[repliedTo]; !ok {
+			targets[repliedTo] = UserNotificationReply
+			order = append(order, repliedTo)
+		}
+	}
+	delete(targets, message.SenderID)
+	if len(targets) == 0 {
+		return
+	}
+
+	candidates := make([]uuid.UUID, 0, len(targets))
+	for _, userID := range order {
+		if _, ok := targets[userID]; ok {
+			candidates = append(candidates, userID)
+		}
+	}
+	notifiable, err := uc.repo.GetNotifiableParticipants(ctx, message.ConversationID, candidates, time.Now())
+	if err != nil {
+		log.Printf("Failed to load participants for notifications on message %s: %v", message.ID, err)
+		return
+	}
+	eligible := make(map[uuid.UUID]bool, len(notifiable))
+	for _, userID := range notifiable {
+		eligible[userID] = true
+	}
+
+	preview := messagePreview(message.ContentType, message.Content)
+	for _, userID := range candidates {
+		if !eligible[userID] {
+			continue
+		}
+		uc.notifier.NotifyUser(&UserNotification{
+			UserID:         userID,
+			Type:           targets[userID],
+			ConversationID: message.ConversationID,
+			MessageID:      message.ID,
+			SenderID:       message.SenderID,
+			Preview:        preview,
+			Timestamp:      message.SentAt,
+		})
+	}
+}
+
+// replyAuthor reads the sender of the quoted parent out of message meta
+func replyAuthor(meta map[string]interface{}) (uuid.UUID, bool) {
+	snapshot, ok := meta[metaKeyReplyTo].(map[string]interface{})
+	if !ok {
+		return uuid.Nil, false
+	}
+	str, ok := snapshot["sender_id"].(string)
+	if !ok {
+		return uuid.Nil, false
+	}
+	id, err := uuid.Parse(str)
+	return id, err == nil
+}
+
+// messagePreview shortens content for a notification the way chat-api's push
+// notifications do; encrypted content is opaque, so it gets a placeholder
+func messagePreview(contentType, content string) string {
+	if contentType == "encrypted" || contentType == "sender-key" {
+		return "Encrypted message"
+	}
+
+	const maxPreview = 100
+	runes := []rune(content)
+	if len(runes) <= maxPreview {
+		return content
+	}
+	return string(runes[:maxPreview]) + "…"
+}
@@ -0,0 +1,139 @@
+package biz
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// notifyRepo stores messages and knows which users are participants and which of
+// them muted the conversation
+type notifyRepo struct {
+	MessageRepo
+	participants map[uuid.UUID]bool
+	muted        map[uuid.UUID]bool
+	stored       map[uuid.UUID]bool
+}
+
+func (r *notifyRepo) CreateMessage(ctx context.Context, message *Message) (bool, error) {
+	if r.stored[message.ID] {
+		return false, nil
+	}
+	r.stored[message.ID] = true
+	return true, nil
+}
+
+func (r *notifyRepo) CreateMentions(ctx context.Context, messageID uuid.UUID, userIDs []uuid.UUID) error {
+	return nil
+}
+
+func (r *notifyRepo) GetNotifiableParticipants(ctx context.Context, conversationID uuid.UUID, userIDs []uuid.UUID, now time.Time) ([]uuid.UUID, error) {
+	var notifiable []uuid.UUID
+	for _, userID := range userIDs {
+		if r.participants[userID] && !r.muted[userID] {
+			notifiable = append(notifiable, userID)
+		}
+	}
+	return notifiable, nil
+}
+
+// recordingNotifier keeps the notifications it was asked to send
+type recordingNotifier struct {
+	sent []*UserNotification
+}
+
+func (n *recordingNotifier) NotifyUser(notification *UserNotification) {
+	n.sent = append(n.sent, notification)
+}
+
+func TestNotifyUsers(t *testing.T) {
+	senderID, alice, bob, muted, outsider := uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	replyTo := func(id uuid.UUID) map[string]interface{} {
+		return map[string]interface{}{"message_id": uuid.NewString(), "sender_id": id.String()}
+	}
+
+	type sent struct {
+		userID uuid.UUID
+		kind   UserNotificationType
+	}
+	tests := []struct {
+		name string
+		meta map[string]interface{}
+		// redelivered stores the message a second time
+		redelivered bool
+		want        []sent
+	}{
+		{
+			name: "mentions and reply",
+			meta: map[string]interface{}{
+				MetaKeyMentions: []interface{}{alice.String()},
+				metaKeyReplyTo:  replyTo(bob),
+			},
+			want: []sent{{alice, UserNotificationMention}, {bob, UserNotificationReply}},
+		},
+		{
+			name: "mentioned and replied to gets one mention",
+			meta: map[string]interface{}{
+				MetaKeyMentions: []interface{}{alice.String()},
+				metaKeyReplyTo:  replyTo(alice),
+			},
+			want: []sent{{alice, UserNotificationMention}},
+		},
+		{
+			name: "sender, muted and former participants are skipped",
+			meta: map[string]interface{}{
+				MetaKeyMentions: []interface{}{senderID.String(), muted.String()},
+				metaKeyReplyTo:  replyTo(outsider),
+			},
+		},
+		{
+			name:        "redelivery doesn't notify again",
+			meta:        map[string]interface{}{MetaKeyMentions: []interface{}{alice.String()}},
+			redelivered: true,
+			want:        []sent{{alice, UserNotificationMention}},
+		},
+		{
+			name: "nothing addressed to anyone",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &notifyRepo{
+				participants: map[uuid.UUID]bool{senderID: true, alice: true, bob: true, muted: true},
+				muted:        map[uuid.UUID]bool{muted: true},
+				stored:       map[uuid.UUID]bool{},
+			}
+			notifier := &recordingNotifier{}
+			uc := NewMessageUsecase(repo, nil, nil, nil)
+			uc.SetUserNotifier(notifier)
+
+			incoming := &IncomingMessage{ID: uuid.New(), ConversationID: uuid.New(), SenderID: senderID,
+				ContentType: "text", Content: "hello", Meta: tt.meta, SentAt: time.Now()}
+			attempts := 1
+			if tt.redelivered {
+				attempts = 2
+			}
+			for i := 0; i < attempts; i++ {
+				if _, err := uc.storeIncoming(context.Background(), incoming); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if len(notifier.sent) != len(tt.want) {
+				t.Fatalf("sent %d notifications, want %d", len(notifier.sent), len(tt.want))
+			}
+			for i, want := range tt.want {
+				got := notifier.sent[i]
+				if got.UserID != want.userID || got.Type != want.kind {
+					t.Errorf("notification %d went to %s as %s, want %s as %s", i, got.UserID, got.Type, want.userID, want.kind)
+				}
+				if got.MessageID != incoming.ID || got.Preview != "hello" {
+					t.Errorf("notification %d doesn't describe the message: %+v", i, got)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/message-service/internal/conf"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/database"
 
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/google/wire"
@@ -15,16 +16,7 @@ var ProviderSet = wire.NewSet(NewData, NewMessageRepo, NewDB)
 
 // NewDB creates a database connection
 func NewDB(c *conf.Data) (*sql.DB, error) {
-	db, err := sql.Open(c.Database.Driver, c.Database.Source)
-	if err != nil {
-		return nil, err
-	}
-	
-	if err := db.Ping(); err != nil {
-		return nil, err
-	}
-	
-	return db, nil
+	return database.Open(c.Database.Driver, c.Database.Source, database.DefaultPoolConfig())
 }
 
 // Data .
@@ -0,0 +1,100 @@
+package data
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/message-service/internal/biz"
+)
+
+// fileDeadLetterQueue keeps each dead-lettered message in its own file, named so
+// that they sort oldest first. Files are written under a temporary name and renamed
+// into place, so a crash never leaves a partial message behind.
+type fileDeadLetterQueue struct {
+	dir string
+	// mu serialises Drain so one message isn't replayed twice concurrently
+	mu    sync.Mutex
+	seq   uint64
+	count int64
+}
+
+// NewFileDeadLetterQueue stores dead-lettered messages in dir, creating it if needed.
+// Messages already there from a previous run are kept for replay.
+func NewFileDeadLetterQueue(dir string) (biz.DeadLetterQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	q := &fileDeadLetterQueue{dir: dir}
+	names, err := q.list()
+	if err != nil {
+		return nil, err
+	}
+	q.count = int64(len(names))
+	return q, nil
+}
+
+func (q *fileDeadLetterQueue) Push(payload []byte) error {
+	name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), atomic.AddUint64(&q.seq, 1)%1000000)
+	tmp := filepath.Join(q.dir, "."+name)
+	if err := os.WriteFile(tmp, payload, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	atomic.AddInt64(&q.count, 1)
+	return nil
+}
+
+func (q *fileDeadLetterQueue) Drain(handle func(payload []byte) error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	names, err := q.list()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		path := filepath.Join(q.dir, name)
+		payload, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := handle(payload); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		atomic.AddInt64(&q.count, -1)
+	}
+	return nil
+}
+
+func (q *fileDeadLetterQueue) Len() int {
+	return int(atomic.LoadInt64(&q.count))
+}
+
+// list returns the queued message files, oldest first, skipping ones still being written
+func (q *fileDeadLetterQueue) list() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
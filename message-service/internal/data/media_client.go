@@ -0,0 +1,67 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/message-service/internal/biz"
+)
+
+type mediaClient struct {
+	baseURL        string
+	internalSecret string
+	httpClient     *http.Client
+}
+
+// NewMediaClient creates a client for media-service's internal HTTP API
+func NewMediaClient(baseURL, internalSecret string) biz.AttachmentLinker {
+	return &mediaClient{
+		baseURL:        baseURL,
+		internalSecret: internalSecret,
+		httpClient:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *mediaClient) LinkMessageAttachments(ctx context.Context, messageID, orgID, senderID uuid.UUID, attachmentIDs []uuid.UUID) (*biz.AttachmentLinkResult, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"organization_id": orgID,
+		"sender_id":       senderID,
+		"attachment_ids":  attachmentIDs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/internal/messages/%s/attachments", c.baseURL, messageID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Internal-Secret", c.internalSecret)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("%w: media service returned status %d", biz.ErrAttachmentsUnavailable, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("media service returned status %d", resp.StatusCode)
+	}
+
+	var result biz.AttachmentLinkResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -4,34 +4,128 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"time"
 
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/message-service/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/retry"
 )
 
 type messageRepo struct {
-	db *sql.DB
+	db    *sql.DB
+	retry retry.Config
 }
 
-func NewMessageRepo(db *sql.DB) biz.MessageRepo {
-	return &messageRepo{db: db}
+func NewMessageRepo(db *sql.DB, retryConfig retry.Config) biz.MessageRepo {
+	return &messageRepo{db: db, retry: retryConfig}
 }
 
-func (r *messageRepo) CreateMessage(ctx context.Context, message *biz.Message) error {
+// CreateMessage assigns the message the conversation's next seq and stores it in one
+// transaction. Bumping the counter locks the conversation's sequence row until commit,
+// so concurrent messages get their seqs in commit order and a reader who has seen seq
+// N will never later find a new message below N. A message already stored under the
+// same ID or dedupe_key rolls back, leaving no gap; message is then replaced by the
+// stored original and false is returned.
+func (r *messageRepo) CreateMessage(ctx context.Context, message *biz.Message) (bool, error) {
 	metaJSON, _ := json.Marshal(message.Meta)
 
-	query := `
-		INSERT INTO messages (id, conversation_id, sender_id, content_type, content, meta, dedupe_key, sent_at, deleted)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-		ON CONFLICT (conversation_id, dedupe_key) WHERE dedupe_key IS NOT NULL DO NOTHING`
+	nextSeq := `
+		INSERT INTO conversation_sequences (conversation_id, last_seq)
+		VALUES ($1, 1)
+		ON CONFLICT (conversation_id) DO UPDATE SET last_seq = conversation_sequences.last_seq + 1
+		RETURNING last_seq`
+
+	// The conversation's last_message_at and updated_at are bumped in the same statement
+	// so the conversation list can order by activity without scanning messages. A
+	// concurrent insert of the same message blocks the conflict check until it commits,
+	// so only one of them is stored.
+	insert := `
+		WITH inserted AS (
+			INSERT INTO messages (id, conversation_id, sender_id, content_type, content, meta, dedupe_key, parent_id, seq, sent_at, deleted)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			ON CONFLICT DO NOTHING
+			RETURNING conversation_id, sent_at
+		)
+		UPDATE conversations c
+		SET last_message_at = GREATEST(COALESCE(c.last_message_at, inserted.sent_at), inserted.sent_at),
+		    updated_at = GREATEST(c.updated_at, inserted.sent_at)
+		FROM inserted
+		WHERE c.id = inserted.conversation_id`
+
+	// Nothing is committed unless the message is, so transient failures are safe to retry
+	created := false
+	err := retry.Do(ctx, r.retry, func(ctx context.Context) error {
+		tx, err := r.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var seq int64
+		if err := tx.QueryRowContext(ctx, nextSeq, message.ConversationID).Scan(&seq); err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+				return biz.ErrConversationNotFound
+			}
+			return err
+		}
 
-	_, err := r.db.ExecContext(ctx, query,
-		message.ID, message.ConversationID, message.SenderID, message.ContentType,
-		message.Content, metaJSON, message.DedupeKey, message.SentAt, message.Deleted)
+		result, err := tx.ExecContext(ctx, insert,
+			message.ID, message.ConversationID, message.SenderID, message.ContentType,
+			message.Content, metaJSON, message.DedupeKey, message.ParentID, seq, message.SentAt, message.Deleted)
+		if err != nil {
+			return err
+		}
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if inserted == 0 {
+			tx.Rollback()
+			return r.getStoredDuplicate(ctx, message)
+		}
 
-	return err
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		message.Seq = seq
+		created = true
+		return nil
+	})
+	return created, err
+}
+
+// getStoredDuplicate replaces message with the stored message it collided with. Only
+// a message of the same sender in the same conversation counts as a copy; an ID taken
+// in another conversation or by another sender is ErrMessageIDConflict.
+func (r *messageRepo) getStoredDuplicate(ctx context.Context, message *biz.Message) error {
+	var metaJSON []byte
+	query := `
+		SELECT id, conversation_id, sender_id, content_type, content, meta, dedupe_key, parent_id, seq, sent_at, edited_at, deleted
+		FROM messages
+		WHERE conversation_id = $2 AND (id = $1 OR ($3 <> '' AND dedupe_key = $3))
+		ORDER BY id = $1 DESC
+		LIMIT 1`
+
+	stored := &biz.Message{}
+	err := r.db.QueryRowContext(ctx, query, message.ID, message.ConversationID, message.DedupeKey).Scan(
+		&stored.ID, &stored.ConversationID, &stored.SenderID, &stored.ContentType, &stored.Content, &metaJSON,
+		&stored.DedupeKey, &stored.ParentID, &stored.Seq, &stored.SentAt, &stored.EditedAt, &stored.Deleted)
+	if err == sql.ErrNoRows {
+		// The ID is taken in another conversation
+		return biz.ErrMessageIDConflict
+	}
+	if err != nil {
+		return err
+	}
+	if stored.SenderID != message.SenderID {
+		return biz.ErrMessageIDConflict
+	}
+	json.Unmarshal(metaJSON, &stored.Meta)
+
+	*message = *stored
+	return nil
 }
 
 func (r *messageRepo) GetMessage(ctx context.Context, id uuid.UUID) (*biz.Message, error) {
@@ -39,12 +133,12 @@ func (r *messageRepo) GetMessage(ctx context.Context, id uuid.UUID) (*biz.Messag
 	var metaJSON []byte
 
 	query := `
-		SELECT id, conversation_id, sender_id, content_type, content, meta, dedupe_key, sent_at, edited_at, deleted
+		SELECT id, conversation_id, sender_id, content_type, content, meta, dedupe_key, seq, sent_at, edited_at, pinned_at, deleted
 		FROM messages WHERE id = $1 AND deleted = false`
 
 	err := r.db.QueryRowContext(ctx, query, id).Scan(
 		&message.ID, &message.ConversationID, &message.SenderID, &message.ContentType,
-		&message.Content, &metaJSON, &message.DedupeKey, &message.SentAt, &message.EditedAt, &message.Deleted)
+		&message.Content, &metaJSON, &message.DedupeKey, &message.Seq, &message.SentAt, &message.EditedAt, &message.PinnedAt, &message.Deleted)
 
 	if err == sql.ErrNoRows {
 		return nil, biz.ErrMessageNotFound
@@ -57,15 +151,17 @@ func (r *messageRepo) GetMessage(ctx context.Context, id uuid.UUID) (*biz.Messag
 	return message, nil
 }
 
-func (r *messageRepo) GetMessagesByConversation(ctx context.Context, conversationID uuid.UUID, limit int, offset int) ([]*biz.Message, error) {
+func (r *messageRepo) GetMessagesByConversation(ctx context.Context, orgID, conversationID uuid.UUID, visibleSince *time.Time, limit int, offset int) ([]*biz.Message, error) {
 	query := `
-		SELECT id, conversation_id, sender_id, content_type, content, meta, dedupe_key, sent_at, edited_at, deleted
-		FROM messages 
-		WHERE conversation_id = $1 AND deleted = false
-		ORDER BY sent_at DESC
+		SELECT m.id, m.conversation_id, m.sender_id, m.content_type, m.content, m.meta, m.dedupe_key, m.seq, m.sent_at, m.edited_at, m.pinned_at, m.deleted
+		FROM messages m
+		INNER JOIN conversations c ON c.id = m.conversation_id AND c.organization_id = $4
+		WHERE m.conversation_id = $1 AND m.deleted = false
+		  AND ($5::timestamptz IS NULL OR m.sent_at >= $5 OR m.pinned_at IS NOT NULL)
+		ORDER BY m.seq DESC
 		LIMIT $2 OFFSET $3`
 
-	rows, err := r.db.QueryContext(ctx, query, conversationID, limit, offset)
+	rows, err := r.db.QueryContext(ctx, query, conversationID, limit, offset, orgID, visibleSince)
 	if err != nil {
 		return nil, err
 	}
@@ -78,7 +174,7 @@ func (r *messageRepo) GetMessagesByConversation(ctx context.Context, conversatio
 
 		err := rows.Scan(
 			&message.ID, &message.ConversationID, &message.SenderID, &message.ContentType,
-			&message.Content, &metaJSON, &message.DedupeKey, &message.SentAt, &message.EditedAt, &message.Deleted)
+			&message.Content, &metaJSON, &message.DedupeKey, &message.Seq, &message.SentAt, &message.EditedAt, &message.PinnedAt, &message.Deleted)
 		if err != nil {
 			return nil, err
 		}
@@ -90,6 +186,94 @@ func (r *messageRepo) GetMessagesByConversation(ctx context.Context, conversatio
 	return messages, nil
 }
 
+func (r *messageRepo) CountMessagesByConversation(ctx context.Context, conversationID uuid.UUID, visibleSince *time.Time) (int, error) {
+	var total int
+	query := `
+		SELECT COUNT(*) FROM messages
+		WHERE conversation_id = $1 AND deleted = false
+		  AND ($2::timestamptz IS NULL OR sent_at >= $2 OR pinned_at IS NOT NULL)`
+	err := r.db.QueryRowContext(ctx, query, conversationID, visibleSince).Scan(&total)
+	return total, err
+}
+
+// GetRetentionDays resolves retention the way chat-api does: the conversation's own
+// retention_days, else the organization's settings->retention_days
+func (r *messageRepo) GetRetentionDays(ctx context.Context, conversationID uuid.UUID) (*int, error) {
+	var days sql.NullInt64
+	query := `
+		SELECT COALESCE(c.retention_days,
+			CASE WHEN jsonb_typeof(o.settings->'retention_days') = 'number'
+			     THEN (o.settings->>'retention_days')::numeric::int END)
+		FROM conversations c
+		INNER JOIN organizations o ON o.id = c.organization_id
+		WHERE c.id = $1`
+	err := r.db.QueryRowContext(ctx, query, conversationID).Scan(&days)
+	if err == sql.ErrNoRows {
+		return nil, biz.ErrConversationNotFound
+	}
+	if err != nil || !days.Valid || days.Int64 < 1 {
+		return nil, err
+	}
+	value := int(days.Int64)
+	return &value, nil
+}
+
+func (r *messageRepo) TokenRevoked(ctx context.Context, userID uuid.UUID, sessionID *uuid.UUID, issuedAt time.Time) (bool, error) {
+	var revoked bool
+	// iat only has second precision, so revocation times are compared at that precision
+	query := `
+		SELECT NOT EXISTS (SELECT 1 FROM users WHERE id = $1)
+		    OR EXISTS (SELECT 1 FROM users WHERE id = $1 AND date_trunc('second', tokens_revoked_at) > $3)
+		    OR ($2::uuid IS NOT NULL AND NOT EXISTS (
+		        SELECT 1 FROM auth_sessions WHERE id = $2 AND user_id = $1 AND revoked_at IS NULL))`
+	err := r.db.QueryRowContext(ctx, query, userID, sessionID, issuedAt).Scan(&revoked)
+	return revoked, err
+}
+
+func (r *messageRepo) GetParticipantDisplayName(ctx context.Context, conversationID, userID uuid.UUID) (string, error) {
+	var displayName string
+	query := `
+		SELECT u.display_name
+		FROM conversation_participants cp
+		INNER JOIN users u ON u.id = cp.user_id
+		WHERE cp.conversation_id = $1 AND cp.user_id = $2`
+
+	err := r.db.QueryRowContext(ctx, query, conversationID, userID).Scan(&displayName)
+	if err == sql.ErrNoRows {
+		return "", biz.ErrNotParticipant
+	}
+	return displayName, err
+}
+
+func (r *messageRepo) GetNotifiableParticipants(ctx context.Context, conversationID uuid.UUID, userIDs []uuid.UUID, now time.Time) ([]uuid.UUID, error) {
+	query := `
+		SELECT user_id
+		FROM conversation_participants
+		WHERE conversation_id = $1 AND user_id = ANY($2)
+		  AND (muted_until IS NULL OR muted_until <= $3)`
+
+	ids := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = id.String()
+	}
+
+	rows, err := r.db.QueryContext(ctx, query, conversationID, pq.Array(ids), now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifiable []uuid.UUID
+	for rows.Next() {
+		var userID uuid.UUID
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		notifiable = append(notifiable, userID)
+	}
+	return notifiable, rows.Err()
+}
+
 func (r *messageRepo) UpdateMessage(ctx context.Context, message *biz.Message) error {
 	metaJSON, _ := json.Marshal(message.Meta)
 
@@ -110,16 +294,72 @@ func (r *messageRepo) DeleteMessage(ctx context.Context, id uuid.UUID) error {
 	return err
 }
 
+// CreateMentions joins against the conversation's participants so mentions of
+// non-members, or of the sender, are dropped rather than stored
+func (r *messageRepo) CreateMentions(ctx context.Context, messageID uuid.UUID, userIDs []uuid.UUID) error {
+	query := `
+		INSERT INTO message_mentions (message_id, conversation_id, user_id, created_at)
+		SELECT m.id, m.conversation_id, cp.user_id, m.sent_at
+		FROM messages m
+		INNER JOIN conversation_participants cp ON cp.conversation_id = m.conversation_id
+		WHERE m.id = $1 AND cp.user_id = ANY($2) AND cp.user_id <> m.sender_id
+		ON CONFLICT (message_id, user_id) DO NOTHING`
+
+	ids := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = id.String()
+	}
+
+	return retry.Do(ctx, r.retry, func(ctx context.Context) error {
+		_, err := r.db.ExecContext(ctx, query, messageID, pq.Array(ids))
+		return err
+	})
+}
+
 func (r *messageRepo) CreateReceipt(ctx context.Context, receipt *biz.Receipt) error {
 	query := `
 		INSERT INTO message_receipts (id, message_id, user_id, status, at)
 		VALUES ($1, $2, $3, $4, $5)
 		ON CONFLICT (message_id, user_id, status) DO UPDATE SET at = $5`
 
-	_, err := r.db.ExecContext(ctx, query,
-		receipt.ID, receipt.MessageID, receipt.UserID, receipt.Status, receipt.At)
+	return retry.Do(ctx, r.retry, func(ctx context.Context) error {
+		_, err := r.db.ExecContext(ctx, query,
+			receipt.ID, receipt.MessageID, receipt.UserID, receipt.Status, receipt.At)
+		return err
+	})
+}
 
-	return err
+// RecordReceipts never moves an existing receipt's time, so a repeated receipt is a
+// no-op and a late delivered receipt can't claim to come after the read one
+func (r *messageRepo) RecordReceipts(ctx context.Context, messageID, userID uuid.UUID, statuses []biz.ReceiptStatus, at time.Time) (bool, error) {
+	query := `
+		WITH inserted AS (
+			INSERT INTO message_receipts (message_id, user_id, status, at)
+			SELECT $1, $2, s::receipt_status, $4 FROM unnest($3::text[]) AS s
+			ON CONFLICT (message_id, user_id, status) DO NOTHING
+			RETURNING status
+		)
+		SELECT EXISTS (SELECT 1 FROM inserted WHERE status = ($3::text[])[1]::receipt_status)`
+
+	names := make([]string, len(statuses))
+	for i, status := range statuses {
+		names[i] = string(status)
+	}
+
+	var created bool
+	err := retry.Do(ctx, r.retry, func(ctx context.Context) error {
+		return r.db.QueryRowContext(ctx, query, messageID, userID, pq.Array(names), at).Scan(&created)
+	})
+	return created, err
+}
+
+func (r *messageRepo) CountReceipts(ctx context.Context, messageID uuid.UUID) (delivered, read int, err error) {
+	query := `
+		SELECT COUNT(*) FILTER (WHERE status = 'delivered'), COUNT(*) FILTER (WHERE status = 'read')
+		FROM message_receipts WHERE message_id = $1`
+
+	err = r.db.QueryRowContext(ctx, query, messageID).Scan(&delivered, &read)
+	return delivered, read, err
 }
 
 func (r *messageRepo) GetReceiptsByMessage(ctx context.Context, messageID uuid.UUID) ([]*biz.Receipt, error) {
@@ -191,3 +431,60 @@ func (r *messageRepo) GetAttachmentsByMessage(ctx context.Context, messageID uui
 
 	return attachments, nil
 }
+
+func (r *messageRepo) GetConversationOrganization(ctx context.Context, conversationID uuid.UUID) (uuid.UUID, error) {
+	var orgID uuid.UUID
+	query := `SELECT organization_id FROM conversations WHERE id = $1`
+	err := r.db.QueryRowContext(ctx, query, conversationID).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, biz.ErrConversationNotFound
+	}
+	return orgID, err
+}
+
+// CreatePendingAttachmentLinks also clears out stale links, which only build up when
+// clients reference attachments that never get uploaded
+func (r *messageRepo) CreatePendingAttachmentLinks(ctx context.Context, messageID uuid.UUID, attachmentIDs []uuid.UUID, staleBefore time.Time) error {
+	query := `
+		WITH purged AS (
+			DELETE FROM pending_attachment_links WHERE created_at < $3
+		)
+		INSERT INTO pending_attachment_links (attachment_id, message_id, created_at)
+		SELECT unnest($2::uuid[]), $1, now()
+		ON CONFLICT (attachment_id, message_id) DO NOTHING`
+
+	ids := make([]string, len(attachmentIDs))
+	for i, id := range attachmentIDs {
+		ids[i] = id.String()
+	}
+
+	return retry.Do(ctx, r.retry, func(ctx context.Context) error {
+		_, err := r.db.ExecContext(ctx, query, messageID, pq.Array(ids), staleBefore)
+		return err
+	})
+}
+
+func (r *messageRepo) TakePendingAttachmentLinks(ctx context.Context, attachmentID uuid.UUID, staleBefore time.Time) ([]*biz.PendingAttachmentLink, error) {
+	query := `
+		DELETE FROM pending_attachment_links p
+		USING messages m, conversations c
+		WHERE p.attachment_id = $1 AND p.created_at >= $2
+		  AND m.id = p.message_id AND c.id = m.conversation_id
+		RETURNING p.message_id, m.sender_id, c.organization_id`
+
+	rows, err := r.db.QueryContext(ctx, query, attachmentID, staleBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []*biz.PendingAttachmentLink
+	for rows.Next() {
+		link := &biz.PendingAttachmentLink{}
+		if err := rows.Scan(&link.MessageID, &link.SenderID, &link.OrganizationID); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
@@ -0,0 +1,165 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/message-service/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/retry"
+)
+
+// openTestDB connects to the database named by TEST_DATABASE_URL, which must have
+// scripts/init.sql loaded. Tests that need it are skipped when it isn't set.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// seedConversation creates an organization with the given number of users and one
+// conversation between them, removed again when the test ends
+func seedConversation(t *testing.T, db *sql.DB, users int) (conversationID uuid.UUID, userIDs []uuid.UUID) {
+	t.Helper()
+	ctx := context.Background()
+
+	orgID := uuid.New()
+	if _, err := db.ExecContext(ctx, `INSERT INTO organizations (id, name) VALUES ($1, 'dedupe test')`, orgID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM organizations WHERE id = $1`, orgID) })
+
+	for i := 0; i < users; i++ {
+		userID := uuid.New()
+		if _, err := db.ExecContext(ctx, `INSERT INTO users (id, organization_id, email, display_name) VALUES ($1, $2, $3, 'tester')`,
+			userID, orgID, userID.String()+"@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	conversationID = uuid.New()
+	if _, err := db.ExecContext(ctx, `INSERT INTO conversations (id, organization_id, type, created_by) VALUES ($1, $2, 'GROUP', $3)`,
+		conversationID, orgID, userIDs[0]); err != nil {
+		t.Fatal(err)
+	}
+	return conversationID, userIDs
+}
+
+func TestCreateMessageConcurrentDedupe(t *testing.T) {
+	db := openTestDB(t)
+	// Each instance of message-service has its own connection pool
+	other := openTestDB(t)
+	instances := []biz.MessageRepo{NewMessageRepo(db, retry.DefaultConfig()), NewMessageRepo(other, retry.DefaultConfig())}
+
+	conversationID, users := seedConversation(t, db, 1)
+
+	for round := 0; round < 20; round++ {
+		dedupeKey := uuid.NewString()
+		messages := make([]*biz.Message, len(instances))
+		created := make([]bool, len(instances))
+		errs := make([]error, len(instances))
+
+		var start, done sync.WaitGroup
+		start.Add(1)
+		for i, repo := range instances {
+			messages[i] = &biz.Message{
+				ID:             uuid.New(),
+				ConversationID: conversationID,
+				SenderID:       users[0],
+				ContentType:    "text",
+				Content:        "hello",
+				DedupeKey:      dedupeKey,
+				SentAt:         time.Now(),
+			}
+			done.Add(1)
+			go func(i int, repo biz.MessageRepo) {
+				defer done.Done()
+				start.Wait()
+				created[i], errs[i] = repo.CreateMessage(context.Background(), messages[i])
+			}(i, repo)
+		}
+		start.Done()
+		done.Wait()
+
+		for i, err := range errs {
+			if err != nil {
+				t.Fatalf("round %d, instance %d: %v", round, i, err)
+			}
+		}
+		if created[0] == created[1] {
+			t.Fatalf("round %d: created = %v, want exactly one", round, created)
+		}
+		if messages[0].ID != messages[1].ID || messages[0].Seq != messages[1].Seq {
+			t.Fatalf("round %d: instances disagree on the stored message: %s/%d and %s/%d",
+				round, messages[0].ID, messages[0].Seq, messages[1].ID, messages[1].Seq)
+		}
+
+		var count int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM messages WHERE conversation_id = $1 AND dedupe_key = $2`, conversationID, dedupeKey).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Fatalf("round %d: %d messages stored, want 1", round, count)
+		}
+	}
+}
+
+func TestCreateMessageForeignCollision(t *testing.T) {
+	db := openTestDB(t)
+	repo := NewMessageRepo(db, retry.DefaultConfig())
+
+	conversationID, users := seedConversation(t, db, 2)
+	otherConversationID, otherUsers := seedConversation(t, db, 1)
+
+	stored := &biz.Message{ID: uuid.New(), ConversationID: conversationID, SenderID: users[0],
+		ContentType: "text", Content: "original", DedupeKey: "key-1", SentAt: time.Now()}
+	if _, err := repo.CreateMessage(context.Background(), stored); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		message biz.Message
+		wantErr error
+	}{
+		{"redelivery", biz.Message{ID: stored.ID, ConversationID: conversationID, SenderID: users[0], DedupeKey: "key-1"}, nil},
+		{"same dedupe_key under a new ID", biz.Message{ID: uuid.New(), ConversationID: conversationID, SenderID: users[0], DedupeKey: "key-1"}, nil},
+		{"ID reused in another conversation", biz.Message{ID: stored.ID, ConversationID: otherConversationID, SenderID: otherUsers[0]}, biz.ErrMessageIDConflict},
+		{"ID reused by another sender", biz.Message{ID: stored.ID, ConversationID: conversationID, SenderID: users[1]}, biz.ErrMessageIDConflict},
+		{"dedupe_key reused by another sender", biz.Message{ID: uuid.New(), ConversationID: conversationID, SenderID: users[1], DedupeKey: "key-1"}, biz.ErrMessageIDConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message := tt.message
+			message.ContentType, message.Content, message.SentAt = "text", "copy", time.Now()
+
+			created, err := repo.CreateMessage(context.Background(), &message)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if created {
+				t.Fatal("stored a second message")
+			}
+			if err == nil && (message.ID != stored.ID || message.Content != "original") {
+				t.Errorf("got message %s %q, want the stored original", message.ID, message.Content)
+			}
+		})
+	}
+}
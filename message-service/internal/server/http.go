@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/message-service/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/jwtauth"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/pagination"
+)
+
+// HTTPServer serves what message-service has persisted, independently of chat-api,
+// so operations can check what was actually stored
+type HTTPServer struct {
+	messageUc      *biz.MessageUsecase
+	tokens         *jwtauth.Verifier
+	internalSecret string
+	router         *mux.Router
+}
+
+// NewHTTPServer creates the read API. User requests are authenticated with tokens.
+// Requests sending internalSecret in X-Internal-Secret are treated as internal and
+// bypass participant checks; with internalSecret empty only user requests are accepted.
+func NewHTTPServer(messageUc *biz.MessageUsecase, tokens *jwtauth.Verifier, internalSecret string) *HTTPServer {
+	s := &HTTPServer{
+		messageUc:      messageUc,
+		tokens:         tokens,
+		internalSecret: internalSecret,
+		router:         mux.NewRouter(),
+	}
+	s.setupRoutes()
+	return s
+}
+
+func (s *HTTPServer) setupRoutes() {
+	api := s.router.PathPrefix("/api/v1").Subrouter()
+
+	api.HandleFunc("/conversations/{id}/messages", s.authMiddleware(s.handleListMessages)).Methods("GET")
+	api.HandleFunc("/messages/{id}", s.authMiddleware(s.handleGetMessage)).Methods("GET")
+	api.HandleFunc("/messages/{id}/receipts", s.authMiddleware(s.handleGetReceipts)).Methods("GET")
+}
+
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+func (s *HTTPServer) handleListMessages(w http.ResponseWriter, r *http.Request) {
+	conversationID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid conversation ID")
+		return
+	}
+
+	params, err := pagination.Parse(r, 50, 100)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid cursor")
+		return
+	}
+
+	messages, err := s.messageUc.ListMessages(r.Context(), s.getCaller(r.Context()), conversationID, params.Fetch(), params.Offset)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	page := pagination.New(messages, params)
+	if params.IncludeTotal {
+		total, err := s.messageUc.CountMessages(r.Context(), s.getCaller(r.Context()), conversationID)
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+		page.SetTotal(total)
+	}
+
+	s.writeJSON(w, http.StatusOK, page.Body(r))
+}
+
+func (s *HTTPServer) handleGetMessage(w http.ResponseWriter, r *http.Request) {
+	messageID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	message, err := s.messageUc.GetMessageDetail(r.Context(), s.getCaller(r.Context()), messageID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, message)
+}
+
+func (s *HTTPServer) handleGetReceipts(w http.ResponseWriter, r *http.Request) {
+	messageID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	receipts, err := s.messageUc.GetMessageReceipts(r.Context(), s.getCaller(r.Context()), messageID)
+	if err != nil {
+		s.handleError(w, err)
+		return
+	}
+	if receipts == nil {
+		receipts = []*biz.Receipt{}
+	}
+
+	s.writeJSON(w, http.StatusOK, receipts)
+}
+
+func (s *HTTPServer) handleError(w http.ResponseWriter, err error) {
+	switch err {
+	case biz.ErrMessageNotFound:
+		s.writeError(w, http.StatusNotFound, "Message not found")
+	case biz.ErrConversationNotFound:
+		s.writeError(w, http.StatusNotFound, "Conversation not found")
+	case biz.ErrNotParticipant:
+		s.writeError(w, http.StatusForbidden, "Not a participant of this conversation")
+	default:
+		log.Printf("HTTP request failed: %v", err)
+		s.writeError(w, http.StatusInternalServerError, "Internal server error")
+	}
+}
+
+// authMiddleware accepts internal calls carrying the shared service secret, and
+// user calls with an auth-service access token, which identifies the user and
+// their organization
+func (s *HTTPServer) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if secret := r.Header.Get("X-Internal-Secret"); secret != "" {
+			if s.internalSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(s.internalSecret)) != 1 {
+				s.writeError(w, http.StatusUnauthorized, "Invalid internal secret")
+				return
+			}
+			ctx := context.WithValue(r.Context(), "caller", biz.Caller{Internal: true})
+			next(w, r.WithContext(ctx))
+			return
+		}
+
+		token, ok := jwtauth.BearerToken(r)
+		if !ok {
+			s.writeError(w, http.StatusUnauthorized, "Authorization header required")
+			return
+		}
+		claims, err := s.tokens.Verify(token)
+		if err != nil {
+			s.writeError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		caller, err := s.messageUc.AuthenticateUser(r.Context(), claims)
+		if err == jwtauth.ErrInvalidToken {
+			s.writeError(w, http.StatusUnauthorized, "Invalid token")
+			return
+		}
+		if err != nil {
+			s.handleError(w, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "caller", caller)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func (s *HTTPServer) getCaller(ctx context.Context) biz.Caller {
+	return ctx.Value("caller").(biz.Caller)
+}
+
+func (s *HTTPServer) writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func (s *HTTPServer) writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -2,18 +2,32 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/message-service/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/inflight"
 )
 
 type MQTTServer struct {
-	client    mqtt.Client
-	messageUc *biz.MessageUsecase
+	client       mqtt.Client
+	messageUc    *biz.MessageUsecase
+	topics       []string
+	cleanSession bool
+	ackSender    bool
+	// handlers tracks paho callbacks handing messages to the pool so Shutdown can wait for them
+	handlers inflight.Tracker
+	pool     *workerPool
+
+	replayInterval time.Duration
+	stopReplay     chan struct{}
+	replayDone     chan struct{}
 }
 
 type MQTTConfig struct {
@@ -21,26 +35,89 @@ type MQTTConfig struct {
 	Username  string   `yaml:"username"`
 	Password  string   `yaml:"password"`
 	Topics    []string `yaml:"topics"`
+	// ClientID names the broker session, DefaultClientID() if empty; every instance
+	// needs its own and should keep it across restarts. Unless CleanSession is set the session outlives restarts: the
+	// broker keeps the subscriptions and queues QoS 1 messages until the service
+	// reconnects, for as long as its session expiry allows.
+	ClientID     string `yaml:"client_id"`
+	CleanSession bool   `yaml:"clean_session"`
+	// AckSender also publishes persistence acks on users/{senderID}/acks, not just
+	// chat/{conversationID}/acks
+	AckSender bool `yaml:"ack_sender"`
+	// Workers handle messages concurrently, each conversation on one worker so its
+	// messages stay in order. QueueSize messages can wait before the subscription is
+	// held up. Zero values use DefaultWorkers and DefaultQueueSize.
+	Workers   int `yaml:"workers"`
+	QueueSize int `yaml:"queue_size"`
+	// DeadLetterReplayInterval is how often messages dead-lettered while the database
+	// was unavailable are retried, DefaultDeadLetterReplayInterval if zero
+	DeadLetterReplayInterval time.Duration `yaml:"dead_letter_replay_interval"`
+}
+
+// DefaultDeadLetterReplayInterval is used when MQTTConfig leaves DeadLetterReplayInterval unset
+const DefaultDeadLetterReplayInterval = 10 * time.Second
+
+// DefaultClientID is the broker client ID used when MQTTConfig leaves it unset. It
+// includes the hostname, so replicas don't share a session and take turns kicking
+// each other off the broker; deployments whose hostnames change on restart should
+// set a stable ID per replica instead, or the old session's messages are lost.
+func DefaultClientID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		log.Printf("Could not read the hostname for the MQTT client ID: %v", err)
+		return "message-service"
+	}
+	return "message-service-" + hostname
 }
 
+const (
+	// ackPublishAttempts and ackRetryBackoff bound the retries of a failed ack publish;
+	// acks are best effort, so after that the ack is dropped
+	ackPublishAttempts = 3
+	ackRetryBackoff    = 200 * time.Millisecond
+	ackPublishTimeout  = 5 * time.Second
+)
+
 func NewMQTTServer(config MQTTConfig, messageUc *biz.MessageUsecase) *MQTTServer {
+	clientID := config.ClientID
+	if clientID == "" {
+		clientID = DefaultClientID()
+	}
+
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(config.BrokerURL)
-	opts.SetClientID("message-service")
+	opts.SetClientID(clientID)
 	opts.SetUsername(config.Username)
 	opts.SetPassword(config.Password)
-	opts.SetCleanSession(true)
+	opts.SetCleanSession(config.CleanSession)
 	opts.SetAutoReconnect(true)
 	opts.SetConnectRetry(true)
 	opts.SetConnectRetryInterval(5 * time.Second)
+	// Messages are acked once a worker has handled them, not when they are queued, so
+	// whatever was still queued when the service went down is redelivered
+	opts.SetAutoAckDisabled(true)
+
+	replayInterval := config.DeadLetterReplayInterval
+	if replayInterval <= 0 {
+		replayInterval = DefaultDeadLetterReplayInterval
+	}
 
 	server := &MQTTServer{
-		messageUc: messageUc,
+		messageUc:      messageUc,
+		topics:         config.Topics,
+		cleanSession:   config.CleanSession,
+		ackSender:      config.AckSender,
+		replayInterval: replayInterval,
+		stopReplay:     make(chan struct{}),
+		replayDone:     make(chan struct{}),
 	}
+	server.pool = newWorkerPool(config.Workers, config.QueueSize, server.process)
 
 	opts.SetDefaultPublishHandler(server.defaultMessageHandler)
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
-		log.Println("Connected to MQTT broker")
+		// A resumed session still has its subscriptions, but subscribing again is
+		// harmless and covers a session the broker expired while we were away
+		log.Printf("Connected to MQTT broker as %s, subscribing", clientID)
 		server.subscribeToTopics(config.Topics)
 	})
 
@@ -51,23 +128,110 @@ func NewMQTTServer(config MQTTConfig, messageUc *biz.MessageUsecase) *MQTTServer
 	client := mqtt.NewClient(opts)
 	server.client = client
 
+	// A resumed session starts delivering what it queued as soon as the connection is
+	// up, before the subscribe calls return, so the handlers are routed up front
+	for _, topic := range config.Topics {
+		client.AddRoute(topic, server.messageHandler)
+	}
+
 	return server
 }
 
 func (s *MQTTServer) Start() error {
+	s.pool.start()
 	if token := s.client.Connect(); token.Wait() && token.Error() != nil {
 		return fmt.Errorf("failed to connect to MQTT broker: %v", token.Error())
 	}
+	go s.replayDeadLetters()
 	return nil
 }
 
-func (s *MQTTServer) Stop() {
+// replayDeadLetters periodically stores the messages dead-lettered while the database
+// was unavailable and publishes their acks, until Shutdown
+func (s *MQTTServer) replayDeadLetters() {
+	defer close(s.replayDone)
+	ticker := time.NewTicker(s.replayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopReplay:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-s.stopReplay:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		replayed, err := s.messageUc.ReplayDeadLetters(ctx, s.publishAck)
+		cancel()
+		if err != nil {
+			log.Printf("Error replaying dead-lettered messages: %v", err)
+		}
+		if replayed > 0 {
+			log.Printf("Replayed %d dead-lettered messages, %d still queued", replayed, s.messageUc.DeadLetterCount())
+		}
+	}
+}
+
+// Connected reports whether the broker connection is currently up
+func (s *MQTTServer) Connected() bool {
+	return s.client.IsConnectionOpen()
+}
+
+// Shutdown stops taking new messages, lets the workers drain the messages already
+// queued, then disconnects. If ctx ends first the remaining messages are cut off by the
+// disconnect and ctx's error is returned. A persistent session keeps its subscriptions,
+// so messages published from here on wait at the broker for the next start; with a
+// clean session the topics are unsubscribed first.
+func (s *MQTTServer) Shutdown(ctx context.Context) error {
+	if s.cleanSession {
+		if token := s.client.Unsubscribe(s.topics...); !token.WaitTimeout(time.Until(deadlineOf(ctx))) {
+			log.Println("Timed out unsubscribing from MQTT topics")
+		} else if token.Error() != nil {
+			log.Printf("Failed to unsubscribe from MQTT topics: %v", token.Error())
+		}
+	}
+
+	// Anything not replayed yet stays dead-lettered for the next start
+	close(s.stopReplay)
+	select {
+	case <-s.replayDone:
+	case <-ctx.Done():
+	}
+
+	// Callbacks still blocked on a full queue must get their message in before the
+	// queues are closed
+	err := s.handlers.Close(ctx)
+	if err == nil {
+		err = s.pool.close(ctx)
+	}
 	s.client.Disconnect(250)
+	return err
+}
+
+// deadlineOf returns ctx's deadline, or a short default for contexts without one
+func deadlineOf(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return time.Now().Add(5 * time.Second)
 }
 
 func (s *MQTTServer) subscribeToTopics(topics []string) {
 	for _, topic := range topics {
-		if token := s.client.Subscribe(topic, 1, s.messageHandler); token.Wait() && token.Error() != nil {
+		// Typing indicators are stale by the time a restart is over, so they aren't
+		// worth the broker queueing them
+		qos := byte(1)
+		if strings.HasSuffix(topic, "/typing/+") {
+			qos = 0
+		}
+		if token := s.client.Subscribe(topic, qos, s.messageHandler); token.Wait() && token.Error() != nil {
 			log.Printf("Failed to subscribe to topic %s: %v", topic, token.Error())
 		} else {
 			log.Printf("Subscribed to topic: %s", topic)
@@ -75,24 +239,221 @@ func (s *MQTTServer) subscribeToTopics(topics []string) {
 	}
 }
 
+// messageHandler is the paho callback; it only queues the message for a worker
 func (s *MQTTServer) messageHandler(client mqtt.Client, msg mqtt.Message) {
-	topic := msg.Topic()
-	payload := msg.Payload()
+	// Messages that arrive while shutting down are left unacked, so a persistent
+	// session gets them again after the restart
+	if !s.handlers.Enter() {
+		return
+	}
+	defer s.handlers.Exit()
 
+	s.pool.enqueue(msg.Topic(), msg.Payload(), msg.Ack)
+}
+
+// process handles one message on a worker. It reports false when handling failed in
+// a way a redelivery may get past, so the message is left unacked.
+func (s *MQTTServer) process(topic string, payload []byte) bool {
 	log.Printf("Received message on topic %s: %s", topic, string(payload))
 
 	ctx := context.Background()
 
 	// Route message based on topic pattern
-	if strings.Contains(topic, "/messages") {
-		if err := s.messageUc.ProcessIncomingMessage(ctx, payload); err != nil {
+	if strings.HasPrefix(topic, "users/") && strings.HasSuffix(topic, "/attachments") {
+		if err := s.messageUc.ProcessAttachmentStatus(ctx, payload); err != nil {
+			log.Printf("Error processing attachment status: %v", err)
+			return !biz.ShouldRedeliver(err)
+		}
+	} else if strings.HasSuffix(topic, "/system") {
+		conversationID, ok := topicConversationID(topic)
+		if !ok {
+			return true
+		}
+		ack, err := s.messageUc.ProcessSystemMessage(ctx, conversationID, payload)
+		if err != nil {
+			log.Printf("Error processing system message: %v", err)
+		}
+		if ack != nil {
+			s.publishAck(ack)
+		}
+		return err == nil || !biz.ShouldRedeliver(err)
+	} else if strings.Contains(topic, "/messages") {
+		conversationID, ok := topicConversationID(topic)
+		if !ok {
+			return true
+		}
+		ack, err := s.messageUc.ProcessIncomingMessage(ctx, conversationID, payload)
+		if err != nil {
 			log.Printf("Error processing message: %v", err)
 		}
+		if ack != nil {
+			s.publishAck(ack)
+		}
+		return err == nil || !biz.ShouldRedeliver(err)
 	} else if strings.Contains(topic, "/typing") {
-		if err := s.messageUc.ProcessTypingIndicator(ctx, payload); err != nil {
-			log.Printf("Error processing typing indicator: %v", err)
+		// Typing indicators are ephemeral, so a failed one isn't worth redelivering
+		s.handleTypingIndicator(ctx, topic, payload)
+	} else if strings.Contains(topic, "/receipts/") {
+		return s.handleReceipt(ctx, topic, payload)
+	}
+	return true
+}
+
+// topicConversationID reads the conversation ID out of a chat/{id}/... topic
+func topicConversationID(topic string) (uuid.UUID, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 2 || parts[0] != "chat" {
+		return uuid.Nil, false
+	}
+	conversationID, err := uuid.Parse(parts[1])
+	if err != nil {
+		log.Printf("Ignoring message on invalid topic %s", topic)
+		return uuid.Nil, false
+	}
+	return conversationID, true
+}
+
+// handleReceipt records a receipt a client published on chat/{id}/receipts/{userID}
+// and announces it, with the message's updated receipt totals, on chat/{id}/receipts.
+// Clients can't publish there, and it isn't matched by the chat/+/receipts/+
+// subscription, so announcements don't loop back here. It reports false when the
+// receipt couldn't be recorded but may be on redelivery.
+func (s *MQTTServer) handleReceipt(ctx context.Context, topic string, payload []byte) bool {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 4 || parts[2] != "receipts" {
+		return true
+	}
+	conversationID, err := uuid.Parse(parts[1])
+	if err != nil {
+		log.Printf("Ignoring receipt on invalid topic %s", topic)
+		return true
+	}
+	userID, err := uuid.Parse(parts[3])
+	if err != nil {
+		log.Printf("Ignoring receipt on invalid topic %s", topic)
+		return true
+	}
+
+	event, err := s.messageUc.ProcessIncomingReceipt(ctx, conversationID, userID, payload)
+	if err != nil {
+		log.Printf("Error processing receipt on %s: %v", topic, err)
+		return !biz.ShouldRedeliver(err)
+	}
+	if event == nil {
+		return true
+	}
+
+	// The receipt is recorded, so a failed announcement doesn't warrant a redelivery
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding receipt event: %v", err)
+		return true
+	}
+	if err := s.publishWithRetry(fmt.Sprintf("chat/%s/receipts", conversationID), encoded); err != nil {
+		log.Printf("Error publishing receipt event for message %s: %v", event.MessageID, err)
+	}
+	return true
+}
+
+// handleTypingIndicator republishes a typing indicator a client published on
+// chat/{id}/typing/{userID} to chat/{id}/typing/enriched with the typist's display
+// name. The enriched topic is matched by the chat/+/typing/+ subscription too, so
+// those events come back here and are skipped.
+func (s *MQTTServer) handleTypingIndicator(ctx context.Context, topic string, payload []byte) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 4 || parts[2] != "typing" || parts[3] == "enriched" {
+		return
+	}
+	conversationID, err := uuid.Parse(parts[1])
+	if err != nil {
+		log.Printf("Ignoring typing indicator on invalid topic %s", topic)
+		return
+	}
+	userID, err := uuid.Parse(parts[3])
+	if err != nil {
+		log.Printf("Ignoring typing indicator on invalid topic %s", topic)
+		return
+	}
+
+	event, err := s.messageUc.ProcessTypingIndicator(ctx, conversationID, userID, payload)
+	if err != nil {
+		log.Printf("Error processing typing indicator: %v", err)
+		return
+	}
+
+	enriched, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding typing event: %v", err)
+		return
+	}
+
+	// Typing is ephemeral, so QoS 0 like the original indicator
+	token := s.client.Publish(fmt.Sprintf("chat/%s/typing/enriched", conversationID), 0, false, enriched)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Error publishing enriched typing event: %v", token.Error())
+	}
+}
+
+// publishAck tells the conversation, and optionally the sender's own topic, whether a
+// message was persisted. Clients use it to move a message from "sending" to "sent".
+func (s *MQTTServer) publishAck(ack *biz.MessageAck) {
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		log.Printf("Error encoding ack for message %s: %v", ack.MessageID, err)
+		return
+	}
+
+	topics := []string{fmt.Sprintf("chat/%s/acks", ack.ConversationID)}
+	if s.ackSender {
+		topics = append(topics, fmt.Sprintf("users/%s/acks", ack.SenderID))
+	}
+	for _, topic := range topics {
+		if err := s.publishWithRetry(topic, payload); err != nil {
+			log.Printf("Dropping ack for message %s on %s: %v", ack.MessageID, topic, err)
+		}
+	}
+}
+
+// NotifyUser publishes a mention or reply notification on users/{userID}/notifications.
+// Mentions also go to the legacy notifications/{userID}/mentions topic, which clients
+// that haven't moved to the new one still subscribe to; it will be removed once they have.
+func (s *MQTTServer) NotifyUser(notification *biz.UserNotification) {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		log.Printf("Error encoding notification for message %s: %v", notification.MessageID, err)
+		return
+	}
+
+	topics := []string{fmt.Sprintf("users/%s/notifications", notification.UserID)}
+	if notification.Type == biz.UserNotificationMention {
+		topics = append(topics, fmt.Sprintf("notifications/%s/mentions", notification.UserID))
+	}
+	for _, topic := range topics {
+		if err := s.publishWithRetry(topic, payload); err != nil {
+			log.Printf("Dropping %s notification for message %s on %s: %v", notification.Type, notification.MessageID, topic, err)
+		}
+	}
+}
+
+// publishWithRetry publishes at QoS 1, retrying with backoff while the broker is
+// unreachable or slow to confirm
+func (s *MQTTServer) publishWithRetry(topic string, payload []byte) error {
+	var err error
+	backoff := ackRetryBackoff
+	for attempt := 1; attempt <= ackPublishAttempts; attempt++ {
+		token := s.client.Publish(topic, 1, false, payload)
+		if !token.WaitTimeout(ackPublishTimeout) {
+			err = fmt.Errorf("timed out after %s", ackPublishTimeout)
+		} else if err = token.Error(); err == nil {
+			return nil
+		}
+
+		if attempt < ackPublishAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
 		}
 	}
+	return err
 }
 
 func (s *MQTTServer) defaultMessageHandler(client mqtt.Client, msg mqtt.Message) {
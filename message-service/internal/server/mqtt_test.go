@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/message-service/internal/biz"
+)
+
+// storedRepo records the messages stored; methods the incoming message path doesn't
+// use are left to the embedded nil interface
+type storedRepo struct {
+	biz.MessageRepo
+	mu     sync.Mutex
+	stored map[uuid.UUID]bool
+}
+
+func (r *storedRepo) CreateMessage(ctx context.Context, message *biz.Message) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stored[message.ID] {
+		return false, nil
+	}
+	r.stored[message.ID] = true
+	message.Seq = int64(len(r.stored))
+	return true, nil
+}
+
+func (r *storedRepo) GetParticipantDisplayName(ctx context.Context, conversationID, userID uuid.UUID) (string, error) {
+	return "Participant", nil
+}
+
+func (r *storedRepo) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.stored)
+}
+
+func (r *storedRepo) has(id uuid.UUID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stored[id]
+}
+
+// testBroker returns the broker named by TEST_MQTT_BROKER_URL, e.g. the EMQX of
+// docker-compose.dev.yml. Tests that need one are skipped when it isn't set.
+func testBroker(t *testing.T) MQTTConfig {
+	t.Helper()
+	url := os.Getenv("TEST_MQTT_BROKER_URL")
+	if url == "" {
+		t.Skip("TEST_MQTT_BROKER_URL not set")
+	}
+	return MQTTConfig{
+		BrokerURL: url,
+		Username:  os.Getenv("TEST_MQTT_USERNAME"),
+		Password:  os.Getenv("TEST_MQTT_PASSWORD"),
+	}
+}
+
+// TestCatchUpAfterRestart publishes messages while message-service is down and checks
+// the persistent session delivers them once it is back under the same client ID
+func TestCatchUpAfterRestart(t *testing.T) {
+	base := testBroker(t)
+	conversationID := uuid.New()
+	topic := "chat/" + conversationID.String() + "/messages"
+
+	publisher := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(base.BrokerURL).
+		SetClientID("publisher-" + uuid.NewString()).SetUsername(base.Username).SetPassword(base.Password))
+	if token := publisher.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer publisher.Disconnect(250)
+	publish := func(t *testing.T, content string) uuid.UUID {
+		incoming := biz.IncomingMessage{ID: uuid.New(), ConversationID: conversationID, SenderID: uuid.New(),
+			ContentType: "text", Content: content, SentAt: time.Now()}
+		payload, _ := json.Marshal(incoming)
+		if token := publisher.Publish(topic, 1, false, payload); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+		return incoming.ID
+	}
+
+	tests := []struct {
+		name         string
+		cleanSession bool
+		wantCaughtUp bool
+	}{
+		{"persistent session catches up", false, true},
+		{"clean session loses what was published while down", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := base
+			config.ClientID = "message-service-test-" + uuid.NewString()
+			config.Topics = []string{topic}
+			config.CleanSession = tt.cleanSession
+			config.DeadLetterReplayInterval = time.Hour
+			repo := &storedRepo{stored: map[uuid.UUID]bool{}}
+			newServer := func() *MQTTServer {
+				return NewMQTTServer(config, biz.NewMessageUsecase(repo, nil, nil, nil))
+			}
+
+			// The first run establishes the session. It subscribes once connected, so
+			// probes are sent until one is stored.
+			first := newServer()
+			if err := first.Start(); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, func() bool {
+				publish(t, "probe")
+				return repo.count() > 0
+			})
+			shutdown(t, first)
+
+			var ids []uuid.UUID
+			for i := 0; i < 3; i++ {
+				ids = append(ids, publish(t, "sent while down"))
+			}
+
+			second := newServer()
+			if err := second.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer shutdown(t, second)
+
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) && !repo.has(ids[len(ids)-1]) {
+				time.Sleep(50 * time.Millisecond)
+			}
+			for _, id := range ids {
+				if repo.has(id) != tt.wantCaughtUp {
+					t.Errorf("message %s stored = %v, want %v", id, repo.has(id), tt.wantCaughtUp)
+				}
+			}
+
+			// Leave nothing behind on the broker
+			if !tt.cleanSession {
+				cleanup := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(base.BrokerURL).
+					SetClientID(config.ClientID).SetUsername(base.Username).SetPassword(base.Password).SetCleanSession(true))
+				if token := cleanup.Connect(); token.Wait() && token.Error() == nil {
+					cleanup.Disconnect(250)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultClientIDPerInstance(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		t.Skip("no hostname")
+	}
+	if got, want := DefaultClientID(), "message-service-"+hostname; got != want {
+		t.Errorf("DefaultClientID() = %q, want %q", got, want)
+	}
+}
+
+func waitFor(t *testing.T, ready func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ready() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the broker")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func shutdown(t *testing.T, s *MQTTServer) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/message-service/internal/biz"
+)
+
+// Worker pool defaults used when MQTTConfig leaves them unset
+const (
+	DefaultWorkers   = 8
+	DefaultQueueSize = 1024
+)
+
+// job is one MQTT message waiting to be handled. ack is called once it has been, so
+// the broker redelivers messages that were queued but never handled.
+type job struct {
+	topic    string
+	payload  []byte
+	ack      func()
+	enqueued time.Time
+
+	// done and handled are set, under the pool's ackMu, once a worker is finished
+	// with the job; handled is false when it should be left for redelivery
+	done    bool
+	handled bool
+}
+
+// workerPool handles MQTT messages off the paho callback goroutine. Each worker has
+// its own queue and messages are routed by the ID in the topic, so messages for one
+// conversation are always handled in order by the same worker.
+//
+// handle reports whether a message is done with. One that isn't, such as a message
+// that failed to store and couldn't be dead-lettered either, is left unacked so the
+// broker delivers it again when the session resumes. Acks go out in the order
+// messages of a topic arrived, as MQTT expects, however the workers finish.
+type workerPool struct {
+	queues  []chan *job
+	handle  func(topic string, payload []byte) bool
+	workers sync.WaitGroup
+
+	// unacked holds each topic's jobs in arrival order until they can be acked
+	ackMu   sync.Mutex
+	unacked map[string][]*job
+
+	processed    uint64
+	latencyNanos uint64
+}
+
+func newWorkerPool(workers, queueSize int, handle func(topic string, payload []byte) bool) *workerPool {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	perWorker := queueSize / workers
+	if perWorker < 1 {
+		perWorker = 1
+	}
+
+	pool := &workerPool{
+		queues:  make([]chan *job, workers),
+		handle:  handle,
+		unacked: make(map[string][]*job),
+	}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan *job, perWorker)
+	}
+	return pool
+}
+
+func (p *workerPool) start() {
+	for _, queue := range p.queues {
+		p.workers.Add(1)
+		go p.run(queue)
+	}
+}
+
+func (p *workerPool) run(queue chan *job) {
+	defer p.workers.Done()
+	for j := range queue {
+		handled := p.handle(j.topic, j.payload)
+		p.finish(j, handled)
+		atomic.AddUint64(&p.processed, 1)
+		atomic.AddUint64(&p.latencyNanos, uint64(time.Since(j.enqueued)))
+	}
+}
+
+// enqueue hands a message to the worker responsible for its topic. When that worker's
+// queue is full it blocks, which holds up the paho callback and so pushes back on the
+// broker instead of dropping messages. It must be called in the order messages
+// arrive, as the paho callback is.
+func (p *workerPool) enqueue(topic string, payload []byte, ack func()) {
+	j := &job{topic: topic, payload: payload, ack: ack, enqueued: time.Now()}
+
+	p.ackMu.Lock()
+	p.unacked[topic] = append(p.unacked[topic], j)
+	p.ackMu.Unlock()
+
+	p.queues[p.workerFor(topic)] <- j
+}
+
+// finish records that a worker is done with j, then acks the handled jobs at the
+// front of its topic that are no longer waiting on an earlier one. Jobs that weren't
+// handled are skipped without an ack.
+func (p *workerPool) finish(j *job, handled bool) {
+	var acks []func()
+
+	p.ackMu.Lock()
+	j.done, j.handled = true, handled
+	pending := p.unacked[j.topic]
+	for len(pending) > 0 && pending[0].done {
+		if pending[0].handled {
+			acks = append(acks, pending[0].ack)
+		}
+		pending[0] = nil
+		pending = pending[1:]
+	}
+	if len(pending) == 0 {
+		delete(p.unacked, j.topic)
+	} else {
+		p.unacked[j.topic] = pending
+	}
+	p.ackMu.Unlock()
+
+	// Only the worker a topic is routed to finishes its jobs, so acking outside the
+	// lock still keeps them in order
+	for _, ack := range acks {
+		ack()
+	}
+}
+
+// workerFor hashes the second topic segment, the conversation or user ID in every
+// topic message-service subscribes to
+func (p *workerPool) workerFor(topic string) int {
+	key := topic
+	if parts := strings.SplitN(topic, "/", 3); len(parts) >= 2 {
+		key = parts[1]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// close stops the workers once they have drained their queues, or when ctx ends.
+// Nothing may be enqueued after close is called.
+func (p *workerPool) close(ctx context.Context) error {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *workerPool) depth() (depth, capacity int) {
+	for _, queue := range p.queues {
+		depth += len(queue)
+		capacity += cap(queue)
+	}
+	return depth, capacity
+}
+
+// HandleMetrics exposes the MQTT worker pool's queue depth and handling latency, the
+// count of duplicate messages and the health of message storage, in the Prometheus
+// text format
+func (s *MQTTServer) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	depth, capacity := s.pool.depth()
+	processed := atomic.LoadUint64(&s.pool.processed)
+	latency := time.Duration(atomic.LoadUint64(&s.pool.latencyNanos))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP message_service_queue_depth MQTT messages waiting for a worker.\n")
+	fmt.Fprintf(w, "# TYPE message_service_queue_depth gauge\nmessage_service_queue_depth %d\n", depth)
+	fmt.Fprintf(w, "# HELP message_service_queue_capacity MQTT messages that can wait before the subscription is held up.\n")
+	fmt.Fprintf(w, "# TYPE message_service_queue_capacity gauge\nmessage_service_queue_capacity %d\n", capacity)
+	fmt.Fprintf(w, "# HELP message_service_workers Workers handling MQTT messages.\n")
+	fmt.Fprintf(w, "# TYPE message_service_workers gauge\nmessage_service_workers %d\n", len(s.pool.queues))
+	fmt.Fprintf(w, "# HELP message_service_processing_seconds Time from an MQTT message arriving to it being handled, queueing included.\n")
+	fmt.Fprintf(w, "# TYPE message_service_processing_seconds summary\n")
+	fmt.Fprintf(w, "message_service_processing_seconds_sum %f\n", latency.Seconds())
+	fmt.Fprintf(w, "message_service_processing_seconds_count %d\n", processed)
+	fmt.Fprintf(w, "# HELP message_service_duplicate_messages_total Incoming messages that were already stored under the same ID or dedupe key.\n")
+	fmt.Fprintf(w, "# TYPE message_service_duplicate_messages_total counter\nmessage_service_duplicate_messages_total %d\n", s.messageUc.DuplicateMessages())
+
+	breaker := s.messageUc.StorageBreaker()
+	fmt.Fprintf(w, "# HELP message_service_storage_breaker_state Message storage circuit breaker, 1 for its current state.\n")
+	fmt.Fprintf(w, "# TYPE message_service_storage_breaker_state gauge\n")
+	state := breaker.State()
+	for _, candidate := range []biz.BreakerState{biz.BreakerClosed, biz.BreakerOpen, biz.BreakerHalfOpen} {
+		value := 0
+		if candidate == state {
+			value = 1
+		}
+		fmt.Fprintf(w, "message_service_storage_breaker_state{state=\"%s\"} %d\n", candidate, value)
+	}
+	fmt.Fprintf(w, "# HELP message_service_storage_breaker_trips_total Times the message storage circuit breaker opened.\n")
+	fmt.Fprintf(w, "# TYPE message_service_storage_breaker_trips_total counter\nmessage_service_storage_breaker_trips_total %d\n", breaker.Trips())
+	fmt.Fprintf(w, "# HELP message_service_db_retries_total Database writes retried after a transient failure.\n")
+	fmt.Fprintf(w, "# TYPE message_service_db_retries_total counter\nmessage_service_db_retries_total %d\n", breaker.Retries())
+	fmt.Fprintf(w, "# HELP message_service_dead_letter_depth Messages waiting to be stored once the database recovers.\n")
+	fmt.Fprintf(w, "# TYPE message_service_dead_letter_depth gauge\nmessage_service_dead_letter_depth %d\n", s.messageUc.DeadLetterCount())
+}
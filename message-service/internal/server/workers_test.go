@@ -0,0 +1,81 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWorkerPoolAckOrder(t *testing.T) {
+	type finish struct {
+		// index into the enqueued messages
+		index   int
+		handled bool
+	}
+
+	tests := []struct {
+		name     string
+		topics   []string
+		finishes []finish
+		// wantAcks lists the messages acked, in the order they were
+		wantAcks []int
+	}{
+		{
+			name:     "finished in order",
+			topics:   []string{"chat/a/messages", "chat/a/messages", "chat/a/messages"},
+			finishes: []finish{{0, true}, {1, true}, {2, true}},
+			wantAcks: []int{0, 1, 2},
+		},
+		{
+			name:     "later message waits for an earlier one of its topic",
+			topics:   []string{"chat/a/messages", "chat/a/messages", "chat/a/messages"},
+			finishes: []finish{{1, true}, {2, true}, {0, true}},
+			wantAcks: []int{0, 1, 2},
+		},
+		{
+			name:     "other topics aren't held back",
+			topics:   []string{"chat/a/messages", "chat/b/messages", "chat/a/typing"},
+			finishes: []finish{{1, true}, {2, true}, {0, true}},
+			wantAcks: []int{1, 2, 0},
+		},
+		{
+			name:     "unhandled message is left unacked",
+			topics:   []string{"chat/a/messages", "chat/a/messages", "chat/a/messages"},
+			finishes: []finish{{0, false}, {1, true}, {2, false}},
+			wantAcks: []int{1},
+		},
+		{
+			name:     "unhandled message still releases the ones behind it",
+			topics:   []string{"chat/a/messages", "chat/a/messages"},
+			finishes: []finish{{1, true}, {0, false}},
+			wantAcks: []int{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Workers aren't started; the test plays them by finishing jobs itself
+			pool := newWorkerPool(1, len(tt.topics), func(string, []byte) bool { return true })
+
+			var acks []int
+			for i, topic := range tt.topics {
+				i := i
+				pool.enqueue(topic, nil, func() { acks = append(acks, i) })
+			}
+			jobs := make([]*job, len(tt.topics))
+			for i := range jobs {
+				jobs[i] = <-pool.queues[0]
+			}
+
+			for _, f := range tt.finishes {
+				pool.finish(jobs[f.index], f.handled)
+			}
+
+			if !reflect.DeepEqual(acks, tt.wantAcks) {
+				t.Errorf("acked %v, want %v", acks, tt.wantAcks)
+			}
+			if len(pool.unacked) != 0 {
+				t.Errorf("%d topics still waiting for acks", len(pool.unacked))
+			}
+		})
+	}
+}
@@ -14,6 +14,13 @@ import (
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/presence-service/internal/biz"
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/presence-service/internal/data"
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/presence-service/internal/server"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/buildinfo"
+)
+
+// Version and Commit are set at build time with -ldflags "-X main.Version=... -X main.Commit=..."
+var (
+	Version = "dev"
+	Commit  = "unknown"
 )
 
 func main() {
@@ -29,16 +36,38 @@ func main() {
 
 	// Repository
 	presenceRepo := data.NewPresenceRepo(redisClient)
+	roomRepo := data.NewRoomRepo(redisClient)
 
 	// Use case
-	presenceUc := biz.NewPresenceUsecaseFromConfig(presenceRepo)
+	presenceUc := biz.NewPresenceUsecaseFromConfig(presenceRepo, roomRepo)
+
+	// Force-offline kicks clients through the EMQX management API and revokes their
+	// credentials through auth-service's internal API
+	internalSecret := getEnv("INTERNAL_API_SECRET", "")
+	emqxAPIURL := getEnv("EMQX_API_URL", "")
+	if emqxAPIURL == "" || internalSecret == "" {
+		log.Println("Warning: EMQX_API_URL or INTERNAL_API_SECRET is not set; force-offline is disabled")
+	} else {
+		presenceUc.SetForceOfflineEnforcement(
+			data.NewBrokerAdmin(emqxAPIURL, getEnv("EMQX_API_KEY", ""), getEnv("EMQX_API_SECRET", "")),
+			data.NewAuthClient(getEnv("AUTH_SERVICE_INTERNAL_URL", "http://localhost:8100"), internalSecret),
+		)
+	}
+
+	// Conversation presence is only shown to the conversation's participants, checked
+	// with chat-api's internal API
+	if internalSecret == "" {
+		log.Println("Warning: INTERNAL_API_SECRET is not set; conversation presence is disabled")
+	} else {
+		presenceUc.SetMembershipChecker(data.NewChatClient(getEnv("CHAT_API_INTERNAL_URL", "http://localhost:8103"), internalSecret))
+	}
 
 	// MQTT server
 	mqttConfig := server.MQTTConfig{
 		BrokerURL: getEnv("MQTT_BROKER_URL", "tcp://localhost:1883"),
 		Username:  getEnv("MQTT_USERNAME", "presence_service"),
 		Password:  getEnv("MQTT_PASSWORD", "presence_service_password"),
-		Topics:    []string{"presence/+/status", "$SYS/brokers/+/clients/+/connected", "$SYS/brokers/+/clients/+/disconnected"},
+		Topics:    []string{"presence/+/status", "presence/+/heartbeat", "$SYS/brokers/+/clients/+/connected", "$SYS/brokers/+/clients/+/disconnected"},
 	}
 	mqttServer := server.NewMQTTServer(mqttConfig, presenceUc)
 
@@ -46,10 +75,13 @@ func main() {
 	if err := mqttServer.Start(); err != nil {
 		log.Fatal("Failed to start MQTT server:", err)
 	}
-	defer mqttServer.Stop()
+
+	// Reported by GET /info
+	info := buildinfo.New("presence-service", Version, Commit)
+	info.Register("mqtt", buildinfo.Connection(mqttServer.Connected))
 
 	// HTTP server
-	httpServer := server.NewPresenceHTTPServer(presenceUc, mqttServer)
+	httpServer := server.NewPresenceHTTPServer(presenceUc, mqttServer, info, internalSecret)
 
 	// Start server
 	srv := &http.Server{
@@ -74,13 +106,17 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	// Stop taking requests, then let in-flight MQTT handlers finish before disconnecting
 	log.Println("Shutting down server...")
 	cancel() // Stop cleanup routine
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), getEnvDuration("SHUTDOWN_DRAIN_TIMEOUT", 10*time.Second))
 	defer shutdownCancel()
 
 	if err := srv.Shutdown(shutdownCtx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+		log.Printf("Server forced to shutdown: %v", err)
+	}
+	if err := mqttServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("MQTT handlers did not drain in time: %v", err)
 	}
 
 	log.Println("Server exited")
@@ -91,4 +127,13 @@ func getEnv(key, defaultValue string) string {
 		return value
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+		log.Printf("Invalid value for %s: %q, using default %s", key, value, defaultValue)
+	}
+	return defaultValue
+}
@@ -10,12 +10,20 @@ import (
 var (
 	ErrSessionNotFound = errors.New("session not found")
 	ErrUserNotFound    = errors.New("user not found")
+	ErrInvalidExpiry   = errors.New("custom status expiry must be in the future")
+	// ErrForceOfflineUnavailable means the broker management API or auth-service
+	// isn't configured, so a user can't be forced offline
+	ErrForceOfflineUnavailable = errors.New("force offline is not configured")
+	ErrNotParticipant          = errors.New("user is not a participant")
+	// ErrMembershipUnavailable means conversation membership can't be checked because
+	// chat-api isn't configured, so conversation presence is refused
+	ErrMembershipUnavailable = errors.New("conversation membership check is not configured")
 )
 
 // ProviderSet is biz providers.
 var ProviderSet = wire.NewSet(NewPresenceUsecaseFromConfig)
 
 // NewPresenceUsecaseFromConfig creates presence usecase with default config
-func NewPresenceUsecaseFromConfig(repo PresenceRepo) *PresenceUsecase {
-	return NewPresenceUsecase(repo, 30*time.Second, 60*time.Second)
+func NewPresenceUsecaseFromConfig(repo PresenceRepo, rooms RoomRepo) *PresenceUsecase {
+	return NewPresenceUsecase(repo, rooms, 30*time.Second, 60*time.Second)
 }
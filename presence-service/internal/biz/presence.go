@@ -3,6 +3,8 @@ package biz
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -23,6 +25,8 @@ type UserPresence struct {
 	LastSeen     time.Time      `json:"last_seen"`
 	DeviceInfo   string         `json:"device_info,omitempty"`
 	CustomStatus string         `json:"custom_status,omitempty"`
+	// CustomStatusExpiresAt clears CustomStatus once passed; nil keeps it until changed
+	CustomStatusExpiresAt *time.Time `json:"custom_status_expires_at,omitempty"`
 }
 
 type DeviceSession struct {
@@ -34,13 +38,28 @@ type DeviceSession struct {
 	ConnectedAt   time.Time  `json:"connected_at"`
 	DisconnectedAt *time.Time `json:"disconnected_at,omitempty"`
 	LastHeartbeat time.Time  `json:"last_heartbeat"`
+	// IsActive is computed when sessions are listed: connected, with a heartbeat
+	// within the offline timeout
+	IsActive bool `json:"is_active"`
+}
+
+// DeviceSessionFilter narrows and pages a user's device sessions
+type DeviceSessionFilter struct {
+	// ActiveSince marks sessions still connected with a heartbeat at or after it active
+	ActiveSince time.Time
+	// ActiveOnly leaves out sessions that aren't active
+	ActiveOnly bool
+	// Limit of 0 returns every matching session
+	Limit  int
+	Offset int
 }
 
 type PresenceUpdate struct {
-	UserID       uuid.UUID      `json:"user_id"`
-	Status       PresenceStatus `json:"status"`
-	CustomStatus string         `json:"custom_status,omitempty"`
-	Timestamp    time.Time      `json:"timestamp"`
+	UserID                uuid.UUID      `json:"user_id"`
+	Status                PresenceStatus `json:"status"`
+	CustomStatus          string         `json:"custom_status,omitempty"`
+	CustomStatusExpiresAt *time.Time     `json:"custom_status_expires_at,omitempty"`
+	Timestamp             time.Time      `json:"timestamp"`
 }
 
 type HeartbeatMessage struct {
@@ -57,7 +76,9 @@ type PresenceRepo interface {
 	CreateDeviceSession(ctx context.Context, session *DeviceSession) error
 	UpdateDeviceSession(ctx context.Context, session *DeviceSession) error
 	GetDeviceSession(ctx context.Context, clientID string) (*DeviceSession, error)
-	GetUserDeviceSessions(ctx context.Context, userID uuid.UUID) ([]*DeviceSession, error)
+	// GetUserDeviceSessions returns a page of the user's sessions, most recently
+	// connected first, and how many match the filter in total
+	GetUserDeviceSessions(ctx context.Context, userID uuid.UUID, filter DeviceSessionFilter) ([]*DeviceSession, int, error)
 	DisconnectDeviceSession(ctx context.Context, clientID string) error
 	
 	// Bulk operations for cleanup
@@ -65,20 +86,51 @@ type PresenceRepo interface {
 	CleanupStalePresence(ctx context.Context, timeout time.Duration) error
 }
 
+// BrokerAdmin disconnects clients through the MQTT broker's management API
+type BrokerAdmin interface {
+	// KickClient disconnects a client; one that isn't connected is not an error
+	KickClient(ctx context.Context, clientID string) error
+}
+
+// CredentialRevoker invalidates the API tokens and MQTT credentials auth-service
+// has issued to a user, so a kicked client can't reconnect with them
+type CredentialRevoker interface {
+	RevokeUserTokens(ctx context.Context, userID uuid.UUID) error
+}
+
 type PresenceUsecase struct {
 	repo              PresenceRepo
+	rooms             RoomRepo
+	broker            BrokerAdmin
+	credentials       CredentialRevoker
+	members           MembershipChecker
 	heartbeatInterval time.Duration
 	offlineTimeout    time.Duration
+	activityDebounce  time.Duration
+
+	// lastActivity is when RecordActivity last wrote to the repo for a user
+	activityMu   sync.Mutex
+	lastActivity map[uuid.UUID]time.Time
 }
 
-func NewPresenceUsecase(repo PresenceRepo, heartbeatInterval, offlineTimeout time.Duration) *PresenceUsecase {
+func NewPresenceUsecase(repo PresenceRepo, rooms RoomRepo, heartbeatInterval, offlineTimeout time.Duration) *PresenceUsecase {
 	return &PresenceUsecase{
 		repo:              repo,
+		rooms:             rooms,
 		heartbeatInterval: heartbeatInterval,
 		offlineTimeout:    offlineTimeout,
+		activityDebounce:  heartbeatInterval / 2,
+		lastActivity:      make(map[uuid.UUID]time.Time),
 	}
 }
 
+// SetForceOfflineEnforcement sets how ForceOffline kicks clients off the broker and
+// revokes their credentials; without both, ForceOffline returns ErrForceOfflineUnavailable
+func (uc *PresenceUsecase) SetForceOfflineEnforcement(broker BrokerAdmin, credentials CredentialRevoker) {
+	uc.broker = broker
+	uc.credentials = credentials
+}
+
 func (uc *PresenceUsecase) HandleClientConnected(ctx context.Context, clientID string, userID uuid.UUID, deviceInfo, ip string) error {
 	// Create device session
 	session := &DeviceSession{
@@ -117,7 +169,7 @@ func (uc *PresenceUsecase) HandleClientDisconnected(ctx context.Context, clientI
 	}
 
 	// Check if user has other active sessions
-	activeSessions, err := uc.repo.GetUserDeviceSessions(ctx, session.UserID)
+	activeSessions, _, err := uc.repo.GetUserDeviceSessions(ctx, session.UserID, DeviceSessionFilter{})
 	if err != nil {
 		return err
 	}
@@ -132,6 +184,11 @@ func (uc *PresenceUsecase) HandleClientDisconnected(ctx context.Context, clientI
 	}
 
 	if !hasActiveSessions {
+		// Nobody is looking at any conversation once the last device is gone
+		if err := uc.rooms.LeaveAllRooms(ctx, session.UserID); err != nil {
+			return err
+		}
+
 		presence := &UserPresence{
 			UserID:   session.UserID,
 			Status:   StatusOffline,
@@ -150,11 +207,13 @@ func (uc *PresenceUsecase) HandlePresenceUpdate(ctx context.Context, payload []b
 	}
 
 	presence := &UserPresence{
-		UserID:       update.UserID,
-		Status:       update.Status,
-		LastSeen:     update.Timestamp,
-		CustomStatus: update.CustomStatus,
+		UserID:                update.UserID,
+		Status:                update.Status,
+		LastSeen:              update.Timestamp,
+		CustomStatus:          update.CustomStatus,
+		CustomStatusExpiresAt: update.CustomStatusExpiresAt,
 	}
+	clearExpiredCustomStatus(presence, time.Now())
 
 	return uc.repo.SetUserPresence(ctx, presence)
 }
@@ -171,30 +230,184 @@ func (uc *PresenceUsecase) HandleHeartbeat(ctx context.Context, payload []byte)
 	}
 
 	session.LastHeartbeat = heartbeat.Timestamp
-	return uc.repo.UpdateDeviceSession(ctx, session)
+	if err := uc.repo.UpdateDeviceSession(ctx, session); err != nil {
+		return err
+	}
+
+	// Keep the user in the conversations they are viewing while the client is alive
+	return uc.rooms.RefreshUserRooms(ctx, session.UserID, uc.offlineTimeout)
 }
 
 func (uc *PresenceUsecase) GetUserPresence(ctx context.Context, userID uuid.UUID) (*UserPresence, error) {
-	return uc.repo.GetUserPresence(ctx, userID)
+	presence, err := uc.repo.GetUserPresence(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	clearExpiredCustomStatus(presence, time.Now())
+	return presence, nil
 }
 
 func (uc *PresenceUsecase) GetMultipleUserPresence(ctx context.Context, userIDs []uuid.UUID) (map[uuid.UUID]*UserPresence, error) {
-	return uc.repo.GetMultipleUserPresence(ctx, userIDs)
+	presenceMap, err := uc.repo.GetMultipleUserPresence(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, presence := range presenceMap {
+		clearExpiredCustomStatus(presence, now)
+	}
+	return presenceMap, nil
 }
 
-func (uc *PresenceUsecase) SetUserStatus(ctx context.Context, userID uuid.UUID, status PresenceStatus, customStatus string) error {
+// SetUserStatus sets the user's status. customStatusExpiresAt, when set, must be in
+// the future and only applies if customStatus is non-empty.
+func (uc *PresenceUsecase) SetUserStatus(ctx context.Context, userID uuid.UUID, status PresenceStatus, customStatus string, customStatusExpiresAt *time.Time) error {
+	now := time.Now()
+	if customStatusExpiresAt != nil && !customStatusExpiresAt.After(now) {
+		return ErrInvalidExpiry
+	}
+	if customStatus == "" {
+		customStatusExpiresAt = nil
+	}
+
 	presence := &UserPresence{
-		UserID:       userID,
-		Status:       status,
-		LastSeen:     time.Now(),
-		CustomStatus: customStatus,
+		UserID:                userID,
+		Status:                status,
+		LastSeen:              now,
+		CustomStatus:          customStatus,
+		CustomStatusExpiresAt: customStatusExpiresAt,
 	}
 
 	return uc.repo.SetUserPresence(ctx, presence)
 }
 
+// ForceOffline disconnects every device session of the user and marks them offline,
+// for admins responding to an incident such as a compromised account. It returns
+// the resulting presence and how many sessions were still connected.
+func (uc *PresenceUsecase) ForceOffline(ctx context.Context, userID uuid.UUID) (*UserPresence, int, error) {
+	if uc.broker == nil || uc.credentials == nil {
+		return nil, 0, ErrForceOfflineUnavailable
+	}
+
+	// Revoke first so the kicked clients can't reconnect with the credentials they hold
+	if err := uc.credentials.RevokeUserTokens(ctx, userID); err != nil {
+		return nil, 0, fmt.Errorf("revoke credentials: %w", err)
+	}
+
+	sessions, _, err := uc.repo.GetUserDeviceSessions(ctx, userID, DeviceSessionFilter{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	disconnected := 0
+	for _, session := range sessions {
+		if session.DisconnectedAt != nil {
+			continue
+		}
+		if err := uc.broker.KickClient(ctx, session.ClientID); err != nil {
+			return nil, disconnected, fmt.Errorf("kick client %s: %w", session.ClientID, err)
+		}
+		if err := uc.repo.DisconnectDeviceSession(ctx, session.ClientID); err != nil {
+			// The session expired in the meantime, which is as good as disconnected
+			if err == ErrSessionNotFound {
+				continue
+			}
+			return nil, disconnected, err
+		}
+		disconnected++
+	}
+
+	if err := uc.rooms.LeaveAllRooms(ctx, userID); err != nil {
+		return nil, disconnected, err
+	}
+
+	presence := &UserPresence{
+		UserID:   userID,
+		Status:   StatusOffline,
+		LastSeen: time.Now(),
+	}
+	if err := uc.repo.SetUserPresence(ctx, presence); err != nil {
+		return nil, disconnected, err
+	}
+	uc.forgetActivity(userID)
+
+	return presence, disconnected, nil
+}
+
+// clearExpiredCustomStatus drops the custom status once its expiry has passed.
+// Stored presence is cleaned up lazily the next time it is written.
+func clearExpiredCustomStatus(presence *UserPresence, now time.Time) {
+	if presence.CustomStatusExpiresAt != nil && !presence.CustomStatusExpiresAt.After(now) {
+		presence.CustomStatus = ""
+		presence.CustomStatusExpiresAt = nil
+	}
+}
+
+// RecordActivity marks a user as active because they did something in a chat, such as
+// sending a message. LastSeen is refreshed and away/offline users are bumped to online;
+// do-not-disturb is left alone. Calls within the debounce window are dropped without
+// touching the repo. It returns the resulting presence when the status changed, nil otherwise.
+func (uc *PresenceUsecase) RecordActivity(ctx context.Context, userID uuid.UUID) (*UserPresence, error) {
+	now := time.Now()
+
+	uc.activityMu.Lock()
+	if last, ok := uc.lastActivity[userID]; ok && now.Sub(last) < uc.activityDebounce {
+		uc.activityMu.Unlock()
+		return nil, nil
+	}
+	uc.lastActivity[userID] = now
+	uc.activityMu.Unlock()
+
+	presence, err := uc.repo.GetUserPresence(ctx, userID)
+	if err != nil {
+		uc.forgetActivity(userID)
+		return nil, err
+	}
+
+	changed := presence.Status == StatusAway || presence.Status == StatusOffline
+	if changed {
+		presence.Status = StatusOnline
+	}
+	presence.LastSeen = now
+	clearExpiredCustomStatus(presence, now)
+
+	if err := uc.repo.SetUserPresence(ctx, presence); err != nil {
+		uc.forgetActivity(userID)
+		return nil, err
+	}
+
+	if !changed {
+		return nil, nil
+	}
+	return presence, nil
+}
+
+// forgetActivity clears the debounce entry so a failed write is retried on the next call
+func (uc *PresenceUsecase) forgetActivity(userID uuid.UUID) {
+	uc.activityMu.Lock()
+	delete(uc.lastActivity, userID)
+	uc.activityMu.Unlock()
+}
+
+// pruneActivity drops debounce entries that are past the window so the map doesn't grow forever
+func (uc *PresenceUsecase) pruneActivity() {
+	cutoff := time.Now().Add(-uc.activityDebounce)
+
+	uc.activityMu.Lock()
+	defer uc.activityMu.Unlock()
+	for userID, last := range uc.lastActivity {
+		if last.Before(cutoff) {
+			delete(uc.lastActivity, userID)
+		}
+	}
+}
+
 // CleanupStalePresence removes stale presence data
 func (uc *PresenceUsecase) CleanupStalePresence(ctx context.Context) error {
+	uc.pruneActivity()
+
 	// Get stale device sessions
 	staleSessions, err := uc.repo.GetStaleDeviceSessions(ctx, uc.offlineTimeout)
 	if err != nil {
@@ -213,7 +426,14 @@ func (uc *PresenceUsecase) CleanupStalePresence(ctx context.Context) error {
 	return uc.repo.CleanupStalePresence(ctx, uc.offlineTimeout)
 }
 
-// GetUserDeviceSessions returns all device sessions for a user
-func (uc *PresenceUsecase) GetUserDeviceSessions(ctx context.Context, userID uuid.UUID) ([]*DeviceSession, error) {
-	return uc.repo.GetUserDeviceSessions(ctx, userID)
+// GetUserDeviceSessions returns a page of a user's device sessions, flagging the
+// ones that are still active, and the total matching. activeOnly leaves out
+// sessions that disconnected or stopped sending heartbeats.
+func (uc *PresenceUsecase) GetUserDeviceSessions(ctx context.Context, userID uuid.UUID, activeOnly bool, limit, offset int) ([]*DeviceSession, int, error) {
+	return uc.repo.GetUserDeviceSessions(ctx, userID, DeviceSessionFilter{
+		ActiveSince: time.Now().Add(-uc.offlineTimeout),
+		ActiveOnly:  activeOnly,
+		Limit:       limit,
+		Offset:      offset,
+	})
 }
@@ -0,0 +1,74 @@
+package biz
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RoomViewer is a user currently looking at a conversation
+type RoomViewer struct {
+	UserID   uuid.UUID `json:"user_id"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// RoomRepo tracks who is viewing which conversation. Entries age out after the
+// TTL unless refreshed, so a crashed client drops out on its own.
+type RoomRepo interface {
+	JoinRoom(ctx context.Context, conversationID, userID uuid.UUID, ttl time.Duration) error
+	LeaveRoom(ctx context.Context, conversationID, userID uuid.UUID) error
+	LeaveAllRooms(ctx context.Context, userID uuid.UUID) error
+	RefreshUserRooms(ctx context.Context, userID uuid.UUID, ttl time.Duration) error
+	GetRoomViewers(ctx context.Context, conversationID uuid.UUID, ttl time.Duration) ([]*RoomViewer, error)
+}
+
+// MembershipChecker tells whether a user is currently in a conversation, owned by chat-api
+type MembershipChecker interface {
+	IsParticipant(ctx context.Context, conversationID, userID uuid.UUID) (bool, error)
+}
+
+// SetMembershipChecker sets how conversation membership is verified; without it, joining
+// a conversation and listing its viewers return ErrMembershipUnavailable
+func (uc *PresenceUsecase) SetMembershipChecker(members MembershipChecker) {
+	uc.members = members
+}
+
+// requireParticipant returns ErrNotParticipant unless the user is in the conversation
+func (uc *PresenceUsecase) requireParticipant(ctx context.Context, conversationID, userID uuid.UUID) error {
+	if uc.members == nil {
+		return ErrMembershipUnavailable
+	}
+	ok, err := uc.members.IsParticipant(ctx, conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotParticipant
+	}
+	return nil
+}
+
+// JoinRoom records the user as viewing the conversation and returns the current viewers
+func (uc *PresenceUsecase) JoinRoom(ctx context.Context, conversationID, userID uuid.UUID) ([]*RoomViewer, error) {
+	if err := uc.requireParticipant(ctx, conversationID, userID); err != nil {
+		return nil, err
+	}
+	if err := uc.rooms.JoinRoom(ctx, conversationID, userID, uc.offlineTimeout); err != nil {
+		return nil, err
+	}
+	return uc.rooms.GetRoomViewers(ctx, conversationID, uc.offlineTimeout)
+}
+
+// LeaveRoom removes the user from the conversation's viewer list
+func (uc *PresenceUsecase) LeaveRoom(ctx context.Context, conversationID, userID uuid.UUID) error {
+	return uc.rooms.LeaveRoom(ctx, conversationID, userID)
+}
+
+// GetRoomViewers returns the users currently viewing a conversation, if userID is in it
+func (uc *PresenceUsecase) GetRoomViewers(ctx context.Context, conversationID, userID uuid.UUID) ([]*RoomViewer, error) {
+	if err := uc.requireParticipant(ctx, conversationID, userID); err != nil {
+		return nil, err
+	}
+	return uc.rooms.GetRoomViewers(ctx, conversationID, uc.offlineTimeout)
+}
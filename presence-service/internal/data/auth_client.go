@@ -0,0 +1,51 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/presence-service/internal/biz"
+)
+
+type authClient struct {
+	baseURL        string
+	internalSecret string
+	httpClient     *http.Client
+}
+
+// NewAuthClient creates a client for auth-service's internal HTTP API
+func NewAuthClient(baseURL, internalSecret string) biz.CredentialRevoker {
+	return &authClient{
+		baseURL:        baseURL,
+		internalSecret: internalSecret,
+		httpClient:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *authClient) RevokeUserTokens(ctx context.Context, userID uuid.UUID) error {
+	url := fmt.Sprintf("%s/api/v1/internal/users/%s/revoke-tokens", c.baseURL, userID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Internal-Secret", c.internalSecret)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return biz.ErrUserNotFound
+	default:
+		return fmt.Errorf("auth service returned status %d", resp.StatusCode)
+	}
+}
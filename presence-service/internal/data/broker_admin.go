@@ -0,0 +1,50 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/presence-service/internal/biz"
+)
+
+type brokerAdmin struct {
+	baseURL    string
+	apiKey     string
+	apiSecret  string
+	httpClient *http.Client
+}
+
+// NewBrokerAdmin creates a client for the EMQX v5 management API, authenticating
+// with an API key and secret
+func NewBrokerAdmin(baseURL, apiKey, apiSecret string) biz.BrokerAdmin {
+	return &brokerAdmin{
+		baseURL:    baseURL,
+		apiKey:     apiKey,
+		apiSecret:  apiSecret,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (b *brokerAdmin) KickClient(ctx context.Context, clientID string) error {
+	endpoint := fmt.Sprintf("%s/api/v5/clients/%s", b.baseURL, url.PathEscape(clientID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(b.apiKey, b.apiSecret)
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 404 means the client already disconnected
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("broker returned status %d", resp.StatusCode)
+	}
+	return nil
+}
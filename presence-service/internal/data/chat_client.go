@@ -0,0 +1,52 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/presence-service/internal/biz"
+)
+
+type chatClient struct {
+	baseURL        string
+	internalSecret string
+	httpClient     *http.Client
+}
+
+// NewChatClient creates a client for chat-api's internal HTTP API
+func NewChatClient(baseURL, internalSecret string) biz.MembershipChecker {
+	return &chatClient{
+		baseURL:        baseURL,
+		internalSecret: internalSecret,
+		httpClient:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *chatClient) IsParticipant(ctx context.Context, conversationID, userID uuid.UUID) (bool, error) {
+	url := fmt.Sprintf("%s/api/v1/internal/conversations/%s/participants/%s", c.baseURL, conversationID, userID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("X-Internal-Secret", c.internalSecret)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return true, nil
+	// A conversation that doesn't exist has no participants either
+	case http.StatusForbidden, http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("chat api returned status %d", resp.StatusCode)
+	}
+}
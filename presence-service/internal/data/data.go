@@ -9,7 +9,7 @@ import (
 )
 
 // ProviderSet is data providers.
-var ProviderSet = wire.NewSet(NewData, NewPresenceRepo, NewRedisClient)
+var ProviderSet = wire.NewSet(NewData, NewPresenceRepo, NewRoomRepo, NewRedisClient)
 
 // NewRedisClient creates a Redis client
 func NewRedisClient(c *conf.Data) *redis.Client {
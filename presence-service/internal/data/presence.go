@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/google/uuid"
@@ -156,28 +157,49 @@ func (r *presenceRepo) GetDeviceSession(ctx context.Context, clientID string) (*
 	return &session, nil
 }
 
-func (r *presenceRepo) GetUserDeviceSessions(ctx context.Context, userID uuid.UUID) ([]*biz.DeviceSession, error) {
+func (r *presenceRepo) GetUserDeviceSessions(ctx context.Context, userID uuid.UUID, filter biz.DeviceSessionFilter) ([]*biz.DeviceSession, int, error) {
 	userSessionsKey := fmt.Sprintf("%s%s", userSessionsPrefix, userID.String())
 	
 	clientIDs, err := r.redis.SMembers(ctx, userSessionsKey).Result()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	if len(clientIDs) == 0 {
-		return []*biz.DeviceSession{}, nil
+		return []*biz.DeviceSession{}, 0, nil
 	}
 
 	sessions := make([]*biz.DeviceSession, 0, len(clientIDs))
 	for _, clientID := range clientIDs {
 		session, err := r.GetDeviceSession(ctx, clientID)
-		if err == nil {
-			sessions = append(sessions, session)
+		if err != nil {
+			// Ignore errors for individual sessions (they might have expired)
+			continue
+		}
+		session.IsActive = session.DisconnectedAt == nil && !session.LastHeartbeat.Before(filter.ActiveSince)
+		if filter.ActiveOnly && !session.IsActive {
+			continue
 		}
-		// Ignore errors for individual sessions (they might have expired)
+		sessions = append(sessions, session)
 	}
 
-	return sessions, nil
+	// Set members come back in no particular order, so sort for stable pages
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].ConnectedAt.Equal(sessions[j].ConnectedAt) {
+			return sessions[i].ConnectedAt.After(sessions[j].ConnectedAt)
+		}
+		return sessions[i].ClientID < sessions[j].ClientID
+	})
+
+	total := len(sessions)
+	if filter.Offset >= total {
+		return []*biz.DeviceSession{}, total, nil
+	}
+	sessions = sessions[filter.Offset:]
+	if filter.Limit > 0 && len(sessions) > filter.Limit {
+		sessions = sessions[:filter.Limit]
+	}
+	return sessions, total, nil
 }
 
 func (r *presenceRepo) DisconnectDeviceSession(ctx context.Context, clientID string) error {
@@ -253,7 +275,7 @@ func (r *presenceRepo) CleanupStalePresence(ctx context.Context, timeout time.Du
 
 		// If user hasn't been seen recently and has no active sessions, mark as offline
 		if presence.LastSeen.Before(cutoff) {
-			sessions, err := r.GetUserDeviceSessions(ctx, userID)
+			sessions, _, err := r.GetUserDeviceSessions(ctx, userID, biz.DeviceSessionFilter{})
 			if err != nil {
 				continue
 			}
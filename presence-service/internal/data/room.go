@@ -0,0 +1,130 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/presence-service/internal/biz"
+)
+
+type roomRepo struct {
+	redis *redis.Client
+}
+
+func NewRoomRepo(redis *redis.Client) biz.RoomRepo {
+	return &roomRepo{redis: redis}
+}
+
+// Each room is a sorted set of user IDs scored by when they were last seen there,
+// and each user has a set of the rooms they joined so heartbeats can refresh them
+const (
+	roomViewersPrefix = "room:conversation:"
+	userRoomsPrefix   = "rooms:user:"
+)
+
+func (r *roomRepo) JoinRoom(ctx context.Context, conversationID, userID uuid.UUID, ttl time.Duration) error {
+	roomKey := fmt.Sprintf("%s%s", roomViewersPrefix, conversationID.String())
+	userRoomsKey := fmt.Sprintf("%s%s", userRoomsPrefix, userID.String())
+
+	pipe := r.redis.Pipeline()
+	pipe.ZAdd(ctx, roomKey, redis.Z{Score: float64(time.Now().UnixMilli()), Member: userID.String()})
+	pipe.Expire(ctx, roomKey, ttl)
+	pipe.SAdd(ctx, userRoomsKey, conversationID.String())
+	pipe.Expire(ctx, userRoomsKey, ttl)
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *roomRepo) LeaveRoom(ctx context.Context, conversationID, userID uuid.UUID) error {
+	roomKey := fmt.Sprintf("%s%s", roomViewersPrefix, conversationID.String())
+	userRoomsKey := fmt.Sprintf("%s%s", userRoomsPrefix, userID.String())
+
+	pipe := r.redis.Pipeline()
+	pipe.ZRem(ctx, roomKey, userID.String())
+	pipe.SRem(ctx, userRoomsKey, conversationID.String())
+
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *roomRepo) LeaveAllRooms(ctx context.Context, userID uuid.UUID) error {
+	userRoomsKey := fmt.Sprintf("%s%s", userRoomsPrefix, userID.String())
+
+	conversationIDs, err := r.redis.SMembers(ctx, userRoomsKey).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := r.redis.Pipeline()
+	for _, conversationID := range conversationIDs {
+		pipe.ZRem(ctx, roomViewersPrefix+conversationID, userID.String())
+	}
+	pipe.Del(ctx, userRoomsKey)
+
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r *roomRepo) RefreshUserRooms(ctx context.Context, userID uuid.UUID, ttl time.Duration) error {
+	userRoomsKey := fmt.Sprintf("%s%s", userRoomsPrefix, userID.String())
+
+	conversationIDs, err := r.redis.SMembers(ctx, userRoomsKey).Result()
+	if err != nil {
+		return err
+	}
+	if len(conversationIDs) == 0 {
+		return nil
+	}
+
+	now := float64(time.Now().UnixMilli())
+	pipe := r.redis.Pipeline()
+	for _, conversationID := range conversationIDs {
+		roomKey := roomViewersPrefix + conversationID
+		// XX only refreshes rooms the user is still in; an explicit leave isn't undone
+		pipe.ZAddXX(ctx, roomKey, redis.Z{Score: now, Member: userID.String()})
+		pipe.Expire(ctx, roomKey, ttl)
+	}
+	pipe.Expire(ctx, userRoomsKey, ttl)
+
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r *roomRepo) GetRoomViewers(ctx context.Context, conversationID uuid.UUID, ttl time.Duration) ([]*biz.RoomViewer, error) {
+	roomKey := fmt.Sprintf("%s%s", roomViewersPrefix, conversationID.String())
+	cutoff := time.Now().Add(-ttl).UnixMilli()
+
+	// Drop viewers whose clients stopped refreshing before reading the rest
+	if err := r.redis.ZRemRangeByScore(ctx, roomKey, "-inf", "("+strconv.FormatInt(cutoff, 10)).Err(); err != nil {
+		return nil, err
+	}
+
+	members, err := r.redis.ZRangeWithScores(ctx, roomKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	viewers := make([]*biz.RoomViewer, 0, len(members))
+	for _, member := range members {
+		userIDStr, ok := member.Member.(string)
+		if !ok {
+			continue
+		}
+		userID, err := uuid.Parse(userIDStr)
+		if err != nil {
+			continue
+		}
+		viewers = append(viewers, &biz.RoomViewer{
+			UserID:   userID,
+			LastSeen: time.UnixMilli(int64(member.Score)),
+		})
+	}
+
+	return viewers, nil
+}
@@ -12,11 +12,15 @@ import (
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/google/uuid"
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/presence-service/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/inflight"
 )
 
 type MQTTServer struct {
 	client      mqtt.Client
 	presenceUc  *biz.PresenceUsecase
+	topics      []string
+	// handlers tracks running message handlers so Shutdown can drain them
+	handlers inflight.Tracker
 }
 
 type MQTTConfig struct {
@@ -39,6 +43,7 @@ func NewMQTTServer(config MQTTConfig, presenceUc *biz.PresenceUsecase) *MQTTServ
 
 	server := &MQTTServer{
 		presenceUc: presenceUc,
+		topics:     config.Topics,
 	}
 
 	opts.SetDefaultPublishHandler(server.defaultMessageHandler)
@@ -64,8 +69,32 @@ func (s *MQTTServer) Start() error {
 	return nil
 }
 
-func (s *MQTTServer) Stop() {
+// Connected reports whether the broker connection is currently up
+func (s *MQTTServer) Connected() bool {
+	return s.client.IsConnectionOpen()
+}
+
+// Shutdown unsubscribes so no new messages are delivered, waits for handlers already
+// running to finish, then disconnects. If ctx ends first the remaining handlers are
+// cut off by the disconnect and ctx's error is returned.
+func (s *MQTTServer) Shutdown(ctx context.Context) error {
+	if token := s.client.Unsubscribe(s.topics...); !token.WaitTimeout(time.Until(deadlineOf(ctx))) {
+		log.Println("Timed out unsubscribing from MQTT topics")
+	} else if token.Error() != nil {
+		log.Printf("Failed to unsubscribe from MQTT topics: %v", token.Error())
+	}
+
+	err := s.handlers.Close(ctx)
 	s.client.Disconnect(250)
+	return err
+}
+
+// deadlineOf returns ctx's deadline, or a short default for contexts without one
+func deadlineOf(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return time.Now().Add(5 * time.Second)
 }
 
 func (s *MQTTServer) subscribeToTopics(topics []string) {
@@ -79,6 +108,12 @@ func (s *MQTTServer) subscribeToTopics(topics []string) {
 }
 
 func (s *MQTTServer) messageHandler(client mqtt.Client, msg mqtt.Message) {
+	// Messages that arrive while shutting down are dropped
+	if !s.handlers.Enter() {
+		return
+	}
+	defer s.handlers.Exit()
+
 	topic := msg.Topic()
 	payload := msg.Payload()
 
@@ -91,6 +126,10 @@ func (s *MQTTServer) messageHandler(client mqtt.Client, msg mqtt.Message) {
 		if err := s.presenceUc.HandlePresenceUpdate(ctx, payload); err != nil {
 			log.Printf("Error processing presence update: %v", err)
 		}
+	} else if strings.Contains(topic, "presence/") && strings.Contains(topic, "/heartbeat") {
+		if err := s.presenceUc.HandleHeartbeat(ctx, payload); err != nil {
+			log.Printf("Error processing heartbeat: %v", err)
+		}
 	} else if strings.Contains(topic, "connected") {
 		s.handleClientConnected(ctx, topic, payload)
 	} else if strings.Contains(topic, "disconnected") {
@@ -159,14 +198,15 @@ func (s *MQTTServer) defaultMessageHandler(client mqtt.Client, msg mqtt.Message)
 }
 
 // PublishPresenceUpdate publishes a presence update to MQTT
-func (s *MQTTServer) PublishPresenceUpdate(userID uuid.UUID, status biz.PresenceStatus, customStatus string) error {
+func (s *MQTTServer) PublishPresenceUpdate(userID uuid.UUID, status biz.PresenceStatus, customStatus string, customStatusExpiresAt *time.Time) error {
 	topic := fmt.Sprintf("presence/%s/status", userID.String())
 	
 	update := biz.PresenceUpdate{
-		UserID:       userID,
-		Status:       status,
-		CustomStatus: customStatus,
-		Timestamp:    time.Now(),
+		UserID:                userID,
+		Status:                status,
+		CustomStatus:          customStatus,
+		CustomStatusExpiresAt: customStatusExpiresAt,
+		Timestamp:             time.Now(),
 	}
 
 	payload, err := json.Marshal(update)
@@ -1,26 +1,38 @@
 package server
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 
 	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/presence-service/internal/biz"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/buildinfo"
+	"github.com/thisisjayakumar/Orbit-Messenger-chat-app/shared/pagination"
 )
 
 type PresenceHTTPServer struct {
-	presenceUc *biz.PresenceUsecase
-	mqttServer *MQTTServer
-	router     *mux.Router
+	presenceUc     *biz.PresenceUsecase
+	mqttServer     *MQTTServer
+	info           *buildinfo.Info
+	internalSecret string
+	router         *mux.Router
 }
 
-func NewPresenceHTTPServer(presenceUc *biz.PresenceUsecase, mqttServer *MQTTServer) *PresenceHTTPServer {
+// NewPresenceHTTPServer creates the presence API. Admin routes are only served to
+// callers sending internalSecret in X-Internal-Secret, and are disabled when it is empty.
+func NewPresenceHTTPServer(presenceUc *biz.PresenceUsecase, mqttServer *MQTTServer, info *buildinfo.Info, internalSecret string) *PresenceHTTPServer {
 	s := &PresenceHTTPServer{
-		presenceUc: presenceUc,
-		mqttServer: mqttServer,
-		router:     mux.NewRouter(),
+		presenceUc:     presenceUc,
+		mqttServer:     mqttServer,
+		info:           info,
+		internalSecret: internalSecret,
+		router:         mux.NewRouter(),
 	}
 	s.setupRoutes()
 	return s
@@ -33,13 +45,23 @@ func (s *PresenceHTTPServer) setupRoutes() {
 	api.HandleFunc("/presence/{userID}/status", s.handleSetUserStatus).Methods("PUT")
 	api.HandleFunc("/presence/bulk", s.handleGetMultipleUserPresence).Methods("POST")
 	api.HandleFunc("/presence/{userID}/sessions", s.handleGetUserSessions).Methods("GET")
+	api.HandleFunc("/presence/{userID}/activity", s.handleRecordActivity).Methods("POST")
+	api.HandleFunc("/presence/{userID}/force-offline", s.adminMiddleware(s.handleForceOffline)).Methods("POST")
+
+	// Conversation-level presence ("who's here")
+	api.HandleFunc("/conversations/{conversationID}/presence", s.handleGetRoomViewers).Methods("GET")
+	api.HandleFunc("/conversations/{conversationID}/presence/join", s.handleJoinRoom).Methods("POST")
+	api.HandleFunc("/conversations/{conversationID}/presence/leave", s.handleLeaveRoom).Methods("POST")
+
+	// Build and dependency status
+	s.router.HandleFunc("/info", s.info.Handler).Methods("GET")
 }
 
 func (s *PresenceHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-User-ID, X-Organization-ID")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-User-ID, X-Organization-ID, X-Internal-Secret")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
@@ -79,8 +101,9 @@ func (s *PresenceHTTPServer) handleSetUserStatus(w http.ResponseWriter, r *http.
 	}
 
 	var req struct {
-		Status       biz.PresenceStatus `json:"status"`
-		CustomStatus string             `json:"custom_status,omitempty"`
+		Status                biz.PresenceStatus `json:"status"`
+		CustomStatus          string             `json:"custom_status,omitempty"`
+		CustomStatusExpiresAt *time.Time         `json:"custom_status_expires_at,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -109,14 +132,18 @@ func (s *PresenceHTTPServer) handleSetUserStatus(w http.ResponseWriter, r *http.
 		return
 	}
 
-	if err := s.presenceUc.SetUserStatus(r.Context(), userID, req.Status, req.CustomStatus); err != nil {
+	if err := s.presenceUc.SetUserStatus(r.Context(), userID, req.Status, req.CustomStatus, req.CustomStatusExpiresAt); err != nil {
+		if err == biz.ErrInvalidExpiry {
+			s.writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		s.writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	// Publish presence update via MQTT
 	if s.mqttServer != nil {
-		s.mqttServer.PublishPresenceUpdate(userID, req.Status, req.CustomStatus)
+		s.mqttServer.PublishPresenceUpdate(userID, req.Status, req.CustomStatus, req.CustomStatusExpiresAt)
 	}
 
 	s.writeJSON(w, http.StatusOK, map[string]string{"status": "updated"})
@@ -177,13 +204,173 @@ func (s *PresenceHTTPServer) handleGetUserSessions(w http.ResponseWriter, r *htt
 		return
 	}
 
-	sessions, err := s.presenceUc.GetUserDeviceSessions(r.Context(), userID)
+	params, err := pagination.Parse(r, 50, 100)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid cursor")
+		return
+	}
+
+	activeOnly := r.URL.Query().Get("active_only") == "true"
+	sessions, total, err := s.presenceUc.GetUserDeviceSessions(r.Context(), userID, activeOnly, params.Fetch(), params.Offset)
 	if err != nil {
 		s.writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, sessions)
+	page := pagination.New(sessions, params)
+	if params.IncludeTotal {
+		page.SetTotal(total)
+	}
+
+	s.writeJSON(w, http.StatusOK, page.Body(r))
+}
+
+// handleRecordActivity is called by chat-api when a user does something in a chat,
+// so users chatting without sending heartbeats don't drift to away
+func (s *PresenceHTTPServer) handleRecordActivity(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userIDStr := vars["userID"]
+
+	userID, err := uuid.Parse(userIDStr)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	presence, err := s.presenceUc.RecordActivity(r.Context(), userID)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Only announce actual status transitions, not every refresh of LastSeen
+	if presence != nil && s.mqttServer != nil {
+		s.mqttServer.PublishPresenceUpdate(userID, presence.Status, presence.CustomStatus, presence.CustomStatusExpiresAt)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleForceOffline revokes a user's tokens and MQTT credentials, kicks their
+// clients off the broker and announces them offline, e.g. when their account is
+// compromised
+func (s *PresenceHTTPServer) handleForceOffline(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(mux.Vars(r)["userID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	presence, disconnected, err := s.presenceUc.ForceOffline(r.Context(), userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, biz.ErrUserNotFound):
+			s.writeError(w, http.StatusNotFound, "User not found")
+		case errors.Is(err, biz.ErrForceOfflineUnavailable):
+			s.writeError(w, http.StatusServiceUnavailable, err.Error())
+		default:
+			s.writeError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	log.Printf("Forced user %s offline, disconnecting %d sessions", userID, disconnected)
+
+	if s.mqttServer != nil {
+		if err := s.mqttServer.PublishPresenceUpdate(userID, presence.Status, presence.CustomStatus, presence.CustomStatusExpiresAt); err != nil {
+			log.Printf("Failed to publish forced offline of user %s: %v", userID, err)
+		}
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":                "offline",
+		"disconnected_sessions": disconnected,
+	})
+}
+
+func (s *PresenceHTTPServer) handleJoinRoom(w http.ResponseWriter, r *http.Request) {
+	conversationID, userID, ok := s.parseRoomRequest(w, r)
+	if !ok {
+		return
+	}
+
+	viewers, err := s.presenceUc.JoinRoom(r.Context(), conversationID, userID)
+	if err != nil {
+		s.writeRoomError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, viewers)
+}
+
+func (s *PresenceHTTPServer) handleLeaveRoom(w http.ResponseWriter, r *http.Request) {
+	conversationID, userID, ok := s.parseRoomRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.presenceUc.LeaveRoom(r.Context(), conversationID, userID); err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, map[string]string{"status": "left"})
+}
+
+func (s *PresenceHTTPServer) handleGetRoomViewers(w http.ResponseWriter, r *http.Request) {
+	conversationID, userID, ok := s.parseRoomRequest(w, r)
+	if !ok {
+		return
+	}
+
+	viewers, err := s.presenceUc.GetRoomViewers(r.Context(), conversationID, userID)
+	if err != nil {
+		s.writeRoomError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, viewers)
+}
+
+// writeRoomError maps conversation presence errors to responses
+func (s *PresenceHTTPServer) writeRoomError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, biz.ErrNotParticipant):
+		s.writeError(w, http.StatusForbidden, "Not a participant in this conversation")
+	case errors.Is(err, biz.ErrMembershipUnavailable):
+		s.writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// parseRoomRequest reads the conversation ID from the path and the caller from X-User-ID
+func (s *PresenceHTTPServer) parseRoomRequest(w http.ResponseWriter, r *http.Request) (uuid.UUID, uuid.UUID, bool) {
+	conversationID, err := uuid.Parse(mux.Vars(r)["conversationID"])
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid conversation ID")
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	userID, err := uuid.Parse(r.Header.Get("X-User-ID"))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	return conversationID, userID, true
+}
+
+// adminMiddleware guards admin routes with the shared internal secret; admin tools
+// call them after checking the caller's role with auth-service
+func (s *PresenceHTTPServer) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get("X-Internal-Secret")
+		if s.internalSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(s.internalSecret)) != 1 {
+			s.writeError(w, http.StatusUnauthorized, "Invalid internal secret")
+			return
+		}
+		next(w, r)
+	}
 }
 
 func (s *PresenceHTTPServer) writeJSON(w http.ResponseWriter, status int, data interface{}) {
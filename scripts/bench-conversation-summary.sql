@@ -0,0 +1,102 @@
+-- Benchmark for the conversation summary queries in chat-api
+-- (chatRepo.GetConversationSummaries and chatRepo.GetParticipantSnapshots).
+--
+-- Seeds one user in 500 groups of 30 participants with 100 messages each inside a
+-- transaction, runs EXPLAIN ANALYZE on both queries, then rolls everything back.
+--
+-- Usage: psql -d orbit_messenger -f scripts/bench-conversation-summary.sql
+--
+-- GET /conversations/summary runs exactly these two statements however many
+-- conversations the user has; check that neither plan degrades to a scan of all
+-- messages or participants as the seed sizes grow.
+
+BEGIN;
+
+INSERT INTO organizations (id, name) VALUES
+    ('c0000000-0000-0000-0000-000000000000', 'Benchmark Org');
+
+INSERT INTO users (id, organization_id, email, display_name)
+SELECT ('c0000000-0000-0000-0000-' || lpad(to_hex(i), 12, '0'))::uuid,
+       'c0000000-0000-0000-0000-000000000000',
+       'bench' || i || '@example.com',
+       'Bench User ' || i
+FROM generate_series(1, 1000) i;
+
+INSERT INTO conversations (id, organization_id, type, title, created_by)
+SELECT ('c1000000-0000-0000-0000-' || lpad(to_hex(g), 12, '0'))::uuid,
+       'c0000000-0000-0000-0000-000000000000',
+       'GROUP', 'Benchmark Group ' || g, 'c0000000-0000-0000-0000-000000000001'
+FROM generate_series(1, 500) g;
+
+-- User 1 is in every group, plus 29 others picked round-robin
+INSERT INTO conversation_participants (conversation_id, user_id, last_read_at)
+SELECT ('c1000000-0000-0000-0000-' || lpad(to_hex(g), 12, '0'))::uuid,
+       ('c0000000-0000-0000-0000-' || lpad(to_hex(CASE WHEN p = 0 THEN 1 ELSE 2 + (g * 29 + p) % 999 END), 12, '0'))::uuid,
+       now() - (random() * interval '2 hours')
+FROM generate_series(1, 500) g, generate_series(0, 29) p
+ON CONFLICT DO NOTHING;
+
+INSERT INTO messages (conversation_id, sender_id, content_type, content, seq, sent_at)
+SELECT ('c1000000-0000-0000-0000-' || lpad(to_hex(g), 12, '0'))::uuid,
+       'c0000000-0000-0000-0000-000000000001',
+       'text', 'message ' || i, 101 - i,
+       now() - (i * interval '1 minute')
+FROM generate_series(1, 500) g, generate_series(1, 100) i;
+
+INSERT INTO message_receipts (message_id, user_id, status)
+SELECT m.id, cp.user_id, 'delivered'
+FROM messages m
+INNER JOIN conversation_participants cp ON cp.conversation_id = m.conversation_id
+WHERE m.sent_at > now() - interval '5 minutes' AND cp.user_id <> m.sender_id;
+
+ANALYZE conversation_participants;
+ANALYZE messages;
+ANALYZE message_receipts;
+
+-- Summaries: unread state, last message and its receipt counts
+EXPLAIN (ANALYZE, BUFFERS)
+SELECT c.id, unread.unread_count, unread.mentioned, last.id,
+       COALESCE(last.delivered_count, 0), COALESCE(last.read_count, 0),
+       (SELECT COUNT(*) FROM conversation_participants pc WHERE pc.conversation_id = c.id)
+FROM conversation_participants cp
+INNER JOIN conversations c ON c.id = cp.conversation_id
+LEFT JOIN LATERAL (
+    SELECT COUNT(*) AS unread_count,
+           COALESCE(BOOL_OR(EXISTS (
+               SELECT 1 FROM message_mentions mm WHERE mm.message_id = m.id AND mm.user_id = cp.user_id
+           )), false) AS mentioned
+    FROM messages m
+    WHERE m.conversation_id = c.id AND m.deleted = false AND m.sender_id <> cp.user_id
+      AND (cp.last_read_at IS NULL OR m.sent_at > cp.last_read_at)
+) unread ON true
+LEFT JOIN LATERAL (
+    SELECT m.id,
+           (SELECT COUNT(*) FROM message_receipts mr
+            WHERE mr.message_id = m.id AND mr.status = 'delivered' AND mr.user_id <> m.sender_id) AS delivered_count,
+           (SELECT COUNT(*) FROM message_receipts mr
+            WHERE mr.message_id = m.id AND mr.status = 'read' AND mr.user_id <> m.sender_id) AS read_count
+    FROM messages m
+    WHERE m.conversation_id = c.id AND m.deleted = false
+    ORDER BY m.sent_at DESC
+    LIMIT 1
+) last ON true
+WHERE cp.user_id = 'c0000000-0000-0000-0000-000000000001'
+ORDER BY cp.pinned_at DESC NULLS LAST, c.updated_at DESC, c.id;
+
+-- Participant snapshots for all 500 conversations at once
+EXPLAIN (ANALYZE, BUFFERS)
+SELECT conversation_id, user_id, display_name, avatar_url
+FROM (
+    SELECT cp.conversation_id, u.id AS user_id, u.display_name, COALESCE(u.avatar_url, '') AS avatar_url,
+           ROW_NUMBER() OVER (PARTITION BY cp.conversation_id ORDER BY cp.joined_at, cp.user_id) AS rn
+    FROM conversation_participants cp
+    INNER JOIN users u ON u.id = cp.user_id
+    WHERE cp.conversation_id IN (
+        SELECT conversation_id FROM conversation_participants
+        WHERE user_id = 'c0000000-0000-0000-0000-000000000001'
+    ) AND cp.user_id <> 'c0000000-0000-0000-0000-000000000001'
+) ranked
+WHERE rn <= 4
+ORDER BY conversation_id, rn;
+
+ROLLBACK;
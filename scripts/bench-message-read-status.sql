@@ -0,0 +1,84 @@
+-- Benchmark for the message list read-status query in chat-api
+-- (chatRepo.GetConversationMessages).
+--
+-- Seeds one group with 200 participants and 50k messages inside a transaction,
+-- runs EXPLAIN ANALYZE on the old per-row subquery form and on the current
+-- single-join form, then rolls everything back.
+--
+-- Usage: psql -d orbit_messenger -f scripts/bench-message-read-status.sql
+--
+-- The old form runs two subquery scans of conversation_participants per message
+-- on the page; the new form reads the participants once (index-only through
+-- conv_part_conv_read_idx) and joins them to the page. Compare the "Execution
+-- Time" and buffer lines of the two plans below.
+
+BEGIN;
+
+INSERT INTO organizations (id, name) VALUES
+    ('b0000000-0000-0000-0000-000000000000', 'Benchmark Org');
+
+INSERT INTO users (id, organization_id, email, display_name)
+SELECT ('b0000000-0000-0000-0000-' || lpad(to_hex(i), 12, '0'))::uuid,
+       'b0000000-0000-0000-0000-000000000000',
+       'bench' || i || '@example.com',
+       'Bench User ' || i
+FROM generate_series(1, 200) i;
+
+INSERT INTO conversations (id, organization_id, type, title, created_by) VALUES
+    ('b1000000-0000-0000-0000-000000000000', 'b0000000-0000-0000-0000-000000000000',
+     'GROUP', 'Benchmark Group', 'b0000000-0000-0000-0000-000000000001');
+
+INSERT INTO conversation_participants (conversation_id, user_id, last_read_at)
+SELECT 'b1000000-0000-0000-0000-000000000000',
+       ('b0000000-0000-0000-0000-' || lpad(to_hex(i), 12, '0'))::uuid,
+       now() - (random() * interval '2 hours')
+FROM generate_series(1, 200) i;
+
+INSERT INTO messages (conversation_id, sender_id, content_type, content, seq, sent_at)
+SELECT 'b1000000-0000-0000-0000-000000000000',
+       ('b0000000-0000-0000-0000-' || lpad(to_hex(1 + i % 200), 12, '0'))::uuid,
+       'text', 'message ' || i, 50001 - i,
+       now() - (i * interval '1 second')
+FROM generate_series(1, 50000) i;
+
+ANALYZE conversation_participants;
+ANALYZE messages;
+
+-- Old form: correlated subqueries per row
+EXPLAIN (ANALYZE, BUFFERS)
+SELECT m.id,
+       EXISTS (
+           SELECT 1 FROM conversation_participants cp
+           WHERE cp.conversation_id = m.conversation_id
+           AND cp.user_id != m.sender_id
+           AND cp.last_read_at >= m.sent_at
+       ) as is_read,
+       (SELECT COUNT(*) FROM conversation_participants cp
+        WHERE cp.conversation_id = m.conversation_id AND cp.user_id != m.sender_id) as recipient_count
+FROM messages m
+WHERE m.conversation_id = 'b1000000-0000-0000-0000-000000000000' AND m.deleted = false
+ORDER BY m.sent_at DESC
+LIMIT 50 OFFSET 0;
+
+-- New form: participants read once and joined to the page
+EXPLAIN (ANALYZE, BUFFERS)
+WITH page AS (
+    SELECT m.id, m.sender_id, m.sent_at
+    FROM messages m
+    WHERE m.conversation_id = 'b1000000-0000-0000-0000-000000000000' AND m.deleted = false
+    ORDER BY m.sent_at DESC
+    LIMIT 50 OFFSET 0
+), participants AS (
+    SELECT cp.user_id, cp.last_read_at
+    FROM conversation_participants cp
+    WHERE cp.conversation_id = 'b1000000-0000-0000-0000-000000000000'
+)
+SELECT p.id,
+       COUNT(cp.user_id) as recipient_count,
+       COALESCE(bool_and(COALESCE(cp.last_read_at >= p.sent_at, false)), false) as read_by_all,
+       COALESCE(bool_or(cp.last_read_at >= p.sent_at), false) as read_by_any
+FROM page p
+LEFT JOIN participants cp ON cp.user_id != p.sender_id
+GROUP BY p.id;
+
+ROLLBACK;
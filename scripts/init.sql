@@ -19,13 +19,55 @@ CREATE TABLE users (
     avatar_url TEXT,
     profile JSONB DEFAULT '{}'::jsonb,
     password_hash TEXT,
+    -- Set by an admin password reset until the user picks a new password
+    must_change_password BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Access tokens issued before this are rejected
+    tokens_revoked_at TIMESTAMPTZ,
     keycloak_id TEXT,
+    keycloak_refresh_token TEXT,
+    -- Two-factor authentication: the AES-GCM encrypted TOTP secret, set when enrolling,
+    -- and when it was verified. The last accepted time step stops codes being replayed.
+    totp_secret TEXT,
+    totp_enabled_at TIMESTAMPTZ,
+    totp_last_step BIGINT,
+    -- Wrong codes in a row, and until when sign-in is locked because of them
+    totp_failed_attempts INTEGER NOT NULL DEFAULT 0,
+    totp_locked_until TIMESTAMPTZ,
+    role TEXT NOT NULL DEFAULT 'member',
+    flagged_at TIMESTAMPTZ,
     created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
     last_seen_at TIMESTAMPTZ
 );
 
 CREATE UNIQUE INDEX users_org_email_uidx ON users(organization_id, email);
 
+-- One-time codes for signing in without the authenticator, stored as SHA-256 hashes
+CREATE TABLE totp_recovery_codes (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, code_hash)
+);
+
+-- Logins, so users can see where they are signed in and revoke sessions. Access
+-- tokens carry their session's ID and stop working once it is revoked.
+CREATE TABLE auth_sessions (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_agent TEXT,
+    ip TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_used_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ,
+    -- SHA-256 of the current refresh token and of the one it replaced, which
+    -- revokes the session if it is presented again
+    refresh_token_hash TEXT,
+    previous_refresh_token_hash TEXT
+);
+
+CREATE INDEX auth_sessions_user_used_idx ON auth_sessions(user_id, last_used_at DESC);
+
 -- Conversation type
 CREATE TYPE conversation_type AS ENUM ('DM','GROUP');
 
@@ -36,7 +78,17 @@ CREATE TABLE conversations (
     title TEXT,
     created_by UUID NOT NULL REFERENCES users(id),
     is_encrypted BOOLEAN NOT NULL DEFAULT FALSE,
-    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    post_policy TEXT NOT NULL DEFAULT 'everyone',
+    -- Overrides the organization's settings->retention_days; NULL inherits it
+    retention_days INTEGER,
+    -- Minimum seconds between each member's messages, set by an admin; 0 is off
+    slow_mode_seconds INTEGER NOT NULL DEFAULT 0,
+    -- Frozen by an admin: only conversation admins may post
+    locked BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- Bumped by new messages and settings changes; the conversation list sorts on it
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_message_at TIMESTAMPTZ
 );
 
 CREATE INDEX conv_org_type_idx ON conversations(organization_id, type);
@@ -50,13 +102,25 @@ CREATE TABLE conversation_participants (
     user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     role participant_role NOT NULL DEFAULT 'member',
     joined_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-    last_read_at TIMESTAMPTZ
+    last_read_at TIMESTAMPTZ,
+    muted_until TIMESTAMPTZ,
+    pinned_at TIMESTAMPTZ
 );
 
 CREATE UNIQUE INDEX conv_part_unique ON conversation_participants(conversation_id, user_id);
 CREATE INDEX conv_part_user_idx ON conversation_participants(user_id, conversation_id);
+CREATE INDEX conv_part_user_pinned_idx ON conversation_participants(user_id, pinned_at) WHERE pinned_at IS NOT NULL;
+-- Lets the message list read every participant's last_read_at with an index-only scan
+CREATE INDEX conv_part_conv_read_idx ON conversation_participants(conversation_id) INCLUDE (user_id, last_read_at);
 
 -- Messages
+-- Last message sequence number handed out per conversation. The row is locked by the
+-- transaction that persists a message, so seqs are committed in the order they're assigned.
+CREATE TABLE conversation_sequences (
+    conversation_id UUID PRIMARY KEY REFERENCES conversations(id) ON DELETE CASCADE,
+    last_seq BIGINT NOT NULL
+);
+
 CREATE TABLE messages (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
     conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
@@ -65,14 +129,34 @@ CREATE TABLE messages (
     content TEXT NOT NULL,
     meta JSONB DEFAULT '{}'::jsonb,
     dedupe_key TEXT,
+    parent_id UUID REFERENCES messages(id) ON DELETE SET NULL,
+    -- Position in the conversation, assigned from conversation_sequences when the
+    -- message is persisted. Messages are ordered by seq, not by sent_at.
+    seq BIGINT NOT NULL,
     sent_at TIMESTAMPTZ NOT NULL DEFAULT now(),
     edited_at TIMESTAMPTZ,
+    -- Pinned messages can be exempted from retention purges
+    pinned_at TIMESTAMPTZ,
     deleted BOOLEAN NOT NULL DEFAULT FALSE
 );
 
 CREATE INDEX msg_conv_time_idx ON messages(conversation_id, sent_at DESC);
+CREATE UNIQUE INDEX msg_conv_seq_uidx ON messages(conversation_id, seq);
+CREATE INDEX msg_parent_idx ON messages(parent_id) WHERE parent_id IS NOT NULL;
+-- Messages sent without a key are stored with an empty one and never collide
 CREATE UNIQUE INDEX msg_dedupe_uidx ON messages(conversation_id, dedupe_key) 
-WHERE dedupe_key IS NOT NULL;
+WHERE dedupe_key IS NOT NULL AND dedupe_key <> '';
+
+-- Mentions, resolved against participants when the message is persisted
+CREATE TABLE message_mentions (
+    message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, user_id)
+);
+
+CREATE INDEX msg_mentions_user_time_idx ON message_mentions(user_id, created_at DESC);
 
 -- Receipts
 CREATE TYPE receipt_status AS ENUM ('delivered','read');
@@ -88,6 +172,37 @@ CREATE TABLE message_receipts (
 CREATE UNIQUE INDEX msg_receipt_unique ON message_receipts(message_id, user_id, status);
 CREATE INDEX msg_receipt_user_idx ON message_receipts(user_id, status, at DESC);
 
+-- Outbox of MQTT publishes from chat-api, drained in order per ordering_key
+CREATE TABLE mqtt_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    topic TEXT NOT NULL,
+    qos SMALLINT NOT NULL DEFAULT 1,
+    payload BYTEA NOT NULL,
+    ordering_key TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    sent_at TIMESTAMPTZ
+);
+
+CREATE INDEX mqtt_outbox_pending_idx ON mqtt_outbox(ordering_key, id) WHERE status = 'pending';
+CREATE INDEX mqtt_outbox_sent_idx ON mqtt_outbox(sent_at) WHERE status = 'sent';
+
+-- Idempotency-Key headers of message sends and the message each one produced
+CREATE TABLE idempotency_keys (
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    idempotency_key TEXT NOT NULL,
+    sender_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    message_id UUID NOT NULL,
+    message JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (conversation_id, idempotency_key)
+);
+
+CREATE INDEX idempotency_keys_created_idx ON idempotency_keys(created_at);
+
 -- Attachments
 CREATE TABLE attachments (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
@@ -98,12 +213,31 @@ CREATE TABLE attachments (
     size BIGINT NOT NULL,
     status TEXT NOT NULL DEFAULT 'uploading',
     meta JSONB DEFAULT '{}'::jsonb,
+    -- Unset on attachments uploaded before uploads were org-scoped
+    organization_id UUID REFERENCES organizations(id) ON DELETE CASCADE,
+    uploaded_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    -- Public attachments (avatars, organization logos) are stored under public/ and
+    -- served without signed URLs; message attachments are always private
+    visibility TEXT NOT NULL DEFAULT 'private' CHECK (visibility IN ('private', 'public')),
     created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
     updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
 CREATE INDEX attachments_message_id_idx ON attachments(message_id);
 CREATE INDEX attachments_status_idx ON attachments(status);
+CREATE INDEX attachments_org_idx ON attachments(organization_id);
+CREATE INDEX attachments_uploading_idx ON attachments(uploaded_by, created_at) WHERE status = 'uploading';
+
+-- Messages waiting on attachments media-service didn't know about when the message was
+-- stored; linked by message-service once the attachment's status event arrives
+CREATE TABLE pending_attachment_links (
+    attachment_id UUID NOT NULL,
+    message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (attachment_id, message_id)
+);
+
+CREATE INDEX pending_attachment_links_created_idx ON pending_attachment_links(created_at);
 
 -- Device sessions
 CREATE TABLE device_sessions (
@@ -118,14 +252,102 @@ CREATE TABLE device_sessions (
 
 CREATE INDEX device_sessions_user_time_idx ON device_sessions(user_id, connected_at DESC);
 
--- Audit events
+-- Notification preferences
+CREATE TABLE notification_preferences (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    default_level TEXT NOT NULL DEFAULT 'all' CHECK (default_level IN ('all', 'mentions', 'none')),
+    quiet_hours_start TIME,
+    quiet_hours_end TIME,
+    timezone TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Push device tokens
+CREATE TABLE device_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token TEXT NOT NULL,
+    platform TEXT NOT NULL,
+    app_version TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- Set when the push provider reports the token invalid
+    deleted_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX device_tokens_token_uidx ON device_tokens(token);
+CREATE INDEX device_tokens_user_idx ON device_tokens(user_id) WHERE deleted_at IS NULL;
+
+-- Public keys for end-to-end encrypted conversations; private keys never reach the server
+CREATE TABLE user_keys (
+    user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    identity_key TEXT NOT NULL,
+    signed_prekey_id INTEGER NOT NULL,
+    signed_prekey TEXT NOT NULL,
+    signed_prekey_signature TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE user_prekeys (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    key_id INTEGER NOT NULL,
+    public_key TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX user_prekeys_user_key_uidx ON user_prekeys(user_id, key_id);
+
+-- User blocks
+CREATE TABLE blocked_users (
+    organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    blocker_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    blocked_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (blocker_id, blocked_id)
+);
+
+CREATE INDEX blocked_users_blocked_idx ON blocked_users(blocked_id);
+
+-- Message reports for moderation
+CREATE TABLE message_reports (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    -- No FK on message_id so reports outlive the message they are about
+    message_id UUID NOT NULL,
+    conversation_id UUID NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    reporter_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    sender_id UUID NOT NULL,
+    reason TEXT NOT NULL,
+    note TEXT,
+    content_type TEXT NOT NULL,
+    content_snapshot TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'open',
+    action TEXT,
+    resolved_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    resolved_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX message_reports_message_reporter_uidx ON message_reports(message_id, reporter_id);
+CREATE INDEX message_reports_org_status_idx ON message_reports(organization_id, status, created_at);
+
+-- Audit events, written by every service through shared/audit. actor_id is the
+-- acting user's ID, NULL for system actions; it isn't a foreign key so the trail
+-- outlives deleted users.
+-- changes holds {"field": {"before": ..., "after": ...}} for updates.
 CREATE TABLE audit_events (
     id BIGSERIAL PRIMARY KEY,
     organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
-    user_id UUID REFERENCES users(id),
+    actor_id UUID,
     action TEXT NOT NULL,
     target_type TEXT,
     target_id TEXT,
     details JSONB,
+    changes JSONB,
     created_at TIMESTAMPTZ NOT NULL DEFAULT now()
-);
\ No newline at end of file
+);
+
+CREATE INDEX audit_events_org_created_idx ON audit_events(organization_id, created_at DESC);
+CREATE INDEX audit_events_org_actor_idx ON audit_events(organization_id, actor_id, created_at DESC);
+CREATE INDEX audit_events_org_action_idx ON audit_events(organization_id, action, created_at DESC);
\ No newline at end of file
@@ -0,0 +1,179 @@
+// Package audit records who did what to what in the audit_events table, which the
+// services share, and reads it back for compliance review.
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Change is a field's value before and after an action
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Entry is one audited action. ActorID is the acting user's ID, nil for system
+// actions such as retention purges.
+type Entry struct {
+	ID             int64                  `json:"id"`
+	OrganizationID uuid.UUID              `json:"organization_id"`
+	ActorID        *uuid.UUID             `json:"actor_id,omitempty"`
+	Action         string                 `json:"action"`
+	TargetType     string                 `json:"target_type,omitempty"`
+	TargetID       string                 `json:"target_id,omitempty"`
+	Details        map[string]interface{} `json:"details,omitempty"`
+	Changes        map[string]Change      `json:"changes,omitempty"`
+	CreatedAt      time.Time              `json:"created_at"`
+}
+
+// Diff returns the fields whose values differ between before and after. A field
+// missing on one side is compared as nil.
+func Diff(before, after map[string]interface{}) map[string]Change {
+	changes := make(map[string]Change)
+	for key, old := range before {
+		if value := after[key]; !equal(old, value) {
+			changes[key] = Change{Before: old, After: value}
+		}
+	}
+	for key, value := range after {
+		if _, seen := before[key]; !seen && value != nil {
+			changes[key] = Change{After: value}
+		}
+	}
+	return changes
+}
+
+// equal compares values as they'll be stored, so a *string and a string holding the
+// same text, or an int and a float64 of the same value, are the same
+func equal(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	if aErr != nil || bErr != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return string(aJSON) == string(bJSON)
+}
+
+// Record writes an entry
+func Record(ctx context.Context, db *sql.DB, entry *Entry) error {
+	detailsJSON, _ := json.Marshal(entry.Details)
+	var changesJSON []byte
+	if len(entry.Changes) > 0 {
+		changesJSON, _ = json.Marshal(entry.Changes)
+	}
+	createdAt := entry.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	var actorID uuid.NullUUID
+	if entry.ActorID != nil {
+		actorID = uuid.NullUUID{UUID: *entry.ActorID, Valid: true}
+	}
+
+	query := `
+		INSERT INTO audit_events (organization_id, actor_id, action, target_type, target_id, details, changes, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	_, err := db.ExecContext(ctx, query,
+		entry.OrganizationID, actorID, entry.Action, entry.TargetType, entry.TargetID,
+		detailsJSON, changesJSON, createdAt)
+	return err
+}
+
+// Filter narrows an organization's audit log
+type Filter struct {
+	ActorID *uuid.UUID
+	// Action matches exactly, or by prefix when it ends in '*' (e.g. "user.*")
+	Action string
+	Since  *time.Time
+	Until  *time.Time
+	Limit  int
+	Offset int
+}
+
+func (f Filter) where(orgID uuid.UUID) (string, []interface{}) {
+	conditions := []string{"organization_id = $1"}
+	args := []interface{}{orgID}
+
+	if f.ActorID != nil {
+		args = append(args, *f.ActorID)
+		conditions = append(conditions, fmt.Sprintf("actor_id = $%d", len(args)))
+	}
+	if f.Action != "" {
+		if prefix := strings.TrimSuffix(f.Action, "*"); prefix != f.Action {
+			args = append(args, prefix)
+			conditions = append(conditions, fmt.Sprintf("starts_with(action, $%d)", len(args)))
+		} else {
+			args = append(args, f.Action)
+			conditions = append(conditions, fmt.Sprintf("action = $%d", len(args)))
+		}
+	}
+	if f.Since != nil {
+		args = append(args, *f.Since)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if f.Until != nil {
+		args = append(args, *f.Until)
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// List returns an organization's entries matching filter, newest first
+func List(ctx context.Context, db *sql.DB, orgID uuid.UUID, filter Filter) ([]*Entry, error) {
+	where, args := filter.where(orgID)
+	query := `
+		SELECT id, organization_id, actor_id, action, COALESCE(target_type, ''),
+		       COALESCE(target_id, ''), details, changes, created_at
+		FROM audit_events
+		WHERE ` + where + `
+		ORDER BY created_at DESC, id DESC`
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit, filter.Offset)
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*Entry{}
+	for rows.Next() {
+		entry := &Entry{}
+		var actorID uuid.NullUUID
+		var detailsJSON, changesJSON []byte
+		err := rows.Scan(&entry.ID, &entry.OrganizationID, &actorID, &entry.Action, &entry.TargetType,
+			&entry.TargetID, &detailsJSON, &changesJSON, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if actorID.Valid {
+			entry.ActorID = &actorID.UUID
+		}
+		json.Unmarshal(detailsJSON, &entry.Details)
+		json.Unmarshal(changesJSON, &entry.Changes)
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// Count counts an organization's entries matching filter, ignoring its limit and offset
+func Count(ctx context.Context, db *sql.DB, orgID uuid.UUID, filter Filter) (int, error) {
+	where, args := filter.where(orgID)
+	var total int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM audit_events WHERE `+where, args...).Scan(&total)
+	return total, err
+}
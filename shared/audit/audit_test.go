@@ -0,0 +1,47 @@
+package audit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFilterWhere(t *testing.T) {
+	orgID, actorID := uuid.New(), uuid.New()
+	since := time.Now()
+
+	tests := []struct {
+		name      string
+		filter    Filter
+		wantWhere string
+		wantArgs  []interface{}
+	}{
+		{"organization only", Filter{}, "organization_id = $1", []interface{}{orgID}},
+		{"actor", Filter{ActorID: &actorID}, "organization_id = $1 AND actor_id = $2", []interface{}{orgID, actorID}},
+		{"action prefix", Filter{Action: "user.*"}, "organization_id = $1 AND starts_with(action, $2)", []interface{}{orgID, "user."}},
+		{
+			"actor, exact action and since",
+			Filter{ActorID: &actorID, Action: "user.delete", Since: &since},
+			"organization_id = $1 AND actor_id = $2 AND action = $3 AND created_at >= $4",
+			[]interface{}{orgID, actorID, "user.delete", since},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, args := tt.filter.where(orgID)
+			if where != tt.wantWhere {
+				t.Errorf("got where %q, want %q", where, tt.wantWhere)
+			}
+			if len(args) != len(tt.wantArgs) {
+				t.Fatalf("got %d args, want %d", len(args), len(tt.wantArgs))
+			}
+			for i, arg := range args {
+				if arg != tt.wantArgs[i] {
+					t.Errorf("arg %d is %v (%T), want %v (%T)", i, arg, arg, tt.wantArgs[i], tt.wantArgs[i])
+				}
+			}
+		})
+	}
+}
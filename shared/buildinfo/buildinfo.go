@@ -0,0 +1,91 @@
+package buildinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Dependency states reported by the info endpoint
+const (
+	StatusUp          = "up"
+	StatusUnavailable = "unavailable"
+	StatusDisabled    = "disabled"
+)
+
+// Check reports the state of one dependency. It is called on every request, so it
+// should read state the service already keeps rather than probe the dependency.
+type Check func() string
+
+// Enabled reports an optional dependency that is either configured or not
+func Enabled(enabled bool) Check {
+	return func() string {
+		if enabled {
+			return StatusUp
+		}
+		return StatusDisabled
+	}
+}
+
+// Connection reports a dependency the service keeps a live connection to
+func Connection(connected func() bool) Check {
+	return func() string {
+		if connected() {
+			return StatusUp
+		}
+		return StatusUnavailable
+	}
+}
+
+// Info describes the running build. Version and Commit are injected at build time
+// through -ldflags "-X main.Version=... -X main.Commit=...".
+type Info struct {
+	Service   string
+	Version   string
+	Commit    string
+	StartedAt time.Time
+
+	checks map[string]Check
+}
+
+// New records the build of service, started now
+func New(service, version, commit string) *Info {
+	return &Info{
+		Service:   service,
+		Version:   version,
+		Commit:    commit,
+		StartedAt: time.Now(),
+		checks:    make(map[string]Check),
+	}
+}
+
+// Register adds a dependency to the report. Call it before serving requests.
+func (i *Info) Register(name string, check Check) {
+	i.checks[name] = check
+}
+
+// Handler serves GET /info. Any dependency that isn't up or disabled marks the
+// service degraded; the response is still 200 since optional dependencies don't
+// stop the service from serving.
+func (i *Info) Handler(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	dependencies := make(map[string]string, len(i.checks))
+	for name, check := range i.checks {
+		state := check()
+		if state != StatusUp && state != StatusDisabled {
+			status = "degraded"
+		}
+		dependencies[name] = state
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"service":        i.Service,
+		"version":        i.Version,
+		"commit":         i.Commit,
+		"started_at":     i.StartedAt,
+		"uptime_seconds": int64(time.Since(i.StartedAt).Seconds()),
+		"status":         status,
+		"dependencies":   dependencies,
+	})
+}
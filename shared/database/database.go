@@ -0,0 +1,53 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PoolConfig holds the database/sql connection pool settings
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	PingTimeout     time.Duration
+}
+
+// DefaultPoolConfig returns pool settings that keep each service well below
+// Postgres' default max_connections
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		MaxOpenConns:    25,
+		MaxIdleConns:    10,
+		ConnMaxLifetime: 30 * time.Minute,
+		PingTimeout:     5 * time.Second,
+	}
+}
+
+// Open opens a database handle with the given pool settings and pings it,
+// so a bad DSN fails at startup instead of on the first query
+func Open(driver, source string, pool PoolConfig) (*sql.DB, error) {
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+
+	timeout := pool.PingTimeout
+	if timeout <= 0 {
+		timeout = DefaultPoolConfig().PingTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
@@ -0,0 +1,53 @@
+package inflight
+
+import (
+	"context"
+	"sync"
+)
+
+// Tracker counts work in progress so shutdown can wait for it. Once Close has been
+// called no new work is admitted, which keeps the underlying WaitGroup from being
+// reused while Close waits on it.
+type Tracker struct {
+	mu      sync.Mutex
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// Enter admits one unit of work. It returns false once the tracker is closing, in
+// which case the caller must not do the work and must not call Exit.
+func (t *Tracker) Enter() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+// Exit marks admitted work as done
+func (t *Tracker) Exit() {
+	t.wg.Done()
+}
+
+// Close stops admitting work and waits for what's in progress, or until ctx is done.
+// It is safe to call more than once.
+func (t *Tracker) Close(ctx context.Context) error {
+	t.mu.Lock()
+	t.closing = true
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
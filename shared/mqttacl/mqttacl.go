@@ -0,0 +1,126 @@
+package mqttacl
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Access is the kind of topic access the broker is asking about
+type Access string
+
+const (
+	Publish   Access = "publish"
+	Subscribe Access = "subscribe"
+)
+
+// Conversations answers what the topic rules need to know about conversation
+// membership. auth-service and chat-api each implement it over the same tables.
+type Conversations interface {
+	// ConversationAccess reports whether the user participates in the conversation
+	// and, if so, whether it is locked for them
+	ConversationAccess(ctx context.Context, conversationID, userID uuid.UUID) (participant, locked bool, err error)
+	// SharesConversation reports whether two users participate in a common conversation
+	SharesConversation(ctx context.Context, userID, peerID uuid.UUID) (bool, error)
+}
+
+// ParseUsername returns the user ID of an MQTT username, which is the user ID
+// optionally prefixed with "user_"
+func ParseUsername(username string) (uuid.UUID, bool) {
+	userID, err := uuid.Parse(strings.TrimPrefix(username, "user_"))
+	return userID, err == nil
+}
+
+// Check decides whether a user may publish or subscribe to an MQTT topic. It backs
+// the broker's authorization plugin, so anything it can't parse is denied.
+//
+//	chat/{conversationID}/...       participants of the conversation may subscribe
+//	chat/{conversationID}/reactions participants may publish; only the conversation's
+//	                                admins while it is locked
+//	chat/{conversationID}/typing/{userID}
+//	                                only the user may publish their typing; not
+//	                                while the conversation is locked, unless admin
+//	chat/{conversationID}/messages  subscribe only; clients send through chat-api,
+//	                                which publishes what it accepted
+//	chat/{conversationID}/receipts  subscribe only; the services announce receipt
+//	                                totals there
+//	chat/{conversationID}/receipts/{userID}
+//	                                only the user may publish their receipts, even
+//	                                while the conversation is locked
+//	notifications/{userID}/...      subscribe only, the user themselves
+//	users/{userID}/notifications    subscribe only, the user themselves
+//	users/{userID}/attachments      subscribe only, the user themselves
+//	users/{userID}/acks             subscribe only, the user themselves
+//	presence/{userID}/...           only the user may publish; the user and anyone
+//	                                sharing a conversation with them may subscribe
+func Check(ctx context.Context, conversations Conversations, userID uuid.UUID, topic string, access Access) (bool, error) {
+	if access != Publish && access != Subscribe {
+		return false, nil
+	}
+
+	parts := strings.Split(topic, "/")
+	if len(parts) < 2 {
+		return false, nil
+	}
+
+	// Wildcards in the ID segment would widen access past a single conversation or user
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return false, nil
+	}
+
+	switch parts[0] {
+	case "chat":
+		participant, locked, err := conversations.ConversationAccess(ctx, id, userID)
+		if err != nil || !participant {
+			return false, err
+		}
+		if access == Subscribe {
+			return true, nil
+		}
+		if len(parts) < 3 {
+			return false, nil
+		}
+		switch parts[2] {
+		case "reactions":
+			// Posting is what a lock stops
+			return len(parts) == 3 && !locked, nil
+		case "typing":
+			// Typing goes on the typist's own topic, so nobody can type as someone else
+			if len(parts) != 4 || locked {
+				return false, nil
+			}
+			typistID, err := uuid.Parse(parts[3])
+			return err == nil && typistID == userID, nil
+		case "receipts":
+			// Receipts go on the reader's own topic, so nobody can send them for someone
+			// else. They aren't posts, so they are still allowed while a conversation is
+			// locked.
+			if len(parts) != 4 {
+				return false, nil
+			}
+			readerID, err := uuid.Parse(parts[3])
+			return err == nil && readerID == userID, nil
+		}
+		// Everything else comes from the services only: messages, system messages, acks, enriched
+		// typing, receipt totals, settings and membership updates and key rotations. A client must not
+		// fake one, e.g. to show a typist under someone else's name.
+		return false, nil
+	case "notifications":
+		return access == Subscribe && id == userID, nil
+	case "users":
+		return access == Subscribe && id == userID && len(parts) == 3 &&
+			(parts[2] == "notifications" || parts[2] == "attachments" || parts[2] == "acks"), nil
+	case "presence":
+		if id == userID {
+			return true, nil
+		}
+		if access != Subscribe {
+			return false, nil
+		}
+		return conversations.SharesConversation(ctx, userID, id)
+	}
+
+	return false, nil
+}
@@ -0,0 +1,97 @@
+package mqttacl
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type fakeConversations struct {
+	participants map[uuid.UUID]bool
+	locked       bool
+	peers        map[uuid.UUID]bool
+}
+
+func (f fakeConversations) ConversationAccess(ctx context.Context, conversationID, userID uuid.UUID) (bool, bool, error) {
+	return f.participants[userID], f.locked, nil
+}
+
+func (f fakeConversations) SharesConversation(ctx context.Context, userID, peerID uuid.UUID) (bool, error) {
+	return f.peers[peerID], nil
+}
+
+func TestCheck(t *testing.T) {
+	conversationID := uuid.New()
+	userID, otherID, strangerID := uuid.New(), uuid.New(), uuid.New()
+	open := fakeConversations{
+		participants: map[uuid.UUID]bool{userID: true, otherID: true},
+		peers:        map[uuid.UUID]bool{otherID: true},
+	}
+	locked := open
+	locked.locked = true
+
+	chat := func(suffix string) string { return fmt.Sprintf("chat/%s/%s", conversationID, suffix) }
+
+	tests := []struct {
+		name          string
+		conversations fakeConversations
+		userID        uuid.UUID
+		topic         string
+		access        Access
+		want          bool
+	}{
+		{"nobody publishes messages", open, userID, chat("messages"), Publish, false},
+		{"participant subscribes to messages", open, userID, chat("messages"), Subscribe, true},
+		{"participant subscribes to the conversation", open, userID, chat("#"), Subscribe, true},
+		{"stranger subscribes to the conversation", open, strangerID, chat("#"), Subscribe, false},
+		{"nobody publishes acks", open, userID, chat("acks"), Publish, false},
+		{"own typing topic", open, userID, chat("typing/" + userID.String()), Publish, true},
+		{"someone else's typing topic", open, userID, chat("typing/" + otherID.String()), Publish, false},
+		{"nobody publishes to the bare typing topic", open, userID, chat("typing"), Publish, false},
+		{"nobody publishes enriched typing", open, userID, chat("typing/enriched"), Publish, false},
+		{"participant subscribes to enriched typing", open, userID, chat("typing/enriched"), Subscribe, true},
+		{"own receipts topic", open, userID, chat("receipts/" + userID.String()), Publish, true},
+		{"someone else's receipts topic", open, userID, chat("receipts/" + otherID.String()), Publish, false},
+		{"receipt announcements are server-only", open, userID, chat("receipts"), Publish, false},
+		{"receipt announcements can be subscribed to", open, userID, chat("receipts"), Subscribe, true},
+		{"receipts topic with a wildcard reader", open, userID, chat("receipts/+"), Publish, false},
+		{"stranger's own receipts topic", open, strangerID, chat("receipts/" + strangerID.String()), Publish, false},
+		{"locked conversation rejects typing", locked, userID, chat("typing/" + userID.String()), Publish, false},
+		{"locked conversation rejects reactions", locked, userID, chat("reactions"), Publish, false},
+		{"participant publishes a reaction", open, userID, chat("reactions"), Publish, true},
+		{"nobody publishes settings updates", open, userID, chat("updated"), Publish, false},
+		{"nobody publishes membership updates", open, userID, chat("participants"), Publish, false},
+		{"nobody publishes key rotations", open, userID, chat("keys"), Publish, false},
+		{"participant subscribes to key rotations", open, userID, chat("keys"), Subscribe, true},
+		{"nobody publishes to the bare conversation", open, userID, "chat/" + conversationID.String(), Publish, false},
+		{"locked conversation still takes receipts", locked, userID, chat("receipts/" + userID.String()), Publish, true},
+		{"wildcard conversation", open, userID, "chat/+/messages", Subscribe, false},
+		{"own notifications", open, userID, "users/" + userID.String() + "/notifications", Subscribe, true},
+		{"someone else's notifications", open, userID, "users/" + otherID.String() + "/notifications", Subscribe, false},
+		{"publish to own notifications", open, userID, "users/" + userID.String() + "/notifications", Publish, false},
+		{"own attachment status", open, userID, "users/" + userID.String() + "/attachments", Subscribe, true},
+		{"someone else's attachment status", open, userID, "users/" + otherID.String() + "/attachments", Subscribe, false},
+		{"publish to own attachment status", open, userID, "users/" + userID.String() + "/attachments", Publish, false},
+		{"attachment status under a numeric user ID", open, userID, "users/42/attachments", Subscribe, false},
+		{"own presence", open, userID, "presence/" + userID.String() + "/status", Publish, true},
+		{"peer's presence", open, userID, "presence/" + otherID.String() + "/status", Subscribe, true},
+		{"publish peer's presence", open, userID, "presence/" + otherID.String() + "/status", Publish, false},
+		{"stranger's presence", open, userID, "presence/" + strangerID.String() + "/status", Subscribe, false},
+		{"unknown access", open, userID, chat("typing"), "delete", false},
+		{"unknown topic", open, userID, "admin/" + userID.String(), Subscribe, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Check(context.Background(), tt.conversations, tt.userID, tt.topic, tt.access)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Check(%s, %s) = %v, want %v", tt.topic, tt.access, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MediaType is the Accept profile of the paginated envelope, the default shape
+	MediaType = "application/vnd.orbit.paginated+json"
+	// BareMediaType asks for the deprecated bare JSON array instead of the envelope
+	BareMediaType = "application/vnd.orbit.bare+json"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page describes where a list response sits in the full result set. Total is only
+// computed when the client asks for it with ?include_total=true.
+type Page struct {
+	Limit int `json:"limit"`
+	// Offset is how far into the full result set this page starts
+	Offset     int    `json:"offset"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+	Total      *int   `json:"total,omitempty"`
+}
+
+// Envelope wraps a list response with its pagination metadata
+type Envelope struct {
+	Data       interface{} `json:"data"`
+	Pagination Page        `json:"pagination"`
+}
+
+// Params are the paging parameters of a list request
+type Params struct {
+	// Limit of 0 means unbounded, only used for legacy bare-array requests
+	Limit        int
+	Offset       int
+	IncludeTotal bool
+}
+
+// Parse reads limit, cursor (or the older offset) and include_total from the query.
+// Out of range limits fall back to defaultLimit.
+func Parse(r *http.Request, defaultLimit, maxLimit int) (Params, error) {
+	query := r.URL.Query()
+	p := Params{Limit: defaultLimit, IncludeTotal: query.Get("include_total") == "true"}
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= maxLimit {
+			p.Limit = l
+		}
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		offset, err := decodeCursor(cursor)
+		if err != nil {
+			return p, err
+		}
+		p.Offset = offset
+	} else if offsetStr := query.Get("offset"); offsetStr != "" {
+		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+			p.Offset = o
+		}
+	}
+
+	return p, nil
+}
+
+// Bare reports whether the client asked for the deprecated bare array, with
+// ?envelope=false or by accepting BareMediaType
+func Bare(r *http.Request) bool {
+	if r.URL.Query().Get("envelope") == "false" {
+		return true
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		if strings.Contains(accept, BareMediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch is how many items to load for p: one past the limit, so New can tell
+// whether there are more without a count query
+func (p Params) Fetch() int {
+	if p.Limit == 0 {
+		return 0
+	}
+	return p.Limit + 1
+}
+
+// New builds an envelope from up to p.Fetch() items loaded at p.Offset
+func New[T any](items []T, p Params) *Envelope {
+	if items == nil {
+		items = []T{}
+	}
+
+	page := Page{Limit: p.Limit, Offset: p.Offset}
+	if p.Limit > 0 && len(items) > p.Limit {
+		items = items[:p.Limit]
+		page.HasMore = true
+		page.NextCursor = encodeCursor(p.Offset + p.Limit)
+	}
+
+	return &Envelope{Data: items, Pagination: page}
+}
+
+// Slice pages a list that is already fully loaded in memory, for small bounded lists
+func Slice[T any](items []T, p Params) []T {
+	if p.Offset >= len(items) {
+		return nil
+	}
+	items = items[p.Offset:]
+	if p.Limit > 0 && len(items) > p.Fetch() {
+		items = items[:p.Fetch()]
+	}
+	return items
+}
+
+// SetTotal records the size of the full result set
+func (e *Envelope) SetTotal(total int) {
+	e.Pagination.Total = &total
+}
+
+// Body is what to write for r: the envelope, or just the data for bare requests
+func (e *Envelope) Body(r *http.Request) interface{} {
+	if Bare(r) {
+		return e.Data
+	}
+	return e
+}
+
+// CursorAt returns a cursor for a page starting offset items into the list
+func CursorAt(offset int) string {
+	return encodeCursor(offset)
+}
+
+// Cursors are opaque to clients; today they encode the offset of the next page
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("o:" + strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), "o:") {
+		return 0, ErrInvalidCursor
+	}
+	offset, err := strconv.Atoi(strings.TrimPrefix(string(raw), "o:"))
+	if err != nil || offset < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return offset, nil
+}
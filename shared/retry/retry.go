@@ -0,0 +1,128 @@
+package retry
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Config controls how many times a write is attempted and how long to wait between attempts
+type Config struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// OnRetry, if set, is called with the error of each attempt that is about to be retried
+	OnRetry func(err error)
+}
+
+// DefaultConfig returns the retry settings used when nothing is configured
+func DefaultConfig() Config {
+	return Config{
+		MaxAttempts:    3,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+}
+
+// Do runs fn until it succeeds, returns a non-retriable error, runs out of attempts
+// or the context is cancelled. Only wrap idempotent operations with it.
+func Do(ctx context.Context, cfg Config, fn func(ctx context.Context) error) error {
+	attempts := cfg.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+
+		if attempt == attempts || !IsRetriable(err) {
+			return err
+		}
+		if cfg.OnRetry != nil {
+			cfg.OnRetry(err)
+		}
+
+		timer := time.NewTimer(backoff(cfg, attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+
+	return err
+}
+
+// IsRetriable reports whether err is a transient database failure worth retrying.
+// Constraint violations and other data errors are never retried.
+func IsRetriable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"53300", // too_many_connections
+			"57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03": // cannot_connect_now
+			return true
+		}
+		// Class 08 - connection exceptions
+		return strings.HasPrefix(string(pqErr.Code), "08")
+	}
+
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	// Of the other network errors only timeouts and failed dials are transient; bad
+	// addresses and unknown hosts won't fix themselves
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		var dnsErr *net.DNSError
+		return !errors.As(opErr.Err, &dnsErr) || !dnsErr.IsNotFound
+	}
+	return false
+}
+
+// backoff returns the exponential delay for the given attempt with full jitter
+func backoff(cfg Config, attempt int) time.Duration {
+	delay := cfg.InitialBackoff
+	if delay <= 0 {
+		return 0
+	}
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if cfg.MaxBackoff > 0 && delay >= cfg.MaxBackoff {
+			delay = cfg.MaxBackoff
+			break
+		}
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
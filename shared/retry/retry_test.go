@@ -0,0 +1,160 @@
+package retry
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestIsRetriable(t *testing.T) {
+	dial := func(err error) error { return &net.OpError{Op: "dial", Net: "tcp", Err: err} }
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"no error", nil, false},
+		{"unique violation", &pq.Error{Code: "23505"}, false},
+		{"foreign key violation", &pq.Error{Code: "23503"}, false},
+		{"serialization failure", &pq.Error{Code: "40001"}, true},
+		{"deadlock", &pq.Error{Code: "40P01"}, true},
+		{"connection failure", &pq.Error{Code: "08006"}, true},
+		{"connection does not exist", &pq.Error{Code: "08003"}, true},
+		{"too many connections", &pq.Error{Code: "53300"}, true},
+		{"wrapped serialization failure", fmt.Errorf("update: %w", &pq.Error{Code: "40001"}), true},
+		{"context cancelled", context.Canceled, false},
+		{"deadline exceeded", context.DeadlineExceeded, false},
+		{"wrapped cancellation", fmt.Errorf("query: %w", context.Canceled), false},
+		{"bad connection", driver.ErrBadConn, true},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"connection reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{"connection refused", dial(os.NewSyscallError("connect", syscall.ECONNREFUSED)), true},
+		{"read timeout", &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, true},
+		{"unreachable host", dial(os.NewSyscallError("connect", syscall.EHOSTUNREACH)), true},
+		{"unknown host", dial(&net.DNSError{Err: "no such host", Name: "db", IsNotFound: true}), false},
+		{"invalid address", &net.AddrError{Err: "missing port in address", Addr: "db"}, false},
+		{"closed connection", &net.OpError{Op: "write", Net: "tcp", Err: net.ErrClosed}, false},
+		{"plain error", errors.New("boom"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetriable(tt.err); got != tt.want {
+				t.Errorf("IsRetriable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoAttempts(t *testing.T) {
+	transient := &pq.Error{Code: "40001"}
+	permanent := &pq.Error{Code: "23505"}
+
+	tests := []struct {
+		name         string
+		maxAttempts  int
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"succeeds first time", 3, nil, 1, nil},
+		{"succeeds after a transient error", 3, []error{transient}, 2, nil},
+		{"gives up after the last attempt", 3, []error{transient, transient, transient, transient}, 3, transient},
+		{"doesn't retry a permanent error", 3, []error{permanent}, 1, permanent},
+		{"permanent error after a transient one", 3, []error{transient, permanent}, 2, permanent},
+		{"at least one attempt", 0, []error{transient}, 1, transient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts, retried := 0, 0
+			cfg := Config{MaxAttempts: tt.maxAttempts, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond,
+				OnRetry: func(error) { retried++ }}
+
+			err := Do(context.Background(), cfg, func(ctx context.Context) error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("got %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if retried != attempts-1 {
+				t.Errorf("OnRetry called %d times for %d attempts", retried, attempts)
+			}
+		})
+	}
+}
+
+func TestDoCancelledDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transient := &pq.Error{Code: "40001"}
+
+	attempts := 0
+	// The backoff would outlast the test, so Do only returns in time if it notices the cancellation
+	cfg := Config{MaxAttempts: 3, InitialBackoff: time.Hour, MaxBackoff: time.Hour, OnRetry: func(error) { cancel() }}
+	done := make(chan error, 1)
+	go func() {
+		done <- Do(ctx, cfg, func(ctx context.Context) error {
+			attempts++
+			return transient
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != transient {
+			t.Errorf("got error %v, want the last attempt's %v", err, transient)
+		}
+		if attempts != 1 {
+			t.Errorf("got %d attempts, want 1", attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Do kept waiting after the context was cancelled")
+	}
+}
+
+func TestBackoffBounds(t *testing.T) {
+	cfg := Config{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{4, 50 * time.Millisecond},
+		{10, 50 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("attempt %d", tt.attempt), func(t *testing.T) {
+			for i := 0; i < 1000; i++ {
+				if delay := backoff(cfg, tt.attempt); delay < 0 || delay > tt.max {
+					t.Fatalf("got backoff %v, want between 0 and %v", delay, tt.max)
+				}
+			}
+		})
+	}
+
+	if delay := backoff(Config{}, 3); delay != 0 {
+		t.Errorf("got backoff %v without an initial backoff, want none", delay)
+	}
+}